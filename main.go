@@ -49,7 +49,7 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	configFile := flag.String("config", "", "The config file name.")
+	configFile := flag.String("config", "", "The config file name, or the URL of a key in etcd or Consul KV, e.g. etcd://127.0.0.1:2379/tlsproxy/config or consul://127.0.0.1:8500/tlsproxy/config.")
 	versionFlag := flag.Bool("v", false, "Show the version.")
 	revokeFlag := flag.String("revoke-all-certificates", "", "Revoke all cached certificates. The value is the revocation code: unspecified, keyCompromise, superseded, or cessationOfOperation")
 	passphraseFlag := flag.String("passphrase", os.Getenv("TLSPROXY_PASSPHRASE"), "The passphrase to encrypt the TLS keys on disk.")
@@ -64,13 +64,19 @@ func main() {
 		return
 	}
 	if *stdoutFlag {
-		log.SetOutput(os.Stdout)
+		proxy.SetLogOutput(os.Stdout)
 	}
 	if *configFile == "" {
 		log.Fatal("--config must be set")
 	}
 	log.Printf("INF tlsproxy %s %s %s/%s", Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
-	cfg, err := proxy.ReadConfig(*configFile)
+	var cfg *proxy.Config
+	var err error
+	if proxy.IsRemoteConfig(*configFile) {
+		cfg, err = proxy.ReadRemoteConfig(ctx, *configFile)
+	} else {
+		cfg, err = proxy.ReadConfig(*configFile)
+	}
 	if err != nil {
 		log.Fatalf("ERR %v", err)
 	}
@@ -100,7 +106,7 @@ func main() {
 		log.Fatal(err)
 	}
 	if *quietFlag {
-		log.SetOutput(io.Discard)
+		proxy.SetLogOutput(io.Discard)
 	}
 	go configLoop(ctx, p, *configFile)
 
@@ -127,6 +133,17 @@ func main() {
 }
 
 func configLoop(ctx context.Context, p *proxy.Proxy, file string) {
+	if proxy.IsRemoteConfig(file) {
+		err := proxy.WatchRemoteConfig(ctx, file, func(cfg *proxy.Config) {
+			if err := p.Reconfigure(cfg); err != nil {
+				log.Printf("ERR %v", err)
+			}
+		})
+		if err != nil {
+			log.Printf("ERR %v", err)
+		}
+		return
+	}
 	for {
 		select {
 		case <-ctx.Done():
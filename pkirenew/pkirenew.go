@@ -0,0 +1,202 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package pkirenew is a client for the certificate renewal API of the tlsproxy
+// PKI. It lets the holder of a certificate issued by a tlsproxy PKI get a new
+// certificate before the current one expires, e.g.
+//
+//	c := &pkirenew.Client{Endpoint: "https://pki.example.com/renew"}
+//	renewed, err := c.RenewFiles(ctx, "cert.pem", "key.pem")
+package pkirenew
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Client renews certificates issued by a tlsproxy PKI.
+type Client struct {
+	// Endpoint is the URL of the renewal API, e.g.
+	// https://pki.example.com/renew
+	Endpoint string
+	// RootCAs is used to verify the server's certificate. When nil, the
+	// system's root CAs are used.
+	RootCAs *x509.CertPool
+	// RenewBefore is how long before expiration the certificates should
+	// be renewed. The default is one third of the certificate's lifetime.
+	// It should match the server's configuration.
+	RenewBefore time.Duration
+	// KeepKey indicates that the renewed certificate should use the same
+	// private key as the current one. By default, a new key of the same
+	// type is generated.
+	KeepKey bool
+}
+
+// NeedsRenewal returns true if cert expires in less than renewBefore. When
+// renewBefore is zero, it returns true if less than one third of the
+// certificate's lifetime remains.
+func NeedsRenewal(cert *x509.Certificate, renewBefore time.Duration) bool {
+	if renewBefore <= 0 {
+		renewBefore = cert.NotAfter.Sub(cert.NotBefore) / 3
+	}
+	return !time.Now().Before(cert.NotAfter.Add(-renewBefore))
+}
+
+// Renew gets a new certificate from the server, authenticating with cert.
+func (c *Client) Renew(ctx context.Context, cert tls.Certificate) (tls.Certificate, error) {
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, errors.New("no certificate")
+	}
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return tls.Certificate{}, errors.New("unsupported private key")
+	}
+	if !c.KeepKey {
+		var err error
+		if key, err = newKeyLike(key); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("x509.CreateCertificateRequest: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint, bytes.NewReader(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	req.Header.Set("content-type", "application/x-pem-file")
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      c.RootCAs,
+				Certificates: []tls.Certificate{cert},
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 102400))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return tls.Certificate{}, fmt.Errorf("renewal failed: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	block, _ := pem.Decode(body)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return tls.Certificate{}, errors.New("invalid response")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("x509.ParseCertificate: %w", err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// RenewFiles renews the certificate in certFile if it needs to be renewed,
+// and saves the new certificate and key in certFile and keyFile. It returns
+// true if the certificate was renewed.
+func (c *Client) RenewFiles(ctx context.Context, certFile, keyFile string) (bool, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return false, err
+	}
+	if !NeedsRenewal(cert.Leaf, c.RenewBefore) {
+		return false, nil
+	}
+	renewed, err := c.Renew(ctx, cert)
+	if err != nil {
+		return false, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(renewed.PrivateKey)
+	if err != nil {
+		return false, fmt.Errorf("x509.MarshalPKCS8PrivateKey: %w", err)
+	}
+	if err := writeFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return false, err
+	}
+	if err := writeFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: renewed.Leaf.Raw}), 0o644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func newKeyLike(key crypto.Signer) (crypto.Signer, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		return ecdsa.GenerateKey(k.Curve, rand.Reader)
+	case *rsa.PrivateKey:
+		return rsa.GenerateKey(rand.Reader, k.N.BitLen())
+	case ed25519.PrivateKey:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+func writeFile(name string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
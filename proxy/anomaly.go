@@ -0,0 +1,231 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	anomalyConnectionRate = "connection rate"
+	anomalyByteRate       = "byte rate"
+)
+
+// anomalyDetector contains the traffic baselines of the backends. It is not
+// affected by configuration changes.
+type anomalyDetector struct {
+	mu        sync.Mutex
+	baselines map[string]*trafficBaseline
+}
+
+// trafficBaseline is the baseline of one rate of one backend.
+type trafficBaseline struct {
+	samples   int
+	avg       float64
+	anomalous bool
+	seen      bool
+}
+
+// anomalyAlert is sent to the webhooks when an anomaly starts or ends.
+type anomalyAlert struct {
+	Time     time.Time `json:"time"`
+	Backend  string    `json:"backend"`
+	Metric   string    `json:"metric"`
+	Rate     float64   `json:"rate"`
+	Baseline float64   `json:"baseline"`
+	State    string    `json:"state"`
+}
+
+// update adds a new measurement to the baseline. It returns the state of the
+// anomaly when it changes, i.e. "spike", "drop", or "normal".
+func (b *trafficBaseline) update(cfg *ConfigAnomalyDetection, rate, minRate float64) (state string) {
+	warm := b.samples >= int(cfg.BaselineWindow/cfg.Interval/10)
+	var anomalous bool
+	if warm {
+		switch {
+		case rate >= minRate && rate > b.avg*cfg.Factor:
+			anomalous, state = true, "spike"
+		case b.avg >= minRate && rate < b.avg/cfg.Factor:
+			anomalous, state = true, "drop"
+		}
+	}
+	if anomalous == b.anomalous {
+		state = ""
+	} else if !anomalous {
+		state = "normal"
+	}
+	b.anomalous = anomalous
+	if anomalous {
+		return state
+	}
+	if b.samples == 0 {
+		b.avg = rate
+	} else {
+		alpha := float64(cfg.Interval) / float64(cfg.BaselineWindow)
+		b.avg += alpha * (rate - b.avg)
+	}
+	b.samples++
+	return state
+}
+
+// check updates the baselines of a backend, and returns the alerts for the
+// anomalies that started or ended.
+func (d *anomalyDetector) check(cfg *ConfigAnomalyDetection, backend string, connRate, byteRate float64, now time.Time) []anomalyAlert {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.baselines == nil {
+		d.baselines = make(map[string]*trafficBaseline)
+	}
+	var alerts []anomalyAlert
+	for _, m := range []struct {
+		metric  string
+		rate    float64
+		minRate float64
+	}{
+		{anomalyConnectionRate, connRate, cfg.MinConnectionRate},
+		{anomalyByteRate, byteRate, cfg.MinByteRate},
+	} {
+		key := backend + " " + m.metric
+		b := d.baselines[key]
+		if b == nil {
+			b = &trafficBaseline{}
+			d.baselines[key] = b
+		}
+		b.seen = true
+		if state := b.update(cfg, m.rate, m.minRate); state != "" {
+			alerts = append(alerts, anomalyAlert{
+				Time:     now.UTC(),
+				Backend:  backend,
+				Metric:   m.metric,
+				Rate:     m.rate,
+				Baseline: b.avg,
+				State:    state,
+			})
+		}
+	}
+	return alerts
+}
+
+// prune removes the baselines that were not checked since the last call.
+func (d *anomalyDetector) prune() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for k, b := range d.baselines {
+		if !b.seen {
+			delete(d.baselines, k)
+			continue
+		}
+		b.seen = false
+	}
+}
+
+// anomalyLoop periodically measures the traffic rates of the backends, and
+// raises events and calls webhooks when they deviate from their baseline.
+func (p *Proxy) anomalyLoop(ctx context.Context) {
+	for {
+		p.mu.RLock()
+		var interval time.Duration
+		if p.cfg != nil && p.cfg.AnomalyDetection != nil {
+			interval = p.cfg.AnomalyDetection.Interval
+		}
+		p.mu.RUnlock()
+		if interval == 0 {
+			interval = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		p.checkAnomalies(ctx, time.Now())
+	}
+}
+
+func (p *Proxy) checkAnomalies(ctx context.Context, now time.Time) {
+	type rates struct {
+		id       string
+		connRate float64
+		byteRate float64
+	}
+	p.mu.RLock()
+	cfg := p.cfg.AnomalyDetection
+	var all []rates
+	if cfg != nil {
+		period := min(cfg.Interval, time.Minute)
+		for _, be := range p.cfg.Backends {
+			if be.Mode == ModeConsole {
+				continue
+			}
+			r := rates{id: be.maintenanceID()}
+			for _, sn := range be.ServerNames {
+				m := p.metrics[sn]
+				if m == nil {
+					continue
+				}
+				r.connRate += m.numConnections.Rate(period)
+				r.byteRate += m.numBytesSent.Rate(period) + m.numBytesReceived.Rate(period)
+			}
+			all = append(all, r)
+		}
+	}
+	p.mu.RUnlock()
+	if cfg == nil {
+		p.anomalies.prune()
+		return
+	}
+
+	var alerts []anomalyAlert
+	for _, r := range all {
+		alerts = append(alerts, p.anomalies.check(cfg, r.id, r.connRate, r.byteRate, now)...)
+	}
+	p.anomalies.prune()
+	p.raiseAnomalyAlerts(ctx, cfg, alerts)
+}
+
+// raiseAnomalyAlerts records the anomalies that started or ended, and sends
+// them to the webhooks.
+func (p *Proxy) raiseAnomalyAlerts(ctx context.Context, cfg *ConfigAnomalyDetection, alerts []anomalyAlert) {
+	for _, a := range alerts {
+		if a.State == "normal" {
+			p.recordBackendEvent(a.Backend, fmt.Sprintf("anomaly: %s back to normal", a.Metric))
+			p.logErrorF("INF Anomaly: %s of %q back to normal (%.1f/s, baseline %.1f/s)", a.Metric, a.Backend, a.Rate, a.Baseline)
+		} else {
+			p.recordBackendEvent(a.Backend, fmt.Sprintf("anomaly: %s %s", a.Metric, a.State))
+			p.logErrorF("WRN Anomaly: %s %s on %q (%.1f/s, baseline %.1f/s)", a.Metric, a.State, a.Backend, a.Rate, a.Baseline)
+		}
+		if len(cfg.WebHooks) == 0 {
+			continue
+		}
+		body, err := json.Marshal(a)
+		if err != nil {
+			p.logErrorF("ERR Anomaly: %v", err)
+			continue
+		}
+		go p.callWebHooks(ctx, "Anomaly", cfg.WebHooks, body)
+	}
+}
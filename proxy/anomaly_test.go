@@ -0,0 +1,118 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAnomalyDetector(t *testing.T) {
+	cfg := &ConfigAnomalyDetection{
+		Interval:          time.Minute,
+		BaselineWindow:    30 * time.Minute,
+		Factor:            3,
+		MinConnectionRate: 1,
+		MinByteRate:       1000,
+	}
+	var d anomalyDetector
+	now := time.Now()
+	check := func(connRate float64) []string {
+		var out []string
+		for _, a := range d.check(cfg, "be", connRate, 10000, now) {
+			out = append(out, a.Metric+" "+a.State)
+		}
+		return out
+	}
+	// Warm up. No anomalies are reported until there are 3 samples.
+	for i, rate := range []float64{10, 100, 10} {
+		if got := check(rate); got != nil {
+			t.Errorf("warmup[%d]: got %q", i, got)
+		}
+	}
+	for _, tc := range []struct {
+		rate float64
+		want []string
+	}{
+		{12, nil},
+		{100, []string{"connection rate spike"}},
+		{200, nil},
+		{10, []string{"connection rate normal"}},
+		{1, []string{"connection rate drop"}},
+		{9, []string{"connection rate normal"}},
+	} {
+		if got := check(tc.rate); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("check(%v) = %q, want %q", tc.rate, got, tc.want)
+		}
+	}
+	// A spike below the minimum rate is not an anomaly.
+	d = anomalyDetector{}
+	for range 5 {
+		check(0.1)
+	}
+	if got := check(0.9); got != nil {
+		t.Errorf("check(0.9) = %q, want nil", got)
+	}
+}
+
+func TestRaiseAnomalyAlerts(t *testing.T) {
+	alerts := make(chan anomalyAlert, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var a anomalyAlert
+		if err := json.NewDecoder(req.Body).Decode(&a); err != nil {
+			t.Errorf("Decode: %v", err)
+		}
+		alerts <- a
+	}))
+	defer srv.Close()
+
+	cfg := &ConfigAnomalyDetection{
+		Interval:          time.Minute,
+		BaselineWindow:    10 * time.Minute,
+		Factor:            3,
+		MinConnectionRate: 1,
+		MinByteRate:       1e9,
+		WebHooks:          []string{srv.URL},
+	}
+	p := &Proxy{}
+	p.anomalies.check(cfg, "www", 10, 0, time.Now())
+	p.raiseAnomalyAlerts(context.Background(), cfg, p.anomalies.check(cfg, "www", 100, 0, time.Now()))
+
+	select {
+	case a := <-alerts:
+		if a.Backend != "www" || a.Metric != anomalyConnectionRate || a.State != "spike" {
+			t.Errorf("Unexpected alert %+v", a)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("webhook not called")
+	}
+	if got, want := p.events["anomaly: connection rate spike"], int64(1); got != want {
+		t.Errorf("spike events = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,133 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/net/http/httpguts"
+)
+
+const defaultAPIKeyHeader = "X-API-Key"
+
+func (ak *APIKeys) check() error {
+	if ak.Header == "" {
+		ak.Header = defaultAPIKeyHeader
+	}
+	if !httpguts.ValidHeaderFieldName(ak.Header) {
+		return fmt.Errorf("Header: invalid header name %q", ak.Header)
+	}
+	ak.identities = make(map[[32]byte]string)
+	add := func(key, identity string) error {
+		if key == "" || identity == "" {
+			return errors.New("the key and the identity must not be empty")
+		}
+		h := sha256.Sum256([]byte(key))
+		if _, exists := ak.identities[h]; exists {
+			return errors.New("duplicate key")
+		}
+		ak.identities[h] = identity
+		return nil
+	}
+	for i, k := range ak.Keys {
+		if err := add(k.Key, k.Identity); err != nil {
+			return fmt.Errorf("Keys[%d]: %w", i, err)
+		}
+	}
+	if ak.File == "" {
+		return nil
+	}
+	b, err := os.ReadFile(ak.File)
+	if err != nil {
+		return fmt.Errorf("File: %w", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("File: line %d: want \"<identity> <key>\"", n)
+		}
+		if err := add(fields[1], fields[0]); err != nil {
+			return fmt.Errorf("File: line %d: %w", n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// apiKey returns the API key sent with the request, if any. The key is
+// removed from the request so that it isn't forwarded to the backend.
+func (ak *APIKeys) apiKey(req *http.Request) (string, bool) {
+	if key := req.Header.Get(ak.Header); key != "" {
+		req.Header.Del(ak.Header)
+		return key, true
+	}
+	if ak.QueryParam == "" {
+		return "", false
+	}
+	q := req.URL.Query()
+	if key := q.Get(ak.QueryParam); key != "" {
+		q.Del(ak.QueryParam)
+		req.URL.RawQuery = q.Encode()
+		if req.RequestURI != "" {
+			// RequestURI is logged.
+			req.RequestURI = req.URL.RequestURI()
+		}
+		return key, true
+	}
+	return "", false
+}
+
+// checkAPIKey returns the claims of the identity mapped to the API key. The
+// identity is used as the email address so that it can be used in the ACL.
+func (be *Backend) checkAPIKey(w http.ResponseWriter, req *http.Request, sso *BackendSSO, key string) (jwt.MapClaims, bool) {
+	identity, ok := sso.APIKeys.identities[sha256.Sum256([]byte(key))]
+	if !ok {
+		be.recordEvent("invalid api key")
+		be.logHTTPRequest("REQ", req, req.URL.Path, http.StatusUnauthorized, " (SSO)")
+		http.Error(w, "invalid api key", http.StatusUnauthorized)
+		return nil, false
+	}
+	hh := sha256.Sum256([]byte(req.Host))
+	return jwt.MapClaims{
+		"email":  identity,
+		"sub":    identity,
+		"apikey": true,
+		"iat":    float64(time.Now().Unix()),
+		"hhash":  hex.EncodeToString(hh[:]),
+	}, true
+}
@@ -0,0 +1,120 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+func TestAPIKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(file, []byte("# API keys\n\nreports-job  key-2\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	proxy := newBackendSSOTestProxy(t)
+	be := proxy.cfg.Backends[0]
+	be.SSO.GenerateIDTokens = false
+	be.SSO.APIKeys = &APIKeys{
+		QueryParam: "key",
+		Keys:       []APIKey{{Key: "key-1", Identity: "billing-service"}},
+		File:       file,
+	}
+	if err := be.SSO.APIKeys.check(); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+
+	for _, tc := range []struct {
+		url      string
+		header   string
+		want     int
+		identity string
+	}{
+		{url: "/", header: "key-1", want: http.StatusOK, identity: "billing-service"},
+		{url: "/?key=key-2&x=y", want: http.StatusOK, identity: "reports-job"},
+		{url: "/", header: "key-3", want: http.StatusUnauthorized},
+		{url: "/?key=key-3", want: http.StatusUnauthorized},
+		{url: "/", want: http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "https://example.com"+tc.url, nil)
+		if tc.header != "" {
+			req.Header.Set("X-API-Key", tc.header)
+		}
+		w := httptest.NewRecorder()
+		ok := be.authenticateUser(w, &req)
+		if got, want := ok, tc.want == http.StatusOK; got != want {
+			t.Errorf("%s %q: authenticateUser() = %v, want %v", tc.url, tc.header, got, want)
+		}
+		if !ok {
+			if got := w.Code; got != tc.want {
+				t.Errorf("%s %q: Code = %d, want %d", tc.url, tc.header, got, tc.want)
+			}
+			continue
+		}
+		var identity string
+		if c := claimsFromCtx(req.Context()); c != nil {
+			identity, _ = c["email"].(string)
+		}
+		if identity != tc.identity {
+			t.Errorf("%s %q: identity = %q, want %q", tc.url, tc.header, identity, tc.identity)
+		}
+		if req.Header.Get("X-API-Key") != "" || req.URL.Query().Has("key") {
+			t.Errorf("%s %q: API key forwarded: %v", tc.url, tc.header, req.URL)
+		}
+	}
+
+	// The key isn't logged when the request is denied.
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+	be.SSO.ACL = &[]string{"nobody@example.com"}
+	conn := netw.NewConnForTest(testConn{})
+	conn.SetAnnotation(serverNameKey, "example.com")
+	req := httptest.NewRequest("GET", "https://example.com/report?key=key-2&x=y", nil)
+	req = req.WithContext(context.WithValue(req.Context(), connCtxKey, conn))
+	if !be.authenticateUser(httptest.NewRecorder(), &req) {
+		t.Fatal("authenticateUser() = false, want true")
+	}
+	if be.enforceSSOPolicy(httptest.NewRecorder(), req) {
+		t.Error("enforceSSOPolicy() = true, want false")
+	}
+	be.SSO.ACL = nil
+	if logs := buf.String(); strings.Contains(logs, "key-2") || !strings.Contains(logs, "/report?x=y") {
+		t.Errorf("Logs = %q, want /report?x=y without the API key", logs)
+	}
+
+	be.SSO.APIKeys.Keys = append(be.SSO.APIKeys.Keys, APIKey{Key: "key-2", Identity: "other"})
+	if err := be.SSO.APIKeys.check(); err == nil {
+		t.Error("check() with duplicate key succeeded")
+	}
+}
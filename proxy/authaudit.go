@@ -0,0 +1,207 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/cookiemanager"
+)
+
+const (
+	authAuditLogFile = "auth-audit.log"
+
+	authResultSuccess = "success"
+	authResultFailure = "failure"
+)
+
+// authAuditRecord is a login attempt saved in the authentication audit log.
+type authAuditRecord struct {
+	Time     time.Time `json:"time"`
+	Provider string    `json:"provider"`
+	Identity string    `json:"identity,omitempty"`
+	SourceIP string    `json:"sourceIp"`
+	Result   string    `json:"result"`
+	Status   int       `json:"status"`
+	Backend  string    `json:"backend,omitempty"`
+}
+
+// authAuditFilter selects records from the authentication audit log.
+type authAuditFilter struct {
+	provider string
+	identity string
+	result   string
+	since    time.Time
+	until    time.Time
+}
+
+func (f authAuditFilter) match(r authAuditRecord) bool {
+	if f.provider != "" && r.Provider != f.provider {
+		return false
+	}
+	if f.identity != "" && r.Identity != f.identity {
+		return false
+	}
+	if f.result != "" && r.Result != f.result {
+		return false
+	}
+	if !f.since.IsZero() && r.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !r.Time.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+// updateAuthAuditLog opens or closes the authentication audit log to match
+// cfg.
+func (p *Proxy) updateAuthAuditLog(cfg *ConfigAuthAuditLog, cacheDir string) {
+	p.eventsmu.Lock()
+	defer p.eventsmu.Unlock()
+	if cfg == nil {
+		p.updateLog(&p.authAudit, "Auth audit log", "", 0)
+		return
+	}
+	p.updateLog(&p.authAudit, "Auth audit log", filepath.Join(cacheDir, authAuditLogFile), cfg.MaxSize)
+}
+
+// auditResponseWriter captures the response of an identity provider's
+// callback when it is sent.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+}
+
+func (w *auditResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// auditLogin records the result of a request to an identity provider's
+// callback in the authentication audit log. A response that sets the auth
+// token cookie is a successful login, and an error response is a failed
+// one. The other responses are intermediate steps, e.g. a redirect to the
+// second factor, and aren't recorded.
+func (p *Proxy) auditLogin(w *auditResponseWriter, req *http.Request, provider string, cm *cookiemanager.CookieManager) {
+	p.eventsmu.Lock()
+	l := p.authAudit
+	p.eventsmu.Unlock()
+	if l == nil {
+		return
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+		w.header = w.Header()
+	}
+	rec := authAuditRecord{
+		Time:     time.Now().UTC(),
+		Provider: provider,
+		SourceIP: req.RemoteAddr,
+		Status:   w.status,
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		rec.SourceIP = host
+	}
+	if claims, ok := cm.AuthTokenFromResponse(w.header); ok {
+		rec.Result = authResultSuccess
+		rec.Identity, _ = claims["email"].(string)
+		if u, err := url.Parse(w.header.Get("Location")); err == nil {
+			rec.Backend = u.Hostname()
+		}
+	} else if w.status >= http.StatusBadRequest {
+		rec.Result = authResultFailure
+		if req.PostForm != nil {
+			rec.Identity = req.PostForm.Get("username")
+		}
+	} else {
+		return
+	}
+	if err := l.add(rec); err != nil {
+		p.logErrorF("ERR Auth audit log: %v", err)
+	}
+}
+
+func (p *Proxy) authAuditHandler(w http.ResponseWriter, req *http.Request) {
+	p.eventsmu.Lock()
+	l := p.authAudit
+	p.eventsmu.Unlock()
+	if l == nil {
+		http.Error(w, "auth audit log is not enabled", http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	q := req.URL.Query()
+	filter := authAuditFilter{
+		provider: q.Get("provider"),
+		identity: q.Get("identity"),
+		result:   q.Get("result"),
+	}
+	var err error
+	if filter.since, err = parseEventTime(q.Get("since"), now); err != nil {
+		http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.until, err = parseEventTime(q.Get("until"), now); err != nil {
+		http.Error(w, "invalid until: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var buf bytes.Buffer
+	if err := l.scan(func(line []byte) {
+		var r authAuditRecord
+		if err := json.Unmarshal(line, &r); err != nil || !filter.match(r) {
+			return
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}); err != nil {
+		p.logErrorF("ERR Auth audit log: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.Header().Set("Content-Disposition", `attachment; filename="auth-audit.jsonl"`)
+	w.Write(buf.Bytes())
+}
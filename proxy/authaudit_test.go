@@ -0,0 +1,118 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/cookiemanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/tokenmanager"
+)
+
+func TestAuthAuditLog(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	tm, err := tokenmanager.New(storage.New(t.TempDir(), mk), nil, nil)
+	if err != nil {
+		t.Fatalf("tokenmanager.New: %v", err)
+	}
+	cm := cookiemanager.New(tm, "pw", "", "https://login.example.com/")
+
+	p := &Proxy{}
+	p.updateAuthAuditLog(&ConfigAuthAuditLog{}, t.TempDir())
+	defer p.updateAuthAuditLog(nil, "")
+
+	callback := func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		switch req.PostForm.Get("password") {
+		case "good":
+			cm.SetAuthTokenCookie(w, "bob", "bob@example.com", "sid", "app.example.com", nil)
+			http.Redirect(w, req, "https://app.example.com/", http.StatusSeeOther)
+		case "":
+			// Show the login form.
+		default:
+			http.Error(w, "invalid", http.StatusUnauthorized)
+		}
+	}
+	login := func(form url.Values) {
+		req := httptest.NewRequest(http.MethodPost, "https://login.example.com/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "10.1.2.3:1234"
+		aw := &auditResponseWriter{ResponseWriter: httptest.NewRecorder()}
+		callback(aw, req)
+		p.auditLogin(aw, req, "pw", cm)
+	}
+	login(url.Values{"username": {"alice"}, "password": {"bad"}})
+	login(url.Values{"username": {"bob"}})
+	login(url.Values{"username": {"bob"}, "password": {"good"}})
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		want  []string
+	}{
+		{"", 200, []string{"alice failure  401", "bob@example.com success app.example.com 303"}},
+		{"?result=success", 200, []string{"bob@example.com success app.example.com 303"}},
+		{"?identity=alice&since=1h", 200, []string{"alice failure  401"}},
+		{"?provider=other", 200, []string{}},
+		{"?until=1h", 200, []string{}},
+		{"?since=yesterday", 400, nil},
+	} {
+		w := httptest.NewRecorder()
+		p.authAuditHandler(w, httptest.NewRequest(http.MethodGet, "/auth-audit"+tc.query, nil))
+		if w.Code != tc.code {
+			t.Errorf("%q: code = %d, want %d", tc.query, w.Code, tc.code)
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		got := []string{}
+		dec := json.NewDecoder(w.Body)
+		for dec.More() {
+			var r authAuditRecord
+			if err := dec.Decode(&r); err != nil {
+				t.Fatalf("%q: %v", tc.query, err)
+			}
+			if r.SourceIP != "10.1.2.3" || r.Provider != "pw" {
+				t.Errorf("%q: unexpected record %+v", tc.query, r)
+			}
+			got = append(got, fmt.Sprintf("%s %s %s %d", r.Identity, r.Result, r.Backend, r.Status))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.query, got, tc.want)
+		}
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"fmt"
 	"net"
@@ -61,6 +62,7 @@ type ctxURLKeyType int
 var (
 	ctxURLKey        ctxURLKeyType = 1
 	ctxOverrideIDKey ctxURLKeyType = 2
+	ctxCanaryIDKey   ctxURLKeyType = 3
 
 	commaRE = regexp.MustCompile(`, *`)
 )
@@ -82,12 +84,24 @@ func (be *Backend) localHandler() http.Handler {
 				be.logPanic(req, r)
 			}
 		}()
+		if !be.checkRealClientIP(w, &req) {
+			return
+		}
+		if !be.checkMaintenance(w, req) {
+			return
+		}
+		if !be.checkEarlyData(w, req) {
+			return
+		}
 		if !be.authenticateUser(w, &req) {
 			return
 		}
 		if !be.handleLocalEndpointsAndAuthorize(w, req) {
 			return
 		}
+		if !be.checkIdentityRateLimit(w, req) {
+			return
+		}
 		be.serveStaticFiles(w, req, be.documentRoot, "")
 	})
 }
@@ -101,7 +115,7 @@ func (be *Backend) redirectPermanently(w http.ResponseWriter, req *http.Request,
 		Path:     path,
 		RawQuery: req.URL.RawQuery,
 	}
-	be.logRequestF("REQ %s ➔ %s %s ➔ status:%d (%q)", formatReqDesc(req), req.Method, req.URL.Path, code, userAgent(req))
+	be.logHTTPRequest("REQ", req, req.URL.Path, code, "")
 	http.Redirect(w, req, u.String(), code)
 }
 
@@ -121,7 +135,7 @@ func pathClean(p string) string {
 
 func (be *Backend) serveStaticFiles(w http.ResponseWriter, req *http.Request, docRoot *os.Root, prefix string) {
 	notFound := func() {
-		be.logRequestF("REQ %s ➔ %s %s ➔ status:%d (%q)", formatReqDesc(req), req.Method, req.URL, http.StatusNotFound, userAgent(req))
+		be.logHTTPRequest("REQ", req, req.URL.String(), http.StatusNotFound, "")
 		http.NotFound(w, req)
 	}
 
@@ -133,7 +147,7 @@ func (be *Backend) serveStaticFiles(w http.ResponseWriter, req *http.Request, do
 	switch req.Method {
 	case http.MethodGet, http.MethodHead:
 	default:
-		be.logRequestF("REQ %s ➔ %s %s ➔ status:%d (%q)", formatReqDesc(req), req.Method, req.URL.Path, http.StatusMethodNotAllowed, userAgent(req))
+		be.logHTTPRequest("REQ", req, req.URL.Path, http.StatusMethodNotAllowed, "")
 		w.Header().Set("Allow", "GET, HEAD")
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
@@ -165,7 +179,7 @@ func (be *Backend) serveStaticFiles(w http.ResponseWriter, req *http.Request, do
 		}
 		p = filepath.Join(p, "index.html")
 		if s, err := docRoot.Stat(p); err != nil || s.IsDir() {
-			be.logRequestF("REQ %s ➔ %s %s ➔ status:%d (%q)", formatReqDesc(req), req.Method, req.URL.Path, http.StatusForbidden, userAgent(req))
+			be.logHTTPRequest("REQ", req, req.URL.Path, http.StatusForbidden, "")
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
@@ -180,11 +194,11 @@ func (be *Backend) serveStaticFiles(w http.ResponseWriter, req *http.Request, do
 	}
 	defer f.Close()
 	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
-		be.logRequestF("REQ %s ➔ %s %s ➔ status:%d (%q)", formatReqDesc(req), req.Method, req.URL.Path, http.StatusForbidden, userAgent(req))
+		be.logHTTPRequest("REQ", req, req.URL.Path, http.StatusForbidden, "")
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
-	be.logRequestF("REQ %s ➔ %s %s ➔ status:%d (%q)", formatReqDesc(req), req.Method, req.URL.Path, http.StatusOK, userAgent(req))
+	be.logHTTPRequest("REQ", req, req.URL.Path, http.StatusOK, "")
 	be.setAltSvc(w.Header(), req)
 	http.ServeContent(w, req, p, fi.ModTime(), f)
 }
@@ -197,6 +211,12 @@ func (be *Backend) reverseProxy() http.Handler {
 		Transport:      be.reverseProxyTransport(),
 		ModifyResponse: be.reverseProxyModifyResponse,
 	}
+	if be.bufPool != nil {
+		reverseProxy.BufferPool = be.bufPool
+	}
+	if be.errorPageTemplate != nil {
+		reverseProxy.ErrorHandler = be.serveErrorPage
+	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		defer func() {
@@ -204,12 +224,28 @@ func (be *Backend) reverseProxy() http.Handler {
 				be.logPanic(req, r)
 			}
 		}()
+		if !be.checkRealClientIP(w, &req) {
+			return
+		}
+		if !be.checkMaintenance(w, req) {
+			return
+		}
+		if !be.checkEarlyData(w, req) {
+			return
+		}
 		if !be.authenticateUser(w, &req) {
 			return
 		}
 		if !be.handleLocalEndpointsAndAuthorize(w, req) {
 			return
 		}
+		if !be.checkIdentityRateLimit(w, req) {
+			return
+		}
+		w, ok := be.checkTrafficQuota(w, req)
+		if !ok {
+			return
+		}
 
 		// Verify that the HTTP request is directed at a server name
 		// that's configured for this backend. This prevents clients
@@ -229,7 +265,7 @@ func (be *Backend) reverseProxy() http.Handler {
 			req.URL.Scheme = "http"
 		}
 
-		if !slices.Contains(be.ServerNames, req.URL.Hostname()) {
+		if !be.hasServerName(req.URL.Hostname()) {
 			if req.Body != nil {
 				req.Body.Close()
 			}
@@ -237,6 +273,9 @@ func (be *Backend) reverseProxy() http.Handler {
 			return
 		}
 		ctx = context.WithValue(ctx, ctxURLKey, req.URL.String())
+		if !be.checkExtAuthz(w, req.WithContext(ctx)) {
+			return
+		}
 
 		// Apply the forward rate limit. The first request was already
 		// counted when the connection was established.
@@ -256,6 +295,7 @@ func (be *Backend) reverseProxy() http.Handler {
 		// other addresses.
 		override := ""
 		proxyProtoVersion := be.proxyProtocolVersion
+		proxyProtoTLVs := be.proxyProtocolTLVs
 		httpHeaders := be.ForwardHTTPHeaders
 		cleanPath := pathClean(req.URL.Path)
 		sanitizePath := be.SanitizePath == nil || *be.SanitizePath
@@ -282,10 +322,14 @@ func (be *Backend) reverseProxy() http.Handler {
 				ctx = context.WithValue(ctx, ctxOverrideIDKey, i)
 				override = fmt.Sprintf("%d", i)
 				proxyProtoVersion = po.proxyProtocolVersion
+				proxyProtoTLVs = po.proxyProtocolTLVs
 				break L
 			}
 		}
-		if len(be.Addresses) == 0 {
+		if i := be.canaryRoute(req); i >= 0 {
+			ctx = context.WithValue(ctx, ctxCanaryIDKey, i)
+			override += fmt.Sprintf(";canary%d", i)
+		} else if len(be.Addresses) == 0 && !be.usesDiscovery() && be.ReverseTunnel == nil {
 			be.serveStaticFiles(w, req, be.documentRoot, "")
 			return
 		}
@@ -293,7 +337,7 @@ func (be *Backend) reverseProxy() http.Handler {
 		hostKey := bytes.NewBufferString(serverName + ";" + override)
 		if proxyProtoVersion > 0 {
 			hostKey.WriteByte(';')
-			writeProxyHeader(proxyProtoVersion, hostKey, req.Context().Value(connCtxKey).(anyConn))
+			writeProxyHeader(proxyProtoVersion, proxyProtoTLVs, hostKey, req.Context().Value(connCtxKey).(anyConn))
 		}
 		h := sha256.Sum256(hostKey.Bytes())
 		req.URL.Host = hex.EncodeToString(h[:])
@@ -319,6 +363,9 @@ func (be *Backend) reverseProxy() http.Handler {
 		if sanitizePath {
 			req.URL.Path = cleanPath
 		}
+		if be.ForwardedHeaders != nil {
+			be.setForwardedHeaders(req)
+		}
 		for k, v := range httpHeaders {
 			v = expandVars(v, req)
 			if v != "" {
@@ -350,7 +397,14 @@ func (be *Backend) reverseProxy() http.Handler {
 			req.Body.Close()
 			req.Body = nil
 		}
-		reverseProxy.ServeHTTP(w, req.WithContext(ctx))
+		req = req.WithContext(ctx)
+		if !be.runRequestPlugins(w, req) {
+			return
+		}
+		if !be.inspectRequest(w, req) {
+			return
+		}
+		reverseProxy.ServeHTTP(w, req)
 	})
 }
 
@@ -389,6 +443,9 @@ func expandVars(s string, req *http.Request) string {
 					return fmt.Sprint(v)
 				}
 			}
+			if strings.HasPrefix(n, "PROXY_TLV:") {
+				return proxyTLVValue(connProxyTLVs(conn), n[10:])
+			}
 			return ""
 		}
 	})
@@ -404,12 +461,36 @@ func (be *Backend) setAltSvc(header http.Header, req *http.Request) {
 	if be.ALPNProtos == nil || !slices.Contains(*be.ALPNProtos, "h3") {
 		return
 	}
-	_, port, _ := net.SplitHostPort(req.Host)
-	if port == "" {
-		port = "443"
+	as := be.AltSvc
+	if as == nil {
+		as = &AltSvc{MaxAge: 30 * 24 * time.Hour}
 	}
-	if p, err := strconv.Atoi(port); err == nil && p > 0 && p < 65536 {
-		header.Set("Alt-Svc", fmt.Sprintf("h3=\":%d\"; ma=2592000;", p))
+	if as.Disabled {
+		return
+	}
+	if len(as.ServerNames) > 0 && !slices.Contains(as.ServerNames, hostFromReq(req)) {
+		return
+	}
+	ma := int64(as.MaxAge / time.Second)
+	var values []string
+	port := as.Port
+	if port == 0 {
+		_, p, _ := net.SplitHostPort(req.Host)
+		if p == "" {
+			p = "443"
+		}
+		if v, err := strconv.Atoi(p); err == nil && v > 0 && v < 65536 {
+			port = v
+		}
+	}
+	if port != 0 {
+		values = append(values, fmt.Sprintf("h3=\":%d\"; ma=%d", port, ma))
+	}
+	for _, e := range as.Endpoints {
+		values = append(values, fmt.Sprintf("h3=%q; ma=%d", e, ma))
+	}
+	if len(values) > 0 {
+		header.Set("Alt-Svc", strings.Join(values, ", "))
 	}
 }
 
@@ -417,6 +498,9 @@ func (be *Backend) setAltSvc(header http.Header, req *http.Request) {
 // authorization policy. It returns true if processing of the request should
 // continue.
 func (be *Backend) handleLocalEndpointsAndAuthorize(w http.ResponseWriter, req *http.Request) bool {
+	if !be.enforceClientCertPolicy(w, req) {
+		return false
+	}
 	reqHost := hostFromReq(req)
 	cleanPath := pathClean(req.URL.Path)
 	hi := slices.IndexFunc(be.localHandlers, func(h localHandler) bool {
@@ -455,14 +539,57 @@ func (be *Backend) handleLocalEndpointsAndAuthorize(w http.ResponseWriter, req *
 	return true
 }
 
+// enforceClientCertPolicy checks that requests to the paths that require a
+// client certificate have one, and that it is authorized. It returns true if
+// processing of the request should continue.
+func (be *Backend) enforceClientCertPolicy(w http.ResponseWriter, req *http.Request) bool {
+	if be.ClientAuth == nil || !be.ClientAuth.Optional || !pathMatches(be.ClientAuth.RequiredPaths, req.URL.Path) {
+		return true
+	}
+	var cert *x509.Certificate
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		cert = req.TLS.PeerCertificates[0]
+	}
+	if cert == nil {
+		be.recordEvent(fmt.Sprintf("deny no cert to %s%s", idnaToUnicode(req.Host), req.URL.Path))
+	} else if err := be.authorize(cert); err != nil {
+		be.recordEvent(fmt.Sprintf("deny X509 [%s] to %s%s", certSummary(cert), idnaToUnicode(req.Host), req.URL.Path))
+	} else {
+		return true
+	}
+	be.logHTTPRequest("REQ", req, req.RequestURI, http.StatusForbidden, " (mTLS)")
+	http.Error(w, "client certificate required", http.StatusForbidden)
+	return false
+}
+
 func (be *Backend) reverseProxyDirector(req *http.Request) {
-	req.Header.Del(xForwardedForHeader)
+	if be.ForwardedHeaders == nil {
+		req.Header.Del(xForwardedForHeader)
+	}
 	req.Header.Del(xFCCHeader)
 	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 && be.ClientAuth != nil && len(be.ClientAuth.AddClientCertHeader) > 0 {
-		addXFCCHeader(req, be.ClientAuth.AddClientCertHeader)
+		addXFCCHeader(req, be.ClientAuth.AddClientCertHeader, be.ClientAuth.ClientCertHeaderFormat)
 	}
 }
 
+// canaryRoute returns the index of the first Canary rule that matches req, or
+// -1 if none matches.
+func (be *Backend) canaryRoute(req *http.Request) int {
+	return slices.IndexFunc(be.Canary, func(c *CanaryRoute) bool {
+		var values []string
+		if c.Header != "" {
+			values = req.Header.Values(c.Header)
+		} else {
+			for _, cookie := range req.CookiesNamed(c.Cookie) {
+				values = append(values, cookie.Value)
+			}
+		}
+		return slices.ContainsFunc(values, func(v string) bool {
+			return v != "" && (c.Value == "" || v == c.Value)
+		})
+	})
+}
+
 type funcRoundTripper func(req *http.Request) (*http.Response, error)
 
 func (rt funcRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -493,6 +620,19 @@ func (be *Backend) reverseProxyTransport() http.RoundTripper {
 			be.recordEvent("http2 client error: " + errType)
 		},
 	}
+	if ht := be.HTTPTransport; ht != nil {
+		h1.MaxIdleConnsPerHost = ht.MaxIdleConnsPerHost
+		h1.MaxConnsPerHost = ht.MaxConnsPerHost
+		if ht.IdleConnTimeout > 0 {
+			h1.IdleConnTimeout = ht.IdleConnTimeout
+			h2.IdleConnTimeout = ht.IdleConnTimeout
+		}
+		if ht.H2Multiplexing != nil && !*ht.H2Multiplexing {
+			h2.ConnPool = newH2SingleStreamPool(h2, ht.MaxIdleConnsPerHost, func(ctx context.Context) (net.Conn, error) {
+				return be.dial(ctx, "h2")
+			})
+		}
+	}
 	h3 := be.http3Transport()
 
 	return funcRoundTripper(func(req *http.Request) (*http.Response, error) {
@@ -527,12 +667,18 @@ func (be *Backend) reverseProxyModifyResponse(resp *http.Response) error {
 			annotatedConn(c).SetAnnotation(httpUpgradeKey, resp.Header.Get("upgrade"))
 		}
 	}
+	if err := be.inspectResponse(resp); err != nil {
+		return err
+	}
+	if err := be.runResponsePlugins(resp); err != nil {
+		return err
+	}
 	var cl string
 	if resp.ContentLength != -1 {
 		cl = fmt.Sprintf(" content-length:%d", resp.ContentLength)
 	}
 	url, _ := req.Context().Value(ctxURLKey).(string)
-	be.logRequestF("PRX %s ➔ %s %s ➔ status:%d%s (%q)", formatReqDesc(req), req.Method, url, resp.StatusCode, cl, userAgent(req))
+	be.logHTTPRequest("PRX", req, url, resp.StatusCode, cl)
 
 	if resp.StatusCode != http.StatusMisdirectedRequest && resp.Header.Get(hstsHeader) == "" {
 		resp.Header.Set(hstsHeader, hstsValue)
@@ -25,13 +25,47 @@ package proxy
 
 import (
 	"context"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	jwt "github.com/golang-jwt/jwt/v5"
 )
 
+func TestSetAltSvc(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		altSvc *AltSvc
+		host   string
+		want   string
+	}{
+		{"default", nil, "www.example.com", `h3=":443"; ma=2592000`},
+		{"default port", nil, "www.example.com:8443", `h3=":8443"; ma=2592000`},
+		{"disabled", &AltSvc{Disabled: true}, "www.example.com", ""},
+		{"port", &AltSvc{Port: 9443, MaxAge: time.Hour}, "www.example.com", `h3=":9443"; ma=3600`},
+		{"endpoints", &AltSvc{MaxAge: time.Hour, Endpoints: []string{"h3.example.com:443"}}, "www.example.com", `h3=":443"; ma=3600, h3="h3.example.com:443"; ma=3600`},
+		{"server name", &AltSvc{MaxAge: time.Hour, ServerNames: []string{"www.example.com"}}, "www.example.com", `h3=":443"; ma=3600`},
+		{"other server name", &AltSvc{MaxAge: time.Hour, ServerNames: []string{"www.example.com"}}, "other.example.com", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			be := &Backend{
+				ALPNProtos:  &[]string{"h2", "http/1.1", "h3"},
+				AltSvc:      tc.altSvc,
+				http3Server: io.NopCloser(nil),
+			}
+			req := httptest.NewRequest("GET", "https://"+tc.host+"/", nil)
+			header := make(http.Header)
+			be.setAltSvc(header, req)
+			if got := header.Get("Alt-Svc"); got != tc.want {
+				t.Errorf("Alt-Svc = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
 func TestExpandVars(t *testing.T) {
 	ctx := context.WithValue(context.Background(), authCtxKey, jwt.MapClaims{
 		"email": "bob@example.com",
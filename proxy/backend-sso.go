@@ -28,15 +28,19 @@ import (
 	"crypto/sha256"
 	_ "embed"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
+	"os"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	jwt "github.com/golang-jwt/jwt/v5"
+	"golang.org/x/net/http/httpguts"
 
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/cookiemanager"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/idp"
@@ -46,8 +50,23 @@ import (
 
 type ctxAuthKey struct{}
 
+// sessionRefresher is implemented by identity providers that can extend the
+// user's session without user interaction.
+type sessionRefresher interface {
+	RefreshSession(w http.ResponseWriter, req *http.Request, authClaims jwt.MapClaims) error
+}
+
+type bearerTokenValidator interface {
+	ValidateBearerToken(token string, audiences []string) (jwt.MapClaims, error)
+}
+
 const (
 	xTLSProxyUserIDHeader = "X-tlsproxy-user-id"
+
+	// sessionRefreshThreshold is the remaining lifetime of the auth token
+	// below which the session is refreshed, when supported by the identity
+	// provider.
+	sessionRefreshThreshold = 10 * time.Hour
 )
 
 var (
@@ -88,16 +107,22 @@ func claimsFromCtx(ctx context.Context) jwt.MapClaims {
 // It returns true if processing of the request should continue.
 func (be *Backend) authenticateUser(w http.ResponseWriter, req **http.Request) bool {
 	(*req).Header.Del(xTLSProxyUserIDHeader)
-	if be.SSO != nil {
-		claims, cont := be.checkCookies(w, *req)
+	for _, sso := range be.ssoPolicies() {
+		for _, h := range sso.ClaimHeaders {
+			(*req).Header.Del(h)
+		}
+	}
+	if sso := be.ssoFor((*req).URL.Path); sso != nil {
+		claims, cont := be.checkCookies(w, *req, sso)
 		if !cont {
 			return false
 		}
 		if claims != nil {
 			if email, ok := claims["email"].(string); ok && email != "" {
-				if be.SSO.SetUserIDHeader {
+				if sso.SetUserIDHeader {
 					(*req).Header.Set(xTLSProxyUserIDHeader, email)
 				}
+				setClaimHeaders((*req).Header, sso.ClaimHeaders, claims)
 				*req = (*req).WithContext(context.WithValue((*req).Context(), authCtxKey, claims))
 			}
 		}
@@ -105,14 +130,80 @@ func (be *Backend) authenticateUser(w http.ResponseWriter, req **http.Request) b
 	return true
 }
 
-func (be *Backend) checkCookies(w http.ResponseWriter, req *http.Request) (jwt.MapClaims, bool) {
+// setClaimHeaders sets the headers in claimHeaders with the values of the
+// claims.
+func setClaimHeaders(h http.Header, claimHeaders map[string]string, claims jwt.MapClaims) {
+	for claim, name := range claimHeaders {
+		var v string
+		switch cv := claims[claim].(type) {
+		case nil:
+			continue
+		case string:
+			v = cv
+		case float64:
+			v = strconv.FormatFloat(cv, 'f', -1, 64)
+		case []any:
+			vals := make([]string, 0, len(cv))
+			for _, e := range cv {
+				vals = append(vals, fmt.Sprint(e))
+			}
+			v = strings.Join(vals, ",")
+		default:
+			v = fmt.Sprint(cv)
+		}
+		if v == "" || !httpguts.ValidHeaderFieldValue(v) {
+			continue
+		}
+		h.Set(name, v)
+	}
+}
+
+// bearerToken returns the bearer token from the request's Authorization
+// header.
+func bearerToken(req *http.Request) (string, bool) {
+	h := req.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+	return h[7:], true
+}
+
+// checkBearerToken validates a bearer token that wasn't issued by the proxy.
+// The requests with an invalid token are rejected without redirecting the
+// client to the identity provider.
+func (be *Backend) checkBearerToken(w http.ResponseWriter, req *http.Request, sso *BackendSSO, token string) (jwt.MapClaims, bool) {
+	if v, ok := sso.p.(bearerTokenValidator); ok && sso.BearerTokens.Upstream {
+		claims, err := v.ValidateBearerToken(token, sso.BearerTokens.Audiences)
+		if err == nil && !sso.cm.IsRevoked(claims) {
+			return claims, true
+		}
+		if err != nil {
+			be.logErrorF("ERR [-] %s: bearer token: %v", req.RemoteAddr, err)
+		}
+	}
+	be.recordEvent("invalid bearer token")
+	be.logHTTPRequest("REQ", req, req.RequestURI, http.StatusUnauthorized, " (SSO)")
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	http.Error(w, "invalid token", http.StatusUnauthorized)
+	return nil, false
+}
+
+func (be *Backend) checkCookies(w http.ResponseWriter, req *http.Request, sso *BackendSSO) (jwt.MapClaims, bool) {
 	// If a valid ID Token is in the authorization header, use it and
 	// ignore the cookies.
-	if tok, err := be.SSO.cm.ValidateAuthorizationHeader(req); err == nil {
+	if tok, err := sso.cm.ValidateAuthorizationHeader(req); err == nil {
 		return tok.Claims.(jwt.MapClaims), true
 	}
+	if token, ok := bearerToken(req); ok && sso.BearerTokens != nil {
+		return be.checkBearerToken(w, req, sso, token)
+	}
+	if sso.APIKeys != nil {
+		if key, ok := sso.APIKeys.apiKey(req); ok {
+			return be.checkAPIKey(w, req, sso, key)
+		}
+	}
 
-	authToken, err := be.SSO.cm.ValidateAuthTokenCookie(req)
+	authToken, err := sso.cm.ValidateAuthTokenCookie(req)
 	if err != nil {
 		return nil, true
 	}
@@ -123,20 +214,28 @@ func (be *Backend) checkCookies(w http.ResponseWriter, req *http.Request) (jwt.M
 	if email, ok := authClaims["email"].(string); !ok || email == "" {
 		return nil, true
 	}
+	if r, ok := sso.p.(sessionRefresher); ok {
+		if exp, _ := authClaims.GetExpirationTime(); exp != nil && time.Until(exp.Time) < sessionRefreshThreshold {
+			if err := r.RefreshSession(w, req, authClaims); err != nil {
+				be.logErrorF("ERR [-] %s: session refresh: %v", req.RemoteAddr, err)
+			}
+		}
+	}
 
-	if !be.SSO.GenerateIDTokens {
+	if !sso.GenerateIDTokens {
 		return authClaims, true
 	}
 
-	if !slices.Contains(be.ServerNames, hostFromReq(req)) {
+	if !be.hasServerName(hostFromReq(req)) {
 		return authClaims, true
 	}
 
-	if err := be.SSO.cm.ValidateIDTokenCookie(req, authToken); err == nil {
+	opts := sso.idTokenOptions(authClaims)
+	if err := sso.cm.ValidateIDTokenCookie(req, authToken, opts); err == nil {
 		// Token is already set, and is valid.
 		return authClaims, true
 	}
-	if err := be.SSO.cm.SetIDTokenCookie(w, req, authToken); err != nil {
+	if err := sso.cm.SetIDTokenCookie(w, req, authToken, opts); err != nil {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return nil, false
 	}
@@ -145,7 +244,8 @@ func (be *Backend) checkCookies(w http.ResponseWriter, req *http.Request) (jwt.M
 }
 
 func (be *Backend) serveSSOStyle(w http.ResponseWriter, req *http.Request) {
-	sum := sha256.Sum256(styleEmbed)
+	style := be.pageTemplates().style
+	sum := sha256.Sum256(style)
 	etag := `"` + hex.EncodeToString(sum[:]) + `"`
 
 	w.Header().Set("Content-Type", "text/css")
@@ -157,7 +257,7 @@ func (be *Backend) serveSSOStyle(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	w.WriteHeader(http.StatusOK)
-	w.Write(styleEmbed)
+	w.Write(style)
 }
 
 func (be *Backend) serveSSOStatus(w http.ResponseWriter, req *http.Request) {
@@ -196,8 +296,8 @@ func (be *Backend) serveSSOStatus(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	data.Token = token
-	_, data.Passkeys = be.SSO.p.(*passkeys.Manager)
-	ssoStatusTemplate.Execute(w, data)
+	_, data.Passkeys = be.ssoFor(req.URL.Path).p.(*passkeys.Manager)
+	be.pageTemplates().ssoStatus.Execute(w, data)
 }
 
 func (be *Backend) serveLogin(w http.ResponseWriter, req *http.Request) {
@@ -216,24 +316,28 @@ func (be *Backend) serveLogin(w http.ResponseWriter, req *http.Request) {
 	if e, ok := claims["email"].(string); ok {
 		email = e
 	}
-	be.SSO.p.RequestLogin(w, req, url.String(), idp.WithLoginHint(email))
+	be.ssoFor(url.Path).p.RequestLogin(w, req, url.String(), idp.WithLoginHint(email))
 }
 
 func (be *Backend) serveLogout(w http.ResponseWriter, req *http.Request) {
-	if be.SSO != nil {
-		be.SSO.cm.ClearCookies(w)
-	}
 	req.ParseForm()
+	everywhere := req.Method == http.MethodPost && req.PostForm.Get("everywhere") != ""
+	for _, sso := range be.ssoPolicies() {
+		if err := sso.cm.RevokeCurrentSession(req, everywhere); err != nil {
+			be.logErrorF("ERR RevokeCurrentSession: %v", err)
+		}
+		sso.cm.ClearCookies(w)
+	}
 	if tokenStr := req.Form.Get("u"); tokenStr != "" {
 		url, _, err := be.tm.ValidateURLToken(w, req, tokenStr)
 		if err != nil {
 			http.Error(w, "invalid request", http.StatusBadRequest)
 			return
 		}
-		be.SSO.p.RequestLogin(w, req, url.String(), idp.WithSelectAccount(true))
+		be.ssoFor(url.Path).p.RequestLogin(w, req, url.String(), idp.WithSelectAccount(true))
 		return
 	}
-	logoutTemplate.Execute(w, nil)
+	be.pageTemplates().logout.Execute(w, struct{ Everywhere bool }{everywhere})
 }
 
 func (be *Backend) servePermissionDenied(w http.ResponseWriter, req *http.Request) {
@@ -260,19 +364,20 @@ func (be *Backend) servePermissionDenied(w http.ResponseWriter, req *http.Reques
 		URL:        url,
 		DisplayURL: url,
 		Token:      token,
-		Message:    template.HTML(be.SSO.HTMLMessage),
+		Message:    template.HTML(be.ssoFor(req.URL.Path).HTMLMessage),
 	}
 	if len(data.DisplayURL) > 100 {
 		data.DisplayURL = data.DisplayURL[:97] + "..."
 	}
 	w.WriteHeader(http.StatusForbidden)
-	if err := permissionDeniedTemplate.Execute(w, data); err != nil {
+	if err := be.pageTemplates().permissionDenied.Execute(w, data); err != nil {
 		be.logErrorF("ERR permission-denied-template: %v", err)
 	}
 }
 
 func (be *Backend) enforceSSOPolicy(w http.ResponseWriter, req *http.Request) bool {
-	if be.SSO == nil || !pathMatches(be.SSO.Paths, req.URL.Path) || (len(be.SSO.Exceptions) > 0 && pathMatches(be.SSO.Exceptions, req.URL.Path)) {
+	sso := be.ssoFor(req.URL.Path)
+	if sso == nil || !pathMatches(sso.Paths, req.URL.Path) || (len(sso.Exceptions) > 0 && pathMatches(sso.Exceptions, req.URL.Path)) {
 		return true
 	}
 	claims := claimsFromCtx(req.Context())
@@ -287,9 +392,9 @@ func (be *Backend) enforceSSOPolicy(w http.ResponseWriter, req *http.Request) bo
 	// * the user isn't logged in, or
 	// * the backend has ForceReAuth set, and the last authentication
 	//   either on a different host, or too long ago.
-	if claims == nil || (be.SSO.ForceReAuth != 0 && (claims["hhash"] != hex.EncodeToString(hh[:]) || time.Since(iat) > be.SSO.ForceReAuth)) {
+	if claims == nil || (sso.ForceReAuth != 0 && (claims["hhash"] != hex.EncodeToString(hh[:]) || time.Since(iat) > sso.ForceReAuth)) {
 		if req.Method != http.MethodGet {
-			be.logRequestF("REQ %s ➔ %s %s ➔ status:%d (SSO) (%q)", formatReqDesc(req), req.Method, req.RequestURI, http.StatusForbidden, userAgent(req))
+			be.logHTTPRequest("REQ", req, req.RequestURI, http.StatusForbidden, " (SSO)")
 			http.Error(w, "authentication required", http.StatusForbidden)
 			return false
 		}
@@ -308,12 +413,12 @@ func (be *Backend) enforceSSOPolicy(w http.ResponseWriter, req *http.Request) bo
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return false
 		}
-		if _, ok := be.SSO.p.(*passkeys.Manager); ok || req.Header.Get("x-skip-login-confirmation") != "" {
-			be.logRequestF("REQ %s ➔ %s %s ➔ status:%d (SSO) (%q)", formatReqDesc(req), req.Method, req.RequestURI, http.StatusFound, userAgent(req))
+		if _, ok := sso.p.(*passkeys.Manager); ok || req.Header.Get("x-skip-login-confirmation") != "" {
+			be.logHTTPRequest("REQ", req, req.RequestURI, http.StatusFound, " (SSO)")
 			http.Redirect(w, req, "/.sso/login?redirect="+token, http.StatusFound)
 			return false
 		}
-		be.logRequestF("REQ %s ➔ %s %s ➔ status:%d (SSO) (%q)", formatReqDesc(req), req.Method, req.RequestURI, http.StatusForbidden, userAgent(req))
+		be.logHTTPRequest("REQ", req, req.RequestURI, http.StatusForbidden, " (SSO)")
 		data := struct {
 			URL        string
 			DisplayURL string
@@ -323,26 +428,28 @@ func (be *Backend) enforceSSOPolicy(w http.ResponseWriter, req *http.Request) bo
 			URL:        url,
 			DisplayURL: url,
 			Token:      token,
-			IDP:        be.SSO.actualIDP,
+			IDP:        sso.actualIDP,
 		}
 		if len(data.DisplayURL) > 100 {
 			data.DisplayURL = data.DisplayURL[:97] + "..."
 		}
 		w.WriteHeader(http.StatusForbidden)
-		if err := loginTemplate.Execute(w, data); err != nil {
+		if err := be.pageTemplates().login.Execute(w, data); err != nil {
 			be.logErrorF("ERR login-template: %v", err)
 		}
 		return false
 	}
 	userID, _ := claims["email"].(string)
 	host := connServerName(req.Context().Value(connCtxKey).(anyConn))
-	_, userDomain, _ := strings.Cut(userID, "@")
-	if be.SSO.ACL != nil && !slices.Contains(*be.SSO.ACL, userID) && !slices.Contains(*be.SSO.ACL, "@"+userDomain) {
+	if sso.ACL != nil && !idp.MatchACL(*sso.ACL, claims) {
 		be.recordEvent(fmt.Sprintf("deny SSO %s to %s", userID, idnaToUnicode(host)))
-		be.logRequestF("REQ %s ➔ %s %s ➔ status:%d (SSO) (%q)", formatReqDesc(req), req.Method, req.RequestURI, http.StatusForbidden, userAgent(req))
+		be.logHTTPRequest("REQ", req, req.RequestURI, http.StatusForbidden, " (SSO)")
 		be.servePermissionDenied(w, req)
 		return false
 	}
+	if !be.checkSessionLimit(w, req, sso, claims) {
+		return false
+	}
 	be.recordEvent(fmt.Sprintf("allow SSO %s to %s", userID, idnaToUnicode(host)))
 
 	// Filter out the tlsproxy auth cookie.
@@ -350,6 +457,75 @@ func (be *Backend) enforceSSOPolicy(w http.ResponseWriter, req *http.Request) bo
 	return true
 }
 
+// idTokenOptions returns the options to use when generating ID tokens for
+// the user with the given claims.
+func (sso *BackendSSO) idTokenOptions(claims jwt.MapClaims) cookiemanager.IDTokenOptions {
+	opts := cookiemanager.IDTokenOptions{
+		Audience: sso.IDTokenAudience,
+		Lifetime: sso.IDTokenLifetime,
+	}
+	if len(sso.IDTokenClaims) > 0 {
+		opts.Claims = make(map[string]any, len(sso.IDTokenClaims))
+		for k, v := range sso.IDTokenClaims {
+			opts.Claims[k] = expandIDTokenClaim(v, claims)
+		}
+	}
+	return opts
+}
+
+// expandIDTokenClaim expands the ${JWT:name} references in v. When v is only
+// one reference, the claim's value is used as is, e.g. a list of groups stays
+// a list. Otherwise, the values that aren't strings are inserted as JSON.
+func expandIDTokenClaim(v string, claims jwt.MapClaims) any {
+	if name, ok := strings.CutPrefix(v, "${JWT:"); ok && strings.Index(name, "}") == len(name)-1 {
+		if c, exists := claims[name[:len(name)-1]]; exists {
+			return c
+		}
+		return ""
+	}
+	return os.Expand(v, func(n string) string {
+		name, ok := strings.CutPrefix(n, "JWT:")
+		if !ok {
+			return ""
+		}
+		switch c := claims[name].(type) {
+		case nil:
+			return ""
+		case string:
+			return c
+		default:
+			b, err := json.Marshal(c)
+			if err != nil {
+				return ""
+			}
+			return string(b)
+		}
+	})
+}
+
+// ssoFor returns the SSO policy that applies to path, or nil if the backend
+// doesn't use SSO.
+func (be *Backend) ssoFor(path string) *BackendSSO {
+	for _, sso := range be.SSOByPath {
+		if pathMatches(sso.Paths, path) {
+			return sso
+		}
+	}
+	if be.SSO == nil && len(be.SSOByPath) > 0 && strings.HasPrefix(path, "/.sso/") {
+		return be.SSOByPath[0]
+	}
+	return be.SSO
+}
+
+// ssoPolicies returns all the SSO policies of the backend.
+func (be *Backend) ssoPolicies() []*BackendSSO {
+	policies := slices.Clone(be.SSOByPath)
+	if be.SSO != nil {
+		policies = append(policies, be.SSO)
+	}
+	return policies
+}
+
 func pathMatches(prefixes []string, path string) bool {
 	if len(prefixes) == 0 {
 		return true
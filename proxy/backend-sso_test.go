@@ -27,10 +27,13 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -42,10 +45,15 @@ import (
 
 func TestAuthenticateUser(t *testing.T) {
 	proxy := newBackendSSOTestProxy(t)
+	proxy.cfg.Backends[0].SSO.ClaimHeaders = map[string]string{
+		"sub":      "X-User-Sub",
+		"provider": "X-User-Provider",
+	}
 
 	// No auth token.
 	req := httptest.NewRequest("GET", "https://example.com/", nil)
 	req.Header.Set("x-tlsproxy-user-id", "imposter")
+	req.Header.Set("x-user-sub", "imposter")
 	w := httptest.NewRecorder()
 
 	if cont := proxy.cfg.Backends[0].authenticateUser(w, &req); !cont {
@@ -54,6 +62,9 @@ func TestAuthenticateUser(t *testing.T) {
 	if req.Header.Get("x-tlsproxy-user-id") != "" {
 		t.Fatalf("request has x-tlsproxy-user-id")
 	}
+	if req.Header.Get("x-user-sub") != "" {
+		t.Fatalf("request has x-user-sub")
+	}
 	if c := claimsFromCtx(req.Context()); c != nil {
 		t.Fatalf("claimsFromCtx() = %v", c)
 	}
@@ -72,6 +83,12 @@ func TestAuthenticateUser(t *testing.T) {
 	if got, want := req.Header.Get("x-tlsproxy-user-id"), "bob@"; got != want {
 		t.Errorf("x-tlsproxy-user-id = %q, want %q", got, want)
 	}
+	if got, want := req.Header.Get("x-user-sub"), "12345"; got != want {
+		t.Errorf("x-user-sub = %q, want %q", got, want)
+	}
+	if got, want := req.Header.Get("x-user-provider"), "test-idp"; got != want {
+		t.Errorf("x-user-provider = %q, want %q", got, want)
+	}
 	if c := claimsFromCtx(req.Context()); c == nil || c["email"] != "bob@" {
 		t.Fatalf("claimsFromCtx() = %v", c)
 	}
@@ -110,6 +127,131 @@ func TestAuthenticateUser(t *testing.T) {
 	}
 }
 
+func TestSetClaimHeaders(t *testing.T) {
+	h := http.Header{}
+	setClaimHeaders(h, map[string]string{
+		"name":    "X-User-Name",
+		"groups":  "X-User-Groups",
+		"iat":     "X-User-Iat",
+		"evil":    "X-Evil",
+		"missing": "X-Missing",
+	}, jwt.MapClaims{
+		"name":   "Bob Smith",
+		"groups": []any{"eng", "oncall"},
+		"iat":    float64(1700000000),
+		"evil":   "foo\r\nX-Injected: bar",
+	})
+	want := http.Header{
+		"X-User-Name":   []string{"Bob Smith"},
+		"X-User-Groups": []string{"eng,oncall"},
+		"X-User-Iat":    []string{"1700000000"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("headers = %v, want %v", h, want)
+	}
+}
+
+func TestExpandIDTokenClaim(t *testing.T) {
+	claims := jwt.MapClaims{
+		"email":  "bob@example.com",
+		"groups": []any{"eng", "oncall"},
+		"level":  float64(3),
+	}
+	for _, tc := range []struct {
+		in   string
+		want any
+	}{
+		{"static", "static"},
+		{"${JWT:email}", "bob@example.com"},
+		{"${JWT:groups}", []any{"eng", "oncall"}},
+		{"${JWT:level}", float64(3)},
+		{"${JWT:missing}", ""},
+		{"user ${JWT:email}", "user bob@example.com"},
+		{"groups=${JWT:groups}", `groups=["eng","oncall"]`},
+		{"${JWT:email} ${JWT:level}", "bob@example.com 3"},
+	} {
+		if got := expandIDTokenClaim(tc.in, claims); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("expandIDTokenClaim(%q) = %#v, want %#v", tc.in, got, tc.want)
+		}
+	}
+
+	cfg := &Config{
+		OIDCProviders: []*ConfigOIDC{{
+			Name:          "idp",
+			AuthEndpoint:  "https://idp/authorization",
+			TokenEndpoint: "https://idp/token",
+			RedirectURL:   "https://example.com/redirect",
+			ClientID:      "CLIENTID",
+			ClientSecret:  "CLIENTSECRET",
+		}},
+		Backends: []*Backend{{
+			ServerNames: []string{"example.com"},
+			Mode:        "LOCAL",
+			SSO:         &BackendSSO{Provider: "idp"},
+			SSOByPath: []*BackendSSO{{
+				Provider:      "idp",
+				Paths:         []string{"/admin/"},
+				IDTokenClaims: map[string]string{"sub": "foo"},
+			}},
+		}},
+	}
+	if err := cfg.Check(); err == nil || !strings.Contains(err.Error(), "backend[0].SSOByPath[0].IDTokenClaims") {
+		t.Errorf("Check() = %v, want SSOByPath[0] error", err)
+	}
+}
+
+type fakeBearerIDP struct {
+	identityProvider
+}
+
+func (fakeBearerIDP) ValidateBearerToken(token string, audiences []string) (jwt.MapClaims, error) {
+	if token != "good" {
+		return nil, errors.New("invalid token")
+	}
+	return jwt.MapClaims{"email": "alice@example.com", "sub": "alice"}, nil
+}
+
+func TestBearerTokens(t *testing.T) {
+	proxy := newBackendSSOTestProxy(t)
+	be := proxy.cfg.Backends[0]
+	be.SSO.GenerateIDTokens = false
+	be.SSO.BearerTokens = &BearerTokens{Upstream: true}
+	be.SSO.p = fakeBearerIDP{be.SSO.p}
+
+	authenticate := func(auth string) (*http.Request, *httptest.ResponseRecorder, bool) {
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		ok := be.authenticateUser(w, &req)
+		return req, w, ok
+	}
+
+	req, _, ok := authenticate("Bearer good")
+	if !ok {
+		t.Fatal("authenticateUser() = false, want true")
+	}
+	if c := claimsFromCtx(req.Context()); c == nil || c["email"] != "alice@example.com" {
+		t.Errorf("claimsFromCtx() = %v", c)
+	}
+
+	_, w, ok := authenticate("Bearer bad")
+	if ok {
+		t.Fatal("authenticateUser() = true, want false")
+	}
+	if got, want := w.Code, http.StatusUnauthorized; got != want {
+		t.Errorf("Code = %d, want %d", got, want)
+	}
+	if got := w.Header().Get("WWW-Authenticate"); !strings.HasPrefix(got, "Bearer") {
+		t.Errorf("WWW-Authenticate = %q", got)
+	}
+
+	// Without BearerTokens, the invalid tokens are ignored.
+	be.SSO.BearerTokens = nil
+	if req, _, ok := authenticate("Bearer good"); !ok || claimsFromCtx(req.Context()) != nil {
+		t.Errorf("authenticateUser() = %v, claims %v", ok, claimsFromCtx(req.Context()))
+	}
+}
+
 func TestEnforceSSOPolicy(t *testing.T) {
 	proxy := newBackendSSOTestProxy(t)
 
@@ -199,6 +341,29 @@ func TestEnforceSSOPolicy(t *testing.T) {
 	}
 }
 
+func TestSSOByPath(t *testing.T) {
+	admin := &BackendSSO{Provider: "corp", Paths: []string{"/admin/"}}
+	partner := &BackendSSO{Provider: "partner", Paths: []string{"/partner/"}}
+	def := &BackendSSO{Provider: "default"}
+
+	for _, tc := range []struct {
+		be   *Backend
+		path string
+		want *BackendSSO
+	}{
+		{&Backend{SSOByPath: []*BackendSSO{admin, partner}, SSO: def}, "/admin/foo", admin},
+		{&Backend{SSOByPath: []*BackendSSO{admin, partner}, SSO: def}, "/partner/", partner},
+		{&Backend{SSOByPath: []*BackendSSO{admin, partner}, SSO: def}, "/other", def},
+		{&Backend{SSOByPath: []*BackendSSO{admin, partner}}, "/other", nil},
+		{&Backend{SSOByPath: []*BackendSSO{admin, partner}}, "/.sso/", admin},
+		{&Backend{}, "/", nil},
+	} {
+		if got := tc.be.ssoFor(tc.path); got != tc.want {
+			t.Errorf("ssoFor(%q) = %v, want %v", tc.path, got, tc.want)
+		}
+	}
+}
+
 func newBackendSSOTestProxy(t *testing.T) *Proxy {
 	return newTestProxy(
 		&Config{
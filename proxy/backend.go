@@ -34,10 +34,14 @@ import (
 	"net"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
 
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/ct"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
 )
 
@@ -53,6 +57,12 @@ func (be *Backend) incInFlight(delta int) int {
 }
 
 func (be *Backend) close(ctx context.Context) {
+	if be.stopDiscovery != nil {
+		be.stopDiscovery()
+	}
+	if be.sshJump != nil {
+		be.sshJump.close()
+	}
 	be.state.mu.Lock()
 	defer be.state.mu.Unlock()
 	if be.httpServer == nil {
@@ -80,15 +90,70 @@ func (be *Backend) close(ctx context.Context) {
 	}
 }
 
+// verifyConnection returns a function that checks the revocation status of
+// the backend's certificate. When requireOCSP is true, the certificate must
+// have a Good OCSP response, stapled or fetched. When requireSCT is true, the
+// certificate must have valid Certificate Transparency SCTs. When pinnedKeys
+// is set, the certificate chain must contain one of the pinned keys.
+func (be *Backend) verifyConnection(ctx context.Context, requireOCSP, requireSCT bool, pinnedKeys []string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return tlsCertificateRequired
+		}
+		cert := cs.PeerCertificates[0]
+		if len(pinnedKeys) > 0 && !matchPinnedKeys(cs, pinnedKeys) {
+			be.recordEvent(fmt.Sprintf("backend X509 %s [%s] (pinned keys mismatch)", idnaToUnicode(cs.ServerName), cert.Subject))
+			return tlsBadCertificate
+		}
+		if requireSCT {
+			var err error
+			if len(cs.VerifiedChains) == 0 || be.ctLogs == nil {
+				err = ct.ErrNoChain
+			} else {
+				err = be.ctLogs.Verify(cs.VerifiedChains[0], cs.SignedCertificateTimestamps)
+			}
+			if err != nil {
+				be.recordEvent(fmt.Sprintf("backend X509 %s [%s] (SCT:%v)", idnaToUnicode(cs.ServerName), cert.Subject, err))
+				return tlsBadCertificate
+			}
+		}
+		if m, ok := be.pkiMap[hex.EncodeToString(cert.AuthorityKeyId)]; ok {
+			if m.IsRevoked(cert.SerialNumber) {
+				return tlsCertificateRevoked
+			}
+			return nil
+		}
+		var err error
+		if requireOCSP {
+			err = be.ocspCache.RequireGood(ctx, cs.VerifiedChains, cs.OCSPResponse)
+		} else if len(cert.OCSPServer) > 0 {
+			err = be.ocspCache.VerifyChains(ctx, cs.VerifiedChains, cs.OCSPResponse)
+		}
+		if err != nil {
+			be.recordEvent(fmt.Sprintf("backend X509 %s [%s] (OCSP:%v)", idnaToUnicode(cs.ServerName), cert.Subject, err))
+			return tlsCertificateRevoked
+		}
+		return nil
+	}
+}
+
 func (be *Backend) dial(ctx context.Context, protos ...string) (net.Conn, error) {
 	var (
-		addresses          = be.Addresses
+		addresses          = be.addresses()
 		mode               = be.Mode
 		timeout            = be.ForwardTimeout
 		insecureSkipVerify = be.InsecureSkipVerify
 		serverName         = be.ForwardServerName
 		rootCAs            = be.forwardRootCAs
+		requireOCSP        = be.ForwardRequireOCSP
+		requireSCT         = be.ForwardRequireSCT
+		forwardDANE        = be.ForwardDANE
+		pinnedKeys         = be.ForwardPinnedKeys
+		sourceAddr         = be.dialSourceAddr
+		iface              = be.DialInterface
+		tcpOptions         = be.ForwardTCPOptions
 		proxyProtoVersion  = be.proxyProtocolVersion
+		proxyProtoTLVs     = be.proxyProtocolTLVs
 		next               = &be.state.next
 	)
 	if id, ok := ctx.Value(ctxOverrideIDKey).(int); ok && id >= 0 && id < len(be.PathOverrides) {
@@ -99,12 +164,28 @@ func (be *Backend) dial(ctx context.Context, protos ...string) (net.Conn, error)
 		insecureSkipVerify = po.InsecureSkipVerify
 		serverName = po.ForwardServerName
 		rootCAs = po.forwardRootCAs
+		requireOCSP = po.ForwardRequireOCSP
+		requireSCT = po.ForwardRequireSCT
+		forwardDANE = po.ForwardDANE
+		pinnedKeys = po.ForwardPinnedKeys
+		sourceAddr = po.dialSourceAddr
+		iface = po.DialInterface
+		tcpOptions = po.ForwardTCPOptions
 		proxyProtoVersion = po.proxyProtocolVersion
+		proxyProtoTLVs = po.proxyProtocolTLVs
 		next = &be.state.oNext[id]
 	}
 
+	if id, ok := ctx.Value(ctxCanaryIDKey).(int); ok && id >= 0 && id < len(be.Canary) {
+		addresses = be.Canary[id].Addresses
+		next = &be.state.cNext[id]
+	}
+
 	if len(addresses) == 0 {
-		return nil, errors.New("no backend addresses")
+		return nil, errNoBackendAddresses
+	}
+	if addresses = be.draining.filter(addresses); len(addresses) == 0 {
+		return nil, errAllAddressesDraining
 	}
 	tc := &tls.Config{
 		InsecureSkipVerify:   insecureSkipVerify,
@@ -112,24 +193,66 @@ func (be *Backend) dial(ctx context.Context, protos ...string) (net.Conn, error)
 		NextProtos:           protos,
 		RootCAs:              rootCAs,
 		GetClientCertificate: be.getClientCert(ctx),
-		VerifyConnection: func(cs tls.ConnectionState) error {
-			if len(cs.PeerCertificates) == 0 {
-				return tlsCertificateRequired
-			}
-			cert := cs.PeerCertificates[0]
-			if m, ok := be.pkiMap[hex.EncodeToString(cert.AuthorityKeyId)]; ok {
-				if m.IsRevoked(cert.SerialNumber) {
-					return tlsCertificateRevoked
-				}
-			} else if len(cert.OCSPServer) > 0 {
-				if err := be.ocspCache.VerifyChains(ctx, cs.VerifiedChains, cs.OCSPResponse); err != nil {
-					be.recordEvent(fmt.Sprintf("backend X509 %s [%s] (OCSP:%v)", idnaToUnicode(cs.ServerName), cert.Subject, err))
-					return tlsCertificateRevoked
+		VerifyConnection:     be.verifyConnection(ctx, requireOCSP, requireSCT, pinnedKeys),
+	}
+	be.spiffeTLSConfig(tc)
+	dialOne := func(addr string) (net.Conn, error) {
+		if mode == ModeQUIC {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			tc := tc
+			if forwardDANE {
+				var err error
+				if tc, err = be.daneTLSConfig(ctx, tc, addr, "udp"); err != nil {
+					return nil, err
 				}
 			}
-			return nil
-		},
+			return be.dialQUICStream(ctx, addr, tc)
+		}
+		var c net.Conn
+		var err error
+		if strings.HasPrefix(addr, reverseTunnelPrefix) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			c, err = be.dialReverseTunnel(ctx, addr)
+		} else if tsAddr, ok := strings.CutPrefix(addr, tailscalePrefix); ok {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			c, err = be.tailscale.dial(ctx, tsAddr)
+		} else if be.wireGuard != nil {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			c, err = be.wireGuard.dial(ctx, addr)
+		} else if be.sshJump != nil {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			c, err = be.sshJump.dial(ctx, addr)
+		} else {
+			dialer := &net.Dialer{
+				Timeout:   timeout,
+				KeepAlive: 30 * time.Second,
+			}
+			if sourceAddr != nil {
+				dialer.LocalAddr = sourceAddr
+			}
+			if iface != "" {
+				dialer.Control = bindToDevice(iface)
+			}
+			c, err = newEyeballsDialer(dialer, sourceAddr, be.resolver).DialContext(ctx, "tcp", addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		setTCPOptions(c, tcpOptions)
+		if proxyProtoVersion > 0 {
+			if err := writeProxyHeader(proxyProtoVersion, proxyProtoTLVs, c, ctx.Value(connCtxKey).(anyConn)); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+		return c, nil
 	}
+
 	var max int
 	for {
 		be.state.mu.Lock()
@@ -137,29 +260,20 @@ func (be *Backend) dial(ctx context.Context, protos ...string) (net.Conn, error)
 		if max == 0 {
 			max = sz
 		}
-		addr := addresses[*next]
+		addr := addresses[*next%sz]
 		*next = (*next + 1) % sz
 		be.state.mu.Unlock()
 
 		var c net.Conn
-		var err error
-		if mode == ModeQUIC {
-			ctx, cancel := context.WithTimeout(ctx, timeout)
-			c, err = be.dialQUICStream(ctx, addr, tc)
-			cancel()
-		} else {
-			dialer := &net.Dialer{
-				Timeout:   timeout,
-				KeepAlive: 30 * time.Second,
+		var dialed string
+		targets, err := be.dialTargets(ctx, addr)
+		for i, target := range targets {
+			if c, err = dialOne(target); err == nil {
+				dialed = target
+				break
 			}
-			c, err = dialer.DialContext(ctx, "tcp", addr)
-			if err == nil {
-				setKeepAlive(c)
-				if proxyProtoVersion > 0 {
-					if err = writeProxyHeader(proxyProtoVersion, c, ctx.Value(connCtxKey).(anyConn)); err != nil {
-						c.Close()
-					}
-				}
+			if i < len(targets)-1 {
+				be.logErrorF("ERR dial %q: %v", target, err)
 			}
 		}
 		if err != nil {
@@ -171,6 +285,13 @@ func (be *Backend) dial(ctx context.Context, protos ...string) (net.Conn, error)
 			return nil, err
 		}
 		if mode == ModeTLS || mode == ModeHTTPS {
+			tc := tc
+			if forwardDANE {
+				if tc, err = be.daneTLSConfig(ctx, tc, strings.TrimPrefix(dialed, tailscalePrefix), "tcp"); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
 			c = tls.Client(c, tc)
 		}
 		wc := netw.NewConn(c)
@@ -193,21 +314,60 @@ func (be *Backend) dial(ctx context.Context, protos ...string) (net.Conn, error)
 	}
 }
 
-func writeProxyHeader(v byte, out io.Writer, in anyConn) error {
+const (
+	proxyTLVAuthority = "authority"
+	proxyTLVALPN      = "alpn"
+	proxyTLVUniqueID  = "unique-id"
+	proxyTLVSSL       = "ssl"
+)
+
+var validProxyTLVs = []string{
+	proxyTLVAuthority,
+	proxyTLVALPN,
+	proxyTLVUniqueID,
+	proxyTLVSSL,
+}
+
+func writeProxyHeader(v byte, tlvNames []string, out io.Writer, in anyConn) error {
 	header := proxyproto.HeaderProxyFromAddrs(v, in.RemoteAddr(), in.LocalAddr())
 	header.Command = proxyproto.PROXY
-	var tlvs []proxyproto.TLV
-	if sn := connServerName(in); sn != "" {
-		tlvs = append(tlvs, proxyproto.TLV{
-			Type:  proxyproto.PP2_TYPE_AUTHORITY,
-			Value: []byte(sn),
-		})
+	if v < 2 {
+		_, err := header.WriteTo(out)
+		return err
 	}
-	if proto := connProto(in); proto != "" {
-		tlvs = append(tlvs, proxyproto.TLV{
-			Type:  proxyproto.PP2_TYPE_ALPN,
-			Value: []byte(proto),
-		})
+	var tlvs []proxyproto.TLV
+	for _, name := range tlvNames {
+		switch name {
+		case proxyTLVAuthority:
+			if sn := connServerName(in); sn != "" {
+				tlvs = append(tlvs, proxyproto.TLV{
+					Type:  proxyproto.PP2_TYPE_AUTHORITY,
+					Value: []byte(sn),
+				})
+			}
+		case proxyTLVALPN:
+			if proto := connProto(in); proto != "" {
+				tlvs = append(tlvs, proxyproto.TLV{
+					Type:  proxyproto.PP2_TYPE_ALPN,
+					Value: []byte(proto),
+				})
+			}
+		case proxyTLVUniqueID:
+			if id := connID(in); id != "" {
+				tlvs = append(tlvs, proxyproto.TLV{
+					Type:  proxyproto.PP2_TYPE_UNIQUE_ID,
+					Value: []byte(id),
+				})
+			}
+		case proxyTLVSSL:
+			tlv, ok, err := proxySSLTLV(in)
+			if err != nil {
+				return err
+			}
+			if ok {
+				tlvs = append(tlvs, tlv)
+			}
+		}
 	}
 	if err := header.SetTLVs(tlvs); err != nil {
 		return err
@@ -218,29 +378,97 @@ func writeProxyHeader(v byte, out io.Writer, in anyConn) error {
 	return nil
 }
 
+// proxySSLTLV returns a PP2_TYPE_SSL TLV describing the TLS connection
+// terminated by the proxy. ok is false when the proxy didn't terminate TLS.
+func proxySSLTLV(in anyConn) (tlv proxyproto.TLV, ok bool, err error) {
+	var cs tls.ConnectionState
+	switch c := in.(type) {
+	case *tls.Conn:
+		cs = c.ConnectionState()
+	case interface{ TLSConnectionState() tls.ConnectionState }:
+		cs = c.TLSConnectionState()
+	default:
+		return tlv, false, nil
+	}
+	if !cs.HandshakeComplete {
+		return tlv, false, nil
+	}
+	ssl := tlvparse.PP2SSL{
+		Client: tlvparse.PP2_BITFIELD_CLIENT_SSL,
+		TLV: []proxyproto.TLV{
+			{
+				Type:  proxyproto.PP2_SUBTYPE_SSL_VERSION,
+				Value: []byte(tls.VersionName(cs.Version)),
+			},
+			{
+				Type:  proxyproto.PP2_SUBTYPE_SSL_CIPHER,
+				Value: []byte(tls.CipherSuiteName(cs.CipherSuite)),
+			},
+		},
+	}
+	if cert := connClientCert(in); cert != nil {
+		ssl.Client |= tlvparse.PP2_BITFIELD_CLIENT_CERT_CONN
+		ssl.TLV = append(ssl.TLV, proxyproto.TLV{
+			Type:  proxyproto.PP2_SUBTYPE_SSL_CN,
+			Value: []byte(cert.Subject.CommonName),
+		})
+	}
+	if tlv, err = ssl.Marshal(); err != nil {
+		return tlv, false, err
+	}
+	return tlv, true, nil
+}
+
 func (be *Backend) authorize(cert *x509.Certificate) error {
-	if be.ClientAuth == nil || be.ClientAuth.ACL == nil {
+	if be.ClientAuth == nil {
 		return nil
 	}
-	if subject := cert.Subject.String(); subject != "" && (slices.Contains(*be.ClientAuth.ACL, subject) || slices.Contains(*be.ClientAuth.ACL, "SUBJECT:"+subject)) {
+	if len(be.ClientAuth.SPIFFETrustDomains) > 0 {
+		if err := checkSPIFFETrustDomain(cert, be.ClientAuth.SPIFFETrustDomains); err != nil {
+			be.logErrorF("ERR SPIFFE [%s]: %v", cert.Subject, err)
+			return tlsAccessDenied
+		}
+	}
+	if be.ClientAuth.ACL == nil || certMatchesACL(cert, *be.ClientAuth.ACL) {
 		return nil
 	}
+	return tlsAccessDenied
+}
+
+// certMatchesACL returns true if the certificate matches any of the entries
+// in acl. See ClientAuth.ACL for the format of the entries.
+func certMatchesACL(cert *x509.Certificate, acl []string) bool {
+	if subject := cert.Subject.String(); subject != "" && (slices.Contains(acl, subject) || slices.Contains(acl, "SUBJECT:"+subject)) {
+		return true
+	}
 	for _, v := range cert.DNSNames {
-		if slices.Contains(*be.ClientAuth.ACL, "DNS:"+v) {
-			return nil
+		if slices.Contains(acl, "DNS:"+v) {
+			return true
 		}
 	}
 	for _, v := range cert.EmailAddresses {
-		if slices.Contains(*be.ClientAuth.ACL, "EMAIL:"+v) {
-			return nil
+		if slices.Contains(acl, "EMAIL:"+v) {
+			return true
 		}
 	}
 	for _, v := range cert.URIs {
-		if slices.Contains(*be.ClientAuth.ACL, "URI:"+v.String()) {
-			return nil
+		if slices.Contains(acl, "URI:"+v.String()) {
+			return true
 		}
 	}
-	return tlsAccessDenied
+	if id, err := spiffeID(cert); err == nil && matchSPIFFEACL(acl, id) {
+		return true
+	}
+	return slices.Contains(acl, spkiPin(cert))
+}
+
+// servedOn returns true if the backend is served on the listener with this
+// address. The empty address is TLSAddr.
+func (be *Backend) servedOn(address string) bool {
+	if address == "" {
+		return len(be.listenAddrs) == 0
+	}
+	return slices.Contains(be.listenAddrs, address)
 }
 
 func (be *Backend) checkIP(addr net.Addr) error {
@@ -271,6 +499,38 @@ func (be *Backend) checkIP(addr net.Addr) error {
 	return nil
 }
 
+// tarpit holds the connection open for the duration d, or until the client
+// closes it, while reading the incoming data one byte at a time.
+func tarpit(ctx context.Context, conn net.Conn, d time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	defer conn.SetReadDeadline(time.Time{})
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var b [1]byte
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := conn.Read(b[:]); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+	}
+}
+
+func (be *Backend) tlsHandshakeTimeout() time.Duration {
+	if be.TLSHandshakeTimeout > 0 {
+		return be.TLSHandshakeTimeout
+	}
+	return 2 * time.Minute
+}
+
 func (be *Backend) bridgeConns(client, server net.Conn) error {
 	serverClose := true
 	if be.ServerCloseEndsConnection != nil {
@@ -284,12 +544,20 @@ func (be *Backend) bridgeConns(client, server net.Conn) error {
 	if be.HalfCloseTimeout != nil {
 		timeout = *be.HalfCloseTimeout
 	}
+	var activity *atomic.Int64
+	if be.IdleTimeout > 0 {
+		activity = new(atomic.Int64)
+		activity.Store(time.Now().UnixNano())
+		done := make(chan struct{})
+		defer close(done)
+		go be.closeWhenIdle(done, activity, client, server)
+	}
 	ch := make(chan error)
 	go func() {
-		ch <- forward(client, server, serverClose, timeout)
+		ch <- forward(client, server, serverClose, timeout, activity, be.bufPool)
 	}()
 	var retErr error
-	if err := forward(server, client, clientClose, timeout); err != nil && !errors.Is(err, net.ErrClosed) {
+	if err := forward(server, client, clientClose, timeout, activity, be.bufPool); err != nil && !errors.Is(err, net.ErrClosed) {
 		retErr = fmt.Errorf("[ext➔ int]: %w", unwrapErr(err))
 	}
 	if err := <-ch; err != nil && !errors.Is(err, net.ErrClosed) {
@@ -298,8 +566,81 @@ func (be *Backend) bridgeConns(client, server net.Conn) error {
 	return retErr
 }
 
-func forward(out net.Conn, in net.Conn, closeWhenDone bool, halfClosedTimeout time.Duration) error {
-	if _, err := io.Copy(out, in); err != nil || closeWhenDone {
+// closeWhenIdle closes both connections when no data was received from either
+// of them for IdleTimeout.
+func (be *Backend) closeWhenIdle(done <-chan struct{}, activity *atomic.Int64, client, server net.Conn) {
+	timer := time.NewTimer(be.IdleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+		idle := time.Since(time.Unix(0, activity.Load()))
+		if idle < be.IdleTimeout {
+			timer.Reset(be.IdleTimeout - idle)
+			continue
+		}
+		be.recordEvent("idle timeout")
+		be.logConnF("INF %s idle timeout (%s)", client.RemoteAddr(), be.IdleTimeout)
+		client.Close()
+		server.Close()
+		return
+	}
+}
+
+// bufferPool is a pool of fixed-size buffers used to copy data between
+// connections. It implements httputil.BufferPool.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{size: size}
+}
+
+func (p *bufferPool) Get() []byte {
+	if b, ok := p.pool.Get().(*[]byte); ok {
+		return *b
+	}
+	return make([]byte, p.size)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	if cap(b) != p.size {
+		return
+	}
+	b = b[:p.size]
+	p.pool.Put(&b)
+}
+
+// activityReader records the time of the last successful read.
+type activityReader struct {
+	r    io.Reader
+	last *atomic.Int64
+}
+
+func (r activityReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func forward(out net.Conn, in net.Conn, closeWhenDone bool, halfClosedTimeout time.Duration, activity *atomic.Int64, bufPool *bufferPool) error {
+	var r io.Reader = in
+	if activity != nil {
+		r = activityReader{r: in, last: activity}
+	}
+	var buf []byte
+	if bufPool != nil {
+		buf = bufPool.Get()
+		defer bufPool.Put(buf)
+	}
+	if _, err := io.CopyBuffer(out, r, buf); err != nil || closeWhenDone {
 		out.Close()
 		in.Close()
 		return err
@@ -0,0 +1,265 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+func TestBridgeConnsIdleTimeout(t *testing.T) {
+	be := &Backend{
+		IdleTimeout: 200 * time.Millisecond,
+		recordEvent: func(string) {},
+	}
+	extClient, client := net.Pipe()
+	server, extServer := net.Pipe()
+	go io.Copy(io.Discard, extServer)
+
+	done := make(chan struct{})
+	go func() {
+		be.bridgeConns(client, server)
+		close(done)
+	}()
+
+	// Keep the connection active for longer than IdleTimeout.
+	for range 5 {
+		if _, err := extClient.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("bridgeConns returned while connection was active")
+	default:
+	}
+
+	// Then stop sending data.
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("bridgeConns didn't return after IdleTimeout")
+	}
+}
+
+func TestBridgeConnsBufferSize(t *testing.T) {
+	be := &Backend{
+		bufPool:     newBufferPool(1024),
+		recordEvent: func(string) {},
+	}
+	extClient, client := net.Pipe()
+	server, extServer := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		be.bridgeConns(client, server)
+		close(done)
+	}()
+
+	want := make([]byte, 10000)
+	for i := range want {
+		want[i] = byte(i)
+	}
+	go func() {
+		extClient.Write(want)
+		extClient.Close()
+	}()
+	got, err := io.ReadAll(extServer)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Got %d bytes, want %d", len(got), len(want))
+	}
+	extServer.Close()
+	<-done
+
+	if b := be.bufPool.Get(); len(b) != 1024 {
+		t.Errorf("len(buf) = %d, want 1024", len(b))
+	}
+}
+
+func TestTarpit(t *testing.T) {
+	client, server := net.Pipe()
+	go io.Copy(io.Discard, client)
+
+	start := time.Now()
+	tarpit(t.Context(), server, 1500*time.Millisecond)
+	if d := time.Since(start); d < 1500*time.Millisecond {
+		t.Errorf("tarpit returned after %s", d)
+	}
+
+	client, server = net.Pipe()
+	client.Close()
+	start = time.Now()
+	tarpit(t.Context(), server, time.Minute)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("tarpit returned after %s", d)
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newHTTPServer(t, ctx, "backend", nil)
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames:       []string{"http.example.com"},
+				Addresses:         []string{be.String()},
+				Mode:              "HTTP",
+				ReadHeaderTimeout: 200 * time.Millisecond,
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	conn, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+		ServerName: "http.example.com",
+		RootCAs:    extCA.RootCACertPool(),
+	})
+	if err != nil {
+		t.Fatalf("tls.Dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\n")); err != nil {
+		t.Fatalf("conn.Write: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("io.ReadAll: %v", err)
+	}
+}
+
+func TestWriteProxyHeaderTLVs(t *testing.T) {
+	cm, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	clientConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	serverConn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	nc := netw.NewConn(serverConn)
+	server := tls.Server(nc, cm.TLSConfig())
+	client := tls.Client(clientConn, &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    cm.RootCACertPool(),
+	})
+	defer client.Close()
+	defer server.Close()
+	go client.Handshake()
+	if err := server.Handshake(); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	nc.SetAnnotation(serverNameKey, "example.com")
+	nc.SetAnnotation(protoKey, "h2")
+	nc.SetAnnotation(connIDKey, "abcd1234")
+
+	var buf bytes.Buffer
+	if err := writeProxyHeader(2, validProxyTLVs, &buf, server); err != nil {
+		t.Fatalf("writeProxyHeader: %v", err)
+	}
+	header, err := proxyproto.Read(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("proxyproto.Read: %v", err)
+	}
+	tlvs, err := header.TLVs()
+	if err != nil {
+		t.Fatalf("TLVs: %v", err)
+	}
+	got := make(map[proxyproto.PP2Type]string)
+	for _, tlv := range tlvs {
+		got[tlv.Type] = string(tlv.Value)
+	}
+	if want := "example.com"; got[proxyproto.PP2_TYPE_AUTHORITY] != want {
+		t.Errorf("Authority = %q, want %q", got[proxyproto.PP2_TYPE_AUTHORITY], want)
+	}
+	if want := "h2"; got[proxyproto.PP2_TYPE_ALPN] != want {
+		t.Errorf("ALPN = %q, want %q", got[proxyproto.PP2_TYPE_ALPN], want)
+	}
+	if want := "abcd1234"; got[proxyproto.PP2_TYPE_UNIQUE_ID] != want {
+		t.Errorf("UniqueID = %q, want %q", got[proxyproto.PP2_TYPE_UNIQUE_ID], want)
+	}
+	ssl, ok := tlvparse.FindSSL(tlvs)
+	if !ok {
+		t.Fatal("SSL TLV not found")
+	}
+	if !ssl.ClientSSL() {
+		t.Errorf("ClientSSL = false, want true")
+	}
+	if v, ok := ssl.SSLVersion(); !ok || v != "TLS 1.3" {
+		t.Errorf("SSLVersion = %q, want %q", v, "TLS 1.3")
+	}
+
+	// Only the requested TLVs are sent.
+	buf.Reset()
+	if err := writeProxyHeader(2, []string{proxyTLVUniqueID}, &buf, server); err != nil {
+		t.Fatalf("writeProxyHeader: %v", err)
+	}
+	if header, err = proxyproto.Read(bufio.NewReader(&buf)); err != nil {
+		t.Fatalf("proxyproto.Read: %v", err)
+	}
+	if tlvs, err = header.TLVs(); err != nil {
+		t.Fatalf("TLVs: %v", err)
+	}
+	if len(tlvs) != 1 || tlvs[0].Type != proxyproto.PP2_TYPE_UNIQUE_ID {
+		t.Errorf("TLVs = %v, want only unique-id", tlvs)
+	}
+}
@@ -0,0 +1,406 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const maxBackendAPIBodySize = 1 << 20
+
+// errAPIBackendsNotLoaded is returned when the backend API's file exists but
+// couldn't be loaded. The API doesn't overwrite it.
+var errAPIBackendsNotLoaded = errors.New("the registered backends couldn't be loaded")
+
+// loadAPIBackends loads the backends that were registered with the backend
+// API. p.dynMu must be held.
+func (p *Proxy) loadAPIBackends(api *ConfigBackendAPI) {
+	if api == nil {
+		p.apiEnabled = false
+		p.apiFile = ""
+		p.apiBackends = nil
+		return
+	}
+	if p.apiEnabled && api.File == p.apiFile && !p.apiLoadFailed {
+		return
+	}
+	p.apiEnabled = true
+	p.apiFile = api.File
+	p.apiBackends = nil
+	p.apiLoadFailed = false
+	if api.File == "" {
+		return
+	}
+	b, err := os.ReadFile(api.File)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		p.apiLoadFailed = true
+		p.logErrorF("ERR backendApi: %v", err)
+		return
+	}
+	backends, err := parseBackends(b)
+	if err != nil {
+		p.apiLoadFailed = true
+		p.logErrorF("ERR backendApi: %s: %v", api.File, err)
+		return
+	}
+	m := make(map[string]*Backend, len(backends))
+	for _, be := range backends {
+		if be.Name == "" || m[be.Name] != nil {
+			p.apiLoadFailed = true
+			p.logErrorF("ERR backendApi: %s: invalid or duplicate backend name %q", api.File, be.Name)
+			return
+		}
+		m[be.Name] = be
+	}
+	p.apiBackends = m
+}
+
+// apiBackendsYAML returns the registered backends in YAML, sorted by name.
+func apiBackendsYAML(m map[string]*Backend) ([]byte, error) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	backends := make([]*Backend, 0, len(names))
+	for _, name := range names {
+		backends = append(backends, m[name])
+	}
+	return yaml.Marshal(backends)
+}
+
+// saveAPIBackends saves the registered backends to the backend API's file, if
+// any. p.dynMu must be held.
+func (p *Proxy) saveAPIBackends() error {
+	if p.apiFile == "" {
+		return nil
+	}
+	b, err := apiBackendsYAML(p.apiBackends)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p.apiFile), ".backends-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p.apiFile)
+}
+
+// backendAPIHandler returns the handler of the backend registration API.
+func (p *Proxy) backendAPIHandler(api ConfigBackendAPI) http.Handler {
+	_, _, prefix, _ := hostAndPath(api.Endpoint)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		who, ok := p.authorizeBackendAPI(api, req)
+		if !ok {
+			p.recordEvent("backend api: unauthorized")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		name := strings.Trim(strings.TrimPrefix(req.URL.Path, prefix), "/")
+		if strings.Contains(name, "/") {
+			http.NotFound(w, req)
+			return
+		}
+		switch {
+		case req.Method == http.MethodGet && name == "":
+			p.dynMu.Lock()
+			b, err := apiBackendsYAML(p.apiBackends)
+			p.dynMu.Unlock()
+			if err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/yaml")
+			w.Write(b)
+		case req.Method == http.MethodGet:
+			p.dynMu.Lock()
+			be := p.apiBackends[name]
+			var b []byte
+			var err error
+			if be != nil {
+				b, err = yaml.Marshal(be)
+			}
+			p.dynMu.Unlock()
+			if be == nil {
+				http.NotFound(w, req)
+				return
+			}
+			if err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/yaml")
+			w.Write(b)
+		case req.Method == http.MethodPut && name != "":
+			body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBackendAPIBodySize))
+			if err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+			be, err := parseAPIBackend(body, name, api.AllowedServerNames)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := p.updateAPIBackend(name, be); err != nil {
+				if errors.Is(err, errAPIBackendsNotLoaded) {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			p.recordEvent("backend api: backend registered")
+			p.logErrorF("INF backendApi: backend %q registered by %s", name, who)
+			w.Write([]byte("ok\n"))
+		case req.Method == http.MethodDelete && name != "":
+			if err := p.updateAPIBackend(name, nil); err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					http.NotFound(w, req)
+					return
+				}
+				if errors.Is(err, errAPIBackendsNotLoaded) {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			p.recordEvent("backend api: backend removed")
+			p.logErrorF("INF backendApi: backend %q removed by %s", name, who)
+			w.Write([]byte("ok\n"))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// authorizeBackendAPI checks the request's token or client certificate. It
+// returns a description of the client.
+func (p *Proxy) authorizeBackendAPI(api ConfigBackendAPI, req *http.Request) (string, bool) {
+	if api.token != "" {
+		if tok, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok && subtle.ConstantTimeCompare([]byte(tok), []byte(api.token)) == 1 {
+			return "token", true
+		}
+	}
+	if len(api.ACL) > 0 {
+		conn, ok := req.Context().Value(connCtxKey).(anyConn)
+		if !ok {
+			return "", false
+		}
+		if cert := connClientCert(conn); cert != nil && certMatchesACL(cert, api.ACL) {
+			return fmt.Sprintf("[%s]", certSummary(cert)), true
+		}
+	}
+	return "", false
+}
+
+// apiBackend is the subset of Backend that the backend API accepts. The other
+// fields can refer to local files, or use the proxy's own credentials, e.g.
+// DialSSH, and are reserved for the config file.
+type apiBackend struct {
+	Name                 string            `yaml:"name,omitempty"`
+	ServerNames          []string          `yaml:"serverNames"`
+	Mode                 string            `yaml:"mode"`
+	Addresses            []string          `yaml:"addresses,omitempty"`
+	AllowIPs             *[]string         `yaml:"allowIPs,omitempty"`
+	DenyIPs              *[]string         `yaml:"denyIPs,omitempty"`
+	ALPNProtos           *[]string         `yaml:"alpnProtos,flow,omitempty"`
+	BackendProto         *string           `yaml:"backendProto,omitempty"`
+	InsecureSkipVerify   bool              `yaml:"insecureSkipVerify,omitempty"`
+	ForwardRateLimit     int               `yaml:"forwardRateLimit,omitempty"`
+	ForwardServerName    string            `yaml:"forwardServerName,omitempty"`
+	ForwardTimeout       time.Duration     `yaml:"forwardTimeout,omitempty"`
+	ForwardHTTPHeaders   map[string]string `yaml:"forwardHttpHeaders,omitempty"`
+	ProxyProtocolVersion string            `yaml:"proxyProtocolVersion,omitempty"`
+	SanitizePath         *bool             `yaml:"sanitizePath,omitempty"`
+	IdleTimeout          time.Duration     `yaml:"idleTimeout,omitempty"`
+}
+
+// apiBackendModes are the modes that the backend API accepts. LOCAL and
+// CONSOLE backends expose the proxy's own handlers.
+var apiBackendModes = []string{
+	"",
+	ModePlaintext,
+	ModeTCP,
+	ModeTLS,
+	ModeTLSPassthrough,
+	ModeQUIC,
+	ModeHTTP,
+	ModeHTTPS,
+}
+
+// parseAPIBackend parses a backend sent to the backend API. Only the fields of
+// apiBackend are accepted, and all the server names must be allowed.
+func parseAPIBackend(body []byte, name string, allowed []string) (*Backend, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(body))
+	dec.KnownFields(true)
+	var ab apiBackend
+	if err := dec.Decode(&ab); err != nil {
+		return nil, fmt.Errorf("invalid backend: %v", err)
+	}
+	if ab.Name == "" {
+		ab.Name = name
+	}
+	if ab.Name != name {
+		return nil, fmt.Errorf("backend name %q doesn't match %q", ab.Name, name)
+	}
+	if !slices.Contains(apiBackendModes, strings.ToUpper(ab.Mode)) {
+		return nil, fmt.Errorf("mode %q is not allowed", ab.Mode)
+	}
+	if len(ab.ServerNames) == 0 {
+		return nil, errors.New("serverNames must be set")
+	}
+	for _, sn := range ab.ServerNames {
+		if !serverNameAllowed(sn, allowed) {
+			return nil, fmt.Errorf("server name %q is not allowed", sn)
+		}
+	}
+	return &Backend{
+		Name:                 ab.Name,
+		ServerNames:          ab.ServerNames,
+		Mode:                 ab.Mode,
+		Addresses:            ab.Addresses,
+		AllowIPs:             ab.AllowIPs,
+		DenyIPs:              ab.DenyIPs,
+		ALPNProtos:           ab.ALPNProtos,
+		BackendProto:         ab.BackendProto,
+		InsecureSkipVerify:   ab.InsecureSkipVerify,
+		ForwardRateLimit:     ab.ForwardRateLimit,
+		ForwardServerName:    ab.ForwardServerName,
+		ForwardTimeout:       ab.ForwardTimeout,
+		ForwardHTTPHeaders:   ab.ForwardHTTPHeaders,
+		ProxyProtocolVersion: ab.ProxyProtocolVersion,
+		SanitizePath:         ab.SanitizePath,
+		IdleTimeout:          ab.IdleTimeout,
+	}, nil
+}
+
+// serverNameAllowed returns true if the server name matches one of the
+// patterns, which are either exact names or *.suffix.
+func serverNameAllowed(serverName string, patterns []string) bool {
+	serverName = strings.ToLower(idnaToASCII(serverName))
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if suffix, ok := strings.CutPrefix(p, "*."); ok {
+			suffix = idnaToASCII(suffix)
+			if strings.HasSuffix(serverName, "."+suffix) {
+				return true
+			}
+			continue
+		}
+		if serverName == idnaToASCII(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateAPIBackend adds, replaces, or removes (when be is nil) a registered
+// backend, and reconfigures the proxy. The new backend is checked with the
+// rest of the config, including the other dynamic backends, before it is
+// registered.
+func (p *Proxy) updateAPIBackend(name string, be *Backend) error {
+	p.dynMu.Lock()
+	cfg := p.userCfg
+	if cfg == nil || !p.apiEnabled {
+		p.dynMu.Unlock()
+		return errors.New("not configured")
+	}
+	if p.apiLoadFailed {
+		p.dynMu.Unlock()
+		return errAPIBackendsNotLoaded
+	}
+	m := make(map[string]*Backend, len(p.apiBackends)+1)
+	for k, v := range p.apiBackends {
+		m[k] = v
+	}
+	if be == nil {
+		if m[name] == nil {
+			p.dynMu.Unlock()
+			return fs.ErrNotExist
+		}
+		delete(m, name)
+	} else {
+		m[name] = be
+		if err := p.checkAPIBackends(cfg, m); err != nil {
+			p.dynMu.Unlock()
+			return err
+		}
+	}
+	p.apiBackends = m
+	if err := p.saveAPIBackends(); err != nil {
+		p.logErrorF("ERR backendApi: %v", err)
+	}
+	p.dynMu.Unlock()
+
+	return p.Reconfigure(cfg)
+}
+
+// checkAPIBackends checks the registered backends m with cfg and the remote
+// backends, like addDynamicBackends does. It returns an error if a backend
+// that is valid with the current registered backends isn't valid with m.
+// p.dynMu must be held.
+func (p *Proxy) checkAPIBackends(cfg *Config, m map[string]*Backend) error {
+	base := cfg.clone()
+	if cfg.RemoteBackends != "" && len(p.remoteBackends) > 0 {
+		p.appendRemoteBackends(base)
+	}
+	before := appendAPIBackends(base.clone(), p.apiBackends)
+	after := appendAPIBackends(base, m)
+	for _, name := range slices.Sorted(maps.Keys(after)) {
+		if _, ok := before[name]; !ok || p.apiBackends[name] != m[name] {
+			return fmt.Errorf("%s: %v", name, after[name])
+		}
+	}
+	return nil
+}
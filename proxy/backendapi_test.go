@@ -0,0 +1,318 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestBackendAPI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	intCA, err := certmanager.New("internal-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "backends.yaml")
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		BackendAPI: &ConfigBackendAPI{
+			Endpoint:           "https://admin.example.com/backends",
+			ACL:                []string{"DNS:deployer"},
+			AllowedServerNames: []string{"*.preview.example.com"},
+			File:               file,
+		},
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"admin.example.com"},
+				Mode:        "CONSOLE",
+				ClientAuth: &ClientAuth{
+					RootCAs: []string{intCA.RootCAPEM()},
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	do := func(method, path, body, certName string) string {
+		t.Helper()
+		c, err := intCA.GetCert(certName)
+		if err != nil {
+			t.Fatalf("intCA.GetCert: %v", err)
+		}
+		var rc io.ReadCloser
+		if body != "" {
+			rc = io.NopCloser(strings.NewReader(body))
+		}
+		got, _, err := httpOp("admin.example.com", proxy.listener.Addr().String(), path, method, rc, extCA, []tls.Certificate{*c})
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		return got
+	}
+	waitFor := func(sn, want string) {
+		t.Helper()
+		for i := 0; ; i++ {
+			got, _, _ := tlsGet(sn, proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil)
+			if got == want {
+				return
+			}
+			if i == 100 {
+				t.Fatalf("tlsGet(%q) = %q, want %q", sn, got, want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	pr1 := "serverNames: [pr1.preview.example.com]\nmode: tcp\naddresses: [" + be1.listener.Addr().String() + "]\n"
+	for _, tc := range []struct {
+		method, path, body, certName, want string
+	}{
+		{"PUT", "/backends/pr1", pr1, "intruder", "HTTP/2.0 401 Unauthorized"},
+		{"PUT", "/backends/pr1", pr1, "deployer", "HTTP/2.0 200 OK"},
+		{"PUT", "/backends/pr2", pr1, "deployer", "HTTP/2.0 400 Bad Request"},
+		{"PUT", "/backends/pr3", "serverNames: [www.example.com]\nmode: tcp\naddresses: [127.0.0.1:1]\n", "deployer", "HTTP/2.0 400 Bad Request"},
+		{"PUT", "/backends/pr4", "name: other\nserverNames: [pr4.preview.example.com]\nmode: tcp\naddresses: [127.0.0.1:1]\n", "deployer", "HTTP/2.0 400 Bad Request"},
+		{"PUT", "/backends/pr5", "serverNames: [pr5.preview.example.com]\nmode: console\n", "deployer", "HTTP/2.0 400 Bad Request"},
+		{"GET", "/backends", "", "deployer", "HTTP/2.0 200 OK"},
+		{"GET", "/backends/pr1", "", "deployer", "HTTP/2.0 200 OK"},
+		{"GET", "/backends/pr2", "", "deployer", "HTTP/2.0 404 Not Found"},
+	} {
+		if got := do(tc.method, tc.path, tc.body, tc.certName); !strings.HasPrefix(got, tc.want) {
+			t.Errorf("%s %s = %q, want %q", tc.method, tc.path, got, tc.want)
+		}
+	}
+	waitFor("pr1.preview.example.com", "Hello from backend1\n")
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !strings.Contains(string(b), "pr1.preview.example.com") {
+		t.Errorf("File = %q, want pr1.preview.example.com", b)
+	}
+
+	// The registered backends survive a config change.
+	cfg2 := *cfg
+	cfg2.MaxOpen = 200
+	if err := proxy.Reconfigure(&cfg2); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	waitFor("pr1.preview.example.com", "Hello from backend1\n")
+
+	if got, want := do("DELETE", "/backends/pr1", "", "deployer"), "HTTP/2.0 200 OK"; !strings.HasPrefix(got, want) {
+		t.Errorf("DELETE = %q, want %q", got, want)
+	}
+	if got, want := do("DELETE", "/backends/pr1", "", "deployer"), "HTTP/2.0 404 Not Found"; !strings.HasPrefix(got, want) {
+		t.Errorf("DELETE = %q, want %q", got, want)
+	}
+	waitFor("pr1.preview.example.com", "")
+}
+
+func TestBackendAPIToken(t *testing.T) {
+	api := ConfigBackendAPI{token: "secret"}
+	p := &Proxy{}
+	for _, tc := range []struct {
+		auth string
+		want bool
+	}{
+		{"", false},
+		{"Bearer wrong", false},
+		{"Basic secret", false},
+		{"Bearer secret", true},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/backends", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		if _, got := p.authorizeBackendAPI(api, req); got != tc.want {
+			t.Errorf("authorizeBackendAPI(%q) = %v, want %v", tc.auth, got, tc.want)
+		}
+	}
+}
+
+func TestParseAPIBackend(t *testing.T) {
+	allowed := []string{"*.preview.example.com"}
+	for _, tc := range []struct {
+		body    string
+		wantErr bool
+	}{
+		{"serverNames: [pr1.preview.example.com]\nmode: http\naddresses: [192.168.0.1:80]\n", false},
+		{"serverNames: [pr1.preview.example.com]\naddresses: [192.168.0.1:22]\nforwardTimeout: 10s\n", false},
+		{"serverNames: [www.example.com]\nmode: http\naddresses: [192.168.0.1:80]\n", true},
+		{"mode: http\naddresses: [192.168.0.1:80]\n", true},
+		{"serverNames: [pr1.preview.example.com]\nmode: local\n", true},
+		{"serverNames: [pr1.preview.example.com]\nmode: console\n", true},
+		{"serverNames: [pr1.preview.example.com]\nmode: tcp\naddresses: [127.0.0.1:22]\ndialSsh:\n  address: bastion:22\n  keyFile: /etc/ssh/ssh_host_ed25519_key\n", true},
+		{"serverNames: [pr1.preview.example.com]\nmode: http\nforwardRootCAs: [/etc/ssl/private/ca.pem]\n", true},
+		{"serverNames: [pr1.preview.example.com]\nmode: http\nclientAuth:\n  rootCAs: [/etc/ssl/private/ca.pem]\n", true},
+		{"serverNames: [pr1.preview.example.com]\nmode: http\nerrorPageTemplate: /etc/shadow\n", true},
+	} {
+		be, err := parseAPIBackend([]byte(tc.body), "pr1", allowed)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseAPIBackend(%q) = %v, wantErr %v", tc.body, err, tc.wantErr)
+			continue
+		}
+		if err == nil && be.Name != "pr1" {
+			t.Errorf("parseAPIBackend(%q).Name = %q, want pr1", tc.body, be.Name)
+		}
+	}
+}
+
+func TestServerNameAllowed(t *testing.T) {
+	patterns := []string{"*.preview.example.com", "www.example.com"}
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"pr1.preview.example.com", true},
+		{"PR1.Preview.Example.com", true},
+		{"preview.example.com", false},
+		{"www.example.com", true},
+		{"example.com", false},
+		{"evilpreview.example.com", false},
+	} {
+		if got := serverNameAllowed(tc.name, patterns); got != tc.want {
+			t.Errorf("serverNameAllowed(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBackendAPIDynamicBackends(t *testing.T) {
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "backends.yaml")
+	cfg := &Config{
+		HTTPAddr:       "localhost:0",
+		TLSAddr:        "localhost:0",
+		CacheDir:       t.TempDir(),
+		MaxOpen:        100,
+		RemoteBackends: "consul://localhost:1/tlsproxy/backends",
+		BackendAPI: &ConfigBackendAPI{
+			Endpoint:           "https://admin.example.com/backends",
+			ACL:                []string{"DNS:deployer"},
+			AllowedServerNames: []string{"*.preview.example.com"},
+			File:               file,
+		},
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"admin.example.com"},
+				Mode:        "CONSOLE",
+				ClientAuth: &ClientAuth{
+					RootCAs: []string{extCA.RootCAPEM()},
+				},
+			},
+		},
+	}
+	if err := cfg.Check(); err != nil {
+		t.Fatalf("cfg.Check: %v", err)
+	}
+	if err := os.WriteFile(file, []byte(""+
+		"- name: a\n  serverNames: [a.preview.example.com]\n  mode: tcp\n  addresses: [127.0.0.1:1]\n"+
+		"- name: b\n  serverNames: [remote.preview.example.com]\n  mode: tcp\n  addresses: [127.0.0.1:1]\n"+
+		"- name: c\n  serverNames: [c.preview.example.com]\n  mode: tcp\n  addresses: [127.0.0.1:1]\n",
+	), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	proxy := newTestProxy(cfg, extCA)
+	proxy.dynMu.Lock()
+	proxy.remoteBackends = []byte("- serverNames: [remote.preview.example.com]\n  mode: tcp\n  addresses: [127.0.0.1:1]\n")
+	proxy.dynMu.Unlock()
+
+	// A registered backend that conflicts with a remote backend is
+	// dropped, and the others are kept.
+	out := proxy.addDynamicBackends(cfg)
+	var got []string
+	for _, be := range out.Backends {
+		got = append(got, be.ServerNames...)
+	}
+	if want := []string{"admin.example.com", "remote.preview.example.com", "a.preview.example.com", "c.preview.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("ServerNames = %q, want %q", got, want)
+	}
+
+	// A new backend is checked with the remote backends.
+	be, err := parseAPIBackend([]byte("serverNames: [remote.preview.example.com]\nmode: tcp\naddresses: [127.0.0.1:1]\n"), "d", cfg.BackendAPI.AllowedServerNames)
+	if err != nil {
+		t.Fatalf("parseAPIBackend: %v", err)
+	}
+	if err := proxy.updateAPIBackend("d", be); err == nil {
+		t.Error("updateAPIBackend(d) succeeded, want error")
+	}
+
+	// The file isn't overwritten when it couldn't be loaded.
+	file2 := filepath.Join(filepath.Dir(file), "backends2.yaml")
+	bad := []byte("not: [a list\n")
+	if err := os.WriteFile(file2, bad, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	api := *cfg.BackendAPI
+	api.File = file2
+	cfg2 := *cfg
+	cfg2.BackendAPI = &api
+	proxy.addDynamicBackends(&cfg2)
+	be, err = parseAPIBackend([]byte("serverNames: [e.preview.example.com]\nmode: tcp\naddresses: [127.0.0.1:1]\n"), "e", cfg.BackendAPI.AllowedServerNames)
+	if err != nil {
+		t.Fatalf("parseAPIBackend: %v", err)
+	}
+	if err := proxy.updateAPIBackend("e", be); !errors.Is(err, errAPIBackendsNotLoaded) {
+		t.Errorf("updateAPIBackend(e) = %v, want %v", err, errAPIBackendsNotLoaded)
+	}
+	if err := proxy.updateAPIBackend("a", nil); !errors.Is(err, errAPIBackendsNotLoaded) {
+		t.Errorf("updateAPIBackend(a, nil) = %v, want %v", err, errAPIBackendsNotLoaded)
+	}
+	if b, err := os.ReadFile(file2); err != nil || !bytes.Equal(b, bad) {
+		t.Errorf("File = %q, %v, want %q", b, err, bad)
+	}
+}
@@ -0,0 +1,143 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestCanaryRouting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	stable := newHTTPServer(t, ctx, "stable", nil)
+	canary := newHTTPServer(t, ctx, "canary", nil)
+	other := newHTTPServer(t, ctx, "other", nil)
+
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{
+						"www.example.com",
+					},
+					Addresses: []string{
+						stable.String(),
+					},
+					Mode: "HTTP",
+					PathOverrides: []*PathOverride{
+						{
+							Paths:     []string{"/other/"},
+							Addresses: []string{other.String()},
+						},
+					},
+					Canary: []*CanaryRoute{
+						{
+							Header:    "X-Canary",
+							Value:     "1",
+							Addresses: []string{canary.String()},
+						},
+						{
+							Cookie:    "canary",
+							Addresses: []string{canary.String()},
+						},
+					},
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialTLSContext: func(context.Context, string, string) (net.Conn, error) {
+				return tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+					ServerName: "www.example.com",
+					RootCAs:    extCA.RootCACertPool(),
+					NextProtos: []string{"h2", "http/1.1"},
+				})
+			},
+			ForceAttemptHTTP2: true,
+		},
+		Timeout: 5 * time.Second,
+	}
+	get := func(path string, hdr http.Header) string {
+		req, err := http.NewRequest("GET", "https://www.example.com"+path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("client.Do: %v", err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		return string(b)
+	}
+
+	for _, tc := range []struct {
+		path string
+		hdr  http.Header
+		want string
+	}{
+		{"/", nil, "[stable] /\n"},
+		{"/", http.Header{"X-Canary": {"1"}}, "[canary] /\n"},
+		{"/", http.Header{"X-Canary": {"0"}}, "[stable] /\n"},
+		{"/", http.Header{"Cookie": {"canary=yes"}}, "[canary] /\n"},
+		{"/", http.Header{"Cookie": {"canary="}}, "[stable] /\n"},
+		{"/other/", nil, "[other] /other/\n"},
+		{"/other/", http.Header{"X-Canary": {"1"}}, "[canary] /other/\n"},
+		{"/", nil, "[stable] /\n"},
+	} {
+		if got := get(tc.path, tc.hdr); got != tc.want {
+			t.Errorf("GET %s %v = %q, want %q", tc.path, tc.hdr, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c2FmZQ/storage/autocertcache"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const maxACMEHistory = 100
+
+// acmeReissuedKey is the cache key where the time of the last re-issuance is
+// saved, so that all the instances of a cluster reload their certificates.
+const acmeReissuedKey = "tlsproxy_reissued"
+
+// acmeHistory contains the recent ACME events, for troubleshooting. It is not
+// affected by configuration changes.
+type acmeHistory struct {
+	mu      sync.Mutex
+	entries []acmeHistoryEntry
+}
+
+type acmeHistoryEntry struct {
+	Time       time.Time `json:"time"`
+	ServerName string    `json:"serverName"`
+	Event      string    `json:"event"`
+	Detail     string    `json:"detail,omitempty"`
+	// Count is the number of times that the same event happened in a
+	// row.
+	Count int `json:"count"`
+}
+
+func (h *acmeHistory) add(serverName, event, detail string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now().UTC()
+	if n := len(h.entries); n > 0 {
+		if e := &h.entries[n-1]; e.ServerName == serverName && e.Event == event && e.Detail == detail {
+			e.Time = now
+			e.Count++
+			return
+		}
+	}
+	h.entries = append(h.entries, acmeHistoryEntry{
+		Time:       now,
+		ServerName: idnaToUnicode(serverName),
+		Event:      event,
+		Detail:     detail,
+		Count:      1,
+	})
+	if n := len(h.entries); n > maxACMEHistory {
+		h.entries = slices.Delete(h.entries, 0, n-maxACMEHistory)
+	}
+}
+
+func (h *acmeHistory) list() []acmeHistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.entries)
+}
+
+// acmeHistoryCache records the certificates that autocert saves in its
+// cache, i.e. the ones that it obtains from the ACME server.
+type acmeHistoryCache struct {
+	*autocertcache.Cache
+	history *acmeHistory
+}
+
+func (c *acmeHistoryCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := c.Cache.Put(ctx, key, data); err != nil {
+		return err
+	}
+	if key == acmeAccountKey || key == acmeReissuedKey || strings.HasSuffix(key, "+token") || strings.HasSuffix(key, "+http-01") {
+		return nil
+	}
+	var detail string
+	for {
+		var b *pem.Block
+		if b, data = pem.Decode(data); b == nil {
+			break
+		}
+		if b.Type != "CERTIFICATE" {
+			continue
+		}
+		if leaf, err := x509.ParseCertificate(b.Bytes); err == nil {
+			detail = fmt.Sprintf("serial %X, expires %s", leaf.SerialNumber, leaf.NotAfter.UTC().Format(time.RFC3339))
+		}
+		break
+	}
+	c.history.add(strings.TrimSuffix(key, "+rsa"), "certificate obtained", detail)
+	return nil
+}
+
+// getACMECert returns the certificate for hello from the autocert manager
+// that replaced the main one after a re-issuance, if any, or from getCert.
+// The errors are recorded in the ACME history.
+func (p *Proxy) getACMECert(hello *tls.ClientHelloInfo, getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*tls.Certificate, error) {
+	p.acmeMu.Lock()
+	if m := p.acmeManager; m != nil {
+		getCert = m.GetCertificate
+	}
+	p.acmeMu.Unlock()
+	cert, err := getCert(hello)
+	if err != nil && hello.ServerName != "" {
+		if _, ok := p.certManager.(*autocert.Manager); ok {
+			p.acmeHistory.add(hello.ServerName, "error", err.Error())
+		}
+	}
+	return cert, err
+}
+
+// reissueCertificate deletes the cached certificate for serverName, and
+// obtains a new one in the background.
+//
+// The autocert manager keeps the certificates in memory, and renews them on
+// its own. It is replaced with a new manager that loads the certificates
+// from the cache again. The other instances of a cluster do the same when
+// they see the new value of acmeReissuedKey.
+func (p *Proxy) reissueCertificate(ctx context.Context, serverName string) error {
+	if _, ok := p.certManager.(*autocert.Manager); !ok {
+		return fmt.Errorf("not implemented with %T", p.certManager)
+	}
+	cache, err := p.acmeCache()
+	if err != nil {
+		return err
+	}
+	if err := cache.DeleteKeys(ctx, []string{serverName, serverName + "+rsa"}); err != nil {
+		return err
+	}
+	now := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	if err := cache.Put(ctx, acmeReissuedKey, now); err != nil {
+		return err
+	}
+	p.resetACMEManager(string(now))
+
+	go func() {
+		if _, err := p.getACMECert(acmeHello(serverName), p.certManager.GetCertificate); err != nil {
+			p.logErrorF("ERR Re-issuing certificate for %s: %v", idnaToUnicode(serverName), err)
+		}
+	}()
+	return nil
+}
+
+// resetACMEManager replaces the autocert manager with a new one that has
+// nothing in memory, and stops the one that it replaces. reissued is the
+// value of acmeReissuedKey that the new manager reflects.
+func (p *Proxy) resetACMEManager(reissued string) {
+	p.acmeMu.Lock()
+	defer p.acmeMu.Unlock()
+	m := p.acmeManager
+	if m == nil {
+		m = p.certManager.(*autocert.Manager)
+	}
+	nm := &autocert.Manager{
+		Prompt:          m.Prompt,
+		Cache:           m.Cache,
+		HostPolicy:      m.HostPolicy,
+		RenewBefore:     m.RenewBefore,
+		Email:           m.Email,
+		ExtraExtensions: m.ExtraExtensions,
+		Client:          newACMEClient(autocert.DefaultACMEDirectory, nil),
+	}
+	if c := m.Client; c != nil {
+		if c.DirectoryURL != "" {
+			nm.Client.DirectoryURL = c.DirectoryURL
+		}
+		if c.HTTPClient != nil {
+			t := c.HTTPClient.Transport
+			if at, ok := t.(*acmeTransport); ok {
+				t = at.base
+			}
+			nm.Client.HTTPClient.Transport.(*acmeTransport).base = t
+		}
+	}
+	stopACMEManager(m)
+	p.acmeManager = nm
+	p.acmeReissued = reissued
+}
+
+// currentACMEManager returns the autocert manager that obtains the
+// certificates, or nil if certManager isn't an autocert manager.
+func (p *Proxy) currentACMEManager() *autocert.Manager {
+	p.acmeMu.Lock()
+	defer p.acmeMu.Unlock()
+	if p.acmeManager != nil {
+		return p.acmeManager
+	}
+	m, _ := p.certManager.(*autocert.Manager)
+	return m
+}
+
+var errACMEManagerStopped = errors.New("autocert manager was replaced")
+
+// acmeTransport is the HTTP transport of the ACME clients of the autocert
+// managers. autocert has no way to stop a manager, and the renewal timers of
+// a replaced manager stay armed. Its transport is stopped instead, so that it
+// can't order certificates anymore.
+type acmeTransport struct {
+	base    http.RoundTripper
+	stopped atomic.Bool
+}
+
+func (t *acmeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.stopped.Load() {
+		return nil, errACMEManagerStopped
+	}
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
+
+// newACMEClient returns an ACME client for an autocert manager that
+// stopACMEManager can stop. base is the underlying transport, or nil for
+// http.DefaultTransport.
+func newACMEClient(directoryURL string, base http.RoundTripper) *acme.Client {
+	return &acme.Client{
+		DirectoryURL: directoryURL,
+		HTTPClient:   &http.Client{Transport: &acmeTransport{base: base}},
+	}
+}
+
+// stopACMEManager stops the ACME client of m, and reports whether it could.
+func stopACMEManager(m *autocert.Manager) bool {
+	if m.Client == nil || m.Client.HTTPClient == nil {
+		return false
+	}
+	t, ok := m.Client.HTTPClient.Transport.(*acmeTransport)
+	if ok {
+		t.stopped.Store(true)
+	}
+	return ok
+}
+
+// acmeReissueLoop replaces the autocert manager when another instance of the
+// cluster re-issues a certificate, so that the old certificate isn't served
+// from memory.
+func (p *Proxy) acmeReissueLoop(ctx context.Context) {
+	if _, ok := p.certManager.(*autocert.Manager); !ok {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+		if err := p.checkACMEReissued(ctx); err != nil {
+			p.logErrorF("ERR %s: %v", acmeReissuedKey, err)
+		}
+	}
+}
+
+// checkACMEReissued replaces the autocert manager if acmeReissuedKey changed.
+func (p *Proxy) checkACMEReissued(ctx context.Context) error {
+	cache, err := p.acmeCache()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	b, err := cache.Get(ctx, acmeReissuedKey)
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	p.acmeMu.Lock()
+	changed := string(b) != p.acmeReissued
+	p.acmeMu.Unlock()
+	if changed {
+		p.logErrorF("INF Reloading the ACME certificates after a re-issuance")
+		p.resetACMEManager(string(b))
+	}
+	return nil
+}
+
+// acmeHello returns a ClientHelloInfo to get an ECDSA certificate for
+// serverName from autocert outside of a TLS handshake.
+func acmeHello(serverName string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName: serverName,
+		SignatureSchemes: []tls.SignatureScheme{
+			tls.ECDSAWithP256AndSHA256,
+		},
+		SupportedCurves: []tls.CurveID{
+			tls.CurveP256,
+		},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		},
+	}
+}
+
+// serverNameInUse returns true if a backend receives the connections for
+// serverName.
+func (p *Proxy) serverNameInUse(serverName string) bool {
+	_, err := p.backend(serverName)
+	return err == nil
+}
+
+type acmeCertInfo struct {
+	Key         string    `json:"key"`
+	ServerNames []string  `json:"serverNames"`
+	Serial      string    `json:"serial"`
+	Issuer      string    `json:"issuer"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	InUse       bool      `json:"inUse"`
+}
+
+// certificatesHandler shows the ACME certificates and the ACME history with
+// GET requests. POST requests can revoke a certificate, or re-issue the
+// certificate of a server name.
+func (p *Proxy) certificatesHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		p.listCertificates(w, req)
+		return
+	}
+	if req.Method != http.MethodPost || req.Header.Get("x-csrf-check") != "1" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	req.ParseForm()
+	var admin string
+	if claims := claimsFromCtx(req.Context()); claims != nil {
+		admin, _ = claims["email"].(string)
+	}
+	switch req.PostForm.Get("action") {
+	case "revoke":
+		p.revokeCertificateHandler(w, req, admin)
+	case "reissue":
+		serverName := idnaToASCII(strings.TrimSpace(req.PostForm.Get("serverName")))
+		if serverName == "" || !p.serverNameInUse(serverName) {
+			http.Error(w, "unknown server name", http.StatusBadRequest)
+			return
+		}
+		if err := p.reissueCertificate(req.Context(), serverName); err != nil {
+			p.logErrorF("ERR Re-issuing certificate for %s: %v", idnaToUnicode(serverName), err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.acmeHistory.add(serverName, "re-issuance requested", admin)
+		p.recordEvent("certificate re-issuance requested")
+		p.logErrorF("INF Re-issuance of the certificate for %s requested by %q", idnaToUnicode(serverName), admin)
+		w.Write([]byte("ok\n"))
+	default:
+		http.Error(w, "invalid request", http.StatusBadRequest)
+	}
+}
+
+func (p *Proxy) listCertificates(w http.ResponseWriter, req *http.Request) {
+	certs, err := p.acmeAllCerts(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	list := []acmeCertInfo{}
+	for key, cert := range certs {
+		if strings.HasSuffix(key, "+token") {
+			continue
+		}
+		info := acmeCertInfo{
+			Key:       key,
+			Serial:    fmt.Sprintf("%X", cert.Leaf.SerialNumber),
+			Issuer:    cert.Leaf.Issuer.String(),
+			NotBefore: cert.Leaf.NotBefore.UTC(),
+			NotAfter:  cert.Leaf.NotAfter.UTC(),
+		}
+		for _, n := range cert.Leaf.DNSNames {
+			info.ServerNames = append(info.ServerNames, idnaToUnicode(n))
+			info.InUse = info.InUse || p.serverNameInUse(n)
+		}
+		list = append(list, info)
+	}
+	slices.SortFunc(list, func(a, b acmeCertInfo) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(struct {
+		Certificates []acmeCertInfo     `json:"certificates"`
+		History      []acmeHistoryEntry `json:"history"`
+	}{
+		Certificates: list,
+		History:      p.acmeHistory.list(),
+	})
+}
+
+// revokeCertificateHandler revokes the certificate with the cache key from
+// the request. When its server names are still in use, new certificates are
+// obtained.
+func (p *Proxy) revokeCertificateHandler(w http.ResponseWriter, req *http.Request, admin string) {
+	ctx := req.Context()
+	key := strings.TrimSpace(req.PostForm.Get("key"))
+	reason := req.PostForm.Get("reason")
+	if reason == "" {
+		reason = "unspecified"
+	}
+	reasonCode, err := parseRevocationReason(reason)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	certs, err := p.acmeAllCerts(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	cert, exists := certs[key]
+	if !exists || key == "" || strings.HasSuffix(key, "+token") {
+		http.Error(w, "unknown certificate", http.StatusBadRequest)
+		return
+	}
+	serverName := strings.TrimSuffix(key, "+rsa")
+	if err := p.revokeACMECerts(ctx, certs, []string{key}, reasonCode, func(string, bool) {}); err != nil {
+		p.acmeHistory.add(serverName, "error", err.Error())
+		p.logErrorF("ERR Revoking certificate %s: %v", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.acmeHistory.add(serverName, "certificate revoked", fmt.Sprintf("serial %X, reason %s, by %s", cert.Leaf.SerialNumber, reason, admin))
+	p.recordEvent("certificate revoked")
+	p.logErrorF("INF Certificate %s revoked by %q", key, admin)
+
+	var errs []error
+	for _, n := range cert.Leaf.DNSNames {
+		if !p.serverNameInUse(n) {
+			continue
+		}
+		if err := p.reissueCertificate(ctx, n); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		p.logErrorF("ERR Re-issuing certificate for %s: %v", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
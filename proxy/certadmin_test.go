@@ -0,0 +1,283 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage/autocertcache"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestCertificatesHandler(t *testing.T) {
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	// A fake ACME server that accepts revocations, and rejects new
+	// accounts.
+	var revoked atomic.Int32
+	var acmeURL string
+	acmeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+		switch req.URL.Path {
+		case "/directory":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"newNonce":%q,"newAccount":%q,"newOrder":%q,"revokeCert":%q}`, acmeURL+"/nonce", acmeURL+"/account", acmeURL+"/order", acmeURL+"/revoke")
+		case "/nonce":
+		case "/revoke":
+			revoked.Add(1)
+		default:
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"type":"urn:ietf:params:acme:error:unauthorized","detail":"go away"}`)
+		}
+	}))
+	defer acmeServer.Close()
+	acmeURL = acmeServer.URL
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Mode:        "LOCAL",
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	cache := &acmeHistoryCache{
+		Cache:   autocertcache.New("autocert", proxy.store),
+		history: &proxy.acmeHistory,
+	}
+	proxy.certManager = &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  cache,
+		Client: newACMEClient(acmeURL+"/directory", nil),
+	}
+	m0 := proxy.certManager.(*autocert.Manager)
+
+	ctx := context.Background()
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	b, err := x509.MarshalECPrivateKey(accountKey)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey: %v", err)
+	}
+	if err := cache.Put(ctx, acmeAccountKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})); err != nil {
+		t.Fatalf("cache.Put: %v", err)
+	}
+	cert, err := extCA.GetCert("www.example.com")
+	if err != nil {
+		t.Fatalf("extCA.GetCert: %v", err)
+	}
+	if b, err = x509.MarshalPKCS8PrivateKey(cert.PrivateKey); err != nil {
+		t.Fatalf("x509.MarshalPKCS8PrivateKey: %v", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})
+	for _, c := range cert.Certificate {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c})...)
+	}
+	if err := cache.Put(ctx, "www.example.com", data); err != nil {
+		t.Fatalf("cache.Put: %v", err)
+	}
+
+	type result struct {
+		Certificates []acmeCertInfo     `json:"certificates"`
+		History      []acmeHistoryEntry `json:"history"`
+	}
+	list := func() result {
+		t.Helper()
+		w := httptest.NewRecorder()
+		proxy.certificatesHandler(w, httptest.NewRequest(http.MethodGet, "/certificates", nil))
+		var res result
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		return res
+	}
+	events := func() []string {
+		var out []string
+		for _, e := range list().History {
+			out = append(out, e.Event)
+		}
+		return out
+	}
+	post := func(form url.Values, csrf bool) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/certificates", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if csrf {
+			req.Header.Set("x-csrf-check", "1")
+		}
+		w := httptest.NewRecorder()
+		proxy.certificatesHandler(w, req)
+		return w.Code
+	}
+
+	res := list()
+	if got, want := len(res.Certificates), 1; got != want {
+		t.Fatalf("len(Certificates) = %d, want %d", got, want)
+	}
+	if c := res.Certificates[0]; c.Key != "www.example.com" || !c.InUse || !slices.Equal(c.ServerNames, []string{"www.example.com"}) {
+		t.Errorf("Certificates[0] = %+v", c)
+	}
+	if got, want := events(), []string{"certificate obtained"}; !slices.Equal(got, want) {
+		t.Errorf("History = %q, want %q", got, want)
+	}
+
+	for _, tc := range []struct {
+		form url.Values
+		csrf bool
+		want int
+	}{
+		{url.Values{"action": {"reissue"}, "serverName": {"www.example.com"}}, false, http.StatusBadRequest},
+		{url.Values{"action": {"reissue"}, "serverName": {"other.example.com"}}, true, http.StatusBadRequest},
+		{url.Values{"action": {"revoke"}, "key": {"other.example.com"}}, true, http.StatusBadRequest},
+		{url.Values{"action": {"revoke"}, "key": {"www.example.com"}, "reason": {"foo"}}, true, http.StatusBadRequest},
+		{url.Values{"action": {"foo"}}, true, http.StatusBadRequest},
+		{url.Values{"action": {"revoke"}, "key": {"www.example.com"}, "reason": {"keyCompromise"}}, true, http.StatusOK},
+	} {
+		if got := post(tc.form, tc.csrf); got != tc.want {
+			t.Errorf("POST %v = %d, want %d", tc.form, got, tc.want)
+		}
+	}
+	if got, want := revoked.Load(), int32(1); got != want {
+		t.Errorf("revoked = %d, want %d", got, want)
+	}
+	if got, want := len(list().Certificates), 0; got != want {
+		t.Errorf("len(Certificates) = %d, want %d", got, want)
+	}
+	// The certificate is re-issued in the background, which fails with the
+	// fake ACME server.
+	for i := 0; ; i++ {
+		if slices.Contains(events(), "error") {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("History = %q, want error", events())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got, want := events()[:2], []string{"certificate obtained", "certificate revoked"}; !slices.Equal(got, want) {
+		t.Errorf("History = %q, want %q", got, want)
+	}
+
+	if got, want := post(url.Values{"action": {"reissue"}, "serverName": {"www.example.com"}}, true), http.StatusOK; got != want {
+		t.Errorf("POST reissue = %d, want %d", got, want)
+	}
+	if !slices.Contains(events(), "re-issuance requested") {
+		t.Errorf("History = %q, want re-issuance requested", events())
+	}
+	for _, e := range list().History {
+		if e.ServerName == acmeReissuedKey {
+			t.Errorf("History has %+v", e)
+		}
+	}
+
+	// Each re-issuance replaces the autocert manager.
+	proxy.acmeMu.Lock()
+	m1 := proxy.acmeManager
+	proxy.acmeMu.Unlock()
+	if m1 == nil {
+		t.Fatal("acmeManager is nil")
+	}
+	if err := proxy.checkACMEReissued(ctx); err != nil {
+		t.Fatalf("checkACMEReissued: %v", err)
+	}
+	proxy.acmeMu.Lock()
+	m2 := proxy.acmeManager
+	proxy.acmeMu.Unlock()
+	if m2 != m1 {
+		t.Error("acmeManager changed without a new re-issuance")
+	}
+	// Another instance of the cluster re-issued a certificate.
+	if err := cache.Put(ctx, acmeReissuedKey, []byte(time.Now().UTC().Format(time.RFC3339Nano))); err != nil {
+		t.Fatalf("cache.Put: %v", err)
+	}
+	if err := proxy.checkACMEReissued(ctx); err != nil {
+		t.Fatalf("checkACMEReissued: %v", err)
+	}
+	proxy.acmeMu.Lock()
+	m3 := proxy.acmeManager
+	proxy.acmeMu.Unlock()
+	if m3 == m2 || m3 == nil {
+		t.Error("acmeManager wasn't replaced after another instance's re-issuance")
+	}
+
+	// Only the current manager can reach the ACME server after two
+	// re-issuances.
+	for i, m := range []*autocert.Manager{m0, m1, m3} {
+		resp, err := m.Client.HTTPClient.Get(acmeURL + "/directory")
+		if err == nil {
+			resp.Body.Close()
+		}
+		if want := i == 2; (err == nil) != want {
+			t.Errorf("Manager %d GET directory err = %v, want success %v", i, err, want)
+		}
+	}
+}
+
+func TestACMEHistory(t *testing.T) {
+	var h acmeHistory
+	h.add("a.example.com", "error", "foo")
+	h.add("a.example.com", "error", "foo")
+	h.add("b.example.com", "error", "foo")
+	entries := h.list()
+	if got, want := len(entries), 2; got != want {
+		t.Fatalf("len(entries) = %d, want %d", got, want)
+	}
+	if got, want := entries[0].Count, 2; got != want {
+		t.Errorf("Count = %d, want %d", got, want)
+	}
+	for i := range 2 * maxACMEHistory {
+		h.add(fmt.Sprintf("%d.example.com", i), "error", "foo")
+	}
+	if got, want := len(h.list()), maxACMEHistory; got != want {
+		t.Errorf("len(entries) = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,72 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+)
+
+// clusterSyncLoop periodically reloads the state that is shared with the
+// other instances of the cluster. It runs until ctx is canceled, or until
+// the cluster mode is disabled.
+func (p *Proxy) clusterSyncLoop(ctx context.Context) {
+	for {
+		p.mu.RLock()
+		cl := p.cfg.Cluster
+		p.mu.RUnlock()
+		if cl == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cl.SyncInterval):
+			p.syncClusterState()
+		}
+	}
+}
+
+// syncClusterState reloads the token signing keys, the revoked sessions, the
+// session ticket keys, and the ECH keys from the shared storage. The TLS
+// certificates are shared through the autocert cache, and the OCSP responses
+// are merged when the OCSP cache is flushed.
+func (p *Proxy) syncClusterState() {
+	if err := p.tokenManager.Reload(); err != nil {
+		p.logErrorF("ERR Cluster sync: tokens: %v", err)
+	}
+	if err := p.tokenManager.Revocations().Reload(); err != nil {
+		p.logErrorF("ERR Cluster sync: revocations: %v", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.rotateSessionTicketKeys(); err != nil && err != storage.ErrRolledBack {
+		p.logErrorF("ERR Cluster sync: session tickets: %v", err)
+	}
+	if err := p.rotateECH(false); err != nil && err != storage.ErrRolledBack {
+		p.logErrorF("ERR Cluster sync: ECH: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestCluster(t *testing.T) {
+	dir := t.TempDir()
+	newProxy := func(name string) *Proxy {
+		cfg := &Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: filepath.Join(dir, name),
+			MaxOpen:  100,
+			Cluster: &ConfigCluster{
+				StorageDir: filepath.Join(dir, "shared"),
+			},
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"www.example.com"},
+					Mode:        "LOCAL",
+				},
+			},
+		}
+		if err := cfg.Check(); err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		p, err := New(cfg, []byte("passphrase"))
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		return p
+	}
+	p1 := newProxy("one")
+	p2 := newProxy("two")
+
+	if p1.ticketKeys[0] != p2.ticketKeys[0] {
+		t.Error("The session ticket keys should be the same")
+	}
+
+	tok, err := p1.tokenManager.CreateToken(jwt.MapClaims{
+		"iat":   time.Now().Add(-time.Minute).Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"email": "bob@example.com",
+	}, "")
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	parsed, err := p2.tokenManager.ValidateToken(tok)
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	claims := parsed.Claims.(jwt.MapClaims)
+
+	if err := p1.tokenManager.Revocations().RevokeUser("bob@example.com"); err != nil {
+		t.Fatalf("RevokeUser: %v", err)
+	}
+	if p2.tokenManager.Revocations().IsRevoked("idp", claims) {
+		t.Fatal("IsRevoked = true before sync")
+	}
+	p2.syncClusterState()
+	if !p2.tokenManager.Revocations().IsRevoked("idp", claims) {
+		t.Error("IsRevoked = false after sync")
+	}
+}
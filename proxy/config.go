@@ -28,11 +28,14 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -43,13 +46,19 @@ import (
 	"sync"
 	"time"
 
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"golang.org/x/net/http/httpguts"
 	"golang.org/x/time/rate"
 	yaml "gopkg.in/yaml.v3"
 
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/cloudflare"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/cookiemanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/ct"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/ocspcache"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/oidc"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/pki"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/ratelimit"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/tokenmanager"
 )
 
@@ -65,6 +74,15 @@ const (
 	ModeConsole        = "CONSOLE"
 )
 
+const (
+	// tailscalePrefix indicates that an address is on the tailnet, e.g.
+	// tailscale+db.example.ts.net:5432
+	tailscalePrefix = "tailscale+"
+	// defaultTailscaleHostname is the default name of the proxy on the
+	// tailnet.
+	defaultTailscaleHostname = "tlsproxy"
+)
+
 var (
 	validModes = []string{
 		ModeTCP,
@@ -84,6 +102,11 @@ var (
 		"uri",
 		"dns",
 	}
+	validForwardedModes = []string{
+		forwardedAppend,
+		forwardedReplace,
+		forwardedStrip,
+	}
 	// https://www.iana.org/assignments/tls-extensiontype-values/tls-extensiontype-values.xhtml#alpn-protocol-ids
 	defaultALPNProtos       = &[]string{"h2", "http/1.1"}
 	defaultALPNProtosPlusH3 = &[]string{"h3", "h2", "http/1.1"}
@@ -108,6 +131,33 @@ type Config struct {
 	// TLSAddr is the address where the proxy will receive TLS connections
 	// and forward them to the backends.
 	TLSAddr string `yaml:"tlsAddr"`
+	// Listeners is an optional list of additional addresses where the
+	// proxy receives TLS connections, each one serving a subset of the
+	// backends, e.g. to serve the public backends on TLSAddr and the
+	// console only on an internal IP address. The backends that are
+	// selected by a listener are only reachable on the listeners that
+	// select them. The other backends are only reachable on TLSAddr.
+	// QUIC connections are only accepted on TLSAddr. Like TLSAddr, the
+	// listeners can't be changed after the proxy is started.
+	Listeners []*ConfigListener `yaml:"listeners,omitempty"`
+	// Tailscale configures the proxy's node on a tailnet, with tsnet.
+	// Listeners with a tailscale+ address, e.g. tailscale+:443, receive
+	// connections from the tailnet only, and backend addresses with the
+	// tailscale+ prefix, e.g. tailscale+db.example.ts.net:5432, are
+	// dialed through the tailnet. It is only available in binaries built
+	// with the tailscale tag. Like the listeners, it can't be changed
+	// after the proxy is started.
+	Tailscale *ConfigTailscale `yaml:"tailscale,omitempty"`
+	// WireGuard is a list of named WireGuard tunnels. Backends use them
+	// with DialWireGuard to reach servers in remote private networks.
+	// The tunnels are terminated inside the proxy process, with a
+	// userspace network stack. They are only available in binaries built
+	// with the wireguard tag.
+	WireGuard []*ConfigWireGuard `yaml:"wireGuard,omitempty"`
+	// TCPOptions specifies the socket options of the TCP connections
+	// accepted on TLSAddr and Listeners. By default, TCP_NODELAY is set and keep-alive
+	// probes are sent every 30 seconds.
+	TCPOptions *TCPOptions `yaml:"tcpOptions,omitempty"`
 	// EnableQUIC specifies whether the QUIC protocol should be enabled.
 	// The default is true if the binary is compiled with QUIC support.
 	EnableQUIC *bool `yaml:"enableQUIC,omitempty"`
@@ -136,20 +186,140 @@ type Config struct {
 	// DefaultServerName is the server name to use when the TLS client
 	// doesn't use the Server Name Indication (SNI) extension.
 	DefaultServerName string `yaml:"defaultServerName,omitempty"`
+	// RejectPolicy specifies how the TLS connections for unknown server
+	// names are rejected. See Backend.RejectPolicy for the valid values,
+	// except forbidden. The default is unrecognized-name.
+	RejectPolicy string `yaml:"rejectPolicy,omitempty"`
 	// LogFilter specifies what gets logged for this backend. Values can
 	// be overridden on a per-backend basis.
 	LogFilter LogFilter `yaml:"logFilter,omitempty"`
+	// EventLog optionally enables the persistent event log. The events
+	// are saved in the CacheDir, and can be queried from the console at
+	// /events. By default, the events are only counted in memory.
+	EventLog *ConfigEventLog `yaml:"eventLog,omitempty"`
+	// AuthAuditLog optionally enables the SSO authentication audit log.
+	// Every login attempt is saved in the CacheDir, and can be exported
+	// from the console at /auth-audit.
+	AuthAuditLog *ConfigAuthAuditLog `yaml:"authAuditLog,omitempty"`
+	// Syslog optionally specifies a syslog server where the logs are sent,
+	// in addition to the standard error output.
+	Syslog *ConfigSyslog `yaml:"syslog,omitempty"`
+	// OutboundProxy optionally specifies the HTTP proxy to use for the
+	// requests that the proxy makes on its own behalf, e.g. to the ACME
+	// server, the OCSP responders, the identity providers, and the
+	// Cloudflare API. By default, the HTTP_PROXY, HTTPS_PROXY, and
+	// NO_PROXY environment variables are used. The requests forwarded to
+	// the backends never use this proxy.
+	OutboundProxy *ConfigOutboundProxy `yaml:"outboundProxy,omitempty"`
+	// SessionTickets optionally specifies how the TLS session ticket keys
+	// are rotated, and how they are shared between multiple proxy
+	// instances. By default, a new key is created every day and saved in
+	// the CacheDir.
+	SessionTickets *ConfigSessionTickets `yaml:"sessionTickets,omitempty"`
+	// Cluster optionally enables the cluster mode, where multiple proxy
+	// instances share their state, e.g. behind a load balancer.
+	Cluster *ConfigCluster `yaml:"cluster,omitempty"`
+	// CTLogList is the name of a file that contains the list of trusted
+	// Certificate Transparency logs, in the JSON format used by Chrome,
+	// e.g. https://www.gstatic.com/ct/log_list/v3/log_list.json
+	// It is required to use ForwardRequireSCT. The list changes often
+	// and should be updated regularly.
+	CTLogList string `yaml:"ctLogList,omitempty"`
+	// Resolver optionally specifies how to resolve the host names of the
+	// backend addresses. By default, the host's resolver is used.
+	Resolver *ConfigResolver `yaml:"resolver,omitempty"`
+	// RemoteBackends is optionally the URL of a key in etcd or in the
+	// Consul KV store that contains a YAML list of additional backends,
+	// e.g. consul://127.0.0.1:8500/tlsproxy/backends. The key is watched,
+	// and the proxy is reconfigured when it changes. The remote backends
+	// are ignored when they are not valid.
+	RemoteBackends string `yaml:"remoteBackends,omitempty"`
+	// BackendAPI optionally enables an API that lets orchestration tools
+	// add, update, and remove backends at runtime, e.g. for preview
+	// deployments.
+	BackendAPI *ConfigBackendAPI `yaml:"backendApi,omitempty"`
+	// Docker optionally enables backends that are created from the labels
+	// of the running Docker containers. The Docker daemon is watched, and
+	// the backends are created and removed as containers start and stop.
+	Docker *ConfigDocker `yaml:"docker,omitempty"`
 	// Backends is the list of service backends.
 	Backends []*Backend `yaml:"backends"`
+	// Routes is an explicit routing table that selects the backend for
+	// combinations of server name and ALPN protocol, e.g. to send
+	// xmpp-client connections to chat.example.com to one backend, and
+	// h2 and http/1.1 connections to another one. Routes are added to the
+	// routing implied by the backends' ServerNames and ALPNProtos, and must
+	// not conflict with it.
+	Routes []*ConfigRoute `yaml:"routes,omitempty"`
 	// Email is optionally sent to Let's Encrypt when registering a new
 	// account.
 	Email string `yaml:"email,omitempty"`
 	// RevokeUnusedCertificates indicates that unused certificates
-	// should be revoked. The default is true.
+	// should be revoked. The default is true, except when Docker or
+	// Cluster is enabled.
 	// See https://letsencrypt.org/docs/revoking/
 	RevokeUnusedCertificates *bool `yaml:"revokeUnusedCertificates,omitempty"`
 	// MaxOpen is the maximum number of open incoming connections.
 	MaxOpen int `yaml:"maxOpen,omitempty"`
+	// ForwardBufferSize is the default size, in bytes, of the buffers used
+	// to copy data between the clients and the backends. Smaller buffers
+	// use less memory with many concurrent connections. Larger buffers
+	// can improve the throughput of bulk transfers. The value must be
+	// between 1 KiB and 16 MiB. The default is 32 KiB.
+	ForwardBufferSize int `yaml:"forwardBufferSize,omitempty"`
+	// RealClientIP optionally specifies how to get the real IP address of
+	// the clients when the proxy is behind a CDN, e.g. Cloudflare.
+	RealClientIP *ConfigRealClientIP `yaml:"realClientIp,omitempty"`
+	// HandshakeRateLimit limits how many TLS handshakes can be initiated
+	// by the same source. Connections that exceed the limits are dropped
+	// before any cryptographic operation takes place. By default, there
+	// is no limit.
+	HandshakeRateLimit *HandshakeRateLimit `yaml:"handshakeRateLimit,omitempty"`
+	// Overload specifies the heap size and the number of open connections
+	// above which the proxy sheds load, i.e. it rejects new TLS connections
+	// and pauses accepting QUIC connections, instead of running out of
+	// memory. By default, no load is shed until MaxOpen is reached.
+	Overload *ConfigOverload `yaml:"overload,omitempty"`
+	// AnomalyDetection optionally tracks the connection and byte rates of
+	// each backend, and raises events and calls webhooks when the rates
+	// deviate from their baseline, e.g. during a DDoS attack, or when a
+	// backend is stuck in a retry loop.
+	AnomalyDetection *ConfigAnomalyDetection `yaml:"anomalyDetection,omitempty"`
+	// SPIFFE configures the connection to the SPIFFE Workload API, e.g.
+	// a SPIRE agent. It is required by the backends that use
+	// ForwardSPIFFE.
+	SPIFFE *ConfigSPIFFE `yaml:"spiffe,omitempty"`
+	// TemplatesDir is the name of a directory that contains templates to
+	// replace the built-in pages, e.g. to apply an organization's
+	// branding. The files that are found in this directory are used
+	// instead of the built-in ones:
+	//   - login.html: the SSO login page
+	//   - logout.html: the SSO logout page
+	//   - permission-denied.html: the SSO permission denied page
+	//   - sso-status.html: the SSO identity page, at /.sso/
+	//   - style.css: the style sheet of the SSO pages
+	//   - passkey-auth.html: the passkey login and registration page
+	//   - passkey-manage.html: the passkey management page
+	//   - passkey-admin.html: the passkey administration page
+	//   - error-page.html: the default ErrorPageTemplate of the HTTP and
+	//     HTTPS backends
+	//
+	// The templates receive the same data as the built-in ones, which can
+	// be used as starting points.
+	TemplatesDir string `yaml:"templatesDir,omitempty"`
+	// QUICHandshakeTimeout is the idle timeout before the QUIC handshake
+	// completes. The default value is 5 seconds. It is read when the QUIC
+	// listener starts and a change requires a restart of the proxy.
+	QUICHandshakeTimeout time.Duration `yaml:"quicHandshakeTimeout,omitempty"`
+	// QUICInitialPacketSize is the size of the QUIC packets that the
+	// proxy sends before path MTU discovery finds the largest size that
+	// the network supports, between 1200 and 1452 bytes. quic-go starts
+	// with a congestion window of 32 packets, so a larger value lets new
+	// connections send more data in the first round trips, e.g. large
+	// downloads on long fat networks. The default is 1280. It is read
+	// when the QUIC listener starts. quic-go doesn't let applications
+	// select the congestion control algorithm.
+	QUICInitialPacketSize uint16 `yaml:"quicInitialPacketSize,omitempty"`
 	// AcceptTOS indicates acceptance of the Let's Encrypt Terms of Service.
 	// See https://letsencrypt.org/repository/
 	AcceptTOS bool `yaml:"acceptTOS"`
@@ -157,6 +327,10 @@ type Config struct {
 	OIDCProviders []*ConfigOIDC `yaml:"oidc,omitempty"`
 	// SAMLProviders is the list of SAML providers.
 	SAMLProviders []*ConfigSAML `yaml:"saml,omitempty"`
+	// LDAPProviders is the list of LDAP providers, e.g. Active Directory.
+	LDAPProviders []*ConfigLDAP `yaml:"ldap,omitempty"`
+	// PasswordProviders is the list of local username/password providers.
+	PasswordProviders []*ConfigPassword `yaml:"password,omitempty"`
 	// PasskeyProviders are identity providers that use OIDC or SAML for
 	// the first authentication and to configure passkeys, and then rely
 	// exclusively on passkeys.
@@ -184,6 +358,9 @@ type Config struct {
 	WebSockets []*WebSocketConfig `yaml:"webSockets,omitempty"`
 
 	acceptProxyHeaderFrom []*net.IPNet
+	realClientIP          *realClientIP
+	ctLogs                *ct.LogList
+	templates             *pageTemplates
 }
 
 // ECH contains the Encrypted Client Hello parameters.
@@ -214,6 +391,78 @@ type BWLimit struct {
 	Egress float64 `yaml:"egress"`
 }
 
+// HandshakeRateLimit specifies the TLS handshake limits that are applied to
+// each source.
+type HandshakeRateLimit struct {
+	// Rate is the number of handshakes per second allowed from the same
+	// source. The value 0 means no rate limit.
+	Rate float64 `yaml:"rate,omitempty"`
+	// Burst is the maximum number of handshakes that can be initiated at
+	// once from the same source. The default is the same as Rate, with a
+	// minimum of 1.
+	Burst int `yaml:"burst,omitempty"`
+	// MaxConcurrent is the maximum number of TLS handshakes in progress
+	// from the same source. The value 0 means no limit. This limit doesn't
+	// apply to QUIC connections.
+	MaxConcurrent int `yaml:"maxConcurrent,omitempty"`
+	// IPv4Prefix is the prefix length used to group IPv4 source addresses,
+	// e.g. 24 to apply the limits to each /24 network. The default is 32,
+	// i.e. each IP address.
+	IPv4Prefix int `yaml:"ipv4Prefix,omitempty"`
+	// IPv6Prefix is the prefix length used to group IPv6 source addresses.
+	// The default is 64.
+	IPv6Prefix int `yaml:"ipv6Prefix,omitempty"`
+}
+
+// ConfigSPIFFE specifies how to connect to the SPIFFE Workload API.
+type ConfigSPIFFE struct {
+	// WorkloadAPIAddr is the address of the Workload API, e.g.
+	// unix:///run/spire/agent/public/api.sock. The default is the value
+	// of the SPIFFE_ENDPOINT_SOCKET environment variable.
+	WorkloadAPIAddr string `yaml:"workloadApiAddr,omitempty"`
+}
+
+// ConfigOverload specifies the load shedding thresholds. The proxy stops
+// shedding load when the heap size and the number of open connections are
+// both below 90% of their thresholds.
+type ConfigOverload struct {
+	// MaxHeapSize is the size of the heap, in bytes, above which load is
+	// shed. The value 0 means no limit.
+	MaxHeapSize int64 `yaml:"maxHeapSize,omitempty"`
+	// MaxOpenPercent is the number of open incoming connections, as a
+	// percentage of MaxOpen, above which load is shed. The value 0 means
+	// no limit.
+	MaxOpenPercent int `yaml:"maxOpenPercent,omitempty"`
+}
+
+// ConfigAnomalyDetection specifies how traffic anomalies are detected. The
+// baseline of each rate is its exponential moving average. It isn't updated
+// while the rate is anomalous.
+type ConfigAnomalyDetection struct {
+	// Interval is how often the rates are measured. The default is 1m.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// BaselineWindow is the time constant of the moving average, i.e.
+	// roughly how far back the baseline looks. No anomalies are reported
+	// until the rates were measured for 10% of this period. The default
+	// is 1h.
+	BaselineWindow time.Duration `yaml:"baselineWindow,omitempty"`
+	// Factor is how much a rate must deviate from its baseline to be
+	// anomalous, i.e. when it is above baseline*Factor or below
+	// baseline/Factor. It must be greater than 1. The default is 3.
+	Factor float64 `yaml:"factor,omitempty"`
+	// MinConnectionRate is the connection rate, in connections per
+	// second, below which the connection rate is never anomalous. The
+	// default is 1.
+	MinConnectionRate float64 `yaml:"minConnectionRate,omitempty"`
+	// MinByteRate is the byte rate, in bytes per second, below which the
+	// byte rate is never anomalous. The default is 100000.
+	MinByteRate float64 `yaml:"minByteRate,omitempty"`
+	// WebHooks is a list of URLs to call when an anomaly starts or ends.
+	// The POST requests contain a JSON object with the backend, metric,
+	// rate, baseline, and state of the anomaly.
+	WebHooks []string `yaml:"webhooks,omitempty"`
+}
+
 // LogFilter specifies what to log.
 type LogFilter struct {
 	// Connections indicates that incoming connections are logged.
@@ -222,6 +471,38 @@ type LogFilter struct {
 	Requests *bool `yaml:"requests,omitempty"`
 	// Errors indicates that errors are logged.
 	Errors *bool `yaml:"errors,omitempty"`
+	// RequestSampleRate is the fraction of the http requests that are
+	// logged, between 0 and 1, e.g. 0.01 to log 1% of the requests.
+	// Requests that fail, i.e. with a status code of 400 or more, are
+	// always logged. The default is 1.
+	RequestSampleRate *float64 `yaml:"requestSampleRate,omitempty"`
+	// Redact is a list of fields to redact in the request logs:
+	//   - clientIP: the client's IP address,
+	//   - user: the user's email address and client certificate,
+	//   - userAgent: the User-Agent header,
+	//   - query: the query string of the URL.
+	Redact []string `yaml:"redact,omitempty"`
+	// RedactMode is either remove or hash. With remove, the redacted
+	// fields are replaced with a dash. With hash, they are replaced with
+	// a keyed hash so that the requests with the same values can still be
+	// correlated. The key changes every time the proxy is restarted. The
+	// default is remove.
+	RedactMode string `yaml:"redactMode,omitempty"`
+}
+
+func (f LogFilter) check() error {
+	if r := f.RequestSampleRate; r != nil && (*r < 0 || *r > 1) {
+		return errors.New("RequestSampleRate must be between 0 and 1")
+	}
+	for _, r := range f.Redact {
+		if !slices.Contains(redactFields, r) {
+			return fmt.Errorf("Redact: invalid field %q", r)
+		}
+	}
+	if m := f.RedactMode; m != "" && m != redactRemove && m != redactHash {
+		return fmt.Errorf("RedactMode: invalid value %q", m)
+	}
+	return nil
 }
 
 // TLSCertificate specifies TLS keys and certificates to use for given server
@@ -237,14 +518,643 @@ type TLSCertificate struct {
 	CertFile string `yaml:"cert"`
 }
 
+// Maintenance specifies how a backend behaves in maintenance mode. HTTP
+// requests receive a 503 Service Unavailable response, and the connections
+// to the other modes are rejected with a TLS or QUIC error.
+type Maintenance struct {
+	// Enabled indicates that the backend is in maintenance mode. It can
+	// also be changed at runtime from the Admin tab of the console, or
+	// with a POST request to /maintenance. The runtime value takes
+	// precedence until the proxy is restarted.
+	Enabled bool `yaml:"enabled,omitempty"`
+	// ErrorPage is the name of a file that contains an HTML page to serve
+	// with status 503 Service Unavailable. It is only valid in HTTP,
+	// HTTPS, and LOCAL modes. By default, a short text message is served.
+	ErrorPage string `yaml:"errorPage,omitempty"`
+	// RetryAfter is the value of the Retry-After header sent with the 503
+	// responses, e.g. 30m.
+	RetryAfter time.Duration `yaml:"retryAfter,omitempty"`
+
+	errorPage []byte
+}
+
+// ContentInspection specifies an external content inspection service.
+//
+// The bodies are sent to the service's URL in POST requests with the
+// original Content-Type, and the following headers:
+//   - X-Inspect-Direction: request or response
+//   - X-Inspect-Method: the method of the client's request
+//   - X-Inspect-URL: the URL of the client's request
+//   - X-Inspect-Status: the status code of the response
+//   - X-Inspect-User: the email address of the user, with SSO
+//
+// The service's response status code is its verdict:
+//   - 204 No Content: the body is allowed without change.
+//   - 200 OK: the body is replaced with the body of the service's response.
+//   - 403 Forbidden: the body is blocked, and the client receives a 403
+//     Forbidden response.
+//
+// Any other status code, or an error, is an inspection failure.
+type ContentInspection struct {
+	// URL is the URL of the inspection service.
+	URL string `yaml:"url"`
+	// Requests indicates that the request bodies are inspected.
+	Requests bool `yaml:"requests,omitempty"`
+	// Responses indicates that the response bodies are inspected.
+	Responses bool `yaml:"responses,omitempty"`
+	// Paths is a list of path prefixes to inspect. By default, all the
+	// paths are inspected.
+	Paths []string `yaml:"paths,omitempty"`
+	// MaxBodySize is the maximum size of the bodies that are inspected.
+	// Larger bodies are inspection failures. The default is 10 MiB.
+	MaxBodySize int64 `yaml:"maxBodySize,omitempty"`
+	// Timeout is the amount of time to wait for the inspection service's
+	// verdict. The default is 30s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// FailOpen indicates that the bodies are allowed when the inspection
+	// fails. By default, the client receives a 502 Bad Gateway response.
+	FailOpen bool `yaml:"failOpen,omitempty"`
+}
+
+// ExtAuthz specifies an external authorization service.
+//
+// Before forwarding a request, the proxy sends a POST request to the
+// service's URL with a JSON object that describes the request:
+//   - method, url, host, path, remoteAddr
+//   - headers: the request headers
+//   - clientCert: the client certificate, if any, with subject, issuer,
+//     serialNumber, sha256, dnsNames, and emailAddresses.
+//   - identity: the claims of the authenticated user, with SSO.
+//
+// The service responds with 200 OK and a JSON object:
+//   - allow: true if the request is allowed.
+//   - setHeaders: the headers to set on the allowed request, e.g.
+//     {"X-User-Role": ["admin"]}.
+//   - removeHeaders: the names of the headers to remove from the allowed
+//     request.
+//   - status: the status code of the response to a denied request. The
+//     default is 403.
+//   - body: the body of the response to a denied request.
+//   - responseHeaders: the headers of the response to a denied request,
+//     e.g. Location or WWW-Authenticate.
+//
+// Any other response, or an error, is an authorization failure. Only HTTP
+// services are supported.
+type ExtAuthz struct {
+	// URL is the URL of the authorization service.
+	URL string `yaml:"url"`
+	// Headers is the list of request headers to send to the service. By
+	// default, all the headers are sent.
+	Headers []string `yaml:"headers,omitempty"`
+	// Paths is a list of path prefixes that require authorization. By
+	// default, all the paths do.
+	Paths []string `yaml:"paths,omitempty"`
+	// Timeout is the amount of time to wait for the service's decision.
+	// The default is 5s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// FailOpen indicates that the requests are allowed when the
+	// authorization fails. By default, the client receives a 502 Bad
+	// Gateway response.
+	FailOpen bool `yaml:"failOpen,omitempty"`
+}
+
+// WASMPlugin specifies a WebAssembly module that is called with each
+// request and/or response of a backend.
+//
+// The module must export its memory and a malloc(size i32) i32 function,
+// and at least one of these functions:
+//   - on_request(ptr i32, len i32) i64
+//   - on_response(ptr i32, len i32) i64
+//
+// The proxy calls malloc to allocate len bytes, writes the input there, and
+// calls on_request or on_response with its location. The input is a JSON
+// object with these fields: method, url, remoteAddr, user, header, status
+// (responses only), body (base64, when Bodies is set), and config.
+//
+// The function returns the location of its output, ptr<<32 | len, or 0 to
+// let the request or response continue without change. The output is a JSON
+// object with these optional fields:
+//   - action: "continue" (default), or "respond" to replace the response.
+//   - status: the status code of the response, with "respond".
+//   - setHeader: the headers to set, e.g. {"X-Foo": ["bar"]}.
+//   - deleteHeader: the names of the headers to remove.
+//   - body: the new body, in base64.
+//
+// A new instance of the module is used for each call. The module can use
+// WASI, and it can import log(ptr i32, len i32) from the "tlsproxy" module
+// to write messages to the proxy's log.
+type WASMPlugin struct {
+	// Module is the name of the file that contains the WebAssembly
+	// module.
+	Module string `yaml:"module"`
+	// Config is an opaque string that is passed to the plugin with each
+	// call.
+	Config string `yaml:"config,omitempty"`
+	// Paths is a list of path prefixes for which the plugin is called. By
+	// default, the plugin is called for all the paths.
+	Paths []string `yaml:"paths,omitempty"`
+	// Bodies indicates that the request and response bodies are passed to
+	// the plugin. The bodies that are larger than MaxBodySize are not.
+	Bodies bool `yaml:"bodies,omitempty"`
+	// MaxBodySize is the maximum size of the bodies that are passed to
+	// the plugin. The default is 1 MiB.
+	MaxBodySize int64 `yaml:"maxBodySize,omitempty"`
+	// Timeout is the maximum amount of time that each call can take. The
+	// default is 1s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	code   []byte
+	plugin *wasmPlugin
+}
+
+// OnDemandTLS specifies which server names get certificates on first use.
+//
+// The TLS handshakes wait while a certificate is being obtained. The
+// requests received on HTTPAddr get a 503 Service Unavailable placeholder
+// response until the certificate is ready.
+type OnDemandTLS struct {
+	// ServerNames is a list of server names or patterns, e.g.
+	// *.preview.example.com.
+	ServerNames []string `yaml:"serverNames"`
+	// CertificatesPerHour is the maximum number of new certificates to
+	// obtain per hour. The default is 10.
+	CertificatesPerHour float64 `yaml:"certificatesPerHour,omitempty"`
+	// RetryAfter is the value of the Retry-After header sent with the
+	// placeholder responses. The default is 10s.
+	RetryAfter time.Duration `yaml:"retryAfter,omitempty"`
+	// Ask is an optional URL that is queried before obtaining a new
+	// certificate, e.g. https://deployer.example.com/ask. The server
+	// name is sent in the domain query parameter, and the certificate is
+	// only obtained when the response status is 2xx. Ask is only queried
+	// when the rate limit allows a new certificate, and the request times
+	// out after 5 seconds.
+	Ask string `yaml:"ask,omitempty"`
+	// FailureBackoff is how long to wait before trying again to obtain
+	// a certificate for a server name after a failure, or after Ask
+	// denied it or failed. The default is 10m.
+	FailureBackoff time.Duration `yaml:"failureBackoff,omitempty"`
+}
+
+// TrafficQuota specifies how many bytes each authenticated user can
+// transfer through a backend. The quotas are reset at midnight UTC, and on
+// the first day of the month for the monthly quota. The usage is kept in
+// memory and is reset when the proxy restarts.
+type TrafficQuota struct {
+	// Daily is the maximum number of bytes that a user can transfer each
+	// day. The value 0 means no limit.
+	Daily int64 `yaml:"daily,omitempty"`
+	// Monthly is the maximum number of bytes that a user can transfer
+	// each month. The value 0 means no limit.
+	Monthly int64 `yaml:"monthly,omitempty"`
+}
+
+// IdentityRateLimit specifies the request limits that are applied to each
+// authenticated client.
+type IdentityRateLimit struct {
+	// RequestsPerMinute is the number of requests per minute allowed from
+	// the same client.
+	RequestsPerMinute float64 `yaml:"requestsPerMinute"`
+	// Burst is the maximum number of requests that the same client can
+	// send at once. The default is the same as RequestsPerMinute, with a
+	// minimum of 1.
+	Burst int `yaml:"burst,omitempty"`
+}
+
 // WebSocketConfig specifies a WebSocket endpoint.
 type WebSocketConfig struct {
 	Endpoint string `yaml:"endpoint"`
 	Address  string `yaml:"address,omitempty"`
 }
 
+// PassthroughFallback specifies how to handle TLSPASSTHROUGH connections when
+// the backend servers can't be used. Instead of resetting the connection, TLS
+// is terminated locally and the connection is handed to another backend, or
+// an error page is served.
+type PassthroughFallback struct {
+	// Backend is the name of a backend that receives the connections. It
+	// must not be in TLSPASSTHROUGH mode, and it must not use ClientAuth.
+	Backend string `yaml:"backend,omitempty"`
+	// ErrorPage is the name of a file that contains an HTML page to serve
+	// with status 503 Service Unavailable for all requests. Exactly one of
+	// Backend or ErrorPage must be set.
+	ErrorPage string `yaml:"errorPage,omitempty"`
+	// OnALPNMismatch indicates that the fallback is also used when none of
+	// the ALPN protocols offered by the client are in the backend's
+	// ALPNProtos. By default, the fallback is only used when the backend
+	// servers can't be reached.
+	OnALPNMismatch bool `yaml:"onAlpnMismatch,omitempty"`
+
+	backend   *Backend
+	errorPage []byte
+}
+
+// ConfigResolver specifies the DNS resolver to use for the backend addresses.
+// Exactly one of Nameservers, DoT, or DoH must be set.
+type ConfigResolver struct {
+	// Nameservers is a list of DNS servers, e.g. 192.168.0.1 or
+	// [2001:db8::1]:53. The default port is 53. The servers are used in
+	// round robin.
+	Nameservers []string `yaml:"nameservers,omitempty"`
+	// DoT is the address of a DNS-over-TLS (RFC 7858) server, e.g.
+	// 1.1.1.1:853. The default port is 853.
+	DoT string `yaml:"dot,omitempty"`
+	// DoTServerName is the name used to verify the DoT server's
+	// certificate, e.g. cloudflare-dns.com. The default is the host part
+	// of DoT.
+	DoTServerName string `yaml:"dotServerName,omitempty"`
+	// DoH is the URL of a DNS-over-HTTPS (RFC 8484) service, e.g.
+	// https://1.1.1.1/dns-query
+	DoH string `yaml:"doh,omitempty"`
+	// Timeout is the maximum amount of time to wait for a name to be
+	// resolved. The default is 5 seconds.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// ConfigEventLog specifies the parameters of the persistent event log.
+//
+// The events can be queried with GET requests to /events on the console
+// backend. The optional query parameters are:
+//
+//   - backend: the name of the backend, or its first server name
+//   - type: the type of event, e.g. "deny X509" or "tcp connection"
+//   - since, until: a RFC 3339 time, or a duration relative to now, e.g. 1h
+//   - limit: the maximum number of events to return. The default is 1000.
+type ConfigEventLog struct {
+	// MaxSize is the approximate maximum size of the event log in bytes.
+	// The oldest events are discarded when the log is full. The default
+	// is 10 MiB.
+	MaxSize int64 `yaml:"maxSize,omitempty"`
+}
+
+// ConfigAuthAuditLog specifies the parameters of the SSO authentication audit
+// log. Each record contains the time, the identity provider, the user's
+// identity when it is known, the source IP address, the result (success or
+// failure), and the server name of the backend on success.
+//
+// The records can be downloaded in JSON-lines format with GET requests to
+// /auth-audit on the console backend. The optional query parameters are:
+//
+//   - provider: the name of the identity provider
+//   - identity: the user's email address or username
+//   - result: success or failure
+//   - since, until: a RFC 3339 time, or a duration relative to now, e.g. 24h
+type ConfigAuthAuditLog struct {
+	// MaxSize is the approximate maximum size of the audit log in bytes.
+	// The oldest records are discarded when the log is full. The default
+	// is 10 MiB.
+	MaxSize int64 `yaml:"maxSize,omitempty"`
+}
+
+// ConfigOutboundProxy specifies an HTTP proxy for outbound requests.
+type ConfigOutboundProxy struct {
+	// URL is the URL of the proxy, e.g. http://proxy.example.com:3128,
+	// https://proxy.example.com, or socks5://proxy.example.com:1080.
+	URL string `yaml:"url"`
+	// NoProxy is a list of host names, domain names, IP addresses, or
+	// CIDRs that are accessed directly, with the same syntax as the
+	// NO_PROXY environment variable, e.g. localhost, .example.com, or
+	// 10.0.0.0/8.
+	NoProxy []string `yaml:"noProxy,omitempty"`
+}
+
+// ConfigSessionTickets specifies how the TLS session ticket keys are managed.
+//
+// When SharedSecretFile is set, the keys are derived from the shared secret
+// and the current time. All the proxy instances that use the same secret and
+// the same RotationInterval use the same keys at the same time, without having
+// to communicate with each other, so the clients can resume their sessions
+// with any of them. Anyone who knows the secret can decrypt the session
+// tickets, past and future, so it must be protected like a private key.
+type ConfigSessionTickets struct {
+	// RotationInterval is how often a new key starts being used to
+	// encrypt the session tickets. The default is 24 hours. The minimum
+	// is 10 minutes.
+	RotationInterval time.Duration `yaml:"rotationInterval,omitempty"`
+	// Lifetime is how long a key can be used to decrypt session tickets
+	// after it is rotated out. The default is 7 days.
+	Lifetime time.Duration `yaml:"lifetime,omitempty"`
+	// SharedSecretFile is the name of a file that contains a secret
+	// shared by all the proxy instances that serve the same server
+	// names, e.g. 32 random bytes from `openssl rand 32`. The secret must
+	// be at least 32 bytes long.
+	SharedSecretFile string `yaml:"sharedSecretFile,omitempty"`
+
+	sharedSecret []byte
+}
+
+// ConfigCluster specifies how multiple proxy instances share their state.
+//
+// The instances share the encrypted storage where the TLS certificates, the
+// OCSP responses, the token signing keys, the session ticket keys, the ECH
+// keys, and the revoked SSO sessions are saved. All the instances must use
+// the same passphrase. Established TLS and SSO sessions can use any instance.
+//
+// Some state is only kept in the memory of the instance that created it:
+//   - the state of the logins in progress with the OIDC, SAML, LDAP, and
+//     password identity providers, and the passkey and TOTP challenges,
+//   - the authorization codes, device codes, and refresh tokens of the local
+//     OIDC servers,
+//   - the orders and challenges of the local PKIs' ACME servers.
+//
+// The requests that use this state must reach the same instance, e.g. with
+// sticky load balancing for the SSO and PKI endpoints. A refresh token can
+// only be used with the instance that issued it, and the refresh tokens are
+// lost when that instance restarts. The passkeys registered with one
+// instance are seen by the others when they reload their configuration.
+type ConfigCluster struct {
+	// StorageDir is a directory shared by all the instances of the
+	// cluster, e.g. on a network filesystem. It is used instead of
+	// CacheDir for the encrypted storage. It cannot be changed after the
+	// proxy is started.
+	StorageDir string `yaml:"storageDir"`
+	// SyncInterval is how often each instance reloads the state that was
+	// changed by the other instances, e.g. the signing keys and the
+	// revoked sessions. The default is 30 seconds.
+	SyncInterval time.Duration `yaml:"syncInterval,omitempty"`
+}
+
+// TCPOptions specifies TCP socket options.
+type TCPOptions struct {
+	// NoDelay controls TCP_NODELAY, i.e. whether Nagle's algorithm is
+	// disabled. The default is true.
+	NoDelay *bool `yaml:"noDelay,omitempty"`
+	// ReceiveBufferSize is the size of the socket's receive buffer
+	// (SO_RCVBUF) in bytes. By default, the operating system chooses.
+	ReceiveBufferSize int `yaml:"receiveBufferSize,omitempty"`
+	// SendBufferSize is the size of the socket's send buffer (SO_SNDBUF)
+	// in bytes. By default, the operating system chooses.
+	SendBufferSize int `yaml:"sendBufferSize,omitempty"`
+	// KeepAliveIdle is how long the connection must be idle before the
+	// first keep-alive probe is sent. The default is 30s. A negative value
+	// disables keep-alive probes.
+	KeepAliveIdle time.Duration `yaml:"keepAliveIdle,omitempty"`
+	// KeepAliveInterval is the time between keep-alive probes. The default
+	// is the same as KeepAliveIdle.
+	KeepAliveInterval time.Duration `yaml:"keepAliveInterval,omitempty"`
+	// KeepAliveCount is the number of unanswered keep-alive probes after
+	// which the connection is closed. By default, the operating system
+	// chooses.
+	KeepAliveCount int `yaml:"keepAliveCount,omitempty"`
+	// UserTimeout is how long transmitted data may remain unacknowledged
+	// before the connection is closed (TCP_USER_TIMEOUT). It is only
+	// supported on linux. By default, the operating system chooses.
+	UserTimeout time.Duration `yaml:"userTimeout,omitempty"`
+}
+
+// ConfigSyslog specifies a syslog server. The messages use the RFC 5424
+// format. With TCP and TLS, they are framed with octet counting (RFC 6587).
+// The messages are dropped when the server is unreachable.
+type ConfigSyslog struct {
+	// Network is udp, tcp, or tls. The default is udp.
+	Network string `yaml:"network,omitempty"`
+	// Address is the address of the syslog server, e.g. 192.168.0.10:514.
+	// The default port is 514, or 6514 with tls.
+	Address string `yaml:"address"`
+	// ServerName is the name used to verify the server's certificate
+	// with tls. The default is the host part of Address.
+	ServerName string `yaml:"serverName,omitempty"`
+	// RootCAs is a list of file names that contain PEM-encoded
+	// certificates, or PEM-encoded certificates, used to verify the
+	// server's certificate with tls. The default is the system's root CAs.
+	RootCAs []string `yaml:"rootCAs,omitempty"`
+	// Facility is the syslog facility, e.g. daemon, or local0. The default
+	// is daemon.
+	Facility string `yaml:"facility,omitempty"`
+	// AppName is the APP-NAME field of the messages. The default is
+	// tlsproxy.
+	AppName string `yaml:"appName,omitempty"`
+	// Hostname is the HOSTNAME field of the messages. The default is the
+	// host's name.
+	Hostname string `yaml:"hostname,omitempty"`
+}
+
+// ConfigRealClientIP specifies how to get the real IP address of the clients
+// from an HTTP header set by a CDN.
+//
+// When a request comes from one of the TrustedSources, the IP address in
+// Header is used instead of the CDN edge's address for AllowIPs, DenyIPs, the
+// handshake rate limit, and the logs. It only applies to the CONSOLE, LOCAL,
+// HTTP, and HTTPS backends. The connections from the TrustedSources are not
+// subject to AllowIPs, DenyIPs, or the handshake rate limit themselves. The
+// handshake rate limit is applied once per client IP address on each
+// connection from the CDN, not to every request.
+type ConfigRealClientIP struct {
+	// Header is the name of the HTTP header that contains the client's
+	// IP address, e.g. CF-Connecting-IP or True-Client-IP. The default is
+	// CF-Connecting-IP.
+	Header string `yaml:"header,omitempty"`
+	// TrustedSources is a list of IP network addresses, in CIDR format,
+	// of the CDN edge servers, e.g. https://www.cloudflare.com/ips/
+	TrustedSources []string `yaml:"trustedSources"`
+}
+
+// ConfigBackendAPI defines the parameters of the backend registration API.
+//
+// The API has the following methods, where <name> is the name of a
+// backend:
+//
+//	GET    <endpoint>         returns the registered backends, in YAML
+//	GET    <endpoint>/<name>  returns one registered backend, in YAML
+//	PUT    <endpoint>/<name>  adds or replaces a backend, in YAML
+//	DELETE <endpoint>/<name>  removes a backend
+//
+// The backends are validated with the rest of the config, including the
+// remote backends, before they are registered. A registered backend that
+// later conflicts with the config is ignored, and the others are kept. The
+// API only accepts the modes that forward connections, i.e.
+// not LOCAL or CONSOLE, and a subset of the backend fields: name,
+// serverNames, mode, addresses, allowIPs, denyIPs, alpnProtos,
+// backendProto, insecureSkipVerify, forwardRateLimit, forwardServerName,
+// forwardTimeout, forwardHttpHeaders, proxyProtocolVersion, sanitizePath,
+// and idleTimeout. The fields that refer to local files or that use the
+// proxy's own credentials, e.g. dialSsh, can only be set in the config file.
+type ConfigBackendAPI struct {
+	// Endpoint is the URL of the API, e.g.
+	// https://admin.example.com/backends. The backend must have mode LOCAL
+	// or CONSOLE.
+	Endpoint string `yaml:"endpoint"`
+	// TokenFile is the name of a file that contains a secret token that
+	// the clients send in the Authorization header, e.g.
+	// Authorization: Bearer <token>
+	TokenFile string `yaml:"tokenFile,omitempty"`
+	// ACL is a list of the TLS client certificates that are allowed to
+	// use the API, in the same format as ClientAuth.ACL. The backend
+	// must have clientAuth. At least one of TokenFile or ACL must be set.
+	ACL []string `yaml:"acl,omitempty"`
+	// AllowedServerNames is the list of server names that the registered
+	// backends can use, e.g. *.preview.example.com. It must be set.
+	AllowedServerNames []string `yaml:"allowedServerNames,omitempty"`
+	// File is the name of a file where the registered backends are saved,
+	// so that they persist when the proxy restarts. By default, they are
+	// only kept in memory. If the file exists but can't be loaded, the API
+	// doesn't change the backends until the file is fixed.
+	File string `yaml:"file,omitempty"`
+
+	token string
+}
+
+// ConfigDocker specifies how to create backends from Docker containers.
+//
+// A backend is created for each running container with a
+// <labelPrefix>.serverNames label, e.g.
+//
+//	tlsproxy.serverNames: "app.example.com,www.example.com"
+//	tlsproxy.mode: "http"
+//	tlsproxy.port: "8080"
+//
+// The mode is optional. The default is HTTP. The port is optional when the
+// container exposes exactly one port. Containers whose server names are
+// already used by other backends are ignored.
+type ConfigDocker struct {
+	// Socket is the path of the Docker daemon's unix socket. The default
+	// is /var/run/docker.sock.
+	Socket string `yaml:"socket,omitempty"`
+	// LabelPrefix is the prefix of the container labels. The default is
+	// tlsproxy.
+	LabelPrefix string `yaml:"labelPrefix,omitempty"`
+	// Network is the name of the Docker network to use to connect to the
+	// containers. The default is the first network of each container, in
+	// alphabetical order.
+	Network string `yaml:"network,omitempty"`
+}
+
+// ConfigKubernetes specifies a Kubernetes service to use as backend. Its
+// endpoints are discovered with the EndpointSlice API.
+type ConfigKubernetes struct {
+	// Namespace is the namespace of the service. The default is the
+	// namespace of the proxy's service account, or "default".
+	Namespace string `yaml:"namespace,omitempty"`
+	// Service is the name of the service.
+	Service string `yaml:"service"`
+	// Port is the name or the number of the endpoints' port. The default
+	// is the first port of the EndpointSlices.
+	Port string `yaml:"port,omitempty"`
+	// APIServer is the URL of the Kubernetes API server. The default is
+	// the in-cluster API server, from the KUBERNETES_SERVICE_HOST and
+	// KUBERNETES_SERVICE_PORT environment variables.
+	APIServer string `yaml:"apiServer,omitempty"`
+	// TokenFile is the file that contains the bearer token to use with
+	// the API server. It is read again for every request. The default is
+	// the service account token,
+	// /var/run/secrets/kubernetes.io/serviceaccount/token
+	TokenFile string `yaml:"tokenFile,omitempty"`
+	// CAFile is the file that contains the CA certificates to use to
+	// verify the API server's certificate. The default is
+	// /var/run/secrets/kubernetes.io/serviceaccount/ca.crt
+	CAFile string `yaml:"caFile,omitempty"`
+}
+
+// ConfigConsul specifies a service in the Consul catalog to use as backend.
+type ConfigConsul struct {
+	// Address is the URL of the Consul agent. The default is
+	// http://127.0.0.1:8500
+	Address string `yaml:"address,omitempty"`
+	// Service is the name of the service.
+	Service string `yaml:"service"`
+	// Tag optionally selects only the service instances with this tag.
+	Tag string `yaml:"tag,omitempty"`
+	// Datacenter is the datacenter to query. The default is the
+	// datacenter of the agent.
+	Datacenter string `yaml:"datacenter,omitempty"`
+	// Token is the ACL token to use with the Consul API.
+	Token string `yaml:"token,omitempty"`
+	// AllowWarning indicates that instances whose health checks are in
+	// the warning state are also used. By default, only instances with
+	// all their checks passing are used.
+	AllowWarning bool `yaml:"allowWarning,omitempty"`
+}
+
+// ConfigListener is an additional address where the proxy receives TLS
+// connections.
+type ConfigListener struct {
+	// Address is the address where the connections are received, e.g.
+	// 192.168.0.10:8443, or tailscale+:443 to receive the connections
+	// from the tailnet.
+	Address string `yaml:"address"`
+	// Backends is a list of names of the backends that are served on this
+	// listener.
+	Backends []string `yaml:"backends,omitempty"`
+	// Modes is a list of modes of the backends that are served on this
+	// listener, e.g. CONSOLE.
+	Modes []string `yaml:"modes,omitempty"`
+}
+
+// ConfigTailscale specifies how the proxy joins a tailnet.
+type ConfigTailscale struct {
+	// Hostname is the name of the proxy on the tailnet. The default is
+	// tlsproxy.
+	Hostname string `yaml:"hostname,omitempty"`
+	// AuthKeyFile is the name of a file that contains the auth key used
+	// to add the proxy to the tailnet. The default is to use the
+	// TS_AUTHKEY environment variable, or to log a URL to authorize the
+	// proxy interactively. The auth key is only needed the first time.
+	AuthKeyFile string `yaml:"authKeyFile,omitempty"`
+	// ControlURL is the URL of the coordination server, e.g. a Headscale
+	// server. The default is to use Tailscale's coordination server.
+	ControlURL string `yaml:"controlUrl,omitempty"`
+	// StateDir is the directory where the node's state is stored. The
+	// default is the tailscale subdirectory of CacheDir.
+	StateDir string `yaml:"stateDir,omitempty"`
+	// Ephemeral indicates that the node should be removed from the
+	// tailnet shortly after the proxy stops.
+	Ephemeral bool `yaml:"ephemeral,omitempty"`
+}
+
+// ConfigWireGuard specifies a WireGuard tunnel.
+type ConfigWireGuard struct {
+	// Name is the name of the tunnel.
+	Name string `yaml:"name"`
+	// PrivateKeyFile is the name of a file that contains the proxy's
+	// private key, e.g. the output of wg genkey.
+	PrivateKeyFile string `yaml:"privateKeyFile"`
+	// Addresses are the proxy's IP addresses inside the tunnel, e.g.
+	// 10.0.0.2.
+	Addresses []string `yaml:"addresses"`
+	// DNS are the IP addresses of the DNS servers used to resolve the
+	// names of the backend servers inside the tunnel. When DNS is empty,
+	// the backend addresses must be IP addresses.
+	DNS []string `yaml:"dns,omitempty"`
+	// MTU is the MTU of the tunnel. The default is 1420.
+	MTU int `yaml:"mtu,omitempty"`
+	// Peers are the WireGuard peers, typically the remote network's
+	// gateway.
+	Peers []*ConfigWireGuardPeer `yaml:"peers"`
+}
+
+// ConfigWireGuardPeer is a WireGuard peer.
+type ConfigWireGuardPeer struct {
+	// PublicKey is the peer's public key, in base64.
+	PublicKey string `yaml:"publicKey"`
+	// PresharedKeyFile is the name of a file that contains an optional
+	// preshared key, e.g. the output of wg genpsk.
+	PresharedKeyFile string `yaml:"presharedKeyFile,omitempty"`
+	// Endpoint is the peer's address, e.g. vpn.example.com:51820. The
+	// name is resolved when the tunnel is created.
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// AllowedIPs are the IP prefixes that are routed to this peer, e.g.
+	// 10.0.0.0/24.
+	AllowedIPs []string `yaml:"allowedIPs"`
+	// PersistentKeepalive is the interval between keepalive packets,
+	// e.g. 25s. The default is to not send keepalive packets.
+	PersistentKeepalive time.Duration `yaml:"persistentKeepalive,omitempty"`
+}
+
+// ConfigRoute is an entry in the routing table.
+type ConfigRoute struct {
+	// ServerName is the server name to route, e.g. chat.example.com.
+	ServerName string `yaml:"serverName"`
+	// ALPNProtos is the list of ALPN protocols to route, e.g.
+	// xmpp-client. The backend must support all these protocols.
+	ALPNProtos []string `yaml:"alpnProtos,flow"`
+	// Backend is the name of the backend that receives the connections.
+	Backend string `yaml:"backend"`
+}
+
 // Backend encapsulates the data of one backend.
 type Backend struct {
+	// Name is an optional name for the backend. It is used to refer to
+	// the backend in the routing table, and must be unique.
+	Name string `yaml:"name,omitempty"`
 	// ServerNames is the list of all the server names for this service,
 	// e.g. example.com, www.example.com.
 	// Internationalized names are converted to ascii using the IDNA2008
@@ -262,19 +1172,76 @@ type Backend struct {
 	//   of the IP addresses on the list.
 	//
 	// If an IP address is blocked, the client receives a TLS "unrecognized
-	// name" alert, as if it connected to an unknown server name.
+	// name" alert by default, as if it connected to an unknown server name.
+	// See RejectPolicy.
 	AllowIPs *[]string `yaml:"allowIPs,omitempty"`
 	// DenyIPs specifies a list of IP network addresses to deny, in CIDR
 	// format, e.g. 192.168.0.0/24. See AllowIPs.
 	DenyIPs *[]string `yaml:"denyIPs,omitempty"`
+	// TarpitDuration, when set, indicates that connections from IP
+	// addresses that are blocked by AllowIPs or DenyIPs should be held open
+	// for this amount of time, reading the incoming data very slowly,
+	// before the connection is rejected. This slows down scanners
+	// without involving the backend servers. It only applies to
+	// TLS connections. The default value of 0 disables the tarpit.
+	TarpitDuration time.Duration `yaml:"tarpitDuration,omitempty"`
+	// RejectPolicy specifies how the TLS connections from IP addresses
+	// that are blocked by AllowIPs or DenyIPs are rejected:
+	//   - unrecognized-name: send an "unrecognized name" TLS alert. This
+	//     is the default.
+	//   - access-denied: send an "access denied" TLS alert.
+	//   - handshake-failure: send a "handshake failure" TLS alert.
+	//   - reset: reset the TCP connection.
+	//   - drop: close the connection without sending anything.
+	//   - forbidden: complete the TLS handshake and respond to the HTTP
+	//     request with 403 Forbidden. This is only valid in CONSOLE,
+	//     LOCAL, HTTP, and HTTPS modes.
+	// QUIC connections are always closed with an "access denied" error.
+	RejectPolicy string `yaml:"rejectPolicy,omitempty"`
 	// SSO indicates that the backend requires user authentication, and
 	// specifies which identity provider to use and who's allowed to
 	// connect.
 	SSO *BackendSSO `yaml:"sso,omitempty"`
+	// SSOByPath is a list of additional SSO policies, each with its own
+	// Paths and Provider, e.g. to require a corporate OIDC provider for
+	// /admin and a SAML federation for /partner on the same backend. The
+	// first policy whose Paths match the request path is used. SSO, if
+	// set, applies to all the other paths.
+	//
+	// Since all providers share the same authentication cookie, users who
+	// go back and forth between paths that use different providers have
+	// to authenticate again when they switch.
+	SSOByPath []*BackendSSO `yaml:"ssoByPath,omitempty"`
 	// ExportJWKS is the path where to export the proxy's JSON Web Key Set.
 	// This should only be set when SSO is enabled and JSON Web Tokens are
 	// generated for the users to authenticate with the backends.
 	ExportJWKS string `yaml:"exportJwks,omitempty"`
+	// PassthroughFallback optionally specifies what to do with the
+	// connections when Mode is TLSPASSTHROUGH and the backend servers can't
+	// be reached.
+	PassthroughFallback *PassthroughFallback `yaml:"passthroughFallback,omitempty"`
+	// Maintenance puts the backend in maintenance mode for planned
+	// downtime without removing it from the config. It is not valid in
+	// CONSOLE mode.
+	Maintenance *Maintenance `yaml:"maintenance,omitempty"`
+	// OnDemandTLS lets the backend receive the connections for server
+	// names that aren't listed in ServerNames, but that match a pattern,
+	// e.g. *.preview.example.com. Their certificates are obtained on first
+	// use. It is not valid in CONSOLE or TLSPASSTHROUGH mode.
+	OnDemandTLS *OnDemandTLS `yaml:"onDemandTls,omitempty"`
+	// TrafficQuota limits the number of bytes that each user authenticated
+	// with SSO can transfer in the request and response bodies. When a
+	// quota is exceeded, the requests receive a 429 Too Many Requests
+	// response, and the streams in progress are closed. The usage is shown
+	// on the console. It is only valid in HTTP and HTTPS modes, with SSO.
+	TrafficQuota *TrafficQuota `yaml:"trafficQuota,omitempty"`
+	// IdentityRateLimit limits how many requests each authenticated
+	// client can send, independently of the other clients. The clients
+	// are identified by their SSO identity, or by the subject of their
+	// client certificate. When the limit is exceeded, the requests receive
+	// a 429 Too Many Requests response. It is only valid in HTTP, HTTPS,
+	// and LOCAL modes.
+	IdentityRateLimit *IdentityRateLimit `yaml:"identityRateLimit,omitempty"`
 	// ALPNProtos specifies the list of ALPN procotols supported by this
 	// backend. The ACME acme-tls/1 protocol doesn't need to be specified.
 	//
@@ -356,7 +1323,26 @@ type Backend struct {
 	// Addresses is a list of server addresses where requests are forwarded.
 	// When more than one address are specified, requests are distributed
 	// using a simple round robin.
+	//
+	// Addresses that start with srv+ are names of DNS SRV records, e.g.
+	// srv+_app._tcp.example.com. The records are resolved again every 30
+	// seconds, and the targets are selected according to their priority
+	// and weight.
+	//
+	// Addresses that start with tailscale+ are dialed through the
+	// tailnet, e.g. tailscale+db.example.ts.net:5432. Tailscale must be
+	// set. They can't be used in QUIC mode.
 	Addresses []string `yaml:"addresses,omitempty"`
+	// Kubernetes specifies a Kubernetes service whose endpoints are used as
+	// the backend addresses. The addresses are kept in sync with the
+	// service's EndpointSlices as pods come and go. When Kubernetes is set,
+	// Addresses must be empty.
+	Kubernetes *ConfigKubernetes `yaml:"kubernetes,omitempty"`
+	// Consul specifies a Consul service whose healthy instances are used
+	// as the backend addresses. The addresses are updated with blocking
+	// queries as instances come and go. When Consul is set, Addresses
+	// must be empty.
+	Consul *ConfigConsul `yaml:"consul,omitempty"`
 	// InsecureSkipVerify disabled the verification of the backend server's
 	// TLS certificate. See https://pkg.go.dev/crypto/tls#Config
 	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty"`
@@ -374,24 +1360,159 @@ type Backend struct {
 	// - File names that contain PEM-encoded certificates, or
 	// - PEM-encoded certificates.
 	ForwardRootCAs []string `yaml:"forwardRootCAs,omitempty"`
+	// ForwardRequireOCSP requires the backend server's certificate to have
+	// a valid Good OCSP response, either stapled in the TLS handshake or
+	// fetched by the proxy. When the certificate has the OCSP must-staple
+	// extension, the response must be stapled. Connections that don't
+	// meet this requirement are rejected. Certificates issued by a local
+	// PKI are checked directly against the PKI's revocation list.
+	ForwardRequireOCSP bool `yaml:"forwardRequireOcsp,omitempty"`
+	// ForwardRequireSCT requires the backend server's certificate to have
+	// valid Signed Certificate Timestamps (SCTs) from at least two
+	// different Certificate Transparency log operators, either embedded in
+	// the certificate or sent in the TLS handshake. The logs are from
+	// CTLogList. Connections that don't meet this requirement are rejected.
+	ForwardRequireSCT bool `yaml:"forwardRequireSct,omitempty"`
+	// ForwardDANE enables the verification of the backend server's
+	// certificate with DNSSEC-signed TLSA records (RFC 6698), e.g.
+	// _443._tcp.backend.example.com, instead of the usual verification.
+	// The Resolver must be set, and must validate DNSSEC. The connection
+	// to the resolver must be trusted, e.g. a local resolver, DoT, or DoH.
+	// Connections without a matching TLSA record are rejected. It is only
+	// valid in TLS, HTTPS, and QUIC modes, with host names in Addresses,
+	// and it can't be used with ForwardRequireOCSP or ForwardRequireSCT.
+	ForwardDANE bool `yaml:"forwardDane,omitempty"`
+	// ForwardPinnedKeys is a list of public key hashes, e.g.
+	// SPKI:sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=
+	// When set, the backend server's certificate chain must contain one
+	// of these public keys. Connections that don't match are rejected.
+	// With InsecureSkipVerify, only the server's own certificate is
+	// checked, and the pins replace the usual verification.
+	ForwardPinnedKeys []string `yaml:"forwardPinnedKeys,omitempty"`
+	// ForwardSPIFFE specifies how the proxy authenticates with the
+	// backend servers, and how it authenticates them, in a SPIFFE mesh.
+	// The X.509 SVIDs and the trust bundles are obtained from the
+	// Workload API, which must be configured with SPIFFE. It applies to
+	// all the connections to the backend servers, including PathOverrides.
+	// It is only valid in TLS, HTTPS, and QUIC modes.
+	ForwardSPIFFE *ForwardSPIFFE `yaml:"forwardSpiffe,omitempty"`
 	// ForwardTimeout is the connection timeout to backend servers. If
 	// Addresses contains multiple addresses, this timeout indicates how
 	// long to wait before trying the next address in the list. The default
 	// value is 30 seconds.
 	ForwardTimeout time.Duration `yaml:"forwardTimeout"`
+	// ForwardQUIC specifies the QUIC transport parameters of the
+	// connections to the backend servers, i.e. in QUIC mode, or when
+	// BackendProto is h3.
+	ForwardQUIC *ForwardQUIC `yaml:"forwardQuic,omitempty"`
+	// DialSourceAddress is the local IP address to use for the connections
+	// to the backend servers, e.g. 192.0.2.10. This is useful when the
+	// backend servers filter connections by source address, or when the
+	// proxy has multiple egress addresses. By default, the operating
+	// system chooses the source address. It doesn't apply to QUIC
+	// connections.
+	DialSourceAddress string `yaml:"dialSourceAddress,omitempty"`
+	// DialInterface is the name of the network interface to use for the
+	// connections to the backend servers, e.g. eth1. This is useful on
+	// multi-homed hosts with policy routing. It uses SO_BINDTODEVICE and
+	// is only supported on linux, where it may require the CAP_NET_RAW
+	// capability. It doesn't apply to QUIC connections.
+	DialInterface string `yaml:"dialInterface,omitempty"`
+	// DialWireGuard is the name of the WireGuard tunnel to use for the
+	// connections to the backend servers, including the path overrides
+	// and canaries. It can't be combined with DialSourceAddress or
+	// DialInterface, and it doesn't apply to QUIC connections.
+	DialWireGuard string `yaml:"dialWireGuard,omitempty"`
+	// DialSSH specifies an SSH bastion host, also known as a jump host,
+	// to use for the connections to the backend servers. The backend
+	// addresses are dialed from the bastion host through SSH channels,
+	// like with ssh -J. One SSH connection is shared by all the
+	// connections to the backend servers. It can't be combined with
+	// DialSourceAddress, DialInterface, or DialWireGuard, and it doesn't
+	// apply to QUIC connections.
+	DialSSH *DialSSH `yaml:"dialSsh,omitempty"`
+	// ReverseTunnel lets the backend servers connect to the proxy with
+	// the tunnelagent command, instead of the proxy connecting to them.
+	// This exposes servers that can't receive connections, e.g. behind
+	// NAT, without port forwarding. Addresses must be empty. The
+	// connections are distributed between the connected agents.
+	// It is valid in TCP, TLS, HTTP, and HTTPS modes.
+	ReverseTunnel *ReverseTunnel `yaml:"reverseTunnel,omitempty"`
+	// ForwardTCPOptions specifies the socket options of the TCP
+	// connections to the backend servers. By default, TCP_NODELAY is set
+	// and keep-alive probes are sent every 30 seconds. It doesn't apply to
+	// QUIC connections.
+	ForwardTCPOptions *TCPOptions `yaml:"forwardTcpOptions,omitempty"`
 	// ForwardHTTPHeaders is a list of HTTP headers to add to the forwarded
-	// request. Headers that already exist are overwritten.
+	// request. Headers that already exist are overwritten. The values are
+	// expanded like in PathOverride.ForwardHTTPHeaders, e.g.
+	// ${PROXY_TLV:aws-vpce-id} is the AWS VPC endpoint ID received in the
+	// PROXY protocol header.
 	ForwardHTTPHeaders map[string]string `yaml:"forwardHttpHeaders,omitempty"`
+	// ForwardedHeaders specifies how the X-Forwarded-For,
+	// X-Forwarded-Proto, X-Forwarded-Host, and Forwarded headers are set
+	// on the forwarded requests. By default, X-Forwarded-For is replaced
+	// with the client's IP address, and the other headers are forwarded
+	// unmodified.
+	ForwardedHeaders *ForwardedHeaders `yaml:"forwardedHeaders,omitempty"`
+	// HTTPTransport specifies how the connections to the backend servers
+	// are pooled and reused in HTTP and HTTPS modes.
+	HTTPTransport *HTTPTransport `yaml:"httpTransport,omitempty"`
+	// ErrorPageTemplate is the name of a file that contains an HTML
+	// template to serve when the request can't be forwarded to the
+	// backend servers, instead of an empty response. The status code is
+	// 502 Bad Gateway, 503 Service Unavailable, or 504 Gateway Timeout.
+	// This field is only valid in HTTP and HTTPS modes.
+	//
+	// The template can use the following fields:
+	//   - {{.StatusCode}}: the HTTP status code, e.g. 502
+	//   - {{.Status}}: the HTTP status text, e.g. Bad Gateway
+	//   - {{.RequestID}}: a unique ID that is also logged with the error
+	//   - {{.ServerName}}: the server name of the request
+	//   - {{.Time}}: the time of the error, in UTC
+	ErrorPageTemplate string `yaml:"errorPageTemplate,omitempty"`
+	// ContentInspection sends the bodies of the requests and/or the
+	// responses to an external inspection service that can allow, block,
+	// or modify them, e.g. to scan file uploads for malware. It is only
+	// valid in HTTP and HTTPS modes.
+	ContentInspection *ContentInspection `yaml:"contentInspection,omitempty"`
+	// WASMPlugins is a list of WebAssembly modules that can inspect and
+	// modify the requests and responses, or respond to the requests
+	// directly. They are called in order. It is only valid in HTTP and
+	// HTTPS modes.
+	WASMPlugins []*WASMPlugin `yaml:"wasmPlugins,omitempty"`
+	// ExtAuthz calls an external authorization service before forwarding
+	// each request. The service can allow or deny the request, and
+	// modify its headers. It is only valid in HTTP and HTTPS modes.
+	ExtAuthz *ExtAuthz `yaml:"extAuthz,omitempty"`
 
 	// PathOverrides specifies different backend parameters for some path
 	// prefixes.
 	// Paths are matched by prefix in the order that they are listed here.
 	PathOverrides []*PathOverride `yaml:"pathOverrides,omitempty"`
+	// Canary specifies routing rules that send the requests with a
+	// specific header or cookie value to a different list of addresses,
+	// e.g. to let testers opt into a new version of the backend server.
+	// The rules are evaluated in the order that they are listed here, and
+	// the first match is used. Only the addresses are replaced. The other
+	// parameters of the backend, or of the matching PathOverride, still
+	// apply. This field is only valid in HTTP and HTTPS modes.
+	Canary []*CanaryRoute `yaml:"canary,omitempty"`
 	// ProxyProtocolVersion enables the PROXY protocol on this backend. The
 	// value is the version of the protocol to use, e.g. v1 or v2.
 	// By default, the proxy protocol is not enabled.
 	// See https://github.com/haproxy/haproxy/blob/master/doc/proxy-protocol.txt
 	ProxyProtocolVersion string `yaml:"proxyProtocolVersion,omitempty"`
+	// ProxyProtocolTLVs is the list of TLVs to add to the PROXY protocol
+	// v2 header:
+	//   - authority: the server name requested by the client.
+	//   - alpn: the ALPN protocol negotiated with the client.
+	//   - unique-id: a unique ID of the client connection.
+	//   - ssl: the TLS version and cipher suite negotiated with the
+	//     client, and the common name of the client certificate, if any.
+	//     It is not sent in TLSPASSTHROUGH mode.
+	// The default is authority and alpn.
+	ProxyProtocolTLVs *[]string `yaml:"proxyProtocolTLVs,omitempty"`
 	// SanitizePath indicates that the request's path should be sanitized
 	// before forwarding the request to the backend. The default is true.
 	// The only reason to set this field is if the backend service somehow
@@ -403,6 +1524,24 @@ type Backend struct {
 	//   /foo/../bar -> /bar
 	//   /../../ -> /
 	SanitizePath *bool `yaml:"sanitizePath,omitempty"`
+	// EarlyData enables TLS 1.3 early data, a.k.a. 0-RTT, on resumed QUIC
+	// connections, and specifies which requests can be served from it.
+	// Early data can be replayed by an attacker, so it should only be
+	// allowed for requests that are safe to repeat. The other requests
+	// that arrive in early data get a 425 Too Early response, and the
+	// clients retry them after the handshake completes. It is only valid
+	// in LOCAL, HTTP, and HTTPS modes, without ClientAuth. Early data is
+	// not supported on TLS over TCP.
+	EarlyData *EarlyData `yaml:"earlyData,omitempty"`
+	// AltSvc controls the Alt-Svc header that advertises HTTP/3 to the
+	// clients, e.g. when QUIC is served on a different port. By default,
+	// HTTP/3 is advertised on the same port as the request when QUIC is
+	// enabled. It is only valid in LOCAL, CONSOLE, HTTP, and HTTPS modes.
+	AltSvc *AltSvc `yaml:"altSvc,omitempty"`
+	// Diagnostics enables the /debug/pprof and /debug/vars (expvar)
+	// handlers to capture CPU and heap profiles, and other runtime data.
+	// It is only valid in CONSOLE mode.
+	Diagnostics *Diagnostics `yaml:"diagnostics,omitempty"`
 
 	// TCP connections consist of two streams of data:
 	//
@@ -438,6 +1577,23 @@ type Backend struct {
 	// HalfCloseTimeout is the amount of time to keep the TCP connection
 	// open when one stream is closed. The default value is 1 minute.
 	HalfCloseTimeout *time.Duration `yaml:"halfCloseTimeout,omitempty"`
+	// ForwardBufferSize is the size, in bytes, of the buffers used to copy
+	// data between the clients and this backend. The default is the global
+	// ForwardBufferSize.
+	ForwardBufferSize int `yaml:"forwardBufferSize,omitempty"`
+	// IdleTimeout is the amount of time after which the TCP connection is
+	// closed when no data is transmitted in either direction. It applies to
+	// modes TCP, TLS, TLSPASSTHROUGH, and QUIC. The default value of 0
+	// disables the idle timeout, which is appropriate for protocols that
+	// can have long periods of silence, e.g. SSH.
+	IdleTimeout time.Duration `yaml:"idleTimeout,omitempty"`
+	// TLSHandshakeTimeout is the amount of time allowed for the client to
+	// complete the TLS handshake. The default value is 2 minutes.
+	TLSHandshakeTimeout time.Duration `yaml:"tlsHandshakeTimeout,omitempty"`
+	// ReadHeaderTimeout is the amount of time allowed to read the HTTP
+	// request headers. It applies to modes CONSOLE, LOCAL, HTTP, and HTTPS.
+	// The default value is 30 seconds.
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout,omitempty"`
 
 	recordEvent      func(string)
 	tm               *tokenmanager.TokenManager
@@ -447,17 +1603,41 @@ type Backend struct {
 	tlsConfig            func(isQUIC bool) *tls.Config
 	clientCAs            *x509.CertPool
 	forwardRootCAs       *x509.CertPool
+	ctLogs               *ct.LogList
+	dialSourceAddr       *net.TCPAddr
+	bufPool              *bufferPool
 	getClientCert        func(context.Context) func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+	spiffe               spiffeSource
 	pkiMap               map[string]*pki.PKIManager
 	ocspCache            *ocspcache.OCSPCache
+	resolver             *resolver
+	tailscale            *tailscaleNode
+	wireGuard            *wireGuardTunnel
+	sshJump              *sshJumpHost
+	tunnelState          *reverseTunnelSet
+	realClientIP         *realClientIP
+	hsLimiter            *handshakeLimiter
+	draining             *drainSet
+	maintenanceState     *maintenanceSet
+	quotaState           *quotaSet
+	identityLimiter      *ratelimit.Limiter
+	sessionState         *sessionSet
+	stopDiscovery        context.CancelFunc
 	bwLimit              *bwLimit
 	connLimit            *rate.Limiter
 	proxyProtocolVersion byte
+	proxyProtocolTLVs    []string
+	// listenAddrs is the list of Listeners that serve this backend. When
+	// it is empty, the backend is served on TLSAddr.
+	listenAddrs []string
 
-	allowIPs *[]*net.IPNet
-	denyIPs  *[]*net.IPNet
+	allowIPs       *[]*net.IPNet
+	denyIPs        *[]*net.IPNet
+	trustedProxies []*net.IPNet
 
-	documentRoot *os.Root
+	documentRoot      *os.Root
+	errorPageTemplate *template.Template
+	templates         *pageTemplates
 
 	httpServer    *http.Server
 	httpConnChan  chan net.Conn
@@ -474,6 +1654,12 @@ type backendState struct {
 	shutdown bool
 	next     int
 	oNext    []int
+	cNext    []int
+	srv      map[string]*srvCacheEntry
+	tlsa     map[string]*tlsaCacheEntry
+	// discovered is the list of addresses discovered with Kubernetes or
+	// Consul.
+	discovered []string
 }
 
 type localHandler struct {
@@ -486,6 +1672,176 @@ type localHandler struct {
 	isCallback  bool
 }
 
+// ForwardedHeaders specifies how to set the X-Forwarded-* and Forwarded
+// headers on the requests forwarded to the backend servers.
+//
+// Each header can be:
+//   - append: the proxy's value is appended to the inbound value if the
+//     request comes from one of the TrustedProxies. Otherwise, the inbound
+//     value is replaced.
+//   - replace: the inbound value is replaced with the proxy's value.
+//   - strip: the header is removed.
+type ForwardedHeaders struct {
+	// For specifies how to set X-Forwarded-For with the client's IP
+	// address. The default is replace.
+	For string `yaml:"for,omitempty"`
+	// Proto specifies how to set X-Forwarded-Proto with the protocol used
+	// by the client, i.e. https or http. By default, the inbound value is
+	// forwarded unmodified.
+	Proto string `yaml:"proto,omitempty"`
+	// Host specifies how to set X-Forwarded-Host with the host requested
+	// by the client. By default, the inbound value is forwarded
+	// unmodified.
+	Host string `yaml:"host,omitempty"`
+	// Forwarded specifies how to set the standard Forwarded header, as
+	// defined in RFC 7239, with the for, proto, host, and by parameters.
+	// With append, inbound values that can't be parsed are discarded. By
+	// default, the inbound value is forwarded unmodified.
+	Forwarded string `yaml:"forwarded,omitempty"`
+	// TrustedProxies is a list of IP network addresses, in CIDR format,
+	// e.g. 192.168.0.0/24, whose inbound X-Forwarded-* values are believed.
+	// If it is empty, append behaves like replace.
+	TrustedProxies []string `yaml:"trustedProxies,omitempty"`
+}
+
+// EarlyData specifies which HTTP requests can be served from early data.
+type EarlyData struct {
+	// Methods is the list of HTTP methods that can be served from early
+	// data. The default is GET, HEAD, and OPTIONS.
+	Methods []string `yaml:"methods,omitempty"`
+	// Paths is a list of path prefixes that can be served from early
+	// data. By default, all paths are allowed.
+	Paths []string `yaml:"paths,omitempty"`
+}
+
+// Diagnostics specifies the pprof and expvar handlers of a console backend.
+type Diagnostics struct {
+	// Enabled indicates whether the handlers are enabled when the proxy
+	// starts. They can be enabled and disabled at runtime from the
+	// console's Admin tab, or with a POST request to /debug/diagnostics
+	// with enabled=true or enabled=false. That setting lasts until the
+	// proxy is restarted.
+	Enabled bool `yaml:"enabled,omitempty"`
+	// ACL restricts which user identity can use the handlers and the
+	// toggle, in addition to the backend's SSO ACL. It has the same
+	// format as the SSO ACL, and requires SSO to be enabled on the
+	// backend. If ACL is nil, all the users of the console are allowed.
+	ACL *[]string `yaml:"acl,omitempty"`
+}
+
+// AltSvc specifies the HTTP/3 alternative services advertised with the Alt-Svc
+// header. See RFC 7838.
+type AltSvc struct {
+	// Disabled disables the Alt-Svc header.
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Port is the UDP port where HTTP/3 is served. The default is the
+	// port of the request.
+	Port int `yaml:"port,omitempty"`
+	// MaxAge is how long the clients can use the alternative services,
+	// i.e. the ma parameter. The default is 30 days.
+	MaxAge time.Duration `yaml:"maxAge,omitempty"`
+	// Endpoints is a list of additional HTTP/3 endpoints, e.g.
+	// h3.example.com:8443.
+	Endpoints []string `yaml:"endpoints,omitempty"`
+	// ServerNames optionally limits the advertisement to some of the
+	// backend's server names. By default, it is sent for all of them.
+	ServerNames []string `yaml:"serverNames,omitempty"`
+}
+
+// ForwardSPIFFE specifies the SPIFFE authentication with the backend servers.
+type ForwardSPIFFE struct {
+	// ClientSVID indicates that the proxy's X.509 SVID should be used as
+	// client certificate with the backend servers, instead of the proxy's
+	// own certificate.
+	ClientSVID bool `yaml:"clientSvid,omitempty"`
+	// ServerIDs is a list of SPIFFE IDs, e.g. spiffe://example.org/api,
+	// and/or trust domains, e.g. spiffe://example.org. When it is set,
+	// the backend servers must present an X.509 SVID that matches one of
+	// them, and that is valid with the trust bundles from the Workload
+	// API. The server names in the certificates are not verified.
+	ServerIDs []string `yaml:"serverIds,omitempty"`
+
+	authorizer tlsconfig.Authorizer
+}
+
+// DialSSH specifies an SSH bastion host.
+type DialSSH struct {
+	// Address is the address of the SSH server, e.g.
+	// bastion.example.com:22.
+	Address string `yaml:"address"`
+	// User is the SSH user name.
+	User string `yaml:"user"`
+	// KeyFile is the name of the file that contains the user's private
+	// key, in OpenSSH or PEM format. The key must not be encrypted.
+	KeyFile string `yaml:"keyFile"`
+	// HostKeys are the SSH server's public keys, in authorized_keys
+	// format, e.g. ssh-ed25519 AAAAC3Nza...
+	HostKeys []string `yaml:"hostKeys,omitempty"`
+	// KnownHostsFile is the name of a file in known_hosts format that
+	// contains the SSH server's public keys. Either HostKeys or
+	// KnownHostsFile must be set.
+	KnownHostsFile string `yaml:"knownHostsFile,omitempty"`
+}
+
+// ReverseTunnel specifies how agents connect to the proxy.
+type ReverseTunnel struct {
+	// TokenFile is the name of a file that contains the secret token
+	// that the agents use to authenticate.
+	TokenFile string `yaml:"tokenFile"`
+	// MaxAgents is the maximum number of agents that can be connected at
+	// the same time. The default is 10.
+	MaxAgents int `yaml:"maxAgents,omitempty"`
+
+	token string
+}
+
+// ForwardQUIC specifies the QUIC transport parameters of the connections to
+// the backend servers.
+type ForwardQUIC struct {
+	// HandshakeIdleTimeout is the idle timeout before the handshake
+	// completes. The default is 5 seconds.
+	HandshakeIdleTimeout time.Duration `yaml:"handshakeIdleTimeout,omitempty"`
+	// MaxIdleTimeout is the amount of time after which the connection is
+	// closed when no data is received. The default is 30 seconds.
+	MaxIdleTimeout time.Duration `yaml:"maxIdleTimeout,omitempty"`
+	// KeepAlivePeriod is how often keep-alive packets are sent to prevent
+	// the connection from timing out. It should be less than
+	// MaxIdleTimeout. By default, no keep-alive packets are sent.
+	KeepAlivePeriod time.Duration `yaml:"keepAlivePeriod,omitempty"`
+	// InitialStreamReceiveWindow is the initial size of the flow control
+	// window of each stream, in bytes. The default is 512 KB.
+	InitialStreamReceiveWindow uint64 `yaml:"initialStreamReceiveWindow,omitempty"`
+	// InitialConnectionReceiveWindow is the initial size of the flow
+	// control window of the connection, in bytes. The default is 768 KB.
+	InitialConnectionReceiveWindow uint64 `yaml:"initialConnectionReceiveWindow,omitempty"`
+}
+
+// HTTPTransport specifies how the connections to the backend servers are
+// pooled and reused.
+//
+// The connections are pooled by the host name of the forwarded requests, not
+// by backend address, because the address is selected when a new connection
+// is dialed. When a backend has more than one address, the limits apply to
+// all of them together.
+type HTTPTransport struct {
+	// MaxIdleConnsPerHost is the maximum number of idle connections to
+	// keep open for reuse. The default is 2.
+	MaxIdleConnsPerHost int `yaml:"maxIdleConnsPerHost,omitempty"`
+	// MaxConnsPerHost is the maximum number of http/1 connections,
+	// including connections that are in use, idle, or being dialed.
+	// Requests wait for a connection when the limit is reached. The
+	// default value of 0 means no limit.
+	MaxConnsPerHost int `yaml:"maxConnsPerHost,omitempty"`
+	// IdleConnTimeout is the amount of time after which an idle
+	// connection is closed. The default is 10 seconds.
+	IdleConnTimeout time.Duration `yaml:"idleConnTimeout,omitempty"`
+	// H2Multiplexing indicates whether concurrent h2 requests can share
+	// the same connection. When false, each h2 connection carries at
+	// most one request at a time, and idle connections are reused. The
+	// default is true.
+	H2Multiplexing *bool `yaml:"h2Multiplexing,omitempty"`
+}
+
 // ClientAuth specifies how to authenticate and authorize the TLS client's
 // identity.
 type ClientAuth struct {
@@ -494,6 +1850,17 @@ type ClientAuth struct {
 	// any valid client certificate. Otherwise, the value is a slice of
 	// Subject or Subject Alternate Name strings from the client X509
 	// certificate, e.g. SUBJECT:CN=Bob or EMAIL:bob@example.com
+	//
+	// SPIFFE IDs can be matched exactly, e.g.
+	// URI:spiffe://example.org/ns/prod/sa/app, or with a trailing /*
+	// wildcard that matches any ID under that path, e.g.
+	// URI:spiffe://example.org/ns/prod/*
+	//
+	// Client public keys can be pinned with the base64-encoded SHA-256
+	// hash of the certificate's SubjectPublicKeyInfo, e.g.
+	// SPKI:sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=
+	// These entries match regardless of the certificate's subject or
+	// expiration, as long as the key doesn't change.
 	ACL *[]string `yaml:"acl,omitempty"`
 	// RootCAs a list of:
 	// - CA names defined in the PKI section,
@@ -504,6 +1871,31 @@ type ClientAuth struct {
 	// X-Forwarded-Client-Cert header should be added to the request when
 	// Mode is HTTP or HTTPS.
 	AddClientCertHeader []string `yaml:"addClientCertHeader,omitempty"`
+	// ClientCertHeaderFormat specifies the order of the fields in the
+	// X-Forwarded-Client-Cert header. The default is to add the fields in
+	// the order of AddClientCertHeader. With "envoy", the fields are always
+	// added in the same order as Envoy: Hash, Cert, Chain, Subject, URI,
+	// DNS.
+	ClientCertHeaderFormat string `yaml:"clientCertHeaderFormat,omitempty"`
+	// SPIFFETrustDomains optionally specifies which SPIFFE trust domains
+	// are accepted, e.g. example.org. When set, the client certificates
+	// must be valid X509-SVIDs, i.e. they must have exactly one URI SAN
+	// with a SPIFFE ID, and the trust domain of the SPIFFE ID must be one
+	// of these values.
+	SPIFFETrustDomains []string `yaml:"spiffeTrustDomains,omitempty"`
+	// Optional indicates that client certificates are requested, but not
+	// required, during the TLS handshake. Certificates that are presented
+	// must still be valid. The presence of a certificate and the ACL are
+	// only enforced for HTTP requests whose path matches one of the
+	// RequiredPaths prefixes. Other requests are allowed with or without
+	// a certificate. This is only valid in HTTP, HTTPS, LOCAL, and
+	// CONSOLE modes. When the ClientAuth settings change, the open
+	// connections are closed so that the new ones are enforced.
+	Optional bool `yaml:"optional,omitempty"`
+	// RequiredPaths is a list of path prefixes where a client certificate
+	// is required when Optional is true. Requests to these paths without
+	// a valid and authorized certificate are denied with status 403.
+	RequiredPaths []string `yaml:"requiredPaths,omitempty"`
 }
 
 // ConfigOIDC contains the parameters of an OIDC provider.
@@ -541,8 +1933,53 @@ type ConfigOIDC struct {
 	RedirectURL string `yaml:"redirectUrl"`
 	// ClientID is the Client ID.
 	ClientID string `yaml:"clientId"`
-	// ClientSecret is the Client Secret.
-	ClientSecret string `yaml:"clientSecret"`
+	// ClientSecret is the Client Secret. It may be left empty for public
+	// clients when PKCE is enabled.
+	ClientSecret string `yaml:"clientSecret,omitempty"`
+	// PKCE indicates whether Proof Key for Code Exchange (RFC 7636) should
+	// be used with the authorization code flow. The default is true. Only
+	// set this to false if the identity provider rejects the
+	// code_challenge parameter.
+	PKCE *bool `yaml:"pkce,omitempty"`
+	// RefreshTokens indicates that refresh tokens should be used to extend
+	// the user's session without sending them back to the identity
+	// provider. When the identity provider supports it, the offline_access
+	// scope is requested automatically. Some identity providers need
+	// other scopes or parameters to issue refresh tokens.
+	// The refresh tokens are encrypted and saved in the CacheDir. A
+	// refresh token is removed when the identity provider rejects it,
+	// but not when the refresh fails for other reasons, e.g. network
+	// errors.
+	RefreshTokens bool `yaml:"refreshTokens,omitempty"`
+	// GroupsClaim is the name of the claim that contains the user's groups,
+	// e.g. "groups". The groups can be used in BackendSSO.ACL with the
+	// "group:" prefix.
+	GroupsClaim string `yaml:"groupsClaim,omitempty"`
+	// RolesClaim is the name of the claim that contains the user's roles,
+	// e.g. "roles". The roles can be used in BackendSSO.ACL with the
+	// "role:" prefix.
+	RolesClaim string `yaml:"rolesClaim,omitempty"`
+	// ClaimMapping maps the names of standard claims to the names of the
+	// claims that the provider uses instead, for providers that don't put
+	// the user's identity in the usual claims, e.g.
+	//   email: upn
+	// or
+	//   email: preferred_username
+	// The standard claims that can be mapped are: sub, email, name,
+	// given_name, middle_name, family_name, and picture.
+	ClaimMapping map[string]string `yaml:"claimMapping,omitempty"`
+	// Issuer, if set, overrides the issuer from the discovery document.
+	// The ID tokens and the logout tokens must have this issuer. The
+	// {tenantid} placeholder is replaced with the token's tid claim, e.g.
+	// https://login.microsoftonline.com/{tenantid}/v2.0 for Azure AD
+	// multi-tenant applications. The value * accepts any issuer.
+	Issuer string `yaml:"issuer,omitempty"`
+	// BackchannelLogoutURL is the OpenID Connect Back-Channel Logout URL.
+	// It must be managed by the proxy. When set, the identity provider can
+	// send logout tokens to this URL to terminate user sessions. It
+	// requires DiscoveryURL.
+	// https://openid.net/specs/openid-connect-backchannel-1_0.html
+	BackchannelLogoutURL string `yaml:"backchannelLogoutUrl,omitempty"`
 	// Domain, if set, determine the domain where the user identities will
 	// be valid. Only set this if all host names in the domain are served
 	// by this proxy.
@@ -557,6 +1994,104 @@ type ConfigSAML struct {
 	EntityID string `yaml:"entityId"`
 	Certs    string `yaml:"certs"`
 	ACSURL   string `yaml:"acsUrl"`
+	// EncryptionCert and EncryptionKey are the PEM-encoded certificate and
+	// RSA private key, or the names of the files that contain them, used
+	// to decrypt encrypted assertions. The certificate must be registered
+	// with the identity provider. They are only needed when the identity
+	// provider encrypts assertions.
+	EncryptionCert string `yaml:"encryptionCert,omitempty"`
+	EncryptionKey  string `yaml:"encryptionKey,omitempty"`
+	// MetadataURL is the URL of the identity provider's metadata. When it
+	// is set, SSOURL and Certs are not needed. They are extracted from the
+	// metadata, which is refreshed every hour so that certificate
+	// rollovers are picked up automatically.
+	MetadataURL string `yaml:"metadataUrl,omitempty"`
+	// MetadataCerts are the PEM-encoded certificates, or the name of a file
+	// that contains them, used to verify the signature of the metadata.
+	// They are required with MetadataURL. The metadata must be signed.
+	MetadataCerts string `yaml:"metadataCerts,omitempty"`
+	// Domain, if set, determine the domain where the user identities will
+	// be valid. Only set this if all host names in the domain are served
+	// by this proxy.
+	Domain string `yaml:"domain,omitempty"`
+}
+
+// ConfigLDAP contains the parameters of an LDAP identity provider. Users
+// enter their username and password in a login form served by the proxy, and
+// the credentials are verified against the LDAP server.
+type ConfigLDAP struct {
+	// Name is the name of the provider. It is used internally only.
+	Name string `yaml:"name"`
+	// Endpoint is a URL on this proxy that will serve the login form.
+	Endpoint string `yaml:"endpoint"`
+	// ServerURL is the URL of the LDAP server, e.g.
+	// ldaps://ldap.example.com or ldap://ldap.example.com:389
+	ServerURL string `yaml:"serverUrl"`
+	// StartTLS indicates that ldap:// connections should be upgraded to
+	// TLS with the StartTLS operation.
+	StartTLS bool `yaml:"startTls,omitempty"`
+	// RootCAs are the PEM-encoded CA certificates, or the name of a file
+	// that contains them, used to verify the LDAP server's certificate.
+	// By default, the system's root CAs are used.
+	RootCAs string `yaml:"rootCAs,omitempty"`
+	// InsecureSkipVerify disables the verification of the LDAP server's
+	// certificate. It should only be used for testing.
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty"`
+	// BindDN and BindPassword are the credentials of the service account
+	// used to search the directory. When BindDN is empty, searches are
+	// anonymous.
+	BindDN       string `yaml:"bindDn,omitempty"`
+	BindPassword string `yaml:"bindPassword,omitempty"`
+	// UserBaseDN is the base DN where users are searched, e.g.
+	// ou=people,dc=example,dc=com
+	UserBaseDN string `yaml:"userBaseDn"`
+	// UserFilter is the filter used to find a user. The string {username}
+	// is replaced with the username entered in the login form. The
+	// default value is (uid={username}). With Active Directory, use
+	// (sAMAccountName={username}) or (userPrincipalName={username}).
+	UserFilter string `yaml:"userFilter,omitempty"`
+	// EmailAttribute is the user attribute that contains the email
+	// address. The default value is mail. Users without this attribute
+	// can't log in.
+	EmailAttribute string `yaml:"emailAttribute,omitempty"`
+	// GroupBaseDN is the base DN where groups are searched. When it is
+	// set, the user's groups are added to the "groups" claim and they can
+	// be used in ACLs.
+	GroupBaseDN string `yaml:"groupBaseDn,omitempty"`
+	// GroupFilter is the filter used to find the user's groups. The
+	// strings {dn} and {username} are replaced with the user's DN and
+	// username. The default value is (member={dn}).
+	GroupFilter string `yaml:"groupFilter,omitempty"`
+	// GroupAttribute is the group attribute that contains the group name.
+	// The default value is cn.
+	GroupAttribute string `yaml:"groupAttribute,omitempty"`
+	// Domain, if set, determine the domain where the user identities will
+	// be valid. Only set this if all host names in the domain are served
+	// by this proxy.
+	Domain string `yaml:"domain,omitempty"`
+}
+
+// ConfigPassword contains the parameters of a local username/password
+// identity provider. Users enter their username and password in a login form
+// served by the proxy, and the credentials are verified against a local
+// htpasswd-style file.
+type ConfigPassword struct {
+	// Name is the name of the provider. It is used internally only.
+	Name string `yaml:"name"`
+	// Endpoint is a URL on this proxy that will serve the login form.
+	Endpoint string `yaml:"endpoint"`
+	// File is the name of an htpasswd-style file with one username:hash
+	// entry per line. The hashes must be bcrypt, e.g. htpasswd -B, or
+	// argon2id in the PHC string format. The usernames are used as email
+	// addresses in ACLs. The file is reloaded automatically when it
+	// changes.
+	File string `yaml:"file"`
+	// TOTP enables time-based one-time passwords as a second factor. The
+	// value is "optional" or "required". With "optional", enrollment is
+	// offered to users at login, but they can skip it. With "required",
+	// users must enroll before they can log in. The enrollments are kept
+	// per identity provider name.
+	TOTP string `yaml:"totp,omitempty"`
 	// Domain, if set, determine the domain where the user identities will
 	// be valid. Only set this if all host names in the domain are served
 	// by this proxy.
@@ -579,6 +2114,14 @@ type ConfigPasskey struct {
 	// Endpoint is a URL on this proxy that will handle the passkey
 	// authentication.
 	Endpoint string `yaml:"endpoint"`
+	// TOTP enables time-based one-time passwords as a second factor after
+	// the passkey. The value is "optional" or "required", with the same
+	// meaning as ConfigPassword.TOTP.
+	TOTP string `yaml:"totp,omitempty"`
+	// Admins is a list of users who are allowed to list, revoke, and reset
+	// the passkeys of all users at /.sso/passkeys?admin=1. Resetting a
+	// user forces them to enroll again through IdentityProvider.
+	Admins []string `yaml:"admins,omitempty"`
 	// Domain, if set, determine the domain where the user identities will
 	// be valid. Only set this if all host names in the domain are served
 	// by this proxy.
@@ -599,6 +2142,19 @@ type ConfigPKI struct {
 	// CRLDistributionPoints is a list of URLs that return the Certificate
 	// Revocation List for this CA.
 	CRLDistributionPoints []string `yaml:"crlDistributionPoints,omitempty"`
+	// CRLUpdateInterval is how often a new Certificate Revocation List is
+	// published. A new list is also published immediately after each
+	// revocation, unless delta CRLs are enabled. The default is 1 hour.
+	CRLUpdateInterval time.Duration `yaml:"crlUpdateInterval,omitempty"`
+	// DeltaCRLDistributionPoints is a list of URLs that return the delta
+	// Certificate Revocation List for this CA. When set, new revocations
+	// are published immediately in the delta CRL, and the base CRL is
+	// only published every CRLUpdateInterval. This is useful when the
+	// base CRL is large.
+	DeltaCRLDistributionPoints []string `yaml:"deltaCrlDistributionPoints,omitempty"`
+	// DeltaCRLUpdateInterval is how often a new delta CRL is published.
+	// The default is 15 minutes.
+	DeltaCRLUpdateInterval time.Duration `yaml:"deltaCrlUpdateInterval,omitempty"`
 	// OCSPServer is a list of URLs that serve the Online Certificate Status
 	// Protocol (OCSP) for this CA.
 	// https://en.wikipedia.org/wiki/Online_Certificate_Status_Protocol
@@ -610,6 +2166,161 @@ type ConfigPKI struct {
 	// Admins is a list of users who are allowed to perform administrative
 	// tasks on the CA, e.g. revoke any certificate.
 	Admins []string `yaml:"admins"`
+	// ACME, if set, enables an ACME server (RFC 8555) for this CA, so that
+	// standard ACME clients can obtain certificates from it.
+	ACME *ConfigPKIACME `yaml:"acme,omitempty"`
+	// EST, if set, enables Enrollment over Secure Transport (RFC 7030)
+	// for this CA.
+	EST *ConfigPKIEST `yaml:"est,omitempty"`
+	// SCEP, if set, enables a Simple Certificate Enrollment Protocol (RFC
+	// 8894) responder for this CA, e.g. for MDM-managed devices.
+	SCEP *ConfigPKISCEP `yaml:"scep,omitempty"`
+	// Renewal, if set, enables an API that clients can use to renew their
+	// certificates before they expire, authenticating with the current
+	// certificate. See the pkirenew package for a Go client.
+	Renewal *ConfigPKIRenewal `yaml:"renewal,omitempty"`
+	// Profiles is a list of certificate profiles that users can select
+	// when they request a certificate on the Endpoint. When empty, the
+	// certificates are issued with the default settings.
+	Profiles []*ConfigPKIProfile `yaml:"profiles,omitempty"`
+}
+
+// ConfigPKIRenewal defines the parameters of a PKI's certificate renewal API.
+type ConfigPKIRenewal struct {
+	// Endpoint is the URL of the renewal API, e.g.
+	// https://pki.example.com/renew
+	//
+	// The backend must require TLS client certificates issued by this CA
+	// (see Backend.ClientAuth). Only certificates that can be used for TLS
+	// client authentication can be renewed.
+	Endpoint string `yaml:"endpoint"`
+	// RenewBefore is how long before expiration a certificate can be
+	// renewed. The default is one third of the certificate's lifetime.
+	RenewBefore time.Duration `yaml:"renewBefore,omitempty"`
+}
+
+// ConfigPKIProfile defines a certificate issuance profile.
+type ConfigPKIProfile struct {
+	// Name is the name of the profile.
+	Name string `yaml:"name"`
+	// Description is shown to the users when they select a profile.
+	Description string `yaml:"description,omitempty"`
+	// KeyUsages is the list of key usages to include in the certificates:
+	// digitalSignature, contentCommitment, keyEncipherment,
+	// dataEncipherment, or keyAgreement. The default is digitalSignature
+	// and dataEncipherment.
+	KeyUsages []string `yaml:"keyUsages,omitempty"`
+	// ExtKeyUsages is the list of extended key usages to include in the
+	// certificates: serverAuth, clientAuth, codeSigning, or
+	// emailProtection. The default is serverAuth when the certificate has
+	// DNS names, and clientAuth otherwise.
+	ExtKeyUsages []string `yaml:"extKeyUsages,omitempty"`
+	// DNSNames is the list of DNS names that are allowed in the
+	// certificates, e.g. "www.example.com" or "*.example.com". The latter
+	// matches any subdomain of example.com. When empty, DNS names are not
+	// allowed.
+	DNSNames []string `yaml:"dnsNames,omitempty"`
+	// LabelPattern is a regular expression that the certificate label,
+	// i.e. the requested common name, must match.
+	LabelPattern string `yaml:"labelPattern,omitempty"`
+	// MaxLifetime is the maximum lifetime of the certificates. It is also
+	// the default lifetime. The default is 10 years.
+	MaxLifetime time.Duration `yaml:"maxLifetime,omitempty"`
+	// Users is the list of users who can use this profile. Each entry is
+	// either an email address or a domain that starts with @, e.g.
+	// @example.com. When empty, all users can use it.
+	Users []string `yaml:"users,omitempty"`
+	// AdminsOnly indicates that only the PKI admins can use this profile.
+	AdminsOnly bool `yaml:"adminsOnly,omitempty"`
+}
+
+func (p *ConfigPKIProfile) pkiProfile() pki.Profile {
+	return pki.Profile{
+		Name:         p.Name,
+		Description:  p.Description,
+		KeyUsages:    p.KeyUsages,
+		ExtKeyUsages: p.ExtKeyUsages,
+		DNSNames:     p.DNSNames,
+		LabelPattern: p.LabelPattern,
+		MaxLifetime:  p.MaxLifetime,
+		Users:        p.Users,
+		AdminsOnly:   p.AdminsOnly,
+	}
+}
+
+// ConfigPKISCEP defines the parameters of a PKI's SCEP responder.
+type ConfigPKISCEP struct {
+	// Endpoint is the URL of the SCEP responder, e.g.
+	// https://pki.example.com/scep
+	Endpoint string `yaml:"endpoint"`
+	// ChallengePassword is a static challenge password that all the
+	// devices can use to enroll.
+	ChallengePassword string `yaml:"challengePassword,omitempty"`
+	// ChallengeEndpoint is the URL where one-time challenge passwords are
+	// issued, one per device, in response to POST requests. Its backend
+	// must restrict access with SSO or ClientAuth, e.g. so that only the
+	// device management server can reach it.
+	ChallengeEndpoint string `yaml:"challengeEndpoint,omitempty"`
+	// ChallengeLifetime is the lifetime of the one-time challenge
+	// passwords. The default is 24 hours.
+	ChallengeLifetime time.Duration `yaml:"challengeLifetime,omitempty"`
+	// CertificateLifetime is the lifetime of the issued certificates. The
+	// default is 365 days.
+	CertificateLifetime time.Duration `yaml:"certificateLifetime,omitempty"`
+	// AllowedDomains restricts which domain names can be in the issued
+	// certificates, e.g. "example.com" or "*.example.com". By default,
+	// domain names are not allowed.
+	AllowedDomains []string `yaml:"allowedDomains,omitempty"`
+	// AllowedIPs are the IP prefixes, e.g. 10.0.0.0/8, that can be in the
+	// issued certificates. By default, IP addresses are not allowed.
+	AllowedIPs []string `yaml:"allowedIPs,omitempty"`
+}
+
+// ConfigPKIEST defines the parameters of a PKI's EST endpoints.
+type ConfigPKIEST struct {
+	// Endpoint is the base URL of the EST endpoints, e.g.
+	// https://pki.example.com/.well-known/est
+	//
+	// The cacerts endpoint is public. The simpleenroll endpoint requires
+	// the client to be authenticated with either SSO or a TLS client
+	// certificate (see Backend.ClientAuth). The simplereenroll endpoint
+	// requires a valid TLS client certificate issued by this CA.
+	Endpoint string `yaml:"endpoint"`
+	// AllowedDomains restricts which domain names can be in the
+	// certificates of the clients that authenticate with a TLS client
+	// certificate, e.g. "example.com" or "*.example.com". It is required
+	// when the Endpoint's backend uses ClientAuth.
+	AllowedDomains []string `yaml:"allowedDomains,omitempty"`
+	// AllowedIPs are the IP prefixes, e.g. 10.0.0.0/8, that can be in the
+	// certificates of the clients that authenticate with a TLS client
+	// certificate. By default, IP addresses are not allowed.
+	AllowedIPs []string `yaml:"allowedIPs,omitempty"`
+	// CertificateLifetime is the lifetime of the issued certificates. The
+	// default is 365 days.
+	CertificateLifetime time.Duration `yaml:"certificateLifetime,omitempty"`
+}
+
+// ConfigPKIACME defines the parameters of a PKI's ACME server.
+type ConfigPKIACME struct {
+	// Endpoint is the base URL of the ACME server. The ACME directory is
+	// at Endpoint + "/directory", e.g.
+	// https://pki.example.com/acme/directory
+	Endpoint string `yaml:"endpoint"`
+	// Challenges is the list of challenge types to offer. Valid values are
+	// http-01 and tls-alpn-01. The default is both. The challenges are
+	// validated by connecting directly to the requested domain names.
+	Challenges []string `yaml:"challenges,omitempty"`
+	// PreAuthorizedAccounts is a list of ACME account key thumbprints (RFC
+	// 7638). These accounts can get certificates without completing any
+	// challenges, including for wildcard names.
+	PreAuthorizedAccounts []string `yaml:"preAuthorizedAccounts,omitempty"`
+	// AllowedDomains optionally restricts which domain names can be in
+	// the issued certificates, e.g. "example.com" or "*.example.com". The
+	// latter matches any subdomain of example.com.
+	AllowedDomains []string `yaml:"allowedDomains,omitempty"`
+	// CertificateLifetime is the lifetime of the issued certificates. The
+	// default is 90 days.
+	CertificateLifetime time.Duration `yaml:"certificateLifetime,omitempty"`
 }
 
 // ConfigSSHCertificateAuthority defines a certificate authority.
@@ -630,7 +2341,8 @@ type ConfigSSHCertificateAuthority struct {
 // BackendSSO specifies the identity parameters to use for a backend.
 type BackendSSO struct {
 	// Provider is the the name of an identity provider defined in
-	// Config.OIDCProviders.
+	// Config.OIDCProviders, Config.SAMLProviders, Config.LDAPProviders,
+	// Config.PasswordProviders, or Config.PasskeyProviders.
 	Provider string `yaml:"provider"`
 	// ForceReAuth is the time duration after which the user has to
 	// authenticate again. By default, users don't have to authenticate
@@ -638,7 +2350,9 @@ type BackendSSO struct {
 	ForceReAuth time.Duration `yaml:"forceReAuth,omitempty"`
 	// ACL restricts which user identity can access this backend. It is a
 	// list of email addresses and/or domains, e.g. "bob@example.com", or
-	// "@example.com"
+	// "@example.com", and/or groups and roles, e.g. "group:engineering",
+	// or "role:admin". Groups and roles are only available with identity
+	// providers that have GroupsClaim or RolesClaim set.
 	// If ACL is nil, all identities are allowed. If ACL is an empty list,
 	// nobody is allowed.
 	ACL *[]string `yaml:"acl,omitempty"`
@@ -659,9 +2373,44 @@ type BackendSSO struct {
 	//       "x-tlsproxy-user-id": "${JWT:email}",
 	//   }
 	SetUserIDHeader bool `yaml:"setUserIdHeader,omitempty"`
+	// ClaimHeaders maps the names of claims to the names of HTTP headers
+	// that are set with the claims of the user's session, e.g.
+	//   name: X-User-Name
+	//   groups: X-User-Groups
+	// Lists of values are joined with commas. The headers are always
+	// removed from the client's requests.
+	ClaimHeaders map[string]string `yaml:"claimHeaders,omitempty"`
+	// BearerTokens allows API clients to authenticate with
+	// "Authorization: Bearer" tokens instead of cookies. The requests with
+	// an invalid bearer token receive a 401 Unauthorized response instead
+	// of being redirected to the identity provider.
+	BearerTokens *BearerTokens `yaml:"bearerTokens,omitempty"`
+	// APIKeys allows API clients to authenticate with static API keys
+	// instead of cookies, e.g. for services that can't use OIDC or
+	// client certificates. The requests with an invalid API key receive a
+	// 401 Unauthorized response.
+	APIKeys *APIKeys `yaml:"apiKeys,omitempty"`
 	// GenerateIDTokens indicates that the proxy should generate ID tokens
 	// for authenticated users.
 	GenerateIDTokens bool `yaml:"generateIdTokens,omitempty"`
+	// IDTokenAudience is the list of audience values of the ID tokens
+	// generated when GenerateIDTokens is true. By default, the audience
+	// is the URL of the backend, e.g. https://www.example.com/.
+	IDTokenAudience []string `yaml:"idTokenAudience,omitempty"`
+	// IDTokenLifetime is the lifetime of the ID tokens generated when
+	// GenerateIDTokens is true. By default, the ID tokens expire at the
+	// same time as the user's session.
+	IDTokenLifetime time.Duration `yaml:"idTokenLifetime,omitempty"`
+	// IDTokenClaims are extra claims to add to the ID tokens generated
+	// when GenerateIDTokens is true. The values can be static strings, or
+	// use the claims of the user's session, e.g. "${JWT:email}". When a
+	// value is only one reference, the claim is copied as is, e.g. a list
+	// of groups stays a list. Otherwise, the claims that aren't strings
+	// are inserted as JSON.
+	IDTokenClaims map[string]string `yaml:"idTokenClaims,omitempty"`
+	// SessionLimit limits how many sessions a user can have at the same
+	// time on this backend, e.g. to prevent credential sharing.
+	SessionLimit *SessionLimit `yaml:"sessionLimit,omitempty"`
 	// LocalOIDCServer is used to configure a local OpenID Provider to
 	// authenticate users with backend services that support OpenID Connect.
 	LocalOIDCServer *LocalOIDCServer `yaml:"localOIDCServer,omitempty"`
@@ -671,6 +2420,72 @@ type BackendSSO struct {
 	actualIDP string
 }
 
+// BearerTokens specifies which bearer tokens are accepted. The ID tokens
+// generated by the proxy for the backend, e.g. with GenerateIDTokens, are
+// always accepted.
+type BearerTokens struct {
+	// Upstream indicates that the tokens issued by the SSO identity
+	// provider, e.g. access tokens, are also accepted. They are validated
+	// with the provider's keys. It requires an OIDC provider with a
+	// DiscoveryURL.
+	Upstream bool `yaml:"upstream,omitempty"`
+	// Audiences is the list of accepted audiences of the upstream
+	// tokens. The default is the ClientID of the identity provider.
+	Audiences []string `yaml:"audiences,omitempty"`
+}
+
+// APIKeys specifies which API keys are accepted, and how the clients send
+// them. Each key is mapped to an identity that is used like an email
+// address in the ACL and in the logs, e.g.
+//
+//	apiKeys:
+//	  keys:
+//	  - key: "5d41402abc4b2a76b9719d911017c592"
+//	    identity: billing-service
+type APIKeys struct {
+	// Header is the name of the HTTP header that contains the API key.
+	// The default is X-API-Key.
+	Header string `yaml:"header,omitempty"`
+	// QueryParam is the name of the query parameter that contains the
+	// API key. By default, the API key can only be sent in the header.
+	QueryParam string `yaml:"queryParam,omitempty"`
+	// Keys is the list of accepted API keys.
+	Keys []APIKey `yaml:"keys,omitempty"`
+	// File is the name of a file that contains more API keys, one per
+	// line, in the format "<identity> <key>". Empty lines and lines that
+	// start with # are ignored.
+	File string `yaml:"file,omitempty"`
+
+	// The SHA256 hashes of the API keys, mapped to their identities.
+	identities map[[32]byte]string
+}
+
+// APIKey is an API key and the identity that it is mapped to.
+type APIKey struct {
+	// Key is the value of the API key. It should be a long random
+	// string.
+	Key string `yaml:"key"`
+	// Identity is the identity of the clients that use this key.
+	Identity string `yaml:"identity"`
+}
+
+// SessionLimit specifies how many sessions a user can have at the same time.
+// A session is one login, e.g. on one browser or device. It is identified
+// by the session ID of the user's auth token.
+type SessionLimit struct {
+	// Max is the maximum number of active sessions per user.
+	Max int `yaml:"max"`
+	// Policy is what to do when a user with Max active sessions uses a
+	// new session:
+	//   - reject: the new session is denied access (default).
+	//   - evict-oldest: the oldest session is revoked, and the user has to
+	//     log in again on that device.
+	Policy string `yaml:"policy,omitempty"`
+	// IdleTimeout is the amount of time after which a session that isn't
+	// used is no longer active. The default is 1h.
+	IdleTimeout time.Duration `yaml:"idleTimeout,omitempty"`
+}
+
 // PathOverride specifies different backend parameters for some path prefixes.
 type PathOverride struct {
 	// Paths is the list of path prefixes for which these parameters apply.
@@ -678,6 +2493,15 @@ type PathOverride struct {
 	// Addresses is a list of server addresses where requests are forwarded.
 	// When more than one address are specified, requests are distributed
 	// using a simple round robin.
+	//
+	// Addresses that start with srv+ are names of DNS SRV records, e.g.
+	// srv+_app._tcp.example.com. The records are resolved again every 30
+	// seconds, and the targets are selected according to their priority
+	// and weight.
+	//
+	// Addresses that start with tailscale+ are dialed through the
+	// tailnet, e.g. tailscale+db.example.ts.net:5432. Tailscale must be
+	// set. They can't be used in QUIC mode.
 	Addresses []string `yaml:"addresses,omitempty"`
 	// Mode is either HTTP or HTTPS.
 	Mode string `yaml:"mode"`
@@ -704,16 +2528,73 @@ type PathOverride struct {
 	// - File names that contain PEM-encoded certificates, or
 	// - PEM-encoded certificates.
 	ForwardRootCAs []string `yaml:"forwardRootCAs,omitempty"`
+	// ForwardRequireOCSP requires the backend server's certificate to have
+	// a valid Good OCSP response, either stapled in the TLS handshake or
+	// fetched by the proxy. When the certificate has the OCSP must-staple
+	// extension, the response must be stapled. Connections that don't
+	// meet this requirement are rejected. Certificates issued by a local
+	// PKI are checked directly against the PKI's revocation list.
+	ForwardRequireOCSP bool `yaml:"forwardRequireOcsp,omitempty"`
+	// ForwardRequireSCT requires the backend server's certificate to have
+	// valid Signed Certificate Timestamps (SCTs) from at least two
+	// different Certificate Transparency log operators, either embedded in
+	// the certificate or sent in the TLS handshake. The logs are from
+	// CTLogList. Connections that don't meet this requirement are rejected.
+	ForwardRequireSCT bool `yaml:"forwardRequireSct,omitempty"`
+	// ForwardDANE enables the verification of the backend server's
+	// certificate with DNSSEC-signed TLSA records (RFC 6698), e.g.
+	// _443._tcp.backend.example.com, instead of the usual verification.
+	// The Resolver must be set, and must validate DNSSEC. The connection
+	// to the resolver must be trusted, e.g. a local resolver, DoT, or DoH.
+	// Connections without a matching TLSA record are rejected. It is only
+	// valid in TLS, HTTPS, and QUIC modes, with host names in Addresses,
+	// and it can't be used with ForwardRequireOCSP or ForwardRequireSCT.
+	ForwardDANE bool `yaml:"forwardDane,omitempty"`
+	// ForwardPinnedKeys is a list of public key hashes, e.g.
+	// SPKI:sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=
+	// When set, the backend server's certificate chain must contain one
+	// of these public keys. Connections that don't match are rejected.
+	// With InsecureSkipVerify, only the server's own certificate is
+	// checked, and the pins replace the usual verification.
+	ForwardPinnedKeys []string `yaml:"forwardPinnedKeys,omitempty"`
 	// ForwardTimeout is the connection timeout to backend servers. If
 	// Addresses contains multiple addresses, this timeout indicates how
 	// long to wait before trying the next address in the list. The default
 	// value is 30 seconds.
 	ForwardTimeout time.Duration `yaml:"forwardTimeout"`
+	// DialSourceAddress is the local IP address to use for the connections
+	// to the backend servers, e.g. 192.0.2.10. This is useful when the
+	// backend servers filter connections by source address, or when the
+	// proxy has multiple egress addresses. By default, the operating
+	// system chooses the source address. It doesn't apply to QUIC
+	// connections.
+	DialSourceAddress string `yaml:"dialSourceAddress,omitempty"`
+	// DialInterface is the name of the network interface to use for the
+	// connections to the backend servers, e.g. eth1. This is useful on
+	// multi-homed hosts with policy routing. It uses SO_BINDTODEVICE and
+	// is only supported on linux, where it may require the CAP_NET_RAW
+	// capability. It doesn't apply to QUIC connections.
+	DialInterface string `yaml:"dialInterface,omitempty"`
+	// ForwardTCPOptions specifies the socket options of the TCP
+	// connections to the backend servers. By default, TCP_NODELAY is set
+	// and keep-alive probes are sent every 30 seconds. It doesn't apply to
+	// QUIC connections.
+	ForwardTCPOptions *TCPOptions `yaml:"forwardTcpOptions,omitempty"`
 	// ProxyProtocolVersion enables the PROXY protocol on this backend. The
 	// value is the version of the protocol to use, e.g. v1 or v2.
 	// By default, the proxy protocol is not enabled.
 	// See https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt
 	ProxyProtocolVersion string `yaml:"proxyProtocolVersion,omitempty"`
+	// ProxyProtocolTLVs is the list of TLVs to add to the PROXY protocol
+	// v2 header:
+	//   - authority: the server name requested by the client.
+	//   - alpn: the ALPN protocol negotiated with the client.
+	//   - unique-id: a unique ID of the client connection.
+	//   - ssl: the TLS version and cipher suite negotiated with the
+	//     client, and the common name of the client certificate, if any.
+	//     It is not sent in TLSPASSTHROUGH mode.
+	// The default is authority and alpn.
+	ProxyProtocolTLVs *[]string `yaml:"proxyProtocolTLVs,omitempty"`
 	// ForwardHTTPHeaders is a list of HTTP headers to add to the forwarded
 	// request. Headers that already exist are overwritten.
 	//
@@ -725,16 +2606,39 @@ type PathOverride struct {
 	//   ${REMOTE_IP} is the remote IP address of the network connection.
 	//   ${SERVER_NAME} is the server name requested by the client.
 	//   ${JWT:xxxx} expands to the value of claim xxxx from the ID token.
+	//   ${PROXY_TLV:xxxx} expands to the value of TLV xxxx from the PROXY
+	//     protocol header received from an upstream load balancer, i.e.
+	//     aws-vpce-id, azure-link-id, gcp-psc-id, authority, alpn,
+	//     unique-id, or 0xNN for the hex encoded value of TLV type NN.
 	ForwardHTTPHeaders *map[string]string `yaml:"forwardHttpHeaders,omitempty"`
 	// SanitizePath indicates that the request's path should be sanitized
 	// before forwarding the request to the backend.
 	SanitizePath *bool `yaml:"sanitizePath,omitempty"`
 
 	forwardRootCAs       *x509.CertPool
+	dialSourceAddr       *net.TCPAddr
 	proxyProtocolVersion byte
+	proxyProtocolTLVs    []string
 	documentRoot         *os.Root
 }
 
+// CanaryRoute sends the requests that have a specific header or cookie value
+// to an alternate list of addresses.
+type CanaryRoute struct {
+	// Header is the name of the request header to match, e.g. X-Canary.
+	Header string `yaml:"header,omitempty"`
+	// Cookie is the name of the cookie to match. Exactly one of Header or
+	// Cookie must be set.
+	Cookie string `yaml:"cookie,omitempty"`
+	// Value is the value that the header or cookie must have. When Value
+	// is empty, any non-empty value matches.
+	Value string `yaml:"value,omitempty"`
+	// Addresses is the list of server addresses where the matching
+	// requests are forwarded. When more than one address are specified,
+	// requests are distributed using a simple round robin.
+	Addresses []string `yaml:"addresses"`
+}
+
 // LocalOIDCServer is used to configure a local OpenID Provider to
 // authenticate users with backend services that support OpenID Connect.
 // When this is enabled, tlsproxy will add a few endpoints to this
@@ -742,7 +2646,16 @@ type PathOverride struct {
 // - <PathPrefix>/.well-known/openid-configuration
 // - <PathPrefix>/authorization
 // - <PathPrefix>/token
+// - <PathPrefix>/userinfo
+// - <PathPrefix>/device_authorization
+// - <PathPrefix>/device
+// - <PathPrefix>/introspect
+// - <PathPrefix>/revoke
 // - <PathPrefix>/jwks
+//
+// The introspect endpoint (RFC 7662) lets resource servers check whether a
+// token is still active, using the credentials of any client. The revoke
+// endpoint (RFC 7009) lets clients revoke their tokens, e.g. on logout.
 type LocalOIDCServer struct {
 	// PathPrefix specifies how the endpoint paths are constructed. It is
 	// generally fine to leave it empty.
@@ -768,7 +2681,41 @@ type LocalOIDCClient struct {
 	Secret string `yaml:"secret"`
 	// RedirectURI is where the authorization endpoint will redirect the
 	// user once the authorization code has been granted.
-	RedirectURI []string `yaml:"redirectUri"`
+	RedirectURI []string `yaml:"redirectUri,omitempty"`
+	// GrantTypes is the list of OAUTH2 grant types that the client is
+	// allowed to use: authorization_code, client_credentials, device_code,
+	// refresh_token, and/or token_exchange. The default is
+	// authorization_code. The client_credentials grant lets
+	// machine-to-machine services get access tokens with their own client
+	// ID and secret. The device_code grant (RFC 8628) lets CLI tools and
+	// devices without a browser get tokens after the user approves the
+	// request at <pathPrefix>/device. The token_exchange grant (RFC 8693)
+	// lets backend services exchange an ID token issued by the proxy for a
+	// token with a narrower audience and scope, e.g. to call another
+	// backend on behalf of the user.
+	GrantTypes []string `yaml:"grantTypes,omitempty"`
+	// Scopes is the list of scopes that the client can request with the
+	// client_credentials and token_exchange grants.
+	Scopes []string `yaml:"scopes,omitempty"`
+	// Audiences is the list of audiences that the client can request with
+	// the token_exchange grant. By default, the tokens are issued with the
+	// client's ID as audience.
+	Audiences []string `yaml:"audiences,omitempty"`
+	// CodeLifetime is the lifetime of the authorization codes. The default
+	// is 2 minutes.
+	CodeLifetime time.Duration `yaml:"codeLifetime,omitempty"`
+	// AccessTokenLifetime is the lifetime of the access tokens. The
+	// default is 90 seconds, or 1 hour with the client_credentials grant.
+	AccessTokenLifetime time.Duration `yaml:"accessTokenLifetime,omitempty"`
+	// IDTokenLifetime is the lifetime of the ID tokens. The default is 5
+	// minutes.
+	IDTokenLifetime time.Duration `yaml:"idTokenLifetime,omitempty"`
+	// RefreshTokenLifetime is the lifetime of the refresh tokens. Refresh
+	// tokens are only issued when GrantTypes includes refresh_token. They
+	// can only be used once, and a new refresh token is issued each time.
+	// Refresh tokens are kept in memory and don't survive a restart. The
+	// default is 24 hours.
+	RefreshTokenLifetime time.Duration `yaml:"refreshTokenLifetime,omitempty"`
 }
 
 // LocalOIDCRewriteRule define how to rewrite existing claims or create new
@@ -801,6 +2748,15 @@ func (cfg *Config) equal(other *Config) bool {
 	return bytes.Equal(a, b)
 }
 
+func (ca *ClientAuth) equal(other *ClientAuth) bool {
+	if ca == nil || other == nil {
+		return ca == other
+	}
+	a, _ := yaml.Marshal(ca)
+	b, _ := yaml.Marshal(other)
+	return bytes.Equal(a, b)
+}
+
 func (cfg *Config) clone() *Config {
 	b := cfg.serialize()
 	var out Config
@@ -808,6 +2764,39 @@ func (cfg *Config) clone() *Config {
 	return &out
 }
 
+// earlyDataEnabled returns true if at least one backend accepts early data.
+func (cfg *Config) earlyDataEnabled() bool {
+	return slices.ContainsFunc(cfg.Backends, func(be *Backend) bool {
+		return be.EarlyData != nil
+	})
+}
+
+// maxTokenLifetime returns the longest configured lifetime of the tokens
+// that are checked against the session revocation list.
+func (cfg *Config) maxTokenLifetime() time.Duration {
+	var d time.Duration
+	for _, be := range cfg.Backends {
+		if be.SSO == nil {
+			continue
+		}
+		d = max(d, be.SSO.IDTokenLifetime)
+		if ls := be.SSO.LocalOIDCServer; ls != nil {
+			for _, c := range ls.Clients {
+				d = max(d, c.AccessTokenLifetime, c.IDTokenLifetime, c.RefreshTokenLifetime)
+			}
+		}
+	}
+	return d
+}
+
+// storageDir returns the directory of the encrypted storage.
+func (cfg *Config) storageDir() string {
+	if cfg.Cluster != nil {
+		return cfg.Cluster.StorageDir
+	}
+	return cfg.CacheDir
+}
+
 // Check checks that the Config is valid, sets some default values, and
 // initializes internal data structures.
 func (cfg *Config) Check() error {
@@ -829,6 +2818,11 @@ func (cfg *Config) Check() error {
 		}
 		cfg.MaxOpen = n/2 - 100
 	}
+	if cfg.ForwardBufferSize != 0 {
+		if err := validateBufferSize(cfg.ForwardBufferSize); err != nil {
+			return fmt.Errorf("ForwardBufferSize: %w", err)
+		}
+	}
 	if cfg.EnableQUIC == nil {
 		v := quicIsEnabled
 		cfg.EnableQUIC = &v
@@ -836,55 +2830,209 @@ func (cfg *Config) Check() error {
 	if *cfg.EnableQUIC && !quicIsEnabled {
 		return errors.New("EnableQUIC: QUIC is not supported in this binary")
 	}
-	cfg.acceptProxyHeaderFrom = make([]*net.IPNet, len(cfg.AcceptProxyHeaderFrom))
-	for i, c := range cfg.AcceptProxyHeaderFrom {
-		_, n, err := net.ParseCIDR(c)
-		if err != nil {
-			return fmt.Errorf("AcceptProxyHeaderFrom[%d]: %w", i, err)
+	if cfg.QUICHandshakeTimeout < 0 {
+		return errors.New("QUICHandshakeTimeout: must not be negative")
+	}
+	if v := cfg.QUICInitialPacketSize; v != 0 && (v < 1200 || v > 1452) {
+		return errors.New("QUICInitialPacketSize: must be between 1200 and 1452")
+	}
+	if o := cfg.Overload; o != nil {
+		if o.MaxHeapSize < 0 {
+			return errors.New("Overload.MaxHeapSize: must not be negative")
+		}
+		if o.MaxOpenPercent < 0 || o.MaxOpenPercent > 100 {
+			return errors.New("Overload.MaxOpenPercent: must be between 0 and 100")
+		}
+		if o.MaxHeapSize == 0 && o.MaxOpenPercent == 0 {
+			return errors.New("Overload: MaxHeapSize or MaxOpenPercent must be set")
 		}
-		cfg.acceptProxyHeaderFrom[i] = n
 	}
-
-	cfg.DefaultServerName = idnaToASCII(cfg.DefaultServerName)
-
-	identityProviders := make(map[string]bool)
-	for i, oi := range cfg.OIDCProviders {
-		if identityProviders[oi.Name] {
-			return fmt.Errorf("oidc[%d].Name: duplicate provider name %q", i, oi.Name)
+	if a := cfg.AnomalyDetection; a != nil {
+		if a.Interval < 0 || a.BaselineWindow < 0 || a.MinConnectionRate < 0 || a.MinByteRate < 0 {
+			return errors.New("AnomalyDetection: values must not be negative")
 		}
-		identityProviders[oi.Name] = true
-
-		if (oi.AuthEndpoint == "" || oi.TokenEndpoint == "") && oi.DiscoveryURL == "" {
-			return fmt.Errorf("oidc[%d] AuthEndpoint and TokenEndpoint must be set unless DiscoveryURL is set", i)
+		if a.Factor != 0 && a.Factor <= 1 {
+			return errors.New("AnomalyDetection.Factor: must be greater than 1")
 		}
-		if oi.DiscoveryURL != "" {
-			if _, err := url.Parse(oi.DiscoveryURL); err != nil {
-				return fmt.Errorf("oidc[%d].DiscoveryURL: %v", i, err)
-			}
+		if a.Interval == 0 {
+			a.Interval = time.Minute
 		}
-		if oi.AuthEndpoint != "" {
-			if _, err := url.Parse(oi.AuthEndpoint); err != nil {
-				return fmt.Errorf("oidc[%d].AuthEndpoint: %v", i, err)
-			}
+		if a.BaselineWindow == 0 {
+			a.BaselineWindow = time.Hour
 		}
-		if oi.TokenEndpoint != "" {
-			if _, err := url.Parse(oi.TokenEndpoint); err != nil {
-				return fmt.Errorf("oidc[%d].TokenEndpoint: %v", i, err)
-			}
+		if a.BaselineWindow < a.Interval {
+			return errors.New("AnomalyDetection.BaselineWindow: must not be less than Interval")
 		}
-		if oi.RedirectURL == "" {
-			return fmt.Errorf("oidc[%d].RedirectURL must be set", i)
+		if a.Factor == 0 {
+			a.Factor = 3
 		}
-		if _, err := url.Parse(oi.RedirectURL); err != nil {
-			return fmt.Errorf("oidc[%d].RedirectURL: %v", i, err)
+		if a.MinConnectionRate == 0 {
+			a.MinConnectionRate = 1
 		}
-		if oi.ClientID == "" {
-			return fmt.Errorf("oidc[%d].ClientID must be set", i)
+		if a.MinByteRate == 0 {
+			a.MinByteRate = 100000
 		}
-		if oi.ClientSecret == "" {
-			return fmt.Errorf("oidc[%d].ClientSecret must be set", i)
+		for i, wh := range a.WebHooks {
+			if u, err := url.Parse(wh); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("AnomalyDetection.WebHooks[%d]: invalid URL %q", i, wh)
+			}
 		}
-		if oi.Domain != "" {
+	}
+	if l := cfg.HandshakeRateLimit; l != nil {
+		if l.Rate < 0 {
+			return errors.New("HandshakeRateLimit.Rate: must not be negative")
+		}
+		if l.Burst < 0 {
+			return errors.New("HandshakeRateLimit.Burst: must not be negative")
+		}
+		if l.MaxConcurrent < 0 {
+			return errors.New("HandshakeRateLimit.MaxConcurrent: must not be negative")
+		}
+		if l.IPv4Prefix == 0 {
+			l.IPv4Prefix = 32
+		}
+		if l.IPv4Prefix < 1 || l.IPv4Prefix > 32 {
+			return errors.New("HandshakeRateLimit.IPv4Prefix: must be between 1 and 32")
+		}
+		if l.IPv6Prefix == 0 {
+			l.IPv6Prefix = 64
+		}
+		if l.IPv6Prefix < 1 || l.IPv6Prefix > 128 {
+			return errors.New("HandshakeRateLimit.IPv6Prefix: must be between 1 and 128")
+		}
+	}
+	if ts := cfg.Tailscale; ts != nil {
+		if !tailscaleIsEnabled {
+			return errors.New("Tailscale: not enabled in this binary, build with -tags tailscale")
+		}
+		if ts.Hostname == "" {
+			ts.Hostname = defaultTailscaleHostname
+		}
+		if ts.StateDir == "" {
+			ts.StateDir = filepath.Join(cfg.CacheDir, "tailscale")
+		}
+		if ts.ControlURL != "" {
+			if u, err := url.Parse(ts.ControlURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return fmt.Errorf("Tailscale.ControlURL: invalid URL %q", ts.ControlURL)
+			}
+		}
+	}
+	if sp := cfg.SPIFFE; sp != nil {
+		if sp.WorkloadAPIAddr == "" {
+			sp.WorkloadAPIAddr, _ = workloadapi.GetDefaultAddress()
+		}
+		if sp.WorkloadAPIAddr == "" {
+			return errors.New("SPIFFE.WorkloadAPIAddr: must be set")
+		}
+		if err := workloadapi.ValidateAddress(sp.WorkloadAPIAddr); err != nil {
+			return fmt.Errorf("SPIFFE.WorkloadAPIAddr: %w", err)
+		}
+	}
+	if cfg.TCPOptions != nil {
+		if err := cfg.TCPOptions.validate(); err != nil {
+			return fmt.Errorf("TCPOptions: %w", err)
+		}
+	}
+	cfg.acceptProxyHeaderFrom = make([]*net.IPNet, len(cfg.AcceptProxyHeaderFrom))
+	for i, c := range cfg.AcceptProxyHeaderFrom {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("AcceptProxyHeaderFrom[%d]: %w", i, err)
+		}
+		cfg.acceptProxyHeaderFrom[i] = n
+	}
+	cfg.realClientIP = nil
+	if rc := cfg.RealClientIP; rc != nil {
+		if rc.Header == "" {
+			rc.Header = "CF-Connecting-IP"
+		}
+		if len(rc.TrustedSources) == 0 {
+			return errors.New("RealClientIP.TrustedSources: must be set")
+		}
+		cfg.realClientIP = &realClientIP{
+			header:  http.CanonicalHeaderKey(rc.Header),
+			sources: make([]*net.IPNet, len(rc.TrustedSources)),
+		}
+		for i, c := range rc.TrustedSources {
+			_, n, err := net.ParseCIDR(c)
+			if err != nil {
+				return fmt.Errorf("RealClientIP.TrustedSources[%d]: %w", i, err)
+			}
+			cfg.realClientIP.sources[i] = n
+		}
+	}
+
+	cfg.ctLogs = nil
+	if cfg.CTLogList != "" {
+		b, err := os.ReadFile(cfg.CTLogList)
+		if err != nil {
+			return fmt.Errorf("CTLogList: %w", err)
+		}
+		if cfg.ctLogs, err = ct.ParseLogList(b); err != nil {
+			return fmt.Errorf("CTLogList: %w", err)
+		}
+	}
+
+	cfg.DefaultServerName = idnaToASCII(cfg.DefaultServerName)
+	cfg.RejectPolicy = strings.ToLower(cfg.RejectPolicy)
+	if !slices.Contains(validRejectPolicies, cfg.RejectPolicy) || cfg.RejectPolicy == rejectForbidden {
+		return fmt.Errorf("RejectPolicy: invalid value %q", cfg.RejectPolicy)
+	}
+
+	identityProviders := make(map[string]bool)
+	for i, oi := range cfg.OIDCProviders {
+		if identityProviders[oi.Name] {
+			return fmt.Errorf("oidc[%d].Name: duplicate provider name %q", i, oi.Name)
+		}
+		identityProviders[oi.Name] = true
+
+		if (oi.AuthEndpoint == "" || oi.TokenEndpoint == "") && oi.DiscoveryURL == "" {
+			return fmt.Errorf("oidc[%d] AuthEndpoint and TokenEndpoint must be set unless DiscoveryURL is set", i)
+		}
+		if oi.DiscoveryURL != "" {
+			if _, err := url.Parse(oi.DiscoveryURL); err != nil {
+				return fmt.Errorf("oidc[%d].DiscoveryURL: %v", i, err)
+			}
+		}
+		if oi.AuthEndpoint != "" {
+			if _, err := url.Parse(oi.AuthEndpoint); err != nil {
+				return fmt.Errorf("oidc[%d].AuthEndpoint: %v", i, err)
+			}
+		}
+		if oi.TokenEndpoint != "" {
+			if _, err := url.Parse(oi.TokenEndpoint); err != nil {
+				return fmt.Errorf("oidc[%d].TokenEndpoint: %v", i, err)
+			}
+		}
+		if oi.RedirectURL == "" {
+			return fmt.Errorf("oidc[%d].RedirectURL must be set", i)
+		}
+		if _, err := url.Parse(oi.RedirectURL); err != nil {
+			return fmt.Errorf("oidc[%d].RedirectURL: %v", i, err)
+		}
+		if oi.ClientID == "" {
+			return fmt.Errorf("oidc[%d].ClientID must be set", i)
+		}
+		for k, v := range oi.ClaimMapping {
+			if !slices.Contains(oidc.MappableClaims, k) {
+				return fmt.Errorf("oidc[%d].ClaimMapping: %q cannot be mapped", i, k)
+			}
+			if v == "" {
+				return fmt.Errorf("oidc[%d].ClaimMapping[%s]: must not be empty", i, k)
+			}
+		}
+		if oi.BackchannelLogoutURL != "" {
+			if oi.DiscoveryURL == "" {
+				return fmt.Errorf("oidc[%d].BackchannelLogoutURL requires DiscoveryURL", i)
+			}
+			if _, err := url.Parse(oi.BackchannelLogoutURL); err != nil {
+				return fmt.Errorf("oidc[%d].BackchannelLogoutURL: %v", i, err)
+			}
+		}
+		if oi.ClientSecret == "" && oi.PKCE != nil && !*oi.PKCE {
+			return fmt.Errorf("oidc[%d].ClientSecret must be set when PKCE is disabled", i)
+		}
+		if oi.Domain != "" {
 			oi.Domain = idnaToASCII(oi.Domain)
 			host, _, _, err := hostAndPath(oi.RedirectURL)
 			if err != nil {
@@ -900,18 +3048,24 @@ func (cfg *Config) Check() error {
 			return fmt.Errorf("saml[%d].Name: duplicate provider name %q", i, s.Name)
 		}
 		identityProviders[s.Name] = true
-		if s.SSOURL == "" {
-			return fmt.Errorf("saml[%d].SSOURL must be set", i)
+		if s.SSOURL == "" && s.MetadataURL == "" {
+			return fmt.Errorf("saml[%d].SSOURL or MetadataURL must be set", i)
 		}
 		if s.EntityID == "" {
 			return fmt.Errorf("saml[%d].EntityID must be set", i)
 		}
-		if s.Certs == "" {
-			return fmt.Errorf("saml[%d].Certs must be set", i)
+		if s.Certs == "" && s.MetadataURL == "" {
+			return fmt.Errorf("saml[%d].Certs or MetadataURL must be set", i)
+		}
+		if s.MetadataURL != "" && s.MetadataCerts == "" {
+			return fmt.Errorf("saml[%d].MetadataCerts must be set with MetadataURL", i)
 		}
 		if s.ACSURL == "" {
 			return fmt.Errorf("saml[%d].ACSURL must be set", i)
 		}
+		if (s.EncryptionCert == "") != (s.EncryptionKey == "") {
+			return fmt.Errorf("saml[%d].EncryptionCert and EncryptionKey must be set together", i)
+		}
 		if s.Domain != "" {
 			s.Domain = idnaToASCII(s.Domain)
 			host, _, _, err := hostAndPath(s.ACSURL)
@@ -923,6 +3077,62 @@ func (cfg *Config) Check() error {
 			}
 		}
 	}
+	for i, l := range cfg.LDAPProviders {
+		if identityProviders[l.Name] {
+			return fmt.Errorf("ldap[%d].Name: duplicate provider name %q", i, l.Name)
+		}
+		identityProviders[l.Name] = true
+		if l.Endpoint == "" {
+			return fmt.Errorf("ldap[%d].Endpoint must be set", i)
+		}
+		if l.ServerURL == "" {
+			return fmt.Errorf("ldap[%d].ServerURL must be set", i)
+		}
+		if u, err := url.Parse(l.ServerURL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+			return fmt.Errorf("ldap[%d].ServerURL %q: must be an ldap:// or ldaps:// URL", i, l.ServerURL)
+		}
+		if l.UserBaseDN == "" {
+			return fmt.Errorf("ldap[%d].UserBaseDN must be set", i)
+		}
+		if l.UserFilter != "" && !strings.Contains(l.UserFilter, "{username}") {
+			return fmt.Errorf("ldap[%d].UserFilter must contain {username}", i)
+		}
+		if l.Domain != "" {
+			l.Domain = idnaToASCII(l.Domain)
+			host, _, _, err := hostAndPath(l.Endpoint)
+			if err != nil {
+				return fmt.Errorf("ldap[%d].Endpoint %q: %v", i, l.Endpoint, err)
+			}
+			if !strings.HasSuffix(host, l.Domain) {
+				return fmt.Errorf("ldap[%d].Domain %q must be part of Endpoint (%s)", i, l.Domain, host)
+			}
+		}
+	}
+	for i, pw := range cfg.PasswordProviders {
+		if identityProviders[pw.Name] {
+			return fmt.Errorf("password[%d].Name: duplicate provider name %q", i, pw.Name)
+		}
+		identityProviders[pw.Name] = true
+		if pw.Endpoint == "" {
+			return fmt.Errorf("password[%d].Endpoint must be set", i)
+		}
+		if pw.File == "" {
+			return fmt.Errorf("password[%d].File must be set", i)
+		}
+		if pw.TOTP != "" && pw.TOTP != "optional" && pw.TOTP != "required" {
+			return fmt.Errorf("password[%d].TOTP: value %q must be optional or required", i, pw.TOTP)
+		}
+		if pw.Domain != "" {
+			pw.Domain = idnaToASCII(pw.Domain)
+			host, _, _, err := hostAndPath(pw.Endpoint)
+			if err != nil {
+				return fmt.Errorf("password[%d].Endpoint %q: %v", i, pw.Endpoint, err)
+			}
+			if !strings.HasSuffix(host, pw.Domain) {
+				return fmt.Errorf("password[%d].Domain %q must be part of Endpoint (%s)", i, pw.Domain, host)
+			}
+		}
+	}
 	for i, pp := range cfg.PasskeyProviders {
 		if identityProviders[pp.Name] {
 			return fmt.Errorf("passkey[%d].Name: duplicate provider name %q", i, pp.Name)
@@ -937,6 +3147,9 @@ func (cfg *Config) Check() error {
 		if _, ok := identityProviders[pp.IdentityProvider]; !ok {
 			return fmt.Errorf("passkey[%d].IdentityProvider has unexpected value %q", i, pp.IdentityProvider)
 		}
+		if pp.TOTP != "" && pp.TOTP != "optional" && pp.TOTP != "required" {
+			return fmt.Errorf("passkey[%d].TOTP: value %q must be optional or required", i, pp.TOTP)
+		}
 		if pp.Domain != "" {
 			pp.Domain = idnaToASCII(pp.Domain)
 			host, _, _, err := hostAndPath(pp.Endpoint)
@@ -952,6 +3165,7 @@ func (cfg *Config) Check() error {
 	for i, be := range cfg.Backends {
 		be.state = new(backendState)
 		be.state.oNext = make([]int, len(be.PathOverrides))
+		be.state.cNext = make([]int, len(be.Canary))
 		be.Mode = strings.ToUpper(be.Mode)
 		if be.Mode == "" || be.Mode == ModePlaintext {
 			be.Mode = ModeTCP
@@ -959,6 +3173,9 @@ func (cfg *Config) Check() error {
 		if !slices.Contains(validModes, be.Mode) {
 			return fmt.Errorf("backend[%d].Mode: value %q must be one of %v", i, be.Mode, validModes)
 		}
+		if err := be.LogFilter.check(); err != nil {
+			return fmt.Errorf("backend[%d].LogFilter.%w", i, err)
+		}
 		if be.Mode == ModeTLSPassthrough && be.ClientAuth != nil {
 			return fmt.Errorf("backend[%d].ClientAuth: client auth is not compatible with TLS Passthrough", i)
 		}
@@ -983,9 +3200,156 @@ func (cfg *Config) Check() error {
 		}
 	}
 
+	if r := cfg.Resolver; r != nil {
+		var n int
+		if len(r.Nameservers) > 0 {
+			n++
+		}
+		if r.DoT != "" {
+			n++
+		}
+		if r.DoH != "" {
+			n++
+		}
+		if n != 1 {
+			return errors.New("resolver: exactly one of Nameservers, DoT, or DoH must be set")
+		}
+		if r.DoTServerName != "" && r.DoT == "" {
+			return errors.New("resolver.DoTServerName: only valid with DoT")
+		}
+		if r.Timeout < 0 {
+			return errors.New("resolver.Timeout: must not be negative")
+		}
+		if _, err := newResolver(r); err != nil {
+			return fmt.Errorf("resolver: %w", err)
+		}
+	}
+
+	if cfg.RemoteBackends != "" {
+		if _, err := newRemoteKV(cfg.RemoteBackends); err != nil {
+			return fmt.Errorf("remoteBackends: %w", err)
+		}
+	}
+	if err := cfg.LogFilter.check(); err != nil {
+		return fmt.Errorf("LogFilter.%w", err)
+	}
+	if sl := cfg.Syslog; sl != nil {
+		if sl.Network == "" {
+			sl.Network = "udp"
+		}
+		if sl.Network != "udp" && sl.Network != "tcp" && sl.Network != "tls" {
+			return fmt.Errorf("syslog.Network: invalid value %q", sl.Network)
+		}
+		if sl.Address == "" {
+			return errors.New("syslog.Address: must be set")
+		}
+		if _, _, err := net.SplitHostPort(sl.Address); err != nil {
+			port := "514"
+			if sl.Network == "tls" {
+				port = "6514"
+			}
+			sl.Address = net.JoinHostPort(strings.Trim(sl.Address, "[]"), port)
+		}
+		if sl.Facility == "" {
+			sl.Facility = "daemon"
+		}
+		if _, ok := syslogFacilities[sl.Facility]; !ok {
+			return fmt.Errorf("syslog.Facility: invalid value %q", sl.Facility)
+		}
+		if sl.AppName == "" {
+			sl.AppName = "tlsproxy"
+		}
+		pool := x509.NewCertPool()
+		for i, n := range sl.RootCAs {
+			if err := loadCerts(pool, n); err != nil {
+				return fmt.Errorf("syslog.RootCAs[%d]: %w", i, err)
+			}
+		}
+	}
+	if op := cfg.OutboundProxy; op != nil {
+		u, err := url.Parse(op.URL)
+		if err != nil {
+			return fmt.Errorf("outboundProxy.URL: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+			return errors.New("outboundProxy.URL: scheme must be http, https, or socks5")
+		}
+		if u.Host == "" {
+			return errors.New("outboundProxy.URL: host must be set")
+		}
+	}
+	if st := cfg.SessionTickets; st != nil {
+		if st.RotationInterval == 0 {
+			st.RotationInterval = sessionTicketKeyRotation
+		}
+		if st.RotationInterval < 10*time.Minute {
+			return errors.New("sessionTickets.RotationInterval: must be at least 10 minutes")
+		}
+		if st.Lifetime == 0 {
+			st.Lifetime = sessionTicketKeyLifetime
+		}
+		if st.Lifetime < 0 {
+			return errors.New("sessionTickets.Lifetime: must not be negative")
+		}
+		st.sharedSecret = nil
+		if st.SharedSecretFile != "" {
+			b, err := os.ReadFile(st.SharedSecretFile)
+			if err != nil {
+				return fmt.Errorf("sessionTickets.SharedSecretFile: %w", err)
+			}
+			if len(b) < 32 {
+				return errors.New("sessionTickets.SharedSecretFile: the secret must be at least 32 bytes long")
+			}
+			st.sharedSecret = b
+		}
+	}
+	if cl := cfg.Cluster; cl != nil {
+		if cl.StorageDir == "" {
+			return errors.New("cluster.StorageDir must be set")
+		}
+		if cfg.HWBacked {
+			return errors.New("cluster cannot be used with HWBacked")
+		}
+		if cl.SyncInterval == 0 {
+			cl.SyncInterval = 30 * time.Second
+		}
+		if cl.SyncInterval < time.Second {
+			return errors.New("cluster.SyncInterval: must be at least 1 second")
+		}
+		if err := os.MkdirAll(cl.StorageDir, 0o700); err != nil {
+			return fmt.Errorf("cluster.StorageDir: %w", err)
+		}
+	}
+	if cfg.EventLog != nil && cfg.EventLog.MaxSize < 0 {
+		return errors.New("eventLog.maxSize must not be negative")
+	}
+	if cfg.AuthAuditLog != nil && cfg.AuthAuditLog.MaxSize < 0 {
+		return errors.New("authAuditLog.maxSize must not be negative")
+	}
+	templates, err := loadPageTemplates(cfg.TemplatesDir)
+	if err != nil {
+		return fmt.Errorf("templatesDir: %w", err)
+	}
+	cfg.templates = templates
+	if d := cfg.Docker; d != nil {
+		if d.Socket == "" {
+			d.Socket = "/var/run/docker.sock"
+		}
+		if d.LabelPrefix == "" {
+			d.LabelPrefix = "tlsproxy"
+		}
+	}
+
 	serverNames := make(map[string]*Backend)
-	beKeys := make(map[beKey]bool)
+	beKeys := make(map[beKey]int)
+	beNames := make(map[string]int)
 	for i, be := range cfg.Backends {
+		if be.Name != "" {
+			if j, exists := beNames[be.Name]; exists {
+				return fmt.Errorf("backend[%d].Name: duplicate name %q, also used by backend[%d]", i, be.Name, j)
+			}
+			beNames[be.Name] = i
+		}
 		for j, sn := range be.ServerNames {
 			sn = idnaToASCII(sn)
 			be.ServerNames[j] = sn
@@ -996,11 +3360,116 @@ func (cfg *Config) Check() error {
 			}
 			for _, proto := range *be.ALPNProtos {
 				key := beKey{serverName: sn, proto: proto}
-				if beKeys[key] {
+				if _, exists := beKeys[key]; exists {
 					return fmt.Errorf("backend[%d].ServerNames: duplicate server name %q alpnProto %q combination", i, sn, proto)
 				}
-				beKeys[key] = true
+				beKeys[key] = i
+			}
+		}
+	}
+	routes := make(map[beKey]int)
+	for i, r := range cfg.Routes {
+		if r.ServerName == "" {
+			return fmt.Errorf("routes[%d].ServerName: must be set", i)
+		}
+		r.ServerName = idnaToASCII(r.ServerName)
+		j, exists := beNames[r.Backend]
+		if !exists {
+			return fmt.Errorf("routes[%d].Backend: unknown backend %q", i, r.Backend)
+		}
+		if len(r.ALPNProtos) == 0 {
+			return fmt.Errorf("routes[%d].ALPNProtos: must not be empty", i)
+		}
+		for _, proto := range r.ALPNProtos {
+			if !slices.Contains(*cfg.Backends[j].ALPNProtos, proto) {
+				return fmt.Errorf("routes[%d].ALPNProtos: backend %q doesn't support alpnProto %q", i, r.Backend, proto)
+			}
+			key := beKey{serverName: r.ServerName, proto: proto}
+			if k, exists := routes[key]; exists {
+				return fmt.Errorf("routes[%d]: server name %q alpnProto %q is already routed by routes[%d]", i, r.ServerName, proto, k)
+			}
+			if k, exists := beKeys[key]; exists && k != j {
+				return fmt.Errorf("routes[%d]: server name %q alpnProto %q conflicts with backend[%d]", i, r.ServerName, proto, k)
+			}
+			routes[key] = i
+		}
+	}
+
+	listenAddrs := make(map[string]int)
+	for i, l := range cfg.Listeners {
+		if l.Address == "" {
+			return fmt.Errorf("listeners[%d].Address: must be set", i)
+		}
+		if l.Address == cfg.TLSAddr {
+			return fmt.Errorf("listeners[%d].Address: must be different from TLSAddr", i)
+		}
+		if j, exists := listenAddrs[l.Address]; exists {
+			return fmt.Errorf("listeners[%d].Address: duplicate address %q, also used by listeners[%d]", i, l.Address, j)
+		}
+		listenAddrs[l.Address] = i
+		if addr, ok := strings.CutPrefix(l.Address, tailscalePrefix); ok {
+			if cfg.Tailscale == nil {
+				return fmt.Errorf("listeners[%d].Address: Tailscale must be set", i)
+			}
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return fmt.Errorf("listeners[%d].Address: invalid tailnet address %q", i, l.Address)
+			}
+		}
+		if len(l.Backends) == 0 && len(l.Modes) == 0 {
+			return fmt.Errorf("listeners[%d]: Backends or Modes must be set", i)
+		}
+		for j, name := range l.Backends {
+			if _, exists := beNames[name]; !exists {
+				return fmt.Errorf("listeners[%d].Backends[%d]: unknown backend %q", i, j, name)
+			}
+		}
+		for j, m := range l.Modes {
+			l.Modes[j] = strings.ToUpper(m)
+			if !slices.Contains(validModes, l.Modes[j]) {
+				return fmt.Errorf("listeners[%d].Modes[%d]: value %q must be one of %v", i, j, m, validModes)
+			}
+		}
+	}
+	for _, be := range cfg.Backends {
+		be.listenAddrs = nil
+		for _, l := range cfg.Listeners {
+			if (be.Name != "" && slices.Contains(l.Backends, be.Name)) || slices.Contains(l.Modes, be.Mode) {
+				be.listenAddrs = append(be.listenAddrs, l.Address)
+			}
+		}
+	}
+
+	for i, be := range cfg.Backends {
+		fb := be.PassthroughFallback
+		if fb == nil {
+			continue
+		}
+		if be.Mode != ModeTLSPassthrough {
+			return fmt.Errorf("backend[%d].PassthroughFallback: only valid in %s mode", i, ModeTLSPassthrough)
+		}
+		if (fb.Backend == "") == (fb.ErrorPage == "") {
+			return fmt.Errorf("backend[%d].PassthroughFallback: exactly one of Backend or ErrorPage must be set", i)
+		}
+		if fb.Backend != "" {
+			j, exists := beNames[fb.Backend]
+			if !exists {
+				return fmt.Errorf("backend[%d].PassthroughFallback.Backend: unknown backend %q", i, fb.Backend)
+			}
+			fbe := cfg.Backends[j]
+			if fbe.Mode == ModeTLSPassthrough {
+				return fmt.Errorf("backend[%d].PassthroughFallback.Backend: backend %q must not be in %s mode", i, fb.Backend, ModeTLSPassthrough)
+			}
+			if fbe.ClientAuth != nil {
+				return fmt.Errorf("backend[%d].PassthroughFallback.Backend: backend %q must not use ClientAuth", i, fb.Backend)
 			}
+			fb.backend = fbe
+		}
+		if fb.ErrorPage != "" {
+			b, err := os.ReadFile(fb.ErrorPage)
+			if err != nil {
+				return fmt.Errorf("backend[%d].PassthroughFallback.ErrorPage: %w", i, err)
+			}
+			fb.errorPage = b
 		}
 	}
 
@@ -1024,42 +3493,260 @@ func (cfg *Config) Check() error {
 				return fmt.Errorf("pki[%d].Endpoint %q: backend must have mode %s or %s, found %s", i, p.Endpoint, ModeLocal, ModeConsole, mode)
 			}
 		}
-	}
-
-	sshCAs := make(map[string]bool)
-	for i, p := range cfg.SSHCertificateAuthorities {
-		if p.Name == "" {
-			return fmt.Errorf("sshCertificateAuthorities[%d].Name: must be set", i)
+		for _, u := range slices.Concat(p.CRLDistributionPoints, p.DeltaCRLDistributionPoints) {
+			host, _, _, err := hostAndPath(u)
+			if err != nil {
+				return fmt.Errorf("pki[%d] CRL URL %q: %v", i, u, err)
+			}
+			// The CRLs can also be published elsewhere.
+			if be := serverNames[host]; be != nil {
+				if mode := strings.ToUpper(be.Mode); mode != ModeLocal && mode != ModeConsole {
+					return fmt.Errorf("pki[%d] CRL URL %q: backend must have mode %s or %s, found %s", i, u, ModeLocal, ModeConsole, mode)
+				}
+			}
 		}
-		if sshCAs[p.Name] {
-			return fmt.Errorf("sshCertificateAuthorities[%d].Name: duplicate name %q", i, p.Name)
+		if p.CRLUpdateInterval < 0 || p.DeltaCRLUpdateInterval < 0 {
+			return fmt.Errorf("pki[%d]: CRL update intervals must not be negative", i)
 		}
-		sshCAs[p.Name] = true
-		if p.CertificateEndpoint != "" {
-			host, _, _, err := hostAndPath(p.CertificateEndpoint)
+		if a := p.ACME; a != nil {
+			host, _, _, err := hostAndPath(a.Endpoint)
 			if err != nil {
-				return fmt.Errorf("sshCertificateAuthorities[%d].CertificateEndpoint %q: %v", i, p.CertificateEndpoint, err)
+				return fmt.Errorf("pki[%d].ACME.Endpoint %q: %v", i, a.Endpoint, err)
 			}
 			if be := serverNames[host]; be == nil {
-				return fmt.Errorf("sshCertificateAuthorities[%d].CertificateEndpoint %q: backend not found", i, p.CertificateEndpoint)
+				return fmt.Errorf("pki[%d].ACME.Endpoint %q: backend not found", i, a.Endpoint)
+			} else if mode := strings.ToUpper(be.Mode); mode != ModeLocal && mode != ModeConsole {
+				return fmt.Errorf("pki[%d].ACME.Endpoint %q: backend must have mode %s or %s, found %s", i, a.Endpoint, ModeLocal, ModeConsole, mode)
+			}
+			for j, c := range a.Challenges {
+				if c != "http-01" && c != "tls-alpn-01" {
+					return fmt.Errorf("pki[%d].ACME.Challenges[%d]: invalid value %q", i, j, c)
+				}
+			}
+			if a.CertificateLifetime < 0 {
+				return fmt.Errorf("pki[%d].ACME.CertificateLifetime: must not be negative", i)
 			}
 		}
-	}
-
-	bwLimits := make(map[string]bool)
-	for i, l := range cfg.BWLimits {
-		if bwLimits[l.Name] {
-			return fmt.Errorf("bwLimit[%d].Name: duplicate name %q", i, l.Name)
+		if e := p.EST; e != nil {
+			host, _, _, err := hostAndPath(e.Endpoint)
+			if err != nil {
+				return fmt.Errorf("pki[%d].EST.Endpoint %q: %v", i, e.Endpoint, err)
+			}
+			if be := serverNames[host]; be == nil {
+				return fmt.Errorf("pki[%d].EST.Endpoint %q: backend not found", i, e.Endpoint)
+			} else if mode := strings.ToUpper(be.Mode); mode != ModeLocal && mode != ModeConsole {
+				return fmt.Errorf("pki[%d].EST.Endpoint %q: backend must have mode %s or %s, found %s", i, e.Endpoint, ModeLocal, ModeConsole, mode)
+			} else if be.ClientAuth != nil && len(e.AllowedDomains) == 0 {
+				return fmt.Errorf("pki[%d].EST.AllowedDomains: must be set when the Endpoint's backend uses ClientAuth", i)
+			}
+			for j, v := range e.AllowedIPs {
+				if _, err := netip.ParsePrefix(v); err != nil {
+					return fmt.Errorf("pki[%d].EST.AllowedIPs[%d]: %w", i, j, err)
+				}
+			}
+			if e.CertificateLifetime < 0 {
+				return fmt.Errorf("pki[%d].EST.CertificateLifetime: must not be negative", i)
+			}
 		}
-		bwLimits[l.Name] = true
-	}
-
-	for i, be := range cfg.Backends {
-		if len(be.ServerNames) == 0 {
-			return fmt.Errorf("backend[%d].ServerNames: backend must have at least one server name", i)
+		if sc := p.SCEP; sc != nil {
+			for _, ep := range []struct {
+				name, url string
+			}{
+				{"Endpoint", sc.Endpoint},
+				{"ChallengeEndpoint", sc.ChallengeEndpoint},
+			} {
+				if ep.url == "" && ep.name != "Endpoint" {
+					continue
+				}
+				host, _, _, err := hostAndPath(ep.url)
+				if err != nil {
+					return fmt.Errorf("pki[%d].SCEP.%s %q: %v", i, ep.name, ep.url, err)
+				}
+				if be := serverNames[host]; be == nil {
+					return fmt.Errorf("pki[%d].SCEP.%s %q: backend not found", i, ep.name, ep.url)
+				} else if mode := strings.ToUpper(be.Mode); mode != ModeLocal && mode != ModeConsole {
+					return fmt.Errorf("pki[%d].SCEP.%s %q: backend must have mode %s or %s, found %s", i, ep.name, ep.url, ModeLocal, ModeConsole, mode)
+				} else if ep.name == "ChallengeEndpoint" && be.ClientAuth == nil && len(be.ssoPolicies()) == 0 {
+					return fmt.Errorf("pki[%d].SCEP.%s %q: backend must use SSO or ClientAuth", i, ep.name, ep.url)
+				}
+			}
+			for j, v := range sc.AllowedIPs {
+				if _, err := netip.ParsePrefix(v); err != nil {
+					return fmt.Errorf("pki[%d].SCEP.AllowedIPs[%d]: %w", i, j, err)
+				}
+			}
+			if sc.ChallengePassword == "" && sc.ChallengeEndpoint == "" {
+				return fmt.Errorf("pki[%d].SCEP: one of ChallengePassword or ChallengeEndpoint must be set", i)
+			}
+			if sc.ChallengeLifetime < 0 {
+				return fmt.Errorf("pki[%d].SCEP.ChallengeLifetime: must not be negative", i)
+			}
+			if sc.CertificateLifetime < 0 {
+				return fmt.Errorf("pki[%d].SCEP.CertificateLifetime: must not be negative", i)
+			}
 		}
-		if len(be.Addresses) == 0 && be.Mode != ModeConsole && be.Mode != ModeHTTP && be.Mode != ModeHTTPS && be.Mode != ModeLocal {
-			return fmt.Errorf("backend[%d].Addresses: backend must have at least one address", i)
+		if r := p.Renewal; r != nil {
+			host, _, _, err := hostAndPath(r.Endpoint)
+			if err != nil {
+				return fmt.Errorf("pki[%d].Renewal.Endpoint %q: %v", i, r.Endpoint, err)
+			}
+			if be := serverNames[host]; be == nil {
+				return fmt.Errorf("pki[%d].Renewal.Endpoint %q: backend not found", i, r.Endpoint)
+			} else if mode := strings.ToUpper(be.Mode); mode != ModeLocal && mode != ModeConsole {
+				return fmt.Errorf("pki[%d].Renewal.Endpoint %q: backend must have mode %s or %s, found %s", i, r.Endpoint, ModeLocal, ModeConsole, mode)
+			} else if be.ClientAuth == nil {
+				return fmt.Errorf("pki[%d].Renewal.Endpoint %q: backend must have clientAuth", i, r.Endpoint)
+			}
+			if r.RenewBefore < 0 {
+				return fmt.Errorf("pki[%d].Renewal.RenewBefore: must not be negative", i)
+			}
+		}
+		profiles := make(map[string]bool)
+		for j, pp := range p.Profiles {
+			if err := pki.ValidateProfile(pp.pkiProfile()); err != nil {
+				return fmt.Errorf("pki[%d].Profiles[%d].%v", i, j, err)
+			}
+			if profiles[pp.Name] {
+				return fmt.Errorf("pki[%d].Profiles[%d].Name: duplicate name %q", i, j, pp.Name)
+			}
+			profiles[pp.Name] = true
+		}
+	}
+
+	if a := cfg.BackendAPI; a != nil {
+		host, _, _, err := hostAndPath(a.Endpoint)
+		if err != nil {
+			return fmt.Errorf("backendApi.Endpoint %q: %v", a.Endpoint, err)
+		}
+		be := serverNames[host]
+		if be == nil {
+			return fmt.Errorf("backendApi.Endpoint %q: backend not found", a.Endpoint)
+		}
+		if mode := strings.ToUpper(be.Mode); mode != ModeLocal && mode != ModeConsole {
+			return fmt.Errorf("backendApi.Endpoint %q: backend must have mode %s or %s, found %s", a.Endpoint, ModeLocal, ModeConsole, mode)
+		}
+		if a.TokenFile == "" && len(a.ACL) == 0 {
+			return errors.New("backendApi: at least one of TokenFile or ACL must be set")
+		}
+		if a.TokenFile != "" {
+			b, err := os.ReadFile(a.TokenFile)
+			if err != nil {
+				return fmt.Errorf("backendApi.TokenFile: %w", err)
+			}
+			if a.token = strings.TrimSpace(string(b)); a.token == "" {
+				return errors.New("backendApi.TokenFile: empty token")
+			}
+		}
+		if len(a.ACL) > 0 && be.ClientAuth == nil {
+			return fmt.Errorf("backendApi.Endpoint %q: backend must have clientAuth", a.Endpoint)
+		}
+		for i, v := range a.ACL {
+			if !strings.HasPrefix(v, "SPKI:") {
+				continue
+			}
+			if err := validateSPKIPin(v); err != nil {
+				return fmt.Errorf("backendApi.ACL[%d]: %w", i, err)
+			}
+		}
+		if len(a.AllowedServerNames) == 0 {
+			return errors.New("backendApi.AllowedServerNames: must be set")
+		}
+		for i, v := range a.AllowedServerNames {
+			if strings.TrimPrefix(v, "*.") == "" || strings.Contains(strings.TrimPrefix(v, "*."), "*") {
+				return fmt.Errorf("backendApi.AllowedServerNames[%d]: invalid value %q", i, v)
+			}
+		}
+	}
+
+	sshCAs := make(map[string]bool)
+	for i, p := range cfg.SSHCertificateAuthorities {
+		if p.Name == "" {
+			return fmt.Errorf("sshCertificateAuthorities[%d].Name: must be set", i)
+		}
+		if sshCAs[p.Name] {
+			return fmt.Errorf("sshCertificateAuthorities[%d].Name: duplicate name %q", i, p.Name)
+		}
+		sshCAs[p.Name] = true
+		if p.CertificateEndpoint != "" {
+			host, _, _, err := hostAndPath(p.CertificateEndpoint)
+			if err != nil {
+				return fmt.Errorf("sshCertificateAuthorities[%d].CertificateEndpoint %q: %v", i, p.CertificateEndpoint, err)
+			}
+			if be := serverNames[host]; be == nil {
+				return fmt.Errorf("sshCertificateAuthorities[%d].CertificateEndpoint %q: backend not found", i, p.CertificateEndpoint)
+			}
+		}
+	}
+
+	bwLimits := make(map[string]bool)
+	for i, l := range cfg.BWLimits {
+		if bwLimits[l.Name] {
+			return fmt.Errorf("bwLimit[%d].Name: duplicate name %q", i, l.Name)
+		}
+		bwLimits[l.Name] = true
+	}
+
+	if len(cfg.WireGuard) > 0 && !wireGuardIsEnabled {
+		return errors.New("WireGuard: not enabled in this binary, build with -tags wireguard")
+	}
+	wgTunnels := make(map[string]bool)
+	for i, wg := range cfg.WireGuard {
+		if wg.Name == "" {
+			return fmt.Errorf("wireGuard[%d].Name: must be set", i)
+		}
+		if wgTunnels[wg.Name] {
+			return fmt.Errorf("wireGuard[%d].Name: duplicate name %q", i, wg.Name)
+		}
+		wgTunnels[wg.Name] = true
+		if err := wg.check(); err != nil {
+			return fmt.Errorf("wireGuard[%d].%w", i, err)
+		}
+	}
+
+	onDemandNames := make(map[string]int)
+	for i, be := range cfg.Backends {
+		if len(be.ServerNames) == 0 {
+			return fmt.Errorf("backend[%d].ServerNames: backend must have at least one server name", i)
+		}
+		if be.usesDiscovery() {
+			if be.Kubernetes != nil && be.Consul != nil {
+				return fmt.Errorf("backend[%d]: Kubernetes and Consul are mutually exclusive", i)
+			}
+			if len(be.Addresses) > 0 {
+				return fmt.Errorf("backend[%d]: Addresses must be empty with Kubernetes or Consul", i)
+			}
+			if be.Mode == ModeConsole || be.Mode == ModeLocal || be.DocumentRoot != "" {
+				return fmt.Errorf("backend[%d]: Kubernetes and Consul are not valid with mode %s or DocumentRoot", i, be.Mode)
+			}
+		}
+		if k := be.Kubernetes; k != nil {
+			if k.Service == "" {
+				return fmt.Errorf("backend[%d].Kubernetes.Service: must be set", i)
+			}
+			if k.APIServer != "" {
+				if u, err := url.Parse(k.APIServer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+					return fmt.Errorf("backend[%d].Kubernetes.APIServer: invalid URL %q", i, k.APIServer)
+				}
+			}
+		}
+		if c := be.Consul; c != nil {
+			if c.Service == "" {
+				return fmt.Errorf("backend[%d].Consul.Service: must be set", i)
+			}
+			if c.Address != "" {
+				if u, err := url.Parse(c.Address); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+					return fmt.Errorf("backend[%d].Consul.Address: invalid URL %q", i, c.Address)
+				}
+			}
+		}
+		if len(be.Addresses) == 0 && !be.usesDiscovery() && be.ReverseTunnel == nil && be.Mode != ModeConsole && be.Mode != ModeHTTP && be.Mode != ModeHTTPS && be.Mode != ModeLocal {
+			return fmt.Errorf("backend[%d].Addresses: backend must have at least one address", i)
+		}
+		if err := validateAddresses(be.Addresses, cfg.Tailscale != nil); err != nil {
+			return fmt.Errorf("backend[%d].Addresses: %w", i, err)
+		}
+		if be.Mode == ModeQUIC && slices.ContainsFunc(be.Addresses, func(a string) bool { return strings.HasPrefix(a, tailscalePrefix) }) {
+			return fmt.Errorf("backend[%d].Addresses: tailnet addresses are not valid in mode %s", i, be.Mode)
 		}
 		if len(be.Addresses) > 0 && (be.Mode == ModeConsole || be.Mode == ModeLocal) {
 			return fmt.Errorf("backend[%d].Addresses: Addresses should be empty when Mode is CONSOLE or LOCAL", i)
@@ -1085,8 +3772,52 @@ func (cfg *Config) Check() error {
 					return fmt.Errorf("backend[%d].ClientAuth.AddClientCertHeader: invalid field %q, valid values are %v", i, f, validXFCCFields)
 				}
 			}
+			if f := be.ClientAuth.ClientCertHeaderFormat; f != "" && f != "envoy" {
+				return fmt.Errorf("backend[%d].ClientAuth.ClientCertHeaderFormat: invalid value %q", i, f)
+			}
+			if be.ClientAuth.ACL != nil {
+				for j, v := range *be.ClientAuth.ACL {
+					if !strings.HasPrefix(v, "SPKI:") {
+						continue
+					}
+					if err := validateSPKIPin(v); err != nil {
+						return fmt.Errorf("backend[%d].ClientAuth.ACL[%d]: %w", i, j, err)
+					}
+				}
+			}
+			if be.ClientAuth.Optional {
+				if be.Mode != ModeHTTP && be.Mode != ModeHTTPS && be.Mode != ModeLocal && be.Mode != ModeConsole {
+					return fmt.Errorf("backend[%d].ClientAuth.Optional: only valid in %s, %s, %s, or %s mode", i, ModeHTTP, ModeHTTPS, ModeLocal, ModeConsole)
+				}
+				if len(be.ClientAuth.RequiredPaths) == 0 {
+					return fmt.Errorf("backend[%d].ClientAuth.RequiredPaths: must be set when Optional is true", i)
+				}
+			} else if len(be.ClientAuth.RequiredPaths) > 0 {
+				return fmt.Errorf("backend[%d].ClientAuth.RequiredPaths: only valid when Optional is true", i)
+			}
+			for j, v := range be.ClientAuth.RequiredPaths {
+				if !strings.HasPrefix(v, "/") {
+					return fmt.Errorf("backend[%d].ClientAuth.RequiredPaths[%d]: must start with /", i, j)
+				}
+			}
+			for j, td := range be.ClientAuth.SPIFFETrustDomains {
+				if td == "" || td != strings.ToLower(td) || strings.ContainsAny(td, ":/") {
+					return fmt.Errorf("backend[%d].ClientAuth.SPIFFETrustDomains[%d]: invalid trust domain %q", i, j, td)
+				}
+			}
 		}
 
+		for j, sso := range be.SSOByPath {
+			if !identityProviders[sso.Provider] {
+				return fmt.Errorf("backend[%d].SSOByPath[%d].Provider: unknown provider %q", i, j, sso.Provider)
+			}
+			if len(sso.Paths) == 0 {
+				return fmt.Errorf("backend[%d].SSOByPath[%d].Paths must be set", i, j)
+			}
+			if sso.LocalOIDCServer != nil {
+				return fmt.Errorf("backend[%d].SSOByPath[%d].LocalOIDCServer is only supported in SSO", i, j)
+			}
+		}
 		if be.SSO != nil {
 			if !identityProviders[be.SSO.Provider] {
 				return fmt.Errorf("backend[%d].SSO.Provider: unknown provider %q", i, be.SSO.Provider)
@@ -1099,9 +3830,17 @@ func (cfg *Config) Check() error {
 					if client.Secret == "" {
 						return fmt.Errorf("backend[%d].SSO.LocalOIDCServer.Clients[%d].Secret must be set", i, j)
 					}
-					if len(client.RedirectURI) == 0 {
+					for _, gt := range client.GrantTypes {
+						if !slices.Contains([]string{"authorization_code", "client_credentials", "device_code", "urn:ietf:params:oauth:grant-type:device_code", "refresh_token", "token_exchange", "urn:ietf:params:oauth:grant-type:token-exchange"}, gt) {
+							return fmt.Errorf("backend[%d].SSO.LocalOIDCServer.Clients[%d].GrantTypes: unexpected value %q", i, j, gt)
+						}
+					}
+					if len(client.RedirectURI) == 0 && (len(client.GrantTypes) == 0 || slices.Contains(client.GrantTypes, "authorization_code")) {
 						return fmt.Errorf("backend[%d].SSO.LocalOIDCServer.Clients[%d].RedirectURI must be set", i, j)
 					}
+					if client.CodeLifetime < 0 || client.AccessTokenLifetime < 0 || client.IDTokenLifetime < 0 || client.RefreshTokenLifetime < 0 {
+						return fmt.Errorf("backend[%d].SSO.LocalOIDCServer.Clients[%d]: lifetimes must not be negative", i, j)
+					}
 				}
 				for j, rr := range be.SSO.LocalOIDCServer.RewriteRules {
 					if rr.InputClaim == "" {
@@ -1119,6 +3858,56 @@ func (cfg *Config) Check() error {
 				}
 			}
 		}
+		for j, sso := range be.ssoPolicies() {
+			// The policies of SSOByPath come first.
+			field := fmt.Sprintf("backend[%d].SSO", i)
+			if j < len(be.SSOByPath) {
+				field = fmt.Sprintf("backend[%d].SSOByPath[%d]", i, j)
+			}
+			if sso.IDTokenLifetime < 0 {
+				return fmt.Errorf("%s.IDTokenLifetime: must not be negative", field)
+			}
+			for k := range sso.IDTokenClaims {
+				if slices.Contains([]string{"iss", "sub", "aud", "exp", "iat", "nbf", "sid"}, k) {
+					return fmt.Errorf("%s.IDTokenClaims: %q cannot be changed", field, k)
+				}
+			}
+			for k, v := range sso.ClaimHeaders {
+				if k == "" || !httpguts.ValidHeaderFieldName(v) {
+					return fmt.Errorf("%s.ClaimHeaders: invalid mapping %q: %q", field, k, v)
+				}
+			}
+			if bt := sso.BearerTokens; bt != nil && bt.Upstream {
+				if !slices.ContainsFunc(cfg.OIDCProviders, func(oi *ConfigOIDC) bool {
+					return oi.Name == sso.Provider && oi.DiscoveryURL != ""
+				}) {
+					return fmt.Errorf("%s.BearerTokens.Upstream: requires an OIDC provider with a DiscoveryURL", field)
+				}
+			}
+			if ak := sso.APIKeys; ak != nil {
+				if err := ak.check(); err != nil {
+					return fmt.Errorf("%s.APIKeys.%w", field, err)
+				}
+			}
+			if sl := sso.SessionLimit; sl != nil {
+				if sl.Max <= 0 {
+					return fmt.Errorf("%s.SessionLimit.Max: must be greater than 0", field)
+				}
+				sl.Policy = strings.ToLower(sl.Policy)
+				if sl.Policy == "" {
+					sl.Policy = sessionLimitReject
+				}
+				if sl.Policy != sessionLimitReject && sl.Policy != sessionLimitEvictOldest {
+					return fmt.Errorf("%s.SessionLimit.Policy: must be %s or %s", field, sessionLimitReject, sessionLimitEvictOldest)
+				}
+				if sl.IdleTimeout < 0 {
+					return fmt.Errorf("%s.SessionLimit.IdleTimeout: must not be negative", field)
+				}
+				if sl.IdleTimeout == 0 {
+					sl.IdleTimeout = time.Hour
+				}
+			}
+		}
 		pool := x509.NewCertPool()
 		for j, n := range be.ForwardRootCAs {
 			if pkis[n] {
@@ -1128,9 +3917,160 @@ func (cfg *Config) Check() error {
 				return fmt.Errorf("backend[%d].ForwardRootCAs[%d]: %w", i, j, err)
 			}
 		}
+		if be.ForwardRequireOCSP && be.InsecureSkipVerify {
+			return fmt.Errorf("backend[%d].ForwardRequireOCSP: cannot be used with InsecureSkipVerify", i)
+		}
+		if be.ForwardRequireSCT && be.InsecureSkipVerify {
+			return fmt.Errorf("backend[%d].ForwardRequireSCT: cannot be used with InsecureSkipVerify", i)
+		}
+		if be.ForwardRequireSCT && cfg.ctLogs == nil {
+			return fmt.Errorf("backend[%d].ForwardRequireSCT: CTLogList must be set", i)
+		}
+		be.ctLogs = cfg.ctLogs
+		if be.ForwardDANE {
+			if err := validateDANE(cfg, be.Mode, be.InsecureSkipVerify, be.ForwardRequireOCSP, be.ForwardRequireSCT); err != nil {
+				return fmt.Errorf("backend[%d].ForwardDANE: %w", i, err)
+			}
+		}
+		for j, pin := range be.ForwardPinnedKeys {
+			if err := validateSPKIPin(pin); err != nil {
+				return fmt.Errorf("backend[%d].ForwardPinnedKeys[%d]: %w", i, j, err)
+			}
+		}
+		if len(be.ForwardPinnedKeys) > 0 && be.ForwardDANE {
+			return fmt.Errorf("backend[%d].ForwardPinnedKeys: cannot be used with ForwardDANE", i)
+		}
+		if fs := be.ForwardSPIFFE; fs != nil {
+			if be.Mode != ModeTLS && be.Mode != ModeHTTPS && be.Mode != ModeQUIC {
+				return fmt.Errorf("backend[%d].ForwardSPIFFE: only valid in %s, %s, or %s mode", i, ModeTLS, ModeHTTPS, ModeQUIC)
+			}
+			if cfg.SPIFFE == nil {
+				return fmt.Errorf("backend[%d].ForwardSPIFFE: SPIFFE must be set", i)
+			}
+			if len(fs.ServerIDs) > 0 && (be.InsecureSkipVerify || be.ForwardRequireOCSP || be.ForwardRequireSCT || be.ForwardDANE || len(be.ForwardRootCAs) > 0) {
+				return fmt.Errorf("backend[%d].ForwardSPIFFE.ServerIDs: cannot be used with InsecureSkipVerify, ForwardRequireOCSP, ForwardRequireSCT, ForwardDANE, or ForwardRootCAs", i)
+			}
+			auth, err := spiffeAuthorizer(fs.ServerIDs)
+			if err != nil {
+				return fmt.Errorf("backend[%d].ForwardSPIFFE.ServerIDs: %w", i, err)
+			}
+			fs.authorizer = auth
+		}
 		if be.ForwardTimeout == 0 {
 			be.ForwardTimeout = 30 * time.Second
 		}
+		if be.DialSourceAddress != "" {
+			ip := net.ParseIP(be.DialSourceAddress)
+			if ip == nil {
+				return fmt.Errorf("backend[%d].DialSourceAddress: invalid IP address %q", i, be.DialSourceAddress)
+			}
+			if be.Mode == ModeQUIC {
+				return fmt.Errorf("backend[%d].DialSourceAddress: not supported in %s mode", i, ModeQUIC)
+			}
+			be.dialSourceAddr = &net.TCPAddr{IP: ip}
+		}
+		if be.DialInterface != "" {
+			if err := validateDialInterface(be.DialInterface); err != nil {
+				return fmt.Errorf("backend[%d].DialInterface: %w", i, err)
+			}
+			if be.Mode == ModeQUIC {
+				return fmt.Errorf("backend[%d].DialInterface: not supported in %s mode", i, ModeQUIC)
+			}
+		}
+		if be.DialWireGuard != "" {
+			if !wgTunnels[be.DialWireGuard] {
+				return fmt.Errorf("backend[%d].DialWireGuard: undefined name %q", i, be.DialWireGuard)
+			}
+			if be.Mode == ModeQUIC {
+				return fmt.Errorf("backend[%d].DialWireGuard: not supported in %s mode", i, ModeQUIC)
+			}
+			if be.DialSourceAddress != "" || be.DialInterface != "" {
+				return fmt.Errorf("backend[%d].DialWireGuard: can't be combined with DialSourceAddress or DialInterface", i)
+			}
+			if slices.ContainsFunc(be.Addresses, func(a string) bool { return strings.HasPrefix(a, tailscalePrefix) }) {
+				return fmt.Errorf("backend[%d].DialWireGuard: can't be used with tailnet addresses", i)
+			}
+		}
+		if be.DialSSH != nil {
+			if be.Mode == ModeQUIC {
+				return fmt.Errorf("backend[%d].DialSSH: not supported in %s mode", i, ModeQUIC)
+			}
+			if be.DialSourceAddress != "" || be.DialInterface != "" || be.DialWireGuard != "" {
+				return fmt.Errorf("backend[%d].DialSSH: can't be combined with DialSourceAddress, DialInterface, or DialWireGuard", i)
+			}
+			if slices.ContainsFunc(be.Addresses, func(a string) bool { return strings.HasPrefix(a, tailscalePrefix) }) {
+				return fmt.Errorf("backend[%d].DialSSH: can't be used with tailnet addresses", i)
+			}
+			jh, err := newSSHJumpHost(be.DialSSH)
+			if err != nil {
+				return fmt.Errorf("backend[%d].DialSSH.%w", i, err)
+			}
+			be.sshJump = jh
+		}
+		if rt := be.ReverseTunnel; rt != nil {
+			if be.Mode != ModeTCP && be.Mode != ModeTLS && be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].ReverseTunnel: only valid in %s, %s, %s, or %s mode", i, ModeTCP, ModeTLS, ModeHTTP, ModeHTTPS)
+			}
+			if len(be.Addresses) > 0 || be.usesDiscovery() || be.DocumentRoot != "" {
+				return fmt.Errorf("backend[%d].ReverseTunnel: Addresses, Kubernetes, Consul, and DocumentRoot must be empty", i)
+			}
+			if be.DialSourceAddress != "" || be.DialInterface != "" || be.DialWireGuard != "" || be.DialSSH != nil || be.ForwardDANE {
+				return fmt.Errorf("backend[%d].ReverseTunnel: can't be combined with DialSourceAddress, DialInterface, DialWireGuard, DialSSH, or ForwardDANE", i)
+			}
+			if rt.TokenFile == "" {
+				return fmt.Errorf("backend[%d].ReverseTunnel.TokenFile: must be set", i)
+			}
+			b, err := os.ReadFile(rt.TokenFile)
+			if err != nil {
+				return fmt.Errorf("backend[%d].ReverseTunnel.TokenFile: %w", i, err)
+			}
+			if rt.token = strings.TrimSpace(string(b)); rt.token == "" {
+				return fmt.Errorf("backend[%d].ReverseTunnel.TokenFile: empty token", i)
+			}
+			if rt.MaxAgents == 0 {
+				rt.MaxAgents = 10
+			}
+			if rt.MaxAgents < 0 {
+				return fmt.Errorf("backend[%d].ReverseTunnel.MaxAgents: must be positive", i)
+			}
+		}
+		if be.ForwardTCPOptions != nil {
+			if err := be.ForwardTCPOptions.validate(); err != nil {
+				return fmt.Errorf("backend[%d].ForwardTCPOptions: %w", i, err)
+			}
+			if be.Mode == ModeQUIC {
+				return fmt.Errorf("backend[%d].ForwardTCPOptions: not supported in %s mode", i, ModeQUIC)
+			}
+		}
+		if be.TarpitDuration < 0 {
+			return fmt.Errorf("backend[%d].TarpitDuration: must not be negative", i)
+		}
+		be.RejectPolicy = strings.ToLower(be.RejectPolicy)
+		if !slices.Contains(validRejectPolicies, be.RejectPolicy) {
+			return fmt.Errorf("backend[%d].RejectPolicy: invalid value %q", i, be.RejectPolicy)
+		}
+		if be.RejectPolicy == rejectForbidden && !slices.Contains([]string{ModeConsole, ModeLocal, ModeHTTP, ModeHTTPS}, be.Mode) {
+			return fmt.Errorf("backend[%d].RejectPolicy: %s is only valid in %s, %s, %s, or %s mode", i, rejectForbidden, ModeConsole, ModeLocal, ModeHTTP, ModeHTTPS)
+		}
+		if be.IdleTimeout < 0 {
+			return fmt.Errorf("backend[%d].IdleTimeout: must not be negative", i)
+		}
+		if be.ForwardBufferSize == 0 {
+			be.ForwardBufferSize = cfg.ForwardBufferSize
+		}
+		be.bufPool = nil
+		if be.ForwardBufferSize != 0 {
+			if err := validateBufferSize(be.ForwardBufferSize); err != nil {
+				return fmt.Errorf("backend[%d].ForwardBufferSize: %w", i, err)
+			}
+			be.bufPool = newBufferPool(be.ForwardBufferSize)
+		}
+		if be.TLSHandshakeTimeout < 0 {
+			return fmt.Errorf("backend[%d].TLSHandshakeTimeout: must not be negative", i)
+		}
+		if be.ReadHeaderTimeout < 0 {
+			return fmt.Errorf("backend[%d].ReadHeaderTimeout: must not be negative", i)
+		}
 		if be.AllowIPs != nil {
 			ips := make([]*net.IPNet, 0, len(*be.AllowIPs))
 			for j, c := range *be.AllowIPs {
@@ -1153,6 +4093,193 @@ func (cfg *Config) Check() error {
 			}
 			be.denyIPs = &ips
 		}
+		if fh := be.ForwardedHeaders; fh != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].ForwardedHeaders: only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			for _, h := range []struct{ name, value string }{{"For", fh.For}, {"Proto", fh.Proto}, {"Host", fh.Host}, {"Forwarded", fh.Forwarded}} {
+				if h.value != "" && !slices.Contains(validForwardedModes, h.value) {
+					return fmt.Errorf("backend[%d].ForwardedHeaders.%s: invalid value %q, valid values are %v", i, h.name, h.value, validForwardedModes)
+				}
+			}
+			be.trustedProxies = make([]*net.IPNet, 0, len(fh.TrustedProxies))
+			for j, c := range fh.TrustedProxies {
+				_, n, err := net.ParseCIDR(c)
+				if err != nil {
+					return fmt.Errorf("backend[%d].ForwardedHeaders.TrustedProxies[%d]: %w", i, j, err)
+				}
+				be.trustedProxies = append(be.trustedProxies, n)
+			}
+		}
+		if ed := be.EarlyData; ed != nil {
+			if be.Mode != ModeLocal && be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].EarlyData: only valid in %s, %s, or %s mode", i, ModeLocal, ModeHTTP, ModeHTTPS)
+			}
+			if be.ClientAuth != nil {
+				return fmt.Errorf("backend[%d].EarlyData: can't be used with ClientAuth", i)
+			}
+			if len(ed.Methods) == 0 {
+				ed.Methods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+			}
+			for j, m := range ed.Methods {
+				ed.Methods[j] = strings.ToUpper(m)
+			}
+			for j, p := range ed.Paths {
+				if !strings.HasPrefix(p, "/") {
+					return fmt.Errorf("backend[%d].EarlyData.Paths[%d]: must start with /", i, j)
+				}
+			}
+		}
+		if be.Mode == ModeConsole && be.Diagnostics == nil && pprofBuildTag {
+			be.Diagnostics = &Diagnostics{Enabled: true}
+		}
+		if d := be.Diagnostics; d != nil {
+			if be.Mode != ModeConsole {
+				return fmt.Errorf("backend[%d].Diagnostics: only valid in %s mode", i, ModeConsole)
+			}
+			if d.ACL != nil && len(be.ssoPolicies()) == 0 {
+				return fmt.Errorf("backend[%d].Diagnostics.ACL: requires SSO", i)
+			}
+		}
+		if as := be.AltSvc; as != nil {
+			if be.Mode != ModeLocal && be.Mode != ModeConsole && be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].AltSvc: only valid in %s, %s, %s, or %s mode", i, ModeLocal, ModeConsole, ModeHTTP, ModeHTTPS)
+			}
+			if as.Port < 0 || as.Port > 65535 {
+				return fmt.Errorf("backend[%d].AltSvc.Port: invalid port %d", i, as.Port)
+			}
+			if as.MaxAge < 0 {
+				return fmt.Errorf("backend[%d].AltSvc.MaxAge: must not be negative", i)
+			}
+			if as.MaxAge == 0 {
+				as.MaxAge = 30 * 24 * time.Hour
+			}
+			for j, e := range as.Endpoints {
+				host, port, err := net.SplitHostPort(e)
+				if err != nil {
+					return fmt.Errorf("backend[%d].AltSvc.Endpoints[%d]: %w", i, j, err)
+				}
+				if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+					return fmt.Errorf("backend[%d].AltSvc.Endpoints[%d]: invalid port %q", i, j, port)
+				}
+				as.Endpoints[j] = net.JoinHostPort(idnaToASCII(host), port)
+			}
+			for j, n := range as.ServerNames {
+				as.ServerNames[j] = idnaToASCII(n)
+				if !slices.Contains(be.ServerNames, as.ServerNames[j]) {
+					return fmt.Errorf("backend[%d].AltSvc.ServerNames[%d]: %q is not one of the backend's server names", i, j, n)
+				}
+			}
+		}
+		if fq := be.ForwardQUIC; fq != nil {
+			if be.Mode != ModeQUIC && be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].ForwardQUIC: only valid in %s, %s, or %s mode", i, ModeQUIC, ModeHTTP, ModeHTTPS)
+			}
+			if fq.HandshakeIdleTimeout < 0 || fq.MaxIdleTimeout < 0 || fq.KeepAlivePeriod < 0 {
+				return fmt.Errorf("backend[%d].ForwardQUIC: timeouts must not be negative", i)
+			}
+			if fq.KeepAlivePeriod > 0 && fq.MaxIdleTimeout > 0 && fq.KeepAlivePeriod >= fq.MaxIdleTimeout {
+				return fmt.Errorf("backend[%d].ForwardQUIC.KeepAlivePeriod: must be less than MaxIdleTimeout", i)
+			}
+		}
+		if be.ErrorPageTemplate != "" {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].ErrorPageTemplate: only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			t, err := parseErrorPageTemplate(be.ErrorPageTemplate)
+			if err != nil {
+				return fmt.Errorf("backend[%d].ErrorPageTemplate: %w", i, err)
+			}
+			be.errorPageTemplate = t
+		} else if cfg.templates.errorPage != nil && (be.Mode == ModeHTTP || be.Mode == ModeHTTPS) {
+			be.errorPageTemplate = cfg.templates.errorPage
+		}
+		be.templates = cfg.templates
+		if ci := be.ContentInspection; ci != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].ContentInspection: only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			if u, err := url.Parse(ci.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("backend[%d].ContentInspection.URL: invalid URL %q", i, ci.URL)
+			}
+			if !ci.Requests && !ci.Responses {
+				return fmt.Errorf("backend[%d].ContentInspection: Requests or Responses must be set", i)
+			}
+			for j, p := range ci.Paths {
+				if !strings.HasPrefix(p, "/") {
+					return fmt.Errorf("backend[%d].ContentInspection.Paths[%d]: must start with /", i, j)
+				}
+			}
+			if ci.MaxBodySize < 0 || ci.Timeout < 0 {
+				return fmt.Errorf("backend[%d].ContentInspection: MaxBodySize and Timeout must not be negative", i)
+			}
+			if ci.MaxBodySize == 0 {
+				ci.MaxBodySize = defaultInspectionMaxBodySize
+			}
+			if ci.Timeout == 0 {
+				ci.Timeout = defaultInspectionTimeout
+			}
+		}
+		for j, pl := range be.WASMPlugins {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].WASMPlugins: only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			if pl == nil {
+				return fmt.Errorf("backend[%d].WASMPlugins[%d]: must not be empty", i, j)
+			}
+			code, err := os.ReadFile(pl.Module)
+			if err != nil {
+				return fmt.Errorf("backend[%d].WASMPlugins[%d].Module: %w", i, j, err)
+			}
+			pl.code = code
+			for k, p := range pl.Paths {
+				if !strings.HasPrefix(p, "/") {
+					return fmt.Errorf("backend[%d].WASMPlugins[%d].Paths[%d]: must start with /", i, j, k)
+				}
+			}
+			if pl.MaxBodySize < 0 || pl.Timeout < 0 {
+				return fmt.Errorf("backend[%d].WASMPlugins[%d]: MaxBodySize and Timeout must not be negative", i, j)
+			}
+			if pl.MaxBodySize == 0 {
+				pl.MaxBodySize = defaultPluginMaxBodySize
+			}
+			if pl.Timeout == 0 {
+				pl.Timeout = defaultPluginTimeout
+			}
+		}
+		if ea := be.ExtAuthz; ea != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].ExtAuthz: only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			if u, err := url.Parse(ea.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("backend[%d].ExtAuthz.URL: invalid URL %q", i, ea.URL)
+			}
+			for j, p := range ea.Paths {
+				if !strings.HasPrefix(p, "/") {
+					return fmt.Errorf("backend[%d].ExtAuthz.Paths[%d]: must start with /", i, j)
+				}
+			}
+			if ea.Timeout < 0 {
+				return fmt.Errorf("backend[%d].ExtAuthz.Timeout: must not be negative", i)
+			}
+			if ea.Timeout == 0 {
+				ea.Timeout = defaultExtAuthzTimeout
+			}
+		}
+		if ht := be.HTTPTransport; ht != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].HTTPTransport: only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			if ht.MaxIdleConnsPerHost < 0 {
+				return fmt.Errorf("backend[%d].HTTPTransport.MaxIdleConnsPerHost: must not be negative", i)
+			}
+			if ht.MaxConnsPerHost < 0 {
+				return fmt.Errorf("backend[%d].HTTPTransport.MaxConnsPerHost: must not be negative", i)
+			}
+			if ht.IdleConnTimeout < 0 {
+				return fmt.Errorf("backend[%d].HTTPTransport.IdleConnTimeout: must not be negative", i)
+			}
+		}
 		be.ForwardServerName = idnaToASCII(be.ForwardServerName)
 		if be.ForwardRateLimit == 0 {
 			be.ForwardRateLimit = 5
@@ -1163,6 +4290,11 @@ func (cfg *Config) Check() error {
 			return fmt.Errorf("backend[%d].ProxyProtocolVersion: %w", i, err)
 		}
 		be.proxyProtocolVersion = ver
+		tlvs, err := validateProxyProtoTLVs(be.ProxyProtocolTLVs, ver)
+		if err != nil {
+			return fmt.Errorf("backend[%d].ProxyProtocolTLVs: %w", i, err)
+		}
+		be.proxyProtocolTLVs = tlvs
 
 		if len(be.PathOverrides) > 0 && be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
 			return fmt.Errorf("backend[%d].PathOverrides is only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
@@ -1176,6 +4308,9 @@ func (cfg *Config) Check() error {
 					return fmt.Errorf("backend[%d].PathOverrides[%d].Paths[%d]: must start and end with /", i, j, k)
 				}
 			}
+			if err := validateAddresses(po.Addresses, cfg.Tailscale != nil); err != nil {
+				return fmt.Errorf("backend[%d].PathOverrides[%d].Addresses: %w", i, j, err)
+			}
 			if po.Mode == "" {
 				po.Mode = be.Mode
 			}
@@ -1193,19 +4328,283 @@ func (cfg *Config) Check() error {
 				}
 			}
 			po.ForwardServerName = idnaToASCII(po.ForwardServerName)
+			if po.ForwardRequireOCSP && po.InsecureSkipVerify {
+				return fmt.Errorf("backend[%d].PathOverrides[%d].ForwardRequireOCSP: cannot be used with InsecureSkipVerify", i, j)
+			}
+			if po.ForwardRequireSCT && po.InsecureSkipVerify {
+				return fmt.Errorf("backend[%d].PathOverrides[%d].ForwardRequireSCT: cannot be used with InsecureSkipVerify", i, j)
+			}
+			if po.ForwardRequireSCT && cfg.ctLogs == nil {
+				return fmt.Errorf("backend[%d].PathOverrides[%d].ForwardRequireSCT: CTLogList must be set", i, j)
+			}
+			if po.ForwardDANE {
+				if err := validateDANE(cfg, po.Mode, po.InsecureSkipVerify, po.ForwardRequireOCSP, po.ForwardRequireSCT); err != nil {
+					return fmt.Errorf("backend[%d].PathOverrides[%d].ForwardDANE: %w", i, j, err)
+				}
+			}
+			for k, pin := range po.ForwardPinnedKeys {
+				if err := validateSPKIPin(pin); err != nil {
+					return fmt.Errorf("backend[%d].PathOverrides[%d].ForwardPinnedKeys[%d]: %w", i, j, k, err)
+				}
+			}
+			if len(po.ForwardPinnedKeys) > 0 && po.ForwardDANE {
+				return fmt.Errorf("backend[%d].PathOverrides[%d].ForwardPinnedKeys: cannot be used with ForwardDANE", i, j)
+			}
 			if po.ForwardTimeout == 0 {
 				po.ForwardTimeout = 30 * time.Second
 			}
+			if po.DialSourceAddress != "" {
+				ip := net.ParseIP(po.DialSourceAddress)
+				if ip == nil {
+					return fmt.Errorf("backend[%d].PathOverrides[%d].DialSourceAddress: invalid IP address %q", i, j, po.DialSourceAddress)
+				}
+				po.dialSourceAddr = &net.TCPAddr{IP: ip}
+			}
+			if po.DialInterface != "" {
+				if err := validateDialInterface(po.DialInterface); err != nil {
+					return fmt.Errorf("backend[%d].PathOverrides[%d].DialInterface: %w", i, j, err)
+				}
+			}
+			if po.ForwardTCPOptions != nil {
+				if err := po.ForwardTCPOptions.validate(); err != nil {
+					return fmt.Errorf("backend[%d].PathOverrides[%d].ForwardTCPOptions: %w", i, j, err)
+				}
+			}
 			ver, err := validateProxyProtoVersion(po.ProxyProtocolVersion)
 			if err != nil {
 				return fmt.Errorf("backend[%d].PathOverrides[%d].ProxyProtocolVersion: %w", i, j, err)
 			}
 			po.proxyProtocolVersion = ver
+			tlvs, err := validateProxyProtoTLVs(po.ProxyProtocolTLVs, ver)
+			if err != nil {
+				return fmt.Errorf("backend[%d].PathOverrides[%d].ProxyProtocolTLVs: %w", i, j, err)
+			}
+			po.proxyProtocolTLVs = tlvs
+		}
+
+		if len(be.Canary) > 0 && be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+			return fmt.Errorf("backend[%d].Canary is only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+		}
+		for j, c := range be.Canary {
+			if (c.Header == "") == (c.Cookie == "") {
+				return fmt.Errorf("backend[%d].Canary[%d]: exactly one of Header or Cookie must be set", i, j)
+			}
+			if len(c.Addresses) == 0 {
+				return fmt.Errorf("backend[%d].Canary[%d].Addresses: cannot be empty", i, j)
+			}
+			if err := validateAddresses(c.Addresses, cfg.Tailscale != nil); err != nil {
+				return fmt.Errorf("backend[%d].Canary[%d].Addresses: %w", i, j, err)
+			}
+		}
+
+		if m := be.Maintenance; m != nil {
+			if be.Mode == ModeConsole {
+				return fmt.Errorf("backend[%d].Maintenance: not valid in %s mode", i, ModeConsole)
+			}
+			if m.RetryAfter < 0 {
+				return fmt.Errorf("backend[%d].Maintenance.RetryAfter: must not be negative", i)
+			}
+			if m.ErrorPage != "" {
+				if be.Mode != ModeHTTP && be.Mode != ModeHTTPS && be.Mode != ModeLocal {
+					return fmt.Errorf("backend[%d].Maintenance.ErrorPage: only valid in %s, %s, or %s mode", i, ModeHTTP, ModeHTTPS, ModeLocal)
+				}
+				b, err := os.ReadFile(m.ErrorPage)
+				if err != nil {
+					return fmt.Errorf("backend[%d].Maintenance.ErrorPage: %w", i, err)
+				}
+				m.errorPage = b
+			}
+		}
+
+		if od := be.OnDemandTLS; od != nil {
+			if be.Mode == ModeConsole || be.Mode == ModeTLSPassthrough {
+				return fmt.Errorf("backend[%d].OnDemandTLS: not valid in %s or %s mode", i, ModeConsole, ModeTLSPassthrough)
+			}
+			if len(od.ServerNames) == 0 {
+				return fmt.Errorf("backend[%d].OnDemandTLS.ServerNames: must be set", i)
+			}
+			for j, v := range od.ServerNames {
+				v = strings.ToLower(v)
+				if strings.TrimPrefix(v, "*.") == "" || strings.Contains(strings.TrimPrefix(v, "*."), "*") {
+					return fmt.Errorf("backend[%d].OnDemandTLS.ServerNames[%d]: invalid value %q", i, j, v)
+				}
+				if k, exists := onDemandNames[v]; exists {
+					return fmt.Errorf("backend[%d].OnDemandTLS.ServerNames[%d]: duplicate value %q, also used by backend[%d]", i, j, v, k)
+				}
+				onDemandNames[v] = i
+			}
+			if od.CertificatesPerHour == 0 {
+				od.CertificatesPerHour = 10
+			}
+			if od.CertificatesPerHour < 0 {
+				return fmt.Errorf("backend[%d].OnDemandTLS.CertificatesPerHour: must be positive", i)
+			}
+			if od.RetryAfter == 0 {
+				od.RetryAfter = 10 * time.Second
+			}
+			if od.RetryAfter < 0 {
+				return fmt.Errorf("backend[%d].OnDemandTLS.RetryAfter: must be positive", i)
+			}
+			if od.Ask != "" {
+				if u, err := url.Parse(od.Ask); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+					return fmt.Errorf("backend[%d].OnDemandTLS.Ask: invalid URL %q", i, od.Ask)
+				}
+			}
+			if od.FailureBackoff == 0 {
+				od.FailureBackoff = 10 * time.Minute
+			}
+			if od.FailureBackoff < 0 {
+				return fmt.Errorf("backend[%d].OnDemandTLS.FailureBackoff: must be positive", i)
+			}
+		}
+
+		if q := be.TrafficQuota; q != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].TrafficQuota: only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			if len(be.ssoPolicies()) == 0 {
+				return fmt.Errorf("backend[%d].TrafficQuota: SSO must be enabled", i)
+			}
+			if q.Daily < 0 || q.Monthly < 0 {
+				return fmt.Errorf("backend[%d].TrafficQuota: must not be negative", i)
+			}
+		}
+		be.identityLimiter = nil
+		if l := be.IdentityRateLimit; l != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS && be.Mode != ModeLocal {
+				return fmt.Errorf("backend[%d].IdentityRateLimit: only valid in %s, %s, or %s mode", i, ModeHTTP, ModeHTTPS, ModeLocal)
+			}
+			if l.RequestsPerMinute <= 0 {
+				return fmt.Errorf("backend[%d].IdentityRateLimit.RequestsPerMinute: must be greater than 0", i)
+			}
+			if l.Burst < 0 {
+				return fmt.Errorf("backend[%d].IdentityRateLimit.Burst: must not be negative", i)
+			}
+			burst := l.Burst
+			if burst == 0 {
+				burst = max(1, int(l.RequestsPerMinute))
+			}
+			be.identityLimiter = ratelimit.New(rate.Limit(l.RequestsPerMinute/60), burst, 0)
 		}
 	}
 	return os.MkdirAll(cfg.CacheDir, 0o700)
 }
 
+func validateDANE(cfg *Config, mode string, insecureSkipVerify, requireOCSP, requireSCT bool) error {
+	if mode != ModeTLS && mode != ModeHTTPS && mode != ModeQUIC {
+		return fmt.Errorf("only valid in %s, %s, or %s mode", ModeTLS, ModeHTTPS, ModeQUIC)
+	}
+	if cfg.Resolver == nil {
+		return errors.New("Resolver must be set")
+	}
+	if insecureSkipVerify || requireOCSP || requireSCT {
+		return errors.New("cannot be used with InsecureSkipVerify, ForwardRequireOCSP, or ForwardRequireSCT")
+	}
+	return nil
+}
+
+func (wg *ConfigWireGuard) check() error {
+	if wg.PrivateKeyFile == "" {
+		return errors.New("PrivateKeyFile: must be set")
+	}
+	if len(wg.Addresses) == 0 {
+		return errors.New("Addresses: must have at least one address")
+	}
+	for _, a := range wg.Addresses {
+		if _, err := netip.ParseAddr(a); err != nil {
+			return fmt.Errorf("Addresses: %w", err)
+		}
+	}
+	for _, a := range wg.DNS {
+		if _, err := netip.ParseAddr(a); err != nil {
+			return fmt.Errorf("DNS: %w", err)
+		}
+	}
+	if wg.MTU == 0 {
+		wg.MTU = 1420
+	}
+	if wg.MTU < 576 || wg.MTU > 65535 {
+		return fmt.Errorf("MTU: invalid value %d", wg.MTU)
+	}
+	if len(wg.Peers) == 0 {
+		return errors.New("Peers: must have at least one peer")
+	}
+	for i, p := range wg.Peers {
+		if b, err := base64.StdEncoding.DecodeString(p.PublicKey); err != nil || len(b) != 32 {
+			return fmt.Errorf("Peers[%d].PublicKey: invalid key", i)
+		}
+		if p.Endpoint != "" {
+			if _, _, err := net.SplitHostPort(p.Endpoint); err != nil {
+				return fmt.Errorf("Peers[%d].Endpoint: %w", i, err)
+			}
+		}
+		if len(p.AllowedIPs) == 0 {
+			return fmt.Errorf("Peers[%d].AllowedIPs: must have at least one prefix", i)
+		}
+		for _, a := range p.AllowedIPs {
+			if _, err := netip.ParsePrefix(a); err != nil {
+				return fmt.Errorf("Peers[%d].AllowedIPs: %w", i, err)
+			}
+		}
+		if p.PersistentKeepalive < 0 || p.PersistentKeepalive > 65535*time.Second {
+			return fmt.Errorf("Peers[%d].PersistentKeepalive: invalid value %s", i, p.PersistentKeepalive)
+		}
+	}
+	return nil
+}
+
+func validateAddresses(addrs []string, tailscale bool) error {
+	for _, a := range addrs {
+		if name, ok := strings.CutPrefix(a, srvPrefix); ok {
+			if name == "" || strings.Contains(name, ":") {
+				return fmt.Errorf("invalid SRV name %q", a)
+			}
+		}
+		if addr, ok := strings.CutPrefix(a, tailscalePrefix); ok {
+			if !tailscale {
+				return fmt.Errorf("%q: Tailscale must be set", a)
+			}
+			if host, _, err := net.SplitHostPort(addr); err != nil || host == "" {
+				return fmt.Errorf("invalid tailnet address %q", a)
+			}
+		}
+	}
+	return nil
+}
+
+func (o *TCPOptions) validate() error {
+	if o.ReceiveBufferSize < 0 || o.SendBufferSize < 0 {
+		return errors.New("buffer sizes must not be negative")
+	}
+	if o.KeepAliveInterval < 0 || o.KeepAliveCount < 0 {
+		return errors.New("KeepAliveInterval and KeepAliveCount must not be negative")
+	}
+	if o.UserTimeout < 0 {
+		return errors.New("UserTimeout must not be negative")
+	}
+	if o.UserTimeout > 0 && !tcpUserTimeoutSupported {
+		return errors.New("UserTimeout is only supported on linux")
+	}
+	return nil
+}
+
+func validateBufferSize(n int) error {
+	if n < 1<<10 || n > 16<<20 {
+		return errors.New("must be between 1 KiB and 16 MiB")
+	}
+	return nil
+}
+
+func validateDialInterface(name string) error {
+	if !bindToDeviceSupported {
+		return errors.New("only supported on linux")
+	}
+	if _, err := net.InterfaceByName(name); err != nil {
+		return fmt.Errorf("%q: %w", name, err)
+	}
+	return nil
+}
+
 func validateProxyProtoVersion(s string) (byte, error) {
 	if s == "" {
 		return 0, nil
@@ -1220,6 +4619,24 @@ func validateProxyProtoVersion(s string) (byte, error) {
 	return byte(v), nil
 }
 
+func validateProxyProtoTLVs(tlvs *[]string, ver byte) ([]string, error) {
+	if tlvs == nil {
+		return []string{proxyTLVAuthority, proxyTLVALPN}, nil
+	}
+	if ver != 2 {
+		return nil, errors.New("only valid with ProxyProtocolVersion v2")
+	}
+	out := make([]string, 0, len(*tlvs))
+	for _, t := range *tlvs {
+		t = strings.ToLower(t)
+		if !slices.Contains(validProxyTLVs, t) {
+			return nil, fmt.Errorf("invalid value %q, expected one of %v", t, validProxyTLVs)
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
 // ReadConfig reads and validates a YAML config file.
 func ReadConfig(filename string) (*Config, error) {
 	f, err := os.Open(filename)
@@ -1227,15 +4644,5 @@ func ReadConfig(filename string) (*Config, error) {
 		return nil, err
 	}
 	defer f.Close()
-
-	dec := yaml.NewDecoder(f)
-	dec.KnownFields(true)
-	var cfg Config
-	if err := dec.Decode(&cfg); err != nil {
-		return nil, err
-	}
-	if err := cfg.Check(); err != nil {
-		return nil, err
-	}
-	return &cfg, nil
+	return decodeConfig(f)
 }
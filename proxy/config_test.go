@@ -154,3 +154,60 @@ func TestReadConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckSCEPChallengeEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		be      *Backend
+		wantErr bool
+	}{
+		{"no auth", &Backend{}, true},
+		{"client auth", &Backend{ClientAuth: &ClientAuth{RootCAs: []string{"TEST CA"}}}, false},
+	} {
+		be := tc.be
+		be.ServerNames = []string{"scep-admin.example.com"}
+		be.Mode = ModeLocal
+		cfg := &Config{
+			PKI: []*ConfigPKI{{
+				Name: "TEST CA",
+				SCEP: &ConfigPKISCEP{
+					Endpoint:          "https://scep.example.com/scep",
+					ChallengeEndpoint: "https://scep-admin.example.com/challenge",
+				},
+			}},
+			Backends: []*Backend{
+				{ServerNames: []string{"scep.example.com"}, Mode: ModeLocal},
+				be,
+			},
+		}
+		if err := cfg.Check(); (err != nil) != tc.wantErr {
+			t.Errorf("%s: Check() = %v, wantErr %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestCheckBackendAPIAllowedServerNames(t *testing.T) {
+	for _, tc := range []struct {
+		allowed []string
+		wantErr bool
+	}{
+		{nil, true},
+		{[]string{"*.preview.example.com"}, false},
+	} {
+		cfg := &Config{
+			BackendAPI: &ConfigBackendAPI{
+				Endpoint:           "https://admin.example.com/backends",
+				ACL:                []string{"EMAIL:deployer@example.com"},
+				AllowedServerNames: tc.allowed,
+			},
+			Backends: []*Backend{{
+				ServerNames: []string{"admin.example.com"},
+				Mode:        ModeLocal,
+				ClientAuth:  &ClientAuth{RootCAs: []string{demoCert}},
+			}},
+		}
+		if err := cfg.Check(); (err != nil) != tc.wantErr {
+			t.Errorf("%v: Check() = %v, wantErr %v", tc.allowed, err, tc.wantErr)
+		}
+	}
+}
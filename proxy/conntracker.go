@@ -52,6 +52,12 @@ func (t *connTracker) slice() []annotatedConnection {
 	return out
 }
 
+func (t *connTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
 func (t *connTracker) add(c annotatedConnection) int {
 	t.mu.Lock()
 	defer t.mu.Unlock()
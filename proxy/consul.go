@@ -0,0 +1,181 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	consulDefaultAddress = "http://127.0.0.1:8500"
+	consulRetryDelay     = 5 * time.Second
+	consulWait           = 5 * time.Minute
+)
+
+// consulServiceEntry contains the fields that we need from the entries
+// returned by Consul's /v1/health/service endpoint.
+type consulServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+	Checks []struct {
+		Status string `json:"Status"`
+	} `json:"Checks"`
+}
+
+// consulWatcher keeps a backend's addresses in sync with the healthy
+// instances of a Consul service.
+type consulWatcher struct {
+	be        *Backend
+	cfg       ConfigConsul
+	client    *http.Client
+	addresses []string
+}
+
+func (w *consulWatcher) run(ctx context.Context) {
+	if w.cfg.Address == "" {
+		w.cfg.Address = consulDefaultAddress
+	}
+	w.client = &http.Client{
+		Timeout: consulWait + consulWait/16 + 30*time.Second,
+	}
+	var index uint64
+	for {
+		next, err := w.query(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			w.be.logErrorF("ERR consul %s: %v", w.cfg.Service, err)
+			index = 0
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(consulRetryDelay):
+			}
+			continue
+		}
+		// The index can go backward, e.g. when the raft state is
+		// restored. Start over when that happens.
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+// query gets the instances of the service and returns the index to use
+// for the next blocking query.
+func (w *consulWatcher) query(ctx context.Context, index uint64) (uint64, error) {
+	v := url.Values{}
+	if w.cfg.Tag != "" {
+		v.Set("tag", w.cfg.Tag)
+	}
+	if w.cfg.Datacenter != "" {
+		v.Set("dc", w.cfg.Datacenter)
+	}
+	if index > 0 {
+		v.Set("index", strconv.FormatUint(index, 10))
+		v.Set("wait", fmt.Sprintf("%ds", int(consulWait.Seconds())))
+	}
+	u := fmt.Sprintf("%s/v1/health/service/%s?%s", strings.TrimSuffix(w.cfg.Address, "/"), url.PathEscape(w.cfg.Service), v.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	if w.cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", w.cfg.Token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("X-Consul-Index: %w", err)
+	}
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return 0, err
+	}
+	w.update(entries)
+	return next, nil
+}
+
+func (w *consulWatcher) update(entries []consulServiceEntry) {
+	var addrs []string
+	for _, e := range entries {
+		if !w.healthy(e) {
+			continue
+		}
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		if host == "" || e.Service.Port <= 0 {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+	}
+	slices.Sort(addrs)
+	addrs = slices.Compact(addrs)
+	if slices.Equal(addrs, w.addresses) {
+		return
+	}
+	w.addresses = addrs
+	w.be.setDiscoveredAddresses(addrs)
+	w.be.logErrorF("INF consul %s: %v", w.cfg.Service, addrs)
+}
+
+func (w *consulWatcher) healthy(e consulServiceEntry) bool {
+	for _, c := range e.Checks {
+		switch c.Status {
+		case "passing":
+		case "warning":
+			if !w.cfg.AllowWarning {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
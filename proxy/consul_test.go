@@ -0,0 +1,152 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestConsulDiscovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+	_, port, _ := net.SplitHostPort(be1.listener.Addr().String())
+
+	entries := fmt.Sprintf(`[
+		{"Node":{"Address":"127.0.0.1"},"Service":{"Port":%s},"Checks":[{"Status":"passing"},{"Status":"passing"}]},
+		{"Node":{"Address":"10.0.0.1"},"Service":{"Address":"127.0.0.2","Port":%s},"Checks":[{"Status":"critical"}]},
+		{"Node":{"Address":"10.0.0.2"},"Service":{"Address":"127.0.0.3","Port":%s},"Checks":[{"Status":"warning"}]}
+	]`, port, port, port)
+	updates := make(chan string)
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if got, want := req.URL.Path, "/v1/health/service/web"; got != want {
+			t.Errorf("Path = %q, want %q", got, want)
+		}
+		q := req.URL.Query()
+		if got, want := q.Get("tag"), "v2"; got != want {
+			t.Errorf("tag = %q, want %q", got, want)
+		}
+		if got, want := q.Get("dc"), "dc1"; got != want {
+			t.Errorf("dc = %q, want %q", got, want)
+		}
+		if got, want := req.Header.Get("X-Consul-Token"), "TOKEN"; got != want {
+			t.Errorf("X-Consul-Token = %q, want %q", got, want)
+		}
+		switch q.Get("index") {
+		case "":
+			w.Header().Set("X-Consul-Index", "10")
+			fmt.Fprint(w, entries)
+		case "10":
+			select {
+			case <-req.Context().Done():
+			case e := <-updates:
+				w.Header().Set("X-Consul-Index", "11")
+				fmt.Fprint(w, e)
+			}
+		default:
+			<-req.Context().Done()
+		}
+	}))
+	defer consul.Close()
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Consul: &ConfigConsul{
+					Address:    consul.URL,
+					Service:    "web",
+					Tag:        "v2",
+					Datacenter: "dc1",
+					Token:      "TOKEN",
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+	be := proxy.cfg.Backends[0]
+
+	waitFor := func(want []string) {
+		t.Helper()
+		for i := 0; ; i++ {
+			got := be.addresses()
+			if slices.Equal(got, want) {
+				return
+			}
+			if i == 100 {
+				t.Fatalf("addresses() = %v, want %v", got, want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	waitFor([]string{"127.0.0.1:" + port})
+
+	got, _, err := tlsGet("example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil)
+	if err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	if want := "Hello from backend1\n"; got != want {
+		t.Errorf("tlsGet() = %q, want %q", got, want)
+	}
+
+	updates <- `[{"Node":{"Address":"127.0.0.1"},"Service":{"Port":1234},"Checks":[{"Status":"critical"}]}]`
+	waitFor(nil)
+
+	for _, be := range []*Backend{
+		{ServerNames: []string{"example.com"}, Consul: &ConfigConsul{}},
+		{ServerNames: []string{"example.com"}, Consul: &ConfigConsul{Service: "web", Address: "127.0.0.1:8500"}},
+		{ServerNames: []string{"example.com"}, Consul: &ConfigConsul{Service: "web"}, Addresses: []string{"127.0.0.1:80"}},
+		{ServerNames: []string{"example.com"}, Consul: &ConfigConsul{Service: "web"}, Kubernetes: &ConfigKubernetes{Service: "web"}},
+	} {
+		cfg := &Config{
+			CacheDir: t.TempDir(),
+			Backends: []*Backend{be},
+		}
+		if err := cfg.Check(); err == nil {
+			t.Errorf("Check() with %+v should fail", be.Consul)
+		}
+	}
+}
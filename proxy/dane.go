@@ -0,0 +1,308 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	tlsaMinTTL = 30 * time.Second
+	tlsaMaxTTL = time.Hour
+)
+
+var errDANE = errors.New("no matching TLSA record")
+
+// tlsaRecord is a DNS TLSA record. See RFC 6698.
+type tlsaRecord struct {
+	usage        uint8
+	selector     uint8
+	matchingType uint8
+	data         []byte
+}
+
+type tlsaCacheEntry struct {
+	records []tlsaRecord
+	expires time.Time
+}
+
+// lookupTLSA returns the TLSA records for name. The response must be
+// authenticated with DNSSEC by the resolver.
+func (r *resolver) lookupTLSA(ctx context.Context, name string) ([]tlsaRecord, time.Duration, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, 0, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               uint16(id[0])<<8 | uint16(id[1]),
+		RecursionDesired: true,
+		AuthenticData:    true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: qname, Type: dnsmessage.Type(52), Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+	// Set the DNSSEC OK bit.
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, true); err != nil {
+		return nil, 0, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, 0, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := r.Exchange(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseTLSAResponse(resp, query)
+}
+
+func parseTLSAResponse(resp, query []byte) ([]tlsaRecord, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !h.Response || h.ID != uint16(query[0])<<8|uint16(query[1]) {
+		return nil, 0, errors.New("invalid DNS response")
+	}
+	if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+		return nil, 0, fmt.Errorf("DNS error: %v", h.RCode)
+	}
+	if !h.AuthenticData {
+		return nil, 0, errors.New("TLSA response not authenticated with DNSSEC")
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+	var records []tlsaRecord
+	ttl := tlsaMaxTTL
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if rh.Type != dnsmessage.Type(52) {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		r, err := p.UnknownResource()
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(r.Data) < 3 {
+			continue
+		}
+		records = append(records, tlsaRecord{
+			usage:        r.Data[0],
+			selector:     r.Data[1],
+			matchingType: r.Data[2],
+			data:         r.Data[3:],
+		})
+		ttl = min(ttl, time.Duration(rh.TTL)*time.Second)
+	}
+	return records, max(ttl, tlsaMinTTL), nil
+}
+
+// tlsaRecords returns the TLSA records of the service at addr. The records
+// are cached according to their TTL.
+func (be *Backend) tlsaRecords(ctx context.Context, addr, network string) ([]tlsaRecord, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return nil, fmt.Errorf("DANE requires a host name: %s", addr)
+	}
+	name := "_" + port + "._" + network + "." + host + "."
+
+	be.state.mu.Lock()
+	e := be.state.tlsa[name]
+	be.state.mu.Unlock()
+	if e != nil && time.Now().Before(e.expires) {
+		return e.records, nil
+	}
+	if be.resolver == nil {
+		return nil, errors.New("DANE requires a resolver")
+	}
+	records, ttl, err := be.resolver.lookupTLSA(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	be.state.mu.Lock()
+	defer be.state.mu.Unlock()
+	if be.state.tlsa == nil {
+		be.state.tlsa = make(map[string]*tlsaCacheEntry)
+	}
+	be.state.tlsa[name] = &tlsaCacheEntry{
+		records: records,
+		expires: time.Now().Add(ttl),
+	}
+	return records, nil
+}
+
+// daneTLSConfig returns a copy of tc that verifies the server's certificate
+// with the TLSA records of addr instead of the usual verification.
+func (be *Backend) daneTLSConfig(ctx context.Context, tc *tls.Config, addr, network string) (*tls.Config, error) {
+	records, err := be.tlsaRecords(ctx, addr, network)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no TLSA records for %s", addr)
+	}
+	tc = tc.Clone()
+	if tc.ServerName == "" {
+		tc.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	serverName, roots := tc.ServerName, tc.RootCAs
+	tc.InsecureSkipVerify = true
+	tc.VerifyConnection = func(cs tls.ConnectionState) error {
+		if err := verifyDANE(records, cs.PeerCertificates, serverName, roots); err != nil {
+			if len(cs.PeerCertificates) > 0 {
+				be.recordEvent(fmt.Sprintf("backend X509 %s [%s] (DANE:%v)", idnaToUnicode(serverName), cs.PeerCertificates[0].Subject, err))
+			}
+			return tlsBadCertificate
+		}
+		return nil
+	}
+	return tc, nil
+}
+
+// matches returns true if the TLSA record matches cert.
+func (r tlsaRecord) matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch r.selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch r.matchingType {
+	case 0:
+	case 1:
+		h := sha256.Sum256(data)
+		data = h[:]
+	case 2:
+		h := sha512.Sum512(data)
+		data = h[:]
+	default:
+		return false
+	}
+	return bytes.Equal(data, r.data)
+}
+
+// verifyDANE verifies the server's certificates with the TLSA records, as
+// specified in RFC 6698 and RFC 7671.
+func verifyDANE(records []tlsaRecord, certs []*x509.Certificate, serverName string, roots *x509.CertPool) error {
+	if len(certs) == 0 {
+		return tlsCertificateRequired
+	}
+	leaf := certs[0]
+	verify := func(roots *x509.CertPool) ([][]*x509.Certificate, error) {
+		inter := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			inter.AddCert(c)
+		}
+		return leaf.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: inter,
+			DNSName:       serverName,
+		})
+	}
+	var pkixChains [][]*x509.Certificate
+	var pkixDone bool
+	pkix := func() [][]*x509.Certificate {
+		if !pkixDone {
+			pkixChains, _ = verify(roots)
+			pkixDone = true
+		}
+		return pkixChains
+	}
+	for _, r := range records {
+		switch r.usage {
+		case 0: // PKIX-TA
+			for _, chain := range pkix() {
+				for _, c := range chain[1:] {
+					if r.matches(c) {
+						return nil
+					}
+				}
+			}
+		case 1: // PKIX-EE
+			if len(pkix()) > 0 && r.matches(leaf) {
+				return nil
+			}
+		case 2: // DANE-TA
+			for _, c := range certs[1:] {
+				if !r.matches(c) {
+					continue
+				}
+				pool := x509.NewCertPool()
+				pool.AddCert(c)
+				if _, err := verify(pool); err == nil {
+					return nil
+				}
+			}
+		case 3: // DANE-EE, the name and the validity period are not checked.
+			if r.matches(leaf) {
+				return nil
+			}
+		}
+	}
+	return errDANE
+}
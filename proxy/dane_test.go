@@ -0,0 +1,179 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestVerifyDANE(t *testing.T) {
+	newCert := func(template, parent *x509.Certificate, key, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+		if err != nil {
+			t.Fatalf("x509.CreateCertificate: %v", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("x509.ParseCertificate: %v", err)
+		}
+		return cert
+	}
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	ca := newCert(caTemplate, caTemplate, caKey, caKey)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leaf := newCert(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     []string{"backend.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, ca, key, caKey)
+
+	spki := func(c *x509.Certificate) []byte {
+		h := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+		return h[:]
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	for _, tc := range []struct {
+		name       string
+		record     tlsaRecord
+		serverName string
+		roots      *x509.CertPool
+		ok         bool
+	}{
+		{"DANE-EE", tlsaRecord{3, 1, 1, spki(leaf)}, "other.example.com", nil, true},
+		{"DANE-EE full cert", tlsaRecord{3, 0, 0, leaf.Raw}, "backend.example.com", nil, true},
+		{"DANE-EE mismatch", tlsaRecord{3, 1, 1, spki(ca)}, "backend.example.com", nil, false},
+		{"DANE-TA", tlsaRecord{2, 1, 1, spki(ca)}, "backend.example.com", nil, true},
+		{"DANE-TA wrong name", tlsaRecord{2, 1, 1, spki(ca)}, "other.example.com", nil, false},
+		{"PKIX-EE", tlsaRecord{1, 1, 1, spki(leaf)}, "backend.example.com", roots, true},
+		{"PKIX-EE untrusted", tlsaRecord{1, 1, 1, spki(leaf)}, "backend.example.com", nil, false},
+		{"PKIX-TA", tlsaRecord{0, 1, 1, spki(ca)}, "backend.example.com", roots, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifyDANE([]tlsaRecord{tc.record}, []*x509.Certificate{leaf, ca}, tc.serverName, tc.roots)
+			if got := err == nil; got != tc.ok {
+				t.Errorf("verifyDANE() = %v, want ok=%v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestTLSARecords(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer pc.Close()
+
+	var authenticated atomic.Bool
+	authenticated.Store(true)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+				ID:            h.ID,
+				Response:      true,
+				AuthenticData: authenticated.Load(),
+			})
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			b.UnknownResource(dnsmessage.ResourceHeader{
+				Name:  q.Name,
+				Type:  q.Type,
+				Class: dnsmessage.ClassINET,
+				TTL:   300,
+			}, dnsmessage.UnknownResource{
+				Type: q.Type,
+				Data: []byte{3, 1, 1, 0xaa, 0xbb},
+			})
+			resp, _ := b.Finish()
+			pc.WriteTo(resp, addr)
+		}
+	}()
+
+	r, err := newResolver(&ConfigResolver{Nameservers: []string{pc.LocalAddr().String()}})
+	if err != nil {
+		t.Fatalf("newResolver: %v", err)
+	}
+	be := &Backend{
+		resolver: r,
+		state:    &backendState{},
+	}
+	records, err := be.tlsaRecords(context.Background(), "backend.example.com:443", "tcp")
+	if err != nil {
+		t.Fatalf("tlsaRecords: %v", err)
+	}
+	if len(records) != 1 || records[0].usage != 3 || records[0].selector != 1 || records[0].matchingType != 1 || string(records[0].data) != "\xaa\xbb" {
+		t.Errorf("tlsaRecords() = %v", records)
+	}
+	if _, ok := be.state.tlsa["_443._tcp.backend.example.com."]; !ok {
+		t.Errorf("TLSA records not cached: %v", be.state.tlsa)
+	}
+
+	authenticated.Store(false)
+	if _, err := be.tlsaRecords(context.Background(), "backend.example.com:8443", "tcp"); err == nil {
+		t.Error("tlsaRecords() should fail without DNSSEC")
+	}
+	if _, err := be.tlsaRecords(context.Background(), "192.168.0.1:443", "tcp"); err == nil {
+		t.Error("tlsaRecords() should fail with an IP address")
+	}
+}
@@ -0,0 +1,113 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/idp"
+)
+
+// addDiagnosticsHandlers adds the pprof and expvar handlers to a console
+// backend.
+func (p *Proxy) addDiagnosticsHandlers(be *Backend) {
+	if be.Diagnostics == nil {
+		return
+	}
+	be.localHandlers = append(be.localHandlers,
+		localHandler{desc: "Diagnostics", path: "/debug/diagnostics", handler: logHandler(p.diagnosticsHandler(be, http.HandlerFunc(p.diagnosticsToggleHandler), true))},
+		localHandler{desc: "PProf", path: "/debug/pprof", matchPrefix: true, handler: logHandler(p.diagnosticsHandler(be, http.HandlerFunc(pprof.Index), false))},
+		localHandler{path: "/debug/pprof/cmdline", handler: logHandler(p.diagnosticsHandler(be, http.HandlerFunc(pprof.Cmdline), false))},
+		localHandler{path: "/debug/pprof/profile", handler: logHandler(p.diagnosticsHandler(be, http.HandlerFunc(pprof.Profile), false))},
+		localHandler{path: "/debug/pprof/symbol", handler: logHandler(p.diagnosticsHandler(be, http.HandlerFunc(pprof.Symbol), false))},
+		localHandler{path: "/debug/pprof/trace", handler: logHandler(p.diagnosticsHandler(be, http.HandlerFunc(pprof.Trace), false))},
+		localHandler{desc: "Expvar", path: "/debug/vars", handler: logHandler(p.diagnosticsHandler(be, expvar.Handler(), false))},
+	)
+}
+
+// diagnosticsEnabled returns whether the diagnostics handlers of be are
+// enabled.
+func (p *Proxy) diagnosticsEnabled(be *Backend) bool {
+	if v := p.diagnostics.Load(); v != nil {
+		return *v
+	}
+	return be.Diagnostics != nil && be.Diagnostics.Enabled
+}
+
+// diagnosticsAllowed returns whether the user of req is allowed to use the
+// diagnostics handlers of be.
+func (p *Proxy) diagnosticsAllowed(be *Backend, req *http.Request) bool {
+	if be.Diagnostics == nil {
+		return false
+	}
+	if be.Diagnostics.ACL == nil {
+		return true
+	}
+	claims := claimsFromCtx(req.Context())
+	return claims != nil && idp.MatchACL(*be.Diagnostics.ACL, claims)
+}
+
+func (p *Proxy) diagnosticsHandler(be *Backend, next http.Handler, isToggle bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !p.diagnosticsAllowed(be, req) {
+			p.recordEvent("diagnostics access denied")
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if !isToggle && !p.diagnosticsEnabled(be) {
+			http.NotFound(w, req)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (p *Proxy) diagnosticsToggleHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || req.Header.Get("x-csrf-check") != "1" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	req.ParseForm()
+	enabled, err := strconv.ParseBool(req.PostForm.Get("enabled"))
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	p.diagnostics.Store(&enabled)
+	var admin string
+	if claims := claimsFromCtx(req.Context()); claims != nil {
+		admin, _ = claims["email"].(string)
+	}
+	if enabled {
+		p.recordEvent("diagnostics enabled")
+		p.logErrorF("INF Diagnostics enabled by %q", admin)
+	} else {
+		p.recordEvent("diagnostics disabled")
+		p.logErrorF("INF Diagnostics disabled by %q", admin)
+	}
+	w.Write([]byte("ok\n"))
+}
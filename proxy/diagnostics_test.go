@@ -0,0 +1,93 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestDiagnosticsHandler(t *testing.T) {
+	p := &Proxy{}
+	be := &Backend{
+		Diagnostics: &Diagnostics{
+			ACL: &[]string{"admin@example.com"},
+		},
+		recordEvent: func(string) {},
+	}
+	h := p.diagnosticsHandler(be, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("profile"))
+	}), false)
+	toggle := p.diagnosticsHandler(be, http.HandlerFunc(p.diagnosticsToggleHandler), true)
+
+	get := func(email string) int {
+		req := httptest.NewRequest("GET", "/debug/pprof/profile", nil)
+		if email != "" {
+			req = req.WithContext(context.WithValue(req.Context(), authCtxKey, jwt.MapClaims{"email": email}))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	setEnabled := func(email, enabled string) int {
+		req := httptest.NewRequest("POST", "/debug/diagnostics", strings.NewReader(url.Values{"enabled": {enabled}}.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.Header.Set("x-csrf-check", "1")
+		req = req.WithContext(context.WithValue(req.Context(), authCtxKey, jwt.MapClaims{"email": email}))
+		w := httptest.NewRecorder()
+		toggle.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if got, want := get("admin@example.com"), http.StatusNotFound; got != want {
+		t.Errorf("Disabled: got %d, want %d", got, want)
+	}
+	if got, want := setEnabled("bob@example.com", "true"), http.StatusForbidden; got != want {
+		t.Errorf("Toggle by bob: got %d, want %d", got, want)
+	}
+	if got, want := setEnabled("admin@example.com", "true"), http.StatusOK; got != want {
+		t.Errorf("Toggle by admin: got %d, want %d", got, want)
+	}
+	if got, want := get("admin@example.com"), http.StatusOK; got != want {
+		t.Errorf("Enabled: got %d, want %d", got, want)
+	}
+	if got, want := get("bob@example.com"), http.StatusForbidden; got != want {
+		t.Errorf("Enabled, bob: got %d, want %d", got, want)
+	}
+	if got, want := get(""), http.StatusForbidden; got != want {
+		t.Errorf("Enabled, no user: got %d, want %d", got, want)
+	}
+	if got, want := setEnabled("admin@example.com", "false"), http.StatusOK; got != want {
+		t.Errorf("Toggle by admin: got %d, want %d", got, want)
+	}
+	if got, want := get("admin@example.com"), http.StatusNotFound; got != want {
+		t.Errorf("Disabled again: got %d, want %d", got, want)
+	}
+}
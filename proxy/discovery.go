@@ -0,0 +1,79 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+)
+
+// startDiscovery starts watching the backend's service discovery source, if
+// any.
+func (be *Backend) startDiscovery() {
+	var run func(context.Context)
+	switch {
+	case be.Kubernetes != nil:
+		w := &k8sWatcher{
+			be:  be,
+			cfg: *be.Kubernetes,
+		}
+		run = w.run
+	case be.Consul != nil:
+		w := &consulWatcher{
+			be:  be,
+			cfg: *be.Consul,
+		}
+		run = w.run
+	default:
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	be.stopDiscovery = cancel
+	go run(ctx)
+}
+
+// usesDiscovery returns true if the backend's addresses are discovered
+// dynamically.
+func (be *Backend) usesDiscovery() bool {
+	return be.Kubernetes != nil || be.Consul != nil
+}
+
+// addresses returns the backend's addresses, either from the config,
+// discovered dynamically, or the agents connected with reverse tunnels.
+func (be *Backend) addresses() []string {
+	if be.ReverseTunnel != nil {
+		return be.tunnelState.addresses(be.maintenanceID())
+	}
+	if !be.usesDiscovery() {
+		return be.Addresses
+	}
+	be.state.mu.Lock()
+	defer be.state.mu.Unlock()
+	return be.state.discovered
+}
+
+func (be *Backend) setDiscoveredAddresses(addrs []string) {
+	be.state.mu.Lock()
+	defer be.state.mu.Unlock()
+	be.state.discovered = addrs
+}
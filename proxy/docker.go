@@ -0,0 +1,337 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dockerRetryDelay = 5 * time.Second
+
+// dockerContainer is a running container that has the labels of a backend.
+type dockerContainer struct {
+	name        string
+	serverNames []string
+	mode        string
+	address     string
+}
+
+// dockerContainerJSON contains the fields that we need from the Docker API's
+// container list.
+type dockerContainerJSON struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string `json:"IPAddress"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+	Ports []struct {
+		PrivatePort int    `json:"PrivatePort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+}
+
+// appendDockerBackends appends the backends of the Docker containers to
+// cfg, skipping the containers whose server names are already used.
+// p.dynMu must be held.
+func (p *Proxy) appendDockerBackends(cfg *Config) {
+	used := make(map[string]bool)
+	for _, be := range cfg.Backends {
+		for _, sn := range be.ServerNames {
+			used[strings.ToLower(sn)] = true
+		}
+	}
+	for _, c := range p.dockerContainers {
+		if slices.ContainsFunc(c.serverNames, func(sn string) bool { return used[strings.ToLower(sn)] }) {
+			continue
+		}
+		for _, sn := range c.serverNames {
+			used[strings.ToLower(sn)] = true
+		}
+		cfg.Backends = append(cfg.Backends, &Backend{
+			ServerNames: slices.Clone(c.serverNames),
+			Mode:        c.mode,
+			Addresses:   []string{c.address},
+		})
+	}
+}
+
+// updateDockerWatcher starts or stops watching the Docker daemon when the
+// config changes.
+func (p *Proxy) updateDockerWatcher(cfg *ConfigDocker) {
+	p.dynMu.Lock()
+	defer p.dynMu.Unlock()
+	if cfg != nil && p.dockerCfg != nil && *cfg == *p.dockerCfg {
+		return
+	}
+	if p.dockerCancel != nil {
+		p.dockerCancel()
+		p.dockerCancel = nil
+	}
+	p.dockerCfg = nil
+	p.dockerContainers = nil
+	p.dockerListed = false
+	if cfg == nil {
+		return
+	}
+	dc := *cfg
+	p.dockerCfg = &dc
+	ctx, cancel := context.WithCancel(context.Background())
+	p.dockerCancel = cancel
+	go p.watchDocker(ctx, dc)
+}
+
+func (p *Proxy) watchDocker(ctx context.Context, cfg ConfigDocker) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", cfg.Socket)
+			},
+		},
+	}
+	for {
+		err := p.watchDockerEvents(ctx, client, cfg)
+		if ctx.Err() != nil {
+			return
+		}
+		p.logErrorF("ERR docker %s: %v", cfg.Socket, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dockerRetryDelay):
+		}
+	}
+}
+
+// watchDockerEvents lists the containers again every time a container
+// starts or stops, until the event stream ends.
+func (p *Proxy) watchDockerEvents(ctx context.Context, client *http.Client, cfg ConfigDocker) error {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": {"start", "die"},
+	})
+	resp, err := dockerGet(ctx, client, "/events?filters="+url.QueryEscape(string(filters)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	events := make(chan error)
+	go func() {
+		defer close(events)
+		dec := json.NewDecoder(bufio.NewReader(resp.Body))
+		for {
+			var ev json.RawMessage
+			if err := dec.Decode(&ev); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				events <- err
+				return
+			}
+			select {
+			case events <- nil:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for {
+		containers, err := p.listDockerContainers(ctx, client, cfg)
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p.setDockerContainers(containers)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-events:
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func dockerGet(ctx context.Context, client *http.Client, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: status code %d", path, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+func (p *Proxy) listDockerContainers(ctx context.Context, client *http.Client, cfg ConfigDocker) ([]dockerContainer, error) {
+	filters, _ := json.Marshal(map[string][]string{
+		"label":  {cfg.LabelPrefix + ".serverNames"},
+		"status": {"running"},
+	})
+	resp, err := dockerGet(ctx, client, "/containers/json?filters="+url.QueryEscape(string(filters)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list []dockerContainerJSON
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	var out []dockerContainer
+	for _, c := range list {
+		dc, err := c.container(cfg)
+		if err != nil {
+			p.logErrorF("ERR docker container %s: %v", c.name(), err)
+			continue
+		}
+		out = append(out, dc)
+	}
+	slices.SortFunc(out, func(a, b dockerContainer) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return out, nil
+}
+
+func (c dockerContainerJSON) name() string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	if len(c.ID) > 12 {
+		return c.ID[:12]
+	}
+	return c.ID
+}
+
+// container returns the backend parameters from the container's labels.
+func (c dockerContainerJSON) container(cfg ConfigDocker) (dockerContainer, error) {
+	dc := dockerContainer{
+		name: c.name(),
+		mode: ModeHTTP,
+	}
+	for _, sn := range strings.Split(c.Labels[cfg.LabelPrefix+".serverNames"], ",") {
+		if sn = strings.TrimSpace(sn); sn != "" {
+			dc.serverNames = append(dc.serverNames, sn)
+		}
+	}
+	if len(dc.serverNames) == 0 {
+		return dc, fmt.Errorf("%s.serverNames: no server names", cfg.LabelPrefix)
+	}
+	if m := c.Labels[cfg.LabelPrefix+".mode"]; m != "" {
+		dc.mode = strings.ToUpper(m)
+	}
+	if !slices.Contains([]string{ModeTCP, ModeTLS, ModeHTTP, ModeHTTPS}, dc.mode) {
+		return dc, fmt.Errorf("%s.mode: invalid mode %q", cfg.LabelPrefix, dc.mode)
+	}
+
+	port := c.Labels[cfg.LabelPrefix+".port"]
+	if port == "" {
+		var ports []int
+		for _, p := range c.Ports {
+			if p.Type == "tcp" && !slices.Contains(ports, p.PrivatePort) {
+				ports = append(ports, p.PrivatePort)
+			}
+		}
+		if len(ports) != 1 {
+			return dc, fmt.Errorf("%s.port: must be set when the container doesn't expose exactly one port", cfg.LabelPrefix)
+		}
+		port = strconv.Itoa(ports[0])
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return dc, fmt.Errorf("%s.port: invalid port %q", cfg.LabelPrefix, port)
+	}
+
+	networks := make([]string, 0, len(c.NetworkSettings.Networks))
+	for n := range c.NetworkSettings.Networks {
+		networks = append(networks, n)
+	}
+	slices.Sort(networks)
+	if cfg.Network != "" {
+		networks = []string{cfg.Network}
+	}
+	for _, n := range networks {
+		nw, ok := c.NetworkSettings.Networks[n]
+		if !ok {
+			continue
+		}
+		ip := nw.IPAddress
+		if ip == "" {
+			ip = nw.GlobalIPv6Address
+		}
+		if ip == "" {
+			continue
+		}
+		dc.address = net.JoinHostPort(ip, port)
+		return dc, nil
+	}
+	return dc, fmt.Errorf("no IP address")
+}
+
+// setDockerContainers updates the list of containers and reconfigures the
+// proxy when it changes.
+func (p *Proxy) setDockerContainers(containers []dockerContainer) {
+	p.dynMu.Lock()
+	if p.dockerListed && slices.EqualFunc(containers, p.dockerContainers, func(a, b dockerContainer) bool {
+		return a.name == b.name && a.mode == b.mode && a.address == b.address && slices.Equal(a.serverNames, b.serverNames)
+	}) {
+		p.dynMu.Unlock()
+		return
+	}
+	p.dockerContainers = containers
+	p.dockerListed = true
+	cfg := p.userCfg
+	p.dynMu.Unlock()
+
+	for _, c := range containers {
+		p.logErrorF("INF docker container %s: %s ➔ %s %s", c.name, strings.Join(c.serverNames, ","), c.mode, c.address)
+	}
+	if cfg == nil {
+		return
+	}
+	if err := p.Reconfigure(cfg); err != nil {
+		p.logErrorF("ERR docker: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestDockerBackends(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+	be2 := newTCPServer(t, ctx, "backend2", nil)
+	_, port1, _ := net.SplitHostPort(be1.listener.Addr().String())
+	_, port2, _ := net.SplitHostPort(be2.listener.Addr().String())
+
+	var mu sync.Mutex
+	containers := fmt.Sprintf(`[
+		{"Id":"1111","Names":["/app"],"Labels":{"tlsproxy.serverNames":"app.example.com","tlsproxy.mode":"tcp","tlsproxy.port":%q},
+		 "NetworkSettings":{"Networks":{"bridge":{"IPAddress":"127.0.0.1"}}}},
+		{"Id":"2222","Names":["/conflict"],"Labels":{"tlsproxy.serverNames":"example.com","tlsproxy.mode":"tcp"},
+		 "NetworkSettings":{"Networks":{"bridge":{"IPAddress":"127.0.0.1"}}},"Ports":[{"PrivatePort":%s,"Type":"tcp"}]},
+		{"Id":"3333","Names":["/bad"],"Labels":{"tlsproxy.serverNames":"bad.example.com","tlsproxy.mode":"console","tlsproxy.port":"80"},
+		 "NetworkSettings":{"Networks":{"bridge":{"IPAddress":"127.0.0.1"}}}}
+	]`, port1, port2)
+	events := make(chan string)
+
+	sock := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	docker := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/containers/json":
+				mu.Lock()
+				defer mu.Unlock()
+				fmt.Fprint(w, containers)
+			case "/events":
+				w.(http.Flusher).Flush()
+				for {
+					select {
+					case <-req.Context().Done():
+						return
+					case ev := <-events:
+						fmt.Fprintln(w, ev)
+						w.(http.Flusher).Flush()
+					}
+				}
+			default:
+				http.NotFound(w, req)
+			}
+		}),
+	}
+	go docker.Serve(l)
+	defer docker.Close()
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Docker: &ConfigDocker{
+			Socket: sock,
+		},
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Mode:        "TCP",
+				Addresses:   []string{be2.listener.Addr().String()},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	waitFor := func(want string) {
+		t.Helper()
+		for i := 0; ; i++ {
+			got, _, _ := tlsGet("app.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil)
+			if got == want {
+				return
+			}
+			if i == 100 {
+				t.Fatalf("tlsGet() = %q, want %q", got, want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	waitFor("Hello from backend1\n")
+
+	got, _, err := tlsGet("example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil)
+	if err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	if want := "Hello from backend2\n"; got != want {
+		t.Errorf("tlsGet() = %q, want %q", got, want)
+	}
+	if got := len(proxy.cfg.Backends); got != 2 {
+		t.Errorf("len(Backends) = %d, want 2", got)
+	}
+
+	mu.Lock()
+	containers = "[]"
+	mu.Unlock()
+	events <- `{"Type":"container","Action":"die","Actor":{"ID":"1111"}}`
+	waitFor("")
+
+	// The user's config is used again when the config file is reloaded.
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	if got := len(proxy.cfg.Backends); got != 1 {
+		t.Errorf("len(Backends) = %d, want 1", got)
+	}
+}
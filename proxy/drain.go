@@ -0,0 +1,155 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// drainSet is the set of backend addresses that are draining. New
+// connections are not sent to draining addresses, but existing connections
+// are allowed to finish. The set is not affected by configuration changes.
+type drainSet struct {
+	mu    sync.Mutex
+	addrs map[string]bool
+}
+
+// set adds or removes an address from the set. It returns true if the set
+// changed.
+func (d *drainSet) set(addr string, drain bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.addrs[addr] == drain {
+		return false
+	}
+	if !drain {
+		delete(d.addrs, addr)
+		return true
+	}
+	if d.addrs == nil {
+		d.addrs = make(map[string]bool)
+	}
+	d.addrs[addr] = true
+	return true
+}
+
+func (d *drainSet) isDraining(addr string) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.addrs[addr]
+}
+
+// filter returns the addresses that are not draining.
+func (d *drainSet) filter(addrs []string) []string {
+	if d == nil {
+		return addrs
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.addrs) == 0 {
+		return addrs
+	}
+	return slices.DeleteFunc(slices.Clone(addrs), func(a string) bool {
+		return d.addrs[a]
+	})
+}
+
+func (d *drainSet) list() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]string, 0, len(d.addrs))
+	for a := range d.addrs {
+		out = append(out, a)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// isBackendAddress returns true if addr is one of the addresses of a backend
+// path override, or canary route in the current config.
+func (p *Proxy) isBackendAddress(addr string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.cfg == nil {
+		return false
+	}
+	for _, be := range p.cfg.Backends {
+		if slices.Contains(be.addresses(), addr) {
+			return true
+		}
+		for _, po := range be.PathOverrides {
+			if slices.Contains(po.Addresses, addr) {
+				return true
+			}
+		}
+		for _, c := range be.Canary {
+			if slices.Contains(c.Addresses, addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *Proxy) drainBackendHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || req.Header.Get("x-csrf-check") != "1" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	req.ParseForm()
+	addr := req.PostForm.Get("address")
+	drain, err := strconv.ParseBool(req.PostForm.Get("drain"))
+	if addr == "" || err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	// Addresses that are no longer in the config can always be removed
+	// from the set.
+	if drain && !p.isBackendAddress(addr) {
+		http.Error(w, "unknown backend address", http.StatusBadRequest)
+		return
+	}
+	if !p.draining.set(addr, drain) {
+		w.Write([]byte("ok\n"))
+		return
+	}
+	var admin string
+	if claims := claimsFromCtx(req.Context()); claims != nil {
+		admin, _ = claims["email"].(string)
+	}
+	if drain {
+		p.recordEvent("backend drain started")
+		p.logErrorF("INF Backend address %s drained by %q", addr, admin)
+	} else {
+		p.recordEvent("backend drain stopped")
+		p.logErrorF("INF Backend address %s undrained by %q", addr, admin)
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,128 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainBackend(t *testing.T) {
+	var addrs []string
+	for range 2 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		defer l.Close()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				c.Close()
+			}
+		}()
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	p := &Proxy{}
+	be := &Backend{
+		Mode:           ModeTCP,
+		Addresses:      addrs,
+		ForwardTimeout: time.Second,
+		getClientCert: func(context.Context) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return nil
+		},
+		recordEvent: func(string) {},
+		outConns:    newConnTracker(),
+		draining:    &p.draining,
+		state:       &backendState{},
+	}
+	p.cfg = &Config{Backends: []*Backend{be}}
+
+	setDrain := func(addr, drain string) int {
+		req := httptest.NewRequest("POST", "/drain-backend", strings.NewReader(url.Values{"address": {addr}, "drain": {drain}}.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.Header.Set("x-csrf-check", "1")
+		w := httptest.NewRecorder()
+		p.drainBackendHandler(w, req)
+		return w.Code
+	}
+	dialed := func() map[string]int {
+		out := make(map[string]int)
+		for range 4 {
+			c, err := be.dial(context.Background())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			out[c.RemoteAddr().String()]++
+			c.Close()
+		}
+		return out
+	}
+
+	if got, want := setDrain("127.0.0.1:1", "true"), http.StatusBadRequest; got != want {
+		t.Errorf("Unknown address: got %d, want %d", got, want)
+	}
+	if got, want := setDrain(addrs[0], "true"), http.StatusOK; got != want {
+		t.Errorf("Drain: got %d, want %d", got, want)
+	}
+	if got := p.draining.list(); len(got) != 1 || got[0] != addrs[0] {
+		t.Errorf("draining = %v, want [%s]", got, addrs[0])
+	}
+	if got := dialed(); got[addrs[0]] != 0 || got[addrs[1]] != 4 {
+		t.Errorf("dialed = %v, want all on %s", got, addrs[1])
+	}
+
+	if got, want := setDrain(addrs[1], "true"), http.StatusOK; got != want {
+		t.Errorf("Drain: got %d, want %d", got, want)
+	}
+	if _, err := be.dial(context.Background()); err == nil {
+		t.Error("dial succeeded with all addresses draining")
+	}
+
+	if got, want := setDrain(addrs[0], "false"), http.StatusOK; got != want {
+		t.Errorf("Undrain: got %d, want %d", got, want)
+	}
+	if got, want := setDrain(addrs[1], "false"), http.StatusOK; got != want {
+		t.Errorf("Undrain: got %d, want %d", got, want)
+	}
+	if got := dialed(); got[addrs[0]] != 2 || got[addrs[1]] != 2 {
+		t.Errorf("dialed = %v, want 2 on each", got)
+	}
+	p.eventsmu.Lock()
+	defer p.eventsmu.Unlock()
+	if got, want := p.events["backend drain started"], int64(2); got != want {
+		t.Errorf("drain started events = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,193 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// addDynamicBackends returns a copy of cfg with the remote backends, the
+// backends registered with the backend API, and the backends of the Docker
+// containers.
+func (p *Proxy) addDynamicBackends(cfg *Config) *Config {
+	p.dynMu.Lock()
+	defer p.dynMu.Unlock()
+	p.userCfg = cfg
+	p.loadAPIBackends(cfg.BackendAPI)
+	remote := cfg.RemoteBackends != "" && len(p.remoteBackends) > 0
+	api := len(p.apiBackends) > 0
+	docker := cfg.Docker != nil && len(p.dockerContainers) > 0
+	if !remote && !api && !docker {
+		return cfg
+	}
+	out := cfg.clone()
+	if remote {
+		if err := p.appendRemoteBackends(out); err != nil {
+			p.logErrorF("ERR remoteBackends: %v", err)
+		}
+	}
+	if api {
+		for name, err := range appendAPIBackends(out, p.apiBackends) {
+			p.logErrorF("ERR backendApi: %s: %v", name, err)
+		}
+	}
+	if docker {
+		p.appendDockerBackends(out)
+	}
+	if err := out.Check(); err != nil {
+		p.logErrorF("ERR dynamic backends: %v", err)
+		return cfg
+	}
+	return out
+}
+
+// appendRemoteBackends appends the remote backends to cfg if they are valid.
+// p.dynMu must be held.
+func (p *Proxy) appendRemoteBackends(cfg *Config) error {
+	backends, err := checkBackends(cfg, p.remoteBackends)
+	if err != nil {
+		return err
+	}
+	cfg.Backends = append(cfg.Backends, backends...)
+	return nil
+}
+
+// appendAPIBackends appends the backends registered with the backend API to
+// cfg, in name order. A backend that isn't valid with cfg and the backends
+// before it is skipped, and its error is returned.
+func appendAPIBackends(cfg *Config, m map[string]*Backend) map[string]error {
+	names := slices.Sorted(maps.Keys(m))
+	errs := make(map[string]error)
+	for _, name := range names {
+		b, err := yaml.Marshal([]*Backend{m[name]})
+		if err == nil {
+			var backends []*Backend
+			if backends, err = checkBackends(cfg, b); err == nil {
+				cfg.Backends = append(cfg.Backends, backends...)
+			}
+		}
+		if err != nil {
+			errs[name] = err
+		}
+	}
+	return errs
+}
+
+// parseBackends decodes a YAML list of backends.
+func parseBackends(data []byte) ([]*Backend, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var backends []*Backend
+	if err := dec.Decode(&backends); err != nil {
+		return nil, err
+	}
+	return backends, nil
+}
+
+// checkBackends decodes a YAML list of backends, and checks that they are
+// valid with cfg.
+func checkBackends(cfg *Config, data []byte) ([]*Backend, error) {
+	backends, err := parseBackends(data)
+	if err != nil {
+		return nil, err
+	}
+	test := cfg.clone()
+	test.Backends = append(test.Backends, backends...)
+	if err := test.Check(); err != nil {
+		return nil, err
+	}
+	// Check modifies the backends. Return fresh ones.
+	return parseBackends(data)
+}
+
+// updateRemoteBackendsWatcher starts or stops watching the remote backends
+// when the config changes.
+func (p *Proxy) updateRemoteBackendsWatcher(rawURL string) {
+	p.dynMu.Lock()
+	defer p.dynMu.Unlock()
+	if rawURL == p.remoteURL {
+		return
+	}
+	if p.remoteCancel != nil {
+		p.remoteCancel()
+		p.remoteCancel = nil
+	}
+	p.remoteURL = rawURL
+	p.remoteBackends = nil
+	p.remoteListed = false
+	if rawURL == "" {
+		return
+	}
+	kv, err := newRemoteKV(rawURL)
+	if err != nil {
+		p.logErrorF("ERR remoteBackends: %v", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.remoteCancel = cancel
+	go kv.watch(ctx, func(v []byte) {
+		p.setRemoteBackends(ctx, v)
+	})
+}
+
+// setRemoteBackends updates the remote backends and reconfigures the proxy
+// when they change.
+func (p *Proxy) setRemoteBackends(ctx context.Context, v []byte) {
+	p.dynMu.Lock()
+	if ctx.Err() != nil || (p.remoteListed && bytes.Equal(v, p.remoteBackends)) {
+		p.dynMu.Unlock()
+		return
+	}
+	p.remoteBackends = v
+	p.remoteListed = true
+	cfg := p.userCfg
+	p.dynMu.Unlock()
+
+	p.logErrorF("INF remoteBackends changed")
+	if cfg == nil {
+		return
+	}
+	if err := p.Reconfigure(cfg); err != nil {
+		p.logErrorF("ERR remoteBackends: %v", err)
+	}
+}
+
+// stopWatchers stops watching Docker and the remote backends.
+func (p *Proxy) stopWatchers() {
+	p.dynMu.Lock()
+	defer p.dynMu.Unlock()
+	if p.dockerCancel != nil {
+		p.dockerCancel()
+		p.dockerCancel = nil
+	}
+	if p.remoteCancel != nil {
+		p.remoteCancel()
+		p.remoteCancel = nil
+	}
+}
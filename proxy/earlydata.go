@@ -0,0 +1,79 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const earlyDataHeader = "Early-Data"
+
+// handshakeComplete returns true if the connection's TLS handshake is
+// complete. Only QUIC connections can be used before the handshake completes.
+func handshakeComplete(conn any) bool {
+	c, ok := conn.(interface{ HandshakeComplete() <-chan struct{} })
+	if !ok {
+		return true
+	}
+	select {
+	case <-c.HandshakeComplete():
+		return true
+	default:
+		return false
+	}
+}
+
+// allowsEarlyData returns true if the request can be served from early data.
+func (ed *EarlyData) allowsEarlyData(req *http.Request) bool {
+	if ed == nil || !slices.Contains(ed.Methods, req.Method) {
+		return false
+	}
+	if len(ed.Paths) == 0 {
+		return true
+	}
+	cleanPath := pathClean(req.URL.Path)
+	return slices.ContainsFunc(ed.Paths, func(prefix string) bool {
+		return strings.HasPrefix(cleanPath, prefix)
+	})
+}
+
+// checkEarlyData rejects the requests that arrive in early data, unless the
+// backend's EarlyData policy allows them. The allowed requests are forwarded
+// with the Early-Data header, as specified in RFC 8470. It returns false if
+// the request was rejected.
+func (be *Backend) checkEarlyData(w http.ResponseWriter, req *http.Request) bool {
+	if handshakeComplete(req.Context().Value(connCtxKey)) {
+		return true
+	}
+	if !be.EarlyData.allowsEarlyData(req) {
+		be.recordEvent("too early")
+		be.logHTTPRequest("REQ", req, req.URL.String(), http.StatusTooEarly, " (early data)")
+		http.Error(w, "Too Early", http.StatusTooEarly)
+		return false
+	}
+	req.Header.Set(earlyDataHeader, "1")
+	return true
+}
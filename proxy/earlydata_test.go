@@ -0,0 +1,93 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type earlyConn struct {
+	mockConn
+	done chan struct{}
+}
+
+func (c earlyConn) HandshakeComplete() <-chan struct{} {
+	return c.done
+}
+
+func TestCheckEarlyData(t *testing.T) {
+	be := &Backend{
+		EarlyData: &EarlyData{
+			Methods: []string{http.MethodGet},
+			Paths:   []string{"/static/"},
+		},
+		recordEvent: func(string) {},
+	}
+	mc := mockConn{
+		localAddr:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443},
+		remoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5000},
+	}
+	early := earlyConn{mockConn: mc, done: make(chan struct{})}
+	complete := earlyConn{mockConn: mc, done: make(chan struct{})}
+	close(complete.done)
+
+	for _, tc := range []struct {
+		name       string
+		conn       any
+		method     string
+		path       string
+		wantOK     bool
+		wantHeader string
+	}{
+		{name: "handshake complete", conn: complete, method: "POST", path: "/foo", wantOK: true},
+		{name: "not quic", conn: mc, method: "POST", path: "/foo", wantOK: true},
+		{name: "allowed", conn: early, method: "GET", path: "/static/x.js", wantOK: true, wantHeader: "1"},
+		{name: "wrong method", conn: early, method: "POST", path: "/static/x.js"},
+		{name: "wrong path", conn: early, method: "GET", path: "/api/foo"},
+		{name: "unclean path", conn: early, method: "GET", path: "/static/../api/foo"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), connCtxKey, tc.conn)
+			req := httptest.NewRequest(tc.method, "https://example.com/", nil).WithContext(ctx)
+			req.URL.Path = tc.path
+			w := httptest.NewRecorder()
+			if got, want := be.checkEarlyData(w, req), tc.wantOK; got != want {
+				t.Fatalf("checkEarlyData() = %v, want %v", got, want)
+			}
+			if !tc.wantOK {
+				if got, want := w.Code, http.StatusTooEarly; got != want {
+					t.Errorf("Code = %d, want %d", got, want)
+				}
+				return
+			}
+			if got, want := req.Header.Get(earlyDataHeader), tc.wantHeader; got != want {
+				t.Errorf("Early-Data = %q, want %q", got, want)
+			}
+		})
+	}
+}
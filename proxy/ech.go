@@ -36,7 +36,6 @@ import (
 	"time"
 
 	"github.com/c2FmZQ/ech"
-	"github.com/hashicorp/go-retryablehttp"
 
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/cloudflare"
 )
@@ -133,33 +132,7 @@ func (p *Proxy) rotateECH(forceCheck bool) (retErr error) {
 		if p.quicListener != nil {
 			p.startQUICListener(p.ctx)
 		}
-		ctx := p.ctx
-		webhooks := p.cfg.ECH.WebHooks
-		go func() {
-			if ctx == nil {
-				ctx = context.Background()
-			}
-			ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
-			defer cancel()
-			client := retryablehttp.NewClient()
-			client.Logger = nil
-			for _, wh := range webhooks {
-				req, err := retryablehttp.NewRequestWithContext(ctx, "POST", wh, nil)
-				if err != nil {
-					p.logErrorF("ERR ECH WebHook %q: %v", wh, err)
-					continue
-				}
-				resp, err := client.Do(req)
-				if err != nil {
-					p.logErrorF("ERR ECH WebHook %q: %v", wh, err)
-					continue
-				}
-				resp.Body.Close()
-				if resp.StatusCode != 200 {
-					p.logErrorF("ERR ECH WebHook %q: status code %d", wh, resp.StatusCode)
-				}
-			}
-		}()
+		go p.callWebHooks(p.ctx, "ECH", p.cfg.ECH.WebHooks, nil)
 	}
 	return nil
 }
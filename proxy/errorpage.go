@@ -0,0 +1,107 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// parseErrorPageTemplate reads and parses the HTML template in file.
+func parseErrorPageTemplate(file string) (*template.Template, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("error-page").Parse(string(b))
+}
+
+// errorStatusCode returns the HTTP status code to use when a request couldn't
+// be forwarded to the backend because of err.
+func errorStatusCode(err error) int {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errNoBackendAddresses) || errors.Is(err, errAllAddressesDraining):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func newRandomID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// serveErrorPage is the ErrorHandler of the reverse proxy when
+// ErrorPageTemplate is set.
+func (be *Backend) serveErrorPage(w http.ResponseWriter, req *http.Request, err error) {
+	code := errorStatusCode(err)
+	if errors.Is(err, context.Canceled) {
+		// The client went away.
+		w.WriteHeader(code)
+		return
+	}
+	id := newRandomID()
+	be.logErrorF("ERR %s ➔ %s %s: %v (request ID %s)", formatReqDesc(req), req.Method, req.URL.Path, err, id)
+
+	var serverName string
+	if conn, ok := req.Context().Value(connCtxKey).(anyConn); ok {
+		serverName = idnaToUnicode(connServerName(conn))
+	}
+	data := struct {
+		StatusCode int
+		Status     string
+		RequestID  string
+		ServerName string
+		Time       string
+	}{
+		StatusCode: code,
+		Status:     http.StatusText(code),
+		RequestID:  id,
+		ServerName: serverName,
+		Time:       time.Now().UTC().Format(time.RFC1123),
+	}
+	var buf bytes.Buffer
+	if err := be.errorPageTemplate.Execute(&buf, data); err != nil {
+		be.logErrorF("ERR error-page-template: %v", err)
+		w.WriteHeader(code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,102 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestErrorPageTemplate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	// An address where nothing is listening.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	deadAddr := l.Addr().String()
+	l.Close()
+
+	tmpl := filepath.Join(t.TempDir(), "error.html")
+	if err := os.WriteFile(tmpl, []byte("{{.StatusCode}} {{.Status}} {{.ServerName}} id={{.RequestID}}"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{
+						"www.example.com",
+					},
+					Addresses: []string{
+						deadAddr,
+					},
+					Mode:              "HTTP",
+					ErrorPageTemplate: tmpl,
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+
+	get := func() string {
+		got, _, err := httpGet("www.example.com", proxy.listener.Addr().String(), "/", extCA, nil)
+		if err != nil {
+			t.Fatalf("httpGet: %v", err)
+		}
+		return got
+	}
+
+	want := regexp.MustCompile(`^HTTP/2.0 502 Bad Gateway\n502 Bad Gateway www.example.com id=[0-9a-f]{16}$`)
+	if got := get(); !want.MatchString(got) {
+		t.Errorf("Got %q, want match for %q", got, want)
+	}
+
+	proxy.draining.set(deadAddr, true)
+	want = regexp.MustCompile(`^HTTP/2.0 503 Service Unavailable\n503 Service Unavailable www.example.com id=[0-9a-f]{16}$`)
+	if got := get(); !want.MatchString(got) {
+		t.Errorf("Got %q, want match for %q", got, want)
+	}
+}
@@ -0,0 +1,342 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventLogFile           = "events.log"
+	defaultEventLogMaxSize = 10 << 20
+	defaultEventQueryLimit = 1000
+)
+
+// loggedEvent is an event saved in the event log.
+type loggedEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Backend string    `json:"backend,omitempty"`
+	Message string    `json:"message"`
+}
+
+// eventFilter selects events from the event log.
+type eventFilter struct {
+	backend string
+	typ     string
+	since   time.Time
+	until   time.Time
+	limit   int
+}
+
+func (f eventFilter) match(e loggedEvent) bool {
+	if f.backend != "" && e.Backend != f.backend {
+		return false
+	}
+	if f.typ != "" && e.Type != f.typ {
+		return false
+	}
+	if !f.since.IsZero() && e.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !e.Time.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+// eventLog is a persistent log of the proxy's events, or of other records.
+// The records are appended to a JSON-lines file. When the file reaches half of the maximum
+// size, it is renamed with a .1 suffix, replacing the previous one, and a new
+// file is started.
+type eventLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+func openEventLog(path string, maxSize int64) (*eventLog, error) {
+	if maxSize <= 0 {
+		maxSize = defaultEventLogMaxSize
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &eventLog{
+		path:    path,
+		maxSize: maxSize,
+		f:       f,
+		size:    fi.Size(),
+	}, nil
+}
+
+func (l *eventLog) add(e any) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return fs.ErrClosed
+	}
+	if l.size > 0 && l.size+int64(len(b)) > l.maxSize/2 {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+// rotate must be called with l.mu locked.
+func (l *eventLog) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	l.f = f
+	l.size = 0
+	return nil
+}
+
+// query returns the most recent events that match filter, in chronological
+// order.
+func (l *eventLog) query(filter eventFilter) ([]loggedEvent, error) {
+	if filter.limit <= 0 {
+		filter.limit = defaultEventQueryLimit
+	}
+	var out []loggedEvent
+	err := l.scan(func(line []byte) {
+		var e loggedEvent
+		if err := json.Unmarshal(line, &e); err != nil {
+			return
+		}
+		if !filter.match(e) {
+			return
+		}
+		if len(out) == filter.limit {
+			copy(out, out[1:])
+			out = out[:len(out)-1]
+		}
+		out = append(out, e)
+	})
+	return out, err
+}
+
+// scan calls fn with each line of the log, from the oldest to the most
+// recent.
+func (l *eventLog) scan(fn func(line []byte)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, name := range []string{l.path + ".1", l.path} {
+		f, err := os.Open(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fn(scanner.Bytes())
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *eventLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// eventType returns the type of an event, i.e. its message without the
+// variable parts like user IDs, host names, or certificate subjects.
+func eventType(msg string) string {
+	switch {
+	case strings.HasPrefix(msg, "allow SSO "):
+		return "allow SSO"
+	case strings.HasPrefix(msg, "deny SSO "):
+		return "deny SSO"
+	case strings.HasPrefix(msg, "allow X509 "):
+		return "allow X509"
+	case strings.HasPrefix(msg, "deny X509 "):
+		return "deny X509"
+	case strings.HasPrefix(msg, "deny no cert "):
+		return "deny no cert"
+	case strings.HasPrefix(msg, "backend X509 "):
+		return "backend X509"
+	case strings.HasPrefix(msg, "http2 client error: "):
+		return "http2 client error"
+	case strings.HasPrefix(msg, "ocsp staple error "):
+		return "ocsp staple error"
+	case strings.Contains(msg, " CheckIP "):
+		return "CheckIP"
+	}
+	return msg
+}
+
+// updateEventLog opens or closes the event log to match cfg.
+func (p *Proxy) updateEventLog(cfg *ConfigEventLog, cacheDir string) {
+	p.eventsmu.Lock()
+	defer p.eventsmu.Unlock()
+	if cfg == nil {
+		p.updateLog(&p.eventLog, "Event log", "", 0)
+		return
+	}
+	p.updateLog(&p.eventLog, "Event log", filepath.Join(cacheDir, eventLogFile), cfg.MaxSize)
+}
+
+// updateLog opens, closes, or resizes the log in *lp. An empty path closes
+// the log. It must be called with p.eventsmu locked.
+func (p *Proxy) updateLog(lp **eventLog, desc, path string, maxSize int64) {
+	if path == "" {
+		if *lp != nil {
+			(*lp).close()
+			*lp = nil
+		}
+		return
+	}
+	if l := *lp; l != nil && l.path == path {
+		l.mu.Lock()
+		l.maxSize = cmp.Or(maxSize, defaultEventLogMaxSize)
+		l.mu.Unlock()
+		return
+	}
+	if *lp != nil {
+		(*lp).close()
+		*lp = nil
+	}
+	l, err := openEventLog(path, maxSize)
+	if err != nil {
+		p.logErrorF("ERR %s: %v", desc, err)
+		return
+	}
+	*lp = l
+}
+
+func (p *Proxy) eventsHandler(w http.ResponseWriter, req *http.Request) {
+	p.eventsmu.Lock()
+	l := p.eventLog
+	p.eventsmu.Unlock()
+	if l == nil {
+		http.Error(w, "event log is not enabled", http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	q := req.URL.Query()
+	filter := eventFilter{
+		backend: q.Get("backend"),
+		typ:     q.Get("type"),
+	}
+	var err error
+	if filter.since, err = parseEventTime(q.Get("since"), now); err != nil {
+		http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.until, err = parseEventTime(q.Get("until"), now); err != nil {
+		http.Error(w, "invalid until: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.limit, err = strconv.Atoi(v); err != nil || filter.limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	events, err := l.query(filter)
+	if err != nil {
+		p.logErrorF("ERR Event log: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []loggedEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(events)
+}
+
+// parseEventTime parses either an RFC 3339 timestamp, or a duration that is
+// relative to now, e.g. 1h for one hour ago.
+func parseEventTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a duration nor a RFC 3339 time", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,172 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEventLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), eventLogFile)
+	l, err := openEventLog(path, 16384)
+	if err != nil {
+		t.Fatalf("openEventLog: %v", err)
+	}
+	defer l.close()
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 200 {
+		be := "a.example.com"
+		if i%2 == 1 {
+			be = "b.example.com"
+		}
+		msg := "tcp connection"
+		if i%10 == 0 {
+			msg = fmt.Sprintf("deny X509 [CN=%d] to %s", i, be)
+		}
+		if err := l.add(loggedEvent{
+			Time:    start.Add(time.Duration(i) * time.Minute),
+			Type:    eventType(msg),
+			Backend: be,
+			Message: msg,
+		}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	for _, fn := range []string{path, path + ".1"} {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if fi.Size() > 8192 {
+			t.Errorf("%s: size = %d, want <= 8192", fn, fi.Size())
+		}
+	}
+
+	all, err := l.query(eventFilter{})
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if len(all) == 0 || len(all) == 200 {
+		t.Fatalf("query returned %d events, want some old events to be discarded", len(all))
+	}
+	if got, want := all[len(all)-1].Time, start.Add(199*time.Minute); !got.Equal(want) {
+		t.Errorf("last event time = %v, want %v", got, want)
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i].Time.Before(all[i-1].Time) {
+			t.Fatalf("events are not in chronological order: %v", all)
+		}
+	}
+
+	got, err := l.query(eventFilter{
+		backend: "a.example.com",
+		typ:     "deny X509",
+		since:   start.Add(150 * time.Minute),
+		until:   start.Add(190 * time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	var msgs []string
+	for _, e := range got {
+		msgs = append(msgs, e.Message)
+	}
+	want := []string{
+		"deny X509 [CN=150] to a.example.com",
+		"deny X509 [CN=160] to a.example.com",
+		"deny X509 [CN=170] to a.example.com",
+		"deny X509 [CN=180] to a.example.com",
+	}
+	if fmt.Sprint(msgs) != fmt.Sprint(want) {
+		t.Errorf("query = %q, want %q", msgs, want)
+	}
+
+	if got, err = l.query(eventFilter{typ: "tcp connection", limit: 3}); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if len(got) != 3 || !got[2].Time.Equal(start.Add(199*time.Minute)) {
+		t.Errorf("query with limit = %v", got)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	p := &Proxy{}
+	p.updateEventLog(&ConfigEventLog{}, t.TempDir())
+	defer p.updateEventLog(nil, "")
+
+	p.recordEvent("tcp connection")
+	p.recordBackendEvent("www.example.com", "allow SSO bob@example.com to www.example.com")
+	p.recordBackendEvent("www.example.com", "idle timeout")
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		want  []string
+	}{
+		{"", 200, []string{"tcp connection", "allow SSO bob@example.com to www.example.com", "idle timeout"}},
+		{"?backend=www.example.com", 200, []string{"allow SSO bob@example.com to www.example.com", "idle timeout"}},
+		{"?type=allow+SSO", 200, []string{"allow SSO bob@example.com to www.example.com"}},
+		{"?since=1h&limit=1", 200, []string{"idle timeout"}},
+		{"?until=1h", 200, []string{}},
+		{"?since=" + time.Now().Add(time.Hour).Format(time.RFC3339), 200, []string{}},
+		{"?since=yesterday", 400, nil},
+		{"?limit=-1", 400, nil},
+	} {
+		w := httptest.NewRecorder()
+		p.eventsHandler(w, httptest.NewRequest(http.MethodGet, "/events"+tc.query, nil))
+		if w.Code != tc.code {
+			t.Errorf("%q: code = %d, want %d", tc.query, w.Code, tc.code)
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		var events []loggedEvent
+		if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+			t.Fatalf("%q: %v", tc.query, err)
+		}
+		msgs := []string{}
+		for _, e := range events {
+			msgs = append(msgs, e.Message)
+		}
+		if fmt.Sprint(msgs) != fmt.Sprint(tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.query, msgs, tc.want)
+		}
+	}
+
+	p.updateEventLog(nil, "")
+	w := httptest.NewRecorder()
+	p.eventsHandler(w, httptest.NewRequest(http.MethodGet, "/events", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("code = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,181 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const defaultExtAuthzTimeout = 5 * time.Second
+
+// extAuthzRequest is the request sent to the external authorization service.
+type extAuthzRequest struct {
+	Method     string         `json:"method"`
+	URL        string         `json:"url"`
+	Host       string         `json:"host"`
+	Path       string         `json:"path"`
+	RemoteAddr string         `json:"remoteAddr"`
+	Headers    http.Header    `json:"headers"`
+	ClientCert *extAuthzCert  `json:"clientCert,omitempty"`
+	Identity   map[string]any `json:"identity,omitempty"`
+}
+
+type extAuthzCert struct {
+	Subject        string   `json:"subject"`
+	Issuer         string   `json:"issuer"`
+	SerialNumber   string   `json:"serialNumber"`
+	SHA256         string   `json:"sha256"`
+	DNSNames       []string `json:"dnsNames,omitempty"`
+	EmailAddresses []string `json:"emailAddresses,omitempty"`
+}
+
+// extAuthzResponse is the decision of the external authorization service.
+type extAuthzResponse struct {
+	Allow           bool        `json:"allow"`
+	SetHeaders      http.Header `json:"setHeaders,omitempty"`
+	RemoveHeaders   []string    `json:"removeHeaders,omitempty"`
+	Status          int         `json:"status,omitempty"`
+	Body            string      `json:"body,omitempty"`
+	ResponseHeaders http.Header `json:"responseHeaders,omitempty"`
+}
+
+// checkExtAuthz asks the external authorization service whether req is
+// allowed. It returns true if processing of the request should continue.
+func (be *Backend) checkExtAuthz(w http.ResponseWriter, req *http.Request) bool {
+	ea := be.ExtAuthz
+	if ea == nil || !pathMatches(ea.Paths, req.URL.Path) {
+		return true
+	}
+	resp, err := be.callExtAuthz(req.Context(), req)
+	if err != nil {
+		be.recordEvent("ext authz: error")
+		be.logErrorF("ERR [-] %s: ext authz: %v", req.RemoteAddr, err)
+		if ea.FailOpen {
+			return true
+		}
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return false
+	}
+	if !resp.Allow {
+		be.recordEvent(fmt.Sprintf("ext authz: deny %s%s", idnaToUnicode(req.Host), req.URL.Path))
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		for k, v := range resp.ResponseHeaders {
+			w.Header()[http.CanonicalHeaderKey(k)] = v
+		}
+		status := resp.Status
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		be.logHTTPRequest("REQ", req, req.RequestURI, status, " (ext authz)")
+		if resp.Body == "" {
+			http.Error(w, http.StatusText(status), status)
+			return false
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, resp.Body)
+		return false
+	}
+	for _, k := range resp.RemoveHeaders {
+		req.Header.Del(k)
+	}
+	for k, v := range resp.SetHeaders {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	return true
+}
+
+func (be *Backend) callExtAuthz(ctx context.Context, req *http.Request) (*extAuthzResponse, error) {
+	ea := be.ExtAuthz
+	url, _ := ctx.Value(ctxURLKey).(string)
+	in := extAuthzRequest{
+		Method:     req.Method,
+		URL:        url,
+		Host:       req.Host,
+		Path:       req.URL.Path,
+		RemoteAddr: req.RemoteAddr,
+		Headers:    req.Header,
+		Identity:   claimsFromCtx(ctx),
+	}
+	if len(ea.Headers) > 0 {
+		in.Headers = make(http.Header)
+		for _, k := range ea.Headers {
+			if v := req.Header.Values(k); len(v) > 0 {
+				in.Headers[http.CanonicalHeaderKey(k)] = v
+			}
+		}
+	}
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		cert := req.TLS.PeerCertificates[0]
+		sum := sha256.Sum256(cert.Raw)
+		in.ClientCert = &extAuthzCert{
+			Subject:        cert.Subject.String(),
+			Issuer:         cert.Issuer.String(),
+			SerialNumber:   cert.SerialNumber.String(),
+			SHA256:         hex.EncodeToString(sum[:]),
+			DNSNames:       cert.DNSNames,
+			EmailAddresses: cert.EmailAddresses,
+		}
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ea.Timeout)
+	defer cancel()
+	areq, err := http.NewRequestWithContext(ctx, http.MethodPost, ea.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	areq.Header.Set("Content-Type", "application/json")
+	aresp, err := http.DefaultClient.Do(areq)
+	if err != nil {
+		return nil, err
+	}
+	defer aresp.Body.Close()
+	if aresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", aresp.StatusCode)
+	}
+	var out extAuthzResponse
+	if err := json.NewDecoder(io.LimitReader(aresp.Body, 1<<20)).Decode(&out); err != nil {
+		return nil, err
+	}
+	if out.Status != 0 && (out.Status < 100 || out.Status > 999) {
+		return nil, fmt.Errorf("invalid status %d", out.Status)
+	}
+	return &out, nil
+}
@@ -0,0 +1,119 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestExtAuthz(t *testing.T) {
+	var got extAuthzRequest
+	authz := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = extAuthzRequest{}
+		if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+			t.Errorf("Decode: %v", err)
+		}
+		var resp extAuthzResponse
+		switch got.Path {
+		case "/allow":
+			resp = extAuthzResponse{
+				Allow:         true,
+				SetHeaders:    http.Header{"X-Role": []string{"admin"}},
+				RemoveHeaders: []string{"X-Secret"},
+			}
+		case "/redirect":
+			resp = extAuthzResponse{
+				Status:          http.StatusFound,
+				ResponseHeaders: http.Header{"Location": []string{"/login"}},
+			}
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer authz.Close()
+
+	be := &Backend{
+		Mode: ModeHTTP,
+		ExtAuthz: &ExtAuthz{
+			URL:     authz.URL,
+			Headers: []string{"X-Secret"},
+			Timeout: defaultExtAuthzTimeout,
+		},
+		recordEvent: func(string) {},
+	}
+	newReq := func(path string) *http.Request {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Secret", "foo")
+		req.Header.Set("X-Other", "bar")
+		ctx := context.WithValue(req.Context(), authCtxKey, jwt.MapClaims{"email": "bob@example.com"})
+		return req.WithContext(ctx)
+	}
+
+	req := newReq("/allow")
+	if !be.checkExtAuthz(httptest.NewRecorder(), req) {
+		t.Fatal("checkExtAuthz(/allow) = false, want true")
+	}
+	if got, want := got.Identity["email"], "bob@example.com"; got != want {
+		t.Errorf("Identity[email] = %v, want %q", got, want)
+	}
+	if len(got.Headers) != 1 || got.Headers.Get("X-Secret") != "foo" {
+		t.Errorf("Headers = %v, want only X-Secret", got.Headers)
+	}
+	if got, want := req.Header.Get("X-Role"), "admin"; got != want {
+		t.Errorf("X-Role = %q, want %q", got, want)
+	}
+	if got := req.Header.Get("X-Secret"); got != "" {
+		t.Errorf("X-Secret = %q, want empty", got)
+	}
+
+	for _, tc := range []struct {
+		path     string
+		failOpen bool
+		ok       bool
+		code     int
+	}{
+		{path: "/deny", code: http.StatusForbidden},
+		{path: "/redirect", code: http.StatusFound},
+		{path: "/fail", code: http.StatusBadGateway},
+		{path: "/fail", failOpen: true, ok: true},
+	} {
+		be.ExtAuthz.FailOpen = tc.failOpen
+		rec := httptest.NewRecorder()
+		if got := be.checkExtAuthz(rec, newReq(tc.path)); got != tc.ok {
+			t.Errorf("checkExtAuthz(%s) = %v, want %v", tc.path, got, tc.ok)
+			continue
+		}
+		if !tc.ok && rec.Code != tc.code {
+			t.Errorf("checkExtAuthz(%s) code = %d, want %d", tc.path, rec.Code, tc.code)
+		}
+	}
+}
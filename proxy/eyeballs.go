@@ -0,0 +1,175 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// connectionAttemptDelay is the delay between connection attempts.
+// https://www.rfc-editor.org/rfc/rfc8305.html#section-5
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// eyeballsDialer implements Happy Eyeballs Version 2 (RFC 8305). When a host
+// name resolves to multiple addresses, connection attempts are made to IPv6
+// and IPv4 addresses alternately, without waiting for the previous attempt
+// to time out.
+type eyeballsDialer struct {
+	localAddr *net.TCPAddr
+	lookup    func(ctx context.Context, host string) ([]net.IPAddr, error)
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+	delay     time.Duration
+}
+
+func newEyeballsDialer(d *net.Dialer, localAddr *net.TCPAddr, r *resolver) *eyeballsDialer {
+	lookup := net.DefaultResolver.LookupIPAddr
+	if r != nil {
+		lookup = r.LookupIPAddr
+	}
+	return &eyeballsDialer{
+		localAddr: localAddr,
+		lookup:    lookup,
+		dial:      d.DialContext,
+		delay:     connectionAttemptDelay,
+	}
+}
+
+// sortAddresses returns the addresses with the IPv6 and IPv4 addresses
+// interleaved, starting with IPv6.
+// https://www.rfc-editor.org/rfc/rfc8305.html#section-4
+func sortAddresses(addrs []net.IPAddr) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			v4 = append(v4, a)
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+	out := make([]net.IPAddr, 0, len(addrs))
+	for len(v4) > 0 || len(v6) > 0 {
+		if len(v6) > 0 {
+			out = append(out, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			out = append(out, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return out
+}
+
+func (d *eyeballsDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return d.dial(ctx, network, addr)
+	}
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = sortAddresses(ips)
+	if d.localAddr != nil {
+		// The source address determines the address family.
+		v4 := d.localAddr.IP.To4() != nil
+		var filtered []net.IPAddr
+		for _, ip := range ips {
+			if (ip.IP.To4() != nil) == v4 {
+				filtered = append(filtered, ip)
+			}
+		}
+		ips = filtered
+	}
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address", Addr: host}
+	}
+	if len(ips) == 1 {
+		return d.dial(ctx, network, net.JoinHostPort(ips[0].String(), port))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result)
+	var pending int
+	var errs []error
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	next := 0
+	for {
+		var timerC <-chan time.Time
+		if next < len(ips) {
+			timerC = timer.C
+		} else if pending == 0 {
+			return nil, errors.Join(errs...)
+		}
+		select {
+		case <-timerC:
+			target := net.JoinHostPort(ips[next].String(), port)
+			next++
+			pending++
+			go func() {
+				conn, err := d.dial(ctx, network, target)
+				select {
+				case results <- result{conn, err}:
+				case <-ctx.Done():
+					if conn != nil {
+						conn.Close()
+					}
+				}
+			}()
+			timer.Reset(d.delay)
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(ips) {
+				// Start the next attempt right away.
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(0)
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
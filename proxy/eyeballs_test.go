@@ -0,0 +1,109 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSortAddresses(t *testing.T) {
+	var in []net.IPAddr
+	for _, s := range []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "192.0.2.3", "2001:db8::2"} {
+		in = append(in, net.IPAddr{IP: net.ParseIP(s)})
+	}
+	var got []string
+	for _, a := range sortAddresses(in) {
+		got = append(got, a.String())
+	}
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("sortAddresses() = %v, want %v", got, want)
+	}
+}
+
+func TestEyeballsDialer(t *testing.T) {
+	lookup := func(context.Context, string) ([]net.IPAddr, error) {
+		return []net.IPAddr{
+			{IP: net.ParseIP("192.0.2.1")},
+			{IP: net.ParseIP("2001:db8::1")},
+		}, nil
+	}
+
+	for _, tc := range []struct {
+		name      string
+		v6        string // hang, fail, or ok
+		localAddr *net.TCPAddr
+		delay     time.Duration
+		want      []string
+	}{
+		{name: "v6 ok", v6: "ok", delay: time.Minute, want: []string{"[2001:db8::1]:443"}},
+		{name: "v6 hangs", v6: "hang", delay: 10 * time.Millisecond, want: []string{"[2001:db8::1]:443", "192.0.2.1:443"}},
+		{name: "v6 fails", v6: "fail", delay: time.Minute, want: []string{"[2001:db8::1]:443", "192.0.2.1:443"}},
+		{name: "v4 source", v6: "ok", localAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, delay: time.Minute, want: []string{"192.0.2.1:443"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var attempts []string
+			d := &eyeballsDialer{
+				localAddr: tc.localAddr,
+				lookup:    lookup,
+				delay:     tc.delay,
+				dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					mu.Lock()
+					attempts = append(attempts, addr)
+					mu.Unlock()
+					if addr == "[2001:db8::1]:443" {
+						switch tc.v6 {
+						case "hang":
+							<-ctx.Done()
+							return nil, ctx.Err()
+						case "fail":
+							return nil, errors.New("connection refused")
+						}
+					}
+					c, _ := net.Pipe()
+					return c, nil
+				},
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := d.DialContext(ctx, "tcp", "example.com:443")
+			if err != nil {
+				t.Fatalf("DialContext: %v", err)
+			}
+			conn.Close()
+			mu.Lock()
+			defer mu.Unlock()
+			if !slices.Equal(attempts, tc.want) {
+				t.Errorf("attempts = %v, want %v", attempts, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	xForwardedProtoHeader = "X-Forwarded-Proto"
+	xForwardedHostHeader  = "X-Forwarded-Host"
+	forwardedHeader       = "Forwarded"
+
+	forwardedAppend  = "append"
+	forwardedReplace = "replace"
+	forwardedStrip   = "strip"
+)
+
+// setForwardedHeaders sets the X-Forwarded-* headers of the request according
+// to the backend's ForwardedHeaders policy.
+//
+// X-Forwarded-For is set by httputil.ReverseProxy after the director runs. It
+// appends the client's IP address to any existing value, and it leaves the
+// header alone when its value is nil.
+func (be *Backend) setForwardedHeaders(req *http.Request) {
+	fh := be.ForwardedHeaders
+	trusted := be.isTrustedProxy(req.RemoteAddr)
+
+	switch fh.For {
+	case forwardedStrip:
+		req.Header[xForwardedForHeader] = nil
+	case forwardedAppend:
+		if !trusted {
+			req.Header.Del(xForwardedForHeader)
+		}
+	default:
+		req.Header.Del(xForwardedForHeader)
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	setForwardedHeader(req.Header, xForwardedProtoHeader, fh.Proto, proto, trusted)
+	setForwardedHeader(req.Header, xForwardedHostHeader, fh.Host, req.Host, trusted)
+
+	if fh.Forwarded == "" {
+		return
+	}
+	if fh.Forwarded == forwardedStrip {
+		req.Header.Del(forwardedHeader)
+		return
+	}
+	elem := []string{
+		"for=" + forwardedNode(req.RemoteAddr),
+		"proto=" + proto,
+		"host=" + forwardedValue(req.Host),
+	}
+	if conn, ok := req.Context().Value(connCtxKey).(anyConn); ok {
+		if ip := addr2ip(conn.LocalAddr()); ip != "" {
+			elem = append(elem, "by="+forwardedNode(ip))
+		}
+	}
+	value := strings.Join(elem, ";")
+	if fh.Forwarded == forwardedAppend && trusted {
+		if prior := strings.Join(req.Header.Values(forwardedHeader), ", "); prior != "" {
+			if _, err := parseForwarded(prior); err == nil {
+				value = prior + ", " + value
+			}
+		}
+	}
+	req.Header.Set(forwardedHeader, value)
+}
+
+func setForwardedHeader(h http.Header, name, mode, value string, trusted bool) {
+	switch mode {
+	case forwardedStrip:
+		h.Del(name)
+	case forwardedReplace:
+		h.Set(name, value)
+	case forwardedAppend:
+		if prior := h.Values(name); trusted && len(prior) > 0 {
+			h.Set(name, strings.Join(append(prior, value), ", "))
+			return
+		}
+		h.Set(name, value)
+	}
+}
+
+// isTrustedProxy returns true if addr is in one of the backend's
+// TrustedProxies networks.
+func (be *Backend) isTrustedProxy(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range be.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedNode returns the RFC 7239 node identifier for addr, which is an IP
+// address with or without a port. The port is omitted.
+func forwardedNode(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() == nil {
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.String()
+}
+
+// forwardedValue returns v as a token, or as a quoted-string if it contains
+// characters that are not allowed in a token.
+func forwardedValue(v string) string {
+	if v != "" && strings.IndexFunc(v, func(r rune) bool { return !isTokenChar(r) }) < 0 {
+		return v
+	}
+	return strconv.Quote(v)
+}
+
+func isTokenChar(r rune) bool {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+// parseForwarded parses the value of a Forwarded header, as defined in
+// RFC 7239. It returns one map of parameters per forwarded element.
+func parseForwarded(v string) ([]map[string]string, error) {
+	var out []map[string]string
+	elem := make(map[string]string)
+	for i := 0; ; {
+		for i < len(v) && (v[i] == ' ' || v[i] == '\t') {
+			i++
+		}
+		j := i
+		for j < len(v) && isTokenChar(rune(v[j])) {
+			j++
+		}
+		if j == i || j >= len(v) || v[j] != '=' {
+			return nil, fmt.Errorf("invalid parameter at offset %d", i)
+		}
+		name := strings.ToLower(v[i:j])
+		if _, exists := elem[name]; exists {
+			return nil, fmt.Errorf("duplicate parameter %q", name)
+		}
+		i = j + 1
+		if i < len(v) && v[i] == '"' {
+			var value strings.Builder
+			for i++; i < len(v) && v[i] != '"'; i++ {
+				if v[i] == '\\' {
+					i++
+				}
+				if i < len(v) {
+					value.WriteByte(v[i])
+				}
+			}
+			if i >= len(v) {
+				return nil, errors.New("unterminated quoted-string")
+			}
+			i++
+			elem[name] = value.String()
+		} else {
+			j = i
+			for j < len(v) && isTokenChar(rune(v[j])) {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("missing value for %q", name)
+			}
+			elem[name] = v[i:j]
+			i = j
+		}
+		for i < len(v) && (v[i] == ' ' || v[i] == '\t') {
+			i++
+		}
+		if i >= len(v) {
+			out = append(out, elem)
+			return out, nil
+		}
+		switch v[i] {
+		case ';':
+		case ',':
+			out = append(out, elem)
+			elem = make(map[string]string)
+		default:
+			return nil, fmt.Errorf("unexpected character %q at offset %d", v[i], i)
+		}
+		i++
+	}
+}
@@ -0,0 +1,213 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestSetForwardedHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		fh         *ForwardedHeaders
+		remoteAddr string
+		want       http.Header
+	}{
+		{
+			name:       "replace",
+			fh:         &ForwardedHeaders{For: "replace", Proto: "replace", Host: "replace", TrustedProxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "10.1.2.3:1234",
+			want: http.Header{
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"www.example.com"},
+			},
+		},
+		{
+			name:       "append trusted",
+			fh:         &ForwardedHeaders{For: "append", Proto: "append", Host: "append", TrustedProxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "10.1.2.3:1234",
+			want: http.Header{
+				"X-Forwarded-For":   {"192.0.2.1"},
+				"X-Forwarded-Proto": {"http, https"},
+				"X-Forwarded-Host":  {"inner.example.com, www.example.com"},
+			},
+		},
+		{
+			name:       "append untrusted",
+			fh:         &ForwardedHeaders{For: "append", Proto: "append", Host: "append", TrustedProxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "192.168.1.1:1234",
+			want: http.Header{
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"www.example.com"},
+			},
+		},
+		{
+			name:       "strip",
+			fh:         &ForwardedHeaders{For: "strip", Proto: "strip", Host: "strip"},
+			remoteAddr: "10.1.2.3:1234",
+			want: http.Header{
+				"X-Forwarded-For": nil,
+			},
+		},
+		{
+			name:       "default",
+			fh:         &ForwardedHeaders{},
+			remoteAddr: "10.1.2.3:1234",
+			want: http.Header{
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"inner.example.com"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{
+				CacheDir: t.TempDir(),
+				Backends: []*Backend{{
+					ServerNames:      []string{"www.example.com"},
+					Mode:             "HTTPS",
+					Addresses:        []string{"192.168.0.1:443"},
+					ForwardedHeaders: tc.fh,
+				}},
+			}
+			if err := cfg.Check(); err != nil {
+				t.Fatalf("cfg.Check() = %v", err)
+			}
+			req := &http.Request{
+				Host:       "www.example.com",
+				RemoteAddr: tc.remoteAddr,
+				TLS:        &tls.ConnectionState{},
+				Header: http.Header{
+					"X-Forwarded-For":   {"192.0.2.1"},
+					"X-Forwarded-Proto": {"http"},
+					"X-Forwarded-Host":  {"inner.example.com"},
+				},
+			}
+			cfg.Backends[0].setForwardedHeaders(req)
+			if diff := deep.Equal(tc.want, req.Header); diff != nil {
+				t.Errorf("Header = %#v, want %#v: %v", req.Header, tc.want, diff)
+			}
+		})
+	}
+}
+
+func TestForwardedHeadersConfig(t *testing.T) {
+	for _, be := range []*Backend{
+		{ServerNames: []string{"example.com"}, Mode: "HTTPS", ForwardedHeaders: &ForwardedHeaders{For: "keep"}},
+		{ServerNames: []string{"example.com"}, Mode: "HTTPS", ForwardedHeaders: &ForwardedHeaders{TrustedProxies: []string{"10.0.0.1"}}},
+		{ServerNames: []string{"example.com"}, Mode: "TCP", ForwardedHeaders: &ForwardedHeaders{For: "strip"}},
+	} {
+		cfg := &Config{
+			CacheDir: t.TempDir(),
+			Backends: []*Backend{be},
+		}
+		if err := cfg.Check(); err == nil {
+			t.Errorf("Check() with %+v should fail", be.ForwardedHeaders)
+		}
+	}
+}
+
+func TestForwardedHeader(t *testing.T) {
+	for _, tc := range []struct {
+		mode       string
+		remoteAddr string
+		inbound    []string
+		want       []string
+	}{
+		{
+			mode:       "replace",
+			remoteAddr: "192.0.2.1:1234",
+			inbound:    []string{"for=198.51.100.1"},
+			want:       []string{`for=192.0.2.1;proto=https;host="www.example.com:8443"`},
+		},
+		{
+			mode:       "append",
+			remoteAddr: "10.1.2.3:1234",
+			inbound:    []string{`for=198.51.100.1;proto=https`, `for="[2001:db8::1]"`},
+			want:       []string{`for=198.51.100.1;proto=https, for="[2001:db8::1]", for=10.1.2.3;proto=https;host="www.example.com:8443"`},
+		},
+		{
+			mode:       "append",
+			remoteAddr: "10.1.2.3:1234",
+			inbound:    []string{`for="198.51.100.1`},
+			want:       []string{`for=10.1.2.3;proto=https;host="www.example.com:8443"`},
+		},
+		{
+			mode:       "append",
+			remoteAddr: "[2001:db8::2]:1234",
+			inbound:    []string{"for=198.51.100.1"},
+			want:       []string{`for="[2001:db8::2]";proto=https;host="www.example.com:8443"`},
+		},
+		{
+			mode:       "strip",
+			remoteAddr: "10.1.2.3:1234",
+			inbound:    []string{"for=198.51.100.1"},
+			want:       nil,
+		},
+		{
+			mode:       "",
+			remoteAddr: "10.1.2.3:1234",
+			inbound:    []string{"for=198.51.100.1"},
+			want:       []string{"for=198.51.100.1"},
+		},
+	} {
+		be := &Backend{
+			ForwardedHeaders: &ForwardedHeaders{Forwarded: tc.mode},
+			trustedProxies:   []*net.IPNet{{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)}},
+		}
+		req := &http.Request{
+			Host:       "www.example.com:8443",
+			RemoteAddr: tc.remoteAddr,
+			TLS:        &tls.ConnectionState{},
+			Header:     http.Header{"Forwarded": tc.inbound},
+		}
+		be.setForwardedHeaders(req)
+		if diff := deep.Equal(tc.want, req.Header.Values("Forwarded")); diff != nil {
+			t.Errorf("%s %v: Forwarded = %q, want %q", tc.mode, tc.inbound, req.Header.Values("Forwarded"), tc.want)
+		}
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	got, err := parseForwarded(`for=192.0.2.60;proto=http;by=203.0.113.43, For="[2001:db8:cafe::17]:4711" ; host="a\"b"`)
+	if err != nil {
+		t.Fatalf("parseForwarded() = %v", err)
+	}
+	want := []map[string]string{
+		{"for": "192.0.2.60", "proto": "http", "by": "203.0.113.43"},
+		{"for": "[2001:db8:cafe::17]:4711", "host": `a"b`},
+	}
+	if diff := deep.Equal(want, got); diff != nil {
+		t.Errorf("parseForwarded() = %v, want %v", got, want)
+	}
+	for _, v := range []string{``, `for`, `for=1;for=2`, `for="x`, `for=1 x`, `=1`, `for=`} {
+		if _, err := parseForwarded(v); err == nil {
+			t.Errorf("parseForwarded(%q) should fail", v)
+		}
+	}
+}
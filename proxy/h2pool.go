@@ -0,0 +1,122 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// h2SingleStreamPool is an http2.ClientConnPool that sends at most one request
+// at a time on each connection. Idle connections are reused, up to maxIdle per
+// address.
+type h2SingleStreamPool struct {
+	t       *http2.Transport
+	maxIdle int
+	dial    func(context.Context) (net.Conn, error)
+
+	mu    sync.Mutex
+	conns map[string][]*http2.ClientConn
+}
+
+func newH2SingleStreamPool(t *http2.Transport, maxIdle int, dial func(context.Context) (net.Conn, error)) *h2SingleStreamPool {
+	if maxIdle <= 0 {
+		maxIdle = http.DefaultMaxIdleConnsPerHost
+	}
+	return &h2SingleStreamPool{
+		t:       t,
+		maxIdle: maxIdle,
+		dial:    dial,
+		conns:   make(map[string][]*http2.ClientConn),
+	}
+}
+
+// GetClientConn returns an idle connection to addr with a reserved stream, or
+// a new connection if none is available. Closed connections and idle
+// connections in excess of maxIdle are removed from the pool.
+func (p *h2SingleStreamPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	p.mu.Lock()
+	var found *http2.ClientConn
+	var idle int
+	p.conns[addr] = slices.DeleteFunc(p.conns[addr], func(cc *http2.ClientConn) bool {
+		st := cc.State()
+		if st.Closed || st.Closing {
+			return true
+		}
+		if st.StreamsActive > 0 || st.StreamsReserved > 0 {
+			return false
+		}
+		if found == nil && cc.ReserveNewRequest() {
+			found = cc
+			return false
+		}
+		if idle++; idle > p.maxIdle {
+			cc.Close()
+			return true
+		}
+		return false
+	})
+	p.mu.Unlock()
+	if found != nil {
+		return found, nil
+	}
+
+	conn, err := p.dial(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	cc, err := p.t.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !cc.ReserveNewRequest() {
+		cc.Close()
+		return nil, http2.ErrNoCachedConn
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns[addr] = append(p.conns[addr], cc)
+	return cc, nil
+}
+
+// MarkDead removes the connection from the pool.
+func (p *h2SingleStreamPool) MarkDead(cc *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, conns := range p.conns {
+		if i := slices.Index(conns, cc); i >= 0 {
+			p.conns[addr] = slices.Delete(conns, i, i+1)
+			if len(p.conns[addr]) == 0 {
+				delete(p.conns, addr)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"net"
+
+	"golang.org/x/time/rate"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/ratelimit"
+)
+
+type handshakeLimiter struct {
+	limiter *ratelimit.Limiter
+	v4Mask  net.IPMask
+	v6Mask  net.IPMask
+}
+
+func newHandshakeLimiter(cfg *HandshakeRateLimit) *handshakeLimiter {
+	if cfg == nil || (cfg.Rate == 0 && cfg.MaxConcurrent == 0) {
+		return nil
+	}
+	return &handshakeLimiter{
+		limiter: ratelimit.New(rate.Limit(cfg.Rate), cfg.Burst, cfg.MaxConcurrent),
+		v4Mask:  net.CIDRMask(cfg.IPv4Prefix, 32),
+		v6Mask:  net.CIDRMask(cfg.IPv6Prefix, 128),
+	}
+}
+
+// key returns the source network of addr, e.g. 192.168.0.0/24.
+func (l *handshakeLimiter) key(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return addr.String()
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(l.v4Mask), Mask: l.v4Mask}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(l.v6Mask), Mask: l.v6Mask}).String()
+}
+
+// acquire applies the rate and concurrency limits to a new TLS handshake. When
+// ok is true, release must be called when the handshake is done.
+func (l *handshakeLimiter) acquire(addr net.Addr) (release func(), ok bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	return l.limiter.Acquire(l.key(addr))
+}
+
+// allow applies only the rate limit to a new handshake.
+func (l *handshakeLimiter) allow(addr net.Addr) bool {
+	if l == nil {
+		return true
+	}
+	return l.limiter.Allow(l.key(addr))
+}
+
+func (p *Proxy) handshakeLimiter() *handshakeLimiter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.hsLimiter
+}
+
+// handshakeDone releases the handshake limiter's reservation for this
+// connection, if any.
+func handshakeDone(c anyConn) {
+	if f, ok := annotatedConn(c).Annotation(handshakeRelKey, nil).(func()); ok {
+		f()
+	}
+}
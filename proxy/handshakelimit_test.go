@@ -0,0 +1,84 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHandshakeLimiter(t *testing.T) {
+	cfg := &Config{
+		HandshakeRateLimit: &HandshakeRateLimit{
+			Rate:          1,
+			Burst:         2,
+			MaxConcurrent: 1,
+			IPv4Prefix:    24,
+		},
+	}
+	if err := cfg.Check(); err != nil {
+		t.Fatalf("cfg.Check() = %v", err)
+	}
+	l := newHandshakeLimiter(cfg.HandshakeRateLimit)
+
+	for _, tc := range []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.168.0.1")}, "192.168.0.0/24"},
+		{&net.UDPAddr{IP: net.ParseIP("192.168.0.200")}, "192.168.0.0/24"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}, "2001:db8::/64"},
+	} {
+		if got := l.key(tc.addr); got != tc.want {
+			t.Errorf("key(%s) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+
+	addr1 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}
+	addr2 := &net.TCPAddr{IP: net.ParseIP("10.0.0.2")}
+	addr3 := &net.TCPAddr{IP: net.ParseIP("10.0.1.1")}
+
+	release, ok := l.acquire(addr1)
+	if !ok {
+		t.Fatal("acquire(addr1) failed")
+	}
+	if _, ok := l.acquire(addr2); ok {
+		t.Fatal("acquire(addr2) should fail while a handshake is in progress")
+	}
+	release()
+	if _, ok := l.acquire(addr2); !ok {
+		t.Fatal("acquire(addr2) failed")
+	}
+	if l.allow(addr1) {
+		t.Fatal("allow(addr1) should exceed the rate limit")
+	}
+	if _, ok := l.acquire(addr3); !ok {
+		t.Fatal("acquire(addr3) failed")
+	}
+
+	var nl *handshakeLimiter
+	if _, ok := nl.acquire(addr1); !ok {
+		t.Fatal("nil limiter should always allow")
+	}
+}
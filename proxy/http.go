@@ -36,14 +36,17 @@ type ctxKey int
 
 var connCtxKey ctxKey = 1
 
-func startInternalHTTPServer(handler http.Handler, conns <-chan net.Conn) *http.Server {
+func startInternalHTTPServer(handler http.Handler, conns <-chan net.Conn, readHeaderTimeout time.Duration) *http.Server {
+	if readHeaderTimeout == 0 {
+		readHeaderTimeout = 30 * time.Second
+	}
 	l := &proxyListener{
 		ch:       conns,
 		closedCh: make(chan struct{}),
 	}
 	s := &http.Server{
 		Handler:           handler,
-		ReadHeaderTimeout: 30 * time.Second,
+		ReadHeaderTimeout: readHeaderTimeout,
 		IdleTimeout:       30 * time.Second,
 		ReadTimeout:       24 * time.Hour,
 		WriteTimeout:      24 * time.Hour,
@@ -112,7 +115,7 @@ func userAgent(req *http.Request) string {
 func logHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if be := connBackend(req.Context().Value(connCtxKey).(anyConn)); be != nil {
-			be.logRequestF("REQ %s ➔ %s %s (%q)", formatReqDesc(req), req.Method, req.URL, userAgent(req))
+			be.logHTTPRequest("REQ", req, req.URL.String(), 0, "")
 		}
 		next.ServeHTTP(w, req)
 	})
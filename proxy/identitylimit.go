@@ -0,0 +1,69 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// requestIdentity returns the identity of the authenticated client that sent
+// the request, i.e. the email address of the SSO user, or the subject of the
+// client certificate. It returns an empty string when the client isn't
+// authenticated.
+func requestIdentity(req *http.Request) string {
+	if email, _ := claimsFromCtx(req.Context())["email"].(string); email != "" {
+		return "sso:" + email
+	}
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return "cert:" + req.TLS.PeerCertificates[0].Subject.String()
+	}
+	return ""
+}
+
+// checkIdentityRateLimit responds with 429 Too Many Requests when the
+// authenticated client has exceeded the backend's IdentityRateLimit. It
+// returns false when the request should not be processed any further.
+func (be *Backend) checkIdentityRateLimit(w http.ResponseWriter, req *http.Request) bool {
+	if be.identityLimiter == nil {
+		return true
+	}
+	id := requestIdentity(req)
+	if id == "" {
+		return true
+	}
+	retry, ok := be.identityLimiter.Check(id)
+	if ok {
+		return true
+	}
+	be.recordEvent("identity rate limit")
+	be.logHTTPRequest("REQ", req, req.URL.Path, http.StatusTooManyRequests, " (rate limit)")
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retry.Seconds())), 10))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+	return false
+}
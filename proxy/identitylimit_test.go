@@ -0,0 +1,94 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestCheckIdentityRateLimit(t *testing.T) {
+	cfg := &Config{
+		CacheDir: t.TempDir(),
+		Backends: []*Backend{{
+			ServerNames:       []string{"example.com"},
+			Mode:              ModeLocal,
+			IdentityRateLimit: &IdentityRateLimit{RequestsPerMinute: 1, Burst: 2},
+		}},
+	}
+	if err := cfg.Check(); err != nil {
+		t.Fatalf("cfg.Check: %v", err)
+	}
+	be := cfg.Backends[0]
+	be.recordEvent = func(string) {}
+
+	withEmail := func(email string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		return req.WithContext(context.WithValue(req.Context(), authCtxKey, jwt.MapClaims{"email": email}))
+	}
+	withCert := func(cn string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}}},
+		}
+		return req
+	}
+
+	for i, tc := range []struct {
+		req  *http.Request
+		want bool
+	}{
+		{withEmail("bob@example.com"), true},
+		{withEmail("bob@example.com"), true},
+		{withEmail("bob@example.com"), false},
+		{withEmail("alice@example.com"), true},
+		{withCert("client"), true},
+		{withCert("client"), true},
+		{withCert("client"), false},
+		{httptest.NewRequest("GET", "/", nil), true},
+		{httptest.NewRequest("GET", "/", nil), true},
+		{httptest.NewRequest("GET", "/", nil), true},
+	} {
+		w := httptest.NewRecorder()
+		if got := be.checkIdentityRateLimit(w, tc.req); got != tc.want {
+			t.Errorf("[%d] checkIdentityRateLimit() = %v, want %v", i, got, tc.want)
+		}
+		if tc.want {
+			continue
+		}
+		if got, want := w.Code, http.StatusTooManyRequests; got != want {
+			t.Errorf("[%d] Code = %d, want %d", i, got, want)
+		}
+		if got := w.Header().Get("Retry-After"); got != "60" {
+			t.Errorf("[%d] Retry-After = %q, want 60", i, got)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultInspectionMaxBodySize = 10 << 20
+	defaultInspectionTimeout     = 30 * time.Second
+)
+
+var errInspectionBodyTooLarge = errors.New("body too large")
+
+// readCloser is an io.ReadCloser with a separate Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// inspectRequest sends the request's body to the content inspection service,
+// when needed. It returns false when the request should not be processed any
+// further.
+func (be *Backend) inspectRequest(w http.ResponseWriter, req *http.Request) bool {
+	ci := be.ContentInspection
+	if ci == nil || !pathMatches(ci.Paths, req.URL.Path) {
+		return true
+	}
+	if ci.Responses {
+		// Let the transport decompress the responses so that the
+		// inspection service sees the actual content.
+		req.Header.Del("Accept-Encoding")
+	}
+	if !ci.Requests || req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	body, size, blocked, err := be.inspectBody(req.Context(), "request", req, 0, req.Header, req.Body)
+	if err != nil {
+		be.recordEvent("content inspection: error")
+		be.logErrorF("ERR [-] %s: content inspection: %v", req.RemoteAddr, err)
+		if !ci.FailOpen {
+			if body != nil {
+				body.Close()
+			}
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return false
+		}
+	}
+	if blocked {
+		be.recordEvent("content inspection: request blocked")
+		http.Error(w, "Blocked by content inspection", http.StatusForbidden)
+		return false
+	}
+	req.Body = body
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	return true
+}
+
+// inspectResponse sends the response's body to the content inspection
+// service, when needed. A blocked response is replaced with a 403 Forbidden
+// response.
+func (be *Backend) inspectResponse(resp *http.Response) error {
+	ci := be.ContentInspection
+	req := resp.Request
+	if ci == nil || !ci.Responses || !pathMatches(ci.Paths, req.URL.Path) {
+		return nil
+	}
+	if req.Method == http.MethodHead || resp.StatusCode < 200 || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+	body, size, blocked, err := be.inspectBody(req.Context(), "response", req, resp.StatusCode, resp.Header, resp.Body)
+	if err != nil {
+		be.recordEvent("content inspection: error")
+		be.logErrorF("ERR [-] %s: content inspection: %v", req.RemoteAddr, err)
+		if !ci.FailOpen {
+			if body != nil {
+				body.Close()
+			}
+			return fmt.Errorf("content inspection: %w", err)
+		}
+	}
+	if blocked {
+		be.recordEvent("content inspection: response blocked")
+		msg := []byte("Blocked by content inspection\n")
+		resp.StatusCode = http.StatusForbidden
+		resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+		resp.Header = http.Header{
+			"Content-Type":   []string{"text/plain; charset=utf-8"},
+			"Content-Length": []string{strconv.Itoa(len(msg))},
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(msg))
+		resp.ContentLength = int64(len(msg))
+		return nil
+	}
+	resp.Body = body
+	if size >= 0 {
+		resp.ContentLength = size
+	}
+	return nil
+}
+
+// inspectBody sends body to the content inspection service. It returns the
+// body to forward, and its size when it was modified, or -1. When err is not
+// nil, the returned body is the original one, if it can still be read.
+func (be *Backend) inspectBody(ctx context.Context, direction string, req *http.Request, status int, header http.Header, body io.ReadCloser) (out io.ReadCloser, size int64, blocked bool, err error) {
+	ci := be.ContentInspection
+	b, err := io.ReadAll(io.LimitReader(body, ci.MaxBodySize+1))
+	if err != nil {
+		body.Close()
+		return nil, -1, false, err
+	}
+	orig := readCloser{io.MultiReader(bytes.NewReader(b), body), body}
+	if int64(len(b)) > ci.MaxBodySize {
+		return orig, -1, false, errInspectionBodyTooLarge
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ci.Timeout)
+	defer cancel()
+	ireq, err := http.NewRequestWithContext(ctx, http.MethodPost, ci.URL, bytes.NewReader(b))
+	if err != nil {
+		return orig, -1, false, err
+	}
+	if ct := header.Get("Content-Type"); ct != "" {
+		ireq.Header.Set("Content-Type", ct)
+	}
+	url, _ := req.Context().Value(ctxURLKey).(string)
+	ireq.Header.Set("X-Inspect-Direction", direction)
+	ireq.Header.Set("X-Inspect-Method", req.Method)
+	ireq.Header.Set("X-Inspect-URL", url)
+	if status > 0 {
+		ireq.Header.Set("X-Inspect-Status", strconv.Itoa(status))
+	}
+	if email, _ := claimsFromCtx(req.Context())["email"].(string); email != "" {
+		ireq.Header.Set("X-Inspect-User", email)
+	}
+	resp, err := http.DefaultClient.Do(ireq)
+	if err != nil {
+		return orig, -1, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return orig, -1, false, nil
+	case http.StatusOK:
+		nb, err := io.ReadAll(io.LimitReader(resp.Body, ci.MaxBodySize+1))
+		if err != nil {
+			return orig, -1, false, err
+		}
+		if int64(len(nb)) > ci.MaxBodySize {
+			return orig, -1, false, errInspectionBodyTooLarge
+		}
+		body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "" {
+			header.Set("Content-Type", ct)
+		}
+		header.Set("Content-Length", strconv.Itoa(len(nb)))
+		return io.NopCloser(bytes.NewReader(nb)), int64(len(nb)), false, nil
+	case http.StatusForbidden:
+		body.Close()
+		return nil, -1, true, nil
+	default:
+		return orig, -1, false, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,146 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContentInspection(t *testing.T) {
+	inspector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		switch {
+		case strings.Contains(string(b), "virus"):
+			w.WriteHeader(http.StatusForbidden)
+		case strings.Contains(string(b), "secret"):
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(strings.ReplaceAll(string(b), "secret", "******")))
+		case strings.Contains(string(b), "fail"):
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer inspector.Close()
+
+	var events []string
+	be := &Backend{
+		Mode: ModeHTTP,
+		ContentInspection: &ContentInspection{
+			URL:         inspector.URL,
+			Requests:    true,
+			Responses:   true,
+			Paths:       []string{"/inspect/"},
+			MaxBodySize: 100,
+			Timeout:     defaultInspectionTimeout,
+		},
+		recordEvent: func(e string) { events = append(events, e) },
+	}
+
+	for _, tc := range []struct {
+		path, body string
+		ok         bool
+		code       int
+		want       string
+	}{
+		{path: "/inspect/", body: "hello", ok: true, want: "hello"},
+		{path: "/inspect/", body: "my secret", ok: true, want: "my ******"},
+		{path: "/inspect/", body: "a virus", code: http.StatusForbidden},
+		{path: "/inspect/", body: "fail", code: http.StatusBadGateway},
+		{path: "/inspect/", body: strings.Repeat("x", 101), code: http.StatusBadGateway},
+		{path: "/other/", body: "a virus", ok: true, want: "a virus"},
+	} {
+		req := httptest.NewRequest("POST", tc.path, strings.NewReader(tc.body))
+		rec := httptest.NewRecorder()
+		if got := be.inspectRequest(rec, req); got != tc.ok {
+			t.Errorf("[%s %q] inspectRequest() = %v, want %v", tc.path, tc.body, got, tc.ok)
+			continue
+		}
+		if !tc.ok {
+			if rec.Code != tc.code {
+				t.Errorf("[%s %q] Code = %d, want %d", tc.path, tc.body, rec.Code, tc.code)
+			}
+			continue
+		}
+		b, _ := io.ReadAll(req.Body)
+		if got := string(b); got != tc.want {
+			t.Errorf("[%s %q] Body = %q, want %q", tc.path, tc.body, got, tc.want)
+		}
+		if req.ContentLength >= 0 && req.ContentLength != int64(len(b)) {
+			t.Errorf("[%s %q] ContentLength = %d, want %d", tc.path, tc.body, req.ContentLength, len(b))
+		}
+	}
+
+	// With failOpen, the original body is forwarded when the inspection
+	// service fails.
+	be.ContentInspection.FailOpen = true
+	req := httptest.NewRequest("POST", "/inspect/", strings.NewReader("fail"))
+	if !be.inspectRequest(httptest.NewRecorder(), req) {
+		t.Fatal("inspectRequest() = false, want true")
+	}
+	if b, _ := io.ReadAll(req.Body); string(b) != "fail" {
+		t.Errorf("Body = %q, want %q", b, "fail")
+	}
+
+	// Responses.
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/plain"}},
+		Body:       io.NopCloser(strings.NewReader("a virus")),
+		Request:    httptest.NewRequest("GET", "/inspect/", nil),
+	}
+	if err := be.inspectResponse(resp); err != nil {
+		t.Fatalf("inspectResponse: %v", err)
+	}
+	if got, want := resp.StatusCode, http.StatusForbidden; got != want {
+		t.Errorf("StatusCode = %d, want %d", got, want)
+	}
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/plain"}},
+		Body:       io.NopCloser(strings.NewReader("the secret")),
+		Request:    httptest.NewRequest("GET", "/inspect/", nil),
+	}
+	if err := be.inspectResponse(resp); err != nil {
+		t.Fatalf("inspectResponse: %v", err)
+	}
+	if b, _ := io.ReadAll(resp.Body); string(b) != "the ******" {
+		t.Errorf("Body = %q, want %q", b, "the ******")
+	}
+
+	want := []string{
+		"content inspection: request blocked",
+		"content inspection: error",
+		"content inspection: error",
+		"content inspection: error",
+		"content inspection: response blocked",
+	}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+}
@@ -30,6 +30,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
@@ -85,6 +86,8 @@ func UpdateECH(ctx context.Context, records []*Target, configList string, logger
 	re := regexp.MustCompile(` *ech=[^ ]*`)
 	client := retryablehttp.NewClient()
 	client.Logger = nil
+	// Use the default transport for its outbound proxy settings.
+	client.HTTPClient.Transport = http.DefaultTransport
 	for _, r := range records {
 		if !zones[r.Zone] {
 			zones[r.Zone] = true
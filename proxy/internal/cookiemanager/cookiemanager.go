@@ -105,7 +105,19 @@ func (cm *CookieManager) SetAuthTokenCookie(w http.ResponseWriter, userID, email
 	return nil
 }
 
-func (cm *CookieManager) SetIDTokenCookie(w http.ResponseWriter, req *http.Request, authToken *jwt.Token) error {
+// IDTokenOptions customizes the ID tokens created by SetIDTokenCookie.
+type IDTokenOptions struct {
+	// Audience is the list of audience values. The default is the URL of
+	// the request's host.
+	Audience []string
+	// Lifetime is the lifetime of the token. The default is to use the
+	// expiration time of the auth token.
+	Lifetime time.Duration
+	// Claims are extra claims to add to the token.
+	Claims map[string]any
+}
+
+func (cm *CookieManager) SetIDTokenCookie(w http.ResponseWriter, req *http.Request, authToken *jwt.Token, opts IDTokenOptions) error {
 	c, ok := authToken.Claims.(jwt.MapClaims)
 	if !ok {
 		return errors.New("internal error")
@@ -123,8 +135,17 @@ func (cm *CookieManager) SetIDTokenCookie(w http.ResponseWriter, req *http.Reque
 		}
 		claims[k] = v
 	}
+	for k, v := range opts.Claims {
+		claims[k] = v
+	}
 	claims["iat"] = now.Unix()
 	claims["aud"] = audienceForToken(req)
+	if len(opts.Audience) > 0 {
+		claims["aud"] = opts.Audience
+	}
+	if opts.Lifetime > 0 {
+		claims["exp"] = now.Add(opts.Lifetime).Unix()
+	}
 	token, err := cm.tm.CreateToken(claims, "ES256")
 	if err != nil {
 		return err
@@ -205,11 +226,60 @@ func (cm *CookieManager) ValidateAuthTokenCookie(req *http.Request) (*jwt.Token,
 	if sub, err := tok.Claims.GetSubject(); err != nil || sub == "" {
 		return nil, errors.New("invalid subject")
 	}
+	if cm.tm.Revocations().IsRevoked(cm.provider, tok.Claims.(jwt.MapClaims)) {
+		return nil, errors.New("session revoked")
+	}
 	return tok, nil
 }
 
-func (cm *CookieManager) ValidateIDTokenCookie(req *http.Request, authToken *jwt.Token) error {
+// AuthTokenFromResponse returns the claims of the auth token cookie that is
+// being set in the response header h, if any.
+func (cm *CookieManager) AuthTokenFromResponse(h http.Header) (jwt.MapClaims, bool) {
+	for _, cookie := range (&http.Response{Header: h}).Cookies() {
+		if cookie.Name != tlsProxyAuthCookie || cookie.Value == "" {
+			continue
+		}
+		tok, err := cm.tm.ValidateToken(cookie.Value, jwt.WithIssuer(cm.issuer), jwt.WithAudience(cm.issuer))
+		if err != nil {
+			return nil, false
+		}
+		claims, ok := tok.Claims.(jwt.MapClaims)
+		return claims, ok
+	}
+	return nil, false
+}
+
+// RevokeSessions revokes the sessions where claim has the given value. The
+// claim can be sid, idp_sid, or sub.
+func (cm *CookieManager) RevokeSessions(claim, value string) error {
+	return cm.tm.Revocations().Revoke(cm.provider, claim, value)
+}
+
+// RevokeCurrentSession revokes the session of the auth token cookie in req,
+// if it is valid. When allSessions is true, all the sessions of the same user
+// are revoked, i.e. "log out everywhere".
+func (cm *CookieManager) RevokeCurrentSession(req *http.Request, allSessions bool) error {
+	tok, err := cm.ValidateAuthTokenCookie(req)
+	if err != nil {
+		return nil
+	}
+	claims := tok.Claims.(jwt.MapClaims)
+	if allSessions {
+		sub, _ := claims.GetSubject()
+		return cm.RevokeSessions("sub", sub)
+	}
+	sid, ok := claims["sid"].(string)
+	if !ok || sid == "" {
+		return errors.New("no session ID")
+	}
+	return cm.RevokeSessions("sid", sid)
+}
+
+func (cm *CookieManager) ValidateIDTokenCookie(req *http.Request, authToken *jwt.Token, opts IDTokenOptions) error {
 	audience := audienceFromReq(req)
+	if len(opts.Audience) > 0 {
+		audience = opts.Audience[0]
+	}
 
 	c, ok := authToken.Claims.(jwt.MapClaims)
 	if !ok {
@@ -239,12 +309,22 @@ func (cm *CookieManager) ValidateAuthorizationHeader(req *http.Request) (*jwt.To
 	if err != nil {
 		return nil, err
 	}
-	if c, ok := tok.Claims.(jwt.MapClaims); !ok || c["proxyauth"] != nil {
+	c, ok := tok.Claims.(jwt.MapClaims)
+	if !ok || c["proxyauth"] != nil {
 		return nil, errors.New("invalid proxyauth")
 	}
+	if cm.tm.Revocations().IsRevoked(cm.provider, c) {
+		return nil, errors.New("session revoked")
+	}
 	return tok, nil
 }
 
+// IsRevoked returns true if the claims of a token that was not issued by the
+// proxy match a revoked session or user.
+func (cm *CookieManager) IsRevoked(claims jwt.MapClaims) bool {
+	return cm.tm.Revocations().IsRevoked(cm.provider, claims)
+}
+
 func FilterOutAuthTokenCookie(req *http.Request, names ...string) {
 	cookies := req.Cookies()
 	req.Header.Del("Cookie")
@@ -27,6 +27,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/c2FmZQ/storage"
 	"github.com/c2FmZQ/storage/crypto"
@@ -60,6 +61,7 @@ func TestCookies(t *testing.T) {
 	}
 	req, _ := http.NewRequest("GET", "http://example.com", nil)
 	req.Header.Set("cookie", v)
+	authCookie := v
 
 	tok, err := cm.ValidateAuthTokenCookie(req)
 	if err != nil {
@@ -77,7 +79,7 @@ func TestCookies(t *testing.T) {
 	}
 
 	recorder = httptest.NewRecorder()
-	if err := cm.SetIDTokenCookie(recorder, req, tok); err != nil {
+	if err := cm.SetIDTokenCookie(recorder, req, tok, IDTokenOptions{}); err != nil {
 		t.Fatal("cookie not set")
 	}
 	v = recorder.Header().Get("Set-Cookie")
@@ -85,7 +87,191 @@ func TestCookies(t *testing.T) {
 		t.Fatal("cookie not set")
 	}
 	req.Header.Set("cookie", v)
-	if err := cm.ValidateIDTokenCookie(req, tok); err != nil {
+	if err := cm.ValidateIDTokenCookie(req, tok, IDTokenOptions{}); err != nil {
 		t.Fatalf("ValidateIDTokenCookie: %v", err)
 	}
+
+	req.Header.Set("cookie", authCookie)
+	if err := cm.RevokeSessions("sid", "session123"); err != nil {
+		t.Fatalf("RevokeSessions: %v", err)
+	}
+	if _, err := cm.ValidateAuthTokenCookie(req); err == nil {
+		t.Fatal("ValidateAuthTokenCookie succeeded after revocation")
+	}
+	// The revocation list is persisted.
+	rl2, err := tokenmanager.NewRevocationList(store)
+	if err != nil {
+		t.Fatalf("NewRevocationList: %v", err)
+	}
+	if !rl2.IsRevoked("idp", claims) {
+		t.Error("IsRevoked = false, want true")
+	}
+	if rl2.IsRevoked("other", claims) {
+		t.Error("IsRevoked(other) = true, want false")
+	}
+}
+
+func TestRevokeCurrentSession(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	store := storage.New(t.TempDir(), mk)
+	tm, err := tokenmanager.New(store, nil, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	cm := New(tm, "idp", "example.com", "https://idp.example.com")
+
+	newReq := func(sid string) *http.Request {
+		recorder := httptest.NewRecorder()
+		if err := cm.SetAuthTokenCookie(recorder, "bob", "bob@example.com", sid, "example.com", nil); err != nil {
+			t.Fatalf("SetAuthTokenCookie: %v", err)
+		}
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		req.Header.Set("cookie", recorder.Header().Get("Set-Cookie"))
+		return req
+	}
+	req1 := newReq("session1")
+	req2 := newReq("session2")
+	req3 := newReq("session3")
+
+	if err := cm.RevokeCurrentSession(req1, false); err != nil {
+		t.Fatalf("RevokeCurrentSession: %v", err)
+	}
+	if _, err := cm.ValidateAuthTokenCookie(req1); err == nil {
+		t.Error("session1 is still valid")
+	}
+	if _, err := cm.ValidateAuthTokenCookie(req2); err != nil {
+		t.Errorf("session2: %v", err)
+	}
+
+	// Log out everywhere.
+	if err := cm.RevokeCurrentSession(req2, true); err != nil {
+		t.Fatalf("RevokeCurrentSession: %v", err)
+	}
+	if _, err := cm.ValidateAuthTokenCookie(req2); err == nil {
+		t.Error("session2 is still valid")
+	}
+	if _, err := cm.ValidateAuthTokenCookie(req3); err == nil {
+		t.Error("session3 is still valid")
+	}
+
+	// Requests without a valid cookie are ignored.
+	if err := cm.RevokeCurrentSession(httptest.NewRequest("GET", "https://example.com/", nil), true); err != nil {
+		t.Errorf("RevokeCurrentSession: %v", err)
+	}
+}
+
+func TestRevokeUser(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	store := storage.New(t.TempDir(), mk)
+	tm, err := tokenmanager.New(store, nil, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	rl := tm.Revocations()
+	cm1 := New(tm, "idp1", "example.com", "https://idp.example.com")
+	cm2 := New(tm, "idp2", "example.com", "https://idp.example.com")
+
+	newReq := func(cm *CookieManager, email string) *http.Request {
+		recorder := httptest.NewRecorder()
+		if err := cm.SetAuthTokenCookie(recorder, "id-"+email, email, "sid-"+email, "example.com", nil); err != nil {
+			t.Fatalf("SetAuthTokenCookie: %v", err)
+		}
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		req.Header.Set("cookie", recorder.Header().Get("Set-Cookie"))
+		return req
+	}
+	bob1 := newReq(cm1, "bob@example.com")
+	bob2 := newReq(cm2, "bob@example.com")
+	alice := newReq(cm1, "alice@example.com")
+
+	if err := rl.RevokeUser("bob@example.com"); err != nil {
+		t.Fatalf("RevokeUser: %v", err)
+	}
+	if _, err := cm1.ValidateAuthTokenCookie(bob1); err == nil {
+		t.Error("bob's idp1 session is still valid")
+	}
+	if _, err := cm2.ValidateAuthTokenCookie(bob2); err == nil {
+		t.Error("bob's idp2 session is still valid")
+	}
+	if _, err := cm1.ValidateAuthTokenCookie(alice); err != nil {
+		t.Errorf("alice's session: %v", err)
+	}
+	// Another instance that shares the same storage sees the revocation
+	// after reloading the list.
+	rl2, err := tokenmanager.NewRevocationList(store)
+	if err != nil {
+		t.Fatalf("NewRevocationList: %v", err)
+	}
+	if err := rl2.RevokeUser("alice@example.com"); err != nil {
+		t.Fatalf("RevokeUser: %v", err)
+	}
+	if _, err := cm1.ValidateAuthTokenCookie(alice); err != nil {
+		t.Errorf("alice's session before Reload: %v", err)
+	}
+	if err := rl.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, err := cm1.ValidateAuthTokenCookie(alice); err == nil {
+		t.Error("alice's session is still valid")
+	}
+}
+
+func TestIDTokenOptions(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	store := storage.New(t.TempDir(), mk)
+	tm, err := tokenmanager.New(store, nil, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	cm := New(tm, "idp", "example.com", "https://idp.example.com")
+
+	recorder := httptest.NewRecorder()
+	if err := cm.SetAuthTokenCookie(recorder, "bob", "bob@example.com", "session123", "example.com", nil); err != nil {
+		t.Fatalf("SetAuthTokenCookie: %v", err)
+	}
+	req := httptest.NewRequest("GET", "https://www.example.com/", nil)
+	req.Header.Set("cookie", recorder.Header().Get("Set-Cookie"))
+	authToken, err := cm.ValidateAuthTokenCookie(req)
+	if err != nil {
+		t.Fatalf("ValidateAuthTokenCookie: %v", err)
+	}
+
+	opts := IDTokenOptions{
+		Audience: []string{"my-app", "other-app"},
+		Lifetime: 5 * time.Minute,
+		Claims:   map[string]any{"tenant": "blue"},
+	}
+	recorder = httptest.NewRecorder()
+	if err := cm.SetIDTokenCookie(recorder, req, authToken, opts); err != nil {
+		t.Fatalf("SetIDTokenCookie: %v", err)
+	}
+	cookie := recorder.Result().Cookies()[0]
+	tok, err := tm.ValidateToken(cookie.Value, jwt.WithAudience("other-app"))
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	claims := tok.Claims.(jwt.MapClaims)
+	if got, want := claims["tenant"], "blue"; got != want {
+		t.Errorf("tenant = %v, want %v", got, want)
+	}
+	if exp, _ := claims.GetExpirationTime(); exp == nil || time.Until(exp.Time) > 5*time.Minute {
+		t.Errorf("exp = %v, want <= 5m", exp)
+	}
+
+	req.Header.Set("cookie", recorder.Header().Get("Set-Cookie"))
+	if err := cm.ValidateIDTokenCookie(req, authToken, opts); err != nil {
+		t.Errorf("ValidateIDTokenCookie: %v", err)
+	}
+	if err := cm.ValidateIDTokenCookie(req, authToken, IDTokenOptions{}); err == nil {
+		t.Error("ValidateIDTokenCookie with default audience succeeded")
+	}
 }
@@ -0,0 +1,356 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package ct verifies the Signed Certificate Timestamps (SCTs) of
+// certificates, as specified in RFC 6962 (Certificate Transparency).
+package ct
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// MinOperators is the minimum number of log operators that must have valid
+// SCTs for a certificate.
+const MinOperators = 2
+
+var (
+	oidExtensionSCT = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+	ErrNoChain      = errors.New("no verified chain")
+	ErrNotEnoughSCT = errors.New("not enough valid SCTs")
+)
+
+// LogList is a list of trusted Certificate Transparency logs.
+type LogList struct {
+	logs map[[32]byte]*ctLog
+}
+
+type ctLog struct {
+	operator string
+	key      crypto.PublicKey
+	// The log only accepts certificates that expire in [start, end).
+	start, end time.Time
+	// The SCTs issued after retired are not valid.
+	retired time.Time
+}
+
+// The JSON log list format used by Chrome, v3.
+// https://www.gstatic.com/ct/log_list/v3/log_list_schema.json
+type jsonLogList struct {
+	Operators []struct {
+		Name string `json:"name"`
+		Logs []struct {
+			Description string `json:"description"`
+			Key         []byte `json:"key"`
+			State       map[string]struct {
+				Timestamp time.Time `json:"timestamp"`
+			} `json:"state"`
+			TemporalInterval *struct {
+				StartInclusive time.Time `json:"start_inclusive"`
+				EndExclusive   time.Time `json:"end_exclusive"`
+			} `json:"temporal_interval"`
+		} `json:"logs"`
+	} `json:"operators"`
+}
+
+// ParseLogList parses a log list in the JSON format used by Chrome, e.g.
+// https://www.gstatic.com/ct/log_list/v3/log_list.json
+//
+// Only the logs that are qualified, usable, read-only, or retired are
+// trusted.
+func ParseLogList(b []byte) (*LogList, error) {
+	var in jsonLogList
+	if err := json.Unmarshal(b, &in); err != nil {
+		return nil, err
+	}
+	ll := &LogList{
+		logs: make(map[[32]byte]*ctLog),
+	}
+	for _, op := range in.Operators {
+		for _, l := range op.Logs {
+			log := &ctLog{
+				operator: op.Name,
+			}
+			var trusted bool
+			for state, v := range l.State {
+				switch state {
+				case "qualified", "usable", "readonly":
+					trusted = true
+				case "retired":
+					trusted = true
+					log.retired = v.Timestamp
+				}
+			}
+			if !trusted {
+				continue
+			}
+			key, err := x509.ParsePKIXPublicKey(l.Key)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", l.Description, err)
+			}
+			log.key = key
+			if ti := l.TemporalInterval; ti != nil {
+				log.start = ti.StartInclusive
+				log.end = ti.EndExclusive
+			}
+			ll.logs[sha256.Sum256(l.Key)] = log
+		}
+	}
+	if len(ll.logs) == 0 {
+		return nil, errors.New("no trusted logs")
+	}
+	return ll, nil
+}
+
+// Verify checks that the first certificate of chain has valid SCTs from at
+// least MinOperators different log operators. The SCTs can be embedded in
+// the certificate, or sent in the TLS handshake (tlsSCTs).
+func (ll *LogList) Verify(chain []*x509.Certificate, tlsSCTs [][]byte) error {
+	if len(chain) < 2 {
+		return ErrNoChain
+	}
+	cert, issuer := chain[0], chain[1]
+	now := time.Now()
+	operators := make(map[string]bool)
+
+	for _, sct := range tlsSCTs {
+		entry := x509Entry(cert.Raw)
+		if op, err := ll.verifySCT(cert, sct, entry, now); err == nil {
+			operators[op] = true
+		}
+	}
+	if embedded, err := embeddedSCTs(cert); err == nil && len(embedded) > 0 {
+		if entry, err := precertEntry(cert, issuer); err == nil {
+			for _, sct := range embedded {
+				if op, err := ll.verifySCT(cert, sct, entry, now); err == nil {
+					operators[op] = true
+				}
+			}
+		}
+	}
+	if len(operators) < MinOperators {
+		return fmt.Errorf("%w: %d operator(s), want %d", ErrNotEnoughSCT, len(operators), MinOperators)
+	}
+	return nil
+}
+
+// verifySCT verifies one serialized SCT, and returns the name of the log's
+// operator.
+func (ll *LogList) verifySCT(cert *x509.Certificate, sct []byte, entry []byte, now time.Time) (string, error) {
+	var (
+		s          = cryptobyte.String(sct)
+		version    uint8
+		logID      [32]byte
+		timestamp  uint64
+		extensions cryptobyte.String
+		hashAlg    uint8
+		sigAlg     uint8
+		sig        cryptobyte.String
+	)
+	if !s.ReadUint8(&version) || version != 0 ||
+		!s.CopyBytes(logID[:]) ||
+		!s.ReadUint64(&timestamp) ||
+		!s.ReadUint16LengthPrefixed(&extensions) ||
+		!s.ReadUint8(&hashAlg) ||
+		!s.ReadUint8(&sigAlg) ||
+		!s.ReadUint16LengthPrefixed(&sig) ||
+		!s.Empty() {
+		return "", errors.New("invalid SCT")
+	}
+	log, ok := ll.logs[logID]
+	if !ok {
+		return "", errors.New("unknown log")
+	}
+	ts := time.UnixMilli(int64(timestamp))
+	if ts.After(now) {
+		return "", errors.New("SCT timestamp in the future")
+	}
+	if !log.retired.IsZero() && !ts.Before(log.retired) {
+		return "", errors.New("SCT issued after the log was retired")
+	}
+	if !log.start.IsZero() && (cert.NotAfter.Before(log.start) || !cert.NotAfter.Before(log.end)) {
+		return "", errors.New("certificate outside of the log's temporal interval")
+	}
+
+	// https://www.rfc-editor.org/rfc/rfc6962#section-3.2
+	var b cryptobyte.Builder
+	b.AddUint8(0) // version: v1
+	b.AddUint8(0) // signature_type: certificate_timestamp
+	b.AddUint64(timestamp)
+	b.AddBytes(entry)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(extensions)
+	})
+	signed, err := b.Bytes()
+	if err != nil {
+		return "", err
+	}
+	if hashAlg != 4 { // sha256
+		return "", errors.New("unsupported hash algorithm")
+	}
+	hashed := sha256.Sum256(signed)
+	switch key := log.key.(type) {
+	case *ecdsa.PublicKey:
+		if sigAlg != 3 || !ecdsa.VerifyASN1(key, hashed[:], sig) {
+			return "", errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if sigAlg != 1 || rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig) != nil {
+			return "", errors.New("invalid signature")
+		}
+	default:
+		return "", errors.New("unsupported log key")
+	}
+	return log.operator, nil
+}
+
+// x509Entry returns the signed entry of an SCT that was sent in the TLS
+// handshake.
+func x509Entry(der []byte) []byte {
+	b := make([]byte, 5, 5+len(der))
+	binary.BigEndian.PutUint16(b, 0) // entry_type: x509_entry
+	b[2], b[3], b[4] = byte(len(der)>>16), byte(len(der)>>8), byte(len(der))
+	return append(b, der...)
+}
+
+// precertEntry returns the signed entry of an SCT that is embedded in cert,
+// i.e. the TBSCertificate without the SCT list extension.
+func precertEntry(cert, issuer *x509.Certificate) ([]byte, error) {
+	tbs, err := removeSCTExtension(cert.RawTBSCertificate)
+	if err != nil {
+		return nil, err
+	}
+	keyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	b := make([]byte, 2, 2+32+3+len(tbs))
+	binary.BigEndian.PutUint16(b, 1) // entry_type: precert_entry
+	b = append(b, keyHash[:]...)
+	b = append(b, byte(len(tbs)>>16), byte(len(tbs)>>8), byte(len(tbs)))
+	return append(b, tbs...), nil
+}
+
+// embeddedSCTs returns the SCTs from the certificate's SCT list extension.
+func embeddedSCTs(cert *x509.Certificate) ([][]byte, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidExtensionSCT) {
+			continue
+		}
+		var list []byte
+		if rest, err := asn1.Unmarshal(ext.Value, &list); err != nil || len(rest) > 0 {
+			return nil, errors.New("invalid SCT list extension")
+		}
+		s := cryptobyte.String(list)
+		var scts cryptobyte.String
+		if !s.ReadUint16LengthPrefixed(&scts) || !s.Empty() {
+			return nil, errors.New("invalid SCT list")
+		}
+		var out [][]byte
+		for !scts.Empty() {
+			var sct cryptobyte.String
+			if !scts.ReadUint16LengthPrefixed(&sct) {
+				return nil, errors.New("invalid SCT list")
+			}
+			out = append(out, sct)
+		}
+		return out, nil
+	}
+	return nil, nil
+}
+
+// removeSCTExtension re-encodes a TBSCertificate without the SCT list
+// extension.
+func removeSCTExtension(raw []byte) ([]byte, error) {
+	errInvalid := errors.New("invalid TBSCertificate")
+	in := cryptobyte.String(raw)
+	var tbs cryptobyte.String
+	if !in.ReadASN1(&tbs, cbasn1.SEQUENCE) || !in.Empty() {
+		return nil, errInvalid
+	}
+	extTag := cbasn1.Tag(3).Constructed().ContextSpecific()
+	var b cryptobyte.Builder
+	var outErr error
+	b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		for !tbs.Empty() {
+			var elem cryptobyte.String
+			var tag cbasn1.Tag
+			if !tbs.ReadAnyASN1Element(&elem, &tag) {
+				outErr = errInvalid
+				return
+			}
+			if tag != extTag {
+				b.AddBytes(elem)
+				continue
+			}
+			var exts, seq cryptobyte.String
+			if !elem.ReadASN1(&seq, extTag) || !seq.ReadASN1(&exts, cbasn1.SEQUENCE) {
+				outErr = errInvalid
+				return
+			}
+			b.AddASN1(extTag, func(b *cryptobyte.Builder) {
+				b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					for !exts.Empty() {
+						var ext, e cryptobyte.String
+						var oid asn1.ObjectIdentifier
+						if !exts.ReadASN1Element(&ext, cbasn1.SEQUENCE) {
+							outErr = errInvalid
+							return
+						}
+						e = ext
+						if !e.ReadASN1(&e, cbasn1.SEQUENCE) || !e.ReadASN1ObjectIdentifier(&oid) {
+							outErr = errInvalid
+							return
+						}
+						if oid.Equal(oidExtensionSCT) {
+							continue
+						}
+						b.AddBytes(ext)
+					}
+				})
+			})
+		}
+	})
+	if outErr != nil {
+		return nil, outErr
+	}
+	out, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(out, raw) {
+		return nil, errors.New("no SCT list extension")
+	}
+	return out, nil
+}
@@ -0,0 +1,217 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ct
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+type testLog struct {
+	operator string
+	key      *ecdsa.PrivateKey
+	id       [32]byte
+}
+
+func newTestLog(t *testing.T, operator string) *testLog {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("x509.MarshalPKIXPublicKey: %v", err)
+	}
+	return &testLog{operator: operator, key: key, id: sha256.Sum256(der)}
+}
+
+func (l *testLog) sct(t *testing.T, entry []byte) []byte {
+	ts := uint64(time.Now().Add(-time.Minute).UnixMilli())
+	var b cryptobyte.Builder
+	b.AddUint8(0)
+	b.AddUint8(0)
+	b.AddUint64(ts)
+	b.AddBytes(entry)
+	b.AddUint16(0)
+	hashed := sha256.Sum256(b.BytesOrPanic())
+	sig, err := ecdsa.SignASN1(rand.Reader, l.key, hashed[:])
+	if err != nil {
+		t.Fatalf("ecdsa.SignASN1: %v", err)
+	}
+	var out cryptobyte.Builder
+	out.AddUint8(0)
+	out.AddBytes(l.id[:])
+	out.AddUint64(ts)
+	out.AddUint16(0)
+	out.AddUint8(4)
+	out.AddUint8(3)
+	out.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(sig)
+	})
+	return out.BytesOrPanic()
+}
+
+func logList(t *testing.T, logs ...*testLog) *LogList {
+	type jsonLog struct {
+		Description string         `json:"description"`
+		Key         []byte         `json:"key"`
+		State       map[string]any `json:"state"`
+	}
+	type jsonOperator struct {
+		Name string    `json:"name"`
+		Logs []jsonLog `json:"logs"`
+	}
+	var in struct {
+		Operators []jsonOperator `json:"operators"`
+	}
+	for _, l := range logs {
+		der, err := x509.MarshalPKIXPublicKey(l.key.Public())
+		if err != nil {
+			t.Fatalf("x509.MarshalPKIXPublicKey: %v", err)
+		}
+		in.Operators = append(in.Operators, jsonOperator{
+			Name: l.operator,
+			Logs: []jsonLog{{
+				Description: l.operator + " log",
+				Key:         der,
+				State:       map[string]any{"usable": map[string]any{"timestamp": time.Now().Add(-time.Hour)}},
+			}},
+		})
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	ll, err := ParseLogList(b)
+	if err != nil {
+		t.Fatalf("ParseLogList: %v", err)
+	}
+	return ll
+}
+
+func createCert(t *testing.T, template, parent *x509.Certificate, pub crypto.PublicKey, priv crypto.Signer) *x509.Certificate {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, priv)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	return cert
+}
+
+func TestVerify(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	ca := createCert(t, caTemplate, caTemplate, caKey.Public(), caKey)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		DNSNames:     []string{"www.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	plain := createCert(t, template, ca, key.Public(), caKey)
+
+	log1 := newTestLog(t, "Operator 1")
+	log2 := newTestLog(t, "Operator 2")
+	log3 := newTestLog(t, "Operator 3")
+	ll := logList(t, log1, log2)
+
+	// SCTs from the TLS handshake.
+	entry := x509Entry(plain.Raw)
+	if err := ll.Verify([]*x509.Certificate{plain, ca}, [][]byte{log1.sct(t, entry), log2.sct(t, entry)}); err != nil {
+		t.Errorf("Verify(tls): %v", err)
+	}
+	if err := ll.Verify([]*x509.Certificate{plain, ca}, [][]byte{log1.sct(t, entry), log3.sct(t, entry)}); !errors.Is(err, ErrNotEnoughSCT) {
+		t.Errorf("Verify(unknown log) = %v, want ErrNotEnoughSCT", err)
+	}
+	if err := ll.Verify([]*x509.Certificate{plain, ca}, [][]byte{log1.sct(t, entry), log1.sct(t, entry)}); !errors.Is(err, ErrNotEnoughSCT) {
+		t.Errorf("Verify(same operator) = %v, want ErrNotEnoughSCT", err)
+	}
+	if err := ll.Verify([]*x509.Certificate{plain, ca}, nil); !errors.Is(err, ErrNotEnoughSCT) {
+		t.Errorf("Verify(no SCTs) = %v, want ErrNotEnoughSCT", err)
+	}
+
+	// Embedded SCTs. The precertificate's TBSCertificate is the same as
+	// the final certificate's without the SCT list extension.
+	keyHash := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	var pb cryptobyte.Builder
+	pb.AddUint16(1)
+	pb.AddBytes(keyHash[:])
+	pb.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(plain.RawTBSCertificate)
+	})
+	precert := pb.BytesOrPanic()
+	var lb cryptobyte.Builder
+	lb.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, l := range []*testLog{log1, log2} {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(l.sct(t, precert))
+			})
+		}
+	})
+	ext, err := asn1.Marshal(lb.BytesOrPanic())
+	if err != nil {
+		t.Fatalf("asn1.Marshal: %v", err)
+	}
+	template.ExtraExtensions = []pkix.Extension{{Id: oidExtensionSCT, Value: ext}}
+	withSCTs := createCert(t, template, ca, key.Public(), caKey)
+	if err := ll.Verify([]*x509.Certificate{withSCTs, ca}, nil); err != nil {
+		t.Errorf("Verify(embedded): %v", err)
+	}
+	if err := ll.Verify([]*x509.Certificate{withSCTs}, nil); !errors.Is(err, ErrNoChain) {
+		t.Errorf("Verify(no chain) = %v, want ErrNoChain", err)
+	}
+}
@@ -0,0 +1,120 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package histogram implements a latency histogram with logarithmic buckets.
+package histogram
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// minValue is the upper bound of the first bucket.
+	minValue = 100 * time.Microsecond
+	// bucketsPerDoubling is the number of buckets for each doubling of the
+	// latency, i.e. the bucket boundaries grow by a factor of 2^(1/4).
+	bucketsPerDoubling = 4
+	// numBuckets covers latencies up to about 2 minutes. Larger values are
+	// all in the last bucket.
+	numBuckets = 21*bucketsPerDoubling + 1
+)
+
+// Histogram records the distribution of durations. The zero value is ready to
+// use. All methods are safe for concurrent use.
+type Histogram struct {
+	mu     sync.Mutex
+	count  int64
+	max    time.Duration
+	counts [numBuckets]int64
+}
+
+// New returns a new Histogram.
+func New() *Histogram {
+	return &Histogram{}
+}
+
+// Add records one duration.
+func (h *Histogram) Add(d time.Duration) {
+	if h == nil {
+		return
+	}
+	i := bucket(d)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count++
+	h.counts[i]++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// Count returns the number of recorded durations.
+func (h *Histogram) Count() int64 {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// Percentile returns an upper bound of the p-th percentile, 0 < p <= 100, of
+// the recorded durations. The value is accurate within about 20%.
+func (h *Histogram) Percentile(p float64) time.Duration {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(float64(h.count) * p / 100))
+	if rank < 1 {
+		rank = 1
+	}
+	var n int64
+	for i, c := range h.counts {
+		if n += c; n >= rank {
+			return min(upperBound(i), h.max)
+		}
+	}
+	return h.max
+}
+
+func bucket(d time.Duration) int {
+	if d <= minValue {
+		return 0
+	}
+	i := int(math.Ceil(bucketsPerDoubling * math.Log2(float64(d)/float64(minValue))))
+	return min(i, numBuckets-1)
+}
+
+func upperBound(i int) time.Duration {
+	if i == numBuckets-1 {
+		return math.MaxInt64
+	}
+	return time.Duration(float64(minValue) * math.Exp2(float64(i)/bucketsPerDoubling))
+}
@@ -0,0 +1,72 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package histogram
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := New()
+	if got := h.Percentile(50); got != 0 {
+		t.Errorf("Percentile(50) = %s, want 0", got)
+	}
+	for i := 1; i <= 1000; i++ {
+		h.Add(time.Duration(i) * time.Millisecond)
+	}
+	if got, want := h.Count(), int64(1000); got != want {
+		t.Errorf("Count() = %d, want %d", got, want)
+	}
+	for _, tc := range []struct {
+		p    float64
+		want time.Duration
+	}{
+		{50, 500 * time.Millisecond},
+		{95, 950 * time.Millisecond},
+		{99, 990 * time.Millisecond},
+		{100, time.Second},
+	} {
+		got := h.Percentile(tc.p)
+		if got < tc.want || got > tc.want*6/5 {
+			t.Errorf("Percentile(%v) = %s, want ~%s", tc.p, got, tc.want)
+		}
+	}
+
+	h = New()
+	h.Add(0)
+	h.Add(time.Hour)
+	if got, want := h.Percentile(50), minValue; got != want {
+		t.Errorf("Percentile(50) = %s, want %s", got, want)
+	}
+	if got, want := h.Percentile(100), time.Hour; got != want {
+		t.Errorf("Percentile(100) = %s, want %s", got, want)
+	}
+
+	var nilHist *Histogram
+	nilHist.Add(time.Second)
+	if got := nilHist.Count(); got != 0 {
+		t.Errorf("Count() = %d, want 0", got)
+	}
+}
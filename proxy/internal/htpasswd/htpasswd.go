@@ -0,0 +1,231 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package htpasswd implements an identity provider that authenticates users
+// with the usernames and password hashes in an htpasswd-style file.
+//
+// Each line of the file has the format username:hash. The supported hashes
+// are bcrypt, e.g. from htpasswd -B, and argon2id or argon2i in the PHC
+// string format, e.g. $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+package htpasswd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/loginform"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/totp"
+)
+
+var (
+	// dummyHash is used to spend the same amount of time verifying the
+	// password of users that don't exist.
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// Config contains the parameters of the password identity provider.
+type Config struct {
+	// Endpoint is the URL of the login form served by the proxy.
+	Endpoint string
+	// File is the name of the htpasswd file. It is reloaded automatically
+	// when it changes.
+	File string
+	// TOTP, if set, is used to verify a second authentication factor.
+	TOTP *totp.Manager
+	// Logger is used to log errors.
+	Logger loginform.Logger
+}
+
+// Provider is a password identity provider.
+type Provider struct {
+	*loginform.Form
+	cfg Config
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	users   map[string]string
+}
+
+// New returns a new password identity provider.
+func New(cfg Config, er loginform.EventRecorder, cm loginform.CookieManager) (*Provider, error) {
+	p := &Provider{
+		cfg: cfg,
+	}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	form, err := loginform.New(loginform.Config{
+		Type:         "password",
+		Endpoint:     cfg.Endpoint,
+		Authenticate: p.authenticate,
+		TOTP:         cfg.TOTP,
+		Logger:       cfg.Logger,
+	}, er, cm)
+	if err != nil {
+		return nil, err
+	}
+	p.Form = form
+	return p, nil
+}
+
+// reload reads the password file again if it changed.
+func (p *Provider) reload() error {
+	fi, err := os.Stat(p.cfg.File)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.users != nil && fi.ModTime().Equal(p.modTime) && fi.Size() == p.size {
+		return nil
+	}
+	b, err := os.ReadFile(p.cfg.File)
+	if err != nil {
+		return err
+	}
+	users, err := parse(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.cfg.File, err)
+	}
+	p.users = users
+	p.modTime = fi.ModTime()
+	p.size = fi.Size()
+	return nil
+}
+
+func parse(b []byte) (map[string]string, error) {
+	users := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: invalid format", n)
+		}
+		if !isSupported(hash) {
+			return nil, fmt.Errorf("line %d: unsupported hash for %q", n, user)
+		}
+		users[user] = hash
+	}
+	return users, s.Err()
+}
+
+func isSupported(hash string) bool {
+	for _, p := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$", "$argon2i$"} {
+		if strings.HasPrefix(hash, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Provider) authenticate(username, password string) (*loginform.User, error) {
+	if err := p.reload(); err != nil {
+		p.Logger().Errorf("password file: %v", err)
+	}
+	p.mu.Lock()
+	hash, exists := p.users[username]
+	p.mu.Unlock()
+
+	if !exists {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, loginform.ErrInvalidCredentials
+	}
+	ok, err := verify(hash, password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, loginform.ErrInvalidCredentials
+	}
+	return &loginform.User{
+		ID:    username,
+		Email: username,
+	}, nil
+}
+
+func verify(hash, password string) (bool, error) {
+	if strings.HasPrefix(hash, "$argon2") {
+		return verifyArgon2(hash, password)
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// verifyArgon2 verifies a password against an argon2 hash in the PHC string
+// format.
+func verifyArgon2(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, errors.New("invalid argon2 hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.New("unsupported argon2 version")
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+	if iterations == 0 || threads == 0 {
+		return false, errors.New("invalid argon2 parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 hash: %w", err)
+	}
+	var got []byte
+	if parts[1] == "argon2id" {
+		got = argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(want)))
+	} else {
+		got = argon2.Key([]byte(password), salt, iterations, memory, threads, uint32(len(want)))
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
@@ -0,0 +1,109 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package htpasswd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/loginform"
+)
+
+func TestAuthenticate(t *testing.T) {
+	bobHash, err := bcrypt.GenerateFromPassword([]byte("bobpw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt: %v", err)
+	}
+	salt := []byte("0123456789abcdef")
+	aliceHash := fmt.Sprintf("$argon2id$v=19$m=1024,t=1,p=1$%s$%s",
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("alicepw"), salt, 1, 1024, 1, 32)),
+	)
+
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	content := "# comment\nbob@example.com:" + string(bobHash) + "\nalice@example.com:" + aliceHash + "\n"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	p, err := New(Config{Endpoint: "https://login.example.com/password", File: file}, nil, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	for _, tc := range []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"bob@example.com", "bobpw", true},
+		{"bob@example.com", "alicepw", false},
+		{"alice@example.com", "alicepw", true},
+		{"alice@example.com", "bobpw", false},
+		{"carol@example.com", "carolpw", false},
+	} {
+		user, err := p.authenticate(tc.username, tc.password)
+		if tc.ok {
+			if err != nil {
+				t.Errorf("authenticate(%q, %q) = %v", tc.username, tc.password, err)
+			} else if user.Email != tc.username {
+				t.Errorf("Email = %q, want %q", user.Email, tc.username)
+			}
+			continue
+		}
+		if err != loginform.ErrInvalidCredentials {
+			t.Errorf("authenticate(%q, %q) = %v, want ErrInvalidCredentials", tc.username, tc.password, err)
+		}
+	}
+
+	// The file is reloaded when it changes.
+	if err := os.WriteFile(file, []byte("carol@example.com:"+string(bobHash)+"\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	os.Chtimes(file, time.Time{}, time.Now().Add(time.Minute))
+	if _, err := p.authenticate("carol@example.com", "bobpw"); err != nil {
+		t.Errorf("authenticate(carol) = %v", err)
+	}
+	if _, err := p.authenticate("bob@example.com", "bobpw"); err != loginform.ErrInvalidCredentials {
+		t.Errorf("authenticate(bob) = %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, content := range []string{
+		"bob",
+		":$2y$05$abc",
+		"bob:plaintext",
+		"bob:$apr1$abc$def",
+	} {
+		if _, err := parse([]byte(content)); err == nil {
+			t.Errorf("parse(%q) didn't fail", content)
+		}
+	}
+}
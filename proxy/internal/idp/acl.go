@@ -0,0 +1,71 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package idp
+
+import (
+	"strings"
+)
+
+// MatchACL returns true if the user identified by claims matches any of the
+// ACL entries. The entries can be:
+//   - an email address, e.g. bob@example.com
+//   - an email domain, e.g. @example.com
+//   - a group, e.g. group:engineering, matched against the "groups" claim
+//   - a role, e.g. role:admin, matched against the "roles" claim
+func MatchACL(acl []string, claims map[string]any) bool {
+	email, _ := claims["email"].(string)
+	_, domain, _ := strings.Cut(email, "@")
+	for _, a := range acl {
+		if email != "" && (a == email || a == "@"+domain) {
+			return true
+		}
+		if g, ok := strings.CutPrefix(a, "group:"); ok && claimContains(claims["groups"], g) {
+			return true
+		}
+		if r, ok := strings.CutPrefix(a, "role:"); ok && claimContains(claims["roles"], r) {
+			return true
+		}
+	}
+	return false
+}
+
+func claimContains(v any, s string) bool {
+	switch v := v.(type) {
+	case string:
+		return v == s
+	case []string:
+		for _, e := range v {
+			if e == s {
+				return true
+			}
+		}
+	case []any:
+		for _, e := range v {
+			if e == s {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package idp
+
+import (
+	"testing"
+)
+
+func TestMatchACL(t *testing.T) {
+	claims := map[string]any{
+		"email":  "bob@example.com",
+		"groups": []any{"engineering", "oncall"},
+		"roles":  "admin",
+	}
+	for _, tc := range []struct {
+		acl  []string
+		want bool
+	}{
+		{nil, false},
+		{[]string{"bob@example.com"}, true},
+		{[]string{"alice@example.com"}, false},
+		{[]string{"@example.com"}, true},
+		{[]string{"@example.org"}, false},
+		{[]string{"group:engineering"}, true},
+		{[]string{"group:sales"}, false},
+		{[]string{"group:admin"}, false},
+		{[]string{"role:admin"}, true},
+		{[]string{"role:engineering"}, false},
+		{[]string{"alice@example.com", "group:oncall"}, true},
+	} {
+		if got := MatchACL(tc.acl, claims); got != tc.want {
+			t.Errorf("MatchACL(%q) = %v, want %v", tc.acl, got, tc.want)
+		}
+	}
+	if MatchACL([]string{"@"}, map[string]any{}) {
+		t.Error("MatchACL matched empty email")
+	}
+}
@@ -0,0 +1,277 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package ldap implements an identity provider that authenticates users
+// against an LDAP directory, e.g. Active Directory, with a login form served
+// by the proxy.
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/loginform"
+)
+
+const (
+	defaultUserFilter     = "(uid={username})"
+	defaultEmailAttribute = "mail"
+	defaultGroupFilter    = "(member={dn})"
+	defaultGroupAttribute = "cn"
+
+	requestTimeout = 10 * time.Second
+)
+
+// Config contains the parameters of the LDAP identity provider.
+type Config struct {
+	// Endpoint is the URL of the login form served by the proxy.
+	Endpoint string
+	// ServerURL is the URL of the LDAP server, e.g. ldaps://ldap.example.com
+	ServerURL string
+	// StartTLS indicates that the connection should be upgraded to TLS
+	// with the StartTLS operation. It is only used with ldap:// URLs.
+	StartTLS bool
+	// RootCAs are the PEM-encoded CA certificates, or the name of a file
+	// that contains them, used to verify the server's certificate. When
+	// empty, the system's root CAs are used.
+	RootCAs string
+	// InsecureSkipVerify disables verification of the server's certificate.
+	InsecureSkipVerify bool
+	// BindDN and BindPassword are the credentials of the service account
+	// used to search the directory. When BindDN is empty, searches are
+	// anonymous.
+	BindDN       string
+	BindPassword string
+	// UserBaseDN is where to search for users.
+	UserBaseDN string
+	// UserFilter is the filter used to find users. The string {username}
+	// is replaced with the escaped username.
+	UserFilter string
+	// EmailAttribute is the user attribute that contains the email
+	// address. Users without this attribute can't log in.
+	EmailAttribute string
+	// GroupBaseDN is where to search for groups. When empty, groups are
+	// not searched.
+	GroupBaseDN string
+	// GroupFilter is the filter used to find the groups of a user. The
+	// strings {dn} and {username} are replaced with the escaped user DN
+	// and username.
+	GroupFilter string
+	// GroupAttribute is the group attribute that contains the group name.
+	GroupAttribute string
+	// Logger is used to log errors.
+	Logger loginform.Logger
+}
+
+// Provider is an LDAP identity provider.
+type Provider struct {
+	*loginform.Form
+	cfg       Config
+	tlsConfig *tls.Config
+	dial      func() (conn, error)
+}
+
+// conn is the subset of *goldap.Conn used by the provider.
+type conn interface {
+	Bind(username, password string) error
+	Search(*goldap.SearchRequest) (*goldap.SearchResult, error)
+	Close() error
+}
+
+// New returns a new LDAP identity provider.
+func New(cfg Config, er loginform.EventRecorder, cm loginform.CookieManager) (*Provider, error) {
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = defaultUserFilter
+	}
+	if cfg.EmailAttribute == "" {
+		cfg.EmailAttribute = defaultEmailAttribute
+	}
+	if cfg.GroupFilter == "" {
+		cfg.GroupFilter = defaultGroupFilter
+	}
+	if cfg.GroupAttribute == "" {
+		cfg.GroupAttribute = defaultGroupAttribute
+	}
+	su, err := url.Parse(cfg.ServerURL)
+	if err != nil {
+		return nil, fmt.Errorf("ServerURL: %w", err)
+	}
+	p := &Provider{
+		cfg: cfg,
+		tlsConfig: &tls.Config{
+			ServerName:         su.Hostname(),
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+		},
+	}
+	if cfg.RootCAs != "" {
+		b, err := readFile(cfg.RootCAs)
+		if err != nil {
+			return nil, fmt.Errorf("RootCAs: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("RootCAs: no certificates found")
+		}
+		p.tlsConfig.RootCAs = pool
+	}
+	p.dial = p.dialServer
+	form, err := loginform.New(loginform.Config{
+		Type:         "ldap",
+		Endpoint:     cfg.Endpoint,
+		Authenticate: p.authenticate,
+		Logger:       cfg.Logger,
+	}, er, cm)
+	if err != nil {
+		return nil, err
+	}
+	p.Form = form
+	return p, nil
+}
+
+func (p *Provider) dialServer() (conn, error) {
+	c, err := goldap.DialURL(p.cfg.ServerURL,
+		goldap.DialWithTLSConfig(p.tlsConfig),
+		goldap.DialWithDialer(&net.Dialer{Timeout: requestTimeout}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	c.SetTimeout(requestTimeout)
+	if p.cfg.StartTLS && !strings.HasPrefix(p.cfg.ServerURL, "ldaps:") {
+		if err := c.StartTLS(p.tlsConfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// authenticate verifies the user's credentials. The user entry is found with
+// the service account, and the password is verified by binding as the user.
+func (p *Provider) authenticate(username, password string) (*loginform.User, error) {
+	if password == "" {
+		// An empty password would be an unauthenticated bind, which
+		// most servers accept.
+		return nil, loginform.ErrInvalidCredentials
+	}
+	c, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if err := p.bindServiceAccount(c); err != nil {
+		return nil, err
+	}
+	res, err := c.Search(goldap.NewSearchRequest(
+		p.cfg.UserBaseDN,
+		goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 2, int(requestTimeout/time.Second), false,
+		expandFilter(p.cfg.UserFilter, username, ""),
+		[]string{p.cfg.EmailAttribute},
+		nil,
+	))
+	if err != nil && !goldap.IsErrorWithCode(err, goldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("user search: %w", err)
+	}
+	if res == nil || len(res.Entries) != 1 {
+		return nil, loginform.ErrInvalidCredentials
+	}
+	user := &loginform.User{
+		ID:    res.Entries[0].DN,
+		Email: res.Entries[0].GetAttributeValue(p.cfg.EmailAttribute),
+		Claims: map[string]any{
+			"name": username,
+		},
+	}
+	if err := c.Bind(user.ID, password); err != nil {
+		if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+			return nil, loginform.ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("user bind: %w", err)
+	}
+	if user.Email == "" {
+		// The email address is what the ACLs match. The username
+		// isn't a substitute for it.
+		return nil, fmt.Errorf("user %s has no %s attribute", user.ID, p.cfg.EmailAttribute)
+	}
+
+	if p.cfg.GroupBaseDN == "" {
+		return user, nil
+	}
+	if err := p.bindServiceAccount(c); err != nil {
+		return nil, err
+	}
+	res, err = c.Search(goldap.NewSearchRequest(
+		p.cfg.GroupBaseDN,
+		goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 0, int(requestTimeout/time.Second), false,
+		expandFilter(p.cfg.GroupFilter, username, user.ID),
+		[]string{p.cfg.GroupAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("group search: %w", err)
+	}
+	var groups []string
+	for _, e := range res.Entries {
+		if g := e.GetAttributeValue(p.cfg.GroupAttribute); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	if len(groups) > 0 {
+		user.Claims["groups"] = groups
+	}
+	return user, nil
+}
+
+func (p *Provider) bindServiceAccount(c conn) error {
+	if p.cfg.BindDN == "" {
+		return nil
+	}
+	if err := c.Bind(p.cfg.BindDN, p.cfg.BindPassword); err != nil {
+		return fmt.Errorf("service account bind: %w", err)
+	}
+	return nil
+}
+
+func expandFilter(filter, username, dn string) string {
+	return strings.NewReplacer(
+		"{username}", goldap.EscapeFilter(username),
+		"{dn}", goldap.EscapeFilter(dn),
+	).Replace(filter)
+}
+
+func readFile(s string) ([]byte, error) {
+	if len(s) > 0 && s[0] == '/' {
+		return os.ReadFile(s)
+	}
+	return []byte(s), nil
+}
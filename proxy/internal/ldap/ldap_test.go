@@ -0,0 +1,139 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ldap
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	goldap "github.com/go-ldap/ldap/v3"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/loginform"
+)
+
+// fakeConn is a tiny in-memory directory.
+type fakeConn struct {
+	passwords map[string]string
+	entries   []*goldap.Entry
+	filters   []string
+}
+
+func (c *fakeConn) Bind(username, password string) error {
+	if pw, ok := c.passwords[username]; !ok || pw != password {
+		return goldap.NewError(goldap.LDAPResultInvalidCredentials, nil)
+	}
+	return nil
+}
+
+func (c *fakeConn) Search(req *goldap.SearchRequest) (*goldap.SearchResult, error) {
+	c.filters = append(c.filters, req.Filter)
+	res := &goldap.SearchResult{}
+	for _, e := range c.entries {
+		if !strings.HasSuffix(e.DN, req.BaseDN) {
+			continue
+		}
+		// Only equality filters on a single attribute are supported.
+		attr, value, _ := strings.Cut(strings.Trim(req.Filter, "()"), "=")
+		if slices.Contains(e.GetAttributeValues(attr), value) {
+			res.Entries = append(res.Entries, e)
+		}
+	}
+	return res, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	fc := &fakeConn{
+		passwords: map[string]string{
+			"cn=svc,dc=example,dc=com":            "svcpw",
+			"uid=bob,ou=people,dc=example,dc=com": "bobpw",
+			"uid=eve,ou=people,dc=example,dc=com": "evepw",
+		},
+		entries: []*goldap.Entry{
+			goldap.NewEntry("uid=bob,ou=people,dc=example,dc=com", map[string][]string{
+				"uid":  {"bob"},
+				"mail": {"bob@example.com"},
+			}),
+			goldap.NewEntry("uid=eve,ou=people,dc=example,dc=com", map[string][]string{
+				"uid": {"eve"},
+			}),
+			goldap.NewEntry("cn=eng,ou=groups,dc=example,dc=com", map[string][]string{
+				"cn":     {"eng"},
+				"member": {"uid=bob,ou=people,dc=example,dc=com"},
+			}),
+			goldap.NewEntry("cn=ops,ou=groups,dc=example,dc=com", map[string][]string{
+				"cn":     {"ops"},
+				"member": {"uid=alice,ou=people,dc=example,dc=com"},
+			}),
+		},
+	}
+	p, err := New(Config{
+		Endpoint:     "https://login.example.com/ldap",
+		ServerURL:    "ldaps://ldap.example.com",
+		BindDN:       "cn=svc,dc=example,dc=com",
+		BindPassword: "svcpw",
+		UserBaseDN:   "ou=people,dc=example,dc=com",
+		GroupBaseDN:  "ou=groups,dc=example,dc=com",
+	}, nil, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	p.dial = func() (conn, error) { return fc, nil }
+
+	for _, tc := range []struct{ username, password string }{
+		{"bob", "wrong"},
+		{"bob", ""},
+		{"alice", "bobpw"},
+		{"*", "bobpw"},
+	} {
+		if _, err := p.authenticate(tc.username, tc.password); err != loginform.ErrInvalidCredentials {
+			t.Errorf("authenticate(%q, %q) = %v, want ErrInvalidCredentials", tc.username, tc.password, err)
+		}
+	}
+	if !slices.Contains(fc.filters, `(uid=\2a)`) {
+		t.Errorf("filters = %q, want escaped username", fc.filters)
+	}
+
+	if user, err := p.authenticate("eve", "evepw"); err == nil || err == loginform.ErrInvalidCredentials {
+		t.Errorf("authenticate(eve) = %v, %v, want missing email error", user, err)
+	}
+
+	user, err := p.authenticate("bob", "bobpw")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if got, want := user.ID, "uid=bob,ou=people,dc=example,dc=com"; got != want {
+		t.Errorf("ID = %q, want %q", got, want)
+	}
+	if got, want := user.Email, "bob@example.com"; got != want {
+		t.Errorf("Email = %q, want %q", got, want)
+	}
+	if got, want := user.Claims["groups"], []string{"eng"}; !slices.Equal(got.([]string), want) {
+		t.Errorf("groups = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,325 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package loginform implements the login form used by identity providers
+// that authenticate users with a username and password.
+package loginform
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/time/rate"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/idp"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/ratelimit"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/totp"
+)
+
+const (
+	stateTTL = 10 * time.Minute
+	// maxStates is the maximum number of pending logins. When this limit
+	// is reached, the oldest ones are forgotten.
+	maxStates = 10000
+
+	// Login attempts are limited for each username and for each client IP
+	// address. The client IP address gets a larger burst because many
+	// users can be behind the same NAT.
+	userAttemptsBurst  = 5
+	userAttemptsPeriod = time.Minute
+	ipAttemptsBurst    = 20
+	ipAttemptsPeriod   = 10 * time.Second
+)
+
+var (
+	//go:embed login-template.html
+	loginEmbed    string
+	loginTemplate *template.Template
+
+	// ErrInvalidCredentials is returned by Authenticate functions when the
+	// username or password is incorrect.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+
+	// failureDelay slows down password guessing.
+	failureDelay = time.Second
+)
+
+func init() {
+	loginTemplate = template.Must(template.New("login").Parse(loginEmbed))
+}
+
+type CookieManager interface {
+	SetAuthTokenCookie(w http.ResponseWriter, userID, email, sessionID, host string, extraClaims map[string]any) error
+}
+
+type EventRecorder interface {
+	Record(string)
+}
+
+// Logger is used to log errors.
+type Logger interface {
+	Errorf(format string, args ...any)
+}
+
+type defaultLogger struct{}
+
+func (defaultLogger) Errorf(format string, args ...any) {
+	log.Printf("ERR "+format, args...)
+}
+
+// User is an authenticated user.
+type User struct {
+	// ID is the user's unique identifier, i.e. the "sub" claim.
+	ID string
+	// Email is the user's email address.
+	Email string
+	// Claims are extra claims to add to the user's auth token.
+	Claims map[string]any
+}
+
+// Config contains the parameters of a login form.
+type Config struct {
+	// Type is the type of identity provider, e.g. ldap. It is used in
+	// events and log messages.
+	Type string
+	// Endpoint is the URL where the login form is served.
+	Endpoint string
+	// Authenticate verifies the user's credentials. It returns
+	// ErrInvalidCredentials when they are incorrect.
+	Authenticate func(username, password string) (*User, error)
+	// TOTP, if set, is used to verify a second authentication factor.
+	TOTP *totp.Manager
+	// Logger is used to log errors. The default is to use the log
+	// package.
+	Logger Logger
+}
+
+// Form is an identity provider that authenticates users with a login form.
+type Form struct {
+	cfg         Config
+	er          EventRecorder
+	cm          CookieManager
+	userLimiter *ratelimit.Limiter
+	ipLimiter   *ratelimit.Limiter
+
+	mu     sync.Mutex
+	states *lru.Cache[string, *loginState]
+}
+
+type loginState struct {
+	created time.Time
+	origURL *url.URL
+}
+
+// New returns a new login form.
+func New(cfg Config, er EventRecorder, cm CookieManager) (*Form, error) {
+	if _, err := url.Parse(cfg.Endpoint); err != nil {
+		return nil, fmt.Errorf("Endpoint: %w", err)
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = defaultLogger{}
+	}
+	states, err := lru.New[string, *loginState](maxStates)
+	if err != nil {
+		return nil, err
+	}
+	return &Form{
+		cfg:         cfg,
+		er:          er,
+		cm:          cm,
+		userLimiter: ratelimit.New(rate.Every(userAttemptsPeriod), userAttemptsBurst, 0),
+		ipLimiter:   ratelimit.New(rate.Every(ipAttemptsPeriod), ipAttemptsBurst, 0),
+		states:      states,
+	}, nil
+}
+
+// Logger returns the form's logger.
+func (f *Form) Logger() Logger {
+	return f.cfg.Logger
+}
+
+func (f *Form) RequestLogin(w http.ResponseWriter, req *http.Request, origURL string, opts ...idp.Option) {
+	ou, err := url.Parse(origURL)
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	state := hex.EncodeToString(b[:])
+
+	f.mu.Lock()
+	f.states.Add(state, &loginState{
+		created: time.Now(),
+		origURL: ou,
+	})
+	f.mu.Unlock()
+
+	u, err := url.Parse(f.cfg.Endpoint)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	q := u.Query()
+	q.Set("state", state)
+	if hint := idp.ApplyOptions(opts).LoginHint(); hint != "" {
+		q.Set("username", hint)
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, req, u.String(), http.StatusFound)
+	f.er.Record(f.cfg.Type + " auth request")
+}
+
+func (f *Form) HandleCallback(w http.ResponseWriter, req *http.Request) {
+	if f.cfg.TOTP != nil && f.cfg.TOTP.HandleRequest(w, req) {
+		return
+	}
+	req.ParseForm()
+	stateID := req.Form.Get("state")
+
+	f.mu.Lock()
+	state, ok := f.states.Peek(stateID)
+	if ok && time.Since(state.created) > stateTTL {
+		f.states.Remove(stateID)
+		ok = false
+	}
+	f.mu.Unlock()
+	if !ok {
+		http.Error(w, "invalid or expired request", http.StatusBadRequest)
+		return
+	}
+
+	data := struct {
+		Self       string
+		State      string
+		DisplayURL string
+		Username   string
+		Error      string
+	}{
+		Self:       req.URL.Path,
+		State:      stateID,
+		DisplayURL: state.origURL.String(),
+		Username:   req.Form.Get("username"),
+	}
+	if len(data.DisplayURL) > 100 {
+		data.DisplayURL = data.DisplayURL[:97] + "..."
+	}
+	w.Header().Set("X-Frame-Options", "DENY")
+
+	if req.Method == http.MethodPost {
+		f.er.Record(f.cfg.Type + " auth callback")
+		username := strings.TrimSpace(req.PostForm.Get("username"))
+		password := req.PostForm.Get("password")
+		if username != "" && password != "" {
+			if retryAfter, ok := f.allowAttempt(req, username); !ok {
+				f.er.Record(f.cfg.Type + " auth rate limited")
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+				data.Error = "Too many login attempts. Try again later."
+				w.WriteHeader(http.StatusTooManyRequests)
+				if err := loginTemplate.Execute(w, data); err != nil {
+					f.cfg.Logger.Errorf("login-template: %v", err)
+				}
+				return
+			}
+		}
+		var user *User
+		err := ErrInvalidCredentials
+		if username != "" && password != "" {
+			user, err = f.cfg.Authenticate(username, password)
+		}
+		if err == nil {
+			f.mu.Lock()
+			f.states.Remove(stateID)
+			f.mu.Unlock()
+			if f.cfg.TOTP == nil {
+				f.setAuthToken(w, req, state, user)
+				return
+			}
+			id, err := f.cfg.TOTP.Challenge(user.ID, func(w http.ResponseWriter, req *http.Request) {
+				f.setAuthToken(w, req, state, user)
+			})
+			if err != nil {
+				f.cfg.Logger.Errorf("%s TOTP: %v", f.cfg.Type, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, req, req.URL.Path+"?totp="+id, http.StatusSeeOther)
+			return
+		}
+		if err != ErrInvalidCredentials {
+			f.cfg.Logger.Errorf("%s %q: %v", f.cfg.Type, username, err)
+		}
+		f.er.Record(f.cfg.Type + " auth failed")
+		time.Sleep(failureDelay)
+		data.Error = "Invalid username or password"
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	if err := loginTemplate.Execute(w, data); err != nil {
+		f.cfg.Logger.Errorf("login-template: %v", err)
+	}
+}
+
+// allowAttempt applies the rate limits of the login attempts for the username
+// and for the client's IP address. When the attempt isn't allowed, it returns
+// how long to wait before trying again.
+func (f *Form) allowAttempt(req *http.Request, username string) (time.Duration, bool) {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if d, ok := f.ipLimiter.Check(ip); !ok {
+		return d, false
+	}
+	return f.userLimiter.Check(strings.ToLower(username))
+}
+
+func (f *Form) setAuthToken(w http.ResponseWriter, req *http.Request, state *loginState, user *User) {
+	var sid [16]byte
+	if _, err := io.ReadFull(rand.Reader, sid[:]); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := f.cm.SetAuthTokenCookie(w, user.ID, user.Email, hex.EncodeToString(sid[:]), state.origURL.Host, user.Claims); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, state.origURL.String(), http.StatusSeeOther)
+}
@@ -0,0 +1,299 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package loginform
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/totp"
+)
+
+type fakeCookieManager struct {
+	userID string
+	email  string
+	host   string
+	claims map[string]any
+}
+
+func (cm *fakeCookieManager) SetAuthTokenCookie(w http.ResponseWriter, userID, email, sessionID, host string, extraClaims map[string]any) error {
+	cm.userID = userID
+	cm.email = email
+	cm.host = host
+	cm.claims = extraClaims
+	return nil
+}
+
+type nopRecorder struct{}
+
+func (nopRecorder) Record(string) {}
+
+func TestLoginForm(t *testing.T) {
+	failureDelay = 0
+	cm := &fakeCookieManager{}
+	f, err := New(Config{
+		Type:     "test",
+		Endpoint: "https://login.example.com/login",
+		Authenticate: func(username, password string) (*User, error) {
+			if username != "bob" || password != "secret" {
+				return nil, ErrInvalidCredentials
+			}
+			return &User{ID: "bob", Email: "bob@example.com", Claims: map[string]any{"foo": "bar"}}, nil
+		},
+	}, nopRecorder{}, cm)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	f.RequestLogin(w, httptest.NewRequest("GET", "https://www.example.com/foo", nil), "https://www.example.com/foo")
+	if got, want := w.Code, http.StatusFound; got != want {
+		t.Fatalf("RequestLogin: status = %d, want %d", got, want)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Location: %v", err)
+	}
+	state := loc.Query().Get("state")
+
+	w = httptest.NewRecorder()
+	f.HandleCallback(w, httptest.NewRequest("GET", loc.String(), nil))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("GET form: status = %d, want %d", got, want)
+	}
+	if body := w.Body.String(); !strings.Contains(body, state) {
+		t.Errorf("GET form: body doesn't contain state: %s", body)
+	}
+
+	post := func(username, password string) *httptest.ResponseRecorder {
+		form := url.Values{}
+		form.Set("state", state)
+		form.Set("username", username)
+		form.Set("password", password)
+		req := httptest.NewRequest("POST", "https://login.example.com/login", strings.NewReader(form.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		f.HandleCallback(w, req)
+		return w
+	}
+
+	for _, tc := range []struct{ username, password string }{
+		{"bob", "wrong"},
+		{"bob", ""},
+		{"", "secret"},
+	} {
+		if got, want := post(tc.username, tc.password).Code, http.StatusUnauthorized; got != want {
+			t.Errorf("POST(%q, %q): status = %d, want %d", tc.username, tc.password, got, want)
+		}
+	}
+
+	w = post("bob", "secret")
+	if got, want := w.Code, http.StatusSeeOther; got != want {
+		t.Fatalf("POST: status = %d, want %d", got, want)
+	}
+	if got, want := w.Header().Get("Location"), "https://www.example.com/foo"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+	if got, want := cm.userID, "bob"; got != want {
+		t.Errorf("userID = %q, want %q", got, want)
+	}
+	if got, want := cm.email, "bob@example.com"; got != want {
+		t.Errorf("email = %q, want %q", got, want)
+	}
+	if got, want := cm.host, "www.example.com"; got != want {
+		t.Errorf("host = %q, want %q", got, want)
+	}
+	if got, want := cm.claims["foo"], "bar"; got != want {
+		t.Errorf("claims[foo] = %v, want %v", got, want)
+	}
+
+	// The state can only be used once.
+	if got, want := post("bob", "secret").Code, http.StatusBadRequest; got != want {
+		t.Errorf("POST again: status = %d, want %d", got, want)
+	}
+}
+
+func TestLoginFormWithTOTP(t *testing.T) {
+	failureDelay = 0
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateAESMasterKeyForTest: %v", err)
+	}
+	tm, err := totp.New(totp.Config{
+		Store:         storage.New(t.TempDir(), mk),
+		Issuer:        "login.example.com",
+		EventRecorder: nopRecorder{},
+	})
+	if err != nil {
+		t.Fatalf("totp.New: %v", err)
+	}
+	cm := &fakeCookieManager{}
+	f, err := New(Config{
+		Type:     "test",
+		Endpoint: "https://login.example.com/login",
+		Authenticate: func(username, password string) (*User, error) {
+			return &User{ID: username, Email: username}, nil
+		},
+		TOTP: tm,
+	}, nopRecorder{}, cm)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	f.RequestLogin(w, httptest.NewRequest("GET", "https://www.example.com/foo", nil), "https://www.example.com/foo")
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Location: %v", err)
+	}
+
+	form := url.Values{}
+	form.Set("state", loc.Query().Get("state"))
+	form.Set("username", "bob")
+	form.Set("password", "secret")
+	req := httptest.NewRequest("POST", "https://login.example.com/login", strings.NewReader(form.Encode()))
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	f.HandleCallback(w, req)
+	if got, want := w.Code, http.StatusSeeOther; got != want {
+		t.Fatalf("POST: status = %d, want %d", got, want)
+	}
+	if got, want := w.Header().Get("Location"), "/login?totp="; !strings.HasPrefix(got, want) {
+		t.Fatalf("Location = %q, want %q...", got, want)
+	}
+	if cm.userID != "" {
+		t.Fatalf("auth cookie set before TOTP verification")
+	}
+
+	// Skip the enrollment, which is optional.
+	form = url.Values{}
+	form.Set("skip", "1")
+	req = httptest.NewRequest("POST", w.Header().Get("Location"), strings.NewReader(form.Encode()))
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	f.HandleCallback(w, req)
+	if got, want := w.Code, http.StatusSeeOther; got != want {
+		t.Fatalf("POST skip: status = %d, want %d", got, want)
+	}
+	if got, want := w.Header().Get("Location"), "https://www.example.com/foo"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+	if got, want := cm.userID, "bob"; got != want {
+		t.Errorf("userID = %q, want %q", got, want)
+	}
+}
+
+func TestLoginFormRateLimit(t *testing.T) {
+	failureDelay = 0
+	var calls int
+	f, err := New(Config{
+		Type:     "test",
+		Endpoint: "https://login.example.com/login",
+		Authenticate: func(username, password string) (*User, error) {
+			calls++
+			if password != "secret" {
+				return nil, ErrInvalidCredentials
+			}
+			return &User{ID: username, Email: username}, nil
+		},
+	}, nopRecorder{}, &fakeCookieManager{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	post := func(ip, username, password string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		f.RequestLogin(w, httptest.NewRequest("GET", "https://www.example.com/foo", nil), "https://www.example.com/foo")
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("Location: %v", err)
+		}
+		form := url.Values{}
+		form.Set("state", loc.Query().Get("state"))
+		form.Set("username", username)
+		form.Set("password", password)
+		req := httptest.NewRequest("POST", "https://login.example.com/login", strings.NewReader(form.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = ip + ":1234"
+		w = httptest.NewRecorder()
+		f.HandleCallback(w, req)
+		return w
+	}
+
+	// Per-user limit, from different IP addresses.
+	for i := range userAttemptsBurst {
+		if got, want := post(fmt.Sprintf("10.0.0.%d", i), "bob", "wrong").Code, http.StatusUnauthorized; got != want {
+			t.Fatalf("POST #%d: status = %d, want %d", i, got, want)
+		}
+	}
+	w := post("10.0.1.1", "BOB", "secret")
+	if got, want := w.Code, http.StatusTooManyRequests; got != want {
+		t.Fatalf("POST bob: status = %d, want %d", got, want)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After header not set")
+	}
+	if got, want := calls, userAttemptsBurst; got != want {
+		t.Errorf("Authenticate calls = %d, want %d", got, want)
+	}
+	if got, want := post("10.0.1.1", "alice", "secret").Code, http.StatusSeeOther; got != want {
+		t.Errorf("POST alice: status = %d, want %d", got, want)
+	}
+
+	// Per-IP limit, with different usernames.
+	for i := range ipAttemptsBurst {
+		if got, want := post("10.0.2.1", fmt.Sprintf("user%d", i), "wrong").Code, http.StatusUnauthorized; got != want {
+			t.Fatalf("POST #%d: status = %d, want %d", i, got, want)
+		}
+	}
+	if got, want := post("10.0.2.1", "carol", "secret").Code, http.StatusTooManyRequests; got != want {
+		t.Errorf("POST carol: status = %d, want %d", got, want)
+	}
+}
+
+func TestLoginFormMaxStates(t *testing.T) {
+	f, err := New(Config{
+		Type:     "test",
+		Endpoint: "https://login.example.com/login",
+		Authenticate: func(username, password string) (*User, error) {
+			return nil, ErrInvalidCredentials
+		},
+	}, nopRecorder{}, &fakeCookieManager{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for range maxStates + 10 {
+		f.RequestLogin(httptest.NewRecorder(), httptest.NewRequest("GET", "https://www.example.com/foo", nil), "https://www.example.com/foo")
+	}
+	if got, want := f.states.Len(), maxStates; got != want {
+		t.Errorf("states = %d, want %d", got, want)
+	}
+}
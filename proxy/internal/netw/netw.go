@@ -46,6 +46,12 @@ func Listen(network, laddr string) (net.Listener, error) {
 	return listener{l}, nil
 }
 
+// NewListener wraps an existing net listener so that it is instrumented like
+// the listeners created with Listen.
+func NewListener(l net.Listener) net.Listener {
+	return listener{l}
+}
+
 type listener struct {
 	net.Listener
 }
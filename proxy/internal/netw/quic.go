@@ -80,12 +80,90 @@ func (t *QUICTransport) Close() error {
 	return t.qt.Close()
 }
 
-func (t *QUICTransport) Listen(tc *tls.Config) (*QUICListener, error) {
-	ln, err := t.qt.Listen(tc, quicConfig)
+// QUICOption is an option for QUICTransport.Listen and QUICTransport.DialEarly.
+type QUICOption func(*quic.Config)
+
+// WithConnFilter sets a function that decides whether an incoming connection
+// attempt from addr should be accepted. It is called before the handshake.
+func WithConnFilter(f func(addr net.Addr) bool) QUICOption {
+	return func(cfg *quic.Config) {
+		cfg.GetConfigForClient = func(info *quic.ClientHelloInfo) (*quic.Config, error) {
+			if !f(info.RemoteAddr) {
+				return nil, errors.New("connection refused")
+			}
+			return cfg, nil
+		}
+	}
+}
+
+// WithHandshakeIdleTimeout sets the idle timeout before the handshake
+// completes. The value 0 means the quic-go default.
+func WithHandshakeIdleTimeout(d time.Duration) QUICOption {
+	return func(cfg *quic.Config) {
+		cfg.HandshakeIdleTimeout = d
+	}
+}
+
+// WithMaxIdleTimeout sets the idle timeout after the handshake completes. The
+// value 0 means the default of 30 seconds.
+func WithMaxIdleTimeout(d time.Duration) QUICOption {
+	return func(cfg *quic.Config) {
+		if d > 0 {
+			cfg.MaxIdleTimeout = d
+		}
+	}
+}
+
+// WithKeepAlivePeriod sets how often keep-alive packets are sent. The value 0
+// disables keep-alives.
+func WithKeepAlivePeriod(d time.Duration) QUICOption {
+	return func(cfg *quic.Config) {
+		cfg.KeepAlivePeriod = d
+	}
+}
+
+// WithInitialReceiveWindows sets the initial stream and connection flow
+// control windows. The value 0 means the quic-go default.
+func WithInitialReceiveWindows(stream, conn uint64) QUICOption {
+	return func(cfg *quic.Config) {
+		cfg.InitialStreamReceiveWindow = stream
+		cfg.InitialConnectionReceiveWindow = conn
+	}
+}
+
+// WithInitialPacketSize sets the size of the packets sent before path MTU
+// discovery completes. The value 0 means the quic-go default.
+func WithInitialPacketSize(size uint16) QUICOption {
+	return func(cfg *quic.Config) {
+		cfg.InitialPacketSize = size
+	}
+}
+
+// WithEarlyData allows 0-RTT connection attempts. The connections are returned
+// by Accept before the handshake completes.
+func WithEarlyData() QUICOption {
+	return func(cfg *quic.Config) {
+		cfg.Allow0RTT = true
+	}
+}
+
+func (t *QUICTransport) Listen(tc *tls.Config, opts ...QUICOption) (*QUICListener, error) {
+	cfg := quicConfig.Clone()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.Allow0RTT {
+		eln, err := t.qt.ListenEarly(tc, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &QUICListener{eln: eln}, nil
+	}
+	ln, err := t.qt.Listen(tc, cfg)
 	if err != nil {
 		return nil, err
 	}
-	return &QUICListener{ln}, nil
+	return &QUICListener{ln: ln}, nil
 }
 
 func (t *QUICTransport) Dial(ctx context.Context, addr net.Addr, tc *tls.Config) (*QUICConn, error) {
@@ -96,9 +174,12 @@ func (t *QUICTransport) Dial(ctx context.Context, addr net.Addr, tc *tls.Config)
 	return newQUICConn(conn), nil
 }
 
-func (t *QUICTransport) DialEarly(ctx context.Context, addr net.Addr, tc *tls.Config, enableDatagrams bool) (*QUICConn, error) {
+func (t *QUICTransport) DialEarly(ctx context.Context, addr net.Addr, tc *tls.Config, enableDatagrams bool, opts ...QUICOption) (*QUICConn, error) {
 	cfg := quicConfig.Clone()
 	cfg.EnableDatagrams = enableDatagrams
+	for _, opt := range opts {
+		opt(cfg)
+	}
 	conn, err := t.qt.Dial(ctx, addr, tc, cfg)
 	if err != nil {
 		return nil, err
@@ -106,12 +187,20 @@ func (t *QUICTransport) DialEarly(ctx context.Context, addr net.Addr, tc *tls.Co
 	return newQUICConn(conn), nil
 }
 
-// QUICListener is a wrapper around quic.Listener.
+// QUICListener is a wrapper around quic.Listener or quic.EarlyListener.
 type QUICListener struct {
-	ln *quic.Listener
+	ln  *quic.Listener
+	eln *quic.EarlyListener
 }
 
 func (l *QUICListener) Accept(ctx context.Context) (*QUICConn, error) {
+	if l.eln != nil {
+		conn, err := l.eln.Accept(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return newQUICConn(conn), nil
+	}
 	conn, err := l.ln.Accept(ctx)
 	if err != nil {
 		return nil, err
@@ -120,10 +209,16 @@ func (l *QUICListener) Accept(ctx context.Context) (*QUICConn, error) {
 }
 
 func (l *QUICListener) Addr() net.Addr {
+	if l.eln != nil {
+		return l.eln.Addr()
+	}
 	return l.ln.Addr()
 }
 
 func (l *QUICListener) Close() error {
+	if l.eln != nil {
+		return l.eln.Close()
+	}
 	return l.ln.Close()
 }
 
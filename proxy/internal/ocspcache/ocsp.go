@@ -28,10 +28,13 @@ import (
 	"context"
 	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/hex"
 	"errors"
 	"io"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/c2FmZQ/storage"
@@ -50,8 +53,14 @@ var (
 	errOCSPUnknown  = errors.New("unknown cert")
 	errOCSPProtocol = errors.New("protocol error")
 	errOCSPInternal = errors.New("internal error")
+	errOCSPNoStaple = errors.New("no stapled response")
+	errOCSPNoChain  = errors.New("no verified chain")
 )
 
+// TLS Feature extension, a.k.a. OCSP must-staple.
+// https://www.rfc-editor.org/rfc/rfc7633.html
+var oidExtensionTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
 type logger interface {
 	Errorf(f string, args ...any)
 	Fatalf(f string, args ...any)
@@ -71,6 +80,8 @@ func New(store *storage.Storage, logger logger) *OCSPCache {
 		logger: logger,
 	}
 	cache.client.Logger = nil
+	// Use the default transport for its outbound proxy settings.
+	cache.client.HTTPClient.Transport = http.DefaultTransport
 	cache.load()
 	return cache
 }
@@ -114,9 +125,25 @@ func (c *OCSPCache) FlushLoop(ctx context.Context) {
 	}
 }
 
-func (c *OCSPCache) flush() error {
+// flush saves the cached responses. The responses that were saved by other
+// proxy instances that share the same storage are merged into the cache.
+func (c *OCSPCache) flush() (retErr error) {
 	var items []ocspCacheItem
+	commit, err := c.store.OpenForUpdate(ocspFile, &items)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
 	now := time.Now()
+	for _, item := range items {
+		if c.cache.Contains(item.Key) {
+			continue
+		}
+		if resp, err := ocsp.ParseResponse(item.Value, nil); err == nil && now.Before(resp.NextUpdate) {
+			c.cache.Add(item.Key, resp)
+		}
+	}
+	items = items[:0]
 	for _, k := range c.cache.Keys() {
 		if v, ok := c.cache.Peek(k); ok {
 			if now.After(v.NextUpdate) {
@@ -128,7 +155,7 @@ func (c *OCSPCache) flush() error {
 			})
 		}
 	}
-	return c.store.SaveDataFile(ocspFile, &items)
+	return commit(true, nil)
 }
 
 func (c *OCSPCache) VerifyChains(ctx context.Context, chains [][]*x509.Certificate, stapled []byte) error {
@@ -186,6 +213,59 @@ nextChain:
 	return lastError
 }
 
+// RequireGood verifies that the leaf certificate of the first verified chain
+// has a valid Good OCSP response, either stapled or fetched from the
+// certificate's OCSP servers. When the certificate has the OCSP must-staple
+// extension, the response must be stapled.
+func (c *OCSPCache) RequireGood(ctx context.Context, chains [][]*x509.Certificate, stapled []byte) error {
+	if len(chains) == 0 || len(chains[0]) < 2 {
+		return errOCSPNoChain
+	}
+	cert, issuer := chains[0][0], chains[0][1]
+	hash := certHash(cert.Raw)
+	if cached, ok := c.cache.Get(hash); ok && cached.Status == ocsp.Revoked {
+		return errOCSPRevoked
+	}
+	if stapled != nil {
+		if resp, err := ocsp.ParseResponseForCert(stapled, cert, issuer); err == nil && time.Now().Before(resp.NextUpdate) {
+			c.cache.Add(hash, resp)
+			switch resp.Status {
+			case ocsp.Good:
+				return nil
+			case ocsp.Revoked:
+				return errOCSPRevoked
+			}
+		}
+	}
+	if mustStaple(cert) {
+		c.logger.Errorf("BAD OCSP: %q requires a stapled response", cert.Subject.String())
+		return errOCSPNoStaple
+	}
+	if len(cert.OCSPServer) == 0 {
+		return errOCSPNoStaple
+	}
+	resp, err := c.Response(ctx, cert, issuer, 0)
+	if err != nil {
+		return err
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return errOCSPRevoked
+	case ocsp.Unknown:
+		return errOCSPUnknown
+	default:
+		return errOCSPProtocol
+	}
+}
+
+func mustStaple(cert *x509.Certificate) bool {
+	return slices.ContainsFunc(cert.Extensions, func(e pkix.Extension) bool {
+		return e.Id.Equal(oidExtensionTLSFeature)
+	})
+}
+
 func certHash(b []byte) string {
 	hash := sha256.Sum256(b)
 	return hex.EncodeToString(hash[:])
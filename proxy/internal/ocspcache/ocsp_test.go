@@ -0,0 +1,217 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ocspcache
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+	"golang.org/x/crypto/ocsp"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Errorf(f string, args ...any) {
+	l.t.Logf(f, args...)
+}
+
+func (l testLogger) Fatalf(f string, args ...any) {
+	l.t.Fatalf(f, args...)
+}
+
+type testCA struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	templ := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, templ, templ, key.Public(), key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	return &testCA{key: key, cert: cert}
+}
+
+func (ca *testCA) issue(t *testing.T, sn int64, ocspServer string, mustStaple bool) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	templ := &x509.Certificate{
+		SerialNumber: big.NewInt(sn),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ocspServer != "" {
+		templ.OCSPServer = []string{ocspServer}
+	}
+	if mustStaple {
+		// SEQUENCE { INTEGER 5 } (status_request)
+		templ.ExtraExtensions = append(templ.ExtraExtensions, pkix.Extension{
+			Id:    oidExtensionTLSFeature,
+			Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05},
+		})
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, templ, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	return cert
+}
+
+func (ca *testCA) response(t *testing.T, cert *x509.Certificate, status int) []byte {
+	tmpl := ocsp.Response{
+		Status:       status,
+		SerialNumber: cert.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   time.Now().Add(time.Hour),
+	}
+	if status == ocsp.Revoked {
+		tmpl.RevokedAt = time.Now().Add(-time.Minute)
+	}
+	b, err := ocsp.CreateResponse(ca.cert, ca.cert, tmpl, ca.key)
+	if err != nil {
+		t.Fatalf("ocsp.CreateResponse: %v", err)
+	}
+	return b
+}
+
+func TestRequireGood(t *testing.T) {
+	ca := newTestCA(t)
+	status := map[string]int{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		s, ok := status[r.SerialNumber.String()]
+		if !ok {
+			s = ocsp.Unknown
+		}
+		tmpl := ocsp.Response{
+			Status:       s,
+			SerialNumber: r.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		if s == ocsp.Revoked {
+			tmpl.RevokedAt = time.Now().Add(-time.Minute)
+		}
+		b, err := ocsp.CreateResponse(ca.cert, ca.cert, tmpl, ca.key)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/ocsp-response")
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateAESMasterKeyForTest: %v", err)
+	}
+	cache := New(storage.New(t.TempDir(), mk), testLogger{t})
+	cache.client.RetryMax = 0
+
+	good := ca.issue(t, 100, srv.URL, false)
+	status["100"] = ocsp.Good
+	revoked := ca.issue(t, 101, srv.URL, false)
+	status["101"] = ocsp.Revoked
+	unknown := ca.issue(t, 102, srv.URL, false)
+	staple := ca.issue(t, 103, srv.URL, true)
+	status["103"] = ocsp.Good
+	noServer := ca.issue(t, 104, "", false)
+	stapleRevoked := ca.issue(t, 105, srv.URL, true)
+
+	chain := func(c *x509.Certificate) [][]*x509.Certificate {
+		return [][]*x509.Certificate{{c, ca.cert}}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		chains  [][]*x509.Certificate
+		stapled []byte
+		wantErr error
+	}{
+		{"no chain", nil, nil, errOCSPNoChain},
+		{"fetched good", chain(good), nil, nil},
+		{"fetched revoked", chain(revoked), nil, errOCSPRevoked},
+		{"fetched unknown", chain(unknown), nil, errOCSPUnknown},
+		{"stapled good", chain(noServer), ca.response(t, noServer, ocsp.Good), nil},
+		{"no server", chain(noServer), nil, errOCSPNoStaple},
+		{"must-staple missing", chain(staple), nil, errOCSPNoStaple},
+		{"must-staple revoked", chain(stapleRevoked), ca.response(t, stapleRevoked, ocsp.Revoked), errOCSPRevoked},
+		{"must-staple good", chain(staple), ca.response(t, staple, ocsp.Good), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := cache.RequireGood(context.Background(), tc.chains, tc.stapled); !errors.Is(err, tc.wantErr) {
+				t.Errorf("RequireGood() = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
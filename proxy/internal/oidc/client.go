@@ -29,19 +29,30 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/c2FmZQ/storage"
 	jwt "github.com/golang-jwt/jwt/v5"
 
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/idp"
 )
 
+// refreshTokenFile is where the refresh tokens are stored, indexed by session
+// ID.
+const refreshTokenFile = "oidc-refresh-tokens"
+
+// refreshTokenMaxAge is how long an unused refresh token is kept. It matches
+// the lifetime of the auth cookie.
+const refreshTokenMaxAge = 24 * time.Hour
+
 // Config contains the parameters of an OIDC provider.
 type Config struct {
 	// DiscoveryURL is the discovery URL of the OIDC provider. If set, it
@@ -65,19 +76,51 @@ type Config struct {
 	RedirectURL string
 	// ClientID is the Client ID.
 	ClientID string
-	// ClientSecret is the Client Secret.
+	// ClientSecret is the Client Secret. It is omitted from the token
+	// request when empty, i.e. for public clients.
 	ClientSecret string
+	// UsePKCE indicates that PKCE (RFC 7636) should be used with the S256
+	// code challenge method.
+	UsePKCE bool
+	// RefreshTokens indicates that refresh tokens should be requested and
+	// used to extend the user's session. Store must be set.
+	RefreshTokens bool
+	// Store is used to save the refresh tokens.
+	Store *storage.Storage
+	// GroupsClaim is the name of the claim that contains the user's
+	// groups. They are copied to the "groups" claim of the auth token.
+	GroupsClaim string
+	// RolesClaim is the name of the claim that contains the user's roles.
+	// They are copied to the "roles" claim of the auth token.
+	RolesClaim string
+	// BackchannelLogout indicates that logout tokens should be accepted
+	// from the identity provider. DiscoveryURL must be set.
+	BackchannelLogout bool
 	// HostedDomain specifies that the HD param should be used.
 	// https://developers.google.com/identity/openid-connect/openid-connect#hd-param
 	HostedDomain string
+	// ClaimMapping maps the names of standard claims to the names of the
+	// claims that the provider uses instead, e.g. email: upn. The keys
+	// must be in MappableClaims.
+	ClaimMapping map[string]string
+	// Issuer, if set, overrides the issuer from the discovery document.
+	// It is used to validate the ID tokens and the logout tokens. The
+	// {tenantid} placeholder is replaced with the token's tid claim, and
+	// the value * accepts any issuer.
+	Issuer string
 }
 
+// MappableClaims are the standard claims that can be used as keys in
+// Config.ClaimMapping.
+var MappableClaims = []string{"sub", "email", "name", "given_name", "middle_name", "family_name", "picture"}
+
 // CookieManager is the interface to set and clear the auth token.
 type CookieManager interface {
 	SetAuthTokenCookie(w http.ResponseWriter, userID, email, sessionID, host string, extraClaims map[string]any) error
 	SetNonce(w http.ResponseWriter, nonce string)
 	Nonce(w http.ResponseWriter, req *http.Request) string
 	ClearCookies(w http.ResponseWriter) error
+	RevokeSessions(claim, value string) error
 }
 
 // EventRecorder is used to record events.
@@ -93,8 +136,12 @@ type ProviderClient struct {
 	cm  CookieManager
 	er  EventRecorder
 
-	mu     sync.Mutex
-	states map[string]*oauthState
+	mu            sync.Mutex
+	states        map[string]*oauthState
+	offlineAccess bool
+	refreshing    map[string]time.Time
+	issuer        string
+	keySet        *remoteKeySet
 }
 
 type oauthState struct {
@@ -105,13 +152,59 @@ type oauthState struct {
 	Seen         bool
 }
 
+type refreshTokens struct {
+	Sessions map[string]*refreshSession
+}
+
+type refreshSession struct {
+	ClientID     string
+	RefreshToken string
+	Subject      string
+	IDPSessionID string
+	Email        string
+	Updated      time.Time
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	IDToken      string `json:"id_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type userClaims struct {
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+	Nonce         string `json:"nonce"`
+	Name          string `json:"name"`
+	GivenName     string `json:"given_name"`
+	MiddleName    string `json:"middle_name"`
+	FamilyName    string `json:"family_name"`
+	Picture       string `json:"picture"`
+	AvatarURL     string `json:"avatar_url"` // github
+	Login         string `json:"login"`      // github
+	HostedDomain  string `json:"hd"`
+	TenantID      string `json:"tid"`
+	jwt.RegisteredClaims
+
+	raw         jwt.MapClaims
+	fromIDToken bool
+}
+
 // New returns a new ProviderClient.
 func New(cfg Config, er EventRecorder, cm CookieManager) (*ProviderClient, error) {
 	p := &ProviderClient{
-		cfg:    cfg,
-		cm:     cm,
-		er:     er,
-		states: make(map[string]*oauthState),
+		cfg:        cfg,
+		cm:         cm,
+		er:         er,
+		states:     make(map[string]*oauthState),
+		refreshing: make(map[string]time.Time),
+	}
+	if cfg.RefreshTokens {
+		if cfg.Store == nil {
+			return nil, errors.New("Store must be set with RefreshTokens")
+		}
+		cfg.Store.CreateEmptyFile(refreshTokenFile, &refreshTokens{})
 	}
 	if p.cfg.DiscoveryURL != "" {
 		resp, err := http.Get(p.cfg.DiscoveryURL)
@@ -123,9 +216,12 @@ func New(cfg Config, er EventRecorder, cm CookieManager) (*ProviderClient, error
 			return nil, fmt.Errorf("http get(%s): %s", cfg.DiscoveryURL, resp.Status)
 		}
 		var disc struct {
-			AuthEndpoint     string `json:"authorization_endpoint"`
-			TokenEndpoint    string `json:"token_endpoint"`
-			UserinfoEndpoint string `json:"userinfo_endpoint"`
+			Issuer           string   `json:"issuer"`
+			JWKSURI          string   `json:"jwks_uri"`
+			AuthEndpoint     string   `json:"authorization_endpoint"`
+			TokenEndpoint    string   `json:"token_endpoint"`
+			UserinfoEndpoint string   `json:"userinfo_endpoint"`
+			ScopesSupported  []string `json:"scopes_supported"`
 		}
 		if err := json.NewDecoder(resp.Body).Decode(&disc); err != nil {
 			return nil, fmt.Errorf("discovery document: %v", err)
@@ -133,6 +229,17 @@ func New(cfg Config, er EventRecorder, cm CookieManager) (*ProviderClient, error
 		p.cfg.AuthEndpoint = disc.AuthEndpoint
 		p.cfg.TokenEndpoint = disc.TokenEndpoint
 		p.cfg.UserinfoEndpoint = disc.UserinfoEndpoint
+		p.offlineAccess = cfg.RefreshTokens && slices.Contains(disc.ScopesSupported, "offline_access")
+		p.issuer = disc.Issuer
+		if disc.JWKSURI != "" {
+			p.keySet = &remoteKeySet{url: disc.JWKSURI}
+		}
+	}
+	if cfg.Issuer != "" {
+		p.issuer = cfg.Issuer
+	}
+	if cfg.BackchannelLogout && (p.issuer == "" || p.keySet == nil) {
+		return nil, errors.New("BackchannelLogout requires a discovery document with issuer and jwks_uri")
 	}
 	if _, err := url.Parse(p.cfg.AuthEndpoint); err != nil {
 		return nil, fmt.Errorf("AuthEndpoint: %v", err)
@@ -159,13 +266,15 @@ func (p *ProviderClient) RequestLogin(w http.ResponseWriter, req *http.Request,
 		return
 	}
 	nonceStr := hex.EncodeToString(nonce[:])
-	var codeVerifier [32]byte
-	if _, err := io.ReadFull(rand.Reader, codeVerifier[:]); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	var codeVerifierStr string
+	if p.cfg.UsePKCE {
+		var codeVerifier [32]byte
+		if _, err := io.ReadFull(rand.Reader, codeVerifier[:]); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		codeVerifierStr = base64.RawURLEncoding.EncodeToString(codeVerifier[:])
 	}
-	codeVerifierStr := base64.RawURLEncoding.EncodeToString(codeVerifier[:])
-	cvh := sha256.Sum256([]byte(codeVerifierStr))
 	p.mu.Lock()
 	p.states[nonceStr] = &oauthState{
 		Created:      time.Now(),
@@ -178,15 +287,21 @@ func (p *ProviderClient) RequestLogin(w http.ResponseWriter, req *http.Request,
 	if len(scopes) == 0 {
 		scopes = []string{"openid", "email"}
 	}
+	if p.offlineAccess && !slices.Contains(scopes, "offline_access") {
+		scopes = append(slices.Clone(scopes), "offline_access")
+	}
 	ep := p.cfg.AuthEndpoint + "?" +
 		"response_type=code" +
 		"&client_id=" + url.QueryEscape(p.cfg.ClientID) +
 		"&scope=" + url.QueryEscape(strings.Join(scopes, " ")) +
 		"&redirect_uri=" + url.QueryEscape(p.cfg.RedirectURL) +
 		"&state=" + nonceStr +
-		"&nonce=" + nonceStr +
-		"&code_challenge=" + base64.RawURLEncoding.EncodeToString(cvh[:]) +
-		"&code_challenge_method=S256"
+		"&nonce=" + nonceStr
+	if codeVerifierStr != "" {
+		cvh := sha256.Sum256([]byte(codeVerifierStr))
+		ep += "&code_challenge=" + base64.RawURLEncoding.EncodeToString(cvh[:]) +
+			"&code_challenge_method=S256"
+	}
 	if p.cfg.HostedDomain != "" {
 		ep += "&hd=" + url.QueryEscape(p.cfg.HostedDomain)
 	}
@@ -229,77 +344,25 @@ func (p *ProviderClient) HandleCallback(w http.ResponseWriter, req *http.Request
 	form := url.Values{}
 	form.Add("code", code)
 	form.Add("client_id", p.cfg.ClientID)
-	form.Add("client_secret", p.cfg.ClientSecret)
+	if p.cfg.ClientSecret != "" {
+		form.Add("client_secret", p.cfg.ClientSecret)
+	}
 	form.Add("redirect_uri", p.cfg.RedirectURL)
 	form.Add("grant_type", "authorization_code")
-	form.Add("code_verifier", state.CodeVerifier)
+	if state.CodeVerifier != "" {
+		form.Add("code_verifier", state.CodeVerifier)
+	}
 
-	req, err := http.NewRequest(http.MethodPost, p.cfg.TokenEndpoint, strings.NewReader(form.Encode()))
+	data, err := p.tokenRequest(form)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	req.Header.Set("content-type", "application/x-www-form-urlencoded")
-	req.Header.Set("accept", "application/json")
-	resp, err := http.DefaultClient.Do(req)
+	claims, err := p.userClaims(data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
-	var data struct {
-		AccessToken string `json:"access_token"`
-		IDToken     string `json:"id_token"`
-		TokenType   string `json:"token_type"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	var claims struct {
-		Email         string `json:"email"`
-		EmailVerified *bool  `json:"email_verified"`
-		Nonce         string `json:"nonce"`
-		Name          string `json:"name"`
-		GivenName     string `json:"given_name"`
-		MiddleName    string `json:"middle_name"`
-		FamilyName    string `json:"family_name"`
-		Picture       string `json:"picture"`
-		AvatarURL     string `json:"avatar_url"` // github
-		Login         string `json:"login"`      // github
-		HostedDomain  string `json:"hd"`
-		jwt.RegisteredClaims
-	}
-	if data.IDToken != "" {
-		// We received the JWT directly from the identity provider. So, we
-		// don't need to validate it.
-		if _, _, err := (&jwt.Parser{}).ParseUnverified(data.IDToken, &claims); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	} else if p.cfg.UserinfoEndpoint != "" && (data.TokenType == "" || strings.ToLower(data.TokenType) == "bearer") {
-		req, err := http.NewRequest(http.MethodGet, p.cfg.UserinfoEndpoint, nil)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		req.Header.Set("authorization", "Bearer "+data.AccessToken)
-		req.Header.Set("accept", "application/json")
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer resp.Body.Close()
-		claims.Issuer = p.cfg.UserinfoEndpoint
-		if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	} else {
-		http.Error(w, "no user info", http.StatusInternalServerError)
-		return
-	}
 	if claims.Nonce == "" {
 		claims.Nonce = nonce
 	}
@@ -312,6 +375,11 @@ func (p *ProviderClient) HandleCallback(w http.ResponseWriter, req *http.Request
 		http.Error(w, "timeout", http.StatusForbidden)
 		return
 	}
+	if claims.fromIDToken && p.cfg.Issuer != "" && !p.validIssuer(claims.Issuer, claims.TenantID) {
+		p.er.Record("invalid issuer")
+		http.Error(w, "invalid issuer", http.StatusForbidden)
+		return
+	}
 	if claims.Email == "" {
 		http.Error(w, "no email", http.StatusInternalServerError)
 		return
@@ -328,32 +396,445 @@ func (p *ProviderClient) HandleCallback(w http.ResponseWriter, req *http.Request
 			return
 		}
 	}
-	extraClaims := map[string]any{
+	if err := p.cm.SetAuthTokenCookie(w, claims.Subject, claims.Email, claims.Nonce, state.Host, p.extraClaims(claims)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p.cfg.RefreshTokens && data.RefreshToken != "" {
+		if err := p.saveRefreshToken(claims.Nonce, &refreshSession{
+			ClientID:     p.cfg.ClientID,
+			RefreshToken: data.RefreshToken,
+			Subject:      claims.Subject,
+			IDPSessionID: idpSessionID(claims),
+			Email:        claims.Email,
+		}); err != nil {
+			p.er.Record("refresh token not saved")
+		}
+	}
+	http.Redirect(w, req, state.OriginalURL, http.StatusFound)
+}
+
+func (p *ProviderClient) tokenRequest(form url.Values) (*tokenResponse, error) {
+	req, err := http.NewRequest(http.MethodPost, p.cfg.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	req.Header.Set("accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		te := &tokenError{Status: resp.Status}
+		json.NewDecoder(io.LimitReader(resp.Body, 16384)).Decode(te)
+		return nil, te
+	}
+	var data tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// tokenError is an error response from the token endpoint. Code is the
+// OAuth 2.0 error code, e.g. invalid_grant, when the response has one.
+type tokenError struct {
+	Status string `json:"-"`
+	Code   string `json:"error"`
+}
+
+func (e *tokenError) Error() string {
+	if e.Code == "" {
+		return "token endpoint: " + e.Status
+	}
+	return "token endpoint: " + e.Status + ": " + e.Code
+}
+
+var errNoUserInfo = errors.New("no user info")
+
+func (p *ProviderClient) userClaims(data *tokenResponse) (*userClaims, error) {
+	var claims userClaims
+	if data.IDToken != "" {
+		// We received the JWT directly from the identity provider. So, we
+		// don't need to validate it.
+		if _, _, err := (&jwt.Parser{}).ParseUnverified(data.IDToken, &claims); err != nil {
+			return nil, err
+		}
+		if _, _, err := (&jwt.Parser{}).ParseUnverified(data.IDToken, &claims.raw); err != nil {
+			return nil, err
+		}
+		claims.fromIDToken = true
+		p.applyClaimMapping(&claims)
+		return &claims, nil
+	}
+	if p.cfg.UserinfoEndpoint != "" && (data.TokenType == "" || strings.ToLower(data.TokenType) == "bearer") {
+		req, err := http.NewRequest(http.MethodGet, p.cfg.UserinfoEndpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("authorization", "Bearer "+data.AccessToken)
+		req.Header.Set("accept", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		claims.Issuer = p.cfg.UserinfoEndpoint
+		if err := json.Unmarshal(body, &claims); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(body, &claims.raw); err != nil {
+			return nil, err
+		}
+		p.applyClaimMapping(&claims)
+		return &claims, nil
+	}
+	return nil, errNoUserInfo
+}
+
+// applyClaimMapping copies the values of the mapped claims to the standard
+// claims.
+func (p *ProviderClient) applyClaimMapping(claims *userClaims) {
+	for std, name := range p.cfg.ClaimMapping {
+		v, ok := claims.raw[name].(string)
+		if !ok || v == "" {
+			continue
+		}
+		switch std {
+		case "sub":
+			claims.Subject = v
+		case "email":
+			claims.Email = v
+		case "name":
+			claims.Name = v
+		case "given_name":
+			claims.GivenName = v
+		case "middle_name":
+			claims.MiddleName = v
+		case "family_name":
+			claims.FamilyName = v
+		case "picture":
+			claims.Picture = v
+		}
+	}
+}
+
+// ValidateBearerToken validates a token that was issued by the identity
+// provider to an API client, and returns its claims. The token must be signed
+// with one of the provider's keys, and have one of the audiences. The default
+// audience is the ClientID.
+func (p *ProviderClient) ValidateBearerToken(token string, audiences []string) (jwt.MapClaims, error) {
+	if p.keySet == nil || p.issuer == "" {
+		return nil, errors.New("bearer tokens require a discovery document with issuer and jwks_uri")
+	}
+	if len(audiences) == 0 {
+		audiences = []string{p.cfg.ClientID}
+	}
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, p.keySet.keyFunc,
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	); err != nil {
+		return nil, err
+	}
+	iss, _ := claims.GetIssuer()
+	tid, _ := claims["tid"].(string)
+	if !p.validIssuer(iss, tid) {
+		return nil, errors.New("invalid issuer")
+	}
+	aud, _ := claims.GetAudience()
+	if !slices.ContainsFunc(aud, func(a string) bool { return slices.Contains(audiences, a) }) {
+		return nil, errors.New("invalid audience")
+	}
+	for std, name := range p.cfg.ClaimMapping {
+		if v, ok := claims[name].(string); ok && v != "" {
+			claims[std] = v
+		}
+	}
+	if email, _ := claims["email"].(string); email == "" {
+		return nil, errors.New("no email")
+	}
+	return claims, nil
+}
+
+// validIssuer returns true if iss is the expected issuer of the tokens. tid
+// is the token's tenant ID, if any.
+func (p *ProviderClient) validIssuer(iss, tid string) bool {
+	want := p.issuer
+	if want == "*" {
+		return true
+	}
+	if tid != "" {
+		want = strings.ReplaceAll(want, "{tenantid}", tid)
+	}
+	return iss == want
+}
+
+func (p *ProviderClient) extraClaims(claims *userClaims) map[string]any {
+	extra := map[string]any{
 		"source": claims.Issuer,
 	}
 	if claims.HostedDomain != "" {
-		extraClaims["hd"] = claims.HostedDomain
+		extra["hd"] = claims.HostedDomain
 	}
 	if claims.Name != "" {
-		extraClaims["name"] = claims.Name
+		extra["name"] = claims.Name
 	}
 	if claims.GivenName != "" {
-		extraClaims["given_name"] = claims.GivenName
+		extra["given_name"] = claims.GivenName
 	}
 	if claims.MiddleName != "" {
-		extraClaims["middle_name"] = claims.MiddleName
+		extra["middle_name"] = claims.MiddleName
 	}
 	if claims.FamilyName != "" {
-		extraClaims["family_name"] = claims.FamilyName
+		extra["family_name"] = claims.FamilyName
 	}
 	if claims.Picture != "" {
-		extraClaims["picture"] = claims.Picture
+		extra["picture"] = claims.Picture
 	} else if claims.AvatarURL != "" {
-		extraClaims["picture"] = claims.AvatarURL
+		extra["picture"] = claims.AvatarURL
 	}
-	if err := p.cm.SetAuthTokenCookie(w, claims.Subject, claims.Email, claims.Nonce, state.Host, extraClaims); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if sid := idpSessionID(claims); sid != "" {
+		extra["idp_sid"] = sid
+	}
+	if p.cfg.GroupsClaim != "" {
+		if v := stringList(claims.raw[p.cfg.GroupsClaim]); len(v) > 0 {
+			extra["groups"] = v
+		}
+	}
+	if p.cfg.RolesClaim != "" {
+		if v := stringList(claims.raw[p.cfg.RolesClaim]); len(v) > 0 {
+			extra["roles"] = v
+		}
+	}
+	return extra
+}
+
+// stringList converts a claim value to a list of strings. The value can be
+// a single string, or a list of strings.
+func stringList(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var out []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func (p *ProviderClient) saveRefreshToken(sid string, rs *refreshSession) (retErr error) {
+	var db refreshTokens
+	commit, err := p.cfg.Store.OpenForUpdate(refreshTokenFile, &db)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if db.Sessions == nil {
+		db.Sessions = make(map[string]*refreshSession)
+	}
+	for k, v := range db.Sessions {
+		if time.Since(v.Updated) > refreshTokenMaxAge {
+			delete(db.Sessions, k)
+		}
+	}
+	if rs == nil {
+		delete(db.Sessions, sid)
+	} else {
+		rs.Updated = time.Now().UTC()
+		db.Sessions[sid] = rs
+	}
+	return commit(true, nil)
+}
+
+func (p *ProviderClient) refreshToken(sid string) (*refreshSession, error) {
+	var db refreshTokens
+	if err := p.cfg.Store.ReadDataFile(refreshTokenFile, &db); err != nil {
+		return nil, err
+	}
+	rs, ok := db.Sessions[sid]
+	if !ok || rs.ClientID != p.cfg.ClientID || time.Since(rs.Updated) > refreshTokenMaxAge {
+		return nil, nil
+	}
+	return rs, nil
+}
+
+// RefreshSession uses the refresh token associated with the user's session,
+// if there is one, to get a new auth token cookie without user interaction.
+func (p *ProviderClient) RefreshSession(w http.ResponseWriter, req *http.Request, authClaims jwt.MapClaims) error {
+	if !p.cfg.RefreshTokens {
+		return nil
+	}
+	sid, _ := authClaims["sid"].(string)
+	if sid == "" {
+		return nil
+	}
+	// Only one refresh attempt per session per minute. Some identity
+	// providers rotate refresh tokens and revoke the session when an old
+	// one is reused.
+	p.mu.Lock()
+	for k, v := range p.refreshing {
+		if time.Since(v) > time.Minute {
+			delete(p.refreshing, k)
+		}
+	}
+	if _, exists := p.refreshing[sid]; exists {
+		p.mu.Unlock()
+		return nil
+	}
+	p.refreshing[sid] = time.Now()
+	p.mu.Unlock()
+
+	rs, err := p.refreshToken(sid)
+	if err != nil || rs == nil {
+		return err
+	}
+	if sub, _ := authClaims["sub"].(string); sub != rs.Subject {
+		return errors.New("subject mismatch")
+	}
+	p.er.Record("oidc refresh request")
+
+	form := url.Values{}
+	form.Add("grant_type", "refresh_token")
+	form.Add("refresh_token", rs.RefreshToken)
+	form.Add("client_id", p.cfg.ClientID)
+	if p.cfg.ClientSecret != "" {
+		form.Add("client_secret", p.cfg.ClientSecret)
+	}
+	data, err := p.tokenRequest(form)
+	if err != nil {
+		p.er.Record("oidc refresh failed")
+		// Only forget the refresh token when the identity provider
+		// rejected it. Network errors and server errors are usually
+		// transient, and the refresh is attempted again later.
+		if te := (*tokenError)(nil); errors.As(err, &te) && te.Code == "invalid_grant" {
+			p.saveRefreshToken(sid, nil)
+		}
+		return err
+	}
+	extra := make(map[string]any)
+	for _, k := range []string{"source", "hd", "name", "given_name", "middle_name", "family_name", "picture", "groups", "roles", "idp_sid"} {
+		if v, exists := authClaims[k]; exists {
+			extra[k] = v
+		}
+	}
+	claims, err := p.userClaims(data)
+	switch {
+	case err == errNoUserInfo:
+		// The identity provider accepted the refresh token, but didn't
+		// return any new information about the user.
+	case err != nil:
+		return err
+	case claims.Email != rs.Email:
+		p.saveRefreshToken(sid, nil)
+		return errors.New("email mismatch")
+	default:
+		extra = p.extraClaims(claims)
+	}
+	if data.RefreshToken != "" {
+		rs.RefreshToken = data.RefreshToken
+	}
+	if err := p.saveRefreshToken(sid, rs); err != nil {
+		return err
+	}
+	return p.cm.SetAuthTokenCookie(w, rs.Subject, rs.Email, sid, req.Host, extra)
+}
+
+func idpSessionID(claims *userClaims) string {
+	sid, _ := claims.raw["sid"].(string)
+	return sid
+}
+
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// HandleBackchannelLogout receives logout tokens from the identity provider,
+// and revokes the corresponding sessions.
+// https://openid.net/specs/openid-connect-backchannel-1_0.html
+func (p *ProviderClient) HandleBackchannelLogout(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if req.Method != http.MethodPost || !p.cfg.BackchannelLogout {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	http.Redirect(w, req, state.OriginalURL, http.StatusFound)
+	p.er.Record("oidc backchannel logout")
+	req.ParseForm()
+	var claims struct {
+		SessionID string         `json:"sid"`
+		TenantID  string         `json:"tid"`
+		Events    map[string]any `json:"events"`
+		Nonce     *string        `json:"nonce"`
+		jwt.RegisteredClaims
+	}
+	_, err := jwt.ParseWithClaims(req.PostForm.Get("logout_token"), &claims, p.keySet.keyFunc,
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	switch {
+	case err != nil:
+	case !p.validIssuer(claims.Issuer, claims.TenantID):
+		err = errors.New("invalid issuer")
+	case claims.Events == nil || claims.Events[backchannelLogoutEvent] == nil:
+		err = errors.New("missing event")
+	case claims.Nonce != nil:
+		err = errors.New("nonce not allowed")
+	case claims.ID == "":
+		err = errors.New("missing jti")
+	case claims.Subject == "" && claims.SessionID == "":
+		err = errors.New("missing sub and sid")
+	}
+	if err != nil {
+		p.er.Record("invalid logout token")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":             "invalid_request",
+			"error_description": err.Error(),
+		})
+		return
+	}
+	if claims.SessionID != "" {
+		err = p.cm.RevokeSessions("idp_sid", claims.SessionID)
+	} else {
+		err = p.cm.RevokeSessions("sub", claims.Subject)
+	}
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if p.cfg.RefreshTokens {
+		p.deleteRefreshTokens(claims.Subject, claims.SessionID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteRefreshTokens deletes the refresh tokens of the sessions that match
+// sid, or sub when sid is empty.
+func (p *ProviderClient) deleteRefreshTokens(sub, sid string) (retErr error) {
+	var db refreshTokens
+	commit, err := p.cfg.Store.OpenForUpdate(refreshTokenFile, &db)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	for k, v := range db.Sessions {
+		if v.ClientID != p.cfg.ClientID {
+			continue
+		}
+		if (sid != "" && v.IDPSessionID == sid) || (sid == "" && v.Subject == sub) {
+			delete(db.Sessions, k)
+		}
+	}
+	return commit(true, nil)
 }
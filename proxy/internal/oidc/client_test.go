@@ -0,0 +1,500 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+type fakeCookieManager struct {
+	nonce string
+	email string
+	sid   string
+	sets  int
+
+	revoked []string
+}
+
+func (cm *fakeCookieManager) SetAuthTokenCookie(w http.ResponseWriter, userID, email, sessionID, host string, extraClaims map[string]any) error {
+	cm.email = email
+	cm.sid = sessionID
+	cm.sets++
+	return nil
+}
+
+func (cm *fakeCookieManager) SetNonce(w http.ResponseWriter, nonce string) {
+	cm.nonce = nonce
+}
+
+func (cm *fakeCookieManager) Nonce(w http.ResponseWriter, req *http.Request) string {
+	return cm.nonce
+}
+
+func (cm *fakeCookieManager) ClearCookies(w http.ResponseWriter) error {
+	return nil
+}
+
+func (cm *fakeCookieManager) RevokeSessions(claim, value string) error {
+	cm.revoked = append(cm.revoked, claim+"="+value)
+	return nil
+}
+
+type nopRecorder struct{}
+
+func (nopRecorder) Record(string) {}
+
+func TestPKCE(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		usePKCE      bool
+		clientSecret string
+	}{
+		{name: "PKCE", usePKCE: true, clientSecret: "SECRET"},
+		{name: "PKCE public client", usePKCE: true},
+		{name: "No PKCE", usePKCE: false, clientSecret: "SECRET"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var challenge, nonce string
+			tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				req.ParseForm()
+				if got, want := req.PostForm.Get("client_secret"), tc.clientSecret; got != want {
+					t.Errorf("client_secret = %q, want %q", got, want)
+				}
+				verifier := req.PostForm.Get("code_verifier")
+				if tc.usePKCE {
+					h := sha256.Sum256([]byte(verifier))
+					if got := base64.RawURLEncoding.EncodeToString(h[:]); got != challenge {
+						t.Errorf("code_verifier doesn't match code_challenge")
+					}
+				} else if verifier != "" {
+					t.Errorf("unexpected code_verifier %q", verifier)
+				}
+				tok, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{
+					"email": "bob@example.com",
+					"nonce": nonce,
+				}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+				if err != nil {
+					t.Errorf("SignedString: %v", err)
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]string{"id_token": tok})
+			}))
+			defer tokenServer.Close()
+
+			cm := &fakeCookieManager{}
+			p, err := New(Config{
+				AuthEndpoint:  "https://idp.example.com/auth",
+				TokenEndpoint: tokenServer.URL,
+				RedirectURL:   "https://login.example.com/callback",
+				ClientID:      "CLIENTID",
+				ClientSecret:  tc.clientSecret,
+				UsePKCE:       tc.usePKCE,
+			}, nopRecorder{}, cm)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			p.RequestLogin(w, httptest.NewRequest("GET", "https://www.example.com/", nil), "https://www.example.com/")
+			loc, err := url.Parse(w.Header().Get("location"))
+			if err != nil {
+				t.Fatalf("location: %v", err)
+			}
+			challenge = loc.Query().Get("code_challenge")
+			nonce = loc.Query().Get("nonce")
+			if got := challenge != ""; got != tc.usePKCE {
+				t.Errorf("code_challenge = %q, usePKCE %v", challenge, tc.usePKCE)
+			}
+
+			w = httptest.NewRecorder()
+			p.HandleCallback(w, httptest.NewRequest("GET", "https://login.example.com/callback?code=CODE&state="+loc.Query().Get("state"), nil))
+			if got, want := w.Code, http.StatusFound; got != want {
+				t.Fatalf("HandleCallback status = %d, want %d: %s", got, want, w.Body.String())
+			}
+			if got, want := cm.email, "bob@example.com"; got != want {
+				t.Errorf("email = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRefreshSession(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateAESMasterKeyForTest: %v", err)
+	}
+	store := storage.New(t.TempDir(), mk)
+
+	var nonce string
+	var refreshes int
+	var refreshErr func(w http.ResponseWriter)
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		resp := map[string]string{}
+		switch gt := req.PostForm.Get("grant_type"); gt {
+		case "authorization_code":
+			resp["refresh_token"] = "REFRESH1"
+		case "refresh_token":
+			refreshes++
+			if refreshErr != nil {
+				refreshErr(w)
+				return
+			}
+			if got, want := req.PostForm.Get("refresh_token"), "REFRESH1"; got != want {
+				t.Errorf("refresh_token = %q, want %q", got, want)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			resp["refresh_token"] = "REFRESH2"
+		default:
+			t.Errorf("unexpected grant_type %q", gt)
+			return
+		}
+		tok, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{
+			"sub":   "1234",
+			"email": "bob@example.com",
+			"nonce": nonce,
+		}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+		if err != nil {
+			t.Errorf("SignedString: %v", err)
+			return
+		}
+		resp["id_token"] = tok
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer tokenServer.Close()
+
+	cm := &fakeCookieManager{}
+	p, err := New(Config{
+		AuthEndpoint:  "https://idp.example.com/auth",
+		TokenEndpoint: tokenServer.URL,
+		RedirectURL:   "https://login.example.com/callback",
+		ClientID:      "CLIENTID",
+		UsePKCE:       true,
+		RefreshTokens: true,
+		Store:         store,
+	}, nopRecorder{}, cm)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	p.RequestLogin(w, httptest.NewRequest("GET", "https://www.example.com/", nil), "https://www.example.com/")
+	loc, err := url.Parse(w.Header().Get("location"))
+	if err != nil {
+		t.Fatalf("location: %v", err)
+	}
+	nonce = loc.Query().Get("nonce")
+
+	w = httptest.NewRecorder()
+	p.HandleCallback(w, httptest.NewRequest("GET", "https://login.example.com/callback?code=CODE&state="+loc.Query().Get("state"), nil))
+	if got, want := w.Code, http.StatusFound; got != want {
+		t.Fatalf("HandleCallback status = %d, want %d: %s", got, want, w.Body.String())
+	}
+
+	authClaims := jwt.MapClaims{"sub": "1234", "email": "bob@example.com", "sid": cm.sid}
+	req := httptest.NewRequest("GET", "https://www.example.com/", nil)
+	if err := p.RefreshSession(httptest.NewRecorder(), req, authClaims); err != nil {
+		t.Fatalf("RefreshSession: %v", err)
+	}
+	if got, want := cm.sets, 2; got != want {
+		t.Errorf("SetAuthTokenCookie called %d times, want %d", got, want)
+	}
+	// A second refresh right away is a no-op.
+	if err := p.RefreshSession(httptest.NewRecorder(), req, authClaims); err != nil {
+		t.Fatalf("RefreshSession: %v", err)
+	}
+	if got, want := refreshes, 1; got != want {
+		t.Errorf("refreshes = %d, want %d", got, want)
+	}
+	rs, err := p.refreshToken(cm.sid)
+	if err != nil || rs == nil {
+		t.Fatalf("refreshToken() = %v, %v", rs, err)
+	}
+	if got, want := rs.RefreshToken, "REFRESH2"; got != want {
+		t.Errorf("RefreshToken = %q, want %q", got, want)
+	}
+
+	// Transient errors don't remove the refresh token.
+	refreshErr = func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	clear(p.refreshing)
+	if err := p.RefreshSession(httptest.NewRecorder(), req, authClaims); err == nil {
+		t.Fatal("RefreshSession succeeded")
+	}
+	if rs, err := p.refreshToken(cm.sid); err != nil || rs == nil {
+		t.Fatalf("refreshToken() = %v, %v", rs, err)
+	}
+	// The refresh token is removed when the identity provider rejects it.
+	refreshErr = func(w http.ResponseWriter) {
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+	}
+	clear(p.refreshing)
+	if err := p.RefreshSession(httptest.NewRecorder(), req, authClaims); err == nil {
+		t.Fatal("RefreshSession succeeded")
+	}
+	if rs, err := p.refreshToken(cm.sid); err != nil || rs != nil {
+		t.Fatalf("refreshToken() = %v, %v", rs, err)
+	}
+	if got, want := cm.sets, 2; got != want {
+		t.Errorf("SetAuthTokenCookie called %d times, want %d", got, want)
+	}
+
+	// Unknown sessions are ignored.
+	authClaims["sid"] = "other"
+	if err := p.RefreshSession(httptest.NewRecorder(), req, authClaims); err != nil {
+		t.Fatalf("RefreshSession: %v", err)
+	}
+	if got, want := cm.sets, 2; got != want {
+		t.Errorf("SetAuthTokenCookie called %d times, want %d", got, want)
+	}
+}
+
+func TestGroupsAndRolesClaims(t *testing.T) {
+	p := &ProviderClient{cfg: Config{GroupsClaim: "memberOf", RolesClaim: "role"}}
+	claims := &userClaims{
+		raw: jwt.MapClaims{
+			"memberOf": []any{"engineering", "oncall"},
+			"role":     "admin",
+		},
+	}
+	extra := p.extraClaims(claims)
+	if got, want := extra["groups"], []string{"engineering", "oncall"}; !slices.Equal(got.([]string), want) {
+		t.Errorf("groups = %v, want %v", got, want)
+	}
+	if got, want := extra["roles"], []string{"admin"}; !slices.Equal(got.([]string), want) {
+		t.Errorf("roles = %v, want %v", got, want)
+	}
+}
+
+func TestClaimMapping(t *testing.T) {
+	p := &ProviderClient{cfg: Config{ClaimMapping: map[string]string{
+		"email": "upn",
+		"name":  "display_name",
+	}}}
+	claims := &userClaims{
+		Name: "Bob",
+		raw: jwt.MapClaims{
+			"upn":          "bob@example.com",
+			"display_name": "Bob Smith",
+		},
+	}
+	p.applyClaimMapping(claims)
+	if got, want := claims.Email, "bob@example.com"; got != want {
+		t.Errorf("Email = %q, want %q", got, want)
+	}
+	if got, want := claims.Name, "Bob Smith"; got != want {
+		t.Errorf("Name = %q, want %q", got, want)
+	}
+}
+
+func TestValidIssuer(t *testing.T) {
+	for _, tc := range []struct {
+		issuer, iss, tid string
+		want             bool
+	}{
+		{"https://idp.example.com", "https://idp.example.com", "", true},
+		{"https://idp.example.com", "https://evil.example.com", "", false},
+		{"https://login.microsoftonline.com/{tenantid}/v2.0", "https://login.microsoftonline.com/1234/v2.0", "1234", true},
+		{"https://login.microsoftonline.com/{tenantid}/v2.0", "https://login.microsoftonline.com/1234/v2.0", "5678", false},
+		{"*", "https://anything.example.com", "", true},
+	} {
+		p := &ProviderClient{issuer: tc.issuer}
+		if got := p.validIssuer(tc.iss, tc.tid); got != tc.want {
+			t.Errorf("validIssuer(%q, %q) with %q = %v, want %v", tc.iss, tc.tid, tc.issuer, got, tc.want)
+		}
+	}
+}
+
+func TestValidateBearerToken(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	mux := http.NewServeMux()
+	idp := httptest.NewServer(mux)
+	defer idp.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"jwks_uri":               idp.URL + "/jwks",
+			"authorization_endpoint": idp.URL + "/auth",
+			"token_endpoint":         idp.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "EC",
+				"kid": "key1",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+			}},
+		})
+	})
+
+	p, err := New(Config{
+		DiscoveryURL: idp.URL + "/.well-known/openid-configuration",
+		RedirectURL:  "https://login.example.com/callback",
+		ClientID:     "CLIENTID",
+		ClaimMapping: map[string]string{"email": "upn"},
+	}, nopRecorder{}, &fakeCookieManager{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	sign := func(claims jwt.MapClaims) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		tok.Header["kid"] = "key1"
+		s, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatalf("SignedString: %v", err)
+		}
+		return s
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	for _, tc := range []struct {
+		name      string
+		claims    jwt.MapClaims
+		audiences []string
+		ok        bool
+	}{
+		{"valid", jwt.MapClaims{"iss": idp.URL, "aud": "CLIENTID", "exp": exp, "upn": "bob@example.com"}, nil, true},
+		{"api audience", jwt.MapClaims{"iss": idp.URL, "aud": "api://foo", "exp": exp, "upn": "bob@example.com"}, []string{"api://foo"}, true},
+		{"wrong audience", jwt.MapClaims{"iss": idp.URL, "aud": "OTHER", "exp": exp, "upn": "bob@example.com"}, nil, false},
+		{"wrong issuer", jwt.MapClaims{"iss": "https://evil.example.com", "aud": "CLIENTID", "exp": exp, "upn": "bob@example.com"}, nil, false},
+		{"expired", jwt.MapClaims{"iss": idp.URL, "aud": "CLIENTID", "exp": time.Now().Add(-time.Hour).Unix(), "upn": "bob@example.com"}, nil, false},
+		{"no exp", jwt.MapClaims{"iss": idp.URL, "aud": "CLIENTID", "upn": "bob@example.com"}, nil, false},
+		{"no email", jwt.MapClaims{"iss": idp.URL, "aud": "CLIENTID", "exp": exp}, nil, false},
+	} {
+		claims, err := p.ValidateBearerToken(sign(tc.claims), tc.audiences)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: ValidateBearerToken() err = %v, want ok=%v", tc.name, err, tc.ok)
+			continue
+		}
+		if tc.ok && claims["email"] != "bob@example.com" {
+			t.Errorf("%s: email = %v, want bob@example.com", tc.name, claims["email"])
+		}
+	}
+	if _, err := p.ValidateBearerToken("garbage", nil); err == nil {
+		t.Error("ValidateBearerToken(garbage) succeeded")
+	}
+}
+
+func TestBackchannelLogout(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	mux := http.NewServeMux()
+	idp := httptest.NewServer(mux)
+	defer idp.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"jwks_uri":               idp.URL + "/jwks",
+			"authorization_endpoint": idp.URL + "/auth",
+			"token_endpoint":         idp.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "EC",
+				"kid": "key1",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+			}},
+		})
+	})
+
+	cm := &fakeCookieManager{}
+	p, err := New(Config{
+		DiscoveryURL:      idp.URL + "/.well-known/openid-configuration",
+		RedirectURL:       "https://login.example.com/callback",
+		ClientID:          "CLIENTID",
+		BackchannelLogout: true,
+	}, nopRecorder{}, cm)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	logout := func(claims jwt.MapClaims) int {
+		tok := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		tok.Header["kid"] = "key1"
+		s, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatalf("SignedString: %v", err)
+		}
+		req := httptest.NewRequest("POST", "https://login.example.com/logout", strings.NewReader(url.Values{"logout_token": {s}}.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		p.HandleBackchannelLogout(w, req)
+		return w.Code
+	}
+	now := time.Now().Unix()
+	events := map[string]any{backchannelLogoutEvent: map[string]any{}}
+
+	for _, tc := range []struct {
+		name   string
+		claims jwt.MapClaims
+		code   int
+	}{
+		{"sid", jwt.MapClaims{"iss": idp.URL, "aud": "CLIENTID", "iat": now, "jti": "1", "events": events, "sid": "SID1"}, 200},
+		{"sub", jwt.MapClaims{"iss": idp.URL, "aud": "CLIENTID", "iat": now, "jti": "2", "events": events, "sub": "bob"}, 200},
+		{"wrong audience", jwt.MapClaims{"iss": idp.URL, "aud": "OTHER", "iat": now, "jti": "3", "events": events, "sub": "bob"}, 400},
+		{"wrong issuer", jwt.MapClaims{"iss": "https://evil.example.com", "aud": "CLIENTID", "iat": now, "jti": "4", "events": events, "sub": "bob"}, 400},
+		{"no event", jwt.MapClaims{"iss": idp.URL, "aud": "CLIENTID", "iat": now, "jti": "5", "sub": "bob"}, 400},
+		{"nonce", jwt.MapClaims{"iss": idp.URL, "aud": "CLIENTID", "iat": now, "jti": "6", "events": events, "sub": "bob", "nonce": "x"}, 400},
+		{"no sub or sid", jwt.MapClaims{"iss": idp.URL, "aud": "CLIENTID", "iat": now, "jti": "7", "events": events}, 400},
+	} {
+		if got := logout(tc.claims); got != tc.code {
+			t.Errorf("%s: status = %d, want %d", tc.name, got, tc.code)
+		}
+	}
+	if got, want := cm.revoked, []string{"idp_sid=SID1", "sub=bob"}; !slices.Equal(got, want) {
+		t.Errorf("revoked = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,330 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// The device authorization grant lets devices with limited input
+// capabilities, e.g. CLI tools or TVs, obtain tokens. The user approves the
+// request in a browser, on the verification page, which is protected by SSO.
+// https://datatracker.ietf.org/doc/html/rfc8628
+
+const (
+	deviceAuthorizationPath = "/device_authorization"
+	deviceVerificationPath  = "/device"
+
+	deviceCodeLifetime = 10 * time.Minute
+	devicePollInterval = 5 * time.Second
+
+	// userCodeChars are the characters used in user codes. Vowels are
+	// omitted to avoid accidental words, and the codes are case
+	// insensitive.
+	userCodeChars = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+var (
+	//go:embed device-template.html
+	deviceEmbed    string
+	deviceTemplate *template.Template
+)
+
+func init() {
+	deviceTemplate = template.Must(template.New("device").Parse(deviceEmbed))
+}
+
+type deviceData struct {
+	created  time.Time
+	clientID string
+	scope    string
+	userCode string
+	lastPoll time.Time
+	denied   bool
+	// csrfTokens are the tokens of the approval forms, by user. A form can
+	// only be submitted by the user it was shown to.
+	csrfTokens map[string]string
+	// userClaims are the claims of the user who approved the request.
+	userClaims jwt.MapClaims
+}
+
+// ServeDeviceAuthorization handles device authorization requests.
+func (s *ProviderServer) ServeDeviceAuthorization(w http.ResponseWriter, req *http.Request) {
+	s.vacuum()
+	if req.Method != http.MethodPost {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	req.ParseForm()
+	client, ok := s.findClient(req)
+	if !ok || !client.allowsGrant(grantDeviceCode) {
+		oauthError(w, "invalid_client")
+		return
+	}
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	deviceCode := base64.RawURLEncoding.EncodeToString(b)
+	userCode, err := newUserCode()
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	if _, exists := s.userCodes[userCode]; exists {
+		s.mu.Unlock()
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	s.devices[deviceCode] = &deviceData{
+		created:  time.Now().UTC(),
+		clientID: client.ID,
+		scope:    req.Form.Get("scope"),
+		userCode: userCode,
+	}
+	s.userCodes[userCode] = deviceCode
+	s.mu.Unlock()
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	verificationURI := fmt.Sprintf("https://%s%s%s", host, s.opts.PathPrefix, deviceVerificationPath)
+	resp := struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?user_code=" + userCode,
+		ExpiresIn:               int(deviceCodeLifetime.Seconds()),
+		Interval:                int(devicePollInterval.Seconds()),
+	}
+	s.opts.EventRecorder.Record("allow openid device authorization request for " + client.ID)
+	writeJSON(w, resp)
+}
+
+// ServeDeviceVerification is where users enter the user code displayed by
+// the device, and approve or deny the request.
+func (s *ProviderServer) ServeDeviceVerification(w http.ResponseWriter, req *http.Request) {
+	s.vacuum()
+	userClaims := s.opts.ClaimsFromCtx(req.Context())
+	if userClaims == nil {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+	req.ParseForm()
+	data := struct {
+		Self     string
+		Email    any
+		UserCode string
+		ClientID string
+		CSRF     string
+		Error    string
+		Message  string
+	}{
+		Self:     req.URL.Path,
+		Email:    userClaims["email"],
+		UserCode: normalizeUserCode(req.Form.Get("user_code")),
+	}
+	render := func() {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := deviceTemplate.Execute(w, data); err != nil {
+			s.opts.Logger.Errorf("ERR device-template: %v", err)
+		}
+	}
+	if data.UserCode == "" {
+		render()
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[s.userCodes[data.UserCode]]
+	if !ok || d.userClaims != nil || d.denied {
+		data.Error = "Invalid or expired code"
+		render()
+		return
+	}
+	data.ClientID = d.clientID
+
+	user := fmt.Sprintf("%v %v", userClaims["sub"], userClaims["email"])
+	if req.Method != http.MethodPost || !req.PostForm.Has("action") {
+		if d.csrfTokens == nil {
+			d.csrfTokens = make(map[string]string)
+		}
+		if d.csrfTokens[user] == "" {
+			b := make([]byte, 16)
+			if _, err := io.ReadFull(rand.Reader, b); err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			d.csrfTokens[user] = base64.RawURLEncoding.EncodeToString(b)
+		}
+		data.CSRF = d.csrfTokens[user]
+		render()
+		return
+	}
+	if tok := d.csrfTokens[user]; tok == "" || subtle.ConstantTimeCompare([]byte(req.PostForm.Get("csrf")), []byte(tok)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	switch req.PostForm.Get("action") {
+	case "approve":
+		d.userClaims = userClaims
+		data.Message = "The device is now logged in. You can close this window."
+		s.opts.EventRecorder.Record("openid device authorization approved for " + d.clientID)
+	case "deny":
+		d.denied = true
+		data.Message = "The request was denied."
+		s.opts.EventRecorder.Record("openid device authorization denied for " + d.clientID)
+	}
+	render()
+}
+
+// serveDeviceCode handles the token requests of the device authorization
+// grant. The device polls this endpoint until the user approves or denies
+// the request.
+func (s *ProviderServer) serveDeviceCode(w http.ResponseWriter, req *http.Request, client Client) {
+	deviceCode := req.Form.Get("device_code")
+	now := time.Now().UTC()
+
+	s.mu.Lock()
+	d, ok := s.devices[deviceCode]
+	if !ok || d.clientID != client.ID {
+		s.mu.Unlock()
+		oauthError(w, "invalid_grant")
+		return
+	}
+	if d.created.Add(deviceCodeLifetime).Before(now) {
+		s.mu.Unlock()
+		oauthError(w, "expired_token")
+		return
+	}
+	if d.denied {
+		delete(s.devices, deviceCode)
+		delete(s.userCodes, d.userCode)
+		s.mu.Unlock()
+		oauthError(w, "access_denied")
+		return
+	}
+	if d.userClaims == nil {
+		tooFast := now.Sub(d.lastPoll) < devicePollInterval
+		d.lastPoll = now
+		s.mu.Unlock()
+		if tooFast {
+			oauthError(w, "slow_down")
+			return
+		}
+		oauthError(w, "authorization_pending")
+		return
+	}
+	delete(s.devices, deviceCode)
+	delete(s.userCodes, d.userCode)
+	s.mu.Unlock()
+
+	resp, err := s.issueTokens(client, d.userClaims, d.scope, "", "")
+	if err != nil {
+		s.opts.Logger.Errorf("ERR issueTokens: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.opts.EventRecorder.Record("allow openid device token request for " + client.ID)
+	writeJSON(w, resp)
+}
+
+func newUserCode() (string, error) {
+	var sb strings.Builder
+	for i := 0; i < 8; i++ {
+		if i == 4 {
+			sb.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeChars))))
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(userCodeChars[n.Int64()])
+	}
+	return sb.String(), nil
+}
+
+// normalizeUserCode converts what the user typed to the format of the user
+// codes, e.g. "bcdf ghjk" becomes "BCDF-GHJK".
+func normalizeUserCode(code string) string {
+	var sb strings.Builder
+	for _, c := range strings.ToUpper(code) {
+		if strings.ContainsRune(userCodeChars, c) {
+			if sb.Len() == 4 {
+				sb.WriteByte('-')
+			}
+			sb.WriteRune(c)
+		}
+	}
+	if sb.Len() != 9 {
+		return ""
+	}
+	return sb.String()
+}
+
+func oauthError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(content)
+}
@@ -0,0 +1,187 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+	jwt "github.com/golang-jwt/jwt/v5"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/tokenmanager"
+)
+
+type claimsKey struct{}
+
+func TestDeviceFlow(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateAESMasterKeyForTest: %v", err)
+	}
+	tm, err := tokenmanager.New(storage.New(t.TempDir(), mk), nil, nil)
+	if err != nil {
+		t.Fatalf("tokenmanager.New: %v", err)
+	}
+	s := NewServer(ServerOptions{
+		TokenManager:  tm,
+		Issuer:        "https://idp.example.com",
+		EventRecorder: nopRecorder{},
+		ClaimsFromCtx: func(ctx context.Context) jwt.MapClaims {
+			c, _ := ctx.Value(claimsKey{}).(jwt.MapClaims)
+			return c
+		},
+		Clients: []Client{
+			{ID: "cli", Secret: "secret", GrantTypes: []string{"device_code"}},
+		},
+	})
+
+	postForm := func(path string, form url.Values, claims jwt.MapClaims) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "https://idp.example.com"+path, strings.NewReader(form.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		if claims != nil {
+			req = req.WithContext(context.WithValue(req.Context(), claimsKey{}, claims))
+		}
+		w := httptest.NewRecorder()
+		switch path {
+		case deviceAuthorizationPath:
+			s.ServeDeviceAuthorization(w, req)
+		case deviceVerificationPath:
+			s.ServeDeviceVerification(w, req)
+		case tokenPath:
+			s.ServeToken(w, req)
+		}
+		return w
+	}
+	poll := func(deviceCode string) (int, map[string]any) {
+		w := postForm(tokenPath, url.Values{
+			"grant_type":    {grantDeviceCode},
+			"device_code":   {deviceCode},
+			"client_id":     {"cli"},
+			"client_secret": {"secret"},
+		}, nil)
+		var resp map[string]any
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+
+	w := postForm(deviceAuthorizationPath, url.Values{"client_id": {"cli"}, "client_secret": {"secret"}, "scope": {"openid email"}}, nil)
+	if got, want := w.Code, 200; got != want {
+		t.Fatalf("device authorization code = %d, want %d", got, want)
+	}
+	var da struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&da); err != nil {
+		t.Fatalf("device authorization: %v", err)
+	}
+	if got, want := da.VerificationURIComplete, "https://idp.example.com/device?user_code="+da.UserCode; got != want {
+		t.Errorf("verification_uri_complete = %q, want %q", got, want)
+	}
+
+	if code, resp := poll(da.DeviceCode); code != 400 || resp["error"] != "authorization_pending" {
+		t.Errorf("poll = %d %v, want authorization_pending", code, resp)
+	}
+	if code, resp := poll(da.DeviceCode); code != 400 || resp["error"] != "slow_down" {
+		t.Errorf("poll = %d %v, want slow_down", code, resp)
+	}
+
+	// The user enters the code in lower case without the dash.
+	userCode := strings.ToLower(strings.ReplaceAll(da.UserCode, "-", " "))
+	user := jwt.MapClaims{"sub": "bob", "email": "bob@example.com"}
+	w = postForm(deviceVerificationPath, url.Values{"user_code": {userCode}}, user)
+	body := w.Body.String()
+	if !strings.Contains(body, "<b>cli</b> wants to access your account") {
+		t.Fatalf("verification page = %s", body)
+	}
+	m := regexp.MustCompile(`name="csrf" value="([^"]+)"`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("verification page has no csrf token: %s", body)
+	}
+	csrf := m[1]
+
+	// A cross-site POST doesn't have the token of the user's form, and
+	// another user's token doesn't work either.
+	for _, tc := range []struct {
+		csrf   string
+		claims jwt.MapClaims
+	}{
+		{"", user},
+		{"foo", user},
+		{csrf, jwt.MapClaims{"sub": "eve", "email": "eve@example.com"}},
+	} {
+		w = postForm(deviceVerificationPath, url.Values{"user_code": {userCode}, "action": {"approve"}, "csrf": {tc.csrf}}, tc.claims)
+		if got, want := w.Code, 403; got != want {
+			t.Errorf("approve with csrf %q = %d, want %d", tc.csrf, got, want)
+		}
+	}
+	if code, resp := poll(da.DeviceCode); code != 400 || resp["error"] != "slow_down" {
+		t.Errorf("poll = %d %v, want slow_down", code, resp)
+	}
+
+	w = postForm(deviceVerificationPath, url.Values{"user_code": {userCode}, "action": {"approve"}, "csrf": {csrf}}, user)
+	if body := w.Body.String(); !strings.Contains(body, "The device is now logged in") {
+		t.Fatalf("verification page = %s", body)
+	}
+
+	code, resp := poll(da.DeviceCode)
+	if code != 200 {
+		t.Fatalf("poll = %d %v", code, resp)
+	}
+	tok, err := tm.ValidateToken(resp["id_token"].(string), jwt.WithIssuer("https://idp.example.com"), jwt.WithAudience("cli"))
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	if got, want := tok.Claims.(jwt.MapClaims)["email"], "bob@example.com"; got != want {
+		t.Errorf("email = %v, want %v", got, want)
+	}
+
+	// The device code can only be used once.
+	if code, resp := poll(da.DeviceCode); code != 400 || resp["error"] != "invalid_grant" {
+		t.Errorf("poll = %d %v, want invalid_grant", code, resp)
+	}
+}
+
+func TestNormalizeUserCode(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"BCDF-GHJK", "BCDF-GHJK"},
+		{"bcdf ghjk", "BCDF-GHJK"},
+		{"bcdfghjk", "BCDF-GHJK"},
+		{"bcdfghj", ""},
+		{"bcdfghjkl", ""},
+		{"", ""},
+	} {
+		if got := normalizeUserCode(tc.in); got != tc.want {
+			t.Errorf("normalizeUserCode(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
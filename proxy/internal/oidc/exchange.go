@@ -0,0 +1,154 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package oidc
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	tokenTypeIDToken     = "urn:ietf:params:oauth:token-type:id_token"
+	tokenTypeJWT         = "urn:ietf:params:oauth:token-type:jwt"
+
+	defaultTokenExchangeLifetime = 5 * time.Minute
+)
+
+type tokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+	Scope           string `json:"scope,omitempty"`
+}
+
+// serveTokenExchange exchanges a token issued by the proxy, e.g. an ID token
+// generated for a backend, for a new token with a narrower audience and
+// scope. The new token can't outlive the subject token.
+// https://datatracker.ietf.org/doc/html/rfc8693
+func (s *ProviderServer) serveTokenExchange(w http.ResponseWriter, req *http.Request, client Client) {
+	if tt := req.Form.Get("subject_token_type"); !slices.Contains([]string{tokenTypeAccessToken, tokenTypeIDToken, tokenTypeJWT}, tt) {
+		s.opts.Logger.Errorf("ERR token exchange: unsupported subject_token_type %q", tt)
+		oauthError(w, "invalid_request")
+		return
+	}
+	if tt := req.Form.Get("requested_token_type"); tt != "" && tt != tokenTypeAccessToken && tt != tokenTypeJWT {
+		s.opts.Logger.Errorf("ERR token exchange: unsupported requested_token_type %q", tt)
+		oauthError(w, "invalid_request")
+		return
+	}
+	tok, err := s.opts.TokenManager.ValidateToken(req.Form.Get("subject_token"), jwt.WithExpirationRequired())
+	if err != nil {
+		s.opts.Logger.Errorf("ERR token exchange: %v", err)
+		oauthError(w, "invalid_grant")
+		return
+	}
+	subject, ok := tok.Claims.(jwt.MapClaims)
+	// The proxy's own auth tokens, i.e. the session cookies, can't be
+	// exchanged.
+	if !ok || subject["proxyauth"] != nil {
+		oauthError(w, "invalid_grant")
+		return
+	}
+	sub, _ := subject.GetSubject()
+	if sub == "" {
+		oauthError(w, "invalid_grant")
+		return
+	}
+	if s.opts.Revocations != nil && s.opts.Revocations.IsRevoked(s.revocationProvider(), subject) {
+		oauthError(w, "invalid_grant")
+		return
+	}
+
+	aud := []string{client.ID}
+	if v := req.Form["audience"]; len(v) > 0 {
+		for _, a := range v {
+			if !slices.Contains(client.Audiences, a) {
+				s.opts.Logger.Errorf("ERR token exchange: audience %q not allowed for %q", a, client.ID)
+				oauthError(w, "invalid_target")
+				return
+			}
+		}
+		aud = v
+	}
+	// The requested scopes must be allowed for the client, and they
+	// can't be broader than the subject token's scopes.
+	subjectScopes, hasScope := subject["scope"].(string)
+	var scopes []string
+	for _, v := range strings.Fields(req.Form.Get("scope")) {
+		if !slices.Contains(client.Scopes, v) || (hasScope && !slices.Contains(strings.Fields(subjectScopes), v)) {
+			s.opts.Logger.Errorf("ERR token exchange: scope %q not allowed for %q", v, client.ID)
+			oauthError(w, "invalid_scope")
+			return
+		}
+		scopes = append(scopes, v)
+	}
+
+	now := time.Now().UTC()
+	exp := now.Add(lifetime(client.AccessTokenLifetime, defaultTokenExchangeLifetime))
+	if e, _ := subject.GetExpirationTime(); e != nil && e.Before(exp) {
+		exp = e.Time
+	}
+	// The act claim identifies the client that requested the token, and
+	// the previous actors, if the subject token was itself exchanged.
+	act := map[string]any{"sub": client.ID}
+	if prev, ok := subject["act"]; ok {
+		act["act"] = prev
+	}
+	claims := jwt.MapClaims{
+		"iat":       now.Unix(),
+		"exp":       exp.Unix(),
+		"iss":       s.opts.Issuer,
+		"aud":       aud,
+		"sub":       sub,
+		"client_id": client.ID,
+		"act":       act,
+		"jti":       newJTI(),
+	}
+	if len(scopes) > 0 {
+		claims["scope"] = strings.Join(scopes, " ")
+	}
+	if email, ok := subject["email"].(string); ok {
+		claims["email"] = email
+	}
+	token, err := s.opts.TokenManager.CreateToken(claims, "RS256")
+	if err != nil {
+		s.opts.Logger.Errorf("ERR token exchange: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.opts.EventRecorder.Record("allow openid token exchange request for " + client.ID)
+	writeJSON(w, tokenExchangeResponse{
+		AccessToken:     token,
+		IssuedTokenType: tokenTypeAccessToken,
+		TokenType:       "Bearer",
+		ExpiresIn:       int(exp.Sub(now).Seconds()),
+		Scope:           strings.Join(scopes, " "),
+	})
+}
@@ -0,0 +1,149 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package oidc
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+	jwt "github.com/golang-jwt/jwt/v5"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/tokenmanager"
+)
+
+func TestTokenExchange(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateAESMasterKeyForTest: %v", err)
+	}
+	tm, err := tokenmanager.New(storage.New(t.TempDir(), mk), nil, nil)
+	if err != nil {
+		t.Fatalf("tokenmanager.New: %v", err)
+	}
+	s := NewServer(ServerOptions{
+		TokenManager:  tm,
+		Issuer:        "https://idp.example.com",
+		EventRecorder: nopRecorder{},
+		Clients: []Client{
+			{ID: "frontend", Secret: "secret1", GrantTypes: []string{"token_exchange"}, Scopes: []string{"read", "write"}, Audiences: []string{"https://api.example.com/"}},
+			{ID: "other", Secret: "secret2", GrantTypes: []string{"client_credentials"}},
+		},
+	})
+
+	now := time.Now()
+	newToken := func(claims jwt.MapClaims) string {
+		claims["iss"] = "https://login.example.com"
+		claims["iat"] = now.Unix()
+		if _, ok := claims["exp"]; !ok {
+			claims["exp"] = now.Add(time.Hour).Unix()
+		}
+		tok, err := tm.CreateToken(claims, "ES256")
+		if err != nil {
+			t.Fatalf("CreateToken: %v", err)
+		}
+		return tok
+	}
+	idToken := newToken(jwt.MapClaims{"sub": "bob", "email": "bob@example.com", "aud": "https://www.example.com/", "exp": now.Add(2 * time.Minute).Unix()})
+
+	exchange := func(user, pass string, form url.Values) (int, map[string]any) {
+		form.Set("grant_type", grantTokenExchange)
+		if !form.Has("subject_token_type") {
+			form.Set("subject_token_type", tokenTypeIDToken)
+		}
+		req := httptest.NewRequest("POST", "https://idp.example.com/token", strings.NewReader(form.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(user, pass)
+		w := httptest.NewRecorder()
+		s.ServeToken(w, req)
+		var resp map[string]any
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	code, resp := exchange("frontend", "secret1", url.Values{
+		"subject_token": {idToken},
+		"audience":      {"https://api.example.com/"},
+		"scope":         {"read"},
+	})
+	if code != 200 {
+		t.Fatalf("exchange: code %d, %v", code, resp)
+	}
+	if got, want := resp["issued_token_type"], tokenTypeAccessToken; got != want {
+		t.Errorf("issued_token_type = %v, want %v", got, want)
+	}
+	if got := resp["expires_in"].(float64); got > 120 {
+		t.Errorf("expires_in = %v, want <= 120", got)
+	}
+	tok, err := tm.ValidateToken(resp["access_token"].(string), jwt.WithIssuer("https://idp.example.com"), jwt.WithAudience("https://api.example.com/"))
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	claims := tok.Claims.(jwt.MapClaims)
+	if claims["sub"] != "bob" || claims["email"] != "bob@example.com" || claims["scope"] != "read" {
+		t.Errorf("claims = %v", claims)
+	}
+	if act, _ := claims["act"].(map[string]any); act["sub"] != "frontend" {
+		t.Errorf("act = %v", claims["act"])
+	}
+
+	// The exchanged token can't be used to get broader scopes.
+	if code, resp := exchange("frontend", "secret1", url.Values{
+		"subject_token":      {resp["access_token"].(string)},
+		"subject_token_type": {tokenTypeAccessToken},
+		"scope":              {"write"},
+	}); code != 400 || resp["error"] != "invalid_scope" {
+		t.Errorf("exchange with broader scope: code %d, %v", code, resp)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		user      string
+		form      url.Values
+		wantCode  int
+		wantError string
+	}{
+		{"bad audience", "frontend", url.Values{"subject_token": {idToken}, "audience": {"https://admin.example.com/"}}, 400, "invalid_target"},
+		{"bad scope", "frontend", url.Values{"subject_token": {idToken}, "scope": {"admin"}}, 400, "invalid_scope"},
+		{"bad token", "frontend", url.Values{"subject_token": {"garbage"}}, 400, "invalid_grant"},
+		{"auth token", "frontend", url.Values{"subject_token": {newToken(jwt.MapClaims{"sub": "bob", "proxyauth": "https://login.example.com"})}}, 400, "invalid_grant"},
+		{"expired token", "frontend", url.Values{"subject_token": {newToken(jwt.MapClaims{"sub": "bob", "exp": now.Add(-time.Hour).Unix()})}}, 400, "invalid_grant"},
+		{"bad token type", "frontend", url.Values{"subject_token": {idToken}, "subject_token_type": {"urn:ietf:params:oauth:token-type:saml2"}}, 400, "invalid_request"},
+		{"grant not allowed", "other", url.Values{"subject_token": {idToken}}, 400, ""},
+	} {
+		pass := "secret1"
+		if tc.user == "other" {
+			pass = "secret2"
+		}
+		code, resp := exchange(tc.user, pass, tc.form)
+		if code != tc.wantCode || (tc.wantError != "" && resp["error"] != tc.wantError) {
+			t.Errorf("%s: code %d, %v, want %d %q", tc.name, code, resp, tc.wantCode, tc.wantError)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package oidc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	introspectionPath = "/introspect"
+	revocationPath    = "/revoke"
+)
+
+func newJTI() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// revocationProvider is the name used to identify this server's tokens in
+// the revocation list.
+func (s *ProviderServer) revocationProvider() string {
+	return "oidc:" + s.opts.Issuer
+}
+
+// validateToken returns the claims of token if it was issued by this server
+// and is still active.
+func (s *ProviderServer) validateToken(token string) (jwt.MapClaims, bool) {
+	s.mu.Lock()
+	data, ok := s.accessTokens[token]
+	s.mu.Unlock()
+	if ok {
+		claims := jwt.MapClaims{
+			"client_id":  data.clientID,
+			"exp":        data.expires.Unix(),
+			"token_type": "Bearer",
+		}
+		for _, k := range []string{"iss", "sub", "scope", "iat", "email"} {
+			if v, exists := data.claims[k]; exists {
+				claims[k] = v
+			}
+		}
+		if s.opts.Revocations != nil && s.opts.Revocations.IsRevoked(s.revocationProvider(), data.claims) {
+			return nil, false
+		}
+		return claims, true
+	}
+	tok, err := s.opts.TokenManager.ValidateToken(token, jwt.WithIssuer(s.opts.Issuer))
+	if err != nil {
+		return nil, false
+	}
+	claims, ok := tok.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, false
+	}
+	if s.opts.Revocations != nil && s.opts.Revocations.IsRevoked(s.revocationProvider(), claims) {
+		return nil, false
+	}
+	return claims, true
+}
+
+// ServeIntrospection lets resource servers check whether a token is active.
+// The resource servers must authenticate with the credentials of one of the
+// clients.
+// https://datatracker.ietf.org/doc/html/rfc7662
+func (s *ProviderServer) ServeIntrospection(w http.ResponseWriter, req *http.Request) {
+	s.vacuum()
+	if req.Method != http.MethodPost {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	req.ParseForm()
+	client, ok := s.findClient(req)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Basic")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	resp := map[string]any{"active": false}
+	if claims, ok := s.validateToken(req.PostForm.Get("token")); ok {
+		resp["active"] = true
+		for _, k := range []string{"scope", "client_id", "sub", "exp", "iat", "iss", "aud", "jti", "token_type", "email"} {
+			if v, exists := claims[k]; exists {
+				resp[k] = v
+			}
+		}
+	}
+	s.opts.EventRecorder.Record("openid introspection request from " + client.ID)
+	writeJSON(w, resp)
+}
+
+// ServeRevocation lets clients revoke the tokens that were issued to them,
+// e.g. when the user logs out.
+// https://datatracker.ietf.org/doc/html/rfc7009
+func (s *ProviderServer) ServeRevocation(w http.ResponseWriter, req *http.Request) {
+	s.vacuum()
+	if req.Method != http.MethodPost {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	req.ParseForm()
+	client, ok := s.findClient(req)
+	if !ok {
+		oauthError(w, "invalid_client")
+		return
+	}
+	token := req.PostForm.Get("token")
+
+	s.mu.Lock()
+	if data, ok := s.accessTokens[token]; ok && data.clientID == client.ID {
+		delete(s.accessTokens, token)
+	}
+	if data, ok := s.refresh[token]; ok && data.clientID == client.ID {
+		s.revokeFamilyLocked(data.family)
+	}
+	s.mu.Unlock()
+
+	// Invalid tokens, and tokens issued to other clients, are ignored.
+	if claims, ok := s.validateToken(token); ok && (claims["aud"] == client.ID || claims["client_id"] == client.ID) {
+		jti, _ := claims["jti"].(string)
+		if jti == "" || s.opts.Revocations == nil {
+			oauthError(w, "unsupported_token_type")
+			return
+		}
+		if err := s.opts.Revocations.Revoke(s.revocationProvider(), "jti", jti); err != nil {
+			s.opts.Logger.Errorf("ERR Revoke: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		s.opts.EventRecorder.Record("openid token revoked by " + client.ID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
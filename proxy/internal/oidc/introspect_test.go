@@ -0,0 +1,133 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package oidc
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+	jwt "github.com/golang-jwt/jwt/v5"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/tokenmanager"
+)
+
+type fakeRevocationList map[string]bool
+
+func (rl fakeRevocationList) Revoke(provider, claim, value string) error {
+	rl[provider+" "+claim+" "+value] = true
+	return nil
+}
+
+func (rl fakeRevocationList) IsRevoked(provider string, claims jwt.MapClaims) bool {
+	jti, _ := claims["jti"].(string)
+	return rl[provider+" jti "+jti]
+}
+
+func TestIntrospectionAndRevocation(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateAESMasterKeyForTest: %v", err)
+	}
+	tm, err := tokenmanager.New(storage.New(t.TempDir(), mk), nil, nil)
+	if err != nil {
+		t.Fatalf("tokenmanager.New: %v", err)
+	}
+	s := NewServer(ServerOptions{
+		TokenManager:  tm,
+		Issuer:        "https://idp.example.com",
+		EventRecorder: nopRecorder{},
+		Revocations:   fakeRevocationList{},
+		Clients: []Client{
+			{ID: "m2m", Secret: "secret1", GrantTypes: []string{"client_credentials"}, Scopes: []string{"read"}},
+			{ID: "other", Secret: "secret2", GrantTypes: []string{"client_credentials"}},
+		},
+	})
+
+	call := func(path string, form url.Values, user, pass string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "https://idp.example.com"+path, strings.NewReader(form.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		w := httptest.NewRecorder()
+		switch path {
+		case tokenPath:
+			s.ServeToken(w, req)
+		case introspectionPath:
+			s.ServeIntrospection(w, req)
+		case revocationPath:
+			s.ServeRevocation(w, req)
+		}
+		return w
+	}
+	introspect := func(token string) map[string]any {
+		w := call(introspectionPath, url.Values{"token": {token}}, "other", "secret2")
+		if w.Code != 200 {
+			t.Fatalf("introspection code = %d", w.Code)
+		}
+		var resp map[string]any
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("introspection: %v", err)
+		}
+		return resp
+	}
+
+	w := call(tokenPath, url.Values{"grant_type": {"client_credentials"}}, "m2m", "secret1")
+	var tr struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&tr); err != nil {
+		t.Fatalf("token: %v", err)
+	}
+
+	if got, want := call(introspectionPath, url.Values{"token": {tr.AccessToken}}, "", "").Code, 401; got != want {
+		t.Errorf("unauthenticated introspection code = %d, want %d", got, want)
+	}
+	if resp := introspect(tr.AccessToken); resp["active"] != true || resp["client_id"] != "m2m" || resp["scope"] != "read" {
+		t.Errorf("introspect = %v", resp)
+	}
+	if resp := introspect("garbage"); resp["active"] != false || len(resp) != 1 {
+		t.Errorf("introspect(garbage) = %v", resp)
+	}
+
+	// Clients can't revoke the tokens of other clients.
+	if got, want := call(revocationPath, url.Values{"token": {tr.AccessToken}}, "other", "secret2").Code, 200; got != want {
+		t.Errorf("revocation code = %d, want %d", got, want)
+	}
+	if resp := introspect(tr.AccessToken); resp["active"] != true {
+		t.Errorf("introspect = %v", resp)
+	}
+
+	if got, want := call(revocationPath, url.Values{"token": {tr.AccessToken}}, "m2m", "secret1").Code, 200; got != want {
+		t.Errorf("revocation code = %d, want %d", got, want)
+	}
+	if resp := introspect(tr.AccessToken); resp["active"] != false {
+		t.Errorf("introspect after revocation = %v", resp)
+	}
+}
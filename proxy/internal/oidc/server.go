@@ -27,6 +27,7 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -55,31 +56,48 @@ const (
 	tokenPath                        = "/token"
 	userInfoPath                     = "/userinfo"
 	jwksPath                         = "/jwks"
+
+	grantAuthorizationCode = "authorization_code"
+	grantClientCredentials = "client_credentials"
+	grantDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+	grantRefreshToken      = "refresh_token"
+	grantTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+	defaultCodeLifetime              = 2 * time.Minute
+	defaultAccessTokenLifetime       = 90 * time.Second
+	defaultIDTokenLifetime           = 5 * time.Minute
+	defaultRefreshTokenLifetime      = 24 * time.Hour
+	defaultClientCredentialsLifetime = time.Hour
 )
 
 type openIDConfiguration struct {
-	Issuer                           string   `json:"issuer"`
-	AuthorizationEndpoint            string   `json:"authorization_endpoint"`
-	TokenEndpoint                    string   `json:"token_endpoint"`
-	UserInfoEndpoint                 string   `json:"userinfo_endpoint"`
-	JWKSURI                          string   `json:"jwks_uri"`
-	ResponseTypesSupported           []string `json:"response_types_supported"`
-	SubjectTypesSupported            []string `json:"subject_types_supported"`
-	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
-	ScopesSupported                  []string `json:"scopes_supported"`
-	ClaimsSupported                  []string `json:"claims_supported"`
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported,omitempty"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint,omitempty"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint,omitempty"`
+	RevocationEndpoint                string   `json:"revocation_endpoint,omitempty"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported,omitempty"`
 }
 
 type codeData struct {
-	created     time.Time
-	clientID    string
-	token       string
-	scope       string
-	accessToken string
+	expires    time.Time
+	clientID   string
+	userClaims jwt.MapClaims
+	scope      string
+	nonce      string
 }
 
 type accessData struct {
-	created  time.Time
+	expires  time.Time
 	clientID string
 	claims   jwt.MapClaims
 }
@@ -92,6 +110,8 @@ type ServerOptions struct {
 	ClaimsFromCtx func(context.Context) jwt.MapClaims
 	Clients       []Client
 	RewriteRules  []RewriteRule
+	// Revocations keeps track of revoked tokens. It is optional.
+	Revocations RevocationList
 
 	EventRecorder EventRecorder
 	Logger        interface {
@@ -99,6 +119,12 @@ type ServerOptions struct {
 	}
 }
 
+// RevocationList keeps track of revoked tokens.
+type RevocationList interface {
+	Revoke(provider, claim, value string) error
+	IsRevoked(provider string, claims jwt.MapClaims) bool
+}
+
 // RewriteRule is used to apply a regular expression on an existing JWT claim
 // to create or overwrite another claim, or possibly the same claim.
 type RewriteRule struct {
@@ -123,6 +149,10 @@ func NewServer(opts ServerOptions) *ProviderServer {
 		opts:         opts,
 		codes:        make(map[string]*codeData),
 		accessTokens: make(map[string]*accessData),
+		devices:      make(map[string]*deviceData),
+		userCodes:    make(map[string]string),
+		refresh:      make(map[string]*refreshData),
+		usedRefresh:  make(map[string]*refreshData),
 	}
 }
 
@@ -135,12 +165,80 @@ type ProviderServer struct {
 	mu           sync.Mutex
 	codes        map[string]*codeData
 	accessTokens map[string]*accessData
+	devices      map[string]*deviceData
+	userCodes    map[string]string
+	refresh      map[string]*refreshData
+	// usedRefresh contains the refresh tokens that were already used, and
+	// their token family.
+	usedRefresh map[string]*refreshData
 }
 
 type Client struct {
 	ID          string
 	Secret      string
 	RedirectURI []string
+	// GrantTypes is the list of OAuth2 grant types that the client can
+	// use. The default is authorization_code. The device code grant can
+	// also be called device_code, and the token exchange grant can also
+	// be called token_exchange.
+	GrantTypes []string
+	// Scopes is the list of scopes that the client can request with the
+	// client_credentials and token exchange grants.
+	Scopes []string
+	// Audiences is the list of audiences that the client can request with
+	// the token exchange grant.
+	Audiences []string
+	// CodeLifetime is the lifetime of the authorization codes. The
+	// default is 2 minutes.
+	CodeLifetime time.Duration
+	// AccessTokenLifetime is the lifetime of the access tokens. The
+	// default is 90 seconds, or one hour with the client_credentials
+	// grant.
+	AccessTokenLifetime time.Duration
+	// IDTokenLifetime is the lifetime of the ID tokens. The default is 5
+	// minutes.
+	IDTokenLifetime time.Duration
+	// RefreshTokenLifetime is the lifetime of the refresh tokens, which
+	// are only issued to clients that can use the refresh_token grant. The
+	// default is 24 hours.
+	RefreshTokenLifetime time.Duration
+}
+
+func lifetime(v, def time.Duration) time.Duration {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+func (c Client) allowsGrant(gt string) bool {
+	if len(c.GrantTypes) == 0 {
+		return gt == grantAuthorizationCode
+	}
+	if gt == grantDeviceCode && slices.Contains(c.GrantTypes, "device_code") {
+		return true
+	}
+	if gt == grantTokenExchange && slices.Contains(c.GrantTypes, "token_exchange") {
+		return true
+	}
+	return slices.Contains(c.GrantTypes, gt)
+}
+
+// findClient returns the client with the given credentials. The credentials
+// can be in the request body, or in the authorization header.
+func (s *ProviderServer) findClient(req *http.Request) (Client, bool) {
+	clientID := req.Form.Get("client_id")
+	clientSecret := req.Form.Get("client_secret")
+	if id, secret, ok := req.BasicAuth(); ok && clientSecret == "" {
+		clientID, _ = url.QueryUnescape(id)
+		clientSecret, _ = url.QueryUnescape(secret)
+	}
+	for _, client := range s.opts.Clients {
+		if client.ID == clientID && subtle.ConstantTimeCompare([]byte(client.Secret), []byte(clientSecret)) == 1 {
+			return client, true
+		}
+	}
+	return Client{}, false
 }
 
 func (s *ProviderServer) vacuum() {
@@ -148,15 +246,31 @@ func (s *ProviderServer) vacuum() {
 	defer s.mu.Unlock()
 	now := time.Now().UTC()
 	for k, v := range s.codes {
-		if v.created.Add(2 * time.Minute).Before(now) {
+		if v.expires.Before(now) {
 			delete(s.codes, k)
 		}
 	}
 	for k, v := range s.accessTokens {
-		if v.created.Add(2 * time.Minute).Before(now) {
+		if v.expires.Before(now) {
 			delete(s.accessTokens, k)
 		}
 	}
+	for k, v := range s.refresh {
+		if v.expires.Before(now) {
+			delete(s.refresh, k)
+		}
+	}
+	for k, v := range s.usedRefresh {
+		if v.expires.Before(now) {
+			delete(s.usedRefresh, k)
+		}
+	}
+	for k, v := range s.devices {
+		if v.created.Add(deviceCodeLifetime).Before(now) {
+			delete(s.userCodes, v.userCode)
+			delete(s.devices, k)
+		}
+	}
 }
 
 func (s *ProviderServer) ServeConfig(w http.ResponseWriter, req *http.Request) {
@@ -165,11 +279,14 @@ func (s *ProviderServer) ServeConfig(w http.ResponseWriter, req *http.Request) {
 		host = h
 	}
 	cfg := openIDConfiguration{
-		Issuer:                s.opts.Issuer,
-		AuthorizationEndpoint: fmt.Sprintf("https://%s%s%s", host, s.opts.PathPrefix, authorizationPath),
-		TokenEndpoint:         fmt.Sprintf("https://%s%s%s", host, s.opts.PathPrefix, tokenPath),
-		UserInfoEndpoint:      fmt.Sprintf("https://%s%s%s", host, s.opts.PathPrefix, userInfoPath),
-		JWKSURI:               fmt.Sprintf("https://%s%s%s", host, s.opts.PathPrefix, jwksPath),
+		Issuer:                      s.opts.Issuer,
+		AuthorizationEndpoint:       fmt.Sprintf("https://%s%s%s", host, s.opts.PathPrefix, authorizationPath),
+		TokenEndpoint:               fmt.Sprintf("https://%s%s%s", host, s.opts.PathPrefix, tokenPath),
+		UserInfoEndpoint:            fmt.Sprintf("https://%s%s%s", host, s.opts.PathPrefix, userInfoPath),
+		JWKSURI:                     fmt.Sprintf("https://%s%s%s", host, s.opts.PathPrefix, jwksPath),
+		DeviceAuthorizationEndpoint: fmt.Sprintf("https://%s%s%s", host, s.opts.PathPrefix, deviceAuthorizationPath),
+		IntrospectionEndpoint:       fmt.Sprintf("https://%s%s%s", host, s.opts.PathPrefix, introspectionPath),
+		RevocationEndpoint:          fmt.Sprintf("https://%s%s%s", host, s.opts.PathPrefix, revocationPath),
 		ResponseTypesSupported: []string{
 			"code",
 		},
@@ -185,6 +302,17 @@ func (s *ProviderServer) ServeConfig(w http.ResponseWriter, req *http.Request) {
 			"email",
 			"profile",
 		},
+		GrantTypesSupported: []string{
+			grantAuthorizationCode,
+			grantClientCredentials,
+			grantDeviceCode,
+			grantRefreshToken,
+			grantTokenExchange,
+		},
+		TokenEndpointAuthMethodsSupported: []string{
+			"client_secret_post",
+			"client_secret_basic",
+		},
 		ClaimsSupported: []string{
 			"aud",
 			"email",
@@ -237,14 +365,8 @@ func (s *ProviderServer) ServeAuthorization(w http.ResponseWriter, req *http.Req
 	}
 	clientID := req.Form.Get("client_id")
 	redirectURI := req.Form.Get("redirect_uri")
-	var found bool
-	for _, client := range s.opts.Clients {
-		if client.ID == clientID && slices.Contains(client.RedirectURI, redirectURI) {
-			found = true
-			break
-		}
-	}
-	if !found {
+	client, found := s.client(clientID)
+	if !found || !client.allowsGrant(grantAuthorizationCode) || !slices.Contains(client.RedirectURI, redirectURI) {
 		s.opts.Logger.Errorf("ERR ServeAuthorization: invalid client_id %q or redirect_uri %q", clientID, redirectURI)
 		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
@@ -263,34 +385,64 @@ func (s *ProviderServer) ServeAuthorization(w http.ResponseWriter, req *http.Req
 		return
 	}
 	code := base64.StdEncoding.EncodeToString(b)
-	b = make([]byte, 12)
-	if _, err := io.ReadFull(rand.Reader, b); err != nil {
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
+	sc := grantedScope(req.Form.Get("scope"))
+
+	s.mu.Lock()
+	s.codes[code] = &codeData{
+		expires:    time.Now().UTC().Add(lifetime(client.CodeLifetime, defaultCodeLifetime)),
+		clientID:   clientID,
+		userClaims: userClaims,
+		scope:      sc,
+		nonce:      req.Form.Get("nonce"),
 	}
-	accessToken := base64.StdEncoding.EncodeToString(b)
+	s.mu.Unlock()
 
+	qs := ru.Query()
+	qs.Set("state", req.Form.Get("state"))
+	qs.Set("code", code)
+	qs.Set("scope", sc)
+	ru.RawQuery = qs.Encode()
+
+	s.opts.EventRecorder.Record("allow openid auth request for " + clientID)
+	http.Redirect(w, req, ru.String(), http.StatusFound)
+}
+
+// grantedScope returns the scopes that are granted when scope is requested.
+func grantedScope(scope string) string {
+	sc := "openid"
+	scopes := strings.Split(scope, " ")
+	if slices.Contains(scopes, "email") {
+		sc += " email"
+	}
+	if slices.Contains(scopes, "profile") {
+		sc += " profile"
+	}
+	return sc
+}
+
+// idTokenClaims returns the claims of the ID token to issue to client for
+// the user with userClaims.
+func (s *ProviderServer) idTokenClaims(userClaims jwt.MapClaims, client Client, scope, nonce string) jwt.MapClaims {
 	sub, _ := userClaims.GetSubject()
 
 	now := time.Now().UTC()
 	claims := jwt.MapClaims{
 		"iat":   now.Unix(),
-		"exp":   now.Add(5 * time.Minute).Unix(),
+		"exp":   now.Add(lifetime(client.IDTokenLifetime, defaultIDTokenLifetime)).Unix(),
 		"iss":   s.opts.Issuer,
-		"aud":   clientID,
+		"aud":   client.ID,
 		"sub":   sub,
-		"scope": "openid",
+		"scope": grantedScope(scope),
+		"jti":   newJTI(),
 	}
-	if nonce := req.Form.Get("nonce"); nonce != "" {
+	if nonce != "" {
 		claims["nonce"] = nonce
 	}
 
-	sc := "openid"
-	scopes := strings.Split(req.Form.Get("scope"), " ")
+	scopes := strings.Split(scope, " ")
 	if slices.Contains(scopes, "email") {
 		claims["email"] = userClaims["email"]
 		claims["email_verified"] = true
-		sc += " email"
 	}
 	if slices.Contains(scopes, "profile") {
 		for _, v := range []string{"name", "family_name", "given_name", "middle_name", "nickname", "preferred_username", "profile", "picture", "website", "gender", "birthdate", "zoneinfo", "locale"} {
@@ -298,41 +450,10 @@ func (s *ProviderServer) ServeAuthorization(w http.ResponseWriter, req *http.Req
 				claims[v] = vv
 			}
 		}
-		sc += " profile"
 	}
-	claims["scope"] = sc
 
 	s.applyRewriteRules(s.opts.RewriteRules, userClaims, claims)
-
-	token, err := s.opts.TokenManager.CreateToken(claims, "RS256")
-	if err != nil {
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
-	}
-
-	s.mu.Lock()
-	s.codes[code] = &codeData{
-		created:     now,
-		clientID:    clientID,
-		token:       token,
-		scope:       sc,
-		accessToken: accessToken,
-	}
-	s.accessTokens[accessToken] = &accessData{
-		created:  now,
-		clientID: clientID,
-		claims:   claims,
-	}
-	s.mu.Unlock()
-
-	qs := ru.Query()
-	qs.Set("state", req.Form.Get("state"))
-	qs.Set("code", code)
-	qs.Set("scope", sc)
-	ru.RawQuery = qs.Encode()
-
-	s.opts.EventRecorder.Record("allow openid auth request for " + clientID)
-	http.Redirect(w, req, ru.String(), http.StatusFound)
+	return claims
 }
 
 func (s *ProviderServer) ServeToken(w http.ResponseWriter, req *http.Request) {
@@ -342,23 +463,35 @@ func (s *ProviderServer) ServeToken(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	req.ParseForm()
-	if gt := req.Form.Get("grant_type"); gt != "authorization_code" {
+	client, ok := s.findClient(req)
+	gt := req.Form.Get("grant_type")
+	if !ok || !client.allowsGrant(gt) {
 		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
-	code := req.Form.Get("code")
-	clientID := req.Form.Get("client_id")
-	clientSecret := req.Form.Get("client_secret")
-	redirectURI := req.Form.Get("redirect_uri")
-
-	var found bool
-	for _, client := range s.opts.Clients {
-		if client.ID == clientID && client.Secret == clientSecret && slices.Contains(client.RedirectURI, redirectURI) {
-			found = true
-			break
-		}
+	if gt == grantClientCredentials {
+		s.serveClientCredentials(w, req, client)
+		return
 	}
-	if !found {
+	if gt == grantDeviceCode {
+		s.serveDeviceCode(w, req, client)
+		return
+	}
+	if gt == grantRefreshToken {
+		s.serveRefreshToken(w, req, client)
+		return
+	}
+	if gt == grantTokenExchange {
+		s.serveTokenExchange(w, req, client)
+		return
+	}
+	if gt != grantAuthorizationCode {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	code := req.Form.Get("code")
+	clientID := client.ID
+	if !slices.Contains(client.RedirectURI, req.Form.Get("redirect_uri")) {
 		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
@@ -368,26 +501,67 @@ func (s *ProviderServer) ServeToken(w http.ResponseWriter, req *http.Request) {
 	delete(s.codes, code)
 	s.mu.Unlock()
 
-	if !ok || data.clientID != clientID {
+	if !ok || data.clientID != clientID || data.expires.Before(time.Now()) {
 		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
 
+	resp, err := s.issueTokens(client, data.userClaims, data.scope, data.nonce, "")
+	if err != nil {
+		s.opts.Logger.Errorf("ERR issueTokens: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.opts.EventRecorder.Record("allow openid token request for " + clientID)
+	writeJSON(w, resp)
+}
+
+// serveClientCredentials issues an access token to a client that
+// authenticated with its own credentials, i.e. without a user.
+// https://datatracker.ietf.org/doc/html/rfc6749#section-4.4
+func (s *ProviderServer) serveClientCredentials(w http.ResponseWriter, req *http.Request, client Client) {
+	scopes := client.Scopes
+	if sc := strings.Fields(req.Form.Get("scope")); len(sc) > 0 {
+		for _, v := range sc {
+			if !slices.Contains(client.Scopes, v) {
+				s.opts.Logger.Errorf("ERR ServeToken: scope %q not allowed for %q", v, client.ID)
+				http.Error(w, "invalid scope", http.StatusBadRequest)
+				return
+			}
+		}
+		scopes = sc
+	}
+	lifetime := lifetime(client.AccessTokenLifetime, defaultClientCredentialsLifetime)
+	now := time.Now().UTC()
+	claims := jwt.MapClaims{
+		"iat":       now.Unix(),
+		"exp":       now.Add(lifetime).Unix(),
+		"iss":       s.opts.Issuer,
+		"aud":       client.ID,
+		"sub":       client.ID,
+		"client_id": client.ID,
+		"scope":     strings.Join(scopes, " "),
+		"jti":       newJTI(),
+	}
+	token, err := s.opts.TokenManager.CreateToken(claims, "RS256")
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
 	resp := struct {
 		AccessToken string `json:"access_token"`
 		ExpiresIn   int    `json:"expires_in"`
-		IDToken     string `json:"id_token"`
-		Scope       string `json:"scope"`
+		Scope       string `json:"scope,omitempty"`
 		TokenType   string `json:"token_type"`
 	}{
-		AccessToken: data.accessToken,
-		ExpiresIn:   90,
-		IDToken:     data.token,
-		Scope:       data.scope,
+		AccessToken: token,
+		ExpiresIn:   int(lifetime.Seconds()),
+		Scope:       strings.Join(scopes, " "),
 		TokenType:   "Bearer",
 	}
 
-	s.opts.EventRecorder.Record("allow openid token request for " + clientID)
+	s.opts.EventRecorder.Record("allow openid client_credentials request for " + client.ID)
 	content, err := json.MarshalIndent(resp, "", "  ")
 	if err != nil {
 		http.Error(w, "internal error", http.StatusInternalServerError)
@@ -430,6 +604,7 @@ func (s *ProviderServer) ServeUserInfo(w http.ResponseWriter, req *http.Request)
 		"scope": true,
 		"sid":   true,
 		"nonce": true,
+		"jti":   true,
 	}
 	out := make(map[string]interface{})
 	for k, v := range data.claims {
@@ -24,9 +24,18 @@
 package oidc
 
 import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
 	jwt "github.com/golang-jwt/jwt/v5"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/tokenmanager"
 )
 
 func TestRewriteRules(t *testing.T) {
@@ -87,3 +96,80 @@ func TestRewriteRules(t *testing.T) {
 		t.Errorf("username2 = %q, want %q", got, want)
 	}
 }
+
+func TestClientCredentials(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateAESMasterKeyForTest: %v", err)
+	}
+	tm, err := tokenmanager.New(storage.New(t.TempDir(), mk), nil, nil)
+	if err != nil {
+		t.Fatalf("tokenmanager.New: %v", err)
+	}
+	s := NewServer(ServerOptions{
+		TokenManager:  tm,
+		Issuer:        "https://idp.example.com",
+		EventRecorder: nopRecorder{},
+		Clients: []Client{
+			{ID: "web", Secret: "secret1", RedirectURI: []string{"https://app.example.com/callback"}},
+			{ID: "m2m", Secret: "secret2", GrantTypes: []string{"client_credentials"}, Scopes: []string{"read", "write"}, AccessTokenLifetime: 10 * time.Minute},
+		},
+	})
+
+	post := func(form url.Values, user, pass string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "https://idp.example.com/token", strings.NewReader(form.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		w := httptest.NewRecorder()
+		s.ServeToken(w, req)
+		return w
+	}
+
+	for _, tc := range []struct {
+		name      string
+		form      url.Values
+		user      string
+		pass      string
+		wantCode  int
+		wantScope string
+	}{
+		{"client not allowed", url.Values{"grant_type": {"client_credentials"}, "client_id": {"web"}, "client_secret": {"secret1"}}, "", "", 400, ""},
+		{"wrong secret", url.Values{"grant_type": {"client_credentials"}, "client_id": {"m2m"}, "client_secret": {"secret1"}}, "", "", 400, ""},
+		{"scope not allowed", url.Values{"grant_type": {"client_credentials"}, "scope": {"admin"}}, "m2m", "secret2", 400, ""},
+		{"all scopes", url.Values{"grant_type": {"client_credentials"}, "client_id": {"m2m"}, "client_secret": {"secret2"}}, "", "", 200, "read write"},
+		{"basic auth", url.Values{"grant_type": {"client_credentials"}, "scope": {"read"}}, "m2m", "secret2", 200, "read"},
+	} {
+		w := post(tc.form, tc.user, tc.pass)
+		if got, want := w.Code, tc.wantCode; got != want {
+			t.Errorf("%s: code = %d, want %d", tc.name, got, want)
+			continue
+		}
+		if w.Code != 200 {
+			continue
+		}
+		var resp struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+			Scope       string `json:"scope"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got, want := resp.ExpiresIn, 600; got != want {
+			t.Errorf("%s: expires_in = %d, want %d", tc.name, got, want)
+		}
+		tok, err := tm.ValidateToken(resp.AccessToken, jwt.WithIssuer("https://idp.example.com"), jwt.WithAudience("m2m"))
+		if err != nil {
+			t.Fatalf("%s: ValidateToken: %v", tc.name, err)
+		}
+		claims := tok.Claims.(jwt.MapClaims)
+		if got, want := claims["sub"], "m2m"; got != want {
+			t.Errorf("%s: sub = %v, want %v", tc.name, got, want)
+		}
+		if got, want := claims["scope"], tc.wantScope; got != want {
+			t.Errorf("%s: scope = %v, want %v", tc.name, got, want)
+		}
+	}
+}
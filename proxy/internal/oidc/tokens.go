@@ -0,0 +1,179 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package oidc
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+type refreshData struct {
+	expires    time.Time
+	clientID   string
+	userClaims jwt.MapClaims
+	scope      string
+	// family identifies all the refresh tokens that were derived from the
+	// same authorization. When a refresh token is used more than once, the
+	// whole family is revoked.
+	family string
+}
+
+type serverTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+	TokenType    string `json:"token_type"`
+}
+
+// client returns the client with the given ID.
+func (s *ProviderServer) client(id string) (Client, bool) {
+	for _, client := range s.opts.Clients {
+		if client.ID == id {
+			return client, true
+		}
+	}
+	return Client{}, false
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// issueTokens creates an ID token and an access token for the user with
+// userClaims. A refresh token is also created when the client is allowed to
+// use the refresh_token grant. family is the token family of the refresh
+// token being used, if any.
+func (s *ProviderServer) issueTokens(client Client, userClaims jwt.MapClaims, scope, nonce, family string) (*serverTokenResponse, error) {
+	claims := s.idTokenClaims(userClaims, client, scope, nonce)
+	idToken, err := s.opts.TokenManager.CreateToken(claims, "RS256")
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	accessLifetime := lifetime(client.AccessTokenLifetime, defaultAccessTokenLifetime)
+	resp := &serverTokenResponse{
+		AccessToken: accessToken,
+		ExpiresIn:   int(accessLifetime.Seconds()),
+		IDToken:     idToken,
+		Scope:       claims["scope"].(string),
+		TokenType:   "Bearer",
+	}
+	var refresh *refreshData
+	if client.allowsGrant(grantRefreshToken) {
+		if resp.RefreshToken, err = randomToken(); err != nil {
+			return nil, err
+		}
+		if family == "" {
+			family = resp.RefreshToken
+		}
+		refresh = &refreshData{
+			expires:    now.Add(lifetime(client.RefreshTokenLifetime, defaultRefreshTokenLifetime)),
+			clientID:   client.ID,
+			userClaims: userClaims,
+			scope:      scope,
+			family:     family,
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessTokens[accessToken] = &accessData{
+		expires:  now.Add(accessLifetime),
+		clientID: client.ID,
+		claims:   claims,
+	}
+	if refresh != nil {
+		s.refresh[resp.RefreshToken] = refresh
+	}
+	return resp, nil
+}
+
+// serveRefreshToken exchanges a refresh token for new tokens. Refresh tokens
+// can only be used once. A new refresh token is returned with the new
+// tokens.
+// https://datatracker.ietf.org/doc/html/rfc6749#section-6
+func (s *ProviderServer) serveRefreshToken(w http.ResponseWriter, req *http.Request, client Client) {
+	token := req.Form.Get("refresh_token")
+
+	s.mu.Lock()
+	data, ok := s.refresh[token]
+	if !ok {
+		if used, exists := s.usedRefresh[token]; exists {
+			// The token was already used. Either the client has a
+			// bug, or the token was stolen. Revoke the whole family.
+			s.revokeFamilyLocked(used.family)
+			s.opts.Logger.Errorf("ERR refresh token reused by %q", client.ID)
+		}
+		s.mu.Unlock()
+		oauthError(w, "invalid_grant")
+		return
+	}
+	if data.clientID != client.ID || data.expires.Before(time.Now()) {
+		// The token stays valid for its own client. Another client
+		// presenting it doesn't consume it.
+		s.mu.Unlock()
+		oauthError(w, "invalid_grant")
+		return
+	}
+	delete(s.refresh, token)
+	s.usedRefresh[token] = data
+	s.mu.Unlock()
+
+	if s.opts.Revocations != nil && s.opts.Revocations.IsRevoked(s.revocationProvider(), data.userClaims) {
+		oauthError(w, "invalid_grant")
+		return
+	}
+	resp, err := s.issueTokens(client, data.userClaims, data.scope, "", data.family)
+	if err != nil {
+		s.opts.Logger.Errorf("ERR issueTokens: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.opts.EventRecorder.Record("allow openid refresh request for " + client.ID)
+	writeJSON(w, resp)
+}
+
+// revokeFamilyLocked revokes all the refresh tokens of a token family.
+// s.mu must be held.
+func (s *ProviderServer) revokeFamilyLocked(family string) {
+	for k, v := range s.refresh {
+		if v.family == family {
+			delete(s.refresh, k)
+		}
+	}
+}
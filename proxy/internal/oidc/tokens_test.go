@@ -0,0 +1,134 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+	jwt "github.com/golang-jwt/jwt/v5"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/tokenmanager"
+)
+
+func TestRefreshTokens(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateAESMasterKeyForTest: %v", err)
+	}
+	tm, err := tokenmanager.New(storage.New(t.TempDir(), mk), nil, nil)
+	if err != nil {
+		t.Fatalf("tokenmanager.New: %v", err)
+	}
+	s := NewServer(ServerOptions{
+		TokenManager:  tm,
+		Issuer:        "https://idp.example.com",
+		EventRecorder: nopRecorder{},
+		ClaimsFromCtx: func(ctx context.Context) jwt.MapClaims {
+			return jwt.MapClaims{"sub": "bob", "email": "bob@example.com"}
+		},
+		Clients: []Client{{
+			ID:                  "app",
+			Secret:              "secret",
+			RedirectURI:         []string{"https://app.example.com/callback"},
+			GrantTypes:          []string{"authorization_code", "refresh_token"},
+			AccessTokenLifetime: 10 * time.Minute,
+			IDTokenLifetime:     time.Hour,
+		}, {
+			ID:          "other",
+			Secret:      "other-secret",
+			RedirectURI: []string{"https://other.example.com/callback"},
+			GrantTypes:  []string{"authorization_code", "refresh_token"},
+		}},
+	})
+
+	req := httptest.NewRequest("GET", "https://idp.example.com/authorization?response_type=code&client_id=app&redirect_uri=https://app.example.com/callback&scope=openid+email", nil)
+	w := httptest.NewRecorder()
+	s.ServeAuthorization(w, req)
+	if got, want := w.Code, 302; got != want {
+		t.Fatalf("authorization code = %d, want %d", got, want)
+	}
+	loc, err := url.Parse(w.Header().Get("location"))
+	if err != nil {
+		t.Fatalf("location: %v", err)
+	}
+
+	tokenAs := func(clientID, secret string, form url.Values) (int, serverTokenResponse) {
+		form.Set("client_id", clientID)
+		form.Set("client_secret", secret)
+		req := httptest.NewRequest("POST", "https://idp.example.com/token", strings.NewReader(form.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		s.ServeToken(w, req)
+		var resp serverTokenResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+	token := func(form url.Values) (int, serverTokenResponse) {
+		return tokenAs("app", "secret", form)
+	}
+
+	code, resp1 := token(url.Values{"grant_type": {"authorization_code"}, "code": {loc.Query().Get("code")}, "redirect_uri": {"https://app.example.com/callback"}})
+	if code != 200 || resp1.RefreshToken == "" {
+		t.Fatalf("token = %d %+v", code, resp1)
+	}
+	if got, want := resp1.ExpiresIn, 600; got != want {
+		t.Errorf("expires_in = %d, want %d", got, want)
+	}
+	tok, err := tm.ValidateToken(resp1.IDToken, jwt.WithAudience("app"))
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	if exp, _ := tok.Claims.GetExpirationTime(); exp == nil || time.Until(exp.Time) < 55*time.Minute {
+		t.Errorf("exp = %v, want ~1h", exp)
+	}
+
+	// Another client can't use the refresh token, and doesn't consume it.
+	if code, _ := tokenAs("other", "other-secret", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {resp1.RefreshToken}}); code != 400 {
+		t.Errorf("refresh by other client = %d, want 400", code)
+	}
+
+	code, resp2 := token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {resp1.RefreshToken}})
+	if code != 200 || resp2.RefreshToken == "" || resp2.RefreshToken == resp1.RefreshToken {
+		t.Fatalf("refresh = %d %+v", code, resp2)
+	}
+	if _, err := tm.ValidateToken(resp2.IDToken, jwt.WithAudience("app")); err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+
+	// Reusing a refresh token revokes the whole family.
+	if code, _ := token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {resp1.RefreshToken}}); code != 400 {
+		t.Errorf("reuse = %d, want 400", code)
+	}
+	if code, _ := token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {resp2.RefreshToken}}); code != 400 {
+		t.Errorf("refresh after reuse = %d, want 400", code)
+	}
+}
@@ -44,7 +44,7 @@ import (
 	"net/url"
 	"reflect"
 	"slices"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 
@@ -54,6 +54,7 @@ import (
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/cookiemanager"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/idp"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/tokenmanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/totp"
 )
 
 const passkeyFile = "passkeys"
@@ -65,6 +66,9 @@ var (
 	//go:embed manage-template.html
 	manageEmbed    string
 	manageTemplate *template.Template
+	//go:embed admin-template.html
+	adminEmbed    string
+	adminTemplate *template.Template
 	//go:embed webauthn.js
 	webauthnJSEmbed []byte
 )
@@ -72,6 +76,7 @@ var (
 func init() {
 	authTemplate = template.Must(template.New("passkey-auth").Parse(authEmbed))
 	manageTemplate = template.Must(template.New("passkey-manage").Parse(manageEmbed))
+	adminTemplate = template.Must(template.New("passkey-admin").Parse(adminEmbed))
 }
 
 type user struct {
@@ -113,7 +118,18 @@ type Config struct {
 	OtherCookieManager *cookiemanager.CookieManager
 	TokenManager       *tokenmanager.TokenManager
 	ClaimsFromCtx      func(context.Context) jwt.MapClaims
-	Logger             interface {
+	// TOTP, if set, is used to verify a second authentication factor
+	// after the passkey.
+	TOTP *totp.Manager
+	// Admins is a list of users who are allowed to manage the passkeys
+	// of all users.
+	Admins []string
+	// AuthTemplate, ManageTemplate, and AdminTemplate optionally replace
+	// the built-in HTML templates.
+	AuthTemplate   *template.Template
+	ManageTemplate *template.Template
+	AdminTemplate  *template.Template
+	Logger         interface {
 		Errorf(format string, args ...any)
 	}
 }
@@ -122,6 +138,15 @@ func NewManager(cfg Config) (*Manager, error) {
 	if cfg.Logger == nil {
 		cfg.Logger = defaultLogger{}
 	}
+	if cfg.AuthTemplate == nil {
+		cfg.AuthTemplate = authTemplate
+	}
+	if cfg.ManageTemplate == nil {
+		cfg.ManageTemplate = manageTemplate
+	}
+	if cfg.AdminTemplate == nil {
+		cfg.AdminTemplate = adminTemplate
+	}
 	m := &Manager{
 		cfg:        cfg,
 		challenges: make(map[string]*challenge),
@@ -271,6 +296,9 @@ func (m *Manager) RequestLogin(w http.ResponseWriter, req *http.Request, origURL
 }
 
 func (m *Manager) HandleCallback(w http.ResponseWriter, req *http.Request) {
+	if m.cfg.TOTP != nil && m.cfg.TOTP.HandleRequest(w, req) {
+		return
+	}
 	req.ParseForm()
 	nonce := req.Form.Get("nonce")
 
@@ -367,13 +395,13 @@ func (m *Manager) HandleCallback(w http.ResponseWriter, req *http.Request) {
 		}
 		if mode == "RegisterNewID" || mode == "RefreshID" {
 			data.Email, _ = token.Claims.(jwt.MapClaims)["email"].(string)
-			data.IsAllowed = m.subjectIsAllowed(data.Email)
+			data.IsAllowed = m.subjectIsAllowed(token.Claims.(jwt.MapClaims))
 			data.IsRegistered = m.subjectIsRegistered(data.Email)
 		} else {
 			data.Email, _ = redirectClaims["email"].(string)
 		}
 		w.Header().Set("X-Frame-Options", "DENY")
-		if err := authTemplate.Execute(w, data); err != nil {
+		if err := m.cfg.AuthTemplate.Execute(w, data); err != nil {
 			m.cfg.Logger.Errorf("ERR auth-template: %v", err)
 		}
 
@@ -469,16 +497,15 @@ func (m *Manager) HandleCallback(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "invalid request", http.StatusBadRequest)
 			return
 		}
-		email, _ := token.Claims.(jwt.MapClaims)["email"].(string)
-		if !m.subjectIsAllowed(email) {
-			http.Error(w, "forbidden", http.StatusForbidden)
-			return
-		}
 		claims, ok := token.Claims.(jwt.MapClaims)
 		if !ok {
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
+		if !m.subjectIsAllowed(claims) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
 		claims, err = m.processAttestation(claims, req.Host, req.Form.Get("args"), false)
 		if err != nil {
 			m.cfg.Logger.Errorf("ERR processAttestation: %v", err)
@@ -581,6 +608,15 @@ func (m *Manager) ManageKeys(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if req.Form.Get("admin") != "" {
+		if !slices.Contains(m.cfg.Admins, email) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		m.manageAllKeys(w, req, email, passkeyHash)
+		return
+	}
+
 	switch mode {
 	case "AttestationOptions":
 		if req.Method != "POST" {
@@ -669,19 +705,186 @@ func (m *Manager) ManageKeys(w http.ResponseWriter, req *http.Request) {
 			CurrentKey: passkeyHash,
 		}
 		w.Header().Set("X-Frame-Options", "DENY")
-		manageTemplate.Execute(w, data)
+		m.cfg.ManageTemplate.Execute(w, data)
 
 	default:
 		http.Error(w, "invalid request", http.StatusBadRequest)
 	}
 }
 
+// manageAllKeys lets admins see and revoke the passkeys of all users.
+func (m *Manager) manageAllKeys(w http.ResponseWriter, req *http.Request, adminEmail, passkeyHash string) {
+	mode := req.Form.Get("get")
+	if mode != "" && mode != "JS" {
+		if req.Method != "POST" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if v := req.Header.Get("x-csrf-check"); v != "1" {
+			m.cfg.Logger.Errorf("ERR x-csrf-check: %v", v)
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	email := req.Form.Get("email")
+
+	switch mode {
+	case "AdminUsers":
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(m.allUsers())
+
+	case "AdminDeleteKey":
+		id, err := hex.DecodeString(req.Form.Get("id"))
+		if err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		h := sha256.Sum256(id)
+		if email == adminEmail && passkeyHash == hex.EncodeToString(h[:]) {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		sub := m.subject(email)
+		if err := m.deleteKey(email, id); err != nil {
+			m.cfg.Logger.Errorf("ERR deleteKey(%q, %v): %v", email, id, err)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		m.revokeSessions(sub)
+		m.cfg.Logger.Errorf("INF Passkey %s of %s revoked by %s", hex.EncodeToString(id), email, adminEmail)
+		m.cfg.EventRecorder.Record("passkey admin deletekey request")
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"result": "ok",
+		})
+
+	case "AdminResetUser":
+		sub, err := m.resetUser(email)
+		if err != nil {
+			m.cfg.Logger.Errorf("ERR resetUser(%q): %v", email, err)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		m.revokeSessions(sub)
+		if m.cfg.TOTP != nil {
+			if err := m.cfg.TOTP.DeleteUser(email); err != nil {
+				m.cfg.Logger.Errorf("ERR TOTP.DeleteUser(%q): %v", email, err)
+			}
+		}
+		m.cfg.Logger.Errorf("INF Passkeys of %s reset by %s", email, adminEmail)
+		m.cfg.EventRecorder.Record("passkey admin reset request")
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"result": "ok",
+		})
+
+	case "JS":
+		serveWebauthnJS(w, req)
+
+	case "":
+		data := struct {
+			Email string
+			Users []adminUser
+		}{
+			Email: adminEmail,
+			Users: m.allUsers(),
+		}
+		w.Header().Set("X-Frame-Options", "DENY")
+		m.cfg.AdminTemplate.Execute(w, data)
+
+	default:
+		http.Error(w, "invalid request", http.StatusBadRequest)
+	}
+}
+
+// revokeSessions revokes the sessions of the user with both the passkey
+// provider and the other identity provider, so that the user has to
+// authenticate again with the other identity provider before registering a
+// new passkey.
+func (m *Manager) revokeSessions(sub string) {
+	if sub == "" {
+		return
+	}
+	for _, cm := range []*cookiemanager.CookieManager{m.cfg.CookieManager, m.cfg.OtherCookieManager} {
+		if cm == nil {
+			continue
+		}
+		if err := cm.RevokeSessions("sub", sub); err != nil {
+			m.cfg.Logger.Errorf("ERR RevokeSessions(%q): %v", sub, err)
+		}
+	}
+}
+
+type adminUser struct {
+	Email string    `json:"email"`
+	Keys  []keyItem `json:"keys"`
+}
+
+func (m *Manager) allUsers() []adminUser {
+	m.mu.Lock()
+	emails := make([]string, 0, len(m.db.Subjects))
+	for email := range m.db.Subjects {
+		emails = append(emails, email)
+	}
+	m.mu.Unlock()
+	sort.Strings(emails)
+
+	users := make([]adminUser, 0, len(emails))
+	for _, email := range emails {
+		users = append(users, adminUser{
+			Email: email,
+			Keys:  m.keys(email),
+		})
+	}
+	return users
+}
+
+func (m *Manager) subject(email string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.db.Subjects[email]
+	if !ok {
+		return ""
+	}
+	u, ok := m.db.Handles[h]
+	if !ok {
+		return ""
+	}
+	sub, _ := u.Claims["sub"].(string)
+	return sub
+}
+
+// resetUser deletes all the passkeys of a user. The user will have to
+// register a new passkey after authenticating with the other identity
+// provider.
+func (m *Manager) resetUser(email string) (sub string, retErr error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	commit, err := m.cfg.Store.OpenForUpdate(passkeyFile, &m.db)
+	if err != nil {
+		return "", err
+	}
+	defer commit(false, &retErr)
+
+	h, ok := m.db.Subjects[email]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	if u, ok := m.db.Handles[h]; ok {
+		sub, _ = u.Claims["sub"].(string)
+	}
+	delete(m.db.Handles, h)
+	delete(m.db.Subjects, email)
+	return sub, commit(true, nil)
+}
+
 type keyItem struct {
-	ID       string
-	ShortID  string
-	Hash     string
-	Created  string
-	LastSeen string
+	ID       string `json:"id"`
+	ShortID  string `json:"-"`
+	Hash     string `json:"-"`
+	Created  string `json:"created"`
+	LastSeen string `json:"lastSeen"`
 }
 
 func (m *Manager) keys(email string) []keyItem {
@@ -713,12 +916,11 @@ func (m *Manager) keys(email string) []keyItem {
 	return keys
 }
 
-func (m *Manager) subjectIsAllowed(email string) bool {
+func (m *Manager) subjectIsAllowed(claims jwt.MapClaims) bool {
 	if m.acl == nil {
 		return true
 	}
-	_, subDomain, _ := strings.Cut(email, "@")
-	return slices.Contains(*m.acl, email) || slices.Contains(*m.acl, "@"+subDomain)
+	return idp.MatchACL(*m.acl, claims)
 }
 
 func (m *Manager) subjectIsRegistered(email string) bool {
@@ -775,11 +977,35 @@ func (m *Manager) setAuthToken(w http.ResponseWriter, u *url.URL, claims map[str
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-	sid, ok := claims["sid"].(string)
-	if !ok {
+	// Each passkey login is a new session that can be revoked independently
+	// of the others.
+	sidBytes := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, sidBytes); err != nil {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	sid := hex.EncodeToString(sidBytes)
+	if m.cfg.TOTP != nil {
+		id, err := m.cfg.TOTP.Challenge(email, func(w http.ResponseWriter, req *http.Request) {
+			if err := m.cfg.CookieManager.SetAuthTokenCookie(w, subject, email, sid, u.Host, claims); err != nil {
+				m.cfg.Logger.Errorf("ERR SetAuthTokenCookie: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, req, u.String(), http.StatusSeeOther)
+		})
+		if err != nil {
+			m.cfg.Logger.Errorf("ERR TOTP: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"result":   "ok",
+			"redirect": "?totp=" + id,
+		})
+		return
+	}
 	if err := m.cfg.CookieManager.SetAuthTokenCookie(w, subject, email, sid, u.Host, claims); err != nil {
 		m.cfg.Logger.Errorf("ERR SetAuthTokenCookie: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
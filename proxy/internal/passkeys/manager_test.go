@@ -0,0 +1,146 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package passkeys
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+type nopRecorder struct{}
+
+func (nopRecorder) Record(string) {}
+
+func TestAdmin(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateAESMasterKeyForTest: %v", err)
+	}
+	var claims jwt.MapClaims
+	m, err := NewManager(Config{
+		Store:         storage.New(t.TempDir(), mk),
+		Endpoint:      "https://login.example.com/passkey",
+		EventRecorder: nopRecorder{},
+		ClaimsFromCtx: func(context.Context) jwt.MapClaims { return claims },
+		Admins:        []string{"admin@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	m.db.Handles["bob"] = &user{
+		Handle: Bytes("bob"),
+		Keys:   []*userKey{{ID: Bytes{1}}, {ID: Bytes{2}}},
+		Claims: map[string]any{"sub": "bob-sub", "email": "bob@example.com"},
+	}
+	m.db.Subjects["bob@example.com"] = "bob"
+	m.db.Handles["admin"] = &user{
+		Handle: Bytes("admin"),
+		Keys:   []*userKey{{ID: Bytes{3}}},
+		Claims: map[string]any{"sub": "admin-sub", "email": "admin@example.com"},
+	}
+	m.db.Subjects["admin@example.com"] = "admin"
+
+	hh := sha256.Sum256([]byte("login.example.com"))
+	kh := sha256.Sum256([]byte{3})
+	setUser := func(email string) {
+		claims = jwt.MapClaims{
+			"email":        email,
+			"iat":          float64(time.Now().Unix()),
+			"hhash":        hex.EncodeToString(hh[:]),
+			"passkey_hash": hex.EncodeToString(kh[:]),
+		}
+	}
+	request := func(method, query, body string, csrf bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "https://login.example.com/.sso/passkeys?"+query, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		}
+		if csrf {
+			req.Header.Set("x-csrf-check", "1")
+		}
+		w := httptest.NewRecorder()
+		m.ManageKeys(w, req)
+		return w
+	}
+
+	setUser("bob@example.com")
+	if got, want := request("GET", "admin=1", "", false).Code, http.StatusForbidden; got != want {
+		t.Errorf("non-admin: status = %d, want %d", got, want)
+	}
+
+	setUser("admin@example.com")
+	w := request("GET", "admin=1", "", false)
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("admin page: status = %d, want %d", got, want)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "bob@example.com") {
+		t.Errorf("admin page doesn't contain bob: %s", body)
+	}
+
+	w = request("POST", "admin=1&get=AdminUsers", "", true)
+	var users []adminUser
+	if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil {
+		t.Fatalf("AdminUsers: %v", err)
+	}
+	if got, want := len(users), 2; got != want {
+		t.Fatalf("AdminUsers: len = %d, want %d", got, want)
+	}
+	if got, want := users[1].Email, "bob@example.com"; got != want {
+		t.Errorf("AdminUsers[1].Email = %q, want %q", got, want)
+	}
+
+	if got, want := request("POST", "admin=1&get=AdminDeleteKey", "email=bob%40example.com&id=01", false).Code, http.StatusBadRequest; got != want {
+		t.Errorf("AdminDeleteKey without csrf: status = %d, want %d", got, want)
+	}
+	if got, want := request("POST", "admin=1&get=AdminDeleteKey", "email=admin%40example.com&id=03", true).Code, http.StatusBadRequest; got != want {
+		t.Errorf("AdminDeleteKey current key: status = %d, want %d", got, want)
+	}
+	if got, want := request("POST", "admin=1&get=AdminDeleteKey", "email=bob%40example.com&id=01", true).Code, http.StatusOK; got != want {
+		t.Errorf("AdminDeleteKey: status = %d, want %d", got, want)
+	}
+	if keys := m.keys("bob@example.com"); len(keys) != 1 || keys[0].ID != "02" {
+		t.Errorf("keys = %v, want [02]", keys)
+	}
+
+	if got, want := request("POST", "admin=1&get=AdminResetUser", "email=bob%40example.com", true).Code, http.StatusOK; got != want {
+		t.Errorf("AdminResetUser: status = %d, want %d", got, want)
+	}
+	if m.subjectIsRegistered("bob@example.com") {
+		t.Error("bob is still registered after reset")
+	}
+	if got, want := request("POST", "admin=1&get=AdminResetUser", "email=bob%40example.com", true).Code, http.StatusNotFound; got != want {
+		t.Errorf("AdminResetUser again: status = %d, want %d", got, want)
+	}
+}
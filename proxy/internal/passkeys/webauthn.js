@@ -225,3 +225,44 @@ function switchAccount(token) {
   });
 }
 
+
+function adminRequest(get, body) {
+  fetch('?admin=1&get=' + get, {
+    method: 'POST',
+    headers: {
+      'content-type': 'application/x-www-form-urlencoded',
+      'x-csrf-check': 1,
+    },
+    body: body,
+  })
+  .then(resp => {
+    if (resp.status !== 200) {
+      throw resp.status;
+    }
+    return resp.json();
+  })
+  .then(r => {
+    if (r.result === 'ok') {
+      console.log('Success');
+      window.location.reload();
+    }
+  })
+  .catch(err => {
+    console.log('Failure', err);
+    alert(err);
+  });
+}
+
+function adminDeleteKey(email, id) {
+  if (!window.confirm('Revoke key ID ' + id + ' of ' + email + '?')) {
+    return;
+  }
+  adminRequest('AdminDeleteKey', 'email=' + encodeURIComponent(email) + '&id=' + encodeURIComponent(id));
+}
+
+function adminResetUser(email) {
+  if (!window.confirm('Delete all the passkeys of ' + email + '? They will have to enroll again.')) {
+    return;
+  }
+  adminRequest('AdminResetUser', 'email=' + encodeURIComponent(email));
+}
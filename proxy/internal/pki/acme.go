@@ -0,0 +1,1244 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"golang.org/x/net/idna"
+)
+
+const (
+	acmeNonceLifetime       = time.Hour
+	acmeMaxNonces           = 10000
+	acmeOrderLifetime       = 24 * time.Hour
+	acmeChallengeTimeout    = 30 * time.Second
+	acmeDefaultCertLifetime = 90 * 24 * time.Hour
+	acmeMaxRequestSize      = 1 << 20
+
+	acmeStatusPending     = "pending"
+	acmeStatusReady       = "ready"
+	acmeStatusProcessing  = "processing"
+	acmeStatusValid       = "valid"
+	acmeStatusInvalid     = "invalid"
+	acmeStatusDeactivated = "deactivated"
+
+	acmeChallengeHTTP01    = "http-01"
+	acmeChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+var (
+	// https://www.rfc-editor.org/rfc/rfc8737.html#section-6.1
+	idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+	acmeAlgorithms = []string{"ES256", "ES384", "ES512", "RS256", "EdDSA"}
+)
+
+// ACMEOptions are used to configure the ACME server of a PKI manager.
+type ACMEOptions struct {
+	// Endpoint is the base URL of the ACME server. The directory is at
+	// Endpoint + "/directory".
+	Endpoint string
+	// Challenges is the list of challenge types that the server offers,
+	// i.e. http-01 and/or tls-alpn-01. The default is both.
+	Challenges []string
+	// PreAuthorizedAccounts is a list of account key thumbprints (RFC
+	// 7638). These accounts don't need to complete any challenges.
+	PreAuthorizedAccounts []string
+	// AllowedDomains optionally restricts which domains certificates can
+	// be issued for, e.g. "example.com" or "*.example.com". The latter
+	// matches any subdomain of example.com.
+	AllowedDomains []string
+	// CertificateLifetime is the lifetime of the issued certificates.
+	// The default is 90 days.
+	CertificateLifetime time.Duration
+}
+
+// acmeServer implements a subset of the ACME protocol (RFC 8555) so that
+// standard ACME clients can obtain certificates from the PKI manager.
+type acmeServer struct {
+	m        *PKIManager
+	opts     ACMEOptions
+	base     string
+	prefix   string
+	acctFile string
+
+	// dialContext is used to connect to the servers being validated.
+	dialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	orders map[string]*acmeOrder
+	authzs map[string]*acmeAuthz
+	challs map[string]*acmeChallenge
+}
+
+type acmeAccounts struct {
+	Accounts map[string]*acmeAccount
+}
+
+type acmeAccount struct {
+	ID      string
+	Key     json.RawMessage
+	Contact []string
+	Status  string
+	Created time.Time
+	Certs   []string
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	id          string
+	account     string
+	status      string
+	expires     time.Time
+	identifiers []acmeIdentifier
+	authzs      []*acmeAuthz
+	cert        []byte
+	err         *acmeProblem
+}
+
+type acmeAuthz struct {
+	id         string
+	account    string
+	identifier acmeIdentifier
+	status     string
+	expires    time.Time
+	challenges []*acmeChallenge
+}
+
+type acmeChallenge struct {
+	id        string
+	typ       string
+	token     string
+	status    string
+	validated time.Time
+	err       *acmeProblem
+	authz     *acmeAuthz
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+func acmeError(typ string, status int, format string, args ...any) *acmeProblem {
+	return &acmeProblem{
+		Type:   "urn:ietf:params:acme:error:" + typ,
+		Detail: fmt.Sprintf(format, args...),
+		Status: status,
+	}
+}
+
+func (p *acmeProblem) Error() string {
+	return p.Type + ": " + p.Detail
+}
+
+func newACMEServer(m *PKIManager, opts ACMEOptions) (*acmeServer, error) {
+	u, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("acme endpoint: %w", err)
+	}
+	if len(opts.Challenges) == 0 {
+		opts.Challenges = []string{acmeChallengeHTTP01, acmeChallengeTLSALPN01}
+	}
+	for _, c := range opts.Challenges {
+		if c != acmeChallengeHTTP01 && c != acmeChallengeTLSALPN01 {
+			return nil, fmt.Errorf("acme: unsupported challenge type %q", c)
+		}
+	}
+	if opts.CertificateLifetime <= 0 {
+		opts.CertificateLifetime = acmeDefaultCertLifetime
+	}
+	s := &acmeServer{
+		m:           m,
+		opts:        opts,
+		base:        strings.TrimSuffix(opts.Endpoint, "/"),
+		prefix:      strings.TrimSuffix(u.Path, "/"),
+		acctFile:    m.pkiFile + "-acme",
+		dialContext: (&net.Dialer{}).DialContext,
+		nonces:      make(map[string]time.Time),
+		orders:      make(map[string]*acmeOrder),
+		authzs:      make(map[string]*acmeAuthz),
+		challs:      make(map[string]*acmeChallenge),
+	}
+	m.opts.Store.CreateEmptyFile(s.acctFile, &acmeAccounts{})
+	return s, nil
+}
+
+// ServeACME implements the ACME server endpoints.
+func (m *PKIManager) ServeACME(w http.ResponseWriter, req *http.Request) {
+	if m.acme == nil {
+		http.NotFound(w, req)
+		return
+	}
+	m.acme.ServeHTTP(w, req)
+}
+
+func (s *acmeServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rel, ok := strings.CutPrefix(req.URL.Path, s.prefix)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch rel {
+	case "/directory":
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, map[string]any{
+			"newNonce":   s.base + "/new-nonce",
+			"newAccount": s.base + "/new-account",
+			"newOrder":   s.base + "/new-order",
+			"revokeCert": s.base + "/revoke-cert",
+			"keyChange":  s.base + "/key-change",
+			"meta": map[string]any{
+				"externalAccountRequired": false,
+			},
+		})
+		return
+	case "/new-nonce":
+		w.Header().Set("Replay-Nonce", s.newNonce())
+		switch req.Method {
+		case http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case http.MethodGet:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Link", fmt.Sprintf("<%s/directory>;rel=\"index\"", s.base))
+
+	r, err := s.verifyJWS(req, rel)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	switch {
+	case rel == "/new-account":
+		err = s.handleNewAccount(w, r)
+	case rel == "/new-order":
+		err = s.handleNewOrder(w, r)
+	case rel == "/revoke-cert":
+		err = s.handleRevokeCert(w, r)
+	case rel == "/key-change":
+		err = acmeError("malformed", http.StatusNotImplemented, "key change is not supported")
+	case strings.HasPrefix(rel, "/account/"):
+		err = s.handleAccount(w, r, strings.TrimPrefix(rel, "/account/"))
+	case strings.HasPrefix(rel, "/order/"):
+		err = s.handleOrder(w, r, strings.TrimPrefix(rel, "/order/"))
+	case strings.HasPrefix(rel, "/authz/"):
+		err = s.handleAuthz(w, r, strings.TrimPrefix(rel, "/authz/"))
+	case strings.HasPrefix(rel, "/chall/"):
+		err = s.handleChallenge(w, r, strings.TrimPrefix(rel, "/chall/"))
+	case strings.HasPrefix(rel, "/finalize/"):
+		err = s.handleFinalize(w, r, strings.TrimPrefix(rel, "/finalize/"))
+	case strings.HasPrefix(rel, "/cert/"):
+		err = s.handleCert(w, r, strings.TrimPrefix(rel, "/cert/"))
+	default:
+		err = acmeError("malformed", http.StatusNotFound, "not found")
+	}
+	if err != nil {
+		s.writeError(w, err)
+	}
+}
+
+func (s *acmeServer) writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *acmeServer) writeError(w http.ResponseWriter, err error) {
+	var p *acmeProblem
+	if !errors.As(err, &p) {
+		s.m.opts.Logger.Errorf("ERR ACME: %v", err)
+		p = acmeError("serverInternal", http.StatusInternalServerError, "internal error")
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func (s *acmeServer) newNonce() string {
+	nonce := randomID()
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.nonces) >= acmeMaxNonces {
+		for k, t := range s.nonces {
+			if now.Sub(t) > acmeNonceLifetime || len(s.nonces) >= acmeMaxNonces {
+				delete(s.nonces, k)
+			}
+		}
+	}
+	s.nonces[nonce] = now
+	return nonce
+}
+
+func (s *acmeServer) useNonce(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.nonces[nonce]
+	delete(s.nonces, nonce)
+	return ok && time.Since(t) < acmeNonceLifetime
+}
+
+func randomID() string {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// acmeRequest is an authenticated ACME request.
+type acmeRequest struct {
+	url        string
+	payload    []byte
+	jwk        json.RawMessage
+	key        crypto.PublicKey
+	thumbprint string
+	account    *acmeAccount
+}
+
+// postAsGet returns true if the request is a POST-as-GET request.
+func (r *acmeRequest) postAsGet() bool {
+	return len(r.payload) == 0
+}
+
+func (r *acmeRequest) decode(v any) error {
+	if err := json.Unmarshal(r.payload, v); err != nil {
+		return acmeError("malformed", http.StatusBadRequest, "invalid payload: %v", err)
+	}
+	return nil
+}
+
+// verifyJWS verifies the signature of the request's JSON Web Signature and
+// returns its payload.
+// https://www.rfc-editor.org/rfc/rfc8555.html#section-6.2
+func (s *acmeServer) verifyJWS(req *http.Request, rel string) (*acmeRequest, error) {
+	if ct := req.Header.Get("Content-Type"); ct != "application/jose+json" {
+		return nil, acmeError("malformed", http.StatusUnsupportedMediaType, "invalid content-type %q", ct)
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, acmeMaxRequestSize))
+	if err != nil {
+		return nil, err
+	}
+	var msg struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, acmeError("malformed", http.StatusBadRequest, "invalid JWS: %v", err)
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(msg.Protected)
+	if err != nil {
+		return nil, acmeError("malformed", http.StatusBadRequest, "invalid JWS header")
+	}
+	var hdr struct {
+		Alg   string          `json:"alg"`
+		Nonce string          `json:"nonce"`
+		URL   string          `json:"url"`
+		JWK   json.RawMessage `json:"jwk"`
+		KID   string          `json:"kid"`
+	}
+	if err := json.Unmarshal(protected, &hdr); err != nil {
+		return nil, acmeError("malformed", http.StatusBadRequest, "invalid JWS header: %v", err)
+	}
+	if !slices.Contains(acmeAlgorithms, hdr.Alg) {
+		return nil, acmeError("badSignatureAlgorithm", http.StatusBadRequest, "unsupported algorithm %q", hdr.Alg)
+	}
+	if !s.useNonce(hdr.Nonce) {
+		return nil, acmeError("badNonce", http.StatusBadRequest, "invalid nonce")
+	}
+	r := &acmeRequest{url: s.base + rel}
+	if hdr.URL != r.url {
+		return nil, acmeError("unauthorized", http.StatusUnauthorized, "url mismatch")
+	}
+	if (len(hdr.JWK) == 0) == (hdr.KID == "") {
+		return nil, acmeError("malformed", http.StatusBadRequest, "exactly one of jwk or kid must be set")
+	}
+	switch {
+	case len(hdr.JWK) > 0:
+		if rel != "/new-account" && rel != "/revoke-cert" {
+			return nil, acmeError("malformed", http.StatusBadRequest, "kid must be set")
+		}
+		if r.key, r.thumbprint, err = parseJWK(hdr.JWK); err != nil {
+			return nil, acmeError("badPublicKey", http.StatusBadRequest, "%v", err)
+		}
+		r.jwk = hdr.JWK
+	default:
+		if rel == "/new-account" {
+			return nil, acmeError("malformed", http.StatusBadRequest, "jwk must be set")
+		}
+		id, ok := strings.CutPrefix(hdr.KID, s.base+"/account/")
+		if !ok {
+			return nil, acmeError("accountDoesNotExist", http.StatusBadRequest, "unknown account")
+		}
+		acct, err := s.account(id)
+		if err != nil {
+			return nil, err
+		}
+		if acct == nil {
+			return nil, acmeError("accountDoesNotExist", http.StatusBadRequest, "unknown account")
+		}
+		if acct.Status != acmeStatusValid {
+			return nil, acmeError("unauthorized", http.StatusUnauthorized, "account is %s", acct.Status)
+		}
+		if r.key, r.thumbprint, err = parseJWK(acct.Key); err != nil {
+			return nil, err
+		}
+		r.account = acct
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return nil, acmeError("malformed", http.StatusBadRequest, "invalid signature encoding")
+	}
+	if err := jwt.GetSigningMethod(hdr.Alg).Verify(msg.Protected+"."+msg.Payload, sig, r.key); err != nil {
+		return nil, acmeError("unauthorized", http.StatusUnauthorized, "invalid signature")
+	}
+	if r.payload, err = base64.RawURLEncoding.DecodeString(msg.Payload); err != nil {
+		return nil, acmeError("malformed", http.StatusBadRequest, "invalid payload encoding")
+	}
+	return r, nil
+}
+
+// parseJWK parses a JSON Web Key and returns the public key and its
+// thumbprint.
+// https://www.rfc-editor.org/rfc/rfc7638.html
+func parseJWK(raw json.RawMessage) (crypto.PublicKey, string, error) {
+	var k struct {
+		Type  string `json:"kty"`
+		Curve string `json:"crv"`
+		X     string `json:"x"`
+		Y     string `json:"y"`
+		N     string `json:"n"`
+		E     string `json:"e"`
+	}
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return nil, "", fmt.Errorf("invalid jwk: %w", err)
+	}
+	var key crypto.PublicKey
+	var members map[string]string
+	switch k.Type {
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, "", fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err := errors.Join(err1, err2); err != nil {
+			return nil, "", fmt.Errorf("invalid jwk: %w", err)
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if _, err := pub.ECDH(); err != nil {
+			return nil, "", fmt.Errorf("invalid jwk: %w", err)
+		}
+		key = pub
+		members = map[string]string{"crv": k.Curve, "kty": k.Type, "x": k.X, "y": k.Y}
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err := errors.Join(err1, err2); err != nil {
+			return nil, "", fmt.Errorf("invalid jwk: %w", err)
+		}
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, "", errors.New("invalid jwk: unsupported rsa key")
+		}
+		key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		members = map[string]string{"e": k.E, "kty": k.Type, "n": k.N}
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, "", fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, "", errors.New("invalid jwk")
+		}
+		key = ed25519.PublicKey(x)
+		members = map[string]string{"crv": k.Curve, "kty": k.Type, "x": k.X}
+	default:
+		return nil, "", fmt.Errorf("unsupported key type %q", k.Type)
+	}
+	// json.Marshal sorts the map keys and adds no whitespace, as required
+	// by RFC 7638.
+	b, err := json.Marshal(members)
+	if err != nil {
+		return nil, "", err
+	}
+	h := sha256.Sum256(b)
+	return key, base64.RawURLEncoding.EncodeToString(h[:]), nil
+}
+
+func (s *acmeServer) account(id string) (*acmeAccount, error) {
+	var accts acmeAccounts
+	if err := s.m.opts.Store.ReadDataFile(s.acctFile, &accts); err != nil {
+		return nil, err
+	}
+	return accts.Accounts[id], nil
+}
+
+func (s *acmeServer) updateAccount(id string, f func(*acmeAccount) error) (retErr error) {
+	var accts acmeAccounts
+	commit, err := s.m.opts.Store.OpenForUpdate(s.acctFile, &accts)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if accts.Accounts == nil {
+		accts.Accounts = make(map[string]*acmeAccount)
+	}
+	acct := accts.Accounts[id]
+	if acct == nil {
+		acct = &acmeAccount{ID: id}
+		accts.Accounts[id] = acct
+	}
+	if err := f(acct); err != nil {
+		return err
+	}
+	return commit(true, nil)
+}
+
+func (s *acmeServer) accountURL(id string) string {
+	return s.base + "/account/" + id
+}
+
+func (s *acmeServer) accountJSON(acct *acmeAccount) map[string]any {
+	return map[string]any{
+		"status":  acct.Status,
+		"contact": acct.Contact,
+		"orders":  s.accountURL(acct.ID) + "/orders",
+	}
+}
+
+func validateContacts(contacts []string) error {
+	for _, c := range contacts {
+		if !strings.HasPrefix(c, "mailto:") {
+			return acmeError("unsupportedContact", http.StatusBadRequest, "unsupported contact %q", c)
+		}
+	}
+	return nil
+}
+
+// https://www.rfc-editor.org/rfc/rfc8555.html#section-7.3
+func (s *acmeServer) handleNewAccount(w http.ResponseWriter, r *acmeRequest) error {
+	var p struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}
+	if err := r.decode(&p); err != nil {
+		return err
+	}
+	acct, err := s.account(r.thumbprint)
+	if err != nil {
+		return err
+	}
+	if acct != nil {
+		if acct.Status != acmeStatusValid {
+			return acmeError("unauthorized", http.StatusUnauthorized, "account is %s", acct.Status)
+		}
+		w.Header().Set("Location", s.accountURL(acct.ID))
+		s.writeJSON(w, http.StatusOK, s.accountJSON(acct))
+		return nil
+	}
+	if p.OnlyReturnExisting {
+		return acmeError("accountDoesNotExist", http.StatusBadRequest, "account does not exist")
+	}
+	if err := validateContacts(p.Contact); err != nil {
+		return err
+	}
+	if err := s.updateAccount(r.thumbprint, func(a *acmeAccount) error {
+		if a.Status == "" {
+			a.Key = r.jwk
+			a.Contact = p.Contact
+			a.Status = acmeStatusValid
+			a.Created = time.Now().UTC()
+		}
+		acct = a
+		return nil
+	}); err != nil {
+		return err
+	}
+	if s.m.opts.EventRecorder != nil {
+		s.m.opts.EventRecorder.Record("pki acme account created")
+	}
+	w.Header().Set("Location", s.accountURL(acct.ID))
+	s.writeJSON(w, http.StatusCreated, s.accountJSON(acct))
+	return nil
+}
+
+func (s *acmeServer) handleAccount(w http.ResponseWriter, r *acmeRequest, id string) error {
+	if id == r.account.ID+"/orders" {
+		s.mu.Lock()
+		orders := []string{}
+		for _, o := range s.orders {
+			if o.account == r.account.ID {
+				orders = append(orders, s.base+"/order/"+o.id)
+			}
+		}
+		s.mu.Unlock()
+		s.writeJSON(w, http.StatusOK, map[string]any{"orders": orders})
+		return nil
+	}
+	if id != r.account.ID {
+		return acmeError("unauthorized", http.StatusUnauthorized, "account mismatch")
+	}
+	acct := r.account
+	if !r.postAsGet() {
+		var p struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}
+		if err := r.decode(&p); err != nil {
+			return err
+		}
+		if p.Status != "" && p.Status != acmeStatusDeactivated {
+			return acmeError("malformed", http.StatusBadRequest, "invalid status %q", p.Status)
+		}
+		if err := validateContacts(p.Contact); err != nil {
+			return err
+		}
+		if err := s.updateAccount(id, func(a *acmeAccount) error {
+			if p.Contact != nil {
+				a.Contact = p.Contact
+			}
+			if p.Status != "" {
+				a.Status = p.Status
+			}
+			acct = a
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	s.writeJSON(w, http.StatusOK, s.accountJSON(acct))
+	return nil
+}
+
+// domainAllowed returns true if domain matches one of the allowed domains,
+// e.g. "example.com" or "*.example.com". All domains are allowed when the list
+// is empty.
+func domainAllowed(allowed []string, domain string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, d := range allowed {
+		if suffix, ok := strings.CutPrefix(d, "*."); ok {
+			if strings.HasSuffix(domain, "."+suffix) {
+				return true
+			}
+			continue
+		}
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+// https://www.rfc-editor.org/rfc/rfc8555.html#section-7.4
+func (s *acmeServer) handleNewOrder(w http.ResponseWriter, r *acmeRequest) error {
+	var p struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+		NotBefore   string           `json:"notBefore"`
+		NotAfter    string           `json:"notAfter"`
+	}
+	if err := r.decode(&p); err != nil {
+		return err
+	}
+	if len(p.Identifiers) == 0 {
+		return acmeError("malformed", http.StatusBadRequest, "identifiers must be set")
+	}
+	if p.NotBefore != "" || p.NotAfter != "" {
+		return acmeError("malformed", http.StatusBadRequest, "notBefore and notAfter are not supported")
+	}
+	preAuthorized := slices.Contains(s.opts.PreAuthorizedAccounts, r.account.ID)
+	var identifiers []acmeIdentifier
+	for _, id := range p.Identifiers {
+		if id.Type != "dns" {
+			return acmeError("unsupportedIdentifier", http.StatusBadRequest, "unsupported identifier type %q", id.Type)
+		}
+		name := strings.ToLower(id.Value)
+		wildcard := strings.HasPrefix(name, "*.")
+		if a, err := idna.Lookup.ToASCII(strings.TrimPrefix(name, "*.")); err != nil || a != strings.TrimPrefix(name, "*.") || !strings.Contains(a, ".") {
+			return acmeError("rejectedIdentifier", http.StatusBadRequest, "invalid identifier %q", id.Value)
+		}
+		if !domainAllowed(s.opts.AllowedDomains, name) {
+			return acmeError("rejectedIdentifier", http.StatusBadRequest, "identifier %q is not allowed", id.Value)
+		}
+		if wildcard && !preAuthorized {
+			return acmeError("rejectedIdentifier", http.StatusBadRequest, "wildcard identifiers require a pre-authorized account")
+		}
+		id := acmeIdentifier{Type: "dns", Value: name}
+		if !slices.Contains(identifiers, id) {
+			identifiers = append(identifiers, id)
+		}
+	}
+
+	now := time.Now().UTC()
+	o := &acmeOrder{
+		id:          randomID(),
+		account:     r.account.ID,
+		status:      acmeStatusPending,
+		expires:     now.Add(acmeOrderLifetime),
+		identifiers: identifiers,
+	}
+	s.mu.Lock()
+	s.pruneLocked(now)
+	for _, id := range identifiers {
+		az := &acmeAuthz{
+			id:         randomID(),
+			account:    r.account.ID,
+			identifier: acmeIdentifier{Type: id.Type, Value: strings.TrimPrefix(id.Value, "*.")},
+			status:     acmeStatusPending,
+			expires:    o.expires,
+		}
+		if preAuthorized {
+			az.status = acmeStatusValid
+		} else {
+			for _, typ := range s.opts.Challenges {
+				ch := &acmeChallenge{
+					id:     randomID(),
+					typ:    typ,
+					token:  randomID(),
+					status: acmeStatusPending,
+					authz:  az,
+				}
+				az.challenges = append(az.challenges, ch)
+				s.challs[ch.id] = ch
+			}
+		}
+		s.authzs[az.id] = az
+		o.authzs = append(o.authzs, az)
+	}
+	s.orders[o.id] = o
+	resp := s.orderJSONLocked(o)
+	s.mu.Unlock()
+
+	w.Header().Set("Location", s.base+"/order/"+o.id)
+	s.writeJSON(w, http.StatusCreated, resp)
+	return nil
+}
+
+// pruneLocked removes the orders that expired more than a day ago.
+func (s *acmeServer) pruneLocked(now time.Time) {
+	for id, o := range s.orders {
+		if now.Sub(o.expires) < 24*time.Hour {
+			continue
+		}
+		for _, az := range o.authzs {
+			for _, ch := range az.challenges {
+				delete(s.challs, ch.id)
+			}
+			delete(s.authzs, az.id)
+		}
+		delete(s.orders, id)
+	}
+}
+
+func (s *acmeServer) updateOrderStatusLocked(o *acmeOrder) {
+	if o.status != acmeStatusPending && o.status != acmeStatusReady {
+		return
+	}
+	if time.Now().After(o.expires) {
+		o.status = acmeStatusInvalid
+		return
+	}
+	ready := true
+	for _, az := range o.authzs {
+		switch az.status {
+		case acmeStatusValid:
+		case acmeStatusPending:
+			ready = false
+		default:
+			o.status = acmeStatusInvalid
+			return
+		}
+	}
+	if ready {
+		o.status = acmeStatusReady
+	}
+}
+
+func (s *acmeServer) orderJSONLocked(o *acmeOrder) map[string]any {
+	s.updateOrderStatusLocked(o)
+	var authzs []string
+	for _, az := range o.authzs {
+		authzs = append(authzs, s.base+"/authz/"+az.id)
+	}
+	resp := map[string]any{
+		"status":         o.status,
+		"expires":        o.expires.Format(time.RFC3339),
+		"identifiers":    o.identifiers,
+		"authorizations": authzs,
+		"finalize":       s.base + "/finalize/" + o.id,
+	}
+	if o.cert != nil {
+		resp["certificate"] = s.base + "/cert/" + o.id
+	}
+	if o.err != nil {
+		resp["error"] = o.err
+	}
+	return resp
+}
+
+func (s *acmeServer) authzJSONLocked(az *acmeAuthz) map[string]any {
+	if az.status == acmeStatusPending && time.Now().After(az.expires) {
+		az.status = "expired"
+	}
+	challenges := []any{}
+	for _, ch := range az.challenges {
+		challenges = append(challenges, s.challengeJSONLocked(ch))
+	}
+	resp := map[string]any{
+		"status":     az.status,
+		"expires":    az.expires.Format(time.RFC3339),
+		"identifier": az.identifier,
+		"challenges": challenges,
+	}
+	if o := s.orderForAuthzLocked(az); o != nil && slices.Contains(o.identifiers, acmeIdentifier{Type: "dns", Value: "*." + az.identifier.Value}) {
+		resp["wildcard"] = true
+	}
+	return resp
+}
+
+func (s *acmeServer) orderForAuthzLocked(az *acmeAuthz) *acmeOrder {
+	for _, o := range s.orders {
+		if slices.Contains(o.authzs, az) {
+			return o
+		}
+	}
+	return nil
+}
+
+func (s *acmeServer) challengeJSONLocked(ch *acmeChallenge) map[string]any {
+	resp := map[string]any{
+		"type":   ch.typ,
+		"url":    s.base + "/chall/" + ch.id,
+		"status": ch.status,
+		"token":  ch.token,
+	}
+	if !ch.validated.IsZero() {
+		resp["validated"] = ch.validated.Format(time.RFC3339)
+	}
+	if ch.err != nil {
+		resp["error"] = ch.err
+	}
+	return resp
+}
+
+func (s *acmeServer) handleOrder(w http.ResponseWriter, r *acmeRequest, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[id]
+	if !ok || o.account != r.account.ID {
+		return acmeError("malformed", http.StatusNotFound, "order not found")
+	}
+	resp := s.orderJSONLocked(o)
+	if o.status == acmeStatusPending || o.status == acmeStatusProcessing {
+		w.Header().Set("Retry-After", "1")
+	}
+	s.writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+func (s *acmeServer) handleAuthz(w http.ResponseWriter, r *acmeRequest, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	az, ok := s.authzs[id]
+	if !ok || az.account != r.account.ID {
+		return acmeError("malformed", http.StatusNotFound, "authorization not found")
+	}
+	if !r.postAsGet() {
+		var p struct {
+			Status string `json:"status"`
+		}
+		if err := r.decode(&p); err != nil {
+			return err
+		}
+		if p.Status != acmeStatusDeactivated {
+			return acmeError("malformed", http.StatusBadRequest, "invalid status %q", p.Status)
+		}
+		az.status = acmeStatusDeactivated
+	}
+	if az.status == acmeStatusPending {
+		w.Header().Set("Retry-After", "1")
+	}
+	s.writeJSON(w, http.StatusOK, s.authzJSONLocked(az))
+	return nil
+}
+
+// https://www.rfc-editor.org/rfc/rfc8555.html#section-7.5.1
+func (s *acmeServer) handleChallenge(w http.ResponseWriter, r *acmeRequest, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch, ok := s.challs[id]
+	if !ok || ch.authz.account != r.account.ID {
+		return acmeError("malformed", http.StatusNotFound, "challenge not found")
+	}
+	if !r.postAsGet() && ch.status == acmeStatusPending && ch.authz.status == acmeStatusPending {
+		ch.status = acmeStatusProcessing
+		go s.validateChallenge(ch, ch.typ, ch.authz.identifier.Value, ch.token, ch.token+"."+r.thumbprint)
+	}
+	w.Header().Add("Link", fmt.Sprintf("<%s/authz/%s>;rel=\"up\"", s.base, ch.authz.id))
+	s.writeJSON(w, http.StatusOK, s.challengeJSONLocked(ch))
+	return nil
+}
+
+func (s *acmeServer) validateChallenge(ch *acmeChallenge, typ, domain, token, keyAuth string) {
+	ctx, cancel := context.WithTimeout(context.Background(), acmeChallengeTimeout)
+	defer cancel()
+	var err error
+	switch typ {
+	case acmeChallengeHTTP01:
+		err = s.validateHTTP01(ctx, domain, token, keyAuth)
+	case acmeChallengeTLSALPN01:
+		err = s.validateTLSALPN01(ctx, domain, keyAuth)
+	default:
+		err = fmt.Errorf("unexpected challenge type %q", typ)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.m.opts.Logger.Errorf("ERR ACME %s %s: %v", typ, domain, err)
+		ch.status = acmeStatusInvalid
+		ch.err = acmeError("incorrectResponse", http.StatusForbidden, "%v", err)
+		if ch.authz.status == acmeStatusPending {
+			ch.authz.status = acmeStatusInvalid
+		}
+		return
+	}
+	ch.status = acmeStatusValid
+	ch.validated = time.Now().UTC()
+	if ch.authz.status == acmeStatusPending {
+		ch.authz.status = acmeStatusValid
+	}
+}
+
+// https://www.rfc-editor.org/rfc/rfc8555.html#section-8.3
+func (s *acmeServer) validateHTTP01(ctx context.Context, domain, token, keyAuth string) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: s.dialContext,
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+domain+"/.well-known/acme-challenge/"+token, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(bytes.TrimSpace(body), []byte(keyAuth)) != 1 {
+		return errors.New("key authorization mismatch")
+	}
+	return nil
+}
+
+// https://www.rfc-editor.org/rfc/rfc8737.html#section-3
+func (s *acmeServer) validateTLSALPN01(ctx context.Context, domain, keyAuth string) error {
+	conn, err := s.dialContext(ctx, "tcp", net.JoinHostPort(domain, "443"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tc := tls.Client(conn, &tls.Config{
+		ServerName:         domain,
+		NextProtos:         []string{"acme-tls/1"},
+		InsecureSkipVerify: true,
+	})
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	cs := tc.ConnectionState()
+	if cs.NegotiatedProtocol != "acme-tls/1" {
+		return fmt.Errorf("unexpected alpn protocol %q", cs.NegotiatedProtocol)
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no certificate")
+	}
+	cert := cs.PeerCertificates[0]
+	if len(cert.DNSNames) != 1 || !strings.EqualFold(cert.DNSNames[0], domain) {
+		return fmt.Errorf("unexpected certificate names %q", cert.DNSNames)
+	}
+	want := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(idPeACMEIdentifier) {
+			continue
+		}
+		if !ext.Critical {
+			return errors.New("acmeIdentifier extension is not critical")
+		}
+		var got []byte
+		if rest, err := asn1.Unmarshal(ext.Value, &got); err != nil || len(rest) > 0 {
+			return errors.New("invalid acmeIdentifier extension")
+		}
+		if subtle.ConstantTimeCompare(got, want[:]) != 1 {
+			return errors.New("key authorization mismatch")
+		}
+		return nil
+	}
+	return errors.New("acmeIdentifier extension not found")
+}
+
+// https://www.rfc-editor.org/rfc/rfc8555.html#section-7.4
+func (s *acmeServer) handleFinalize(w http.ResponseWriter, r *acmeRequest, id string) error {
+	var p struct {
+		CSR string `json:"csr"`
+	}
+	if err := r.decode(&p); err != nil {
+		return err
+	}
+	der, err := base64.RawURLEncoding.DecodeString(p.CSR)
+	if err != nil {
+		return acmeError("badCSR", http.StatusBadRequest, "invalid csr encoding")
+	}
+	cr, err := s.m.ValidateCertificateRequest(der)
+	if err != nil {
+		return acmeError("badCSR", http.StatusBadRequest, "invalid csr: %v", err)
+	}
+
+	s.mu.Lock()
+	o, ok := s.orders[id]
+	if !ok || o.account != r.account.ID {
+		s.mu.Unlock()
+		return acmeError("malformed", http.StatusNotFound, "order not found")
+	}
+	if s.updateOrderStatusLocked(o); o.status != acmeStatusReady {
+		s.mu.Unlock()
+		return acmeError("orderNotReady", http.StatusForbidden, "order is %s", o.status)
+	}
+	var want []string
+	for _, id := range o.identifiers {
+		want = append(want, id.Value)
+	}
+	s.mu.Unlock()
+
+	var names []string
+	for _, n := range cr.DNSNames {
+		names = append(names, strings.ToLower(n))
+	}
+	if cn := strings.ToLower(cr.Subject.CommonName); cn != "" && !slices.Contains(names, cn) {
+		names = append(names, cn)
+	}
+	slices.Sort(names)
+	names = slices.Compact(names)
+	if !slices.Equal(names, slices.Sorted(slices.Values(want))) || len(cr.IPAddresses) > 0 || len(cr.EmailAddresses) > 0 || len(cr.URIs) > 0 {
+		return acmeError("badCSR", http.StatusBadRequest, "csr does not match the order's identifiers")
+	}
+
+	s.mu.Lock()
+	if o.status != acmeStatusReady {
+		s.mu.Unlock()
+		return acmeError("orderNotReady", http.StatusForbidden, "order is %s", o.status)
+	}
+	o.status = acmeStatusProcessing
+	s.mu.Unlock()
+
+	chain, sn, err := s.issue(cr, want, r.account.ID)
+
+	s.mu.Lock()
+	if err != nil {
+		o.status = acmeStatusInvalid
+		o.err = acmeError("serverInternal", http.StatusInternalServerError, "certificate issuance failed")
+		s.mu.Unlock()
+		return err
+	}
+	o.status = acmeStatusValid
+	o.cert = chain
+	resp := s.orderJSONLocked(o)
+	s.mu.Unlock()
+
+	if err := s.updateAccount(r.account.ID, func(a *acmeAccount) error {
+		a.Certs = append(a.Certs, sn)
+		return nil
+	}); err != nil {
+		s.m.opts.Logger.Errorf("ERR ACME updateAccount: %v", err)
+	}
+	if s.m.opts.EventRecorder != nil {
+		s.m.opts.EventRecorder.Record("pki acme certificate issued")
+	}
+	w.Header().Set("Location", s.base+"/order/"+o.id)
+	s.writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+// issue issues a certificate for names and returns the PEM-encoded chain and
+// the certificate's serial number.
+func (s *acmeServer) issue(in *x509.CertificateRequest, names []string, accountID string) ([]byte, string, error) {
+	cr := &x509.CertificateRequest{
+		PublicKeyAlgorithm: in.PublicKeyAlgorithm,
+		PublicKey:          in.PublicKey,
+		Subject:            pkix.Name{CommonName: names[0]},
+		DNSNames:           names,
+	}
+	raw, err := s.m.issueCertificate(cr, s.opts.CertificateLifetime)
+	if err != nil {
+		return nil, "", err
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	s.m.recordAudit(AuditActionIssue, "acme:"+accountID, "acme", "", cert, 0)
+	caCert, err := s.m.CACert()
+	if err != nil {
+		return nil, "", err
+	}
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: raw})
+	pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+	return buf.Bytes(), bytesToHex(cert.SerialNumber.Bytes()), nil
+}
+
+func (s *acmeServer) handleCert(w http.ResponseWriter, r *acmeRequest, id string) error {
+	s.mu.Lock()
+	o, ok := s.orders[id]
+	if !ok || o.account != r.account.ID || o.cert == nil {
+		s.mu.Unlock()
+		return acmeError("malformed", http.StatusNotFound, "certificate not found")
+	}
+	chain := o.cert
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(chain)
+	return nil
+}
+
+// https://www.rfc-editor.org/rfc/rfc8555.html#section-7.6
+func (s *acmeServer) handleRevokeCert(w http.ResponseWriter, r *acmeRequest) error {
+	var p struct {
+		Certificate string `json:"certificate"`
+		Reason      int    `json:"reason"`
+	}
+	if err := r.decode(&p); err != nil {
+		return err
+	}
+	der, err := base64.RawURLEncoding.DecodeString(p.Certificate)
+	if err != nil {
+		return acmeError("malformed", http.StatusBadRequest, "invalid certificate encoding")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return acmeError("malformed", http.StatusBadRequest, "invalid certificate")
+	}
+	if p.Reason < RevokeReasonUnspecified || p.Reason > RevokeReasonAACompromise || p.Reason == 7 {
+		return acmeError("badRevocationReason", http.StatusBadRequest, "invalid reason %d", p.Reason)
+	}
+	sn := bytesToHex(cert.SerialNumber.Bytes())
+	if s.m.IsRevoked(cert.SerialNumber) {
+		return acmeError("alreadyRevoked", http.StatusBadRequest, "certificate is already revoked")
+	}
+	issued, err := s.m.findCert(sn)
+	if err != nil || !bytes.Equal(issued.Raw, cert.Raw) {
+		return acmeError("malformed", http.StatusNotFound, "certificate not found")
+	}
+	actor := "acme:certificate-key"
+	switch {
+	case r.account != nil:
+		actor = "acme:" + r.account.ID
+		if !slices.Contains(r.account.Certs, sn) {
+			return acmeError("unauthorized", http.StatusForbidden, "certificate was not issued to this account")
+		}
+	default:
+		k, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !k.Equal(r.key) {
+			return acmeError("unauthorized", http.StatusForbidden, "key mismatch")
+		}
+	}
+	if err := s.m.RevokeCertificate(cert.SerialNumber, p.Reason); err != nil {
+		return err
+	}
+	s.m.recordAudit(AuditActionRevoke, actor, "acme", "", cert, p.Reason)
+	if s.m.opts.EventRecorder != nil {
+		s.m.opts.EventRecorder.Record("pki acme certificate revoked")
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
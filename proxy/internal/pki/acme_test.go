@@ -0,0 +1,277 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+	"golang.org/x/crypto/acme"
+)
+
+func newACMETest(t *testing.T, opts ACMEOptions) (*PKIManager, *acme.Client) {
+	t.Helper()
+	var m *PKIManager
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m.ServeACME(w, req)
+	}))
+	t.Cleanup(srv.Close)
+
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	opts.Endpoint = srv.URL + "/acme"
+	if m, err = New(Options{
+		Name:  "acme-test",
+		Store: storage.New(t.TempDir(), mk),
+		ACME:  &opts,
+	}); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: opts.Endpoint + "/directory",
+	}
+	if _, err := client.Register(context.Background(), &acme.Account{Contact: []string{"mailto:bob@example.com"}}, acme.AcceptTOS); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	return m, client
+}
+
+func newCSR(t *testing.T, names ...string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: names[0]},
+		DNSNames: names,
+	}, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificateRequest: %v", err)
+	}
+	return csr
+}
+
+func TestACMEPreAuthorized(t *testing.T) {
+	ctx := context.Background()
+	m, client := newACMETest(t, ACMEOptions{
+		AllowedDomains: []string{"*.example.com"},
+	})
+	tp, err := acme.JWKThumbprint(client.Key.Public())
+	if err != nil {
+		t.Fatalf("JWKThumbprint: %v", err)
+	}
+
+	// Not pre-authorized yet.
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("www.example.com"))
+	if err != nil {
+		t.Fatalf("AuthorizeOrder: %v", err)
+	}
+	if got, want := order.Status, acme.StatusPending; got != want {
+		t.Errorf("order.Status = %q, want %q", got, want)
+	}
+	if _, err := client.AuthorizeOrder(ctx, acme.DomainIDs("*.example.com")); err == nil {
+		t.Error("AuthorizeOrder(*.example.com) succeeded unexpectedly")
+	}
+
+	m.acme.opts.PreAuthorizedAccounts = []string{tp}
+
+	if _, err := client.AuthorizeOrder(ctx, acme.DomainIDs("www.example.org")); err == nil {
+		t.Error("AuthorizeOrder(www.example.org) succeeded unexpectedly")
+	}
+	order, err = client.AuthorizeOrder(ctx, acme.DomainIDs("www.example.com", "*.example.com"))
+	if err != nil {
+		t.Fatalf("AuthorizeOrder: %v", err)
+	}
+	if got, want := order.Status, acme.StatusReady; got != want {
+		t.Fatalf("order.Status = %q, want %q", got, want)
+	}
+	if _, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, newCSR(t, "www.example.com"), true); err == nil {
+		t.Error("CreateOrderCert with wrong names succeeded unexpectedly")
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, newCSR(t, "www.example.com", "*.example.com"), true)
+	if err != nil {
+		t.Fatalf("CreateOrderCert: %v", err)
+	}
+	if got, want := len(der), 2; got != want {
+		t.Fatalf("len(der) = %d, want %d", got, want)
+	}
+	cert, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	if got, want := strings.Join(cert.DNSNames, ","), "www.example.com,*.example.com"; got != want {
+		t.Errorf("DNSNames = %q, want %q", got, want)
+	}
+	if lifetime := cert.NotAfter.Sub(cert.NotBefore); lifetime != acmeDefaultCertLifetime {
+		t.Errorf("lifetime = %v, want %v", lifetime, acmeDefaultCertLifetime)
+	}
+
+	if err := client.RevokeCert(ctx, nil, der[0], acme.CRLReasonKeyCompromise); err != nil {
+		t.Fatalf("RevokeCert: %v", err)
+	}
+	if !m.IsRevoked(cert.SerialNumber) {
+		t.Error("certificate is not revoked")
+	}
+}
+
+func TestACMEChallenges(t *testing.T) {
+	for _, typ := range []string{acmeChallengeHTTP01, acmeChallengeTLSALPN01} {
+		t.Run(typ, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			m, client := newACMETest(t, ACMEOptions{
+				Challenges:          []string{typ},
+				CertificateLifetime: 24 * time.Hour,
+			})
+			const domain = "www.example.com"
+
+			order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+			if err != nil {
+				t.Fatalf("AuthorizeOrder: %v", err)
+			}
+			if got, want := len(order.AuthzURLs), 1; got != want {
+				t.Fatalf("len(AuthzURLs) = %d, want %d", got, want)
+			}
+			authz, err := client.GetAuthorization(ctx, order.AuthzURLs[0])
+			if err != nil {
+				t.Fatalf("GetAuthorization: %v", err)
+			}
+			if got, want := len(authz.Challenges), 1; got != want {
+				t.Fatalf("len(Challenges) = %d, want %d", got, want)
+			}
+			chal := authz.Challenges[0]
+			if got, want := chal.Type, typ; got != want {
+				t.Fatalf("chal.Type = %q, want %q", got, want)
+			}
+
+			var srv *httptest.Server
+			switch typ {
+			case acmeChallengeHTTP01:
+				resp, err := client.HTTP01ChallengeResponse(chal.Token)
+				if err != nil {
+					t.Fatalf("HTTP01ChallengeResponse: %v", err)
+				}
+				srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					if req.Host != domain || req.URL.Path != client.HTTP01ChallengePath(chal.Token) {
+						http.NotFound(w, req)
+						return
+					}
+					w.Write([]byte(resp))
+				}))
+			case acmeChallengeTLSALPN01:
+				cert, err := client.TLSALPN01ChallengeCert(chal.Token, domain)
+				if err != nil {
+					t.Fatalf("TLSALPN01ChallengeCert: %v", err)
+				}
+				srv = httptest.NewUnstartedServer(http.NotFoundHandler())
+				srv.TLS = &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					NextProtos:   []string{"acme-tls/1"},
+				}
+				srv.StartTLS()
+			}
+			defer srv.Close()
+			m.acme.dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, srv.Listener.Addr().String())
+			}
+
+			if _, err := client.Accept(ctx, chal); err != nil {
+				t.Fatalf("Accept: %v", err)
+			}
+			if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+				t.Fatalf("WaitAuthorization: %v", err)
+			}
+			if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+				t.Fatalf("WaitOrder: %v", err)
+			}
+			der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, newCSR(t, domain), true)
+			if err != nil {
+				t.Fatalf("CreateOrderCert: %v", err)
+			}
+			cert, err := x509.ParseCertificate(der[0])
+			if err != nil {
+				t.Fatalf("x509.ParseCertificate: %v", err)
+			}
+			if lifetime := cert.NotAfter.Sub(cert.NotBefore); lifetime != 24*time.Hour {
+				t.Errorf("lifetime = %v, want %v", lifetime, 24*time.Hour)
+			}
+		})
+	}
+}
+
+func TestACMEChallengeFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	m, client := newACMETest(t, ACMEOptions{
+		Challenges: []string{acmeChallengeHTTP01},
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("wrong"))
+	}))
+	defer srv.Close()
+	m.acme.dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("www.example.com"))
+	if err != nil {
+		t.Fatalf("AuthorizeOrder: %v", err)
+	}
+	authz, err := client.GetAuthorization(ctx, order.AuthzURLs[0])
+	if err != nil {
+		t.Fatalf("GetAuthorization: %v", err)
+	}
+	if _, err := client.Accept(ctx, authz.Challenges[0]); err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err == nil {
+		t.Fatal("WaitAuthorization succeeded unexpectedly")
+	}
+	if _, err := client.WaitOrder(ctx, order.URI); err == nil {
+		t.Fatal("WaitOrder succeeded unexpectedly")
+	}
+}
@@ -0,0 +1,169 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"crypto/x509"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Audit log actions.
+const (
+	AuditActionIssue  = "issue"
+	AuditActionRenew  = "renew"
+	AuditActionRevoke = "revoke"
+)
+
+// AuditEntry is a record of a certificate issuance, renewal, or revocation.
+type AuditEntry struct {
+	// Time is when the action happened.
+	Time time.Time `json:"time"`
+	// Action is one of issue, renew, or revoke.
+	Action string `json:"action"`
+	// Actor is who requested the action, e.g. a user's email address, an
+	// ACME account, or the subject of a client certificate.
+	Actor string `json:"actor"`
+	// Source is how the action was requested: web, acme, est, scep, renew,
+	// or internal.
+	Source string `json:"source"`
+	// Profile is the certificate profile that was used, if any.
+	Profile string `json:"profile,omitempty"`
+	// SerialNumber is the certificate's serial number in hex.
+	SerialNumber string `json:"serialNumber"`
+	// Subject is the certificate's subject.
+	Subject string `json:"subject"`
+	// The certificate's subject alternative names.
+	DNSNames       []string `json:"dnsNames,omitempty"`
+	EmailAddresses []string `json:"emailAddresses,omitempty"`
+	IPAddresses    []string `json:"ipAddresses,omitempty"`
+	URIs           []string `json:"uris,omitempty"`
+	// NotAfter is the certificate's expiration time.
+	NotAfter time.Time `json:"notAfter"`
+	// RevocationReason is the reason code of a revocation.
+	RevocationReason int `json:"revocationReason,omitempty"`
+}
+
+// AuditQuery selects audit log entries. Empty fields match all entries.
+type AuditQuery struct {
+	// Action matches the entries with this action.
+	Action string
+	// Actor matches the entries with this actor.
+	Actor string
+	// SerialNumber matches the entries for this certificate.
+	SerialNumber string
+	// Name matches the entries for certificates with this subject
+	// alternative name.
+	Name string
+	// Since matches the entries at or after this time.
+	Since time.Time
+	// Until matches the entries before this time.
+	Until time.Time
+}
+
+type auditLog struct {
+	Entries []*AuditEntry
+}
+
+func (m *PKIManager) auditFile() string {
+	return m.pkiFile + "-audit"
+}
+
+// recordAudit appends an entry to the audit log. Errors are logged, but not
+// returned, because the action has already happened.
+func (m *PKIManager) recordAudit(action, actor, source, profile string, cert *x509.Certificate, reason int) {
+	e := &AuditEntry{
+		Time:             time.Now().UTC(),
+		Action:           action,
+		Actor:            actor,
+		Source:           source,
+		Profile:          profile,
+		SerialNumber:     bytesToHex(cert.SerialNumber.Bytes()),
+		Subject:          cert.Subject.String(),
+		DNSNames:         cert.DNSNames,
+		EmailAddresses:   cert.EmailAddresses,
+		NotAfter:         cert.NotAfter.UTC(),
+		RevocationReason: reason,
+	}
+	for _, ip := range cert.IPAddresses {
+		e.IPAddresses = append(e.IPAddresses, ip.String())
+	}
+	for _, u := range cert.URIs {
+		e.URIs = append(e.URIs, u.String())
+	}
+	var data auditLog
+	commit, err := m.opts.Store.OpenForUpdate(m.auditFile(), &data)
+	if err != nil {
+		m.opts.Logger.Errorf("ERR audit log: %v", err)
+		return
+	}
+	data.Entries = append(data.Entries, e)
+	if err := commit(true, nil); err != nil {
+		m.opts.Logger.Errorf("ERR audit log: %v", err)
+	}
+}
+
+// recordAuditRaw is like recordAudit for a DER-encoded certificate.
+func (m *PKIManager) recordAuditRaw(action, actor, source, profile string, raw []byte) {
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		m.opts.Logger.Errorf("ERR audit log: %v", err)
+		return
+	}
+	m.recordAudit(action, actor, source, profile, cert, 0)
+}
+
+// AuditLog returns the audit log entries that match the query, in
+// chronological order.
+func (m *PKIManager) AuditLog(q AuditQuery) ([]*AuditEntry, error) {
+	var data auditLog
+	if err := m.opts.Store.ReadDataFile(m.auditFile(), &data); err != nil {
+		return nil, err
+	}
+	sn := strings.ToLower(q.SerialNumber)
+	out := make([]*AuditEntry, 0, len(data.Entries))
+	for _, e := range data.Entries {
+		if q.Action != "" && e.Action != q.Action {
+			continue
+		}
+		if q.Actor != "" && e.Actor != q.Actor {
+			continue
+		}
+		if sn != "" && e.SerialNumber != sn {
+			continue
+		}
+		if q.Name != "" && !slices.Contains(e.DNSNames, q.Name) && !slices.Contains(e.EmailAddresses, q.Name) && !slices.Contains(e.IPAddresses, q.Name) && !slices.Contains(e.URIs, q.Name) {
+			continue
+		}
+		if !q.Since.IsZero() && e.Time.Before(q.Since) {
+			continue
+		}
+		if !q.Until.IsZero() && !e.Time.Before(q.Until) {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
@@ -0,0 +1,171 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestAuditLog(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	m, err := New(Options{
+		Name:   "audit-test",
+		Store:  storage.New(t.TempDir(), mk),
+		Admins: []string{"admin@example.com"},
+		ClaimsFromCtx: func(ctx context.Context) jwt.MapClaims {
+			c, _ := ctx.Value(claimsCtxKey{}).(jwt.MapClaims)
+			return c
+		},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	serve := func(email, method, target, contentType, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("content-type", contentType)
+		}
+		req.Header.Set("x-csrf-check", "1")
+		req = req.WithContext(context.WithValue(req.Context(), claimsCtxKey{}, jwt.MapClaims{"email": email}))
+		w := httptest.NewRecorder()
+		m.ServeCertificateManagement(w, req)
+		return w
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "laptop"},
+		DNSNames: []string{"laptop.example.com"},
+	}, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificateRequest: %v", err)
+	}
+	w := serve("bob@example.com", http.MethodPost, "/pki?get=requestCert", "application/x-pem-file", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})))
+	var resp struct {
+		Result string `json:"result"`
+		Cert   string `json:"cert"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Result != "ok" {
+		t.Fatalf("requestCert: %v %q", err, resp.Result)
+	}
+	block, _ := pem.Decode([]byte(resp.Cert))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	sn := bytesToHex(cert.SerialNumber.Bytes())
+
+	if w := serve("admin@example.com", http.MethodPost, "/pki?get=revokeCert&admin=1", "application/x-www-form-urlencoded", "sn="+sn); w.Code != http.StatusOK {
+		t.Fatalf("revokeCert: %d", w.Code)
+	}
+
+	entries, err := m.AuditLog(AuditQuery{SerialNumber: sn})
+	if err != nil {
+		t.Fatalf("AuditLog: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("AuditLog returned %d entries, want 2", len(entries))
+	}
+	for i, want := range []struct{ action, actor string }{
+		{AuditActionIssue, "bob@example.com"},
+		{AuditActionRevoke, "admin@example.com"},
+	} {
+		e := entries[i]
+		if e.Action != want.action || e.Actor != want.actor || e.Source != "web" {
+			t.Errorf("entries[%d] = %+v, want %s by %s", i, e, want.action, want.actor)
+		}
+		if !slices.Equal(e.DNSNames, []string{"laptop.example.com"}) || !slices.Equal(e.EmailAddresses, []string{"bob@example.com"}) {
+			t.Errorf("entries[%d] names = %v %v", i, e.DNSNames, e.EmailAddresses)
+		}
+	}
+
+	for _, tc := range []struct {
+		q    AuditQuery
+		want int
+	}{
+		{AuditQuery{Action: AuditActionRevoke}, 1},
+		{AuditQuery{Actor: "bob@example.com"}, 1},
+		{AuditQuery{Name: "laptop.example.com"}, 2},
+		{AuditQuery{Name: "other.example.com"}, 0},
+		{AuditQuery{Since: time.Now().Add(time.Hour)}, 0},
+		{AuditQuery{Until: time.Now().Add(-time.Hour)}, 0},
+	} {
+		got, err := m.AuditLog(tc.q)
+		if err != nil {
+			t.Fatalf("AuditLog: %v", err)
+		}
+		var n int
+		for _, e := range got {
+			if e.SerialNumber == sn {
+				n++
+			}
+		}
+		if n != tc.want {
+			t.Errorf("AuditLog(%+v) = %d entries, want %d", tc.q, n, tc.want)
+		}
+	}
+
+	if w := serve("bob@example.com", http.MethodGet, "/pki?get=auditLog&admin=1", "", ""); w.Code != http.StatusForbidden {
+		t.Errorf("auditLog as non-admin: %d", w.Code)
+	}
+	w = serve("admin@example.com", http.MethodGet, "/pki?get=auditLog&admin=1&format=json&sn="+sn, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("auditLog: %d", w.Code)
+	}
+	var exported []*AuditEntry
+	if err := json.NewDecoder(w.Body).Decode(&exported); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if len(exported) != 2 || exported[1].Action != AuditActionRevoke {
+		t.Errorf("exported = %+v", exported)
+	}
+	if w := serve("admin@example.com", http.MethodGet, "/pki?get=auditLog&admin=1&since=2020-01-01", "", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), sn) {
+		t.Errorf("auditLog html: %d %s", w.Code, w.Body)
+	}
+}
@@ -34,14 +34,24 @@ pkiApp.ready = new Promise(resolve => {
 const go = new Go();
 let wasmLoaded = false;
 
-function requestCert(csr) {
-  fetch('?get=requestCert', {
+function profileParams(f) {
+  let params = '';
+  if (f.profile) {
+    params += '&profile='+encodeURIComponent(f.profile.value);
+  }
+  if (f.lifetime && f.lifetime.value !== '') {
+    params += '&lifetime='+encodeURIComponent(f.lifetime.value);
+  }
+  return params;
+}
+function requestCert(f) {
+  fetch('?get=requestCert'+profileParams(f), {
     method: 'POST',
     headers: {
       'content-type': 'application/x-pem-file',
       'x-csrf-check': '1',
     },
-    body: csr,
+    body: f.csr.value,
   })
   .then(resp => {
     if (resp.status !== 200 || resp.headers.get('content-type') !== 'application/json') {
@@ -51,12 +61,13 @@ function requestCert(csr) {
     return resp.json();
   })
   .then(r => {
-    if (r.result === 'ok') {
-      console.log('Success');
-      document.getElementById('csrform').style.display = 'none';
-      document.getElementById('viewcert').style.display = 'block';
-      document.getElementById('certpem').textContent = r.cert;
+    if (r.result !== 'ok') {
+      throw new Error(r.result);
     }
+    console.log('Success');
+    document.getElementById('csrform').style.display = 'none';
+    document.getElementById('viewcert').style.display = 'block';
+    document.getElementById('certpem').textContent = r.cert;
   })
   .catch(err => {
     console.log('Failure', err);
@@ -144,6 +155,7 @@ function generateKeyAndCert(b) {
     'password': pw,
     'label': f.label.value,
     'dnsname': f.dnsname.value,
+    'params': profileParams(f),
   }))
   .then(() => window.location.reload())
   .catch(err => {
@@ -67,6 +67,9 @@ func getCertificate(this js.Value, args []js.Value) (result any) {
 	label := arg.Get("label").String()
 	dnsName := arg.Get("dnsname").String()
 	url := js.Global().Get("location").Get("pathname").String() + "?get=requestCert"
+	if p := arg.Get("params"); p.Type() == js.TypeString {
+		url += p.String()
+	}
 
 	return js.Global().Get("Promise").New(js.FuncOf(
 		func(this js.Value, args []js.Value) any {
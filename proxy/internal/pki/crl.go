@@ -0,0 +1,279 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+)
+
+const deltaCRLDefaultInterval = 15 * time.Minute
+
+var (
+	oidExtensionDeltaCRLIndicator = asn1.ObjectIdentifier{2, 5, 29, 27}
+	oidExtensionFreshestCRL       = asn1.ObjectIdentifier{2, 5, 29, 46}
+)
+
+func (m *PKIManager) crlUpdateInterval() time.Duration {
+	if m.opts.CRLUpdateInterval > 0 {
+		return m.opts.CRLUpdateInterval
+	}
+	return crlRefreshPeriod
+}
+
+func (m *PKIManager) deltaCRLUpdateInterval() time.Duration {
+	if m.opts.DeltaCRLUpdateInterval > 0 {
+		return m.opts.DeltaCRLUpdateInterval
+	}
+	return deltaCRLDefaultInterval
+}
+
+func (m *PKIManager) deltaCRLEnabled() bool {
+	return len(m.opts.DeltaCRLDistributionPoints) > 0
+}
+
+// crlIsFresh returns true if rl doesn't need to be replaced yet. A new list is
+// published a little before the current one expires.
+func crlIsFresh(rl *x509.RevocationList, interval time.Duration, now time.Time) bool {
+	return now.Before(rl.NextUpdate.Add(-interval / 10))
+}
+
+// upToDateLocked returns true if there were no revocations since the
+// revocation list was created.
+func (m *PKIManager) upToDateLocked(l *revocationList, rl *x509.RevocationList) bool {
+	if l.NumRevocations != m.db.NumRevocations {
+		return false
+	}
+	for _, c := range m.db.IssuedCerts {
+		if c.Revocation != nil && c.Revocation.Time.After(rl.ThisUpdate) {
+			return false
+		}
+	}
+	return true
+}
+
+// revokedEntriesLocked returns the entries of the certificates that were
+// revoked after the first minSeq-1 revocations, and that are not expired.
+func (m *PKIManager) revokedEntriesLocked(now time.Time, minSeq int64) []x509.RevocationListEntry {
+	var entries []x509.RevocationListEntry
+	for _, c := range m.db.IssuedCerts {
+		if c.Revocation == nil || c.Revocation.Seq < minSeq {
+			continue
+		}
+		cert, err := c.parse()
+		if err != nil {
+			m.opts.Logger.Errorf("ERR x509.ParseCertificate: %v", err)
+			continue
+		}
+		if now.After(cert.NotAfter) {
+			continue
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: c.Revocation.Time,
+			ReasonCode:     c.Revocation.ReasonCode,
+		})
+	}
+	return entries
+}
+
+// createRevocationListLocked creates a new revocation list signed by the
+// delegate key.
+func (m *PKIManager) createRevocationListLocked(now time.Time, lifetime time.Duration, entries []x509.RevocationListEntry, ext []pkix.Extension) (*x509.Certificate, []byte, error) {
+	signCert, err := m.db.DelegateCerts[0].parse()
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := m.parseKeyBytes(m.db.DelegateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("invalid private key")
+	}
+	m.db.CRLNumber++
+	rl := &x509.RevocationList{
+		Issuer:                    signCert.Subject,
+		Number:                    big.NewInt(m.db.CRLNumber),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(lifetime),
+		RevokedCertificateEntries: entries,
+		ExtraExtensions:           ext,
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, rl, signCert, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signCert, crl, nil
+}
+
+// DeltaRevocationList returns the current delta revocation list, i.e. the
+// certificates that were revoked since the current base revocation list was
+// published.
+// https://www.rfc-editor.org/rfc/rfc5280#section-5.2.4
+func (m *PKIManager) DeltaRevocationList() (cert, crl []byte, retErr error) {
+	if !m.deltaCRLEnabled() {
+		return nil, nil, errNotFound
+	}
+	if _, _, err := m.RevocationList(); err != nil {
+		return nil, nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	commit, err := m.open()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		commit(false, &retErr)
+		if retErr == storage.ErrRolledBack {
+			retErr = nil
+		}
+	}()
+
+	if m.db == nil || len(m.db.RevocationLists) == 0 {
+		return nil, nil, errNotFound
+	}
+	now := time.Now().UTC()
+	interval := m.deltaCRLUpdateInterval()
+
+	last := m.db.RevocationLists[len(m.db.RevocationLists)-1]
+	base, err := x509.ParseRevocationList(last.RawCRL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d := m.db.DeltaCRL; d != nil {
+		rl, err := x509.ParseRevocationList(d.RawCRL)
+		if err != nil {
+			return nil, nil, err
+		}
+		if crlIsFresh(rl, interval, now) && m.upToDateLocked(d, rl) && bytes.Equal(deltaCRLBase(rl), base.Number.Bytes()) {
+			return d.RawCert, rl.Raw, nil
+		}
+	}
+
+	baseNumber, err := asn1.Marshal(base.Number)
+	if err != nil {
+		return nil, nil, err
+	}
+	ext := []pkix.Extension{{
+		Id:       oidExtensionDeltaCRLIndicator,
+		Critical: true,
+		Value:    baseNumber,
+	}}
+	signCert, crl, err := m.createRevocationListLocked(now, interval, m.revokedEntriesLocked(now, last.NumRevocations+1), ext)
+	if err != nil {
+		return nil, nil, err
+	}
+	m.db.DeltaCRL = &revocationList{
+		RawCert:        signCert.Raw,
+		RawCRL:         crl,
+		NumRevocations: m.db.NumRevocations,
+	}
+	if err := commit(true, nil); err != nil {
+		return nil, nil, err
+	}
+	return signCert.Raw, crl, nil
+}
+
+// DeltaRevocationListPEM returns the current delta revocation list, PEM
+// encoded.
+func (m *PKIManager) DeltaRevocationListPEM() ([]byte, error) {
+	cert, crl, err := m.DeltaRevocationList()
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	pem.Encode(&out, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert,
+	})
+	pem.Encode(&out, &pem.Block{
+		Type:  "X509 CRL",
+		Bytes: crl,
+	})
+	return out.Bytes(), nil
+}
+
+// RefreshRevocationLists publishes new revocation lists when they are due.
+func (m *PKIManager) RefreshRevocationLists() error {
+	if m.deltaCRLEnabled() {
+		_, _, err := m.DeltaRevocationList()
+		return err
+	}
+	_, _, err := m.RevocationList()
+	return err
+}
+
+// deltaCRLBase returns the base CRL number of a delta CRL.
+func deltaCRLBase(rl *x509.RevocationList) []byte {
+	for _, e := range rl.Extensions {
+		if !e.Id.Equal(oidExtensionDeltaCRLIndicator) {
+			continue
+		}
+		var n *big.Int
+		if _, err := asn1.Unmarshal(e.Value, &n); err != nil {
+			return nil
+		}
+		return n.Bytes()
+	}
+	return nil
+}
+
+// freshestCRLExtension returns a Freshest CRL extension with these URLs.
+// https://www.rfc-editor.org/rfc/rfc5280#section-4.2.1.15
+func freshestCRLExtension(urls []string) (pkix.Extension, error) {
+	type distributionPointName struct {
+		FullName []asn1.RawValue `asn1:"optional,tag:0"`
+	}
+	type distributionPoint struct {
+		DistributionPoint distributionPointName `asn1:"optional,tag:0"`
+	}
+	var dps []distributionPoint
+	for _, u := range urls {
+		dps = append(dps, distributionPoint{
+			DistributionPoint: distributionPointName{
+				FullName: []asn1.RawValue{{Tag: 6, Class: asn1.ClassContextSpecific, Bytes: []byte(u)}},
+			},
+		})
+	}
+	b, err := asn1.Marshal(dps)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidExtensionFreshestCRL, Value: b}, nil
+}
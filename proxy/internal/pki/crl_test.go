@@ -0,0 +1,164 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+func TestDeltaCRL(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	m, err := New(Options{
+		Name:                       "crl-test",
+		Store:                      storage.New(t.TempDir(), mk),
+		CRLUpdateInterval:          24 * time.Hour,
+		DeltaCRLDistributionPoints: []string{"https://pki.example.com/delta.crl"},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	issue := func() *x509.Certificate {
+		t.Helper()
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("ecdsa.GenerateKey: %v", err)
+		}
+		raw, err := m.IssueCertificate(&x509.CertificateRequest{
+			PublicKeyAlgorithm: x509.ECDSA,
+			PublicKey:          key.Public(),
+			Subject:            pkix.Name{CommonName: "test"},
+		})
+		if err != nil {
+			t.Fatalf("IssueCertificate: %v", err)
+		}
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			t.Fatalf("x509.ParseCertificate: %v", err)
+		}
+		return cert
+	}
+	lists := func() (*x509.RevocationList, *x509.RevocationList) {
+		t.Helper()
+		_, raw, err := m.RevocationList()
+		if err != nil {
+			t.Fatalf("RevocationList: %v", err)
+		}
+		base, err := x509.ParseRevocationList(raw)
+		if err != nil {
+			t.Fatalf("x509.ParseRevocationList: %v", err)
+		}
+		_, raw, err = m.DeltaRevocationList()
+		if err != nil {
+			t.Fatalf("DeltaRevocationList: %v", err)
+		}
+		delta, err := x509.ParseRevocationList(raw)
+		if err != nil {
+			t.Fatalf("x509.ParseRevocationList: %v", err)
+		}
+		return base, delta
+	}
+	serials := func(rl *x509.RevocationList) []*big.Int {
+		var out []*big.Int
+		for _, e := range rl.RevokedCertificateEntries {
+			out = append(out, e.SerialNumber)
+		}
+		return out
+	}
+
+	cert1 := issue()
+	cert2 := issue()
+	if err := m.RevokeCertificate(cert1.SerialNumber, RevokeReasonKeyCompromise); err != nil {
+		t.Fatalf("RevokeCertificate: %v", err)
+	}
+	base1, delta1 := lists()
+	if got, want := base1.NextUpdate.Sub(base1.ThisUpdate), 24*time.Hour; got != want {
+		t.Errorf("base lifetime = %v, want %v", got, want)
+	}
+	if got := serials(base1); len(got) != 1 || got[0].Cmp(cert1.SerialNumber) != 0 {
+		t.Errorf("base entries = %v, want [%v]", got, cert1.SerialNumber)
+	}
+	if got := serials(delta1); len(got) != 0 {
+		t.Errorf("delta entries = %v, want []", got)
+	}
+	var hasFreshest bool
+	for _, e := range base1.Extensions {
+		if e.Id.Equal(oidExtensionFreshestCRL) {
+			hasFreshest = true
+			if !bytes.Contains(e.Value, []byte("https://pki.example.com/delta.crl")) {
+				t.Errorf("FreshestCRL = %x", e.Value)
+			}
+		}
+	}
+	if !hasFreshest {
+		t.Error("base CRL doesn't have a FreshestCRL extension")
+	}
+	if got, want := deltaCRLBase(delta1), base1.Number.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("delta base = %x, want %x", got, want)
+	}
+
+	// The second revocation is published immediately in the delta CRL,
+	// and the base CRL doesn't change.
+	if err := m.RevokeCertificate(cert2.SerialNumber, RevokeReasonSuperseded); err != nil {
+		t.Fatalf("RevokeCertificate: %v", err)
+	}
+	base2, delta2 := lists()
+	if !bytes.Equal(base1.Raw, base2.Raw) {
+		t.Error("base CRL changed")
+	}
+	if got := serials(delta2); len(got) != 1 || got[0].Cmp(cert2.SerialNumber) != 0 {
+		t.Errorf("delta entries = %v, want [%v]", got, cert2.SerialNumber)
+	}
+	if delta2.Number.Cmp(delta1.Number) <= 0 {
+		t.Errorf("delta number = %v, want > %v", delta2.Number, delta1.Number)
+	}
+	var critical bool
+	for _, e := range delta2.Extensions {
+		if e.Id.Equal(oidExtensionDeltaCRLIndicator) {
+			critical = e.Critical
+			var n *big.Int
+			if _, err := asn1.Unmarshal(e.Value, &n); err != nil || n.Cmp(base2.Number) != 0 {
+				t.Errorf("DeltaCRLIndicator = %v, %v, want %v", n, err, base2.Number)
+			}
+		}
+	}
+	if !critical {
+		t.Error("DeltaCRLIndicator is missing or not critical")
+	}
+}
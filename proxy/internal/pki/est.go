@@ -0,0 +1,327 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const estDefaultCertLifetime = 365 * 24 * time.Hour
+
+var (
+	oidPKCS7Data       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+)
+
+// ESTOptions are used to configure the Enrollment over Secure Transport (EST)
+// endpoints of a PKI manager.
+// https://www.rfc-editor.org/rfc/rfc7030.html
+type ESTOptions struct {
+	// AllowedDomains restricts which domains can be in the certificates of
+	// clients that authenticate with a TLS client certificate, e.g.
+	// "example.com" or "*.example.com". When it is empty, clients can't
+	// enroll with a TLS client certificate.
+	AllowedDomains []string
+	// AllowedIPs are the IP prefixes that can be in the certificates of
+	// clients that authenticate with a TLS client certificate. When it is
+	// empty, IP addresses aren't allowed.
+	AllowedIPs []netip.Prefix
+	// CertificateLifetime is the lifetime of the issued certificates.
+	// The default is 365 days.
+	CertificateLifetime time.Duration
+}
+
+// ServeESTCACerts implements the /cacerts EST endpoint. It returns the CA
+// certificate in a certs-only PKCS#7 structure.
+// https://www.rfc-editor.org/rfc/rfc7030.html#section-4.1
+func (m *PKIManager) ServeESTCACerts(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	caCert, err := m.CACert()
+	if err != nil {
+		m.opts.Logger.Errorf("ERR CACert: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	m.writeESTCerts(w, caCert.Raw)
+}
+
+// ServeESTSimpleEnroll implements the /simpleenroll EST endpoint. The client
+// must be authenticated, either with SSO or with a TLS client certificate.
+// https://www.rfc-editor.org/rfc/rfc7030.html#section-4.2.1
+func (m *PKIManager) ServeESTSimpleEnroll(w http.ResponseWriter, req *http.Request) {
+	in, ok := m.readESTRequest(w, req)
+	if !ok {
+		return
+	}
+	var cr *x509.CertificateRequest
+	var claims jwt.MapClaims
+	if m.opts.ClaimsFromCtx != nil {
+		claims = m.opts.ClaimsFromCtx(req.Context())
+	}
+	var actor string
+	if email, _ := claims["email"].(string); email != "" {
+		cr = userCertificateRequest(in, email)
+		actor = email
+	} else if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		peer := req.TLS.PeerCertificates[0]
+		actor = peer.Subject.String()
+		if len(m.opts.EST.AllowedDomains) == 0 {
+			m.opts.Logger.Errorf("ERR EST enrollment with a client certificate requires AllowedDomains")
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if len(in.EmailAddresses) > 0 || len(in.URIs) > 0 {
+			http.Error(w, "unsupported subject alternative names", http.StatusBadRequest)
+			return
+		}
+		if len(in.DNSNames) == 0 && len(in.IPAddresses) == 0 {
+			http.Error(w, "subject alternative names required", http.StatusBadRequest)
+			return
+		}
+		for _, n := range in.DNSNames {
+			if !domainAllowed(m.opts.EST.AllowedDomains, n) {
+				m.opts.Logger.Errorf("ERR EST %q not allowed for %q", n, peer.Subject)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		for _, ip := range in.IPAddresses {
+			if !ipAllowed(m.opts.EST.AllowedIPs, ip) {
+				m.opts.Logger.Errorf("ERR EST %s not allowed for %q", ip, peer.Subject)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		// The subject comes from the approved names. The one in the
+		// request isn't verified.
+		var subject pkix.Name
+		if len(in.DNSNames) > 0 {
+			subject.CommonName = in.DNSNames[0]
+		} else {
+			subject.CommonName = in.IPAddresses[0].String()
+		}
+		cr = &x509.CertificateRequest{
+			PublicKeyAlgorithm: in.PublicKeyAlgorithm,
+			PublicKey:          in.PublicKey,
+			Subject:            subject,
+			DNSNames:           in.DNSNames,
+			IPAddresses:        in.IPAddresses,
+		}
+	} else {
+		w.Header().Set("WWW-Authenticate", `Basic realm="est"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	m.issueESTCert(w, AuditActionIssue, actor, cr)
+}
+
+// ServeESTSimpleReEnroll implements the /simplereenroll EST endpoint. The
+// client must authenticate with a valid TLS client certificate issued by
+// this CA. The new certificate has the same subject and subject alternative
+// names as the current one.
+// https://www.rfc-editor.org/rfc/rfc7030.html#section-4.2.2
+func (m *PKIManager) ServeESTSimpleReEnroll(w http.ResponseWriter, req *http.Request) {
+	in, ok := m.readESTRequest(w, req)
+	if !ok {
+		return
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	current := req.TLS.PeerCertificates[0]
+	if err := m.checkIssuedCert(current); err != nil {
+		m.opts.Logger.Errorf("ERR EST reenroll %q: %v", current.Subject, err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	m.issueESTCert(w, AuditActionRenew, current.Subject.String(), &x509.CertificateRequest{
+		PublicKeyAlgorithm: in.PublicKeyAlgorithm,
+		PublicKey:          in.PublicKey,
+		Subject:            current.Subject,
+		DNSNames:           current.DNSNames,
+		EmailAddresses:     current.EmailAddresses,
+		IPAddresses:        current.IPAddresses,
+		URIs:               current.URIs,
+	})
+}
+
+// ipAllowed returns true if ip is in one of the allowed prefixes.
+func ipAllowed(allowed []netip.Prefix, ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	return slices.ContainsFunc(allowed, func(p netip.Prefix) bool {
+		return p.Contains(addr)
+	})
+}
+
+// checkIssuedCert verifies that cert was issued by this CA, and that it is
+// neither expired nor revoked.
+func (m *PKIManager) checkIssuedCert(cert *x509.Certificate) error {
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return errors.New("certificate is expired")
+	}
+	issued, err := m.findCert(bytesToHex(cert.SerialNumber.Bytes()))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(issued.Raw, cert.Raw) {
+		return errNotFound
+	}
+	return nil
+}
+
+func (m *PKIManager) readESTRequest(w http.ResponseWriter, req *http.Request) (*x509.CertificateRequest, bool) {
+	if m.opts.EST == nil {
+		http.NotFound(w, req)
+		return nil, false
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	if ct := req.Header.Get("content-type"); ct != "application/pkcs10" {
+		m.opts.Logger.Errorf("ERR content-type: %v", ct)
+		http.Error(w, "invalid content-type", http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, 102400))
+	if err != nil {
+		m.opts.Logger.Errorf("ERR body: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	der, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(body), nil)))
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return nil, false
+	}
+	cr, err := m.ValidateCertificateRequest(der)
+	if err != nil {
+		m.opts.Logger.Errorf("ERR ValidateCertificateRequest: %v", err)
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return nil, false
+	}
+	return cr, true
+}
+
+func (m *PKIManager) issueESTCert(w http.ResponseWriter, action, actor string, cr *x509.CertificateRequest) {
+	lifetime := m.opts.EST.CertificateLifetime
+	if lifetime <= 0 {
+		lifetime = estDefaultCertLifetime
+	}
+	raw, err := m.issueCertificate(cr, lifetime)
+	if err != nil {
+		m.opts.Logger.Errorf("ERR issueCertificate: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	m.recordAuditRaw(action, actor, "est", "", raw)
+	if m.opts.EventRecorder != nil {
+		m.opts.EventRecorder.Record("pki est certificate issued")
+	}
+	m.writeESTCerts(w, raw)
+}
+
+func (m *PKIManager) writeESTCerts(w http.ResponseWriter, certs ...[]byte) {
+	p7, err := certsOnlyPKCS7(certs...)
+	if err != nil {
+		m.opts.Logger.Errorf("ERR certsOnlyPKCS7: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/pkcs7-mime; smime-type=certs-only")
+	w.Header().Set("content-transfer-encoding", "base64")
+	enc := base64.StdEncoding.EncodeToString(p7)
+	for len(enc) > 64 {
+		fmt.Fprintf(w, "%s\r\n", enc[:64])
+		enc = enc[64:]
+	}
+	fmt.Fprintf(w, "%s\r\n", enc)
+}
+
+// certsOnlyPKCS7 returns a degenerate PKCS#7 SignedData structure that
+// contains only certificates.
+// https://www.rfc-editor.org/rfc/rfc5652.html#section-5
+func certsOnlyPKCS7(certs ...[]byte) ([]byte, error) {
+	emptySet := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true}
+	signedData, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      struct {
+			ContentType asn1.ObjectIdentifier
+		}
+		Certificates asn1.RawValue
+		SignerInfos  asn1.RawValue
+	}{
+		Version:          1,
+		DigestAlgorithms: emptySet,
+		ContentInfo: struct {
+			ContentType asn1.ObjectIdentifier
+		}{ContentType: oidPKCS7Data},
+		Certificates: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      slices.Concat(certs...),
+		},
+		SignerInfos: emptySet,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{
+		ContentType: oidPKCS7SignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      signedData,
+		},
+	})
+}
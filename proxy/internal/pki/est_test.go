@@ -0,0 +1,274 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+type claimsCtxKey struct{}
+
+func newESTTest(t *testing.T) *PKIManager {
+	t.Helper()
+	return newESTTestWithOptions(t, &ESTOptions{
+		AllowedDomains: []string{"*.example.com"},
+		AllowedIPs:     []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+	})
+}
+
+func newESTTestWithOptions(t *testing.T, opts *ESTOptions) *PKIManager {
+	t.Helper()
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	m, err := New(Options{
+		Name:  "est-test",
+		Store: storage.New(t.TempDir(), mk),
+		EST:   opts,
+		ClaimsFromCtx: func(ctx context.Context) jwt.MapClaims {
+			c, _ := ctx.Value(claimsCtxKey{}).(jwt.MapClaims)
+			return c
+		},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return m
+}
+
+func estRequest(t *testing.T, h http.HandlerFunc, req *http.Request) (int, []*x509.Certificate) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, req)
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	if got, want := w.Header().Get("content-type"), "application/pkcs7-mime; smime-type=certs-only"; got != want {
+		t.Errorf("content-type = %q, want %q", got, want)
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(w.Body.String()), ""))
+	if err != nil {
+		t.Fatalf("base64: %v", err)
+	}
+	var ci struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"explicit,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		t.Fatalf("asn1.Unmarshal(ContentInfo): %v", err)
+	}
+	var sd struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      asn1.RawValue
+		Certificates     asn1.RawValue `asn1:"tag:0"`
+		SignerInfos      asn1.RawValue
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatalf("asn1.Unmarshal(SignedData): %v", err)
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificates: %v", err)
+	}
+	return w.Code, certs
+}
+
+func newESTEnrollRequest(t *testing.T, path string, names ...string) *http.Request {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	tmpl := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "device", Organization: []string{"Evil Corp"}},
+	}
+	for _, n := range names {
+		if ip := net.ParseIP(n); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+			continue
+		}
+		tmpl.DNSNames = append(tmpl.DNSNames, n)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificateRequest: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(base64.StdEncoding.EncodeToString(csr)))
+	req.Header.Set("content-type", "application/pkcs10")
+	return req
+}
+
+func TestESTCACerts(t *testing.T) {
+	m := newESTTest(t)
+	code, certs := estRequest(t, m.ServeESTCACerts, httptest.NewRequest(http.MethodGet, "/.well-known/est/cacerts", nil))
+	if code != http.StatusOK {
+		t.Fatalf("code = %d", code)
+	}
+	caCert, err := m.CACert()
+	if err != nil {
+		t.Fatalf("CACert: %v", err)
+	}
+	if len(certs) != 1 || !certs[0].Equal(caCert) {
+		t.Errorf("cacerts = %v, want CA cert", certs)
+	}
+}
+
+func TestESTEnroll(t *testing.T) {
+	m := newESTTest(t)
+	const path = "/.well-known/est/simpleenroll"
+
+	// Not authenticated.
+	if code, _ := estRequest(t, m.ServeESTSimpleEnroll, newESTEnrollRequest(t, path, "dev.example.com")); code != http.StatusUnauthorized {
+		t.Errorf("code = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// Authenticated with SSO.
+	req := newESTEnrollRequest(t, path, "dev.example.org")
+	req = req.WithContext(context.WithValue(req.Context(), claimsCtxKey{}, jwt.MapClaims{"email": "bob@example.com"}))
+	code, certs := estRequest(t, m.ServeESTSimpleEnroll, req)
+	if code != http.StatusOK || len(certs) != 1 {
+		t.Fatalf("code = %d, certs = %v", code, certs)
+	}
+	if got, want := certs[0].Subject.CommonName, "bob@example.com::device"; got != want {
+		t.Errorf("CommonName = %q, want %q", got, want)
+	}
+
+	// Authenticated with a TLS client certificate.
+	bootstrap := &x509.Certificate{Subject: pkix.Name{CommonName: "bootstrap"}}
+	req = newESTEnrollRequest(t, path, "dev.example.org")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{bootstrap}}
+	if code, _ := estRequest(t, m.ServeESTSimpleEnroll, req); code != http.StatusForbidden {
+		t.Errorf("code = %d, want %d", code, http.StatusForbidden)
+	}
+	req = newESTEnrollRequest(t, path, "dev.example.com")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{bootstrap}}
+	code, certs = estRequest(t, m.ServeESTSimpleEnroll, req)
+	if code != http.StatusOK || len(certs) != 1 {
+		t.Fatalf("code = %d, certs = %v", code, certs)
+	}
+	cert := certs[0]
+	if got, want := cert.Subject.CommonName, "dev.example.com"; got != want {
+		t.Errorf("CommonName = %q, want %q", got, want)
+	}
+	if got, want := strings.Join(cert.DNSNames, ","), "dev.example.com"; got != want {
+		t.Errorf("DNSNames = %q, want %q", got, want)
+	}
+	if lifetime := cert.NotAfter.Sub(cert.NotBefore); lifetime != estDefaultCertLifetime {
+		t.Errorf("lifetime = %v, want %v", lifetime, estDefaultCertLifetime)
+	}
+
+	// Re-enroll with a certificate that wasn't issued by this CA.
+	const rePath = "/.well-known/est/simplereenroll"
+	req = newESTEnrollRequest(t, rePath, "dev.example.com")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{bootstrap}}
+	if code, _ := estRequest(t, m.ServeESTSimpleReEnroll, req); code != http.StatusForbidden {
+		t.Errorf("code = %d, want %d", code, http.StatusForbidden)
+	}
+
+	// Re-enroll with the issued certificate.
+	req = newESTEnrollRequest(t, rePath, "other.example.com")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	code, certs = estRequest(t, m.ServeESTSimpleReEnroll, req)
+	if code != http.StatusOK || len(certs) != 1 {
+		t.Fatalf("code = %d, certs = %v", code, certs)
+	}
+	if got, want := strings.Join(certs[0].DNSNames, ","), "dev.example.com"; got != want {
+		t.Errorf("DNSNames = %q, want %q", got, want)
+	}
+
+	// Re-enroll with a revoked certificate.
+	if err := m.RevokeCertificate(cert.SerialNumber, RevokeReasonSuperseded); err != nil {
+		t.Fatalf("RevokeCertificate: %v", err)
+	}
+	req = newESTEnrollRequest(t, rePath, "dev.example.com")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if code, _ := estRequest(t, m.ServeESTSimpleReEnroll, req); code != http.StatusForbidden {
+		t.Errorf("code = %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestESTEnrollClientCertRestrictions(t *testing.T) {
+	const path = "/.well-known/est/simpleenroll"
+	bootstrap := &x509.Certificate{Subject: pkix.Name{CommonName: "bootstrap"}}
+	enroll := func(m *PKIManager, names ...string) (int, []*x509.Certificate) {
+		req := newESTEnrollRequest(t, path, names...)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{bootstrap}}
+		return estRequest(t, m.ServeESTSimpleEnroll, req)
+	}
+
+	// Without AllowedDomains, enrollment with a client certificate is
+	// disabled.
+	if code, _ := enroll(newESTTestWithOptions(t, &ESTOptions{}), "dev.example.com"); code != http.StatusForbidden {
+		t.Errorf("no AllowedDomains: code = %d, want %d", code, http.StatusForbidden)
+	}
+
+	// IP addresses require AllowedIPs.
+	m := newESTTestWithOptions(t, &ESTOptions{AllowedDomains: []string{"*.example.com"}})
+	if code, _ := enroll(m, "dev.example.com", "10.1.2.3"); code != http.StatusForbidden {
+		t.Errorf("no AllowedIPs: code = %d, want %d", code, http.StatusForbidden)
+	}
+
+	m = newESTTest(t)
+	if code, _ := enroll(m, "dev.example.com", "10.2.0.1"); code != http.StatusForbidden {
+		t.Errorf("IP not allowed: code = %d, want %d", code, http.StatusForbidden)
+	}
+	if code, _ := enroll(m); code != http.StatusBadRequest {
+		t.Errorf("no names: code = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	// The subject comes from the approved names, not from the request.
+	code, certs := enroll(m, "10.1.2.3")
+	if code != http.StatusOK || len(certs) != 1 {
+		t.Fatalf("code = %d, certs = %v", code, certs)
+	}
+	if got, want := certs[0].Subject.CommonName, "10.1.2.3"; got != want {
+		t.Errorf("CommonName = %q, want %q", got, want)
+	}
+	if got := certs[0].Subject.Organization; len(got) != 0 {
+		t.Errorf("Organization = %q, want none", got)
+	}
+	if len(certs[0].IPAddresses) != 1 || !certs[0].IPAddresses[0].Equal(net.ParseIP("10.1.2.3")) {
+		t.Errorf("IPAddresses = %v, want [10.1.2.3]", certs[0].IPAddresses)
+	}
+}
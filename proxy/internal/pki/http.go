@@ -35,6 +35,8 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"mime"
@@ -52,12 +54,17 @@ import (
 var embedCerts string
 var certsTemplate *template.Template
 
+//go:embed audit.html
+var embedAudit string
+var auditTemplate *template.Template
+
 //go:embed certs.js style.css pki.wasm.bz2 wasm_exec.js
 var staticFiles embed.FS
 var staticEtags map[string]string
 
 func init() {
 	certsTemplate = template.Must(template.New("pki-certs").Parse(embedCerts))
+	auditTemplate = template.Must(template.New("pki-audit").Parse(embedAudit))
 	staticEtags = make(map[string]string)
 	d, err := staticFiles.ReadDir(".")
 	if err != nil {
@@ -101,9 +108,18 @@ func (m *PKIManager) ServeCACert(w http.ResponseWriter, req *http.Request) {
 
 // ServeCRL sends the revocation list.
 func (m *PKIManager) ServeCRL(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("cache-control", "public, max-age=1800")
+	serveCRL(w, req, m.crlUpdateInterval()/2, m.RevocationListPEM, m.RevocationList)
+}
+
+// ServeDeltaCRL sends the delta revocation list.
+func (m *PKIManager) ServeDeltaCRL(w http.ResponseWriter, req *http.Request) {
+	serveCRL(w, req, m.deltaCRLUpdateInterval()/2, m.DeltaRevocationListPEM, m.DeltaRevocationList)
+}
+
+func serveCRL(w http.ResponseWriter, req *http.Request, maxAge time.Duration, pemFunc func() ([]byte, error), derFunc func() ([]byte, []byte, error)) {
+	w.Header().Set("cache-control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
 	if strings.HasSuffix(req.URL.Path, ".pem") {
-		b, err := m.RevocationListPEM()
+		b, err := pemFunc()
 		if err != nil {
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
@@ -112,7 +128,7 @@ func (m *PKIManager) ServeCRL(w http.ResponseWriter, req *http.Request) {
 		etag(w, req, b)
 		return
 	}
-	_, b, err := m.RevocationList()
+	_, b, err := derFunc()
 	if err != nil {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
@@ -210,6 +226,9 @@ func (m *PKIManager) ServeCertificateManagement(w http.ResponseWriter, req *http
 	case "static":
 		m.handleStaticFile(w, req)
 		return
+	case "auditLog":
+		m.handleAuditLog(w, req, email, isAdmin)
+		return
 	default:
 		m.opts.Logger.Errorf("ERR unexpected mode: %v", mode)
 		http.Error(w, "invalid request", http.StatusBadRequest)
@@ -328,6 +347,8 @@ func (m *PKIManager) ServeCertificateManagement(w http.ResponseWriter, req *http
 		CASN           string
 		CASubjectKeyId string
 		Certs          []cert
+		Profiles       []*profile
+		IsAdmin        bool
 	}{
 		Status:         statusFilter,
 		Owner:          ownerFilter,
@@ -336,6 +357,8 @@ func (m *PKIManager) ServeCertificateManagement(w http.ResponseWriter, req *http
 		CASN:           bytesToHex(caCert.SerialNumber.Bytes()),
 		CASubjectKeyId: bytesToHex(caCert.SubjectKeyId),
 		Certs:          certs,
+		Profiles:       m.availableProfiles(email),
+		IsAdmin:        slices.Contains(m.opts.Admins, email),
 	}
 	w.Header().Set("X-Frame-Options", "DENY")
 	certsTemplate.Execute(w, data)
@@ -383,24 +406,49 @@ func (m *PKIManager) handleRequestCert(w http.ResponseWriter, req *http.Request)
 		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
-	cr := &x509.CertificateRequest{
-		PublicKeyAlgorithm: in.PublicKeyAlgorithm,
-		PublicKey:          in.PublicKey,
-		Subject:            pkix.Name{CommonName: email},
-		EmailAddresses: []string{
-			email,
-		},
-		DNSNames: in.DNSNames,
+	var lifetime time.Duration
+	if v := req.Form.Get("lifetime"); v != "" {
+		if lifetime, err = time.ParseDuration(v); err != nil {
+			m.opts.Logger.Errorf("ERR lifetime: %v", err)
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
 	}
-	if in.Subject.CommonName != "" {
-		cr.Subject.CommonName += "::" + in.Subject.CommonName
+	p, err := m.selectProfile(req.Form.Get("profile"), email)
+	if err == nil && p == nil && lifetime != 0 {
+		err = errors.New("lifetime requires a profile")
+	}
+	if err != nil {
+		m.opts.Logger.Errorf("ERR selectProfile: %v", err)
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"result": "permission denied",
+		})
+		return
+	}
+	cr := userCertificateRequest(in, email)
+	var cert []byte
+	var profileName string
+	if p == nil {
+		cert, err = m.IssueCertificate(cr)
+	} else {
+		profileName = p.Name
+		if lifetime, err = p.check(cr, in.Subject.CommonName, lifetime); err != nil {
+			m.opts.Logger.Errorf("ERR profile %q: %v", p.Name, err)
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{
+				"result": err.Error(),
+			})
+			return
+		}
+		cert, err = m.issueProfileCertificate(cr, p, lifetime)
 	}
-	cert, err := m.IssueCertificate(cr)
 	if err != nil {
 		m.opts.Logger.Errorf("ERR body: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	m.recordAuditRaw(AuditActionIssue, email, "web", profileName, cert)
 	w.Header().Set("content-type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
 		"result": "ok",
@@ -408,6 +456,24 @@ func (m *PKIManager) handleRequestCert(w http.ResponseWriter, req *http.Request)
 	})
 }
 
+// userCertificateRequest returns the certificate request to use for a user's
+// certificate. The user's email address is always in the certificate.
+func userCertificateRequest(in *x509.CertificateRequest, email string) *x509.CertificateRequest {
+	cr := &x509.CertificateRequest{
+		PublicKeyAlgorithm: in.PublicKeyAlgorithm,
+		PublicKey:          in.PublicKey,
+		Subject:            pkix.Name{CommonName: email},
+		EmailAddresses: []string{
+			email,
+		},
+		DNSNames: in.DNSNames,
+	}
+	if in.Subject.CommonName != "" {
+		cr.Subject.CommonName += "::" + in.Subject.CommonName
+	}
+	return cr
+}
+
 func (m *PKIManager) handleRevokeCert(w http.ResponseWriter, req *http.Request, isAdmin bool) {
 	claims := m.opts.ClaimsFromCtx(req.Context())
 	if claims == nil {
@@ -450,12 +516,88 @@ func (m *PKIManager) handleRevokeCert(w http.ResponseWriter, req *http.Request,
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	m.recordAudit(AuditActionRevoke, email, "web", "", c, RevokeReasonUnspecified)
 	w.Header().Set("content-type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
 		"result": "ok",
 	})
 }
 
+func (m *PKIManager) handleAuditLog(w http.ResponseWriter, req *http.Request, email string, isAdmin bool) {
+	if !isAdmin {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	q := AuditQuery{
+		Action:       req.Form.Get("action"),
+		Actor:        req.Form.Get("actor"),
+		SerialNumber: req.Form.Get("sn"),
+		Name:         req.Form.Get("name"),
+	}
+	for _, f := range []struct {
+		name string
+		t    *time.Time
+		add  int
+	}{
+		{"since", &q.Since, 0},
+		{"until", &q.Until, 1},
+	} {
+		v := req.Form.Get(f.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		*f.t = t.AddDate(0, 0, f.add)
+	}
+	entries, err := m.AuditLog(q)
+	if err != nil {
+		m.opts.Logger.Errorf("ERR AuditLog: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if req.Form.Get("format") == "json" {
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("content-disposition", `attachment; filename="audit-log.json"`)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(entries)
+		return
+	}
+	jsonQuery := url.Values{}
+	for k, v := range req.Form {
+		jsonQuery[k] = v
+	}
+	jsonQuery.Set("format", "json")
+	slices.Reverse(entries)
+	data := struct {
+		Email     string
+		Action    string
+		Actor     string
+		SN        string
+		Name      string
+		Since     string
+		Until     string
+		JSONQuery string
+		Entries   []*AuditEntry
+	}{
+		Email:     email,
+		Action:    q.Action,
+		Actor:     q.Actor,
+		SN:        q.SerialNumber,
+		Name:      q.Name,
+		Since:     req.Form.Get("since"),
+		Until:     req.Form.Get("until"),
+		JSONQuery: jsonQuery.Encode(),
+		Entries:   entries,
+	}
+	w.Header().Set("X-Frame-Options", "DENY")
+	auditTemplate.Execute(w, data)
+}
+
 func (m *PKIManager) handleDownloadCert(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodGet {
 		m.opts.Logger.Errorf("ERR method: %v", req.Method)
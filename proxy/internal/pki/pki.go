@@ -121,6 +121,29 @@ type Options struct {
 	}
 	// ClaimsFromCtx returns jwt claims for the current user.
 	ClaimsFromCtx func(context.Context) jwt.MapClaims
+	// ACME, if set, enables the ACME server.
+	ACME *ACMEOptions
+	// EST, if set, enables the EST endpoints.
+	EST *ESTOptions
+	// SCEP, if set, enables the SCEP responder.
+	SCEP *SCEPOptions
+	// CRLUpdateInterval is how often a new Certificate Revocation List is
+	// published. The default is 1 hour.
+	CRLUpdateInterval time.Duration
+	// DeltaCRLDistributionPoints is a list of URLs that serve this CA's
+	// delta Certificate Revocation List. When set, new revocations are
+	// published in the delta CRL until the next base CRL is published.
+	DeltaCRLDistributionPoints []string
+	// DeltaCRLUpdateInterval is how often a new delta CRL is published,
+	// in addition to immediately after each revocation. The default is 15
+	// minutes.
+	DeltaCRLUpdateInterval time.Duration
+	// Renewal, if set, enables the certificate renewal endpoint.
+	Renewal *RenewalOptions
+	// Profiles is the list of certificate profiles that users can select
+	// when they request a certificate. When empty, the certificates are
+	// issued with the default settings.
+	Profiles []Profile
 }
 
 // New returns a new initialized PKI manager. The Certificate Authority's key
@@ -136,20 +159,38 @@ func New(opts Options) (*PKIManager, error) {
 	if m.opts.KeyType == "" {
 		m.opts.KeyType = "ecdsa-p256"
 	}
+	profiles, err := compileProfiles(opts.Profiles)
+	if err != nil {
+		return nil, err
+	}
+	m.profiles = profiles
 	m.opts.Store.CreateEmptyFile(m.pkiFile, &certificateAuthority{})
+	m.opts.Store.CreateEmptyFile(m.auditFile(), &auditLog{})
 	if err := m.initCA(); err != nil {
 		return nil, err
 	}
+	if opts.ACME != nil {
+		acme, err := newACMEServer(m, *opts.ACME)
+		if err != nil {
+			return nil, err
+		}
+		m.acme = acme
+	}
+	if opts.SCEP != nil {
+		m.opts.Store.CreateEmptyFile(m.scepFile(), &scepData{})
+	}
 	return m, nil
 }
 
 // PKIManager implements a simple Public Key Infrastructure (PKI) manager that
 // can issue and revoke X.509 certificates.
 type PKIManager struct {
-	opts    Options
-	pkiFile string
-	mu      sync.Mutex
-	db      *certificateAuthority
+	opts     Options
+	pkiFile  string
+	mu       sync.Mutex
+	db       *certificateAuthority
+	acme     *acmeServer
+	profiles []*profile
 }
 
 type certificateAuthority struct {
@@ -161,7 +202,11 @@ type certificateAuthority struct {
 	IssuedCerts     []*certificate
 	CRLNumber       int64
 	RevocationLists []revocationList
+	DeltaCRL        *revocationList
+	NumRevocations  int64
 	Revoked         map[string]bool
+	SCEPKey         []byte
+	SCEPCert        *certificate
 }
 
 type certificate struct {
@@ -202,11 +247,17 @@ func (c *certificate) revoke(code int) {
 type revocation struct {
 	Time       time.Time
 	ReasonCode int
+	// Seq is the value of certificateAuthority.NumRevocations after this
+	// revocation.
+	Seq int64
 }
 
 type revocationList struct {
 	RawCert []byte
 	RawCRL  []byte
+	// NumRevocations is the value of certificateAuthority.NumRevocations
+	// when the list was created.
+	NumRevocations int64
 }
 
 func (m *PKIManager) open() (func(commit bool, errp *error) error, error) {
@@ -441,7 +492,7 @@ func (m *PKIManager) maybeRotateDelegateCert() error {
 		CRLDistributionPoints: m.opts.CRLDistributionPoints,
 		OCSPServer:            m.opts.OCSPServer,
 	}
-	_, err = m.signCertificate(templ, func(c *certificate) error {
+	raw, err := m.signCertificate(templ, func(c *certificate) error {
 		m.db.DelegateKey = keyBytes
 		old := m.db.DelegateCerts
 		m.db.DelegateCerts = make([]*certificate, 0, 2)
@@ -451,7 +502,11 @@ func (m *PKIManager) maybeRotateDelegateCert() error {
 		}
 		return nil
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	m.recordAuditRaw(AuditActionIssue, "system", "internal", "", raw)
+	return nil
 }
 
 // RevocationListPEM returns the current revocation list, PEM encoded.
@@ -496,67 +551,37 @@ func (m *PKIManager) RevocationList() (cert, crl []byte, retErr error) {
 		return nil, nil, errNotFound
 	}
 	now := time.Now().UTC()
+	interval := m.crlUpdateInterval()
 
 	if len(m.db.RevocationLists) > 0 {
-		var lastRevocation time.Time
-		for _, c := range m.db.IssuedCerts {
-			if c.Revocation != nil && c.Revocation.Time.After(lastRevocation) {
-				lastRevocation = c.Revocation.Time
-			}
-		}
 		last := m.db.RevocationLists[len(m.db.RevocationLists)-1]
 		rl, err := x509.ParseRevocationList(last.RawCRL)
 		if err != nil {
 			return nil, nil, err
 		}
-		if !rl.ThisUpdate.Before(lastRevocation) && rl.NextUpdate.Add(crlRefreshPeriod/2).After(now) {
+		// With delta CRLs, new revocations are published in the delta
+		// CRL, and the base CRL is only updated on schedule.
+		if crlIsFresh(rl, interval, now) && (m.deltaCRLEnabled() || m.upToDateLocked(&last, rl)) {
 			return last.RawCert, rl.Raw, nil
 		}
 	}
 
-	signCert, err := m.db.DelegateCerts[0].parse()
-	if err != nil {
-		return nil, nil, err
-	}
-	m.db.CRLNumber++
-	rl := &x509.RevocationList{
-		Issuer:     signCert.Subject,
-		Number:     big.NewInt(m.db.CRLNumber),
-		ThisUpdate: now,
-		NextUpdate: now.Add(crlRefreshPeriod),
-	}
-	for _, c := range m.db.IssuedCerts {
-		if c.Revocation == nil {
-			continue
-		}
-		cert, err := c.parse()
+	var ext []pkix.Extension
+	if m.deltaCRLEnabled() {
+		e, err := freshestCRLExtension(m.opts.DeltaCRLDistributionPoints)
 		if err != nil {
 			return nil, nil, err
 		}
-		if now.After(cert.NotAfter) {
-			continue
-		}
-		rl.RevokedCertificateEntries = append(rl.RevokedCertificateEntries, x509.RevocationListEntry{
-			SerialNumber:   cert.SerialNumber,
-			RevocationTime: c.Revocation.Time,
-			ReasonCode:     c.Revocation.ReasonCode,
-		})
+		ext = append(ext, e)
 	}
-
-	key, err := m.parseKeyBytes(m.db.DelegateKey)
+	signCert, crl, err := m.createRevocationListLocked(now, interval, m.revokedEntriesLocked(now, 0), ext)
 	if err != nil {
 		return nil, nil, err
 	}
-	signer, ok := key.(crypto.Signer)
-	if !ok {
-		return nil, nil, errors.New("invalid private key")
-	}
-	if crl, err = x509.CreateRevocationList(rand.Reader, rl, signCert, signer); err != nil {
-		return nil, nil, err
-	}
 	m.db.RevocationLists = append(m.db.RevocationLists, revocationList{
-		RawCert: signCert.Raw,
-		RawCRL:  crl,
+		RawCert:        signCert.Raw,
+		RawCRL:         crl,
+		NumRevocations: m.db.NumRevocations,
 	})
 	if n := len(m.db.RevocationLists) - maxNumCRL; n > 0 {
 		m.db.RevocationLists = m.db.RevocationLists[n:]
@@ -676,8 +701,18 @@ func (m *PKIManager) OCSPResponse(req *ocsp.Request) ([]byte, error) {
 }
 
 // RevokeCertificate revokes the certificate with this serial number and set the
-// reason code.
-func (m *PKIManager) RevokeCertificate(serialNumber *big.Int, reasonCode int) (retErr error) {
+// reason code. The revocation lists are updated immediately.
+func (m *PKIManager) RevokeCertificate(serialNumber *big.Int, reasonCode int) error {
+	if err := m.revokeCertificate(serialNumber, reasonCode); err != nil {
+		return err
+	}
+	if err := m.RefreshRevocationLists(); err != nil {
+		m.opts.Logger.Errorf("ERR RefreshRevocationLists: %v", err)
+	}
+	return nil
+}
+
+func (m *PKIManager) revokeCertificate(serialNumber *big.Int, reasonCode int) (retErr error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -703,6 +738,8 @@ func (m *PKIManager) RevokeCertificate(serialNumber *big.Int, reasonCode int) (r
 				m.db.Revoked = make(map[string]bool)
 			}
 			m.db.Revoked[snh] = true
+			m.db.NumRevocations++
+			c.Revocation.Seq = m.db.NumRevocations
 			return commit(true, nil)
 		}
 	}
@@ -735,6 +772,20 @@ func (m *PKIManager) ValidateCertificateRequest(csr []byte) (*x509.CertificateRe
 
 // IssueCertificate issues a new certificate.
 func (m *PKIManager) IssueCertificate(cr *x509.CertificateRequest) (cert []byte, retErr error) {
+	return m.issueCertificate(cr, issuedCertsLifetime)
+}
+
+func (m *PKIManager) issueCertificate(cr *x509.CertificateRequest, lifetime time.Duration) ([]byte, error) {
+	templ, err := m.certificateTemplate(cr, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	return m.signCertificate(templ, nil)
+}
+
+// certificateTemplate returns the template of a new certificate for this
+// certificate request.
+func (m *PKIManager) certificateTemplate(cr *x509.CertificateRequest, lifetime time.Duration) (*x509.Certificate, error) {
 	now := time.Now().UTC()
 	sn, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 160))
 	if err != nil {
@@ -753,7 +804,7 @@ func (m *PKIManager) IssueCertificate(cr *x509.CertificateRequest) (cert []byte,
 		PublicKey:             cr.PublicKey,
 		Subject:               cr.Subject,
 		NotBefore:             now,
-		NotAfter:              now.Add(issuedCertsLifetime),
+		NotAfter:              now.Add(lifetime),
 		KeyUsage:              x509.KeyUsageDataEncipherment | x509.KeyUsageDigitalSignature,
 		BasicConstraintsValid: true,
 		ExtKeyUsage:           eku,
@@ -765,7 +816,7 @@ func (m *PKIManager) IssueCertificate(cr *x509.CertificateRequest) (cert []byte,
 		IPAddresses:           cr.IPAddresses,
 		URIs:                  cr.URIs,
 	}
-	return m.signCertificate(templ, nil)
+	return templ, nil
 }
 
 // signCertificate signs a new certificate.
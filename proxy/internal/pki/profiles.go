@@ -0,0 +1,239 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	keyUsageNames = map[string]x509.KeyUsage{
+		"digitalSignature":  x509.KeyUsageDigitalSignature,
+		"contentCommitment": x509.KeyUsageContentCommitment,
+		"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+		"dataEncipherment":  x509.KeyUsageDataEncipherment,
+		"keyAgreement":      x509.KeyUsageKeyAgreement,
+	}
+	extKeyUsageNames = map[string]x509.ExtKeyUsage{
+		"serverAuth":      x509.ExtKeyUsageServerAuth,
+		"clientAuth":      x509.ExtKeyUsageClientAuth,
+		"codeSigning":     x509.ExtKeyUsageCodeSigning,
+		"emailProtection": x509.ExtKeyUsageEmailProtection,
+	}
+
+	errProfileDenied = errors.New("profile not allowed")
+)
+
+// Profile is a certificate issuance profile. Users select a profile when they
+// request a certificate, and the profile determines what the certificate can
+// contain and how long it is valid.
+type Profile struct {
+	// Name is the name of the profile.
+	Name string
+	// Description is shown to the users when they select a profile.
+	Description string
+	// KeyUsages is the list of key usages to include in the certificates,
+	// e.g. digitalSignature, keyEncipherment, etc. The default is
+	// digitalSignature and dataEncipherment.
+	KeyUsages []string
+	// ExtKeyUsages is the list of extended key usages to include in the
+	// certificates: serverAuth, clientAuth, codeSigning, or
+	// emailProtection. The default is serverAuth when the certificate has
+	// DNS names, and clientAuth otherwise.
+	ExtKeyUsages []string
+	// DNSNames is the list of DNS names that are allowed in the
+	// certificates, e.g. "www.example.com" or "*.example.com". The latter
+	// matches any subdomain of example.com. When empty, DNS names are not
+	// allowed.
+	DNSNames []string
+	// LabelPattern is a regular expression that the certificate label, i.e.
+	// the requested common name, must match. When empty, any label is
+	// allowed.
+	LabelPattern string
+	// MaxLifetime is the maximum lifetime of the certificates. It is also
+	// the default lifetime. The default is 10 years.
+	MaxLifetime time.Duration
+	// Users is the list of users who can use this profile. Each entry is
+	// either an email address or a domain that starts with @. When empty,
+	// all users can use it.
+	Users []string
+	// AdminsOnly indicates that only the PKI admins can use this profile.
+	AdminsOnly bool
+}
+
+type profile struct {
+	Profile
+	keyUsage     x509.KeyUsage
+	extKeyUsage  []x509.ExtKeyUsage
+	labelPattern *regexp.Regexp
+}
+
+// ValidateProfile returns an error if the profile is not valid.
+func ValidateProfile(p Profile) error {
+	_, err := compileProfile(p)
+	return err
+}
+
+func compileProfile(p Profile) (*profile, error) {
+	if p.Name == "" {
+		return nil, errors.New("Name: must be set")
+	}
+	out := &profile{Profile: p}
+	for _, ku := range p.KeyUsages {
+		v, ok := keyUsageNames[ku]
+		if !ok {
+			return nil, fmt.Errorf("KeyUsages: invalid value %q", ku)
+		}
+		out.keyUsage |= v
+	}
+	for _, eku := range p.ExtKeyUsages {
+		v, ok := extKeyUsageNames[eku]
+		if !ok {
+			return nil, fmt.Errorf("ExtKeyUsages: invalid value %q", eku)
+		}
+		out.extKeyUsage = append(out.extKeyUsage, v)
+	}
+	if p.LabelPattern != "" {
+		re, err := regexp.Compile("^(?:" + p.LabelPattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("LabelPattern: %w", err)
+		}
+		out.labelPattern = re
+	}
+	if p.MaxLifetime < 0 {
+		return nil, errors.New("MaxLifetime: must not be negative")
+	}
+	if out.MaxLifetime == 0 {
+		out.MaxLifetime = issuedCertsLifetime
+	}
+	return out, nil
+}
+
+func compileProfiles(profiles []Profile) ([]*profile, error) {
+	out := make([]*profile, 0, len(profiles))
+	seen := make(map[string]bool)
+	for i, p := range profiles {
+		cp, err := compileProfile(p)
+		if err != nil {
+			return nil, fmt.Errorf("profile[%d].%w", i, err)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("profile[%d].Name: duplicate name %q", i, p.Name)
+		}
+		seen[p.Name] = true
+		out = append(out, cp)
+	}
+	return out, nil
+}
+
+// allowed returns true if the user can use this profile.
+func (p *profile) allowed(email string, isAdmin bool) bool {
+	if p.AdminsOnly && !isAdmin {
+		return false
+	}
+	if len(p.Users) == 0 {
+		return true
+	}
+	if slices.Contains(p.Users, email) {
+		return true
+	}
+	if at := strings.LastIndex(email, "@"); at >= 0 && slices.Contains(p.Users, email[at:]) {
+		return true
+	}
+	return false
+}
+
+// availableProfiles returns the profiles that the user can use.
+func (m *PKIManager) availableProfiles(email string) []*profile {
+	isAdmin := slices.Contains(m.opts.Admins, email)
+	var out []*profile
+	for _, p := range m.profiles {
+		if p.allowed(email, isAdmin) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// selectProfile returns the profile with this name, or the first available
+// profile when name is empty. It returns nil when no profiles are configured.
+func (m *PKIManager) selectProfile(name, email string) (*profile, error) {
+	if len(m.profiles) == 0 {
+		if name != "" {
+			return nil, fmt.Errorf("%w: %q", errProfileDenied, name)
+		}
+		return nil, nil
+	}
+	for _, p := range m.availableProfiles(email) {
+		if name == "" || p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", errProfileDenied, name)
+}
+
+// check verifies that the certificate request conforms to the profile, and
+// returns the lifetime to use.
+func (p *profile) check(cr *x509.CertificateRequest, label string, lifetime time.Duration) (time.Duration, error) {
+	if lifetime == 0 {
+		lifetime = p.MaxLifetime
+	}
+	if lifetime < 0 || lifetime > p.MaxLifetime {
+		return 0, fmt.Errorf("lifetime %s exceeds the maximum of %s", lifetime, p.MaxLifetime)
+	}
+	if p.labelPattern != nil && !p.labelPattern.MatchString(label) {
+		return 0, fmt.Errorf("label %q is not allowed", label)
+	}
+	if len(cr.IPAddresses) > 0 || len(cr.URIs) > 0 {
+		return 0, errors.New("only DNS names are allowed")
+	}
+	for _, n := range cr.DNSNames {
+		if len(p.DNSNames) == 0 || !domainAllowed(p.DNSNames, n) {
+			return 0, fmt.Errorf("DNS name %q is not allowed", n)
+		}
+	}
+	return lifetime, nil
+}
+
+// issueProfileCertificate issues a new certificate using the key usages of
+// the profile. The request must already have been checked.
+func (m *PKIManager) issueProfileCertificate(cr *x509.CertificateRequest, p *profile, lifetime time.Duration) ([]byte, error) {
+	templ, err := m.certificateTemplate(cr, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	if p.keyUsage != 0 {
+		templ.KeyUsage = p.keyUsage
+	}
+	if len(p.extKeyUsage) > 0 {
+		templ.ExtKeyUsage = p.extKeyUsage
+	}
+	return m.signCertificate(templ, nil)
+}
@@ -0,0 +1,190 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestProfiles(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	m, err := New(Options{
+		Name:   "profile-test",
+		Store:  storage.New(t.TempDir(), mk),
+		Admins: []string{"admin@example.com"},
+		Profiles: []Profile{
+			{
+				Name:         "client",
+				ExtKeyUsages: []string{"clientAuth"},
+				LabelPattern: "[a-z]+",
+				MaxLifetime:  24 * time.Hour,
+			},
+			{
+				Name:         "server",
+				KeyUsages:    []string{"digitalSignature", "keyEncipherment"},
+				ExtKeyUsages: []string{"serverAuth"},
+				DNSNames:     []string{"*.example.com"},
+				MaxLifetime:  365 * 24 * time.Hour,
+				Users:        []string{"@example.com"},
+			},
+			{
+				Name:       "admin",
+				AdminsOnly: true,
+			},
+		},
+		ClaimsFromCtx: func(ctx context.Context) jwt.MapClaims {
+			c, _ := ctx.Value(claimsCtxKey{}).(jwt.MapClaims)
+			return c
+		},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	request := func(email, params, label string, names ...string) (string, *x509.Certificate) {
+		t.Helper()
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("ecdsa.GenerateKey: %v", err)
+		}
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: label},
+			DNSNames: names,
+		}, key)
+		if err != nil {
+			t.Fatalf("x509.CreateCertificateRequest: %v", err)
+		}
+		body := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})
+		req := httptest.NewRequest(http.MethodPost, "/pki?get=requestCert"+params, strings.NewReader(string(body)))
+		req.Header.Set("content-type", "application/x-pem-file")
+		req.Header.Set("x-csrf-check", "1")
+		req = req.WithContext(context.WithValue(req.Context(), claimsCtxKey{}, jwt.MapClaims{"email": email}))
+		w := httptest.NewRecorder()
+		m.ServeCertificateManagement(w, req)
+		if w.Code != http.StatusOK {
+			return http.StatusText(w.Code), nil
+		}
+		var resp struct {
+			Result string `json:"result"`
+			Cert   string `json:"cert"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("json: %v", err)
+		}
+		if resp.Result != "ok" {
+			return resp.Result, nil
+		}
+		block, _ := pem.Decode([]byte(resp.Cert))
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("x509.ParseCertificate: %v", err)
+		}
+		return resp.Result, cert
+	}
+
+	// Default profile is the first one available.
+	result, cert := request("bob@example.org", "", "laptop")
+	if result != "ok" {
+		t.Fatalf("result = %q", result)
+	}
+	if got, want := cert.NotAfter.Sub(cert.NotBefore), 24*time.Hour; got != want {
+		t.Errorf("lifetime = %v, want %v", got, want)
+	}
+	if got, want := cert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}; !slices.Equal(got, want) {
+		t.Errorf("ExtKeyUsage = %v, want %v", got, want)
+	}
+
+	for _, tc := range []struct {
+		email, params, label string
+		names                []string
+		want                 string
+	}{
+		{"bob@example.org", "&profile=client&lifetime=48h", "laptop", nil, "lifetime 48h0m0s exceeds the maximum of 24h0m0s"},
+		{"bob@example.org", "&profile=client", "Laptop", nil, `label "Laptop" is not allowed`},
+		{"bob@example.org", "&profile=client", "laptop", []string{"www.example.com"}, `DNS name "www.example.com" is not allowed`},
+		{"bob@example.org", "&profile=server", "", []string{"www.example.com"}, "permission denied"},
+		{"bob@example.com", "&profile=server", "", []string{"www.example.org"}, `DNS name "www.example.org" is not allowed`},
+		{"bob@example.com", "&profile=admin", "", nil, "permission denied"},
+		{"bob@example.com", "&profile=foo", "", nil, "permission denied"},
+		{"bob@example.com", "&profile=server&lifetime=foo", "", nil, "Bad Request"},
+		{"bob@example.com", "&profile=server&lifetime=720h", "", []string{"www.example.com"}, "ok"},
+		{"admin@example.com", "&profile=admin", "", nil, "ok"},
+	} {
+		if got, _ := request(tc.email, tc.params, tc.label, tc.names...); got != tc.want {
+			t.Errorf("request(%q, %q, %q, %v) = %q, want %q", tc.email, tc.params, tc.label, tc.names, got, tc.want)
+		}
+	}
+
+	_, cert = request("bob@example.com", "&profile=server&lifetime=720h", "", "www.example.com")
+	if cert == nil {
+		t.Fatal("server cert not issued")
+	}
+	if got, want := cert.NotAfter.Sub(cert.NotBefore), 720*time.Hour; got != want {
+		t.Errorf("lifetime = %v, want %v", got, want)
+	}
+	if got, want := cert.KeyUsage, x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment; got != want {
+		t.Errorf("KeyUsage = %v, want %v", got, want)
+	}
+	if got, want := cert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}; !slices.Equal(got, want) {
+		t.Errorf("ExtKeyUsage = %v, want %v", got, want)
+	}
+}
+
+func TestValidateProfile(t *testing.T) {
+	for _, tc := range []struct {
+		p       Profile
+		wantErr bool
+	}{
+		{Profile{Name: "ok", KeyUsages: []string{"keyAgreement"}, ExtKeyUsages: []string{"codeSigning"}}, false},
+		{Profile{}, true},
+		{Profile{Name: "x", KeyUsages: []string{"foo"}}, true},
+		{Profile{Name: "x", ExtKeyUsages: []string{"foo"}}, true},
+		{Profile{Name: "x", LabelPattern: "("}, true},
+		{Profile{Name: "x", MaxLifetime: -time.Hour}, true},
+	} {
+		if err := ValidateProfile(tc.p); (err != nil) != tc.wantErr {
+			t.Errorf("ValidateProfile(%+v) = %v, wantErr %v", tc.p, err, tc.wantErr)
+		}
+	}
+}
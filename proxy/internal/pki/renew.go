@@ -0,0 +1,129 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"time"
+)
+
+// RenewalOptions are used to configure the certificate renewal endpoint of a
+// PKI manager.
+type RenewalOptions struct {
+	// RenewBefore is how long before expiration a certificate can be
+	// renewed. The default is one third of the certificate's lifetime.
+	RenewBefore time.Duration
+}
+
+// renewalAllowed returns true if cert can be renewed at time now.
+func renewalAllowed(cert *x509.Certificate, renewBefore time.Duration, now time.Time) bool {
+	if renewBefore <= 0 {
+		renewBefore = cert.NotAfter.Sub(cert.NotBefore) / 3
+	}
+	return !now.Before(cert.NotAfter.Add(-renewBefore))
+}
+
+// ServeRenew lets the holder of a valid certificate issued by this CA get a
+// new certificate when the current one is about to expire. The client must
+// authenticate with the current certificate, and send a PEM-encoded
+// certificate request in a POST request. The new certificate has the same
+// subject, subject alternative names, key usages, and lifetime as the current
+// one. The new key can be the same as the current one, or a new key.
+func (m *PKIManager) ServeRenew(w http.ResponseWriter, req *http.Request) {
+	if m.opts.Renewal == nil {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := req.Header.Get("content-type"); ct != "application/x-pem-file" {
+		m.opts.Logger.Errorf("ERR content-type: %v", ct)
+		http.Error(w, "invalid content-type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	current := req.TLS.PeerCertificates[0]
+	if err := m.checkIssuedCert(current); err != nil {
+		m.opts.Logger.Errorf("ERR renew %q: %v", current.Subject, err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if !renewalAllowed(current, m.opts.Renewal.RenewBefore, time.Now()) {
+		http.Error(w, "certificate is not due for renewal", http.StatusForbidden)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, 102400))
+	if err != nil {
+		m.opts.Logger.Errorf("ERR body: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	block, _ := pem.Decode(body)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	cr, err := m.ValidateCertificateRequest(block.Bytes)
+	if err != nil {
+		m.opts.Logger.Errorf("ERR ValidateCertificateRequest: %v", err)
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	templ, err := m.certificateTemplate(&x509.CertificateRequest{
+		PublicKeyAlgorithm: cr.PublicKeyAlgorithm,
+		PublicKey:          cr.PublicKey,
+		Subject:            current.Subject,
+		DNSNames:           current.DNSNames,
+		EmailAddresses:     current.EmailAddresses,
+		IPAddresses:        current.IPAddresses,
+		URIs:               current.URIs,
+	}, current.NotAfter.Sub(current.NotBefore))
+	if err != nil {
+		m.opts.Logger.Errorf("ERR certificateTemplate: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	templ.KeyUsage = current.KeyUsage
+	templ.ExtKeyUsage = current.ExtKeyUsage
+	raw, err := m.signCertificate(templ, nil)
+	if err != nil {
+		m.opts.Logger.Errorf("ERR signCertificate: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	m.recordAuditRaw(AuditActionRenew, current.Subject.String(), "renew", "", raw)
+	if m.opts.EventRecorder != nil {
+		m.opts.EventRecorder.Record("pki certificate renewed")
+	}
+	w.Header().Set("content-type", "application/x-pem-file")
+	w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw}))
+}
@@ -0,0 +1,166 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+func TestRenew(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	m, err := New(Options{
+		Name:    "renew-test",
+		Store:   storage.New(t.TempDir(), mk),
+		Renewal: &RenewalOptions{},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	newCSR := func() []byte {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("ecdsa.GenerateKey: %v", err)
+		}
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: "ignored"},
+		}, key)
+		if err != nil {
+			t.Fatalf("x509.CreateCertificateRequest: %v", err)
+		}
+		return csr
+	}
+	in, err := x509.ParseCertificateRequest(newCSR())
+	if err != nil {
+		t.Fatalf("x509.ParseCertificateRequest: %v", err)
+	}
+	raw, err := m.issueCertificate(&x509.CertificateRequest{
+		PublicKeyAlgorithm: in.PublicKeyAlgorithm,
+		PublicKey:          in.PublicKey,
+		Subject:            pkix.Name{CommonName: "server"},
+		DNSNames:           []string{"server.example.com"},
+	}, 3*time.Hour)
+	if err != nil {
+		t.Fatalf("issueCertificate: %v", err)
+	}
+	current, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+
+	renew := func(cert *x509.Certificate) (int, *x509.Certificate) {
+		t.Helper()
+		body := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: newCSR()})
+		req := httptest.NewRequest(http.MethodPost, "/renew", strings.NewReader(string(body)))
+		req.Header.Set("content-type", "application/x-pem-file")
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		}
+		w := httptest.NewRecorder()
+		m.ServeRenew(w, req)
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		block, _ := pem.Decode(w.Body.Bytes())
+		if block == nil {
+			t.Fatal("no pem block")
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("x509.ParseCertificate: %v", err)
+		}
+		return w.Code, c
+	}
+
+	if code, _ := renew(nil); code != http.StatusUnauthorized {
+		t.Errorf("code = %d, want %d", code, http.StatusUnauthorized)
+	}
+	// The certificate is not due for renewal yet.
+	if code, _ := renew(current); code != http.StatusForbidden {
+		t.Errorf("code = %d, want %d", code, http.StatusForbidden)
+	}
+
+	m.opts.Renewal.RenewBefore = 24 * time.Hour
+	code, renewed := renew(current)
+	if code != http.StatusOK {
+		t.Fatalf("code = %d, want %d", code, http.StatusOK)
+	}
+	if got, want := renewed.Subject.CommonName, "server"; got != want {
+		t.Errorf("CommonName = %q, want %q", got, want)
+	}
+	if got, want := renewed.DNSNames, current.DNSNames; !slices.Equal(got, want) {
+		t.Errorf("DNSNames = %v, want %v", got, want)
+	}
+	if got, want := renewed.ExtKeyUsage, current.ExtKeyUsage; !slices.Equal(got, want) {
+		t.Errorf("ExtKeyUsage = %v, want %v", got, want)
+	}
+	if got, want := renewed.NotAfter.Sub(renewed.NotBefore), 3*time.Hour; got != want {
+		t.Errorf("lifetime = %v, want %v", got, want)
+	}
+	if renewed.SerialNumber.Cmp(current.SerialNumber) == 0 {
+		t.Error("renewed certificate has the same serial number")
+	}
+
+	if err := m.RevokeCertificate(current.SerialNumber, RevokeReasonSuperseded); err != nil {
+		t.Fatalf("RevokeCertificate: %v", err)
+	}
+	if code, _ := renew(current); code != http.StatusForbidden {
+		t.Errorf("code = %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestRenewalAllowed(t *testing.T) {
+	now := time.Now()
+	cert := &x509.Certificate{
+		NotBefore: now.Add(-59 * time.Hour),
+		NotAfter:  now.Add(31 * time.Hour),
+	}
+	if renewalAllowed(cert, 0, now) {
+		t.Error("renewalAllowed(0) = true")
+	}
+	if !renewalAllowed(cert, 0, now.Add(time.Hour)) {
+		t.Error("renewalAllowed(0) = false")
+	}
+	if !renewalAllowed(cert, 48*time.Hour, now) {
+		t.Error("renewalAllowed(48h) = false")
+	}
+}
@@ -0,0 +1,565 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/smallstep/pkcs7"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/pki/keys"
+)
+
+const (
+	scepRALifetime            = 30 * 24 * time.Hour
+	scepDefaultCertLifetime   = 365 * 24 * time.Hour
+	scepDefaultChallengeLife  = 24 * time.Hour
+	scepMaxRequestSize        = 1 << 20
+	scepMessageTypeCertRep    = "3"
+	scepMessageTypeRenewalReq = "17"
+	scepMessageTypePKCSReq    = "19"
+	scepStatusSuccess         = "0"
+	scepStatusFailure         = "2"
+	scepFailBadMessageCheck   = "1"
+	scepFailBadRequest        = "2"
+)
+
+// https://www.rfc-editor.org/rfc/rfc8894.html#section-3.2.1
+var (
+	oidSCEPMessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidSCEPPKIStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidSCEPFailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidSCEPSenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidSCEPRecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidSCEPTransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+
+	oidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+)
+
+func init() {
+	// SCEP clients that advertise the AES capability must support
+	// AES-128-CBC. The default, DES-CBC, is too weak.
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES128CBC
+}
+
+// SCEPOptions are used to configure the Simple Certificate Enrollment
+// Protocol (SCEP) responder of a PKI manager.
+// https://www.rfc-editor.org/rfc/rfc8894.html
+type SCEPOptions struct {
+	// ChallengePassword is a static challenge password that all the
+	// clients can use.
+	ChallengePassword string
+	// ChallengeLifetime is the lifetime of the one-time challenge
+	// passwords. The default is 24 hours.
+	ChallengeLifetime time.Duration
+	// CertificateLifetime is the lifetime of the issued certificates.
+	// The default is 365 days.
+	CertificateLifetime time.Duration
+	// AllowedDomains restricts which domain names can be in the
+	// certificates, e.g. "example.com" or "*.example.com". When it is
+	// empty, domain names aren't allowed.
+	AllowedDomains []string
+	// AllowedIPs are the IP prefixes that can be in the certificates. When
+	// it is empty, IP addresses aren't allowed.
+	AllowedIPs []netip.Prefix
+}
+
+type scepData struct {
+	// Challenges maps the SHA256 hashes of the one-time challenge
+	// passwords to their expiration times.
+	Challenges map[string]time.Time
+}
+
+func (m *PKIManager) scepFile() string {
+	return m.pkiFile + "-scep"
+}
+
+// ServeSCEP implements the SCEP responder.
+// https://www.rfc-editor.org/rfc/rfc8894.html#section-4
+func (m *PKIManager) ServeSCEP(w http.ResponseWriter, req *http.Request) {
+	if m.opts.SCEP == nil {
+		http.NotFound(w, req)
+		return
+	}
+	switch op := req.URL.Query().Get("operation"); op {
+	case "GetCACaps":
+		w.Header().Set("content-type", "text/plain")
+		io.WriteString(w, "AES\nPOSTPKIOperation\nRenewal\nSCEPStandard\nSHA-256\n")
+	case "GetCACert":
+		raCert, _, err := m.scepRA()
+		if err != nil {
+			m.opts.Logger.Errorf("ERR scepRA: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		caCert, err := m.CACert()
+		if err != nil {
+			m.opts.Logger.Errorf("ERR CACert: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		p7, err := pkcs7.DegenerateCertificate(append(append([]byte(nil), raCert.Raw...), caCert.Raw...))
+		if err != nil {
+			m.opts.Logger.Errorf("ERR DegenerateCertificate: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/x-x509-ca-ra-cert")
+		w.Write(p7)
+	case "PKIOperation":
+		var msg []byte
+		switch req.Method {
+		case http.MethodGet:
+			var err error
+			if msg, err = base64.StdEncoding.DecodeString(req.URL.Query().Get("message")); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+		case http.MethodPost:
+			var err error
+			if msg, err = io.ReadAll(io.LimitReader(req.Body, scepMaxRequestSize)); err != nil {
+				m.opts.Logger.Errorf("ERR body: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		resp, err := m.scepPKIOperation(msg)
+		if err != nil {
+			m.opts.Logger.Errorf("ERR SCEP PKIOperation: %v", err)
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("content-type", "application/x-pki-message")
+		w.Write(resp)
+	default:
+		http.Error(w, "invalid operation", http.StatusBadRequest)
+	}
+}
+
+// ServeSCEPChallenge returns a new one-time challenge password. This endpoint
+// should be on a backend with restricted access, e.g. only reachable by the
+// device management server.
+func (m *PKIManager) ServeSCEPChallenge(w http.ResponseWriter, req *http.Request) {
+	if m.opts.SCEP == nil {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	challenge, expires, err := m.NewSCEPChallenge()
+	if err != nil {
+		m.opts.Logger.Errorf("ERR NewSCEPChallenge: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	json.NewEncoder(w).Encode(map[string]any{
+		"challenge": challenge,
+		"expires":   expires.Unix(),
+	})
+}
+
+// NewSCEPChallenge creates a new one-time challenge password.
+func (m *PKIManager) NewSCEPChallenge() (challenge string, expires time.Time, retErr error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", time.Time{}, err
+	}
+	challenge = hex.EncodeToString(b[:])
+	lifetime := m.opts.SCEP.ChallengeLifetime
+	if lifetime <= 0 {
+		lifetime = scepDefaultChallengeLife
+	}
+	now := time.Now().UTC()
+	expires = now.Add(lifetime)
+
+	var data scepData
+	commit, err := m.opts.Store.OpenForUpdate(m.scepFile(), &data)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer commit(false, &retErr)
+	if data.Challenges == nil {
+		data.Challenges = make(map[string]time.Time)
+	}
+	for k, v := range data.Challenges {
+		if now.After(v) {
+			delete(data.Challenges, k)
+		}
+	}
+	data.Challenges[hashChallenge(challenge)] = expires
+	if err := commit(true, nil); err != nil {
+		return "", time.Time{}, err
+	}
+	return challenge, expires, nil
+}
+
+func hashChallenge(c string) string {
+	h := sha256.Sum256([]byte(c))
+	return hex.EncodeToString(h[:])
+}
+
+// useSCEPChallenge returns true if the challenge password is either the
+// static password or a valid one-time password. One-time passwords can only
+// be used once.
+func (m *PKIManager) useSCEPChallenge(challenge string) (ok bool, retErr error) {
+	if challenge == "" {
+		return false, nil
+	}
+	if p := m.opts.SCEP.ChallengePassword; p != "" && subtle.ConstantTimeCompare([]byte(p), []byte(challenge)) == 1 {
+		return true, nil
+	}
+	var data scepData
+	commit, err := m.opts.Store.OpenForUpdate(m.scepFile(), &data)
+	if err != nil {
+		return false, err
+	}
+	defer commit(false, &retErr)
+	h := hashChallenge(challenge)
+	expires, exists := data.Challenges[h]
+	if !exists {
+		return false, nil
+	}
+	delete(data.Challenges, h)
+	if err := commit(true, nil); err != nil {
+		return false, err
+	}
+	return time.Now().Before(expires), nil
+}
+
+// scepRA returns the certificate and key of the SCEP Registration Authority.
+// SCEP requires an RSA key to decrypt the requests, regardless of the CA's
+// key type. The RA key is never stored in the TPM because it is used for
+// decryption.
+func (m *PKIManager) scepRA() (*x509.Certificate, crypto.PrivateKey, error) {
+	if err := m.maybeRotateSCEPCert(); err != nil {
+		return nil, nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.db == nil || m.db.SCEPCert == nil {
+		return nil, nil, errNotFound
+	}
+	cert, err := m.db.SCEPCert.parse()
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(m.db.SCEPKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func (m *PKIManager) maybeRotateSCEPCert() error {
+	m.mu.Lock()
+	if m.db == nil {
+		m.mu.Unlock()
+		return errors.New("no ca")
+	}
+	now := time.Now().UTC()
+	if m.db.SCEPCert != nil {
+		c, err := m.db.SCEPCert.parse()
+		if err == nil && c.NotBefore.Add(c.NotAfter.Sub(c.NotBefore)/2).After(now) {
+			m.mu.Unlock()
+			return nil
+		}
+	}
+	caCert, err := m.db.CACert.parse()
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	raKey, err := keys.GenerateKey("rsa-2048")
+	if err != nil {
+		return err
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(raKey)
+	if err != nil {
+		return fmt.Errorf("x509.MarshalPKCS8PrivateKey: %v", err)
+	}
+	sn, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 160))
+	if err != nil {
+		return err
+	}
+	templ := &x509.Certificate{
+		SerialNumber:          sn,
+		PublicKey:             raKey.(crypto.Signer).Public(),
+		Issuer:                caCert.Subject,
+		Subject:               pkix.Name{CommonName: m.opts.Name + " SCEP RA"},
+		NotBefore:             now,
+		NotAfter:              now.Add(scepRALifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IssuingCertificateURL: m.opts.IssuingCertificateURL,
+		CRLDistributionPoints: m.opts.CRLDistributionPoints,
+		OCSPServer:            m.opts.OCSPServer,
+	}
+	raw, err := m.signCertificate(templ, func(c *certificate) error {
+		m.db.SCEPKey = keyBytes
+		m.db.SCEPCert = c
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.recordAuditRaw(AuditActionIssue, "system", "internal", "", raw)
+	return nil
+}
+
+// scepPKIOperation handles a PKIOperation message and returns the CertRep
+// response.
+// https://www.rfc-editor.org/rfc/rfc8894.html#section-3.3
+func (m *PKIManager) scepPKIOperation(msg []byte) ([]byte, error) {
+	p7, err := pkcs7.Parse(msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := p7.Verify(); err != nil {
+		return nil, err
+	}
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return nil, errors.New("no signer")
+	}
+	var msgType, transactionID string
+	var senderNonce []byte
+	if err := errors.Join(
+		p7.UnmarshalSignedAttribute(oidSCEPMessageType, &msgType),
+		p7.UnmarshalSignedAttribute(oidSCEPTransactionID, &transactionID),
+		p7.UnmarshalSignedAttribute(oidSCEPSenderNonce, &senderNonce),
+	); err != nil {
+		return nil, err
+	}
+	raCert, raKey, err := m.scepRA()
+	if err != nil {
+		return nil, err
+	}
+	rep := &scepCertRep{
+		raCert:        raCert,
+		raKey:         raKey,
+		recipient:     signer,
+		transactionID: transactionID,
+		senderNonce:   senderNonce,
+	}
+
+	cr, failInfo, err := m.scepCertificateRequest(p7, msgType, signer, raCert, raKey)
+	if err != nil {
+		m.opts.Logger.Errorf("ERR SCEP %s [%s]: %v", msgType, signer.Subject, err)
+		return rep.failure(failInfo)
+	}
+	lifetime := m.opts.SCEP.CertificateLifetime
+	if lifetime <= 0 {
+		lifetime = scepDefaultCertLifetime
+	}
+	raw, err := m.issueCertificate(cr, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	action := AuditActionIssue
+	if msgType == scepMessageTypeRenewalReq {
+		action = AuditActionRenew
+	}
+	m.recordAuditRaw(action, signer.Subject.String(), "scep", "", raw)
+	if m.opts.EventRecorder != nil {
+		m.opts.EventRecorder.Record("pki scep certificate issued")
+	}
+	return rep.success(raw)
+}
+
+// scepCertificateRequest decrypts and validates the certificate request.
+func (m *PKIManager) scepCertificateRequest(p7 *pkcs7.PKCS7, msgType string, signer, raCert *x509.Certificate, raKey crypto.PrivateKey) (*x509.CertificateRequest, string, error) {
+	if msgType != scepMessageTypePKCSReq && msgType != scepMessageTypeRenewalReq {
+		return nil, scepFailBadRequest, fmt.Errorf("unsupported message type %q", msgType)
+	}
+	env, err := pkcs7.Parse(p7.Content)
+	if err != nil {
+		return nil, scepFailBadMessageCheck, err
+	}
+	der, err := env.Decrypt(raCert, raKey)
+	if err != nil {
+		return nil, scepFailBadMessageCheck, err
+	}
+	in, err := m.ValidateCertificateRequest(der)
+	if err != nil {
+		return nil, scepFailBadRequest, err
+	}
+
+	if msgType == scepMessageTypeRenewalReq {
+		if err := m.checkIssuedCert(signer); err != nil {
+			return nil, scepFailBadRequest, fmt.Errorf("renewal: %w", err)
+		}
+		return &x509.CertificateRequest{
+			PublicKeyAlgorithm: in.PublicKeyAlgorithm,
+			PublicKey:          in.PublicKey,
+			Subject:            signer.Subject,
+			DNSNames:           signer.DNSNames,
+			EmailAddresses:     signer.EmailAddresses,
+			IPAddresses:        signer.IPAddresses,
+			URIs:               signer.URIs,
+		}, "", nil
+	}
+
+	if err := m.checkSCEPNames(in); err != nil {
+		return nil, scepFailBadRequest, err
+	}
+	challenge, err := challengePassword(in)
+	if err != nil {
+		return nil, scepFailBadRequest, err
+	}
+	ok, err := m.useSCEPChallenge(challenge)
+	if err != nil {
+		return nil, scepFailBadRequest, err
+	}
+	if !ok {
+		return nil, scepFailBadRequest, errors.New("invalid challenge password")
+	}
+	return &x509.CertificateRequest{
+		PublicKeyAlgorithm: in.PublicKeyAlgorithm,
+		PublicKey:          in.PublicKey,
+		Subject:            in.Subject,
+		DNSNames:           in.DNSNames,
+		IPAddresses:        in.IPAddresses,
+	}, "", nil
+}
+
+// checkSCEPNames verifies that the subject alternative names of a certificate
+// request are allowed.
+func (m *PKIManager) checkSCEPNames(cr *x509.CertificateRequest) error {
+	if len(cr.EmailAddresses) > 0 || len(cr.URIs) > 0 {
+		return errors.New("unsupported subject alternative names")
+	}
+	for _, n := range cr.DNSNames {
+		if len(m.opts.SCEP.AllowedDomains) == 0 || !domainAllowed(m.opts.SCEP.AllowedDomains, n) {
+			return fmt.Errorf("%q not allowed", n)
+		}
+	}
+	for _, ip := range cr.IPAddresses {
+		if !ipAllowed(m.opts.SCEP.AllowedIPs, ip) {
+			return fmt.Errorf("%s not allowed", ip)
+		}
+	}
+	return nil
+}
+
+// challengePassword extracts the challengePassword attribute from a
+// certificate request.
+// https://www.rfc-editor.org/rfc/rfc2985.html#section-5.4.1
+func challengePassword(cr *x509.CertificateRequest) (string, error) {
+	var tbs struct {
+		Version    int
+		Subject    asn1.RawValue
+		PublicKey  asn1.RawValue
+		Attributes []struct {
+			Type   asn1.ObjectIdentifier
+			Values []asn1.RawValue `asn1:"set"`
+		} `asn1:"tag:0,optional"`
+	}
+	if _, err := asn1.Unmarshal(cr.RawTBSCertificateRequest, &tbs); err != nil {
+		return "", err
+	}
+	for _, attr := range tbs.Attributes {
+		if !attr.Type.Equal(oidChallengePassword) || len(attr.Values) == 0 {
+			continue
+		}
+		var pw string
+		if _, err := asn1.Unmarshal(attr.Values[0].FullBytes, &pw); err != nil {
+			return "", fmt.Errorf("challengePassword: %w", err)
+		}
+		return pw, nil
+	}
+	return "", nil
+}
+
+type scepCertRep struct {
+	raCert        *x509.Certificate
+	raKey         crypto.PrivateKey
+	recipient     *x509.Certificate
+	transactionID string
+	senderNonce   []byte
+}
+
+func (r *scepCertRep) success(cert []byte) ([]byte, error) {
+	deg, err := pkcs7.DegenerateCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+	env, err := pkcs7.Encrypt(deg, []*x509.Certificate{r.recipient})
+	if err != nil {
+		return nil, err
+	}
+	return r.sign(env, pkcs7.Attribute{Type: oidSCEPPKIStatus, Value: scepStatusSuccess})
+}
+
+func (r *scepCertRep) failure(failInfo string) ([]byte, error) {
+	return r.sign(nil,
+		pkcs7.Attribute{Type: oidSCEPPKIStatus, Value: scepStatusFailure},
+		pkcs7.Attribute{Type: oidSCEPFailInfo, Value: failInfo},
+	)
+}
+
+func (r *scepCertRep) sign(content []byte, attrs ...pkcs7.Attribute) ([]byte, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sd, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		return nil, err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	attrs = append(attrs,
+		pkcs7.Attribute{Type: oidSCEPMessageType, Value: scepMessageTypeCertRep},
+		pkcs7.Attribute{Type: oidSCEPTransactionID, Value: r.transactionID},
+		pkcs7.Attribute{Type: oidSCEPSenderNonce, Value: nonce},
+		pkcs7.Attribute{Type: oidSCEPRecipientNonce, Value: r.senderNonce},
+	)
+	if err := sd.AddSigner(r.raCert, r.raKey, pkcs7.SignerInfoConfig{ExtraSignedAttributes: attrs}); err != nil {
+		return nil, err
+	}
+	return sd.Finish()
+}
@@ -0,0 +1,371 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	storagecrypto "github.com/c2FmZQ/storage/crypto"
+	"github.com/smallstep/pkcs7"
+)
+
+type scepTestClient struct {
+	t      *testing.T
+	m      *PKIManager
+	raCert *x509.Certificate
+}
+
+func newSCEPTest(t *testing.T) (*PKIManager, *scepTestClient) {
+	t.Helper()
+	mk, err := storagecrypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	m, err := New(Options{
+		Name:  "scep-test",
+		Store: storage.New(t.TempDir(), mk),
+		SCEP: &SCEPOptions{
+			ChallengePassword: "static-secret",
+			AllowedDomains:    []string{"*.example.com"},
+			AllowedIPs:        []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	c := &scepTestClient{t: t, m: m}
+
+	caps := c.do(http.MethodGet, "/scep?operation=GetCACaps", nil)
+	if !bytes.Contains(caps, []byte("AES\n")) || !bytes.Contains(caps, []byte("POSTPKIOperation\n")) {
+		t.Errorf("GetCACaps = %q", caps)
+	}
+	p7, err := pkcs7.Parse(c.do(http.MethodGet, "/scep?operation=GetCACert", nil))
+	if err != nil {
+		t.Fatalf("pkcs7.Parse: %v", err)
+	}
+	if got, want := len(p7.Certificates), 2; got != want {
+		t.Fatalf("GetCACert returned %d certs, want %d", got, want)
+	}
+	c.raCert = p7.Certificates[0]
+	caCert, err := m.CACert()
+	if err != nil {
+		t.Fatalf("CACert: %v", err)
+	}
+	if err := c.raCert.CheckSignatureFrom(caCert); err != nil {
+		t.Fatalf("RA cert: %v", err)
+	}
+	return m, c
+}
+
+func (c *scepTestClient) do(method, path string, body []byte) []byte {
+	c.t.Helper()
+	w := httptest.NewRecorder()
+	c.m.ServeSCEP(w, httptest.NewRequest(method, path, bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		c.t.Fatalf("%s %s: %d %s", method, path, w.Code, w.Body)
+	}
+	return w.Body.Bytes()
+}
+
+// enroll sends a PKIOperation request and returns the issued certificate, or
+// nil if the request failed.
+func (c *scepTestClient) enroll(msgType string, key *rsa.PrivateKey, signer *x509.Certificate, signerKey crypto.PrivateKey, challenge string, names ...string) *x509.Certificate {
+	c.t.Helper()
+	env, err := pkcs7.Encrypt(newSCEPCSR(c.t, key, challenge, names...), []*x509.Certificate{c.raCert})
+	if err != nil {
+		c.t.Fatalf("pkcs7.Encrypt: %v", err)
+	}
+	sd, err := pkcs7.NewSignedData(env)
+	if err != nil {
+		c.t.Fatalf("pkcs7.NewSignedData: %v", err)
+	}
+	nonce := []byte("0123456789abcdef")
+	if err := sd.AddSigner(signer, signerKey, pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{
+			{Type: oidSCEPMessageType, Value: msgType},
+			{Type: oidSCEPTransactionID, Value: "txid"},
+			{Type: oidSCEPSenderNonce, Value: nonce},
+		},
+	}); err != nil {
+		c.t.Fatalf("AddSigner: %v", err)
+	}
+	msg, err := sd.Finish()
+	if err != nil {
+		c.t.Fatalf("Finish: %v", err)
+	}
+
+	p7, err := pkcs7.Parse(c.do(http.MethodPost, "/scep?operation=PKIOperation", msg))
+	if err != nil {
+		c.t.Fatalf("pkcs7.Parse: %v", err)
+	}
+	if err := p7.Verify(); err != nil {
+		c.t.Fatalf("Verify: %v", err)
+	}
+	var status, txid string
+	var recipientNonce []byte
+	if err := p7.UnmarshalSignedAttribute(oidSCEPPKIStatus, &status); err != nil {
+		c.t.Fatalf("pkiStatus: %v", err)
+	}
+	if err := p7.UnmarshalSignedAttribute(oidSCEPTransactionID, &txid); err != nil || txid != "txid" {
+		c.t.Errorf("transactionID = %q, %v", txid, err)
+	}
+	if err := p7.UnmarshalSignedAttribute(oidSCEPRecipientNonce, &recipientNonce); err != nil || !bytes.Equal(recipientNonce, nonce) {
+		c.t.Errorf("recipientNonce = %q, %v", recipientNonce, err)
+	}
+	if status != scepStatusSuccess {
+		return nil
+	}
+	inner, err := pkcs7.Parse(p7.Content)
+	if err != nil {
+		c.t.Fatalf("pkcs7.Parse: %v", err)
+	}
+	deg, err := inner.Decrypt(signer, signerKey)
+	if err != nil {
+		c.t.Fatalf("Decrypt: %v", err)
+	}
+	certs, err := pkcs7.Parse(deg)
+	if err != nil {
+		c.t.Fatalf("pkcs7.Parse: %v", err)
+	}
+	if len(certs.Certificates) != 1 {
+		c.t.Fatalf("got %d certs", len(certs.Certificates))
+	}
+	return certs.Certificates[0]
+}
+
+// newSCEPCSR returns a certificate request with a challenge password. The
+// names are added as DNS names or IP addresses.
+func newSCEPCSR(t *testing.T, key *rsa.PrivateKey, challenge string, names ...string) []byte {
+	t.Helper()
+	spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %v", err)
+	}
+	subject, err := asn1.Marshal(pkix.Name{CommonName: "device-1234"}.ToRDNSequence())
+	if err != nil {
+		t.Fatalf("asn1.Marshal: %v", err)
+	}
+	pw, err := asn1.MarshalWithParams(challenge, "printable")
+	if err != nil {
+		t.Fatalf("asn1.Marshal: %v", err)
+	}
+	type attribute struct {
+		Type   asn1.ObjectIdentifier
+		Values []asn1.RawValue `asn1:"set"`
+	}
+	attrs := []attribute{{Type: oidChallengePassword, Values: []asn1.RawValue{{FullBytes: pw}}}}
+	if len(names) > 0 {
+		var generalNames []asn1.RawValue
+		for _, n := range names {
+			if ip := net.ParseIP(n); ip != nil {
+				if ip4 := ip.To4(); ip4 != nil {
+					ip = ip4
+				}
+				generalNames = append(generalNames, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 7, Bytes: ip})
+				continue
+			}
+			generalNames = append(generalNames, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: []byte(n)})
+		}
+		san, err := asn1.Marshal(generalNames)
+		if err != nil {
+			t.Fatalf("asn1.Marshal: %v", err)
+		}
+		exts, err := asn1.Marshal([]pkix.Extension{{Id: asn1.ObjectIdentifier{2, 5, 29, 17}, Value: san}})
+		if err != nil {
+			t.Fatalf("asn1.Marshal: %v", err)
+		}
+		attrs = append(attrs, attribute{Type: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 14}, Values: []asn1.RawValue{{FullBytes: exts}}})
+	}
+	tbs, err := asn1.Marshal(struct {
+		Version    int
+		Subject    asn1.RawValue
+		PublicKey  asn1.RawValue
+		Attributes []attribute `asn1:"tag:0,set"`
+	}{
+		Subject:    asn1.RawValue{FullBytes: subject},
+		PublicKey:  asn1.RawValue{FullBytes: spki},
+		Attributes: attrs,
+	})
+	if err != nil {
+		t.Fatalf("asn1.Marshal: %v", err)
+	}
+	h := sha256.Sum256(tbs)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatalf("rsa.SignPKCS1v15: %v", err)
+	}
+	csr, err := asn1.Marshal(struct {
+		TBS       asn1.RawValue
+		Algorithm pkix.AlgorithmIdentifier
+		Signature asn1.BitString
+	}{
+		TBS: asn1.RawValue{FullBytes: tbs},
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11},
+			Parameters: asn1.NullRawValue,
+		},
+		Signature: asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)},
+	})
+	if err != nil {
+		t.Fatalf("asn1.Marshal: %v", err)
+	}
+	return csr
+}
+
+func newSelfSignedCert(t *testing.T, key *rsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+	templ := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device-1234"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, templ, templ, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	return cert
+}
+
+func TestSCEP(t *testing.T) {
+	m, c := newSCEPTest(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	self := newSelfSignedCert(t, key)
+
+	if cert := c.enroll(scepMessageTypePKCSReq, key, self, key, "wrong"); cert != nil {
+		t.Fatal("enroll with wrong challenge succeeded unexpectedly")
+	}
+	cert := c.enroll(scepMessageTypePKCSReq, key, self, key, "static-secret")
+	if cert == nil {
+		t.Fatal("enroll with static challenge failed")
+	}
+	if got, want := cert.Subject.CommonName, "device-1234"; got != want {
+		t.Errorf("CommonName = %q, want %q", got, want)
+	}
+	if lifetime := cert.NotAfter.Sub(cert.NotBefore); lifetime != scepDefaultCertLifetime {
+		t.Errorf("lifetime = %v, want %v", lifetime, scepDefaultCertLifetime)
+	}
+
+	// One-time challenge.
+	w := httptest.NewRecorder()
+	m.ServeSCEPChallenge(w, httptest.NewRequest(http.MethodPost, "/scep-challenge", nil))
+	var resp struct {
+		Challenge string `json:"challenge"`
+	}
+	body, _ := io.ReadAll(w.Body)
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", body, err)
+	}
+	if c.enroll(scepMessageTypePKCSReq, key, self, key, resp.Challenge) == nil {
+		t.Fatal("enroll with one-time challenge failed")
+	}
+	if c.enroll(scepMessageTypePKCSReq, key, self, key, resp.Challenge) != nil {
+		t.Fatal("second enroll with one-time challenge succeeded unexpectedly")
+	}
+
+	// Renewal, signed with the issued certificate.
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	if c.enroll(scepMessageTypeRenewalReq, newKey, self, key, "") != nil {
+		t.Fatal("renewal with self-signed cert succeeded unexpectedly")
+	}
+	renewed := c.enroll(scepMessageTypeRenewalReq, newKey, cert, key, "")
+	if renewed == nil {
+		t.Fatal("renewal failed")
+	}
+	if got, want := renewed.Subject.CommonName, "device-1234"; got != want {
+		t.Errorf("CommonName = %q, want %q", got, want)
+	}
+	if !renewed.PublicKey.(*rsa.PublicKey).Equal(&newKey.PublicKey) {
+		t.Error("renewed certificate has the wrong key")
+	}
+}
+
+func TestSCEPAllowedNames(t *testing.T) {
+	m, c := newSCEPTest(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	self := newSelfSignedCert(t, key)
+
+	for _, names := range [][]string{
+		{"dev.example.org"},
+		{"dev.example.com", "10.2.0.1"},
+	} {
+		if cert := c.enroll(scepMessageTypePKCSReq, key, self, key, "static-secret", names...); cert != nil {
+			t.Errorf("enroll(%q) succeeded unexpectedly", names)
+		}
+	}
+
+	// A rejected request doesn't use the one-time challenge.
+	w := httptest.NewRecorder()
+	m.ServeSCEPChallenge(w, httptest.NewRequest(http.MethodPost, "/scep-challenge", nil))
+	var resp struct {
+		Challenge string `json:"challenge"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", w.Body, err)
+	}
+	if c.enroll(scepMessageTypePKCSReq, key, self, key, resp.Challenge, "dev.example.net") != nil {
+		t.Fatal("enroll(dev.example.net) succeeded unexpectedly")
+	}
+	cert := c.enroll(scepMessageTypePKCSReq, key, self, key, resp.Challenge, "dev.example.com", "10.1.2.3")
+	if cert == nil {
+		t.Fatal("enroll failed")
+	}
+	if got, want := strings.Join(cert.DNSNames, ","), "dev.example.com"; got != want {
+		t.Errorf("DNSNames = %q, want %q", got, want)
+	}
+	if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("10.1.2.3")) {
+		t.Errorf("IPAddresses = %v, want [10.1.2.3]", cert.IPAddresses)
+	}
+}
@@ -0,0 +1,134 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package ratelimit implements rate and concurrency limits that are applied
+// independently to each key, e.g. to each IP address or user identity.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/time/rate"
+)
+
+// cacheSize is the maximum number of rate limited keys that are tracked at the
+// same time. When this limit is reached, the least recently used keys are
+// forgotten. The keys with operations in flight are tracked separately, and
+// are never forgotten.
+const cacheSize = 65536
+
+// New returns a new Limiter. A rate of 0 disables the rate limit, and a
+// maxConcurrent of 0 disables the concurrency limit.
+func New(r rate.Limit, burst, maxConcurrent int) *Limiter {
+	cache, err := lru.New[string, *rate.Limiter](cacheSize)
+	if err != nil {
+		panic(err)
+	}
+	if burst <= 0 {
+		burst = max(1, int(r))
+	}
+	return &Limiter{
+		rate:          r,
+		burst:         burst,
+		maxConcurrent: maxConcurrent,
+		cache:         cache,
+		inFlight:      make(map[string]int),
+	}
+}
+
+// Limiter applies rate and concurrency limits to keys.
+type Limiter struct {
+	rate          rate.Limit
+	burst         int
+	maxConcurrent int
+
+	mu       sync.Mutex
+	cache    *lru.Cache[string, *rate.Limiter]
+	inFlight map[string]int
+}
+
+// limiter returns the rate limiter of key, or nil if the rate is not limited.
+func (l *Limiter) limiter(key string) *rate.Limiter {
+	if l.rate <= 0 {
+		return nil
+	}
+	rl, ok := l.cache.Get(key)
+	if !ok {
+		rl = rate.NewLimiter(l.rate, l.burst)
+		l.cache.Add(key, rl)
+	}
+	return rl
+}
+
+// Allow reports whether an event for key may happen now. Only the rate limit
+// is applied.
+func (l *Limiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rl := l.limiter(key)
+	return rl == nil || rl.Allow()
+}
+
+// Check is like Allow, but when the event may not happen now, it also
+// returns how long to wait before the next event for key is allowed.
+func (l *Limiter) Check(key string) (retryAfter time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rl := l.limiter(key)
+	if rl == nil {
+		return 0, true
+	}
+	r := rl.Reserve()
+	if d := r.Delay(); d > 0 {
+		r.Cancel()
+		return d, false
+	}
+	return 0, true
+}
+
+// Acquire applies both the rate and concurrency limits. When ok is true, the
+// release function must be called when the operation is done. It is safe to
+// call release more than once.
+func (l *Limiter) Acquire(key string) (release func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxConcurrent > 0 && l.inFlight[key] >= l.maxConcurrent {
+		return nil, false
+	}
+	if rl := l.limiter(key); rl != nil && !rl.Allow() {
+		return nil, false
+	}
+	l.inFlight[key]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.inFlight[key]--; l.inFlight[key] <= 0 {
+				delete(l.inFlight, key)
+			}
+		})
+	}, true
+}
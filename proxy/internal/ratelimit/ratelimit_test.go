@@ -0,0 +1,113 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	l := New(1, 2, 0)
+	for i, want := range []bool{true, true, false, false} {
+		if got := l.Allow("foo"); got != want {
+			t.Errorf("[%d] Allow(foo) = %v, want %v", i, got, want)
+		}
+	}
+	if !l.Allow("bar") {
+		t.Error("Allow(bar) = false, want true")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	l := New(0.5, 1, 0)
+	if _, ok := l.Check("foo"); !ok {
+		t.Fatal("Check(foo) #1 failed")
+	}
+	for i := range 2 {
+		d, ok := l.Check("foo")
+		if ok {
+			t.Fatalf("Check(foo) #%d succeeded", i+2)
+		}
+		if d <= time.Second || d > 2*time.Second {
+			t.Errorf("Check(foo) #%d retryAfter = %v, want ~2s", i+2, d)
+		}
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	l := New(0, 0, 2)
+	r1, ok := l.Acquire("foo")
+	if !ok {
+		t.Fatal("Acquire(foo) #1 failed")
+	}
+	r2, ok := l.Acquire("foo")
+	if !ok {
+		t.Fatal("Acquire(foo) #2 failed")
+	}
+	if _, ok := l.Acquire("foo"); ok {
+		t.Fatal("Acquire(foo) #3 succeeded")
+	}
+	if _, ok := l.Acquire("bar"); !ok {
+		t.Fatal("Acquire(bar) failed")
+	}
+	r1()
+	r1()
+	if _, ok := l.Acquire("foo"); !ok {
+		t.Fatal("Acquire(foo) #4 failed")
+	}
+	if _, ok := l.Acquire("foo"); ok {
+		t.Fatal("Acquire(foo) #5 succeeded")
+	}
+	r2()
+	if _, ok := l.Acquire("foo"); !ok {
+		t.Fatal("Acquire(foo) #6 failed")
+	}
+}
+
+func TestAcquireEviction(t *testing.T) {
+	l := New(1000, 1000, 1)
+	release, ok := l.Acquire("foo")
+	if !ok {
+		t.Fatal("Acquire(foo) #1 failed")
+	}
+	// Evict foo's rate limiter from the cache.
+	for i := range cacheSize {
+		l.Allow(fmt.Sprintf("key%d", i))
+	}
+	if l.cache.Contains("foo") {
+		t.Fatal("foo was not evicted")
+	}
+	if _, ok := l.Acquire("foo"); ok {
+		t.Fatal("Acquire(foo) #2 succeeded")
+	}
+	release()
+	if len(l.inFlight) != 0 {
+		t.Errorf("inFlight = %v, want empty", l.inFlight)
+	}
+	if _, ok := l.Acquire("foo"); !ok {
+		t.Fatal("Acquire(foo) #3 failed")
+	}
+}
@@ -0,0 +1,166 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package saml
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// https://www.w3.org/TR/xmlenc-core1/
+
+const (
+	xencAES128CBC = "http://www.w3.org/2001/04/xmlenc#aes128-cbc"
+	xencAES256CBC = "http://www.w3.org/2001/04/xmlenc#aes256-cbc"
+	xencAES128GCM = "http://www.w3.org/2009/xmlenc11#aes128-gcm"
+	xencAES256GCM = "http://www.w3.org/2009/xmlenc11#aes256-gcm"
+
+	xencRSAOAEPMGF1P = "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"
+	xencRSAOAEP      = "http://www.w3.org/2009/xmlenc11#rsa-oaep"
+)
+
+// decryptAssertion decrypts an EncryptedAssertion element and returns the
+// Assertion element that it contains.
+func decryptAssertion(ea *etree.Element, key *rsa.PrivateKey) (*etree.Element, error) {
+	ed := ea.FindElement("./EncryptedData")
+	if ed == nil {
+		return nil, errors.New("missing EncryptedData")
+	}
+	ek := ed.FindElement("./KeyInfo/EncryptedKey")
+	if ek == nil {
+		ek = ea.FindElement("./EncryptedKey")
+	}
+	if ek == nil {
+		return nil, errors.New("missing EncryptedKey")
+	}
+	sessionKey, err := decryptKey(ek, key)
+	if err != nil {
+		return nil, err
+	}
+	cipherText, err := base64.StdEncoding.DecodeString(strings.TrimSpace(findElementText(ed, "./CipherData/CipherValue")))
+	if err != nil {
+		return nil, err
+	}
+	plainText, err := decryptData(findElementAttr(ed, "./EncryptionMethod", "Algorithm"), sessionKey, cipherText)
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(plainText); err != nil {
+		return nil, err
+	}
+	assertion := doc.Root()
+	if assertion == nil || assertion.Tag != "Assertion" {
+		return nil, errors.New("encrypted data is not an assertion")
+	}
+	return assertion, nil
+}
+
+func decryptKey(ek *etree.Element, key *rsa.PrivateKey) ([]byte, error) {
+	cipherText, err := base64.StdEncoding.DecodeString(strings.TrimSpace(findElementText(ek, "./CipherData/CipherValue")))
+	if err != nil {
+		return nil, err
+	}
+	opts := &rsa.OAEPOptions{
+		Hash:    crypto.SHA1,
+		MGFHash: crypto.SHA1,
+	}
+	switch alg := findElementAttr(ek, "./EncryptionMethod", "Algorithm"); alg {
+	case xencRSAOAEPMGF1P:
+	case xencRSAOAEP:
+		if mgf := findElementAttr(ek, "./EncryptionMethod/MGF", "Algorithm"); mgf != "" {
+			h, ok := mgfHashes[mgf]
+			if !ok {
+				return nil, fmt.Errorf("unsupported MGF %q", mgf)
+			}
+			opts.MGFHash = h
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key encryption algorithm %q", alg)
+	}
+	if dm := findElementAttr(ek, "./EncryptionMethod/DigestMethod", "Algorithm"); dm != "" {
+		h, ok := digestHashes[dm]
+		if !ok {
+			return nil, fmt.Errorf("unsupported digest method %q", dm)
+		}
+		opts.Hash = h
+	}
+	return key.Decrypt(nil, cipherText, opts)
+}
+
+var digestHashes = map[string]crypto.Hash{
+	"http://www.w3.org/2000/09/xmldsig#sha1":        crypto.SHA1,
+	"http://www.w3.org/2001/04/xmlenc#sha256":       crypto.SHA256,
+	"http://www.w3.org/2001/04/xmldsig-more#sha384": crypto.SHA384,
+	"http://www.w3.org/2001/04/xmlenc#sha512":       crypto.SHA512,
+}
+
+var mgfHashes = map[string]crypto.Hash{
+	"http://www.w3.org/2009/xmlenc11#mgf1sha1":   crypto.SHA1,
+	"http://www.w3.org/2009/xmlenc11#mgf1sha256": crypto.SHA256,
+	"http://www.w3.org/2009/xmlenc11#mgf1sha384": crypto.SHA384,
+	"http://www.w3.org/2009/xmlenc11#mgf1sha512": crypto.SHA512,
+}
+
+func decryptData(alg string, key, cipherText []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	switch alg {
+	case xencAES128CBC, xencAES256CBC:
+		if len(cipherText) < 2*aes.BlockSize || len(cipherText)%aes.BlockSize != 0 {
+			return nil, errors.New("invalid cipher text length")
+		}
+		iv, data := cipherText[:aes.BlockSize], cipherText[aes.BlockSize:]
+		out := make([]byte, len(data))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+		// The last byte is the padding length. The value of the other
+		// padding bytes is arbitrary.
+		n := int(out[len(out)-1])
+		if n == 0 || n > aes.BlockSize {
+			return nil, errors.New("invalid padding")
+		}
+		return out[:len(out)-n], nil
+	case xencAES128GCM, xencAES256GCM:
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if len(cipherText) < gcm.NonceSize()+gcm.Overhead() {
+			return nil, errors.New("invalid cipher text length")
+		}
+		return gcm.Open(nil, cipherText[:gcm.NonceSize()], cipherText[gcm.NonceSize():], nil)
+	default:
+		return nil, fmt.Errorf("unsupported data encryption algorithm %q", alg)
+	}
+}
@@ -0,0 +1,136 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package saml
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/beevik/etree"
+)
+
+const testAssertion = `<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_123"><saml:Subject><saml:NameID>bob@example.com</saml:NameID></saml:Subject></saml:Assertion>`
+
+func encryptForTest(t *testing.T, pub *rsa.PublicKey, dataAlg, keyAlg, keyParams string, keySize int) *etree.Element {
+	sessionKey := make([]byte, keySize)
+	if _, err := rand.Read(sessionKey); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		t.Fatalf("aes.NewCipher: %v", err)
+	}
+	var cipherText []byte
+	switch dataAlg {
+	case xencAES128CBC, xencAES256CBC:
+		n := aes.BlockSize - len(testAssertion)%aes.BlockSize
+		data := append([]byte(testAssertion), make([]byte, n)...)
+		data[len(data)-1] = byte(n)
+		cipherText = make([]byte, aes.BlockSize+len(data))
+		rand.Read(cipherText[:aes.BlockSize])
+		cipher.NewCBCEncrypter(block, cipherText[:aes.BlockSize]).CryptBlocks(cipherText[aes.BlockSize:], data)
+	default:
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			t.Fatalf("cipher.NewGCM: %v", err)
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		rand.Read(nonce)
+		cipherText = gcm.Seal(nonce, nonce, []byte(testAssertion), nil)
+	}
+	var encKey []byte
+	if keyAlg == xencRSAOAEP {
+		encKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, sessionKey, nil)
+	} else {
+		encKey, err = rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, sessionKey, nil)
+	}
+	if err != nil {
+		t.Fatalf("rsa.EncryptOAEP: %v", err)
+	}
+	doc := etree.NewDocument()
+	err = doc.ReadFromString(fmt.Sprintf(`<saml:EncryptedAssertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">
+<xenc:EncryptedData xmlns:xenc="http://www.w3.org/2001/04/xmlenc#" Type="http://www.w3.org/2001/04/xmlenc#Element">
+<xenc:EncryptionMethod Algorithm="%s"/>
+<ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+<xenc:EncryptedKey>
+<xenc:EncryptionMethod Algorithm="%s">%s</xenc:EncryptionMethod>
+<xenc:CipherData><xenc:CipherValue>%s</xenc:CipherValue></xenc:CipherData>
+</xenc:EncryptedKey>
+</ds:KeyInfo>
+<xenc:CipherData><xenc:CipherValue>%s</xenc:CipherValue></xenc:CipherData>
+</xenc:EncryptedData>
+</saml:EncryptedAssertion>`, dataAlg, keyAlg, keyParams,
+		base64.StdEncoding.EncodeToString(encKey), base64.StdEncoding.EncodeToString(cipherText)))
+	if err != nil {
+		t.Fatalf("ReadFromString: %v", err)
+	}
+	return doc.Root()
+}
+
+func TestDecryptAssertion(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	for _, tc := range []struct {
+		name      string
+		dataAlg   string
+		keyAlg    string
+		keyParams string
+		keySize   int
+	}{
+		{"aes128-cbc", xencAES128CBC, xencRSAOAEPMGF1P, "", 16},
+		{"aes256-cbc", xencAES256CBC, xencRSAOAEPMGF1P, "", 32},
+		{"aes128-gcm", xencAES128GCM, xencRSAOAEPMGF1P, "", 16},
+		{"aes256-gcm rsa-oaep sha256", xencAES256GCM, xencRSAOAEP,
+			`<ds:DigestMethod xmlns:ds="http://www.w3.org/2000/09/xmldsig#" Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/><xenc11:MGF xmlns:xenc11="http://www.w3.org/2009/xmlenc11#" Algorithm="http://www.w3.org/2009/xmlenc11#mgf1sha256"/>`, 32},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ea := encryptForTest(t, &key.PublicKey, tc.dataAlg, tc.keyAlg, tc.keyParams, tc.keySize)
+			assertion, err := decryptAssertion(ea, key)
+			if err != nil {
+				t.Fatalf("decryptAssertion: %v", err)
+			}
+			if got, want := findElementText(assertion, "./Subject/NameID"), "bob@example.com"; got != want {
+				t.Errorf("NameID = %q, want %q", got, want)
+			}
+		})
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	ea := encryptForTest(t, &other.PublicKey, xencAES256GCM, xencRSAOAEPMGF1P, "", 32)
+	if _, err := decryptAssertion(ea, key); err == nil {
+		t.Error("decryptAssertion succeeded with the wrong key")
+	}
+}
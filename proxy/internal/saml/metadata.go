@@ -0,0 +1,127 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// metadataRefreshInterval is how often the identity provider's metadata is
+// fetched again.
+const metadataRefreshInterval = time.Hour
+
+const bindingHTTPRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+
+type idpMetadata struct {
+	ssoURL string
+	certs  []*x509.Certificate
+}
+
+// fetchMetadata fetches and parses the identity provider's metadata. The
+// metadata must be signed by one of the trusted certificates.
+// http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf
+func fetchMetadata(url string, trusted []*x509.Certificate) (*idpMetadata, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http get(%s): %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseMetadata(body, trusted)
+}
+
+func parseMetadata(body []byte, trusted []*x509.Certificate) (*idpMetadata, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(body); err != nil {
+		return nil, err
+	}
+	root := doc.Root()
+	if root == nil {
+		return nil, errors.New("empty metadata")
+	}
+	if len(trusted) == 0 {
+		return nil, errors.New("metadata signature: no trusted certificates")
+	}
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: trusted,
+	})
+	v, err := ctx.Validate(root)
+	if err != nil {
+		return nil, fmt.Errorf("metadata signature: %w", err)
+	}
+	root = v
+	ed := root
+	if ed.Tag == "EntitiesDescriptor" {
+		ed = root.FindElement("./EntityDescriptor[IDPSSODescriptor]")
+	}
+	if ed == nil || ed.Tag != "EntityDescriptor" {
+		return nil, errors.New("EntityDescriptor not found")
+	}
+	idpd := ed.FindElement("./IDPSSODescriptor")
+	if idpd == nil {
+		return nil, errors.New("IDPSSODescriptor not found")
+	}
+	md := &idpMetadata{
+		ssoURL: findElementAttr(idpd, "./SingleSignOnService[@Binding='"+bindingHTTPRedirect+"']", "Location"),
+	}
+	if md.ssoURL == "" {
+		return nil, errors.New("SingleSignOnService with HTTP-Redirect binding not found")
+	}
+	for _, kd := range idpd.FindElements("./KeyDescriptor") {
+		if use := kd.SelectAttrValue("use", "signing"); use != "signing" {
+			continue
+		}
+		for _, c := range kd.FindElements("./KeyInfo/X509Data/X509Certificate") {
+			der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(c.Text()), ""))
+			if err != nil {
+				return nil, err
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			md.certs = append(md.certs, cert)
+		}
+	}
+	if len(md.certs) == 0 {
+		return nil, errors.New("no signing certificates found")
+	}
+	return md, nil
+}
@@ -0,0 +1,172 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+func testMetadata(certDER []byte) string {
+	return fmt.Sprintf(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ds="http://www.w3.org/2000/09/xmldsig#" entityID="https://idp.example.com/" ID="_md1">
+<md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+<md:KeyDescriptor use="encryption"><ds:KeyInfo><ds:X509Data><ds:X509Certificate>invalid</ds:X509Certificate></ds:X509Data></ds:KeyInfo></md:KeyDescriptor>
+<md:KeyDescriptor use="signing"><ds:KeyInfo><ds:X509Data><ds:X509Certificate>%s</ds:X509Certificate></ds:X509Data></ds:KeyInfo></md:KeyDescriptor>
+<md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://idp.example.com/sso/post"/>
+<md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso/redirect"/>
+</md:IDPSSODescriptor>
+</md:EntityDescriptor>`, base64.StdEncoding.EncodeToString(certDER))
+}
+
+func TestMetadata(t *testing.T) {
+	ks := dsig.RandomKeyStoreForTest()
+	_, certDER, err := ks.GetKeyPair()
+	if err != nil {
+		t.Fatalf("GetKeyPair: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	unsigned := testMetadata(certDER)
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(unsigned); err != nil {
+		t.Fatalf("ReadFromString: %v", err)
+	}
+	signedRoot, err := dsig.NewDefaultSigningContext(ks).SignEnveloped(doc.Root())
+	if err != nil {
+		t.Fatalf("SignEnveloped: %v", err)
+	}
+	doc.SetRoot(signedRoot)
+	signed, err := doc.WriteToString()
+	if err != nil {
+		t.Fatalf("WriteToString: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/unsigned", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(unsigned))
+	})
+	mux.HandleFunc("/signed", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(signed))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, tc := range []struct {
+		path    string
+		trusted []*x509.Certificate
+		wantErr bool
+	}{
+		{"/unsigned", nil, true},
+		{"/unsigned", []*x509.Certificate{cert}, true},
+		{"/signed", nil, true},
+		{"/signed", []*x509.Certificate{cert}, false},
+	} {
+		md, err := fetchMetadata(server.URL+tc.path, tc.trusted)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("fetchMetadata(%s, %d) err = %v, wantErr %v", tc.path, len(tc.trusted), err, tc.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got, want := md.ssoURL, "https://idp.example.com/sso/redirect"; got != want {
+			t.Errorf("ssoURL = %q, want %q", got, want)
+		}
+		if len(md.certs) != 1 || !md.certs[0].Equal(cert) {
+			t.Errorf("certs = %v, want [%v]", md.certs, cert.Subject)
+		}
+	}
+}
+
+func TestRefreshMetadata(t *testing.T) {
+	ks := dsig.RandomKeyStoreForTest()
+	_, certDER, err := ks.GetKeyPair()
+	if err != nil {
+		t.Fatalf("GetKeyPair: %v", err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(testMetadata(certDER)); err != nil {
+		t.Fatalf("ReadFromString: %v", err)
+	}
+	signedRoot, err := dsig.NewDefaultSigningContext(ks).SignEnveloped(doc.Root())
+	if err != nil {
+		t.Fatalf("SignEnveloped: %v", err)
+	}
+	doc.SetRoot(signedRoot)
+	signed, err := doc.WriteToString()
+	if err != nil {
+		t.Fatalf("WriteToString: %v", err)
+	}
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte(signed))
+	}))
+	defer server.Close()
+
+	cfg := Config{
+		EntityID:    "https://sp.example.com/",
+		ACSURL:      "https://sp.example.com/saml",
+		MetadataURL: server.URL,
+	}
+	if _, err := New(cfg, nil, nil); err == nil {
+		t.Fatal("New() without MetadataCerts succeeded unexpectedly")
+	}
+	cfg.MetadataCerts = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}))
+	p, err := New(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got, want := fetches.Load(), int32(1); got != want {
+		t.Fatalf("fetches = %d, want %d", got, want)
+	}
+	if err := p.RefreshMetadata(); err != nil {
+		t.Fatalf("RefreshMetadata: %v", err)
+	}
+	if got, want := fetches.Load(), int32(1); got != want {
+		t.Fatalf("fetches = %d, want %d", got, want)
+	}
+	p.mu.Lock()
+	p.metadataUpdated = time.Now().Add(-metadataRefreshInterval)
+	p.mu.Unlock()
+	if err := p.RefreshMetadata(); err != nil {
+		t.Fatalf("RefreshMetadata: %v", err)
+	}
+	if got, want := fetches.Load(), int32(2); got != want {
+		t.Fatalf("fetches = %d, want %d", got, want)
+	}
+}
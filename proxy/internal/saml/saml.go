@@ -27,11 +27,14 @@ import (
 	"bytes"
 	"compress/flate"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/pem"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -63,16 +66,33 @@ type Config struct {
 	EntityID string
 	Certs    string
 	ACSURL   string
+	// EncryptionCert and EncryptionKey are the PEM-encoded certificate and
+	// RSA private key used to decrypt encrypted assertions, or the names
+	// of files that contain them.
+	EncryptionCert string
+	EncryptionKey  string
+	// MetadataURL is the URL of the identity provider's metadata. When
+	// set, SSOURL and Certs are taken from the metadata, which is
+	// refreshed periodically.
+	MetadataURL string
+	// MetadataCerts are the PEM-encoded certificates used to verify the
+	// signature of the metadata. They are required with MetadataURL.
+	MetadataCerts string
 }
 
 type Provider struct {
-	cfg     Config
-	er      EventRecorder
-	cm      CookieManager
-	dsigCtx *dsig.ValidationContext
+	cfg           Config
+	er            EventRecorder
+	cm            CookieManager
+	decryptionKey *rsa.PrivateKey
+	metadataCerts []*x509.Certificate
 
-	mu     sync.Mutex
-	states map[string]*samlState
+	mu              sync.Mutex
+	states          map[string]*samlState
+	ssoURL          string
+	dsigCtx         *dsig.ValidationContext
+	metadataUpdated time.Time
+	refreshing      bool
 }
 
 type samlState struct {
@@ -82,29 +102,118 @@ type samlState struct {
 }
 
 func New(cfg Config, er EventRecorder, cm CookieManager) (*Provider, error) {
-	certs, err := readCerts(cfg.Certs)
-	if err != nil {
-		return nil, err
-	}
-	dsigCtx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
-		Roots: certs,
-	})
 	p := &Provider{
-		cfg:     cfg,
-		er:      er,
-		cm:      cm,
-		dsigCtx: dsigCtx,
-		states:  make(map[string]*samlState),
+		cfg:    cfg,
+		er:     er,
+		cm:     cm,
+		states: make(map[string]*samlState),
+		ssoURL: cfg.SSOURL,
+	}
+	if cfg.MetadataURL != "" {
+		certs, err := readCerts(cfg.MetadataCerts)
+		if err != nil {
+			return nil, fmt.Errorf("MetadataCerts: %w", err)
+		}
+		if len(certs) == 0 {
+			return nil, errors.New("MetadataCerts: must be set with MetadataURL")
+		}
+		p.metadataCerts = certs
+		if err := p.refreshMetadata(); err != nil {
+			return nil, fmt.Errorf("MetadataURL: %w", err)
+		}
+	} else {
+		certs, err := readCerts(cfg.Certs)
+		if err != nil {
+			return nil, err
+		}
+		p.dsigCtx = dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+			Roots: certs,
+		})
 	}
-	if _, err := url.Parse(cfg.SSOURL); err != nil {
+	if _, err := url.Parse(p.ssoURL); err != nil {
 		return nil, fmt.Errorf("SSOURL: %v", err)
 	}
 	if _, err := url.Parse(cfg.ACSURL); err != nil {
 		return nil, fmt.Errorf("ACSURL: %v", err)
 	}
+	if cfg.EncryptionKey != "" {
+		certPEM, err := readFile(cfg.EncryptionCert)
+		if err != nil {
+			return nil, fmt.Errorf("EncryptionCert: %w", err)
+		}
+		keyPEM, err := readFile(cfg.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("EncryptionKey: %w", err)
+		}
+		kp, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("EncryptionKey: %w", err)
+		}
+		key, ok := kp.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("EncryptionKey: must be an RSA key")
+		}
+		p.decryptionKey = key
+	}
 	return p, nil
 }
 
+// refreshMetadata fetches the identity provider's metadata and updates the SSO
+// URL and the signing certificates.
+func (p *Provider) refreshMetadata() error {
+	md, err := fetchMetadata(p.cfg.MetadataURL, p.metadataCerts)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refreshing = false
+	if err != nil {
+		return err
+	}
+	p.ssoURL = md.ssoURL
+	p.dsigCtx = dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: md.certs,
+	})
+	p.metadataUpdated = time.Now()
+	return nil
+}
+
+// RefreshMetadata fetches the identity provider's metadata again when it is
+// older than metadataRefreshInterval. The current metadata continues to be
+// used until the refresh succeeds.
+func (p *Provider) RefreshMetadata() error {
+	if !p.refreshDue() {
+		return nil
+	}
+	return p.refreshMetadata()
+}
+
+// refreshDue returns true, and marks the refresh as started, when the metadata
+// needs to be refreshed.
+func (p *Provider) refreshDue() bool {
+	if p.cfg.MetadataURL == "" {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.refreshing || time.Since(p.metadataUpdated) < metadataRefreshInterval {
+		return false
+	}
+	p.refreshing = true
+	return true
+}
+
+// maybeRefreshMetadata refreshes the metadata in the background when it is
+// older than metadataRefreshInterval.
+func (p *Provider) maybeRefreshMetadata() {
+	if !p.refreshDue() {
+		return
+	}
+	go func() {
+		if err := p.refreshMetadata(); err != nil {
+			p.er.Record("saml metadata refresh failed")
+		}
+	}()
+}
+
 func (p *Provider) RequestLogin(w http.ResponseWriter, req *http.Request, origURL string, opts ...idp.Option) {
 	ou, err := url.Parse(origURL)
 	if err != nil {
@@ -117,12 +226,14 @@ func (p *Provider) RequestLogin(w http.ResponseWriter, req *http.Request, origUR
 		return
 	}
 	idStr := hex.EncodeToString(id[:])
+	p.maybeRefreshMetadata()
 	p.mu.Lock()
 	p.states[idStr] = &samlState{
 		Created:     time.Now(),
 		OriginalURL: origURL,
 		Host:        ou.Host,
 	}
+	ssoURL := p.ssoURL
 	p.mu.Unlock()
 
 	authReq := &samlAuthnRequest{
@@ -130,7 +241,7 @@ func (p *Provider) RequestLogin(w http.ResponseWriter, req *http.Request, origUR
 		ID:                          idStr,
 		Version:                     "2.0",
 		IssueInstant:                time.Now().UTC().Format(time.RFC3339Nano),
-		Destination:                 p.cfg.SSOURL,
+		Destination:                 ssoURL,
 		ProtocolBinding:             "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
 		AssertionConsumerServiceURL: p.cfg.ACSURL,
 		Issuer: samlIssuer{
@@ -176,11 +287,21 @@ func (p *Provider) HandleCallback(w http.ResponseWriter, req *http.Request) {
 	// Assertion is the only part that's signed. So, we ignore everything
 	// else.
 	assertion := root.FindElement("./Assertion")
+	if ea := root.FindElement("./EncryptedAssertion"); assertion == nil && ea != nil && p.decryptionKey != nil {
+		if assertion, err = decryptAssertion(ea, p.decryptionKey); err != nil {
+			p.er.Record("saml decryption failed")
+			http.Error(w, "invalid request", http.StatusForbidden)
+			return
+		}
+	}
 	if assertion == nil {
 		http.Error(w, "invalid request", http.StatusForbidden)
 		return
 	}
-	v, err := p.dsigCtx.Validate(assertion)
+	p.mu.Lock()
+	dsigCtx := p.dsigCtx
+	p.mu.Unlock()
+	v, err := dsigCtx.Validate(assertion)
 	if err != nil {
 		http.Error(w, "invalid request", http.StatusForbidden)
 		return
@@ -260,15 +381,19 @@ func (p *Provider) HandleCallback(w http.ResponseWriter, req *http.Request) {
 	http.Redirect(w, req, state.OriginalURL, http.StatusFound)
 }
 
-func readCerts(s string) ([]*x509.Certificate, error) {
-	var b []byte
+// readFile returns the content of the file if s is an absolute file name, or
+// s itself otherwise.
+func readFile(s string) ([]byte, error) {
 	if len(s) > 0 && s[0] == '/' {
-		var err error
-		if b, err = os.ReadFile(s); err != nil {
-			return nil, err
-		}
-	} else {
-		b = []byte(s)
+		return os.ReadFile(s)
+	}
+	return []byte(s), nil
+}
+
+func readCerts(s string) ([]*x509.Certificate, error) {
+	b, err := readFile(s)
+	if err != nil {
+		return nil, err
 	}
 	var certs []*x509.Certificate
 	for len(b) > 0 {
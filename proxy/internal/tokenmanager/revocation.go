@@ -0,0 +1,183 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package tokenmanager
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	revocationFile = "revoked-sessions"
+
+	// revocationMaxAge is how long revocations are kept by default. It
+	// must be at least as long as the lifetime of the auth token. SetMaxAge
+	// extends it for the tokens that live longer.
+	revocationMaxAge = 24 * time.Hour
+)
+
+// RevocationList keeps track of revoked user sessions. Sessions can be revoked
+// by session ID (sid), by upstream session ID (idp_sid), by subject (sub), by
+// token ID (jti), or by email address for all providers. Revoking a subject or
+// an email address revokes all the sessions created before the revocation.
+// The email addresses are case insensitive.
+type RevocationList struct {
+	store *storage.Storage
+
+	mu      sync.Mutex
+	maxAge  time.Duration
+	revoked revokedSessions
+}
+
+type revokedSessions struct {
+	Entries map[string]time.Time
+}
+
+// NewRevocationList returns a new RevocationList backed by store.
+func NewRevocationList(store *storage.Storage) (*RevocationList, error) {
+	rl := &RevocationList{
+		store:  store,
+		maxAge: revocationMaxAge,
+	}
+	store.CreateEmptyFile(revocationFile, &rl.revoked)
+	if err := store.ReadDataFile(revocationFile, &rl.revoked); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// Reload reloads the revocation list from storage, e.g. after another proxy
+// instance that shares the same storage revoked some sessions.
+func (rl *RevocationList) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	var revoked revokedSessions
+	if err := rl.store.ReadDataFile(revocationFile, &revoked); err != nil {
+		return err
+	}
+	rl.revoked = revoked
+	return nil
+}
+
+// SetMaxAge sets how long revocations are kept. It must be at least as long
+// as the lifetime of the tokens that are checked against the list. It is
+// never less than 24 hours.
+func (rl *RevocationList) SetMaxAge(d time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.maxAge = max(d, revocationMaxAge)
+}
+
+func revocationKey(provider, claim, value string) string {
+	return provider + "\x00" + claim + "\x00" + value
+}
+
+// Revoke revokes the sessions of provider where claim has the given value.
+func (rl *RevocationList) Revoke(provider, claim, value string) (retErr error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	var revoked revokedSessions
+	commit, err := rl.store.OpenForUpdate(revocationFile, &revoked)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if revoked.Entries == nil {
+		revoked.Entries = make(map[string]time.Time)
+	}
+	now := time.Now().UTC()
+	for k, v := range revoked.Entries {
+		if now.Sub(v) > rl.maxAge {
+			delete(revoked.Entries, k)
+		}
+	}
+	revoked.Entries[revocationKey(provider, claim, value)] = now
+	if err := commit(true, nil); err != nil {
+		return err
+	}
+	rl.revoked = revoked
+	return nil
+}
+
+// RevokeUser revokes all the sessions of the user with the given email
+// address, regardless of the identity provider.
+func (rl *RevocationList) RevokeUser(email string) error {
+	return rl.Revoke("", "email", strings.ToLower(email))
+}
+
+// IsRevoked returns true if the session described by claims was revoked.
+func (rl *RevocationList) IsRevoked(provider string, claims jwt.MapClaims) bool {
+	return rl.isRevoked(claims, []revocationClaim{
+		{provider, "sid"},
+		{provider, "idp_sid"},
+		{provider, "sub"},
+		{provider, "jti"},
+		{"", "email"},
+	})
+}
+
+// IsUserRevoked returns true if the user with the email address in claims was
+// revoked after the token was issued.
+func (rl *RevocationList) IsUserRevoked(claims jwt.MapClaims) bool {
+	return rl.isRevoked(claims, []revocationClaim{{"", "email"}})
+}
+
+type revocationClaim struct {
+	provider, claim string
+}
+
+func (rl *RevocationList) isRevoked(claims jwt.MapClaims, keys []revocationClaim) bool {
+	if rl == nil {
+		return false
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if len(rl.revoked.Entries) == 0 {
+		return false
+	}
+	for _, k := range keys {
+		v, ok := claims[k.claim].(string)
+		if !ok || v == "" {
+			continue
+		}
+		if k.claim == "email" {
+			v = strings.ToLower(v)
+		}
+		t, exists := rl.revoked.Entries[revocationKey(k.provider, k.claim, v)]
+		if !exists {
+			continue
+		}
+		if k.claim != "sub" && k.claim != "email" {
+			return true
+		}
+		if iat, err := claims.GetIssuedAt(); err != nil || iat == nil || !iat.After(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package tokenmanager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestRevokeUserTokens(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	store := storage.New(t.TempDir(), mk)
+	tm, err := New(store, nil, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	newToken := func(email string) string {
+		tok, err := tm.CreateToken(jwt.MapClaims{
+			"iss":   "https://idp.example.com",
+			"sub":   "id-" + email,
+			"email": email,
+			"iat":   time.Now().Add(-time.Minute).Unix(),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}, "")
+		if err != nil {
+			t.Fatalf("CreateToken: %v", err)
+		}
+		return tok
+	}
+	bob := newToken("Bob@Example.com")
+	alice := newToken("alice@example.com")
+
+	if err := tm.Revocations().RevokeUser("BOB@example.COM"); err != nil {
+		t.Fatalf("RevokeUser: %v", err)
+	}
+	if _, err := tm.ValidateToken(bob); err == nil {
+		t.Error("bob's token is still valid")
+	}
+	if _, err := tm.ValidateToken(alice); err != nil {
+		t.Errorf("alice's token: %v", err)
+	}
+	if !tm.Revocations().IsRevoked("idp", jwt.MapClaims{"email": "bob@example.com"}) {
+		t.Error("IsRevoked(bob) = false, want true")
+	}
+	// Tokens issued after the revocation are valid.
+	claims := jwt.MapClaims{
+		"email": "bob@example.com",
+		"iat":   float64(time.Now().Add(time.Minute).Unix()),
+	}
+	if tm.Revocations().IsUserRevoked(claims) {
+		t.Error("IsUserRevoked(new token) = true, want false")
+	}
+}
+
+func TestRevocationMaxAge(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	store := storage.New(t.TempDir(), mk)
+	rl, err := NewRevocationList(store)
+	if err != nil {
+		t.Fatalf("NewRevocationList: %v", err)
+	}
+	revokedAt := func(value string, age time.Duration) {
+		var revoked revokedSessions
+		commit, err := store.OpenForUpdate(revocationFile, &revoked)
+		if err != nil {
+			t.Fatalf("OpenForUpdate: %v", err)
+		}
+		if revoked.Entries == nil {
+			revoked.Entries = make(map[string]time.Time)
+		}
+		revoked.Entries[revocationKey("idp", "sid", value)] = time.Now().UTC().Add(-age)
+		if err := commit(true, nil); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+
+	// The revocations are kept as long as the longest token lifetime.
+	rl.SetMaxAge(30 * 24 * time.Hour)
+	revokedAt("old", 10*24*time.Hour)
+	if err := rl.Revoke("idp", "sid", "new"); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if !rl.IsRevoked("idp", jwt.MapClaims{"sid": "old"}) {
+		t.Error("IsRevoked(old) = false, want true")
+	}
+
+	// They are never kept less than revocationMaxAge.
+	rl.SetMaxAge(time.Hour)
+	revokedAt("recent", 2*time.Hour)
+	if err := rl.Revoke("idp", "sid", "new"); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if rl.IsRevoked("idp", jwt.MapClaims{"sid": "old"}) {
+		t.Error("IsRevoked(old) = true, want false")
+	}
+	if !rl.IsRevoked("idp", jwt.MapClaims{"sid": "recent"}) {
+		t.Error("IsRevoked(recent) = false, want true")
+	}
+}
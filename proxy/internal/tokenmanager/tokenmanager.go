@@ -92,6 +92,8 @@ type TokenManager struct {
 	tpm    *tpm.TPM
 	logger logger
 
+	revocations *RevocationList
+
 	mu   sync.Mutex
 	keys tokenKeys
 }
@@ -110,6 +112,11 @@ func New(store *storage.Storage, tpm *tpm.TPM, logger logger) (*TokenManager, er
 	if err := tm.rotateKeys(); err != nil {
 		return nil, err
 	}
+	rl, err := NewRevocationList(store)
+	if err != nil {
+		return nil, err
+	}
+	tm.revocations = rl
 	return &tm, nil
 }
 
@@ -160,10 +167,40 @@ func (tm *TokenManager) rotateKeys() (retErr error) {
 		keys.Keys = keys.Keys[1:]
 		changed = true
 	}
-	if !changed && len(tm.keys.Keys) > 0 {
+	if !changed && tm.hasKeys(keys) {
 		return nil
 	}
+	tm.loadKeys(keys)
+	return commit(true, nil)
+}
+
+// Reload reloads the keys from storage, e.g. after another proxy instance
+// that shares the same storage rotated them.
+func (tm *TokenManager) Reload() error {
+	var keys tokenKeys
+	if err := tm.store.ReadDataFile(tokenKeyFile, &keys); err != nil {
+		return err
+	}
+	if len(keys.Keys) == 0 || tm.hasKeys(keys) {
+		return nil
+	}
+	tm.loadKeys(keys)
+	return nil
+}
+
+// hasKeys returns true if the current keys are the same as keys.
+func (tm *TokenManager) hasKeys(keys tokenKeys) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if len(tm.keys.Keys) == 0 {
+		return false
+	}
+	return slices.EqualFunc(tm.keys.Keys, keys.Keys, func(a, b *tokenKey) bool {
+		return a.ID == b.ID
+	})
+}
 
+func (tm *TokenManager) loadKeys(keys tokenKeys) {
 	for _, k := range keys.Keys {
 		if tm.tpm != nil {
 			privKey, err := tm.tpm.UnmarshalKey(k.Key)
@@ -187,7 +224,6 @@ func (tm *TokenManager) rotateKeys() (retErr error) {
 	tm.mu.Lock()
 	tm.keys = keys
 	tm.mu.Unlock()
-	return commit(true, nil)
 }
 
 func (tm *TokenManager) createNewTokenKeys() ([]*tokenKey, error) {
@@ -425,10 +461,23 @@ func (tm *TokenManager) getKey(tok *jwt.Token) (interface{}, error) {
 	return nil, errors.New("not found")
 }
 
-// ValidateToken validates a JSON Web Token (JWT).
+// Revocations returns the list of revoked sessions and users.
+func (tm *TokenManager) Revocations() *RevocationList {
+	return tm.revocations
+}
+
+// ValidateToken validates a JSON Web Token (JWT). Tokens of users that were
+// revoked after the tokens were issued are rejected.
 func (tm *TokenManager) ValidateToken(t string, opts ...jwt.ParserOption) (*jwt.Token, error) {
 	opts = append(opts, jwt.WithValidMethods([]string{"ES256", "RS256", "EdDSA"}))
-	return jwt.ParseWithClaims(t, jwt.MapClaims{}, tm.getKey, opts...)
+	tok, err := jwt.ParseWithClaims(t, jwt.MapClaims{}, tm.getKey, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if tm.revocations.IsUserRevoked(tok.Claims.(jwt.MapClaims)) {
+		return nil, errors.New("user revoked")
+	}
+	return tok, nil
 }
 
 type jwks struct {
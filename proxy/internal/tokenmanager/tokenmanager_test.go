@@ -124,3 +124,43 @@ func TestTokenManager(t *testing.T) {
 		})
 	}
 }
+
+func TestReload(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	store := storage.New(t.TempDir(), mk)
+	tm1, err := New(store, nil, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	tm2, err := New(store, nil, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// Delete the keys to force tm1 to create new ones.
+	if err := store.SaveDataFile(tokenKeyFile, &tokenKeys{}); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	if err := tm1.rotateKeys(); err != nil {
+		t.Fatalf("rotateKeys: %v", err)
+	}
+	tok, err := tm1.CreateToken(jwt.MapClaims{
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	}, "ES256")
+	if err != nil {
+		t.Fatalf("tm.CreateToken: %v", err)
+	}
+	if _, err := tm2.ValidateToken(tok); err == nil {
+		t.Fatal("tm2.ValidateToken should fail before Reload")
+	}
+	if err := tm2.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, err := tm2.ValidateToken(tok); err != nil {
+		t.Fatalf("tm2.ValidateToken: %v", err)
+	}
+}
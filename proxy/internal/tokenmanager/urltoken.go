@@ -76,6 +76,7 @@ func (tm *TokenManager) URLToken(w http.ResponseWriter, req *http.Request, u *ur
 	}
 	claims["url"] = u.String()
 	claims["sid"] = sid
+	claims["iat"] = time.Now().Unix()
 	token, err := tm.CreateToken(claims, "")
 	return token, displayURL, err
 }
@@ -0,0 +1,455 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package totp implements time-based one-time passwords (RFC 6238) as a
+// second authentication factor for the built-in identity providers.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"rsc.io/qr"
+)
+
+const (
+	totpFile = "totp"
+
+	period            = 30
+	digits            = 6
+	skew              = 1
+	numRecoveryCodes  = 10
+	maxFailures       = 5
+	challengeLifetime = 10 * time.Minute
+)
+
+var (
+	//go:embed totp-template.html
+	totpEmbed    string
+	totpTemplate *template.Template
+
+	b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+func init() {
+	totpTemplate = template.Must(template.New("totp").Parse(totpEmbed))
+}
+
+type EventRecorder interface {
+	Record(string)
+}
+
+// Logger is used to log errors.
+type Logger interface {
+	Errorf(format string, args ...any)
+}
+
+type defaultLogger struct{}
+
+func (defaultLogger) Errorf(format string, args ...any) {
+	log.Printf(format, args...)
+}
+
+// Config contains the parameters of the TOTP manager.
+type Config struct {
+	// Store is where the TOTP secrets are stored.
+	Store *storage.Storage
+	// Provider is the name of the identity provider. The enrollments of
+	// each provider are separate, since the providers don't identify the
+	// users the same way.
+	Provider string
+	// Issuer is the name shown in authenticator apps.
+	Issuer string
+	// Required indicates that users who haven't enrolled yet must do so
+	// before they can log in. Otherwise, enrollment is offered but can be
+	// skipped.
+	Required      bool
+	EventRecorder EventRecorder
+	// Logger is used to log errors. The default is to use the log
+	// package.
+	Logger Logger
+}
+
+// Manager verifies TOTP codes after the first authentication factor, and
+// lets users enroll their authenticator app.
+type Manager struct {
+	cfg Config
+
+	mu         sync.Mutex
+	challenges map[string]*challenge
+}
+
+type challenge struct {
+	created  time.Time
+	user     string
+	enroll   *enrollment
+	failures int
+	done     func(http.ResponseWriter, *http.Request)
+}
+
+type enrollment struct {
+	secret        []byte
+	recoveryCodes []string
+}
+
+type totpDB struct {
+	Users map[string]*userData `json:"users"`
+}
+
+type userData struct {
+	Secret        []byte    `json:"secret"`
+	RecoveryCodes [][]byte  `json:"recoveryCodes"`
+	LastStep      int64     `json:"lastStep"`
+	Created       time.Time `json:"created"`
+}
+
+// New returns a new TOTP manager.
+func New(cfg Config) (*Manager, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = defaultLogger{}
+	}
+	var db totpDB
+	cfg.Store.CreateEmptyFile(totpFile, &db)
+	if err := cfg.Store.ReadDataFile(totpFile, &db); err != nil {
+		return nil, err
+	}
+	return &Manager{
+		cfg:        cfg,
+		challenges: make(map[string]*challenge),
+	}, nil
+}
+
+// Challenge starts the second factor verification for user, who has already
+// been authenticated with the first factor. It returns an ID that must be
+// passed to the identity provider's endpoint in the totp parameter. done is
+// called when the verification succeeds.
+func (m *Manager) Challenge(user string, done func(http.ResponseWriter, *http.Request)) (string, error) {
+	enrolled, err := m.isEnrolled(user)
+	if err != nil {
+		return "", err
+	}
+	c := &challenge{
+		created: time.Now(),
+		user:    user,
+		done:    done,
+	}
+	if !enrolled {
+		if c.enroll, err = newEnrollment(); err != nil {
+			return "", err
+		}
+	}
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b[:])
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, v := range m.challenges {
+		if now.Sub(v.created) > challengeLifetime {
+			delete(m.challenges, k)
+		}
+	}
+	m.challenges[id] = c
+	return id, nil
+}
+
+// HandleRequest handles the requests that have a totp parameter. It returns
+// false if the request isn't a TOTP request.
+func (m *Manager) HandleRequest(w http.ResponseWriter, req *http.Request) bool {
+	req.ParseForm()
+	id := req.Form.Get("totp")
+	if id == "" {
+		return false
+	}
+	m.mu.Lock()
+	c, ok := m.challenges[id]
+	if ok && time.Since(c.created) > challengeLifetime {
+		delete(m.challenges, id)
+		ok = false
+	}
+	m.mu.Unlock()
+	if !ok {
+		http.Error(w, "invalid or expired request", http.StatusBadRequest)
+		return true
+	}
+
+	data := struct {
+		Self          string
+		ID            string
+		User          string
+		Enroll        bool
+		QRCode        string
+		Secret        string
+		RecoveryCodes []string
+		CanSkip       bool
+		Error         string
+	}{
+		Self:    req.URL.Path,
+		ID:      id,
+		User:    c.user,
+		Enroll:  c.enroll != nil,
+		CanSkip: c.enroll != nil && !m.cfg.Required,
+	}
+	if c.enroll != nil {
+		u := m.keyURI(c.user, c.enroll.secret)
+		code, err := qr.Encode(u, qr.M)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return true
+		}
+		data.QRCode = base64.StdEncoding.EncodeToString(code.PNG())
+		data.Secret = b32.EncodeToString(c.enroll.secret)
+		data.RecoveryCodes = c.enroll.recoveryCodes
+	}
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if req.Method == http.MethodPost {
+		ok, err := m.verify(c, req.PostForm.Get("code"), data.CanSkip && req.PostForm.Get("skip") != "")
+		if err != nil {
+			m.cfg.Logger.Errorf("ERR TOTP %q: %v", c.user, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return true
+		}
+		if ok {
+			m.mu.Lock()
+			delete(m.challenges, id)
+			m.mu.Unlock()
+			c.done(w, req)
+			return true
+		}
+		m.mu.Lock()
+		c.failures++
+		tooMany := c.failures >= maxFailures
+		if tooMany {
+			delete(m.challenges, id)
+		}
+		m.mu.Unlock()
+		m.cfg.EventRecorder.Record("totp verification failed")
+		if tooMany {
+			http.Error(w, "too many failed attempts", http.StatusForbidden)
+			return true
+		}
+		data.Error = "Invalid code"
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	if err := totpTemplate.Execute(w, data); err != nil {
+		m.cfg.Logger.Errorf("ERR totp-template: %v", err)
+	}
+	return true
+}
+
+func (m *Manager) verify(c *challenge, code string, skip bool) (bool, error) {
+	if skip {
+		m.cfg.EventRecorder.Record("totp enrollment skipped")
+		return true, nil
+	}
+	code = normalizeCode(code)
+	if c.enroll != nil {
+		step, ok := validateCode(c.enroll.secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		if err := m.enroll(c.user, c.enroll, step); err != nil {
+			return false, err
+		}
+		m.cfg.EventRecorder.Record("totp enrollment")
+		return true, nil
+	}
+	ok, err := m.check(c.user, code)
+	if ok {
+		m.cfg.EventRecorder.Record("totp verification")
+	}
+	return ok, err
+}
+
+func (m *Manager) keyURI(user string, secret []byte) string {
+	v := url.Values{}
+	v.Set("secret", b32.EncodeToString(secret))
+	v.Set("issuer", m.cfg.Issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(digits))
+	v.Set("period", fmt.Sprint(period))
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + m.cfg.Issuer + ":" + user,
+		RawQuery: v.Encode(),
+	}).String()
+}
+
+// key returns the key of the user's record, which is namespaced by identity
+// provider.
+func (m *Manager) key(user string) string {
+	return m.cfg.Provider + "/" + user
+}
+
+func (m *Manager) isEnrolled(user string) (bool, error) {
+	var db totpDB
+	if err := m.cfg.Store.ReadDataFile(totpFile, &db); err != nil {
+		return false, err
+	}
+	_, ok := db.Users[m.key(user)]
+	return ok, nil
+}
+
+func (m *Manager) enroll(user string, e *enrollment, step int64) (retErr error) {
+	var db totpDB
+	commit, err := m.cfg.Store.OpenForUpdate(totpFile, &db)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if db.Users == nil {
+		db.Users = make(map[string]*userData)
+	}
+	ud := &userData{
+		Secret:   e.secret,
+		LastStep: step,
+		Created:  time.Now().UTC(),
+	}
+	for _, rc := range e.recoveryCodes {
+		h := sha256.Sum256([]byte(normalizeCode(rc)))
+		ud.RecoveryCodes = append(ud.RecoveryCodes, h[:])
+	}
+	db.Users[m.key(user)] = ud
+	return commit(true, nil)
+}
+
+// check verifies a TOTP code or a recovery code. Codes can only be used once.
+func (m *Manager) check(user, code string) (ok bool, retErr error) {
+	var db totpDB
+	commit, err := m.cfg.Store.OpenForUpdate(totpFile, &db)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		commit(false, &retErr)
+		if retErr == storage.ErrRolledBack {
+			retErr = nil
+		}
+	}()
+	ud, exists := db.Users[m.key(user)]
+	if !exists {
+		return false, nil
+	}
+	if step, ok := validateCode(ud.Secret, code, time.Now()); ok {
+		if step <= ud.LastStep {
+			return false, nil
+		}
+		ud.LastStep = step
+		return true, commit(true, nil)
+	}
+	h := sha256.Sum256([]byte(code))
+	for i, rc := range ud.RecoveryCodes {
+		if subtle.ConstantTimeCompare(rc, h[:]) == 1 {
+			ud.RecoveryCodes = append(ud.RecoveryCodes[:i], ud.RecoveryCodes[i+1:]...)
+			m.cfg.EventRecorder.Record("totp recovery code used")
+			return true, commit(true, nil)
+		}
+	}
+	return false, nil
+}
+
+// DeleteUser removes the user's enrollment. The user will have to enroll
+// again on their next login.
+func (m *Manager) DeleteUser(user string) (retErr error) {
+	var db totpDB
+	commit, err := m.cfg.Store.OpenForUpdate(totpFile, &db)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	delete(db.Users, m.key(user))
+	return commit(true, nil)
+}
+
+func newEnrollment() (*enrollment, error) {
+	e := &enrollment{
+		secret: make([]byte, 20),
+	}
+	if _, err := io.ReadFull(rand.Reader, e.secret); err != nil {
+		return nil, err
+	}
+	for range numRecoveryCodes {
+		var b [6]byte
+		if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(b32.EncodeToString(b[:]))
+		e.recoveryCodes = append(e.recoveryCodes, s[:5]+"-"+s[5:])
+	}
+	return e, nil
+}
+
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// validateCode checks the code against the time steps around now, and
+// returns the matching step.
+func validateCode(secret []byte, code string, now time.Time) (int64, bool) {
+	if len(code) != digits {
+		return 0, false
+	}
+	step := now.Unix() / period
+	for i := int64(-skew); i <= skew; i++ {
+		if subtle.ConstantTimeCompare([]byte(generateCode(secret, step+i)), []byte(code)) == 1 {
+			return step + i, true
+		}
+	}
+	return 0, false
+}
+
+// generateCode implements the HOTP algorithm from RFC 4226.
+func generateCode(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, v%1000000)
+}
@@ -0,0 +1,191 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package totp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+type nopRecorder struct{}
+
+func (nopRecorder) Record(string) {}
+
+func TestGenerateCode(t *testing.T) {
+	// RFC 6238, Appendix B, truncated to 6 digits.
+	secret := []byte("12345678901234567890")
+	for _, tc := range []struct {
+		t    int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	} {
+		if got := generateCode(secret, tc.t/period); got != tc.want {
+			t.Errorf("generateCode(%d) = %q, want %q", tc.t, got, tc.want)
+		}
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateAESMasterKeyForTest: %v", err)
+	}
+	store := storage.New(t.TempDir(), mk)
+	m, err := New(Config{
+		Store:         store,
+		Provider:      "password",
+		Issuer:        "login.example.com",
+		Required:      true,
+		EventRecorder: nopRecorder{},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	var done int
+	doneFunc := func(w http.ResponseWriter, req *http.Request) {
+		done++
+		w.WriteHeader(http.StatusNoContent)
+	}
+	post := func(id, code string) int {
+		form := url.Values{}
+		form.Set("totp", id)
+		form.Set("code", code)
+		form.Set("skip", "1")
+		req := httptest.NewRequest("POST", "https://login.example.com/login", strings.NewReader(form.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		if !m.HandleRequest(w, req) {
+			t.Fatal("HandleRequest returned false")
+		}
+		return w.Code
+	}
+
+	// Enrollment.
+	id, err := m.Challenge("bob", doneFunc)
+	if err != nil {
+		t.Fatalf("Challenge: %v", err)
+	}
+	w := httptest.NewRecorder()
+	m.HandleRequest(w, httptest.NewRequest("GET", "https://login.example.com/login?totp="+id, nil))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("GET: status = %d, want %d", got, want)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "data:image/png;base64,") {
+		t.Errorf("GET: body doesn't contain QR code: %s", body)
+	}
+	m.mu.Lock()
+	enroll := m.challenges[id].enroll
+	m.mu.Unlock()
+	if enroll == nil {
+		t.Fatal("enroll is nil")
+	}
+	// Skip isn't allowed when TOTP is required.
+	if got, want := post(id, "000000"), http.StatusUnauthorized; got != want {
+		t.Errorf("POST(bad code) = %d, want %d", got, want)
+	}
+	now := time.Now()
+	if got, want := post(id, generateCode(enroll.secret, now.Unix()/period)), http.StatusNoContent; got != want {
+		t.Fatalf("POST(enroll) = %d, want %d", got, want)
+	}
+	if done != 1 {
+		t.Errorf("done = %d, want 1", done)
+	}
+
+	// Verification.
+	if id, err = m.Challenge("bob", doneFunc); err != nil {
+		t.Fatalf("Challenge: %v", err)
+	}
+	// The code used for enrollment can't be used again.
+	if got, want := post(id, generateCode(enroll.secret, now.Unix()/period)), http.StatusUnauthorized; got != want {
+		t.Errorf("POST(reused code) = %d, want %d", got, want)
+	}
+	if got, want := post(id, generateCode(enroll.secret, now.Unix()/period+1)), http.StatusNoContent; got != want {
+		t.Errorf("POST(next code) = %d, want %d", got, want)
+	}
+	if done != 2 {
+		t.Errorf("done = %d, want 2", done)
+	}
+
+	// Recovery codes can be used once.
+	for i, want := range []int{http.StatusNoContent, http.StatusUnauthorized} {
+		if id, err = m.Challenge("bob", doneFunc); err != nil {
+			t.Fatalf("Challenge: %v", err)
+		}
+		if got := post(id, strings.ToUpper(enroll.recoveryCodes[0])); got != want {
+			t.Errorf("[%d] POST(recovery code) = %d, want %d", i, got, want)
+		}
+	}
+
+	// Too many failures.
+	if id, err = m.Challenge("bob", doneFunc); err != nil {
+		t.Fatalf("Challenge: %v", err)
+	}
+	for range maxFailures - 1 {
+		post(id, "000000")
+	}
+	if got, want := post(id, "000000"), http.StatusForbidden; got != want {
+		t.Errorf("POST(too many) = %d, want %d", got, want)
+	}
+	if got, want := post(id, generateCode(enroll.secret, now.Unix()/period+1)), http.StatusBadRequest; got != want {
+		t.Errorf("POST(after too many) = %d, want %d", got, want)
+	}
+
+	if w := httptest.NewRecorder(); m.HandleRequest(w, httptest.NewRequest("GET", "https://login.example.com/login", nil)) {
+		t.Error("HandleRequest returned true for non-TOTP request")
+	}
+
+	// The enrollments of another identity provider are separate.
+	m2, err := New(Config{
+		Store:         store,
+		Provider:      "passkey",
+		Issuer:        "login.example.com",
+		Required:      true,
+		EventRecorder: nopRecorder{},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if enrolled, err := m2.isEnrolled("bob"); err != nil || enrolled {
+		t.Errorf("isEnrolled(bob) = %v, %v, want false", enrolled, err)
+	}
+	if err := m2.DeleteUser("bob"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if enrolled, err := m.isEnrolled("bob"); err != nil || !enrolled {
+		t.Errorf("isEnrolled(bob) = %v, %v, want true", enrolled, err)
+	}
+}
@@ -0,0 +1,282 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	k8sRetryDelay        = 5 * time.Second
+	k8sWatchTimeout      = 5 * time.Minute
+)
+
+// k8sEndpointSlice contains the fields that we need from a
+// discovery.k8s.io/v1 EndpointSlice.
+type k8sEndpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	AddressType string `json:"addressType"`
+	Endpoints   []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int32  `json:"port"`
+	} `json:"ports"`
+}
+
+type k8sEndpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []k8sEndpointSlice `json:"items"`
+}
+
+type k8sWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// k8sWatcher keeps a backend's addresses in sync with the EndpointSlices of
+// a Kubernetes service.
+type k8sWatcher struct {
+	be        *Backend
+	cfg       ConfigKubernetes
+	client    *http.Client
+	url       string
+	slices    map[string][]string
+	addresses []string
+}
+
+func (w *k8sWatcher) init() error {
+	if w.cfg.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return errors.New("not running in a kubernetes cluster, apiServer must be set")
+		}
+		w.cfg.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if w.cfg.TokenFile == "" {
+		w.cfg.TokenFile = k8sServiceAccountDir + "/token"
+	}
+	if w.cfg.CAFile == "" {
+		w.cfg.CAFile = k8sServiceAccountDir + "/ca.crt"
+	}
+	if w.cfg.Namespace == "" {
+		w.cfg.Namespace = "default"
+		if b, err := os.ReadFile(k8sServiceAccountDir + "/namespace"); err == nil {
+			w.cfg.Namespace = strings.TrimSpace(string(b))
+		}
+	}
+	tc := &tls.Config{}
+	if b, err := os.ReadFile(w.cfg.CAFile); err == nil {
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(b) {
+			return fmt.Errorf("%s: no certificates", w.cfg.CAFile)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	w.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tc,
+		},
+	}
+	w.url = fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?labelSelector=%s",
+		strings.TrimSuffix(w.cfg.APIServer, "/"),
+		url.PathEscape(w.cfg.Namespace),
+		url.QueryEscape("kubernetes.io/service-name="+w.cfg.Service))
+	return nil
+}
+
+func (w *k8sWatcher) run(ctx context.Context) {
+	if err := w.init(); err != nil {
+		w.be.logErrorF("ERR kubernetes %s: %v", w.cfg.Service, err)
+		return
+	}
+	for {
+		rv, err := w.list(ctx)
+		if err == nil {
+			err = w.watch(ctx, rv)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			w.be.logErrorF("ERR kubernetes %s/%s: %v", w.cfg.Namespace, w.cfg.Service, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(k8sRetryDelay):
+		}
+	}
+}
+
+func (w *k8sWatcher) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if token, err := os.ReadFile(w.cfg.TokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// list gets all the EndpointSlices of the service and returns the
+// resource version of the list.
+func (w *k8sWatcher) list(ctx context.Context) (string, error) {
+	resp, err := w.get(ctx, w.url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var list k8sEndpointSliceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+	w.slices = make(map[string][]string)
+	for _, s := range list.Items {
+		w.slices[s.Metadata.Name] = w.sliceAddresses(s)
+	}
+	w.update()
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies the changes to the EndpointSlices until the watch ends.
+func (w *k8sWatcher) watch(ctx context.Context, rv string) error {
+	resp, err := w.get(ctx, fmt.Sprintf("%s&watch=true&resourceVersion=%s&timeoutSeconds=%d",
+		w.url, url.QueryEscape(rv), int(k8sWatchTimeout.Seconds())))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var ev k8sWatchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if ev.Type == "ERROR" {
+			// The resource version is probably too old. Start over.
+			return fmt.Errorf("watch error: %s", ev.Object)
+		}
+		var s k8sEndpointSlice
+		if err := json.Unmarshal(ev.Object, &s); err != nil {
+			return err
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			w.slices[s.Metadata.Name] = w.sliceAddresses(s)
+		case "DELETED":
+			delete(w.slices, s.Metadata.Name)
+		default:
+			continue
+		}
+		w.update()
+	}
+}
+
+// sliceAddresses returns the addresses of the ready endpoints in s.
+func (w *k8sWatcher) sliceAddresses(s k8sEndpointSlice) []string {
+	if s.AddressType != "IPv4" && s.AddressType != "IPv6" {
+		return nil
+	}
+	var port string
+	for _, p := range s.Ports {
+		if p.Port == nil {
+			continue
+		}
+		if w.cfg.Port == "" || (p.Name != nil && *p.Name == w.cfg.Port) || strconv.Itoa(int(*p.Port)) == w.cfg.Port {
+			port = strconv.Itoa(int(*p.Port))
+			break
+		}
+	}
+	if port == "" {
+		return nil
+	}
+	var addrs []string
+	for _, ep := range s.Endpoints {
+		if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+			continue
+		}
+		for _, a := range ep.Addresses {
+			addrs = append(addrs, net.JoinHostPort(a, port))
+		}
+	}
+	return addrs
+}
+
+func (w *k8sWatcher) update() {
+	var addrs []string
+	for _, v := range w.slices {
+		addrs = append(addrs, v...)
+	}
+	slices.Sort(addrs)
+	addrs = slices.Compact(addrs)
+	if slices.Equal(addrs, w.addresses) {
+		return
+	}
+	w.addresses = addrs
+	w.be.setDiscoveredAddresses(addrs)
+	w.be.logErrorF("INF kubernetes %s/%s: %v", w.cfg.Namespace, w.cfg.Service, addrs)
+}
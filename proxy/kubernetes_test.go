@@ -0,0 +1,168 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestKubernetesDiscovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+	_, port, _ := net.SplitHostPort(be1.listener.Addr().String())
+
+	slice := func(rv string, ready bool) string {
+		return fmt.Sprintf(`{"metadata":{"name":"svc-abc","resourceVersion":%q},"addressType":"IPv4",`+
+			`"endpoints":[{"addresses":["127.0.0.1"],"conditions":{"ready":%v}},{"addresses":["127.0.0.2"],"conditions":{"ready":false}}],`+
+			`"ports":[{"name":"other","port":1},{"name":"tcp","port":%s}]}`, rv, ready, port)
+	}
+	events := make(chan string)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if got, want := req.URL.Path, "/apis/discovery.k8s.io/v1/namespaces/ns/endpointslices"; got != want {
+			t.Errorf("Path = %q, want %q", got, want)
+		}
+		if got, want := req.URL.Query().Get("labelSelector"), "kubernetes.io/service-name=svc"; got != want {
+			t.Errorf("labelSelector = %q, want %q", got, want)
+		}
+		if got, want := req.Header.Get("Authorization"), "Bearer TOKEN"; got != want {
+			t.Errorf("Authorization = %q, want %q", got, want)
+		}
+		if req.URL.Query().Get("watch") != "true" {
+			fmt.Fprintf(w, `{"metadata":{"resourceVersion":"1"},"items":[%s]}`, slice("1", true))
+			return
+		}
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case ev := <-events:
+				fmt.Fprintln(w, ev)
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	defer apiServer.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("TOKEN\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Kubernetes: &ConfigKubernetes{
+					Namespace: "ns",
+					Service:   "svc",
+					Port:      "tcp",
+					APIServer: apiServer.URL,
+					TokenFile: tokenFile,
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+	be := proxy.cfg.Backends[0]
+
+	waitFor := func(want []string) {
+		t.Helper()
+		for i := 0; ; i++ {
+			got := be.addresses()
+			if slices.Equal(got, want) {
+				return
+			}
+			if i == 100 {
+				t.Fatalf("addresses() = %v, want %v", got, want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	waitFor([]string{"127.0.0.1:" + port})
+
+	got, _, err := tlsGet("example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil)
+	if err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	if want := "Hello from backend1\n"; got != want {
+		t.Errorf("tlsGet() = %q, want %q", got, want)
+	}
+
+	events <- `{"type":"MODIFIED","object":` + slice("2", false) + `}`
+	waitFor(nil)
+	if got, _, _ := tlsGet("example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); got != "" {
+		t.Errorf("tlsGet() = %q, want no response", got)
+	}
+
+	events <- `{"type":"MODIFIED","object":` + slice("3", true) + `}`
+	waitFor([]string{"127.0.0.1:" + port})
+	events <- `{"type":"DELETED","object":` + slice("4", true) + `}`
+	waitFor(nil)
+
+	for _, k := range []*ConfigKubernetes{
+		{},
+		{Service: "svc", APIServer: "ftp://example.com"},
+	} {
+		cfg := &Config{
+			CacheDir: t.TempDir(),
+			Backends: []*Backend{{ServerNames: []string{"example.com"}, Kubernetes: k}},
+		}
+		if err := cfg.Check(); err == nil {
+			t.Errorf("Check() with %+v should fail", k)
+		}
+	}
+	cfg = &Config{
+		CacheDir: t.TempDir(),
+		Backends: []*Backend{{ServerNames: []string{"example.com"}, Addresses: []string{"127.0.0.1:1"}, Kubernetes: &ConfigKubernetes{Service: "svc"}}},
+	}
+	if err := cfg.Check(); err == nil {
+		t.Error("Check() with Addresses and Kubernetes should fail")
+	}
+}
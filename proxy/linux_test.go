@@ -0,0 +1,117 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSetTCPOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	defer conn.Close()
+
+	noDelay := false
+	setTCPOptions(conn, &TCPOptions{
+		NoDelay:           &noDelay,
+		KeepAliveIdle:     time.Minute,
+		KeepAliveInterval: 10 * time.Second,
+		KeepAliveCount:    3,
+		UserTimeout:       45 * time.Second,
+	})
+
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %v", err)
+	}
+	for _, tc := range []struct {
+		name  string
+		level int
+		opt   int
+		want  int
+	}{
+		{"TCP_NODELAY", unix.IPPROTO_TCP, unix.TCP_NODELAY, 0},
+		{"SO_KEEPALIVE", unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1},
+		{"TCP_KEEPIDLE", unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, 60},
+		{"TCP_KEEPINTVL", unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, 10},
+		{"TCP_KEEPCNT", unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 3},
+		{"TCP_USER_TIMEOUT", unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, 45000},
+	} {
+		var got int
+		var gerr error
+		if err := rc.Control(func(fd uintptr) {
+			got, gerr = unix.GetsockoptInt(int(fd), tc.level, tc.opt)
+		}); err != nil {
+			t.Fatalf("Control: %v", err)
+		}
+		if gerr != nil {
+			t.Fatalf("GetsockoptInt(%s): %v", tc.name, gerr)
+		}
+		if got != tc.want {
+			t.Errorf("%s = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	setTCPOptions(conn, &TCPOptions{KeepAliveIdle: -1})
+	rc.Control(func(fd uintptr) {
+		if v, _ := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_KEEPALIVE); v != 0 {
+			t.Errorf("SO_KEEPALIVE = %d, want 0", v)
+		}
+	})
+}
+
+func TestProcessStats(t *testing.T) {
+	n1, rss, err := processStats()
+	if err != nil {
+		t.Fatalf("processStats: %v", err)
+	}
+	if rss <= 0 {
+		t.Errorf("rss = %d, want > 0", rss)
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer l.Close()
+	n2, _, err := processStats()
+	if err != nil {
+		t.Fatalf("processStats: %v", err)
+	}
+	if n2 != n1+1 {
+		t.Errorf("openFiles = %d, want %d", n2, n1+1)
+	}
+}
@@ -0,0 +1,134 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestListeners(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+	be2 := newTCPServer(t, ctx, "backend2", nil)
+	intCA, err := certmanager.New("internal-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be3 := newTCPServer(t, ctx, "backend3", intCA)
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				Name:        "public",
+				ServerNames: []string{"www.example.com"},
+				Addresses:   []string{be1.listener.Addr().String()},
+			},
+			{
+				Name:        "admin",
+				ServerNames: []string{"admin.example.com"},
+				Addresses:   []string{be2.listener.Addr().String()},
+			},
+			{
+				ServerNames:       []string{"tls.example.com"},
+				Addresses:         []string{be3.listener.Addr().String()},
+				Mode:              "TLS",
+				ForwardRootCAs:    []string{intCA.RootCAPEM()},
+				ForwardServerName: "tls-internal.example.com",
+			},
+		},
+		Listeners: []*ConfigListener{
+			{
+				Address:  freeAddr(t),
+				Backends: []string{"admin"},
+			},
+			{
+				Address: freeAddr(t),
+				Modes:   []string{"tls"},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	mainAddr := proxy.listener.Addr().String()
+	adminAddr := proxy.listeners[0].Addr().String()
+	tlsAddr := proxy.listeners[1].Addr().String()
+
+	for _, tc := range []struct {
+		host    string
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{host: "www.example.com", addr: mainAddr, want: "Hello from backend1\n"},
+		{host: "www.example.com", addr: adminAddr, wantErr: true},
+		{host: "admin.example.com", addr: mainAddr, wantErr: true},
+		{host: "admin.example.com", addr: adminAddr, want: "Hello from backend2\n"},
+		{host: "tls.example.com", addr: mainAddr, wantErr: true},
+		{host: "tls.example.com", addr: adminAddr, wantErr: true},
+		{host: "tls.example.com", addr: tlsAddr, want: "Hello from backend3\n"},
+		{host: "www.example.com", addr: tlsAddr, wantErr: true},
+	} {
+		got, _, err := tlsGet(tc.host, tc.addr, "Hello!\n", extCA, nil, nil)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("tlsGet(%q, %q) = %q, want error", tc.host, tc.addr, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("tlsGet(%q, %q): %v", tc.host, tc.addr, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("tlsGet(%q, %q) = %q, want %q", tc.host, tc.addr, got, tc.want)
+		}
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
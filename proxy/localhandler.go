@@ -0,0 +1,74 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// LocalHandler is an HTTP handler that is served by the proxy itself, e.g. a
+// custom endpoint added by a program that uses the proxy as a library.
+type LocalHandler struct {
+	// Description is a short description of the handler that is shown on
+	// the metrics page.
+	Description string
+	// URL is the URL of the handler, e.g. https://www.example.com/hello.
+	// Its host must be one of the server names of a backend.
+	URL string
+	// Handler is the handler that serves the requests.
+	Handler http.Handler
+	// SSOBypass indicates that the backend's SSO policy is not enforced
+	// for this handler.
+	SSOBypass bool
+	// MatchPrefix indicates that the handler also serves all the paths
+	// under the URL's path.
+	MatchPrefix bool
+}
+
+// AddLocalHandlers adds local handlers to the backends that match their URLs.
+// The handlers remain registered when the configuration changes.
+func (p *Proxy) AddLocalHandlers(handlers ...LocalHandler) error {
+	for _, h := range handlers {
+		if h.Handler == nil {
+			return errors.New("Handler must be set")
+		}
+		if _, _, _, err := hostAndPath(h.URL); err != nil {
+			return fmt.Errorf("%s: %w", h.URL, err)
+		}
+	}
+	p.mu.Lock()
+	p.customHandlers = append(p.customHandlers, handlers...)
+	p.customHandlersChanged = true
+	p.mu.Unlock()
+
+	p.dynMu.Lock()
+	cfg := p.userCfg
+	p.dynMu.Unlock()
+	if cfg == nil {
+		return nil
+	}
+	return p.Reconfigure(cfg)
+}
@@ -0,0 +1,107 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestAddLocalHandlers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Mode:        "LOCAL",
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	get := func(path string) string {
+		got, _, err := httpGet("www.example.com", proxy.listener.Addr().String(), path, extCA, nil)
+		if err != nil {
+			t.Fatalf("httpGet: %v", err)
+		}
+		return got
+	}
+	if got, want := get("/hello"), "HTTP/2.0 404 Not Found\n404 page not found\n"; got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+
+	if err := proxy.AddLocalHandlers(LocalHandler{URL: "https://www.example.com/hello"}); err == nil {
+		t.Error("AddLocalHandlers() without Handler succeeded")
+	}
+	if err := proxy.AddLocalHandlers(
+		LocalHandler{
+			URL: "https://www.example.com/hello",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte("Hello!\n"))
+			}),
+		},
+		LocalHandler{
+			URL:         "https://www.example.com/api",
+			MatchPrefix: true,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte("API " + req.URL.Path + "\n"))
+			}),
+		},
+	); err != nil {
+		t.Fatalf("AddLocalHandlers: %v", err)
+	}
+	if got, want := get("/hello"), "HTTP/2.0 200 OK\nHello!\n"; got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+	if got, want := get("/api/foo"), "HTTP/2.0 200 OK\nAPI /api/foo\n"; got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+
+	// The handlers are kept when the configuration changes.
+	cfg = cfg.clone()
+	cfg.MaxOpen = 200
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("Reconfigure: %v", err)
+	}
+	if got, want := get("/hello"), "HTTP/2.0 200 OK\nHello!\n"; got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+}
@@ -24,7 +24,10 @@
 package proxy
 
 import (
+	"fmt"
 	"log"
+	"math/rand/v2"
+	"net/http"
 )
 
 type logType int
@@ -36,21 +39,21 @@ const (
 )
 
 func (p *Proxy) logConnF(format string, args ...any) {
-	if p.cfg == nil || !shouldLog(logConnection, p.cfg.LogFilter) {
+	if lf := p.logFilter.Load(); lf == nil || !shouldLog(logConnection, *lf) {
 		return
 	}
 	log.Printf(format, args...)
 }
 
 func (p *Proxy) logError(args ...any) {
-	if p.cfg != nil && !shouldLog(logError, p.cfg.LogFilter) {
+	if lf := p.logFilter.Load(); lf != nil && !shouldLog(logError, *lf) {
 		return
 	}
 	log.Print(args...)
 }
 
 func (p *Proxy) logErrorF(format string, args ...any) {
-	if p.cfg != nil && !shouldLog(logError, p.cfg.LogFilter) {
+	if lf := p.logFilter.Load(); lf != nil && !shouldLog(logError, *lf) {
 		return
 	}
 	log.Printf(format, args...)
@@ -63,11 +66,22 @@ func (be *Backend) logConnF(format string, args ...any) {
 	log.Printf(format, args...)
 }
 
-func (be *Backend) logRequestF(format string, args ...any) {
+// logHTTPRequest logs an http request. The requests that don't fail are
+// sampled according to RequestSampleRate, and the fields listed in Redact are
+// redacted. A code of 0 means that the status is not known yet.
+func (be *Backend) logHTTPRequest(typ string, req *http.Request, target string, code int, note string) {
 	if !shouldLog(logRequest, be.LogFilter, be.defaultLogFilter) {
 		return
 	}
-	log.Printf(format, args...)
+	if code < 400 && !sampleRequest(be.LogFilter, be.defaultLogFilter) {
+		return
+	}
+	r := newLogRedactor(be.LogFilter, be.defaultLogFilter)
+	var status string
+	if code != 0 {
+		status = fmt.Sprintf(" ➔ status:%d", code)
+	}
+	log.Printf("%s %s ➔ %s %s%s%s (%q)", typ, formatReqDescRedacted(req, r), req.Method, r.target(target), status, note, r.value(redactUserAgent, userAgent(req)))
 }
 
 func (be *Backend) logErrorF(format string, args ...any) {
@@ -84,6 +98,15 @@ func (be *Backend) logError(args ...any) {
 	log.Print(args...)
 }
 
+func sampleRequest(f ...LogFilter) bool {
+	for _, ff := range f {
+		if ff.RequestSampleRate != nil {
+			return *ff.RequestSampleRate >= 1 || rand.Float64() < *ff.RequestSampleRate
+		}
+	}
+	return true
+}
+
 func shouldLog(typ logType, f ...LogFilter) bool {
 	if typ == logConnection {
 		for _, ff := range f {
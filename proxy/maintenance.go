@@ -0,0 +1,149 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// maintenanceSet contains the maintenance mode of the backends that was
+// changed at runtime. It is not affected by configuration changes.
+type maintenanceSet struct {
+	mu sync.Mutex
+	m  map[string]bool
+}
+
+func (s *maintenanceSet) set(id string, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string]bool)
+	}
+	s.m[id] = enabled
+}
+
+func (s *maintenanceSet) get(id string) (enabled, ok bool) {
+	if s == nil {
+		return false, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	enabled, ok = s.m[id]
+	return
+}
+
+// maintenanceID returns the name that identifies the backend in the
+// maintenance API, i.e. its Name or its first server name.
+func (be *Backend) maintenanceID() string {
+	if be.Name != "" {
+		return be.Name
+	}
+	if len(be.ServerNames) > 0 {
+		return idnaToUnicode(be.ServerNames[0])
+	}
+	return ""
+}
+
+// inMaintenance returns true if the backend is in maintenance mode.
+func (be *Backend) inMaintenance() bool {
+	if be.Mode == ModeConsole {
+		return false
+	}
+	if enabled, ok := be.maintenanceState.get(be.maintenanceID()); ok {
+		return enabled
+	}
+	return be.Maintenance != nil && be.Maintenance.Enabled
+}
+
+// checkMaintenance responds with 503 Service Unavailable when the backend is
+// in maintenance mode. It returns false when the request should not be
+// processed any further.
+func (be *Backend) checkMaintenance(w http.ResponseWriter, req *http.Request) bool {
+	if !be.inMaintenance() {
+		return true
+	}
+	be.recordEvent("maintenance: request rejected")
+	w.Header().Set("Cache-Control", "no-store")
+	var page []byte
+	if m := be.Maintenance; m != nil {
+		if m.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(m.RetryAfter.Seconds()), 10))
+		}
+		page = m.errorPage
+	}
+	if page == nil {
+		http.Error(w, "This service is down for maintenance. Please try again later.", http.StatusServiceUnavailable)
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if req.Method != http.MethodHead {
+		w.Write(page)
+	}
+	return false
+}
+
+func (p *Proxy) maintenanceHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || req.Header.Get("x-csrf-check") != "1" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	req.ParseForm()
+	id := req.PostForm.Get("backend")
+	enabled, err := strconv.ParseBool(req.PostForm.Get("enabled"))
+	if id == "" || err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	p.mu.RLock()
+	var found bool
+	if p.cfg != nil {
+		for _, be := range p.cfg.Backends {
+			if be.Mode != ModeConsole && be.maintenanceID() == id {
+				found = true
+				break
+			}
+		}
+	}
+	p.mu.RUnlock()
+	if !found {
+		http.Error(w, "unknown backend", http.StatusBadRequest)
+		return
+	}
+	p.maintenance.set(id, enabled)
+	var admin string
+	if claims := claimsFromCtx(req.Context()); claims != nil {
+		admin, _ = claims["email"].(string)
+	}
+	if enabled {
+		p.recordEvent("maintenance mode enabled")
+		p.logErrorF("INF Maintenance mode of %q enabled by %q", id, admin)
+	} else {
+		p.recordEvent("maintenance mode disabled")
+		p.logErrorF("INF Maintenance mode of %q disabled by %q", id, admin)
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,166 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestMaintenance(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	httpBE := newHTTPServer(t, ctx, "http-backend", nil)
+	tcpBE := newTCPServer(t, ctx, "tcp-backend", nil)
+
+	errorPage := filepath.Join(t.TempDir(), "maintenance.html")
+	if err := os.WriteFile(errorPage, []byte("<h1>Be right back</h1>"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{
+						"www.example.com",
+					},
+					Addresses: []string{
+						httpBE.String(),
+					},
+					Mode: "HTTP",
+					Maintenance: &Maintenance{
+						Enabled:    true,
+						ErrorPage:  errorPage,
+						RetryAfter: time.Hour,
+					},
+				},
+				{
+					Name: "tcp",
+					ServerNames: []string{
+						"tcp.example.com",
+					},
+					Addresses: []string{
+						tcpBE.listener.Addr().String(),
+					},
+					Mode: "TCP",
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+
+	setMaintenance := func(id string, enabled bool) int {
+		req := httptest.NewRequest("POST", "/maintenance", strings.NewReader(url.Values{"backend": {id}, "enabled": {strconv.FormatBool(enabled)}}.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.Header.Set("x-csrf-check", "1")
+		w := httptest.NewRecorder()
+		proxy.maintenanceHandler(w, req)
+		return w.Code
+	}
+	httpGetBody := func() string {
+		got, _, err := httpGet("www.example.com", proxy.listener.Addr().String(), "/", extCA, nil)
+		if err != nil {
+			t.Fatalf("httpGet: %v", err)
+		}
+		return got
+	}
+	tlsGetErr := func() error {
+		_, _, err := tlsGet("tcp.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil)
+		return err
+	}
+
+	if got, want := httpGetBody(), "HTTP/2.0 503 Service Unavailable\n<h1>Be right back</h1>"; got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+	if err := tlsGetErr(); err != nil {
+		t.Errorf("tlsGet: %v", err)
+	}
+
+	if got, want := setMaintenance("unknown", true), http.StatusBadRequest; got != want {
+		t.Errorf("setMaintenance(unknown) = %d, want %d", got, want)
+	}
+	if got, want := setMaintenance("www.example.com", false), http.StatusOK; got != want {
+		t.Errorf("setMaintenance(www) = %d, want %d", got, want)
+	}
+	if got, want := setMaintenance("tcp", true), http.StatusOK; got != want {
+		t.Errorf("setMaintenance(tcp) = %d, want %d", got, want)
+	}
+
+	if got, want := httpGetBody(), "HTTP/2.0 200 OK\n[http-backend] /\n"; got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+	if err := tlsGetErr(); err == nil || !strings.Contains(err.Error(), "internal error") {
+		t.Errorf("tlsGet: %v, want internal error", err)
+	}
+}
+
+func TestCheckMaintenance(t *testing.T) {
+	be := &Backend{
+		Mode: ModeHTTP,
+		Maintenance: &Maintenance{
+			Enabled:    true,
+			RetryAfter: 90 * time.Second,
+		},
+		recordEvent: func(string) {},
+	}
+	w := httptest.NewRecorder()
+	if be.checkMaintenance(w, httptest.NewRequest("GET", "/", nil)) {
+		t.Fatal("checkMaintenance returned true")
+	}
+	if got, want := w.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("Code = %d, want %d", got, want)
+	}
+	if got, want := w.Header().Get("Retry-After"), "90"; got != want {
+		t.Errorf("Retry-After = %q, want %q", got, want)
+	}
+
+	be.Maintenance.Enabled = false
+	if !be.checkMaintenance(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)) {
+		t.Error("checkMaintenance returned false")
+	}
+}
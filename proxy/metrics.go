@@ -26,6 +26,7 @@ package proxy
 import (
 	"bytes"
 	_ "embed"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -40,6 +41,7 @@ import (
 	yaml "gopkg.in/yaml.v3"
 
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/counter"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/histogram"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
 )
 
@@ -57,12 +59,27 @@ func init() {
 }
 
 func (p *Proxy) recordEvent(msg string) {
+	p.recordBackendEvent("", msg)
+}
+
+func (p *Proxy) recordBackendEvent(backend, msg string) {
 	p.eventsmu.Lock()
 	defer p.eventsmu.Unlock()
 	if p.events == nil {
 		p.events = make(map[string]int64)
 	}
 	p.events[msg]++
+	if p.eventLog == nil {
+		return
+	}
+	if err := p.eventLog.add(loggedEvent{
+		Time:    time.Now().UTC(),
+		Type:    eventType(msg),
+		Backend: backend,
+		Message: msg,
+	}); err != nil {
+		p.logErrorF("ERR Event log: %v", err)
+	}
 }
 
 type counterSetter interface {
@@ -70,13 +87,18 @@ type counterSetter interface {
 }
 
 func (p *Proxy) setCounters(c counterSetter, serverName string) {
+	m := p.metricsFor(serverName)
+	m.numConnections.Incr(1)
+	c.SetCounters(m.numBytesSent, m.numBytesReceived)
+}
+
+// metricsFor returns the metrics of serverName, creating them if needed.
+func (p *Proxy) metricsFor(serverName string) *backendMetrics {
 	p.mu.RLock()
 	if p.metrics != nil {
 		if m := p.metrics[serverName]; m != nil {
-			m.numConnections.Incr(1)
-			c.SetCounters(m.numBytesSent, m.numBytesReceived)
 			p.mu.RUnlock()
-			return
+			return m
 		}
 	}
 	p.mu.RUnlock()
@@ -92,11 +114,13 @@ func (p *Proxy) setCounters(c counterSetter, serverName string) {
 			numConnections:   counter.New(time.Minute, time.Second),
 			numBytesSent:     counter.New(time.Minute, time.Second),
 			numBytesReceived: counter.New(time.Minute, time.Second),
+			handshakeTime:    histogram.New(),
+			dialTime:         histogram.New(),
+			totalTime:        histogram.New(),
 		}
 		p.metrics[serverName] = m
 	}
-	m.numConnections.Incr(1)
-	c.SetCounters(m.numBytesSent, m.numBytesReceived)
+	return m
 }
 
 func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
@@ -107,6 +131,16 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	if req.Form.Get("format") == "json" {
+		w.Header().Set("content-type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(p.runtimeStats()); err != nil {
+			p.logErrorF("ERR metrics: %v", err)
+		}
+		return
+	}
+
 	type backendMetric struct {
 		ServerName     string
 		NumConnections int64
@@ -115,6 +149,12 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		EgressRate     string
 		IngressRate    string
 	}
+	type latencyMetric struct {
+		ServerName string
+		Handshake  [3]string
+		Dial       [3]string
+		Total      [3]string
+	}
 	type proxyEvent struct {
 		Description string
 		Count       int64
@@ -161,7 +201,18 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		HostPath string
 		Desc     string
 	}
+	type backendAddress struct {
+		Addr     string
+		Draining bool
+	}
+	type quotaUsage struct {
+		User    string
+		Daily   string
+		Monthly string
+	}
 	type backend struct {
+		ID           string
+		Maintenance  bool
 		Mode         string
 		ALPNProtos   string
 		BackendProto string
@@ -169,20 +220,12 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		SSO          string
 		DocumentRoot string
 		ServerNames  []string
-		Addresses    []string
+		Addresses    []backendAddress
+		Canary       []string
+		Quota        string
+		QuotaUsage   []quotaUsage
 		Handlers     []handler
 	}
-	type runtimeData struct {
-		Uptime       string
-		NumCPU       int
-		NumGoroutine int
-		Mallocs      uint64
-		Frees        uint64
-		HeapObjects  uint64
-		HeapAlloc    uint64
-		NextGC       uint64
-		NumGC        uint32
-	}
 	type memoryProf struct {
 		Size  int64
 		Count int64
@@ -197,16 +240,25 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		Count int
 		Func  string
 	}
+	type adminLink struct {
+		Desc string
+		URL  string
+	}
 
 	var data struct {
 		Email              string
 		Version            string
 		Metrics            []backendMetric
+		Latency            []latencyMetric
 		Events             []proxyEvent
+		EventLog           bool
 		Connections        []connection
 		BackendConnections []beConnectionList
 		Backends           []backend
-		Runtime            runtimeData
+		AdminLinks         []adminLink
+		Draining           []string
+		Diagnostics        *struct{ Enabled bool }
+		Runtime            runtimeStats
 		Memory             []memoryProf
 		Mutex              []mutexProf
 		Goroutines         []goroutine
@@ -263,8 +315,21 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 			IngressRate:    formatSize10(totals[s].numBytesReceived.Rate(time.Minute)) + "/s",
 		})
 	}
+	for _, s := range serverNames {
+		m := totals[s]
+		if m.handshakeTime.Count() == 0 && m.dialTime.Count() == 0 && m.totalTime.Count() == 0 {
+			continue
+		}
+		data.Latency = append(data.Latency, latencyMetric{
+			ServerName: s,
+			Handshake:  formatPercentiles(m.handshakeTime),
+			Dial:       formatPercentiles(m.dialTime),
+			Total:      formatPercentiles(m.totalTime),
+		})
+	}
 
 	p.eventsmu.Lock()
+	data.EventLog = p.eventLog != nil
 	events := make([]string, 0, len(p.events))
 	for k := range p.events {
 		events = append(events, k)
@@ -410,8 +475,12 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		backend := backend{
 			Mode: be.Mode,
 		}
-		if be.SSO != nil {
-			backend.SSO = fmt.Sprintf(" SSO %s %s", be.SSO.Provider, strings.Join(be.SSO.Paths, ","))
+		if be.Mode != ModeConsole {
+			backend.ID = be.maintenanceID()
+			backend.Maintenance = be.inMaintenance()
+		}
+		for _, sso := range be.ssoPolicies() {
+			backend.SSO += fmt.Sprintf(" SSO %s %s", sso.Provider, strings.Join(sso.Paths, ","))
 		}
 		if be.ClientAuth != nil {
 			backend.ClientAuth = " TLS ClientAuth"
@@ -427,7 +496,38 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		for _, sn := range be.ServerNames {
 			backend.ServerNames = append(backend.ServerNames, idnaToUnicode(sn))
 		}
-		backend.Addresses = slices.Clone(be.Addresses)
+		for _, addr := range be.addresses() {
+			backend.Addresses = append(backend.Addresses, backendAddress{
+				Addr:     addr,
+				Draining: p.draining.isDraining(addr),
+			})
+		}
+		for _, c := range be.Canary {
+			match := "Header " + c.Header
+			if c.Cookie != "" {
+				match = "Cookie " + c.Cookie
+			}
+			if c.Value != "" {
+				match += "=" + c.Value
+			}
+			backend.Canary = append(backend.Canary, match+" -> "+strings.Join(c.Addresses, ", "))
+		}
+		if q := be.TrafficQuota; q != nil {
+			formatQuota := func(n int64) string {
+				if n == 0 {
+					return "unlimited"
+				}
+				return formatSize10(n)
+			}
+			backend.Quota = fmt.Sprintf("daily %s, monthly %s", formatQuota(q.Daily), formatQuota(q.Monthly))
+			for _, u := range p.quotas.list(be.maintenanceID(), time.Now()) {
+				backend.QuotaUsage = append(backend.QuotaUsage, quotaUsage{
+					User:    u.User,
+					Daily:   formatSize10(u.Daily),
+					Monthly: formatSize10(u.Monthly),
+				})
+			}
+		}
 		for _, h := range be.localHandlers {
 			host := "<any>"
 			if h.host != "" {
@@ -442,17 +542,33 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		data.Backends = append(data.Backends, backend)
 	}
 
-	data.Runtime.Uptime = time.Since(p.startTime).Truncate(time.Second).String()
-	data.Runtime.NumCPU = runtime.NumCPU()
-	data.Runtime.NumGoroutine = runtime.NumGoroutine()
-	var memStats runtime.MemStats
-	runtime.ReadMemStats(&memStats)
-	data.Runtime.Mallocs = memStats.Mallocs
-	data.Runtime.Frees = memStats.Frees
-	data.Runtime.HeapObjects = memStats.HeapObjects
-	data.Runtime.HeapAlloc = memStats.HeapAlloc
-	data.Runtime.NextGC = memStats.NextGC
-	data.Runtime.NumGC = memStats.NumGC
+	for _, pp := range p.cfg.PasskeyProviders {
+		if len(pp.Admins) == 0 {
+			continue
+		}
+		for _, be := range p.cfg.Backends {
+			usesProvider := slices.ContainsFunc(be.ssoPolicies(), func(sso *BackendSSO) bool {
+				return sso.Provider == pp.Name
+			})
+			if !usesProvider || len(be.ServerNames) == 0 {
+				continue
+			}
+			data.AdminLinks = append(data.AdminLinks, adminLink{
+				Desc: fmt.Sprintf("Passkeys (%s)", pp.Name),
+				URL:  "https://" + be.ServerNames[0] + "/.sso/passkeys?admin=1",
+			})
+			break
+		}
+	}
+
+	if c, ok := req.Context().Value(connCtxKey).(anyConn); ok {
+		if be := connBackend(c); be != nil && p.diagnosticsAllowed(be, req) {
+			data.Diagnostics = &struct{ Enabled bool }{Enabled: p.diagnosticsEnabled(be)}
+		}
+	}
+
+	data.Draining = p.draining.list()
+	data.Runtime = p.runtimeStats()
 
 	getFunc := func(stack [32]uintptr, n int) string {
 		var out []string
@@ -584,6 +700,11 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 	for _, p := range cfg.OIDCProviders {
 		p.ClientSecret = "**REDACTED**"
 	}
+	for _, p := range cfg.LDAPProviders {
+		if p.BindPassword != "" {
+			p.BindPassword = "**REDACTED**"
+		}
+	}
 	for _, be := range cfg.Backends {
 		if be.SSO == nil || be.SSO.LocalOIDCServer == nil {
 			continue
@@ -604,6 +725,120 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("content-length", fmt.Sprintf("%d", buf.Len()))
 }
 
+// runtimeStats contains the Go runtime and process metrics. The fields that
+// are not available on this platform are -1.
+type runtimeStats struct {
+	Uptime        string
+	NumCPU        int
+	NumGoroutine  int
+	Mallocs       uint64
+	Frees         uint64
+	HeapObjects   uint64
+	HeapAlloc     uint64
+	HeapInuse     uint64
+	HeapSys       uint64
+	StackInuse    uint64
+	Sys           uint64
+	NextGC        uint64
+	NumGC         uint32
+	GCPauseTotal  time.Duration
+	GCPauseLast   time.Duration
+	GCPauseMax    time.Duration
+	GCCPUFraction float64
+	OpenConns     int
+	MaxOpen       int
+	OpenFiles     int
+	OpenFileLimit int
+	RSS           int64
+	Overloaded    bool
+}
+
+func (p *Proxy) runtimeStats() runtimeStats {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	rs := runtimeStats{
+		Uptime:        time.Since(p.startTime).Truncate(time.Second).String(),
+		NumCPU:        runtime.NumCPU(),
+		NumGoroutine:  runtime.NumGoroutine(),
+		Mallocs:       memStats.Mallocs,
+		Frees:         memStats.Frees,
+		HeapObjects:   memStats.HeapObjects,
+		HeapAlloc:     memStats.HeapAlloc,
+		HeapInuse:     memStats.HeapInuse,
+		HeapSys:       memStats.HeapSys,
+		StackInuse:    memStats.StackInuse,
+		Sys:           memStats.Sys,
+		NextGC:        memStats.NextGC,
+		NumGC:         memStats.NumGC,
+		GCPauseTotal:  time.Duration(memStats.PauseTotalNs),
+		GCCPUFraction: memStats.GCCPUFraction,
+		OpenConns:     p.inConns.count(),
+		MaxOpen:       p.cfg.MaxOpen,
+		OpenFiles:     -1,
+		OpenFileLimit: -1,
+		RSS:           -1,
+		Overloaded:    p.overloaded.Load(),
+	}
+	if memStats.NumGC > 0 {
+		rs.GCPauseLast = time.Duration(memStats.PauseNs[(memStats.NumGC+255)%256])
+		// PauseNs is a circular buffer of the most recent pauses.
+		for _, ns := range memStats.PauseNs[:min(memStats.NumGC, 256)] {
+			rs.GCPauseMax = max(rs.GCPauseMax, time.Duration(ns))
+		}
+	}
+	if n, err := currentOpenFileLimit(); err == nil {
+		rs.OpenFileLimit = n
+	}
+	if n, rss, err := processStats(); err == nil {
+		rs.OpenFiles = n
+		rs.RSS = rss
+	}
+	return rs
+}
+
+// formatPercentiles returns the p50, p95, and p99 of h.
+func formatPercentiles(h *histogram.Histogram) [3]string {
+	if h.Count() == 0 {
+		return [3]string{"-", "-", "-"}
+	}
+	var out [3]string
+	for i, p := range []float64{50, 95, 99} {
+		d := h.Percentile(p)
+		if d >= 10*time.Millisecond {
+			d = d.Round(time.Millisecond)
+		} else {
+			d = d.Round(10 * time.Microsecond)
+		}
+		out[i] = d.String()
+	}
+	return out
+}
+
+func (p *Proxy) revokeSessionsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || req.Header.Get("x-csrf-check") != "1" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	req.ParseForm()
+	email := req.PostForm.Get("email")
+	if email == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := p.tokenManager.Revocations().RevokeUser(email); err != nil {
+		p.logErrorF("ERR RevokeUser: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var admin string
+	if claims := claimsFromCtx(req.Context()); claims != nil {
+		admin, _ = claims["email"].(string)
+	}
+	p.recordEvent("user sessions revoked")
+	p.logErrorF("INF Sessions of %s revoked by %q", email, admin)
+	w.Write([]byte("ok\n"))
+}
+
 func (p *Proxy) faviconHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "image/png")
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(iconBytes)))
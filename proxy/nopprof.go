@@ -25,5 +25,6 @@
 
 package proxy
 
-func addPProfHandlers(*[]localHandler) {
-}
+// pprofBuildTag indicates that the binary was built with the pprof tag. The
+// diagnostics handlers are then enabled by default on the console backends.
+const pprofBuildTag = false
@@ -0,0 +1,339 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/time/rate"
+)
+
+var (
+	errOnDemandRateLimit = errors.New("on-demand certificate rate limit exceeded")
+	errOnDemandFailed    = errors.New("on-demand certificate recently failed")
+	errOnDemandDenied    = errors.New("on-demand certificate denied")
+)
+
+// maxOnDemandNames is the maximum number of server names whose state is kept
+// in memory. The ready names that are evicted are found in the cache again.
+const maxOnDemandNames = 10000
+
+// onDemandAskClient is the HTTP client used to query the Ask URLs. The TLS
+// handshakes wait for the answer.
+var onDemandAskClient = &http.Client{Timeout: 5 * time.Second}
+
+type onDemandState int
+
+const (
+	// onDemandReady means that the certificate was already obtained.
+	onDemandReady onDemandState = iota
+	// onDemandPending means that the certificate is being obtained.
+	onDemandPending
+	// onDemandStarted means that the caller must obtain the certificate,
+	// and then call done().
+	onDemandStarted
+)
+
+// onDemandCerts keeps track of the certificates that are obtained on first
+// use. It is not affected by configuration changes. The pending names and
+// the names being asked about are bounded by the rate limits.
+type onDemandCerts struct {
+	mu       sync.Mutex
+	ready    *lru.Cache[string, bool]
+	failed   *lru.Cache[string, time.Time]
+	pending  map[string]bool
+	asking   map[string]chan struct{}
+	limiters map[string]*rate.Limiter
+}
+
+func (c *onDemandCerts) init() {
+	if c.ready != nil {
+		return
+	}
+	c.ready, _ = lru.New[string, bool](maxOnDemandNames)
+	c.failed, _ = lru.New[string, time.Time](maxOnDemandNames)
+	c.pending = make(map[string]bool)
+	c.asking = make(map[string]chan struct{})
+	c.limiters = make(map[string]*rate.Limiter)
+}
+
+// check returns the state of serverName when it is known, i.e. ready,
+// pending, or recently failed. c.mu must be held.
+func (c *onDemandCerts) check(od *OnDemandTLS, serverName string) (onDemandState, bool, error) {
+	c.init()
+	if c.ready.Contains(serverName) {
+		return onDemandReady, true, nil
+	}
+	if c.pending[serverName] {
+		return onDemandPending, true, nil
+	}
+	if t, ok := c.failed.Get(serverName); ok {
+		if time.Since(t) < od.FailureBackoff {
+			return 0, true, errOnDemandFailed
+		}
+		c.failed.Remove(serverName)
+	}
+	return 0, false, nil
+}
+
+// start returns the state of the certificate for serverName. When the
+// certificate wasn't obtained yet, the rate limit allows it, and the Ask URL
+// approves the name, the state changes to pending. The Ask URL is queried
+// once at a time for each name, and its errors aren't retried before
+// OnDemandTLS.FailureBackoff.
+func (c *onDemandCerts) start(be *Backend, serverName string, cached func(string) bool) (onDemandState, error) {
+	od := be.OnDemandTLS
+	c.mu.Lock()
+	if state, ok, err := c.check(od, serverName); ok {
+		c.mu.Unlock()
+		return state, err
+	}
+	c.mu.Unlock()
+
+	if cached(serverName) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.ready.Add(serverName, true)
+		return onDemandReady, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if state, ok, err := c.check(od, serverName); ok {
+			return state, err
+		}
+		ch, ok := c.asking[serverName]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		<-ch
+		c.mu.Lock()
+	}
+	perHour := od.CertificatesPerHour
+	limit := rate.Limit(perHour / 3600)
+	id := be.maintenanceID()
+	l := c.limiters[id]
+	if l == nil {
+		l = rate.NewLimiter(limit, int(max(1, perHour)))
+		c.limiters[id] = l
+	} else if l.Limit() != limit {
+		l.SetLimit(limit)
+		l.SetBurst(int(max(1, perHour)))
+	}
+	if !l.Allow() {
+		return 0, errOnDemandRateLimit
+	}
+	if od.Ask != "" {
+		ch := make(chan struct{})
+		c.asking[serverName] = ch
+		c.mu.Unlock()
+		err := onDemandAsk(od.Ask, serverName)
+		c.mu.Lock()
+		delete(c.asking, serverName)
+		close(ch)
+		if err != nil {
+			c.failed.Add(serverName, time.Now())
+			return 0, err
+		}
+	}
+	c.pending[serverName] = true
+	return onDemandStarted, nil
+}
+
+// done records the result of obtaining the certificate for serverName. A
+// failed name isn't tried again before OnDemandTLS.FailureBackoff.
+func (c *onDemandCerts) done(serverName string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, serverName)
+	if ok {
+		c.ready.Add(serverName, true)
+		return
+	}
+	c.failed.Add(serverName, time.Now())
+}
+
+// onDemandAsk asks the askURL whether a certificate can be obtained for
+// serverName. The name is approved when the response status is 2xx.
+func onDemandAsk(askURL, serverName string) error {
+	u, err := url.Parse(askURL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("domain", serverName)
+	u.RawQuery = q.Encode()
+
+	resp, err := onDemandAskClient.Get(u.String())
+	if err != nil {
+		return fmt.Errorf("on-demand ask: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %s", errOnDemandDenied, resp.Status)
+	}
+	return nil
+}
+
+// onDemandEvent returns the event that describes an error from start().
+func onDemandEvent(err error) string {
+	switch {
+	case errors.Is(err, errOnDemandRateLimit):
+		return "on-demand tls: rate limit exceeded"
+	case errors.Is(err, errOnDemandFailed):
+		return "on-demand tls: recently failed"
+	case errors.Is(err, errOnDemandDenied):
+		return "on-demand tls: denied"
+	default:
+		return "on-demand tls: ask failed"
+	}
+}
+
+// onDemandBackend returns the backend whose OnDemandTLS patterns match
+// serverName, if serverName isn't one of the configured server names.
+func (p *Proxy) onDemandBackend(serverName string) *Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.cfg == nil {
+		return nil
+	}
+	if _, exists := p.backends[beKey{serverName: serverName}]; exists {
+		return nil
+	}
+	for _, be := range p.cfg.Backends {
+		if be.OnDemandTLS != nil && serverNameAllowed(serverName, be.OnDemandTLS.ServerNames) {
+			return be
+		}
+	}
+	return nil
+}
+
+// onDemandCached returns true if the certificate for serverName is in the
+// autocert cache.
+func (p *Proxy) onDemandCached(serverName string) bool {
+	m, ok := p.certManager.(*autocert.Manager)
+	if !ok || m.Cache == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.Cache.Get(ctx, serverName)
+	return err == nil
+}
+
+// getOnDemandCert calls getCert, after checking the on-demand rate limit
+// when the server name matches an OnDemandTLS pattern.
+func (p *Proxy) getOnDemandCert(hello *tls.ClientHelloInfo, getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*tls.Certificate, error) {
+	be := p.onDemandBackend(hello.ServerName)
+	if be == nil {
+		return getCert(hello)
+	}
+	state, err := p.onDemand.start(be, hello.ServerName, p.onDemandCached)
+	if err != nil {
+		be.recordEvent(onDemandEvent(err))
+		return nil, err
+	}
+	cert, err := getCert(hello)
+	if state == onDemandStarted {
+		p.onDemand.done(hello.ServerName, err == nil)
+		if err == nil {
+			p.logErrorF("INF Obtained on-demand certificate for %s", idnaToUnicode(hello.ServerName))
+		}
+	}
+	return cert, err
+}
+
+// onDemandHandler serves a placeholder response to the HTTP requests for
+// the server names whose certificate isn't ready yet, and starts obtaining
+// the certificate.
+func (p *Proxy) onDemandHandler(next http.Handler) http.Handler {
+	if next == nil {
+		// Same as http.Server with a nil Handler.
+		next = http.DefaultServeMux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/.well-known/acme-challenge/") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = idnaToASCII(host)
+		be := p.onDemandBackend(host)
+		if be == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		state, err := p.onDemand.start(be, host, p.onDemandCached)
+		if state == onDemandReady && err == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if err != nil {
+			be.recordEvent(onDemandEvent(err))
+		}
+		if state == onDemandStarted {
+			go func() {
+				_, err := p.getACMECert(acmeHello(host), p.certManager.GetCertificate)
+				p.onDemand.done(host, err == nil)
+				if err != nil {
+					p.logErrorF("ERR On-demand certificate for %s: %v", idnaToUnicode(host), err)
+					return
+				}
+				p.logErrorF("INF Obtained on-demand certificate for %s", idnaToUnicode(host))
+			}()
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(be.OnDemandTLS.RetryAfter.Seconds()), 10))
+		http.Error(w, "The certificate for this site isn't ready yet. Please try again shortly.", http.StatusServiceUnavailable)
+	})
+}
+
+// hasServerName returns true if serverName is one of the backend's server
+// names, or matches one of its OnDemandTLS patterns.
+func (be *Backend) hasServerName(serverName string) bool {
+	if slices.Contains(be.ServerNames, serverName) {
+		return true
+	}
+	return be.OnDemandTLS != nil && serverNameAllowed(serverName, be.OnDemandTLS.ServerNames)
+}
@@ -0,0 +1,286 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestOnDemandTLS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+	be2 := newTCPServer(t, ctx, "backend2", nil)
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"preview.example.com"},
+				Mode:        "TCP",
+				Addresses:   []string{be1.listener.Addr().String()},
+				OnDemandTLS: &OnDemandTLS{
+					ServerNames:         []string{"*.preview.example.com"},
+					CertificatesPerHour: 2,
+				},
+			},
+			{
+				ServerNames: []string{"www.preview.example.com"},
+				Mode:        "TCP",
+				Addresses:   []string{be2.listener.Addr().String()},
+			},
+			{
+				ServerNames: []string{"other.example.com"},
+				Mode:        "TCP",
+				Addresses:   []string{be2.listener.Addr().String()},
+				OnDemandTLS: &OnDemandTLS{
+					ServerNames: []string{"*.other.example.com"},
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	for _, tc := range []struct {
+		serverName, want string
+	}{
+		{"pr1.preview.example.com", "Hello from backend1\n"},
+		{"www.preview.example.com", "Hello from backend2\n"},
+		{"pr2.preview.example.com", "Hello from backend1\n"},
+		// The rate limit is exceeded.
+		{"pr3.preview.example.com", ""},
+		{"pr1.preview.example.com", "Hello from backend1\n"},
+		{"pr1.example.com", ""},
+	} {
+		got, _, err := tlsGet(tc.serverName, proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil)
+		if tc.want == "" && err == nil {
+			t.Errorf("tlsGet(%q) = %q, want error", tc.serverName, got)
+		}
+		if got != tc.want {
+			t.Errorf("tlsGet(%q) = %q, want %q", tc.serverName, got, tc.want)
+		}
+	}
+
+	h := proxy.onDemandHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "https://"+req.Host+req.URL.RequestURI(), http.StatusFound)
+	}))
+	get := func(host string) *http.Response {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://"+host+"/foo", nil))
+		return w.Result()
+	}
+	resp := get("new.other.example.com")
+	if got, want := resp.StatusCode, http.StatusServiceUnavailable; got != want {
+		t.Fatalf("StatusCode = %d, want %d", got, want)
+	}
+	if got, want := resp.Header.Get("Retry-After"), "10"; got != want {
+		t.Errorf("Retry-After = %q, want %q", got, want)
+	}
+	for i := 0; ; i++ {
+		if resp = get("new.other.example.com"); resp.StatusCode == http.StatusFound {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("StatusCode = %d, want %d", resp.StatusCode, http.StatusFound)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got, want := get("other.example.com").StatusCode, http.StatusFound; got != want {
+		t.Errorf("StatusCode = %d, want %d", got, want)
+	}
+	got, _, err := tlsGet("new.other.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil)
+	if err != nil || got != "Hello from backend2\n" {
+		t.Errorf("tlsGet() = %q, %v", got, err)
+	}
+}
+
+func TestOnDemandCertsAskAndFailures(t *testing.T) {
+	var asked []string
+	ask := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		domain := req.URL.Query().Get("domain")
+		asked = append(asked, domain)
+		if domain != "ok.preview.example.com" && domain != "fail.preview.example.com" {
+			http.Error(w, "no", http.StatusNotFound)
+		}
+	}))
+	defer ask.Close()
+
+	be := &Backend{
+		ServerNames: []string{"preview.example.com"},
+		OnDemandTLS: &OnDemandTLS{
+			ServerNames:         []string{"*.preview.example.com"},
+			CertificatesPerHour: 100,
+			Ask:                 ask.URL,
+			FailureBackoff:      time.Hour,
+		},
+	}
+	notCached := func(string) bool { return false }
+	var c onDemandCerts
+
+	if state, err := c.start(be, "ok.preview.example.com", notCached); err != nil || state != onDemandStarted {
+		t.Fatalf("start(ok) = %v, %v, want started", state, err)
+	}
+	c.done("ok.preview.example.com", true)
+	if state, err := c.start(be, "ok.preview.example.com", notCached); err != nil || state != onDemandReady {
+		t.Errorf("start(ok) = %v, %v, want ready", state, err)
+	}
+
+	// Denied names are remembered, and Ask isn't queried again.
+	for range 2 {
+		if _, err := c.start(be, "bad.preview.example.com", notCached); !errors.Is(err, errOnDemandDenied) && !errors.Is(err, errOnDemandFailed) {
+			t.Errorf("start(bad) = %v, want denied", err)
+		}
+	}
+	// Failures aren't retried before FailureBackoff.
+	if state, err := c.start(be, "fail.preview.example.com", notCached); err != nil || state != onDemandStarted {
+		t.Fatalf("start(fail) = %v, %v, want started", state, err)
+	}
+	c.done("fail.preview.example.com", false)
+	if _, err := c.start(be, "fail.preview.example.com", notCached); !errors.Is(err, errOnDemandFailed) {
+		t.Errorf("start(fail) = %v, want %v", err, errOnDemandFailed)
+	}
+	if got, want := fmt.Sprint(asked), "[ok.preview.example.com bad.preview.example.com fail.preview.example.com]"; got != want {
+		t.Errorf("asked = %s, want %s", got, want)
+	}
+
+	// The state of the names is bounded.
+	be.OnDemandTLS.Ask = ""
+	cached := func(string) bool { return true }
+	for i := range maxOnDemandNames + 10 {
+		if _, err := c.start(be, fmt.Sprintf("pr%d.preview.example.com", i), cached); err != nil {
+			t.Fatalf("start: %v", err)
+		}
+	}
+	if got := c.ready.Len(); got > maxOnDemandNames {
+		t.Errorf("len(ready) = %d, want <= %d", got, maxOnDemandNames)
+	}
+}
+
+func TestOnDemandCertsAskLimits(t *testing.T) {
+	var mu sync.Mutex
+	var asked []string
+	release := make(chan struct{})
+	ask := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		domain := req.URL.Query().Get("domain")
+		mu.Lock()
+		asked = append(asked, domain)
+		mu.Unlock()
+		switch domain {
+		case "slow.preview.example.com":
+			<-release
+		case "error.preview.example.com":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		}
+	}))
+	defer ask.Close()
+
+	be := &Backend{
+		ServerNames: []string{"preview.example.com"},
+		OnDemandTLS: &OnDemandTLS{
+			ServerNames:         []string{"*.preview.example.com"},
+			CertificatesPerHour: 3,
+			Ask:                 ask.URL,
+			FailureBackoff:      time.Hour,
+		},
+	}
+	notCached := func(string) bool { return false }
+	var c onDemandCerts
+
+	// Concurrent handshakes for the same name query Ask once.
+	var wg sync.WaitGroup
+	states := make(chan onDemandState, 5)
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state, err := c.start(be, "slow.preview.example.com", notCached)
+			if err != nil {
+				t.Errorf("start(slow) = %v", err)
+			}
+			states <- state
+		}()
+	}
+	for {
+		c.mu.Lock()
+		n := len(c.asking)
+		c.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(states)
+	var started int
+	for state := range states {
+		if state == onDemandStarted {
+			started++
+		}
+	}
+	if started != 1 {
+		t.Errorf("started = %d, want 1", started)
+	}
+
+	// Errors are remembered for FailureBackoff.
+	for range 2 {
+		if _, err := c.start(be, "error.preview.example.com", notCached); err == nil {
+			t.Error("start(error) succeeded")
+		}
+	}
+	// The rate limit applies before Ask is queried.
+	if _, err := c.start(be, "one.preview.example.com", notCached); err != nil {
+		t.Errorf("start(one) = %v", err)
+	}
+	if _, err := c.start(be, "two.preview.example.com", notCached); !errors.Is(err, errOnDemandRateLimit) {
+		t.Errorf("start(two) = %v, want %v", err, errOnDemandRateLimit)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := fmt.Sprint(asked), "[slow.preview.example.com error.preview.example.com one.preview.example.com]"; got != want {
+		t.Errorf("asked = %s, want %s", got, want)
+	}
+}
@@ -32,3 +32,7 @@ import (
 func openFileLimit() (int, error) {
 	return 0, errors.New("unable to get the limit of open files")
 }
+
+func currentOpenFileLimit() (int, error) {
+	return 0, errors.New("unable to get the limit of open files")
+}
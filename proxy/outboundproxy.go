@@ -0,0 +1,68 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+var (
+	outboundProxy        atomic.Pointer[func(*url.URL) (*url.URL, error)]
+	installOutboundProxy sync.Once
+)
+
+// setOutboundProxy sets the proxy used by http.DefaultTransport, i.e. for the
+// requests that the proxy makes on its own behalf. Without config, the
+// HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment variables are used.
+func setOutboundProxy(cfg *ConfigOutboundProxy) {
+	if cfg == nil {
+		outboundProxy.Store(nil)
+		return
+	}
+	pc := &httpproxy.Config{
+		HTTPProxy:  cfg.URL,
+		HTTPSProxy: cfg.URL,
+		NoProxy:    strings.Join(cfg.NoProxy, ","),
+	}
+	f := pc.ProxyFunc()
+	outboundProxy.Store(&f)
+	installOutboundProxy.Do(func() {
+		if t, ok := http.DefaultTransport.(*http.Transport); ok {
+			t.Proxy = outboundProxyFunc
+		}
+	})
+}
+
+func outboundProxyFunc(req *http.Request) (*url.URL, error) {
+	if f := outboundProxy.Load(); f != nil {
+		return (*f)(req.URL)
+	}
+	return http.ProxyFromEnvironment(req)
+}
@@ -0,0 +1,63 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestOutboundProxy(t *testing.T) {
+	defer setOutboundProxy(nil)
+	setOutboundProxy(&ConfigOutboundProxy{
+		URL:     "http://proxy.example.com:3128",
+		NoProxy: []string{".internal.example.com", "10.0.0.0/8"},
+	})
+
+	for _, tc := range []struct {
+		url  string
+		want string
+	}{
+		{"https://acme-v02.api.letsencrypt.org/directory", "http://proxy.example.com:3128"},
+		{"http://r3.o.lencr.org/", "http://proxy.example.com:3128"},
+		{"https://idp.internal.example.com/", ""},
+		{"http://10.1.2.3/", ""},
+	} {
+		req, err := http.NewRequest("GET", tc.url, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		u, err := outboundProxyFunc(req)
+		if err != nil {
+			t.Fatalf("outboundProxyFunc(%q): %v", tc.url, err)
+		}
+		var got string
+		if u != nil {
+			got = u.String()
+		}
+		if got != tc.want {
+			t.Errorf("outboundProxyFunc(%q) = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"runtime/metrics"
+	"time"
+)
+
+const overloadCheckInterval = time.Second
+
+// overloadLoop periodically checks the heap size and the number of open
+// connections, and updates p.overloaded.
+func (p *Proxy) overloadLoop(ctx context.Context) {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	ticker := time.NewTicker(overloadCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		p.mu.RLock()
+		cfg := p.cfg.Overload
+		maxOpen := p.cfg.MaxOpen
+		p.mu.RUnlock()
+		if cfg == nil {
+			p.setOverloaded(false, "overload config removed")
+			continue
+		}
+		metrics.Read(sample)
+		p.checkOverload(cfg, maxOpen, int64(sample[0].Value.Uint64()), p.inConns.count())
+	}
+}
+
+// checkOverload starts shedding load when the heap size or the number of open
+// connections is above its threshold, and stops when both are below 90% of
+// their thresholds.
+func (p *Proxy) checkOverload(cfg *ConfigOverload, maxOpen int, heapSize int64, numOpen int) {
+	above := func(percent int64) (bool, string) {
+		if cfg.MaxHeapSize > 0 && heapSize*100 >= cfg.MaxHeapSize*percent {
+			return true, "heap size " + formatSize10(heapSize)
+		}
+		if cfg.MaxOpenPercent > 0 && int64(numOpen)*100*100 >= int64(maxOpen)*int64(cfg.MaxOpenPercent)*percent {
+			return true, fmt.Sprintf("%d open connections", numOpen)
+		}
+		return false, ""
+	}
+	if !p.overloaded.Load() {
+		if ok, reason := above(100); ok {
+			p.setOverloaded(true, reason)
+		}
+		return
+	}
+	if ok, _ := above(90); !ok {
+		p.setOverloaded(false, fmt.Sprintf("heap size %s, %d open connections", formatSize10(heapSize), numOpen))
+	}
+}
+
+func (p *Proxy) setOverloaded(v bool, reason string) {
+	if p.overloaded.Swap(v) == v {
+		return
+	}
+	if v {
+		p.recordEvent("overload: load shedding started")
+		p.logErrorF("WRN Overload: load shedding started (%s)", reason)
+	} else {
+		p.recordEvent("overload: load shedding stopped")
+		p.logErrorF("INF Overload: load shedding stopped (%s)", reason)
+	}
+}
+
+// waitNotOverloaded waits until the proxy is not shedding load.
+func (p *Proxy) waitNotOverloaded(ctx context.Context) {
+	for p.overloaded.Load() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(overloadCheckInterval / 10):
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"testing"
+)
+
+func TestCheckOverload(t *testing.T) {
+	p := &Proxy{}
+	cfg := &ConfigOverload{
+		MaxHeapSize:    1000,
+		MaxOpenPercent: 80,
+	}
+	for _, tc := range []struct {
+		heap    int64
+		numOpen int
+		want    bool
+	}{
+		{500, 10, false},
+		{1000, 10, true},
+		{950, 10, true},
+		{899, 10, false},
+		{100, 80, true},
+		{100, 75, true},
+		{100, 71, false},
+	} {
+		p.checkOverload(cfg, 100, tc.heap, tc.numOpen)
+		if got := p.overloaded.Load(); got != tc.want {
+			t.Errorf("checkOverload(heap=%d, numOpen=%d) = %v, want %v", tc.heap, tc.numOpen, got, tc.want)
+		}
+	}
+	if got, want := p.events["overload: load shedding started"], int64(2); got != want {
+		t.Errorf("started events = %d, want %d", got, want)
+	}
+	if got, want := p.events["overload: load shedding stopped"], int64(2); got != want {
+		t.Errorf("stopped events = %d, want %d", got, want)
+	}
+}
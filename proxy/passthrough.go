@@ -0,0 +1,120 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+// alpnMismatch returns true if the client offered ALPN protocols and none of
+// them are supported by the backend.
+func alpnMismatch(offered, supported []string) bool {
+	if len(offered) == 0 || len(supported) == 0 {
+		return false
+	}
+	return !slices.ContainsFunc(offered, func(p string) bool {
+		return slices.Contains(supported, p)
+	})
+}
+
+// handlePassthroughFallback terminates TLS locally for a TLSPASSTHROUGH
+// connection, and hands it to the fallback backend, or serves the error page.
+// It returns true if the connection still needs to be closed by the caller.
+func (p *Proxy) handlePassthroughFallback(conn *netw.Conn) bool {
+	be := connBackend(conn)
+	fb := be.PassthroughFallback
+	serverName := idnaToUnicode(connServerName(conn))
+	if fb.backend == nil {
+		be.logConnF("INF %s ➔  %q passthrough fallback: error page", conn.RemoteAddr(), serverName)
+		p.servePassthroughErrorPage(conn, fb.errorPage)
+		return true
+	}
+	fbe := fb.backend
+	be.logConnF("INF %s ➔  %q passthrough fallback: %s", conn.RemoteAddr(), serverName, fb.Backend)
+	conn.SetAnnotation(backendKey, fbe)
+	fbe.incInFlight(1)
+	be.incInFlight(-1)
+
+	switch fbe.Mode {
+	case ModeConsole, ModeLocal, ModeHTTP, ModeHTTPS:
+		p.handleHTTPConnection(tls.Server(conn, fbe.tlsConfig(false)))
+		return false
+	default:
+		p.handleTLSConnection(tls.Server(conn, fbe.tlsConfig(false)))
+		return true
+	}
+}
+
+// servePassthroughErrorPage terminates TLS and responds to the HTTP request
+// on the connection with the error page.
+func (p *Proxy) servePassthroughErrorPage(conn *netw.Conn, page []byte) {
+	p.serveLocalResponse(conn, http.StatusServiceUnavailable, page, " (fallback)")
+}
+
+// serveLocalResponse terminates TLS and responds to the HTTP request on the
+// connection with the status code and HTML page.
+func (p *Proxy) serveLocalResponse(conn *netw.Conn, code int, page []byte, note string) {
+	be := connBackend(conn)
+	tc := p.baseTLSConfig()
+	tc.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Server(conn, tc)
+
+	ctx, cancel := context.WithTimeout(p.ctx, be.tlsHandshakeTimeout())
+	defer cancel()
+	err := tlsConn.HandshakeContext(ctx)
+	handshakeDone(conn)
+	if err != nil {
+		p.recordEvent("tls handshake failed")
+		be.logErrorF("BAD [-] %s ➔ %q Handshake: %v", conn.RemoteAddr(), idnaToUnicode(connServerName(conn)), unwrapErr(err))
+		return
+	}
+	tlsConn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	req, err := http.ReadRequest(bufio.NewReader(tlsConn))
+	if err != nil {
+		return
+	}
+	be.logHTTPRequest("REQ", req.WithContext(context.WithValue(p.ctx, connCtxKey, conn)), req.RequestURI, code, note)
+	resp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: int64(len(page)),
+		Body:          io.NopCloser(bytes.NewReader(page)),
+		Close:         true,
+	}
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header.Set("Cache-Control", "no-store")
+	resp.Write(tlsConn)
+	tlsConn.Close()
+}
@@ -25,17 +25,6 @@
 
 package proxy
 
-import (
-	"net/http"
-	"net/http/pprof"
-)
-
-func addPProfHandlers(h *[]localHandler) {
-	*h = append(*h,
-		localHandler{path: "/debug/pprof", matchPrefix: true, handler: http.HandlerFunc(pprof.Index)},
-		localHandler{path: "/debug/pprof/cmdline", handler: http.HandlerFunc(pprof.Cmdline)},
-		localHandler{path: "/debug/pprof/profile", handler: http.HandlerFunc(pprof.Profile)},
-		localHandler{path: "/debug/pprof/symbol", handler: http.HandlerFunc(pprof.Symbol)},
-		localHandler{path: "/debug/pprof/trace", handler: http.HandlerFunc(pprof.Trace)},
-	)
-}
+// pprofBuildTag indicates that the binary was built with the pprof tag. The
+// diagnostics handlers are then enabled by default on the console backends.
+const pprofBuildTag = true
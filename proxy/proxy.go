@@ -39,8 +39,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"path"
@@ -50,6 +52,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/c2FmZQ/ech"
@@ -59,6 +62,7 @@ import (
 	"github.com/c2FmZQ/tpm"
 	"github.com/gorilla/websocket"
 	"github.com/pires/go-proxyproto"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/crypto/ocsp"
@@ -67,7 +71,10 @@ import (
 	"github.com/c2FmZQ/tlsproxy/certmanager"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/cookiemanager"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/counter"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/histogram"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/htpasswd"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/idp"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/ldap"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/ocspcache"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/oidc"
@@ -76,6 +83,8 @@ import (
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/saml"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/sshca"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/tokenmanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/totp"
+	"github.com/c2FmZQ/tlsproxy/revtunnel"
 )
 
 const (
@@ -93,6 +102,10 @@ const (
 	requestFlagKey   = "rf"
 	proxyProtoKey    = "pp"
 	httpUpgradeKey   = "hu"
+	handshakeRelKey  = "hr"
+	listenerKey      = "l"
+	connIDKey        = "id"
+	realClientIPsKey = "ri"
 
 	tlsBadCertificate      = tls.AlertError(0x2a)
 	tlsCertificateRevoked  = tls.AlertError(0x2c)
@@ -102,7 +115,9 @@ const (
 )
 
 var (
-	errAccessDenied = errors.New("access denied")
+	errAccessDenied         = errors.New("access denied")
+	errNoBackendAddresses   = errors.New("no backend addresses")
+	errAllAddressesDraining = errors.New("all backend addresses are draining")
 )
 
 // Proxy receives TLS connections and forwards them to the configured
@@ -117,32 +132,105 @@ type Proxy struct {
 	ctx           context.Context
 	cancel        func()
 	listener      net.Listener
+	listeners     []net.Listener
 	quicTransport io.Closer
 	quicListener  io.Closer
+	quicEarlyData bool
 	tpm           *tpm.TPM
 	mk            crypto.MasterKey
 	store         *storage.Storage
 	tokenManager  *tokenmanager.TokenManager
 	wsUpgrader    *websocket.Upgrader
 
+	// logFilter is the top level LogFilter of the current config. It can
+	// be read without holding mu.
+	logFilter atomic.Pointer[LogFilter]
+	// diagnostics is set when the diagnostics handlers are enabled or
+	// disabled at runtime. It overrides the config.
+	diagnostics atomic.Pointer[bool]
+	// overloaded indicates that the proxy is shedding load.
+	overloaded atomic.Bool
+	// draining is the set of backend addresses that are draining.
+	draining drainSet
+	// maintenance contains the maintenance mode of the backends that
+	// was changed at runtime.
+	maintenance maintenanceSet
+	// quotas contains the traffic usage of the users of the backends with
+	// a TrafficQuota. It is not affected by configuration changes.
+	quotas quotaSet
+	// sessions contains the active sessions of the users of the backends
+	// with a SessionLimit.
+	sessions sessionSet
+	// tunnels contains the agents connected with reverse tunnels.
+	tunnels reverseTunnelSet
+	// onDemand contains the state of the certificates obtained on first
+	// use.
+	onDemand onDemandCerts
+	// acmeHistory contains the recent ACME events.
+	acmeHistory acmeHistory
+	// acmeManager replaces certManager after a certificate is re-issued,
+	// and acmeReissued is the value of acmeReissuedKey that it reflects.
+	acmeMu       sync.Mutex
+	acmeManager  *autocert.Manager
+	acmeReissued string
+	// anomalies contains the traffic baselines of the backends.
+	anomalies anomalyDetector
+
 	mu            sync.RWMutex
 	connClosed    *sync.Cond
 	defServerName string
 	backends      map[beKey]*Backend
 	pkis          map[string]*pki.PKIManager
+	samlIDPs      []*saml.Provider
 	ocspCache     *ocspcache.OCSPCache
 	bwLimits      map[string]*bwLimit
 	inConns       *connTracker
 	outConns      *connTracker
+	hsLimiter     *handshakeLimiter
+	wasm          *wasmRuntime
+	spiffe        *workloadapi.X509Source
+	spiffeAddr    string
+	tailscale     *tailscaleNode
+	wireGuard     map[string]*wireGuardTunnel
+	// customHandlers are the local handlers added with AddLocalHandlers.
+	customHandlers        []LocalHandler
+	customHandlersChanged bool
 
 	metrics   map[string]*backendMetrics
 	startTime time.Time
 
 	eventsmu sync.Mutex
 	events   map[string]int64
+	eventLog *eventLog
+	// authAudit is the SSO authentication audit log.
+	authAudit *eventLog
+
+	syslogMu  sync.Mutex
+	syslogCfg *ConfigSyslog
+	syslog    *syslogWriter
 
 	echKeys       []tls.EncryptedClientHelloKey
 	echLastUpdate time.Time
+
+	ticketKeys           [][32]byte
+	ticketKeysLastUpdate time.Time
+
+	// dynMu protects the fields used to add dynamic backends to the
+	// config.
+	dynMu            sync.Mutex
+	userCfg          *Config
+	dockerCfg        *ConfigDocker
+	dockerCancel     context.CancelFunc
+	dockerContainers []dockerContainer
+	dockerListed     bool
+	remoteURL        string
+	remoteCancel     context.CancelFunc
+	remoteBackends   []byte
+	remoteListed     bool
+	apiEnabled       bool
+	apiFile          string
+	apiLoadFailed    bool
+	apiBackends      map[string]*Backend
 }
 
 type beKey struct {
@@ -159,6 +247,9 @@ type backendMetrics struct {
 	numConnections   *counter.Counter
 	numBytesSent     *counter.Counter
 	numBytesReceived *counter.Counter
+	handshakeTime    *histogram.Histogram
+	dialTime         *histogram.Histogram
+	totalTime        *histogram.Histogram
 }
 
 type eventRecorder struct {
@@ -191,7 +282,7 @@ func New(cfg *Config, passphrase []byte) (*Proxy, error) {
 	} else {
 		opts = append(opts, crypto.WithAlgo(crypto.PickFastest))
 	}
-	mkFile := filepath.Join(cfg.CacheDir, "masterkey")
+	mkFile := filepath.Join(cfg.storageDir(), "masterkey")
 	mk, err := crypto.ReadMasterKey(passphrase, mkFile, opts...)
 	if errors.Is(err, os.ErrNotExist) {
 		if mk, err = crypto.CreateMasterKey(opts...); err != nil {
@@ -202,7 +293,7 @@ func New(cfg *Config, passphrase []byte) (*Proxy, error) {
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", mkFile, err)
 	}
-	store := storage.New(cfg.CacheDir, mk)
+	store := storage.New(cfg.storageDir(), mk)
 	tm, err := tokenmanager.New(store, pTPM, p.extLogger())
 	if err != nil {
 		return nil, err
@@ -213,8 +304,12 @@ func New(cfg *Config, passphrase []byte) (*Proxy, error) {
 			p.logError("AcceptTOS must be set in the config")
 			return false
 		},
-		Cache: autocertcache.New("autocert", store),
-		Email: cfg.Email,
+		Cache: &acmeHistoryCache{
+			Cache:   autocertcache.New("autocert", store),
+			history: &p.acmeHistory,
+		},
+		Email:  cfg.Email,
+		Client: newACMEClient(autocert.DefaultACMEDirectory, nil),
 	}
 	if cfg.AcceptTOS {
 		p.certManager.(*autocert.Manager).Prompt = autocert.AcceptTOS
@@ -286,10 +381,12 @@ func NewTestProxy(cfg *Config) (*Proxy, error) {
 // Reconfigure updates the proxy's configuration. Some parameters cannot be
 // changed after Start has been called, e.g. HTTPAddr, TLSAddr, CacheDir.
 func (p *Proxy) Reconfigure(cfg *Config) error {
+	cfg = p.addDynamicBackends(cfg)
 	p.mu.RLock()
 	curCfg := p.cfg
+	handlersChanged := p.customHandlersChanged
 	p.mu.RUnlock()
-	if cfg.equal(curCfg) {
+	if cfg.equal(curCfg) && !handlersChanged {
 		return nil
 	}
 	p.mu.Lock()
@@ -310,23 +407,35 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 		domain           string
 		cm               *cookiemanager.CookieManager
 		actualIDP        string
+		logoutURL        string
+		logoutHandler    http.HandlerFunc
 	}
+	p.tokenManager.Revocations().SetMaxAge(cfg.maxTokenLifetime())
 	er := eventRecorder{record: p.recordEvent}
 	identityProviders := make(map[string]idp)
+	var samlIDPs []*saml.Provider
 	for _, pp := range cfg.OIDCProviders {
 		_, host, _, _ := hostAndPath(pp.RedirectURL)
 		issuer := "https://" + host + "/"
 		cm := cookiemanager.New(p.tokenManager, pp.Name, pp.Domain, issuer)
 		oidcCfg := oidc.Config{
-			DiscoveryURL:     pp.DiscoveryURL,
-			AuthEndpoint:     pp.AuthEndpoint,
-			Scopes:           pp.Scopes,
-			TokenEndpoint:    pp.TokenEndpoint,
-			UserinfoEndpoint: pp.UserinfoEndpoint,
-			RedirectURL:      pp.RedirectURL,
-			ClientID:         pp.ClientID,
-			ClientSecret:     pp.ClientSecret,
-			HostedDomain:     pp.HostedDomain,
+			DiscoveryURL:      pp.DiscoveryURL,
+			AuthEndpoint:      pp.AuthEndpoint,
+			Scopes:            pp.Scopes,
+			TokenEndpoint:     pp.TokenEndpoint,
+			UserinfoEndpoint:  pp.UserinfoEndpoint,
+			RedirectURL:       pp.RedirectURL,
+			ClientID:          pp.ClientID,
+			ClientSecret:      pp.ClientSecret,
+			HostedDomain:      pp.HostedDomain,
+			UsePKCE:           pp.PKCE == nil || *pp.PKCE,
+			RefreshTokens:     pp.RefreshTokens,
+			GroupsClaim:       pp.GroupsClaim,
+			RolesClaim:        pp.RolesClaim,
+			Store:             p.store,
+			BackchannelLogout: pp.BackchannelLogoutURL != "",
+			ClaimMapping:      pp.ClaimMapping,
+			Issuer:            pp.Issuer,
 		}
 		provider, err := oidc.New(oidcCfg, er, cm)
 		if err != nil {
@@ -339,6 +448,8 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 			domain:           pp.Domain,
 			cm:               cm,
 			actualIDP:        guessIDP(pp.AuthEndpoint),
+			logoutURL:        pp.BackchannelLogoutURL,
+			logoutHandler:    provider.HandleBackchannelLogout,
 		}
 	}
 	for _, pp := range cfg.SAMLProviders {
@@ -346,22 +457,88 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 		issuer := "https://" + host + "/"
 		cm := cookiemanager.New(p.tokenManager, pp.Name, pp.Domain, issuer)
 		samlCfg := saml.Config{
-			SSOURL:   pp.SSOURL,
-			EntityID: pp.EntityID,
-			Certs:    pp.Certs,
-			ACSURL:   pp.ACSURL,
+			SSOURL:         pp.SSOURL,
+			EntityID:       pp.EntityID,
+			Certs:          pp.Certs,
+			ACSURL:         pp.ACSURL,
+			EncryptionCert: pp.EncryptionCert,
+			EncryptionKey:  pp.EncryptionKey,
+			MetadataURL:    pp.MetadataURL,
+			MetadataCerts:  pp.MetadataCerts,
 		}
 		provider, err := saml.New(samlCfg, er, cm)
 		if err != nil {
 			return err
 		}
+		samlIDPs = append(samlIDPs, provider)
+		idpURL := pp.SSOURL
+		if idpURL == "" {
+			idpURL = pp.MetadataURL
+		}
 		identityProviders[pp.Name] = idp{
 			name:             pp.Name,
 			identityProvider: provider,
 			callback:         pp.ACSURL,
 			domain:           pp.Domain,
 			cm:               cm,
-			actualIDP:        guessIDP(pp.SSOURL),
+			actualIDP:        guessIDP(idpURL),
+		}
+	}
+	for _, pp := range cfg.LDAPProviders {
+		_, host, _, _ := hostAndPath(pp.Endpoint)
+		issuer := "https://" + host + "/"
+		cm := cookiemanager.New(p.tokenManager, pp.Name, pp.Domain, issuer)
+		ldapCfg := ldap.Config{
+			Endpoint:           pp.Endpoint,
+			ServerURL:          pp.ServerURL,
+			StartTLS:           pp.StartTLS,
+			RootCAs:            pp.RootCAs,
+			InsecureSkipVerify: pp.InsecureSkipVerify,
+			BindDN:             pp.BindDN,
+			BindPassword:       pp.BindPassword,
+			UserBaseDN:         pp.UserBaseDN,
+			UserFilter:         pp.UserFilter,
+			EmailAttribute:     pp.EmailAttribute,
+			GroupBaseDN:        pp.GroupBaseDN,
+			GroupFilter:        pp.GroupFilter,
+			GroupAttribute:     pp.GroupAttribute,
+			Logger:             p.extLogger(),
+		}
+		provider, err := ldap.New(ldapCfg, er, cm)
+		if err != nil {
+			return err
+		}
+		identityProviders[pp.Name] = idp{
+			name:             pp.Name,
+			identityProvider: provider,
+			callback:         pp.Endpoint,
+			domain:           pp.Domain,
+			cm:               cm,
+		}
+	}
+	for _, pp := range cfg.PasswordProviders {
+		_, host, _, _ := hostAndPath(pp.Endpoint)
+		issuer := "https://" + host + "/"
+		cm := cookiemanager.New(p.tokenManager, pp.Name, pp.Domain, issuer)
+		tm, err := p.newTOTPManager(pp.Name, pp.TOTP, host)
+		if err != nil {
+			return err
+		}
+		provider, err := htpasswd.New(htpasswd.Config{
+			Endpoint: pp.Endpoint,
+			File:     pp.File,
+			TOTP:     tm,
+			Logger:   p.extLogger(),
+		}, er, cm)
+		if err != nil {
+			return err
+		}
+		identityProviders[pp.Name] = idp{
+			name:             pp.Name,
+			identityProvider: provider,
+			callback:         pp.Endpoint,
+			domain:           pp.Domain,
+			cm:               cm,
 		}
 	}
 	for _, pp := range cfg.PasskeyProviders {
@@ -372,6 +549,10 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 		_, host, _, _ := hostAndPath(pp.Endpoint)
 		issuer := "https://" + host + "/"
 		cm := cookiemanager.New(p.tokenManager, pp.Name, pp.Domain, issuer)
+		tm, err := p.newTOTPManager(pp.Name, pp.TOTP, host)
+		if err != nil {
+			return err
+		}
 		cfg := passkeys.Config{
 			Store:              p.store,
 			Other:              other.identityProvider,
@@ -382,6 +563,11 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 			OtherCookieManager: other.cm,
 			TokenManager:       p.tokenManager,
 			ClaimsFromCtx:      claimsFromCtx,
+			TOTP:               tm,
+			Admins:             pp.Admins,
+			AuthTemplate:       cfg.templates.passkeyAuth,
+			ManageTemplate:     cfg.templates.passkeyManage,
+			AdminTemplate:      cfg.templates.passkeyAdmin,
 		}
 		provider, err := passkeys.NewManager(cfg)
 		if err != nil {
@@ -399,17 +585,65 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 	pkis := make(map[string]*pki.PKIManager)
 	for _, pp := range cfg.PKI {
 		opts := pki.Options{
-			Name:                  pp.Name,
-			KeyType:               pp.KeyType,
-			Endpoint:              pp.Endpoint,
-			IssuingCertificateURL: pp.IssuingCertificateURLs,
-			CRLDistributionPoints: pp.CRLDistributionPoints,
-			OCSPServer:            pp.OCSPServer,
-			Admins:                pp.Admins,
-			TPM:                   p.tpm,
-			Store:                 p.store,
-			EventRecorder:         er,
-			ClaimsFromCtx:         claimsFromCtx,
+			Name:                       pp.Name,
+			KeyType:                    pp.KeyType,
+			Endpoint:                   pp.Endpoint,
+			IssuingCertificateURL:      pp.IssuingCertificateURLs,
+			CRLDistributionPoints:      pp.CRLDistributionPoints,
+			OCSPServer:                 pp.OCSPServer,
+			CRLUpdateInterval:          pp.CRLUpdateInterval,
+			DeltaCRLDistributionPoints: pp.DeltaCRLDistributionPoints,
+			DeltaCRLUpdateInterval:     pp.DeltaCRLUpdateInterval,
+			Admins:                     pp.Admins,
+			TPM:                        p.tpm,
+			Store:                      p.store,
+			EventRecorder:              er,
+			ClaimsFromCtx:              claimsFromCtx,
+		}
+		if a := pp.ACME; a != nil {
+			opts.ACME = &pki.ACMEOptions{
+				Endpoint:              a.Endpoint,
+				Challenges:            a.Challenges,
+				PreAuthorizedAccounts: a.PreAuthorizedAccounts,
+				AllowedDomains:        a.AllowedDomains,
+				CertificateLifetime:   a.CertificateLifetime,
+			}
+		}
+		if e := pp.EST; e != nil {
+			opts.EST = &pki.ESTOptions{
+				AllowedDomains:      e.AllowedDomains,
+				CertificateLifetime: e.CertificateLifetime,
+			}
+			for _, v := range e.AllowedIPs {
+				prefix, err := netip.ParsePrefix(v)
+				if err != nil {
+					return err
+				}
+				opts.EST.AllowedIPs = append(opts.EST.AllowedIPs, prefix)
+			}
+		}
+		if sc := pp.SCEP; sc != nil {
+			opts.SCEP = &pki.SCEPOptions{
+				ChallengePassword:   sc.ChallengePassword,
+				ChallengeLifetime:   sc.ChallengeLifetime,
+				CertificateLifetime: sc.CertificateLifetime,
+				AllowedDomains:      sc.AllowedDomains,
+			}
+			for _, v := range sc.AllowedIPs {
+				prefix, err := netip.ParsePrefix(v)
+				if err != nil {
+					return err
+				}
+				opts.SCEP.AllowedIPs = append(opts.SCEP.AllowedIPs, prefix)
+			}
+		}
+		if r := pp.Renewal; r != nil {
+			opts.Renewal = &pki.RenewalOptions{
+				RenewBefore: r.RenewBefore,
+			}
+		}
+		for _, pr := range pp.Profiles {
+			opts.Profiles = append(opts.Profiles, pr.pkiProfile())
 		}
 		m, err := pki.New(opts)
 		if err != nil {
@@ -434,13 +668,65 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 		}
 	}
 
+	var res *resolver
+	if cfg.Resolver != nil {
+		r, err := newResolver(cfg.Resolver)
+		if err != nil {
+			return err
+		}
+		res = r
+	}
+
+	hsLimiter := newHandshakeLimiter(cfg.HandshakeRateLimit)
+	spiffeSrc, err := p.spiffeSource(cfg)
+	if err != nil {
+		return err
+	}
+	tsNode := p.tailscale
+	if cfg.Tailscale != nil && tsNode == nil {
+		if tsNode, err = newTailscaleNode(cfg.Tailscale); err != nil {
+			return err
+		}
+	}
 	backends := make(map[beKey]*Backend, len(cfg.Backends))
 	for _, be := range cfg.Backends {
-		be.recordEvent = p.recordEvent
+		beName := be.Name
+		if beName == "" && len(be.ServerNames) > 0 {
+			beName = idnaToUnicode(be.ServerNames[0])
+		}
+		be.recordEvent = func(msg string) {
+			p.recordBackendEvent(beName, msg)
+		}
 		be.tm = p.tokenManager
 		be.quicTransport = p.quicTransport
 		be.ocspCache = p.ocspCache
+		be.resolver = res
 		be.defaultLogFilter = cfg.LogFilter
+		be.realClientIP = cfg.realClientIP
+		be.hsLimiter = hsLimiter
+		be.draining = &p.draining
+		be.maintenanceState = &p.maintenance
+		be.quotaState = &p.quotas
+		be.sessionState = &p.sessions
+		be.tunnelState = &p.tunnels
+		be.tailscale = tsNode
+		if be.ForwardSPIFFE != nil && spiffeSrc != nil {
+			be.spiffe = spiffeSrc
+		}
+		for _, pl := range be.WASMPlugins {
+			if p.wasm == nil {
+				w, err := newWASMRuntime(context.Background())
+				if err != nil {
+					return err
+				}
+				p.wasm = w
+			}
+			wp, err := p.wasm.compile(context.Background(), pl.code)
+			if err != nil {
+				return fmt.Errorf("%s: %w", pl.Module, err)
+			}
+			pl.plugin = wp
+		}
 		if be.DocumentRoot != "" {
 			r, err := os.OpenRoot(be.DocumentRoot)
 			if err != nil {
@@ -460,14 +746,16 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 		if l, ok := p.bwLimits[be.BWLimit]; ok {
 			be.bwLimit = l
 		}
-		if be.SSO != nil {
-			idp, ok := identityProviders[be.SSO.Provider]
+		for _, sso := range be.ssoPolicies() {
+			idp, ok := identityProviders[sso.Provider]
 			if !ok {
-				return fmt.Errorf("unknown identity provider: %q", be.SSO.Provider)
+				return fmt.Errorf("unknown identity provider: %q", sso.Provider)
 			}
-			be.SSO.p = idp.identityProvider
-			be.SSO.cm = idp.cm
-			be.SSO.actualIDP = idp.actualIDP
+			sso.p = idp.identityProvider
+			sso.cm = idp.cm
+			sso.actualIDP = idp.actualIDP
+		}
+		if policies := be.ssoPolicies(); len(policies) > 0 {
 			be.localHandlers = append(be.localHandlers,
 				localHandler{
 					desc:      "SSO identity",
@@ -499,7 +787,11 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 					handler:   logHandler(http.HandlerFunc(p.faviconHandler)),
 					ssoBypass: true,
 				})
-			if m, ok := be.SSO.p.(*passkeys.Manager); ok {
+			for _, sso := range policies {
+				m, ok := sso.p.(*passkeys.Manager)
+				if !ok {
+					continue
+				}
 				be.localHandlers = append(be.localHandlers,
 					localHandler{
 						desc:    "Manage Passkeys",
@@ -513,8 +805,10 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 						ssoBypass: true,
 					},
 				)
+				break
 			}
-
+		}
+		if be.SSO != nil {
 			if ls := be.SSO.LocalOIDCServer; ls != nil && len(be.ServerNames) > 0 {
 				opts := oidc.ServerOptions{
 					TokenManager:  p.tokenManager,
@@ -522,14 +816,22 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 					PathPrefix:    ls.PathPrefix,
 					ClaimsFromCtx: claimsFromCtx,
 					Clients:       make([]oidc.Client, 0, len(ls.Clients)),
+					Revocations:   p.tokenManager.Revocations(),
 					EventRecorder: er,
 					Logger:        be.extLogger(),
 				}
 				for _, client := range ls.Clients {
 					opts.Clients = append(opts.Clients, oidc.Client{
-						ID:          client.ID,
-						Secret:      client.Secret,
-						RedirectURI: client.RedirectURI,
+						ID:                   client.ID,
+						Secret:               client.Secret,
+						RedirectURI:          client.RedirectURI,
+						GrantTypes:           client.GrantTypes,
+						Scopes:               client.Scopes,
+						Audiences:            client.Audiences,
+						CodeLifetime:         client.CodeLifetime,
+						AccessTokenLifetime:  client.AccessTokenLifetime,
+						IDTokenLifetime:      client.IDTokenLifetime,
+						RefreshTokenLifetime: client.RefreshTokenLifetime,
 					})
 				}
 				for _, rr := range ls.RewriteRules {
@@ -564,6 +866,29 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 						handler:   logHandler(http.HandlerFunc(oidcServer.ServeUserInfo)),
 						ssoBypass: true,
 					},
+					localHandler{
+						desc:      "OIDC Server Device Authorization Endpoint",
+						path:      ls.PathPrefix + "/device_authorization",
+						handler:   logHandler(http.HandlerFunc(oidcServer.ServeDeviceAuthorization)),
+						ssoBypass: true,
+					},
+					localHandler{
+						desc:    "OIDC Server Device Verification",
+						path:    ls.PathPrefix + "/device",
+						handler: logHandler(http.HandlerFunc(oidcServer.ServeDeviceVerification)),
+					},
+					localHandler{
+						desc:      "OIDC Server Introspection Endpoint",
+						path:      ls.PathPrefix + "/introspect",
+						handler:   logHandler(http.HandlerFunc(oidcServer.ServeIntrospection)),
+						ssoBypass: true,
+					},
+					localHandler{
+						desc:      "OIDC Server Revocation Endpoint",
+						path:      ls.PathPrefix + "/revoke",
+						handler:   logHandler(http.HandlerFunc(oidcServer.ServeRevocation)),
+						ssoBypass: true,
+					},
 					localHandler{
 						desc:      "OIDC Server JWKS Endpoint",
 						path:      ls.PathPrefix + "/jwks",
@@ -599,8 +924,14 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 			if forQUIC {
 				tc.MinVersion = tls.VersionTLS13
 			}
+			if keys := p.backendTicketKeys(be); len(keys) > 0 {
+				tc.SetSessionTicketKeys(keys)
+			}
 			if be.ClientAuth != nil {
 				tc.ClientAuth = tls.RequireAndVerifyClientCert
+				if be.ClientAuth.Optional {
+					tc.ClientAuth = tls.VerifyClientCertIfGiven
+				}
 				tc.ClientCAs = be.clientCAs
 				tc.VerifyConnection = p.verifyConnection
 			}
@@ -631,7 +962,7 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 						tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
 					},
 				}
-				return p.certManager.GetCertificate(hello)
+				return p.getACMECert(hello, p.certManager.GetCertificate)
 			}
 		}
 
@@ -692,30 +1023,45 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 			be.localHandlers = append(be.localHandlers,
 				localHandler{desc: "Metrics", path: "/", handler: logHandler(http.HandlerFunc(p.metricsHandler))},
 				localHandler{desc: "Icon", path: "/favicon.ico", handler: logHandler(http.HandlerFunc(p.faviconHandler))},
+				localHandler{desc: "Revoke Sessions", path: "/revoke-sessions", handler: logHandler(http.HandlerFunc(p.revokeSessionsHandler))},
+				localHandler{desc: "Drain Backend", path: "/drain-backend", handler: logHandler(http.HandlerFunc(p.drainBackendHandler))},
+				localHandler{desc: "Maintenance", path: "/maintenance", handler: logHandler(http.HandlerFunc(p.maintenanceHandler))},
+				localHandler{desc: "Events", path: "/events", handler: logHandler(http.HandlerFunc(p.eventsHandler))},
+				localHandler{desc: "Certificates", path: "/certificates", handler: logHandler(http.HandlerFunc(p.certificatesHandler))},
+				localHandler{desc: "Authentication Audit Log", path: "/auth-audit", handler: logHandler(http.HandlerFunc(p.authAuditHandler))},
 			)
-			addPProfHandlers(&be.localHandlers)
+			p.addDiagnosticsHandlers(be)
 
 			be.httpConnChan = make(chan net.Conn)
-			be.httpServer = startInternalHTTPServer(be.localHandler(), be.httpConnChan)
+			be.httpServer = startInternalHTTPServer(be.localHandler(), be.httpConnChan, be.ReadHeaderTimeout)
 			if *cfg.EnableQUIC && be.ALPNProtos != nil && slices.Contains(*be.ALPNProtos, "h3") {
 				be.http3Server = http3Server(be.localHandler())
 			}
 
 		case ModeLocal:
 			be.httpConnChan = make(chan net.Conn)
-			be.httpServer = startInternalHTTPServer(be.localHandler(), be.httpConnChan)
+			be.httpServer = startInternalHTTPServer(be.localHandler(), be.httpConnChan, be.ReadHeaderTimeout)
 			if *cfg.EnableQUIC && be.ALPNProtos != nil && slices.Contains(*be.ALPNProtos, "h3") {
 				be.http3Server = http3Server(be.localHandler())
 			}
 
 		case ModeHTTPS, ModeHTTP:
 			be.httpConnChan = make(chan net.Conn)
-			be.httpServer = startInternalHTTPServer(be.reverseProxy(), be.httpConnChan)
+			be.httpServer = startInternalHTTPServer(be.reverseProxy(), be.httpConnChan, be.ReadHeaderTimeout)
 			if *cfg.EnableQUIC && be.ALPNProtos != nil && slices.Contains(*be.ALPNProtos, "h3") {
 				be.http3Server = http3Server(be.reverseProxy())
 			}
 		}
 	}
+	for _, r := range cfg.Routes {
+		idx := slices.IndexFunc(cfg.Backends, func(be *Backend) bool { return be.Name == r.Backend })
+		if idx < 0 {
+			return fmt.Errorf("unknown backend: %q", r.Backend)
+		}
+		for _, proto := range r.ALPNProtos {
+			backends[beKey{serverName: r.ServerName, proto: proto}] = cfg.Backends[idx]
+		}
+	}
 
 	addLocalHandler := func(h localHandler, urls ...string) {
 		for _, v := range urls {
@@ -733,9 +1079,11 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 			h.path = path
 			be.localHandlers = append(be.localHandlers, h)
 
-			if h.isCallback && be.SSO != nil {
-				if m, ok := be.SSO.p.(*passkeys.Manager); ok {
-					m.SetACL(be.SSO.ACL)
+			if h.isCallback {
+				for _, sso := range be.ssoPolicies() {
+					if m, ok := sso.p.(*passkeys.Manager); ok {
+						m.SetACL(sso.ACL)
+					}
 				}
 			}
 		}
@@ -747,19 +1095,28 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 			ssoBypass: true,
 		}, cfg.ECH.Endpoint)
 	}
-	for _, p := range identityProviders {
-		p := p
+	for _, ip := range identityProviders {
+		ip := ip
 		addLocalHandler(localHandler{
-			desc: fmt.Sprintf("OIDC Client Redirect Endpoint (%s)", p.name),
+			desc: fmt.Sprintf("OIDC Client Redirect Endpoint (%s)", ip.name),
 			handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 				if be := connBackend(req.Context().Value(connCtxKey).(anyConn)); be != nil {
-					be.logRequestF("REQ %s ➔ %s %s (SSO callback) (%q)", formatReqDesc(req), req.Method, req.URL.Path, userAgent(req))
+					be.logHTTPRequest("REQ", req, req.URL.Path, 0, " (SSO callback)")
 				}
-				p.identityProvider.HandleCallback(w, req)
+				aw := &auditResponseWriter{ResponseWriter: w}
+				ip.identityProvider.HandleCallback(aw, req)
+				p.auditLogin(aw, req, ip.name, ip.cm)
 			}),
 			ssoBypass:  true,
 			isCallback: true,
-		}, p.callback)
+		}, ip.callback)
+		if ip.logoutURL != "" {
+			addLocalHandler(localHandler{
+				desc:      fmt.Sprintf("OIDC Back-Channel Logout Endpoint (%s)", ip.name),
+				handler:   logHandler(ip.logoutHandler),
+				ssoBypass: true,
+			}, ip.logoutURL)
+		}
 	}
 	for _, pp := range cfg.PKI {
 		addLocalHandler(localHandler{
@@ -772,6 +1129,11 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 			handler:   logHandler(http.HandlerFunc(pkis[pp.Name].ServeCRL)),
 			ssoBypass: true,
 		}, pp.CRLDistributionPoints...)
+		addLocalHandler(localHandler{
+			desc:      fmt.Sprintf("PKI Delta CRL (%s)", pp.Name),
+			handler:   logHandler(http.HandlerFunc(pkis[pp.Name].ServeDeltaCRL)),
+			ssoBypass: true,
+		}, pp.DeltaCRLDistributionPoints...)
 		addLocalHandler(localHandler{
 			desc:        fmt.Sprintf("PKI OCSP (%s)", pp.Name),
 			handler:     logHandler(http.HandlerFunc(pkis[pp.Name].ServeOCSP)),
@@ -784,6 +1146,50 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 				handler: logHandler(http.HandlerFunc(pkis[pp.Name].ServeCertificateManagement)),
 			}, pp.Endpoint)
 		}
+		if pp.ACME != nil {
+			addLocalHandler(localHandler{
+				desc:        fmt.Sprintf("PKI ACME Server (%s)", pp.Name),
+				handler:     logHandler(http.HandlerFunc(pkis[pp.Name].ServeACME)),
+				ssoBypass:   true,
+				matchPrefix: true,
+			}, pp.ACME.Endpoint)
+		}
+		if pp.EST != nil {
+			base := strings.TrimSuffix(pp.EST.Endpoint, "/")
+			addLocalHandler(localHandler{
+				desc:      fmt.Sprintf("PKI EST CA Certs (%s)", pp.Name),
+				handler:   logHandler(http.HandlerFunc(pkis[pp.Name].ServeESTCACerts)),
+				ssoBypass: true,
+			}, base+"/cacerts")
+			addLocalHandler(localHandler{
+				desc:    fmt.Sprintf("PKI EST Enroll (%s)", pp.Name),
+				handler: logHandler(http.HandlerFunc(pkis[pp.Name].ServeESTSimpleEnroll)),
+			}, base+"/simpleenroll")
+			addLocalHandler(localHandler{
+				desc:    fmt.Sprintf("PKI EST Re-Enroll (%s)", pp.Name),
+				handler: logHandler(http.HandlerFunc(pkis[pp.Name].ServeESTSimpleReEnroll)),
+			}, base+"/simplereenroll")
+		}
+		if r := pp.Renewal; r != nil {
+			addLocalHandler(localHandler{
+				desc:      fmt.Sprintf("PKI Certificate Renewal (%s)", pp.Name),
+				handler:   logHandler(http.HandlerFunc(pkis[pp.Name].ServeRenew)),
+				ssoBypass: true,
+			}, r.Endpoint)
+		}
+		if sc := pp.SCEP; sc != nil {
+			addLocalHandler(localHandler{
+				desc:      fmt.Sprintf("PKI SCEP (%s)", pp.Name),
+				handler:   logHandler(http.HandlerFunc(pkis[pp.Name].ServeSCEP)),
+				ssoBypass: true,
+			}, sc.Endpoint)
+			if sc.ChallengeEndpoint != "" {
+				addLocalHandler(localHandler{
+					desc:    fmt.Sprintf("PKI SCEP Challenge (%s)", pp.Name),
+					handler: logHandler(http.HandlerFunc(pkis[pp.Name].ServeSCEPChallenge)),
+				}, sc.ChallengeEndpoint)
+			}
+		}
 	}
 	for _, pp := range cfg.SSHCertificateAuthorities {
 		opts := sshca.Options{
@@ -824,6 +1230,26 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 			handler: logHandler(p.webSocketHandler(*ws)),
 		}, ws.Endpoint)
 	}
+	if api := cfg.BackendAPI; api != nil {
+		addLocalHandler(localHandler{
+			desc:        "Backend API",
+			handler:     logHandler(p.backendAPIHandler(*api)),
+			ssoBypass:   true,
+			matchPrefix: true,
+		}, api.Endpoint)
+	}
+	for _, h := range p.customHandlers {
+		desc := h.Description
+		if desc == "" {
+			desc = "Custom Handler"
+		}
+		addLocalHandler(localHandler{
+			desc:        desc,
+			handler:     logHandler(h.Handler),
+			ssoBypass:   h.SSOBypass,
+			matchPrefix: h.MatchPrefix,
+		}, h.URL)
+	}
 	for _, be := range backends {
 		sort.Slice(be.localHandlers, func(i, j int) bool {
 			a := be.localHandlers[i].host
@@ -840,6 +1266,18 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 		})
 		be.outConns = p.outConns
 	}
+	// The tunnels are created after all the other checks so that they
+	// aren't left running when the new config is rejected.
+	wgTunnels, err := p.wireGuardTunnels(cfg)
+	if err != nil {
+		return err
+	}
+	for _, be := range cfg.Backends {
+		if be.DialWireGuard != "" {
+			be.wireGuard = wgTunnels[be.DialWireGuard]
+		}
+	}
+
 	if p.cfg != nil {
 		for _, be := range p.cfg.Backends {
 			be.close(p.ctx)
@@ -848,7 +1286,39 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 	p.defServerName = cfg.DefaultServerName
 	p.backends = backends
 	p.pkis = pkis
+	p.samlIDPs = samlIDPs
+	p.hsLimiter = hsLimiter
 	p.cfg = cfg
+	p.customHandlersChanged = false
+	p.logFilter.Store(&cfg.LogFilter)
+	if p.wasm != nil {
+		p.wasm.prune(cfg.Backends)
+	}
+	p.tunnels.prune(cfg.Backends)
+	var spiffeAddr string
+	if cfg.SPIFFE != nil {
+		spiffeAddr = cfg.SPIFFE.WorkloadAPIAddr
+	}
+	p.setSPIFFESource(spiffeSrc, spiffeAddr)
+	p.tailscale = tsNode
+	p.setWireGuardTunnels(wgTunnels)
+	for _, be := range cfg.Backends {
+		be.startDiscovery()
+	}
+	p.updateSyslog(cfg.Syslog)
+	p.updateEventLog(cfg.EventLog, cfg.CacheDir)
+	p.updateAuthAuditLog(cfg.AuthAuditLog, cfg.CacheDir)
+	setOutboundProxy(cfg.OutboundProxy)
+	p.updateDockerWatcher(cfg.Docker)
+	p.updateRemoteBackendsWatcher(cfg.RemoteBackends)
+	if p.quicListener != nil && p.quicEarlyData != cfg.earlyDataEnabled() {
+		if err := p.startQUICListener(p.ctx); err != nil {
+			return err
+		}
+	}
+	if err := p.rotateSessionTicketKeys(); err != nil && err != storage.ErrRolledBack {
+		return err
+	}
 	if err := p.rotateECH(true); err != nil && err != storage.ErrRolledBack {
 		return err
 	}
@@ -866,16 +1336,21 @@ func (p *Proxy) reAuthorize() {
 		be, err := p.backend(serverName, proto)
 		if err != nil {
 			p.recordEvent(err.Error())
-			be.logErrorF("BAD [-] ReAuth %s ➔ %q: %v", conn.RemoteAddr(), serverName, err)
+			p.logErrorF("BAD [-] ReAuth %s ➔ %q: %v", conn.RemoteAddr(), serverName, err)
 			conn.Close()
 			continue
 		}
-		if oldBE := connBackend(conn); be.Mode != oldBE.Mode {
+		oldBE := connBackend(conn)
+		if oldBE == nil {
+			// The connection is still being set up.
+			continue
+		}
+		if be.Mode != oldBE.Mode {
 			be.logErrorF("INF [-] ReAuth %s ➔  %q backend mode changed %s->%s", conn.RemoteAddr(), idnaToUnicode(serverName), oldBE.Mode, be.Mode)
 			conn.Close()
 			continue
 		}
-		if err := be.checkIP(conn.RemoteAddr()); err != nil {
+		if err := be.checkIP(conn.RemoteAddr()); err != nil && !be.trustsRealClientIP(conn.RemoteAddr()) {
 			p.recordEvent(serverName + " CheckIP " + err.Error())
 			be.logErrorF("BAD [-] ReAuth %s ➔ %q CheckIP: %v", conn.RemoteAddr(), idnaToUnicode(serverName), err)
 			conn.Close()
@@ -884,6 +1359,15 @@ func (p *Proxy) reAuthorize() {
 		if be.ClientAuth == nil {
 			continue
 		}
+		if be.ClientAuth.Optional {
+			// The requests are still served by the old backend, which
+			// enforces its own RequiredPaths and ACL.
+			if be != oldBE && !be.ClientAuth.equal(oldBE.ClientAuth) {
+				be.logErrorF("INF [-] ReAuth %s ➔ %q client auth changed", conn.RemoteAddr(), idnaToUnicode(serverName))
+				conn.Close()
+			}
+			continue
+		}
 		clientCert := connClientCert(conn)
 		if err := be.authorize(clientCert); err != nil {
 			p.recordEvent(err.Error())
@@ -902,6 +1386,9 @@ func (p *Proxy) verifyConnection(cs tls.ConnectionState) error {
 	if be.ClientAuth == nil {
 		return nil
 	}
+	if len(cs.PeerCertificates) == 0 && be.ClientAuth.Optional {
+		return nil
+	}
 	if len(cs.PeerCertificates) == 0 || len(cs.VerifiedChains) == 0 {
 		p.recordEvent(fmt.Sprintf("deny no cert to %s", idnaToUnicode(cs.ServerName)))
 		if cs.Version == tls.VersionTLS12 {
@@ -922,7 +1409,8 @@ func (p *Proxy) verifyConnection(cs tls.ConnectionState) error {
 			return tlsCertificateRevoked
 		}
 	}
-	if err := be.authorize(cert); err != nil {
+	// With optional client auth, the ACL is enforced for each HTTP request.
+	if err := be.authorize(cert); err != nil && !be.ClientAuth.Optional {
 		p.recordEvent(fmt.Sprintf("deny X509 [%s] to %s", sum, idnaToUnicode(cs.ServerName)))
 		return tlsAccessDenied
 	}
@@ -942,7 +1430,7 @@ func (p *Proxy) Start(ctx context.Context) error {
 	var httpServer *http.Server
 	if p.cfg.HTTPAddr != "" {
 		httpServer = &http.Server{
-			Handler: p.certManager.HTTPHandler(nil),
+			Handler: p.onDemandHandler(p.certManager.HTTPHandler(nil)),
 		}
 		httpListener, err := net.Listen("tcp", p.cfg.HTTPAddr)
 		if err != nil {
@@ -963,12 +1451,37 @@ func (p *Proxy) Start(ctx context.Context) error {
 		return err
 	}
 	p.listener = listener
+	for _, l := range p.cfg.Listeners {
+		var listener net.Listener
+		if addr, ok := strings.CutPrefix(l.Address, tailscalePrefix); ok {
+			listener, err = p.tailscale.listen(addr)
+		} else {
+			listener, err = netw.Listen("tcp", l.Address)
+		}
+		if err != nil {
+			p.listener.Close()
+			for _, l := range p.listeners {
+				l.Close()
+			}
+			return err
+		}
+		p.listeners = append(p.listeners, listener)
+		go p.acceptLoop(listener, l.Address)
+	}
 
 	go p.revokeUnusedCertificates(p.ctx)
 	go p.ctxWait(httpServer)
 	go p.tokenManager.KeyRotationLoop(p.ctx)
 	go p.ocspCache.FlushLoop(p.ctx)
-	go p.acceptLoop()
+	go p.crlRefreshLoop(p.ctx)
+	go p.samlMetadataLoop(p.ctx)
+	go p.acmeReissueLoop(p.ctx)
+	go p.overloadLoop(p.ctx)
+	go p.anomalyLoop(p.ctx)
+	if p.cfg.Cluster != nil {
+		go p.clusterSyncLoop(p.ctx)
+	}
+	go p.acceptLoop(p.listener, "")
 	return nil
 }
 
@@ -984,7 +1497,16 @@ func (p *Proxy) ctxWait(s *http.Server) {
 		case <-time.After(10 * time.Minute):
 			p.mu.RLock()
 			needed := p.cfg.ECH != nil && p.cfg.ECH.Interval > 0 && time.Since(p.echLastUpdate) > p.cfg.ECH.Interval
+			ticketsNeeded := time.Since(p.ticketKeysLastUpdate) >= p.cfg.sessionTickets().RotationInterval
 			p.mu.RUnlock()
+			if ticketsNeeded {
+				p.mu.Lock()
+				err := p.rotateSessionTicketKeys()
+				p.mu.Unlock()
+				if err != nil && err != storage.ErrRolledBack {
+					p.logErrorF("ERR Session tickets: %v", err)
+				}
+			}
 			if !needed {
 				continue
 			}
@@ -998,10 +1520,53 @@ func (p *Proxy) ctxWait(s *http.Server) {
 	}
 }
 
-func (p *Proxy) acceptLoop() {
-	p.logErrorF("INF Accepting TLS connections on %s %s", p.listener.Addr().Network(), p.listener.Addr())
+// crlRefreshLoop publishes new Certificate Revocation Lists for the local
+// PKIs when they are due, even when nobody is requesting them.
+func (p *Proxy) crlRefreshLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+		p.mu.RLock()
+		pkis := slices.Collect(maps.Values(p.pkis))
+		p.mu.RUnlock()
+		for _, m := range pkis {
+			if err := m.RefreshRevocationLists(); err != nil {
+				p.logErrorF("ERR RefreshRevocationLists: %v", err)
+			}
+		}
+	}
+}
+
+// samlMetadataLoop refreshes the metadata of the SAML identity providers when
+// it is due, even when nobody is logging in.
+func (p *Proxy) samlMetadataLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+		p.mu.RLock()
+		providers := p.samlIDPs
+		p.mu.RUnlock()
+		for _, pp := range providers {
+			if err := pp.RefreshMetadata(); err != nil {
+				p.recordEvent("saml metadata refresh failed")
+				p.logErrorF("ERR SAML metadata: %v", err)
+			}
+		}
+	}
+}
+
+// acceptLoop accepts the TLS connections on a listener. The address is the one
+// from Listeners, or empty for TLSAddr.
+func (p *Proxy) acceptLoop(listener net.Listener, address string) {
+	p.logErrorF("INF Accepting TLS connections on %s %s", listener.Addr().Network(), listener.Addr())
 	for {
-		conn, err := p.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				p.logErrorF("INF TLS Accept loop terminated")
@@ -1010,17 +1575,25 @@ func (p *Proxy) acceptLoop() {
 			p.logErrorF("ERR TLS Accept: %v", err)
 			continue
 		}
-		go p.handleConnection(conn.(*netw.Conn))
+		nc := conn.(*netw.Conn)
+		if address != "" {
+			nc.SetAnnotation(listenerKey, address)
+		}
+		go p.handleConnection(nc)
 	}
 }
 
 // Stop closes all connections and stops all goroutines.
 func (p *Proxy) Stop() {
+	p.stopWatchers()
 	p.mu.Lock()
 	if p.cancel != nil {
 		p.cancel()
 	}
 	p.listener.Close()
+	for _, l := range p.listeners {
+		l.Close()
+	}
 	if p.quicTransport != nil {
 		p.quicTransport.Close()
 	}
@@ -1028,6 +1601,16 @@ func (p *Proxy) Stop() {
 		p.mk.Wipe()
 		p.mk = nil
 	}
+	if p.wasm != nil {
+		p.wasm.close()
+		p.wasm = nil
+	}
+	p.setSPIFFESource(nil, "")
+	if p.tailscale != nil {
+		p.tailscale.close()
+		p.tailscale = nil
+	}
+	p.setWireGuardTunnels(nil)
 	backends := p.cfg.Backends
 	p.cfg.Backends = nil
 	conns := p.inConns.slice()
@@ -1039,6 +1622,9 @@ func (p *Proxy) Stop() {
 	for _, conn := range conns {
 		conn.Close()
 	}
+	p.updateEventLog(nil, "")
+	p.updateAuthAuditLog(nil, "")
+	p.updateSyslog(nil)
 	if p.tpm != nil {
 		p.tpm.Close()
 	}
@@ -1047,8 +1633,12 @@ func (p *Proxy) Stop() {
 // Shutdown gracefully shuts down the proxy, waiting for all existing
 // connections to close or ctx to be canceled.
 func (p *Proxy) Shutdown(ctx context.Context) {
+	p.stopWatchers()
 	p.mu.Lock()
 	p.listener.Close()
+	for _, l := range p.listeners {
+		l.Close()
+	}
 	if p.quicTransport != nil {
 		p.quicTransport.Close()
 	}
@@ -1083,7 +1673,10 @@ func (p *Proxy) Shutdown(ctx context.Context) {
 
 func (p *Proxy) baseTLSConfig() *tls.Config {
 	tc := p.certManager.TLSConfig()
-	getCert := tc.GetCertificate
+	acmeGetCert := tc.GetCertificate
+	getCert := func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return p.getACMECert(hello, acmeGetCert)
+	}
 	tc.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		if hello.ServerName == "" {
 			hello.ServerName = p.defaultServerName()
@@ -1100,7 +1693,7 @@ func (p *Proxy) baseTLSConfig() *tls.Config {
 				return nil, errors.New("AcceptTOS must be set to true")
 			}
 		}
-		cert, err := getCert(hello)
+		cert, err := p.getOnDemandCert(hello, getCert)
 		if err != nil {
 			return nil, err
 		}
@@ -1127,6 +1720,9 @@ func (p *Proxy) baseTLSConfig() *tls.Config {
 	}
 	tc.NextProtos = *defaultALPNProtos
 	tc.EncryptedClientHelloKeys = p.echKeys
+	if len(p.ticketKeys) > 0 {
+		tc.SetSessionTicketKeys(p.ticketKeys)
+	}
 	return tc
 }
 
@@ -1169,6 +1765,14 @@ func (p *Proxy) acceptProxyHeader(addr net.Addr) bool {
 	return false
 }
 
+// isRealClientIPSource returns true if addr is one of the RealClientIP
+// TrustedSources.
+func (p *Proxy) isRealClientIPSource(addr net.Addr) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cfg.realClientIP.isTrustedSource(addr)
+}
+
 func (p *Proxy) handleConnection(conn *netw.Conn) {
 	p.recordEvent("tcp connection")
 	defer func() {
@@ -1185,6 +1789,7 @@ func (p *Proxy) handleConnection(conn *netw.Conn) {
 		}
 	}()
 	conn.SetAnnotation(startTimeKey, time.Now())
+	conn.SetAnnotation(connIDKey, newRandomID())
 	if p.acceptProxyHeader(conn.RemoteAddr()) {
 		cc := proxyproto.NewConn(conn.Conn)
 		conn.Conn = cc
@@ -1192,6 +1797,7 @@ func (p *Proxy) handleConnection(conn *netw.Conn) {
 	numOpen := p.inConns.add(conn)
 	conn.OnClose(func() {
 		p.inConns.remove(conn)
+		handshakeDone(conn)
 		if be := connBackend(conn); be != nil {
 			be.incInFlight(-1)
 			if conn.Annotation(reportEndKey, false).(bool) {
@@ -1209,7 +1815,24 @@ func (p *Proxy) handleConnection(conn *netw.Conn) {
 		sendCloseNotify(conn)
 		return
 	}
-	setKeepAlive(conn)
+	if p.overloaded.Load() {
+		p.recordEvent("overload: connection rejected")
+		sendInternalError(conn)
+		return
+	}
+	hsLimiter := p.handshakeLimiter()
+	if p.isRealClientIPSource(conn.RemoteAddr()) {
+		// The requests from the CDN are limited individually.
+		hsLimiter = nil
+	}
+	release, ok := hsLimiter.acquire(conn.RemoteAddr())
+	if !ok {
+		p.recordEvent("handshake rate limit")
+		p.logErrorF("BAD [-] %s: handshake rate limit exceeded", conn.RemoteAddr())
+		return
+	}
+	conn.SetAnnotation(handshakeRelKey, release)
+	setTCPOptions(conn, p.cfg.TCPOptions)
 
 	ctx, cancel := context.WithTimeout(p.ctx, 5*time.Second)
 	defer cancel()
@@ -1237,7 +1860,13 @@ func (p *Proxy) handleConnection(conn *netw.Conn) {
 	if err != nil {
 		p.recordEvent(err.Error())
 		p.logErrorF("BAD [-] %s ➔ %q: %v", conn.RemoteAddr(), serverName, err)
-		sendUnrecognizedName(conn)
+		p.rejectConn(conn, p.cfg.RejectPolicy)
+		return
+	}
+	if listenAddr, _ := conn.Annotation(listenerKey, "").(string); !be.servedOn(listenAddr) {
+		p.recordEvent("server name not served on listener")
+		p.logErrorF("BAD [-] %s ➔ %q: not served on %s", conn.RemoteAddr(), serverName, conn.LocalAddr())
+		p.rejectConn(conn, p.cfg.RejectPolicy)
 		return
 	}
 	conn.SetAnnotation(backendKey, be)
@@ -1251,13 +1880,31 @@ func (p *Proxy) handleConnection(conn *netw.Conn) {
 		if err := p.checkIP(conn); err != nil {
 			return
 		}
-		p.handleTLSPassthroughConnection(conn)
+		if p.rejectInMaintenance(conn) {
+			return
+		}
+		if fb := be.PassthroughFallback; fb != nil && fb.OnALPNMismatch && alpnMismatch(alpnProtos, *be.ALPNProtos) {
+			p.recordEvent("passthrough fallback (alpn)")
+			closeConnNeeded = p.handlePassthroughFallback(conn)
+			return
+		}
+		handshakeDone(conn)
+		if !p.handleTLSPassthroughConnection(conn) {
+			p.recordEvent("passthrough fallback (dial)")
+			closeConnNeeded = p.handlePassthroughFallback(conn)
+		}
 
 	case len(alpnProtos) == 1 && alpnProtos[0] == acme.ALPNProto && echConn.ServerName() != "":
 		tc := p.baseTLSConfig()
 		tc.NextProtos = []string{acme.ALPNProto}
 		p.handleACMEConnection(tls.Server(conn, tc))
 
+	case len(alpnProtos) == 1 && alpnProtos[0] == revtunnel.ALPNProto && be.ReverseTunnel != nil:
+		if err := p.checkIP(conn); err != nil {
+			return
+		}
+		p.handleReverseTunnelConnection(tls.Server(conn, be.reverseTunnelTLSConfig()))
+
 	case be.Mode == ModeConsole || be.Mode == ModeLocal || be.Mode == ModeHTTP || be.Mode == ModeHTTPS:
 		if err := p.checkIP(conn); err != nil {
 			return
@@ -1269,6 +1916,9 @@ func (p *Proxy) handleConnection(conn *netw.Conn) {
 		if err := p.checkIP(conn); err != nil {
 			return
 		}
+		if p.rejectInMaintenance(conn) {
+			return
+		}
 		p.handleTLSConnection(tls.Server(conn, be.tlsConfig(false)))
 
 	default:
@@ -1280,22 +1930,45 @@ func (p *Proxy) handleConnection(conn *netw.Conn) {
 // handshake completes.
 func (p *Proxy) checkIP(conn *netw.Conn) error {
 	be := connBackend(conn)
+	if be.trustsRealClientIP(conn.RemoteAddr()) {
+		return nil
+	}
 	if err := be.checkIP(conn.RemoteAddr()); err != nil {
 		serverName := idnaToUnicode(connServerName(conn))
 		p.recordEvent(serverName + " CheckIP " + err.Error())
 		be.logConnF("BAD [-] %s ➔ %q CheckIP: %v", conn.RemoteAddr(), serverName, err)
-		sendUnrecognizedName(conn)
+		if be.TarpitDuration > 0 {
+			p.recordEvent("tarpit")
+			tarpit(p.ctx, conn, be.TarpitDuration)
+		}
+		p.rejectConn(conn, be.RejectPolicy)
 		return err
 	}
 	return nil
 }
 
+// rejectInMaintenance rejects the connection with a TLS alert when the
+// backend is in maintenance mode. It must be called before the TLS handshake
+// completes.
+func (p *Proxy) rejectInMaintenance(conn *netw.Conn) bool {
+	be := connBackend(conn)
+	if !be.inMaintenance() {
+		return false
+	}
+	be.recordEvent("maintenance: connection rejected")
+	be.logConnF("INF [-] %s ➔ %q rejected: maintenance mode", conn.RemoteAddr(), idnaToUnicode(connServerName(conn)))
+	sendInternalError(conn)
+	return true
+}
+
 func (p *Proxy) handleACMEConnection(conn *tls.Conn) {
-	ctx, cancel := context.WithTimeout(p.ctx, 2*time.Minute)
+	ctx, cancel := context.WithTimeout(p.ctx, connBackend(conn).tlsHandshakeTimeout())
 	defer cancel()
 	serverName := idnaToUnicode(connServerName(conn))
 	p.logConnF("INF ACME %s ➔  %s", conn.RemoteAddr(), serverName)
-	if err := conn.HandshakeContext(ctx); err != nil {
+	err := conn.HandshakeContext(ctx)
+	handshakeDone(conn)
+	if err != nil {
 		p.recordEvent("tls handshake failed")
 		p.logErrorF("BAD [-] %s ➔ %q Handshake: %v", conn.RemoteAddr(), serverName, unwrapErr(err))
 	}
@@ -1305,9 +1978,11 @@ func (p *Proxy) authorizeTLSConnection(conn *tls.Conn) bool {
 	serverName := connServerName(conn)
 	be := connBackend(conn)
 
-	ctx, cancel := context.WithTimeout(p.ctx, 2*time.Minute)
+	ctx, cancel := context.WithTimeout(p.ctx, be.tlsHandshakeTimeout())
 	defer cancel()
-	if err := conn.HandshakeContext(ctx); err != nil {
+	err := conn.HandshakeContext(ctx)
+	handshakeDone(conn)
+	if err != nil {
 		switch {
 		case err.Error() == "tls: client didn't provide a certificate":
 			p.recordEvent(fmt.Sprintf("deny no cert to %s", idnaToUnicode(serverName)))
@@ -1321,7 +1996,10 @@ func (p *Proxy) authorizeTLSConnection(conn *tls.Conn) bool {
 		be.logErrorF("BAD [-] %s ➔ %q Handshake: %v", conn.RemoteAddr(), idnaToUnicode(serverName), unwrapErr(err))
 		return false
 	}
-	annotatedConn(conn).SetAnnotation(handshakeDoneKey, time.Now())
+	hsDone := time.Now()
+	annotatedConn(conn).SetAnnotation(handshakeDoneKey, hsDone)
+	startTime := annotatedConn(conn).Annotation(startTimeKey, time.Time{}).(time.Time)
+	p.metricsFor(serverName).handshakeTime.Add(hsDone.Sub(startTime))
 	cs := conn.ConnectionState()
 	if (cs.ServerName == "" && serverName != p.defaultServerName()) || (cs.ServerName != "" && cs.ServerName != serverName) {
 		p.recordEvent("mismatched server name")
@@ -1337,7 +2015,7 @@ func (p *Proxy) authorizeTLSConnection(conn *tls.Conn) bool {
 	annotatedConn(conn).SetAnnotation(clientCertKey, clientCert)
 
 	// The check below is also done in VerifyConnection.
-	if be.ClientAuth != nil && be.ClientAuth.ACL != nil {
+	if be.ClientAuth != nil && be.ClientAuth.ACL != nil && !be.ClientAuth.Optional {
 		if err := be.authorize(clientCert); err != nil {
 			p.recordEvent(err.Error())
 			be.logErrorF("BAD [-] %s ➔ %q Authorize(%q): %v", conn.RemoteAddr(), idnaToUnicode(serverName), certSummary(clientCert), err)
@@ -1401,7 +2079,6 @@ func (p *Proxy) handleTLSConnection(extConn *tls.Conn) {
 		return
 	}
 	defer intConn.Close()
-	setKeepAlive(intConn)
 	annotatedConn(extConn).SetAnnotation(dialDoneKey, time.Now())
 
 	desc := formatConnDesc(annotatedConn(extConn))
@@ -1415,6 +2092,9 @@ func (p *Proxy) handleTLSConnection(extConn *tls.Conn) {
 	hsTime := annotatedConn(extConn).Annotation(handshakeDoneKey, time.Time{}).(time.Time)
 	dialTime := annotatedConn(extConn).Annotation(dialDoneKey, time.Time{}).(time.Time)
 	totalTime := time.Since(startTime).Truncate(time.Millisecond)
+	m := p.metricsFor(serverName)
+	m.dialTime.Add(dialTime.Sub(hsTime))
+	m.totalTime.Add(totalTime)
 
 	be.logConnF("END %s; HS:%s Dial:%s Dur:%s Recv:%d Sent:%d", desc,
 		hsTime.Sub(startTime).Truncate(time.Millisecond),
@@ -1422,25 +2102,30 @@ func (p *Proxy) handleTLSConnection(extConn *tls.Conn) {
 		annotatedConn(extConn).BytesReceived(), annotatedConn(extConn).BytesSent())
 }
 
-func (p *Proxy) handleTLSPassthroughConnection(extConn net.Conn) {
+// handleTLSPassthroughConnection forwards the connection to the backend. It
+// returns false if the backend couldn't be reached and the connection should
+// use the backend's PassthroughFallback.
+func (p *Proxy) handleTLSPassthroughConnection(extConn net.Conn) bool {
 	serverName := connServerName(extConn)
 	be := connBackend(extConn)
 	if err := be.connLimit.Wait(p.ctx); err != nil {
 		p.recordEvent(err.Error())
 		be.logErrorF("ERR [-] %s ➔  %q Wait: %v", extConn.RemoteAddr(), idnaToUnicode(serverName), err)
 		sendInternalError(extConn)
-		return
+		return true
 	}
 
 	intConn, err := be.dial(context.WithValue(p.ctx, connCtxKey, extConn))
 	if err != nil {
 		p.recordEvent("dial error")
 		be.logErrorF("ERR [-] %s ➔  %q Dial: %v", extConn.RemoteAddr(), idnaToUnicode(serverName), err)
+		if be.PassthroughFallback != nil {
+			return false
+		}
 		sendInternalError(extConn)
-		return
+		return true
 	}
 	defer intConn.Close()
-	setKeepAlive(intConn)
 
 	annotatedConn(extConn).SetAnnotation(dialDoneKey, time.Now())
 
@@ -1454,10 +2139,14 @@ func (p *Proxy) handleTLSPassthroughConnection(extConn net.Conn) {
 	startTime := annotatedConn(extConn).Annotation(startTimeKey, time.Time{}).(time.Time)
 	dialTime := annotatedConn(extConn).Annotation(dialDoneKey, time.Time{}).(time.Time)
 	totalTime := time.Since(startTime).Truncate(time.Millisecond)
+	m := p.metricsFor(serverName)
+	m.dialTime.Add(dialTime.Sub(startTime))
+	m.totalTime.Add(totalTime)
 
 	be.logConnF("END %s; Dial:%s Dur:%s Recv:%d Sent:%d", desc,
 		dialTime.Sub(startTime).Truncate(time.Millisecond), totalTime,
 		annotatedConn(extConn).BytesReceived(), annotatedConn(extConn).BytesSent())
+	return true
 }
 
 func (p *Proxy) defaultServerName() string {
@@ -1479,6 +2168,14 @@ func (p *Proxy) backend(serverName string, protos ...string) (*Backend, error) {
 	if !ok {
 		be, ok = p.backends[beKey{serverName: serverName}]
 	}
+	if !ok && p.cfg != nil {
+		for _, b := range p.cfg.Backends {
+			if b.OnDemandTLS != nil && serverNameAllowed(serverName, b.OnDemandTLS.ServerNames) {
+				be, ok = b, true
+				break
+			}
+		}
+	}
 	if !ok {
 		return nil, errors.New("unexpected SNI")
 	}
@@ -1491,6 +2188,10 @@ func (p *Proxy) backend(serverName string, protos ...string) (*Backend, error) {
 }
 
 func formatReqDesc(req *http.Request) string {
+	return formatReqDescRedacted(req, nil)
+}
+
+func formatReqDescRedacted(req *http.Request, r *logRedactor) string {
 	var ids []string
 	if claims := claimsFromCtx(req.Context()); claims != nil {
 		email, _ := claims["email"].(string)
@@ -1501,10 +2202,22 @@ func formatReqDesc(req *http.Request) string {
 		log.Printf("ERR Request without connCtxKey: %v", req.Context())
 		return ""
 	}
-	return formatConnDesc(conn, ids...)
+	remote := realClientAddr(req)
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return formatDescRedacted(conn, remote, r, ids...)
 }
 
 func formatConnDesc(c anyConn, ids ...string) string {
+	return formatConnDescRedacted(c, nil, ids...)
+}
+
+func formatConnDescRedacted(c anyConn, r *logRedactor, ids ...string) string {
+	return formatDescRedacted(c, c.RemoteAddr(), r, ids...)
+}
+
+func formatDescRedacted(c anyConn, remote net.Addr, r *logRedactor, ids ...string) string {
 	serverName := connServerName(c)
 	mode := connMode(c)
 	proto := connProto(c)
@@ -1517,6 +2230,9 @@ func formatConnDesc(c anyConn, ids ...string) string {
 		identities = append(identities, sum)
 	}
 	identities = append(identities, ids...)
+	for i, id := range identities {
+		identities[i] = r.value(redactUser, id)
+	}
 
 	var buf bytes.Buffer
 	if len(identities) == 0 {
@@ -1524,7 +2240,7 @@ func formatConnDesc(c anyConn, ids ...string) string {
 	} else {
 		buf.WriteString("[" + strings.Join(identities, "|") + "] ")
 	}
-	buf.WriteString(c.RemoteAddr().Network() + ":" + c.RemoteAddr().String())
+	buf.WriteString(remote.Network() + ":" + r.addr(remote))
 	if isProxyProtoConn(c) {
 		buf.WriteString(" ➔ ")
 		buf.WriteString(c.LocalAddr().Network() + ":" + c.LocalAddr().String())
@@ -1551,15 +2267,52 @@ func formatConnDesc(c anyConn, ids ...string) string {
 	return buf.String()
 }
 
-func setKeepAlive(conn net.Conn) {
+// setTCPOptions sets the socket options of the underlying TCP connection, if
+// any. A nil opts uses the default options.
+func setTCPOptions(conn net.Conn, opts *TCPOptions) {
 	switch c := conn.(type) {
 	case *tls.Conn:
-		setKeepAlive(c.NetConn())
-	case *net.TCPConn:
-		c.SetKeepAlivePeriod(30 * time.Second)
-		c.SetKeepAlive(true)
+		setTCPOptions(c.NetConn(), opts)
 	case *netw.Conn:
-		setKeepAlive(c.Conn)
+		setTCPOptions(c.Conn, opts)
+	case *proxyproto.Conn:
+		setTCPOptions(c.Raw(), opts)
+	case *net.TCPConn:
+		if opts == nil {
+			opts = &TCPOptions{}
+		}
+		c.SetNoDelay(opts.NoDelay == nil || *opts.NoDelay)
+		if opts.ReceiveBufferSize > 0 {
+			c.SetReadBuffer(opts.ReceiveBufferSize)
+		}
+		if opts.SendBufferSize > 0 {
+			c.SetWriteBuffer(opts.SendBufferSize)
+		}
+		if opts.KeepAliveIdle < 0 {
+			c.SetKeepAlive(false)
+		} else {
+			kac := net.KeepAliveConfig{
+				Enable:   true,
+				Idle:     opts.KeepAliveIdle,
+				Interval: opts.KeepAliveInterval,
+				Count:    opts.KeepAliveCount,
+			}
+			if kac.Idle == 0 {
+				kac.Idle = 30 * time.Second
+			}
+			if kac.Interval == 0 {
+				kac.Interval = kac.Idle
+			}
+			if kac.Count == 0 {
+				kac.Count = -1
+			}
+			c.SetKeepAliveConfig(kac)
+		}
+		if opts.UserTimeout > 0 {
+			if rc, err := c.SyscallConn(); err == nil {
+				setTCPUserTimeout(rc, opts.UserTimeout)
+			}
+		}
 	default:
 	}
 }
@@ -1624,6 +2377,22 @@ func certSummary(c *x509.Certificate) string {
 	return strings.Join(parts, ";")
 }
 
+// newTOTPManager returns a TOTP manager for the mode set in the identity
+// provider's config, or nil if TOTP is not enabled.
+func (p *Proxy) newTOTPManager(provider, mode, issuer string) (*totp.Manager, error) {
+	if mode == "" {
+		return nil, nil
+	}
+	return totp.New(totp.Config{
+		Store:         p.store,
+		Provider:      provider,
+		Logger:        p.extLogger(),
+		Issuer:        issuer,
+		Required:      mode == "required",
+		EventRecorder: eventRecorder{record: p.recordEvent},
+	})
+}
+
 func guessIDP(url string) string {
 	if strings.HasPrefix(url, "https://accounts.google.com/") {
 		return "google"
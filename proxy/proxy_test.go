@@ -55,6 +55,7 @@ import (
 	"golang.org/x/net/http2/h2c"
 
 	"github.com/c2FmZQ/tlsproxy/certmanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/ocspcache"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/pki"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/tokenmanager"
@@ -588,6 +589,376 @@ func TestAuthnAuthz(t *testing.T) {
 	}
 }
 
+func TestRoutes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+	be2 := newTCPServer(t, ctx, "backend2", nil)
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				Name:        "web",
+				ServerNames: []string{"chat.example.com"},
+				Addresses:   []string{be1.listener.Addr().String()},
+			},
+			{
+				Name:        "xmpp",
+				ServerNames: []string{"xmpp.example.com"},
+				Addresses:   []string{be2.listener.Addr().String()},
+				ALPNProtos:  &[]string{"xmpp-client"},
+			},
+		},
+		Routes: []*ConfigRoute{
+			{
+				ServerName: "chat.example.com",
+				ALPNProtos: []string{"xmpp-client"},
+				Backend:    "xmpp",
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	for _, tc := range []struct {
+		host   string
+		protos []string
+		want   string
+	}{
+		{host: "chat.example.com", want: "Hello from backend1\n"},
+		{host: "chat.example.com", protos: []string{"h2", "http/1.1"}, want: "Hello from backend1\n"},
+		{host: "chat.example.com", protos: []string{"xmpp-client"}, want: "Hello from backend2\n"},
+		{host: "xmpp.example.com", protos: []string{"xmpp-client"}, want: "Hello from backend2\n"},
+	} {
+		got, _, err := tlsGet(tc.host, proxy.listener.Addr().String(), "Hello!\n", extCA, nil, tc.protos)
+		if err != nil {
+			t.Errorf("tlsGet(%q, %v): %v", tc.host, tc.protos, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("tlsGet(%q, %v) = %q, want %q", tc.host, tc.protos, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		desc    string
+		routes  []*ConfigRoute
+		wantErr string
+	}{
+		{
+			desc:    "unknown backend",
+			routes:  []*ConfigRoute{{ServerName: "chat.example.com", ALPNProtos: []string{"xmpp-client"}, Backend: "foo"}},
+			wantErr: `routes[0].Backend: unknown backend "foo"`,
+		},
+		{
+			desc:    "unsupported proto",
+			routes:  []*ConfigRoute{{ServerName: "chat.example.com", ALPNProtos: []string{"imap"}, Backend: "xmpp"}},
+			wantErr: `routes[0].ALPNProtos: backend "xmpp" doesn't support alpnProto "imap"`,
+		},
+		{
+			desc: "duplicate route",
+			routes: []*ConfigRoute{
+				{ServerName: "chat.example.com", ALPNProtos: []string{"xmpp-client"}, Backend: "xmpp"},
+				{ServerName: "chat.example.com", ALPNProtos: []string{"xmpp-client"}, Backend: "xmpp"},
+			},
+			wantErr: `routes[1]: server name "chat.example.com" alpnProto "xmpp-client" is already routed by routes[0]`,
+		},
+		{
+			desc:    "conflict with backend",
+			routes:  []*ConfigRoute{{ServerName: "chat.example.com", ALPNProtos: []string{"h2"}, Backend: "both"}},
+			wantErr: `routes[0]: server name "chat.example.com" alpnProto "h2" conflicts with backend[0]`,
+		},
+	} {
+		cfg := &Config{
+			CacheDir: t.TempDir(),
+			Backends: []*Backend{
+				{Name: "web", ServerNames: []string{"chat.example.com"}, Addresses: []string{"127.0.0.1:1"}},
+				{Name: "xmpp", ServerNames: []string{"xmpp.example.com"}, Addresses: []string{"127.0.0.1:1"}, ALPNProtos: &[]string{"xmpp-client"}},
+				{Name: "both", ServerNames: []string{"other.example.com"}, Addresses: []string{"127.0.0.1:1"}},
+			},
+			Routes: tc.routes,
+		}
+		if err := cfg.Check(); err == nil || err.Error() != tc.wantErr {
+			t.Errorf("%s: Check() = %v, want %q", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestPassthroughFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", extCA)
+
+	dir := t.TempDir()
+	errorPage := filepath.Join(dir, "error.html")
+	if err := os.WriteFile(errorPage, []byte("<h1>Down for maintenance</h1>"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	// Reserve a port that nothing listens on.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	deadAddr := l.Addr().String()
+	l.Close()
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: dir,
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"down.example.com"},
+				Mode:        "TLSPASSTHROUGH",
+				Addresses:   []string{deadAddr},
+				PassthroughFallback: &PassthroughFallback{
+					ErrorPage: errorPage,
+				},
+			},
+			{
+				ServerNames: []string{"down2.example.com"},
+				Mode:        "TLSPASSTHROUGH",
+				Addresses:   []string{deadAddr},
+				PassthroughFallback: &PassthroughFallback{
+					Backend: "console",
+				},
+			},
+			{
+				ServerNames: []string{"imap.example.com"},
+				Mode:        "TLSPASSTHROUGH",
+				Addresses:   []string{be1.listener.Addr().String()},
+				ALPNProtos:  &[]string{"imap"},
+				PassthroughFallback: &PassthroughFallback{
+					ErrorPage:      errorPage,
+					OnALPNMismatch: true,
+				},
+			},
+			{
+				Name:        "console",
+				ServerNames: []string{"console.example.com"},
+				Mode:        "CONSOLE",
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	for _, tc := range []struct {
+		desc, host, want string
+	}{
+		{desc: "error page", host: "down.example.com", want: "HTTP/1.1 503 Service Unavailable\n<h1>Down for maintenance</h1>"},
+		{desc: "fallback backend", host: "down2.example.com", want: "HTTP/2.0 200 OK"},
+		{desc: "alpn mismatch", host: "imap.example.com", want: "HTTP/1.1 503 Service Unavailable\n<h1>Down for maintenance</h1>"},
+	} {
+		got, _, err := httpGet(tc.host, proxy.listener.Addr().String(), "/", extCA, nil)
+		if err != nil {
+			t.Errorf("%s: httpGet: %v", tc.desc, err)
+			continue
+		}
+		if !strings.HasPrefix(got, tc.want) {
+			t.Errorf("%s: Got %q, want %q", tc.desc, got, tc.want)
+		}
+	}
+
+	got, _, err := tlsGet("imap.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, []string{"imap"})
+	if err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	if want := "Hello from backend1\n"; got != want {
+		t.Errorf("tlsGet() = %q, want %q", got, want)
+	}
+}
+
+func TestDialSourceAddress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames:       []string{"local.example.com"},
+				Addresses:         []string{be1.listener.Addr().String()},
+				DialSourceAddress: "127.0.0.1",
+			},
+			{
+				ServerNames: []string{"remote.example.com"},
+				Addresses:   []string{be1.listener.Addr().String()},
+				// Not a local address.
+				DialSourceAddress: "192.0.2.1",
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	got, _, err := tlsGet("local.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil)
+	if err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	if want := "Hello from backend1\n"; got != want {
+		t.Errorf("tlsGet() = %q, want %q", got, want)
+	}
+	if got, _, _ := tlsGet("remote.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); got != "" {
+		t.Errorf("tlsGet() = %q, want dial error", got)
+	}
+
+	cfg.Backends[0].DialSourceAddress = "foo"
+	if err := cfg.Check(); err == nil {
+		t.Error("Check() with invalid DialSourceAddress should fail")
+	}
+}
+
+func TestDialInterface(t *testing.T) {
+	if !bindToDeviceSupported {
+		t.Skip("not supported on this platform")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames:   []string{"lo.example.com"},
+				Addresses:     []string{be1.listener.Addr().String()},
+				DialInterface: "lo",
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	got, _, err := tlsGet("lo.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil)
+	if err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	if want := "Hello from backend1\n"; got != want {
+		t.Errorf("tlsGet() = %q, want %q", got, want)
+	}
+
+	cfg.Backends[0].DialInterface = "nonexistent0"
+	if err := cfg.Check(); err == nil {
+		t.Error("Check() with unknown DialInterface should fail")
+	}
+}
+
+func TestOptionalClientAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	intCA, err := certmanager.New("internal-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{
+					"mixed.example.com",
+				},
+				Mode: "CONSOLE",
+				ClientAuth: &ClientAuth{
+					RootCAs:       []string{intCA.RootCAPEM()},
+					ACL:           &[]string{"SUBJECT:CN=client1"},
+					Optional:      true,
+					RequiredPaths: []string{"/private/"},
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	get := func(path, certName string) (string, error) {
+		var certs []tls.Certificate
+		if certName != "" {
+			c, err := intCA.GetCert(certName)
+			if err != nil {
+				t.Fatalf("intCA.GetCert: %v", err)
+			}
+			certs = append(certs, *c)
+		}
+		body, _, err := httpGet("mixed.example.com", proxy.listener.Addr().String(), path, extCA, certs)
+		return body, err
+	}
+
+	for _, tc := range []struct {
+		desc, path, certName, want string
+	}{
+		{desc: "public, no cert", path: "/", want: "HTTP/2.0 200 OK"},
+		{desc: "public, wrong cert", path: "/", certName: "foo", want: "HTTP/2.0 200 OK"},
+		{desc: "private, no cert", path: "/private/x", want: "HTTP/2.0 403 Forbidden"},
+		{desc: "private, wrong cert", path: "/private/x", certName: "foo", want: "HTTP/2.0 403 Forbidden"},
+		{desc: "private, client1", path: "/private/x", certName: "client1", want: "HTTP/2.0 404 Not Found"},
+	} {
+		got, err := get(tc.path, tc.certName)
+		if err != nil {
+			t.Errorf("%s: get(%q) failed: %v", tc.desc, tc.path, err)
+			continue
+		}
+		if !strings.HasPrefix(got, tc.want) {
+			t.Errorf("%s: Got %q, want %q", tc.desc, got, tc.want)
+		}
+	}
+}
+
 func TestLocalTLSCerts(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -1163,6 +1534,119 @@ func TestProxyTPM(t *testing.T) {
 	}
 }
 
+func TestReAuthorizeWithoutBackend(t *testing.T) {
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Mode:        "LOCAL",
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+
+	// The server name is set before the backend while the connection is
+	// being set up.
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := netw.NewConnForTest(c1)
+	defer conn.Close()
+	conn.SetAnnotation(serverNameKey, "www.example.com")
+	proxy.inConns.add(conn)
+	defer proxy.inConns.remove(conn)
+
+	proxy.reAuthorize()
+}
+
+func TestReAuthorizeOptionalClientAuth(t *testing.T) {
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	intCA, err := certmanager.New("internal-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	newCfg := func(requiredPaths ...string) *Config {
+		return &Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"mixed.example.com"},
+					Mode:        "CONSOLE",
+					ClientAuth: &ClientAuth{
+						RootCAs:       []string{intCA.RootCAPEM()},
+						ACL:           &[]string{"SUBJECT:CN=client1"},
+						Optional:      true,
+						RequiredPaths: requiredPaths,
+					},
+				},
+			},
+		}
+	}
+	proxy := newTestProxy(newCfg("/private/"), extCA)
+	be, err := proxy.backend("mixed.example.com", "")
+	if err != nil {
+		t.Fatalf("proxy.backend: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer l.Close()
+	c2, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	defer c2.Close()
+	c1, err := l.Accept()
+	if err != nil {
+		t.Fatalf("l.Accept: %v", err)
+	}
+	conn := netw.NewConnForTest(c1)
+	defer conn.Close()
+	conn.SetAnnotation(serverNameKey, "mixed.example.com")
+	conn.SetAnnotation(backendKey, be)
+	proxy.inConns.add(conn)
+	defer proxy.inConns.remove(conn)
+
+	isClosed := func() bool {
+		c2.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := c2.Read(make([]byte, 1))
+		return errors.Is(err, io.EOF)
+	}
+
+	// The same client auth policy keeps the connection.
+	if err := proxy.Reconfigure(newCfg("/private/")); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	proxy.reAuthorize()
+	if isClosed() {
+		t.Fatal("connection closed with the same policy")
+	}
+
+	// The old backend would still serve /admin/ without a certificate.
+	if err := proxy.Reconfigure(newCfg("/private/", "/admin/")); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	proxy.reAuthorize()
+	if !isClosed() {
+		t.Error("connection not closed after the policy changed")
+	}
+}
+
 func TestCheckIP(t *testing.T) {
 	cfg := &Config{
 		HTTPAddr: "localhost:0",
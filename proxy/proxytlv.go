@@ -0,0 +1,114 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/c2FmZQ/ech"
+	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+// connProxyTLVs returns the TLVs of the PROXY protocol header received on
+// the connection, if any.
+func connProxyTLVs(c anyConn) []proxyproto.TLV {
+	switch cc := c.(type) {
+	case *tls.Conn:
+		return connProxyTLVs(cc.NetConn())
+	case *netw.Conn:
+		return connProxyTLVs(cc.Conn)
+	case *ech.Conn:
+		return connProxyTLVs(cc.Conn)
+	case *proxyproto.Conn:
+		header := cc.ProxyHeader()
+		if header == nil {
+			return nil
+		}
+		tlvs, err := header.TLVs()
+		if err != nil {
+			return nil
+		}
+		return tlvs
+	default:
+		return nil
+	}
+}
+
+// proxyTLVValue returns the value of a TLV received in the PROXY protocol
+// header. The name is one of:
+//   - aws-vpce-id: the AWS VPC endpoint ID.
+//   - azure-link-id: the Azure private endpoint link ID.
+//   - gcp-psc-id: the GCP Private Service Connect connection ID.
+//   - authority: the server name requested by the client.
+//   - alpn: the ALPN protocol negotiated with the client.
+//   - unique-id: the unique ID of the connection.
+//   - 0xNN: the hex encoded value of the TLV of type NN.
+func proxyTLVValue(tlvs []proxyproto.TLV, name string) string {
+	if len(tlvs) == 0 {
+		return ""
+	}
+	switch strings.ToLower(name) {
+	case "aws-vpce-id":
+		return tlvparse.FindAWSVPCEndpointID(tlvs)
+	case "azure-link-id":
+		if id, ok := tlvparse.FindAzurePrivateEndpointLinkID(tlvs); ok {
+			return strconv.FormatUint(uint64(id), 10)
+		}
+	case "gcp-psc-id":
+		if id, ok := tlvparse.ExtractPSCConnectionID(tlvs); ok {
+			return strconv.FormatUint(id, 10)
+		}
+	case proxyTLVAuthority:
+		return findProxyTLV(tlvs, proxyproto.PP2_TYPE_AUTHORITY)
+	case proxyTLVALPN:
+		return findProxyTLV(tlvs, proxyproto.PP2_TYPE_ALPN)
+	case proxyTLVUniqueID:
+		return findProxyTLV(tlvs, proxyproto.PP2_TYPE_UNIQUE_ID)
+	default:
+		if len(name) != 4 || !strings.HasPrefix(name, "0x") {
+			return ""
+		}
+		t, err := strconv.ParseUint(name[2:], 16, 8)
+		if err != nil {
+			return ""
+		}
+		return hex.EncodeToString([]byte(findProxyTLV(tlvs, proxyproto.PP2Type(t))))
+	}
+	return ""
+}
+
+func findProxyTLV(tlvs []proxyproto.TLV, t proxyproto.PP2Type) string {
+	for _, tlv := range tlvs {
+		if tlv.Type == t {
+			return string(tlv.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,138 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestInboundProxyTLVHeaders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "vpce=%q raw=%q", req.Header.Get("x-vpce-id"), req.Header.Get("x-raw"))
+	}))
+
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			AcceptProxyHeaderFrom: []string{
+				"127.0.0.1/32",
+				"::1/128",
+			},
+			Backends: []*Backend{
+				{
+					ServerNames: []string{
+						"example.com",
+					},
+					Mode: "HTTP",
+					Addresses: []string{
+						l.Addr().String(),
+					},
+					ForwardHTTPHeaders: map[string]string{
+						"x-vpce-id": "${PROXY_TLV:aws-vpce-id}",
+						"x-raw":     "${PROXY_TLV:0xE0}",
+					},
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	get := func(tlvs []proxyproto.TLV) string {
+		t.Helper()
+		c, err := net.Dial("tcp", proxy.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		header := proxyproto.HeaderProxyFromAddrs(2, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 12345}, &net.TCPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 23456})
+		header.Command = proxyproto.PROXY
+		if err := header.SetTLVs(tlvs); err != nil {
+			t.Fatalf("SetTLVs: %v", err)
+		}
+		if _, err := header.WriteTo(c); err != nil {
+			t.Fatalf("WriteTo: %v", err)
+		}
+		tlsConn := tls.Client(c, &tls.Config{
+			ServerName: "example.com",
+			RootCAs:    extCA.RootCACertPool(),
+		})
+		defer tlsConn.Close()
+		// The client's own headers are overwritten or removed.
+		fmt.Fprint(tlsConn, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Vpce-Id: spoofed\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+		if err != nil {
+			t.Fatalf("ReadResponse: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		return string(body)
+	}
+
+	got := get([]proxyproto.TLV{
+		{Type: tlvparse.PP2_TYPE_AWS, Value: append([]byte{tlvparse.PP2_SUBTYPE_AWS_VPCE_ID}, "vpce-0123456789abcdef"...)},
+		{Type: 0xE0, Value: []byte{0x01, 0x02}},
+	})
+	if want := `vpce="vpce-0123456789abcdef" raw="0102"`; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+
+	got = get(nil)
+	if want := `vpce="" raw=""`; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
@@ -30,7 +30,6 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -54,6 +53,7 @@ const (
 	quicBadGateway       = quic.ApplicationErrorCode(0x1003)
 	quicStreamError      = quic.ApplicationErrorCode(0x1004)
 	quicTooBusy          = quic.ApplicationErrorCode(0x1005)
+	quicMaintenance      = quic.ApplicationErrorCode(0x1006)
 )
 
 func (p *Proxy) startQUIC(ctx context.Context) error {
@@ -98,7 +98,23 @@ func (p *Proxy) startQUICListener(ctx context.Context) error {
 		p.logErrorF("ERR QUIC connection %s %s", hello.ServerName, hello.SupportedProtos)
 		return nil, tlsUnrecognizedName
 	}
-	quicListener, err := p.quicTransport.(*netw.QUICTransport).Listen(tc)
+	opts := []netw.QUICOption{
+		netw.WithConnFilter(func(addr net.Addr) bool {
+			if !p.isRealClientIPSource(addr) && !p.handshakeLimiter().allow(addr) {
+				p.recordEvent("handshake rate limit")
+				p.logErrorF("BAD [-] %s: handshake rate limit exceeded", addr)
+				return false
+			}
+			return true
+		}),
+		netw.WithHandshakeIdleTimeout(p.cfg.QUICHandshakeTimeout),
+		netw.WithInitialPacketSize(p.cfg.QUICInitialPacketSize),
+	}
+	p.quicEarlyData = p.cfg.earlyDataEnabled()
+	if p.quicEarlyData {
+		opts = append(opts, netw.WithEarlyData())
+	}
+	quicListener, err := p.quicTransport.(*netw.QUICTransport).Listen(tc, opts...)
 	if err != nil {
 		return err
 	}
@@ -107,9 +123,19 @@ func (p *Proxy) startQUICListener(ctx context.Context) error {
 	return nil
 }
 
+// acceptsEarlyData returns true if the backend for serverName and proto can
+// serve requests before the handshake completes.
+func (p *Proxy) acceptsEarlyData(serverName, proto string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	be, ok := p.backends[beKey{serverName: serverName, proto: proto}]
+	return ok && be.EarlyData != nil
+}
+
 func (p *Proxy) quicAcceptLoop(ctx context.Context, ln *netw.QUICListener) {
 	p.logConnF("INF Accepting QUIC connections on %s %s", ln.Addr().Network(), ln.Addr())
 	for {
+		p.waitNotOverloaded(ctx)
 		conn, err := ln.Accept(ctx)
 		if err != nil {
 			if errors.Is(err, quic.ErrServerClosed) || errors.Is(err, quic.ErrTransportClosed) || errors.Is(err, context.Canceled) || err.Error() == "closing" {
@@ -148,8 +174,17 @@ func (p *Proxy) handleQUICConnection(qc *netw.QUICConn) {
 		p.connClosed.Broadcast()
 	})
 	qc.SetAnnotation(startTimeKey, time.Now())
+	qc.SetAnnotation(connIDKey, newRandomID())
 
 	cs := qc.TLSConnectionState()
+	if !handshakeComplete(qc) && !p.acceptsEarlyData(cs.ServerName, cs.NegotiatedProtocol) {
+		select {
+		case <-qc.HandshakeComplete():
+		case <-ctx.Done():
+			return
+		}
+		cs = qc.TLSConnectionState()
+	}
 	qc.SetAnnotation(serverNameKey, cs.ServerName)
 	qc.SetAnnotation(protoKey, cs.NegotiatedProtocol)
 	qc.SetAnnotation(echAcceptedKey, cs.ECHAccepted)
@@ -168,7 +203,7 @@ func (p *Proxy) handleQUICConnection(qc *netw.QUICConn) {
 	p.mu.RLock()
 	be, ok := p.backends[beKey{serverName: cs.ServerName, proto: cs.NegotiatedProtocol}]
 	p.mu.RUnlock()
-	if !ok {
+	if !ok || !be.servedOn("") {
 		p.recordEvent("unexpected SNI")
 		p.logErrorF("BAD [%s] %s:%s ➔ %q: unexpected SNI", sum, qc.RemoteAddr().Network(), qc.RemoteAddr(), cs.ServerName)
 		qc.CloseWithError(quicUnrecognizedName, "unrecognized name")
@@ -188,7 +223,7 @@ func (p *Proxy) handleQUICConnection(qc *netw.QUICConn) {
 		qc.SetLimiters(l.ingress, l.egress)
 	}
 
-	if err := be.checkIP(qc.RemoteAddr()); err != nil {
+	if err := be.checkIP(qc.RemoteAddr()); err != nil && !be.trustsRealClientIP(qc.RemoteAddr()) {
 		p.recordEvent(idnaToUnicode(cs.ServerName) + " CheckIP " + err.Error())
 		be.logErrorF("BAD [%s] %s:%s ➔ %q CheckIP: %v", sum, qc.RemoteAddr().Network(), qc.RemoteAddr(), idnaToUnicode(cs.ServerName), err)
 		qc.CloseWithError(quicAccessDenied, "access denied")
@@ -223,7 +258,15 @@ func (p *Proxy) handleQUICConnection(qc *netw.QUICConn) {
 		be.logErrorF("ERR [%s] %s:%s ➔ %s|%s:%s %s: %v", sum, qc.RemoteAddr().Network(), qc.RemoteAddr(), idnaToUnicode(cs.ServerName), be.Mode, cs.NegotiatedProtocol, tag, err)
 	}
 
-	if serv, ok := be.http3Server.(*http3.Server); ok && cs.NegotiatedProtocol == "h3" {
+	serv, isH3 := be.http3Server.(*http3.Server)
+	isH3 = isH3 && cs.NegotiatedProtocol == "h3"
+	if !isH3 && be.inMaintenance() {
+		be.recordEvent("maintenance: connection rejected")
+		qc.CloseWithError(quicMaintenance, "maintenance")
+		return
+	}
+
+	if isH3 {
 		if err := serv.ServeQUICConn(qc); err != nil {
 			reportErr(err, "ServeQUICConn")
 		}
@@ -397,7 +440,6 @@ func (p *Proxy) handleQUICTCPStream(ctx context.Context, be *Backend, conn *netw
 			return
 		}
 		defer intConn.Close()
-		setKeepAlive(intConn)
 
 		conn.SetAnnotation(dialDoneKey, time.Now())
 		if cc, ok := conn.Conn.(interface {
@@ -414,6 +456,9 @@ func (p *Proxy) handleQUICTCPStream(ctx context.Context, be *Backend, conn *netw
 		startTime := conn.Annotation(startTimeKey, time.Time{}).(time.Time)
 		dialTime := conn.Annotation(dialDoneKey, time.Time{}).(time.Time)
 		totalTime := time.Since(startTime).Truncate(time.Millisecond)
+		m := p.metricsFor(connServerName(conn))
+		m.dialTime.Add(dialTime.Sub(startTime))
+		m.totalTime.Add(totalTime)
 
 		be.logConnF("END %s; Dial:%s Dur:%s Recv:%d Sent:%d", formatConnDesc(conn),
 			dialTime.Sub(startTime).Truncate(time.Millisecond), totalTime,
@@ -484,7 +529,7 @@ func (be *Backend) dialQUIC(ctx context.Context, addr string, tc *tls.Config) (*
 	if !ok {
 		return nil, errors.New("invalid QUIC transport")
 	}
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	udpAddr, err := be.resolveUDPAddr(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -492,13 +537,28 @@ func (be *Backend) dialQUIC(ctx context.Context, addr string, tc *tls.Config) (*
 	if cc, ok := ctx.Value(connCtxKey).(*netw.QUICConn); ok {
 		enableDatagrams = cc.ConnectionState().SupportsDatagrams
 	}
-	conn, err := qt.DialEarly(ctx, udpAddr, tc, enableDatagrams)
+	conn, err := qt.DialEarly(ctx, udpAddr, tc, enableDatagrams, be.forwardQUICOptions()...)
 	if err != nil {
 		return nil, err
 	}
 	return conn, nil
 }
 
+// forwardQUICOptions returns the QUIC options to use when connecting to the
+// backend servers.
+func (be *Backend) forwardQUICOptions() []netw.QUICOption {
+	fq := be.ForwardQUIC
+	if fq == nil {
+		return nil
+	}
+	return []netw.QUICOption{
+		netw.WithHandshakeIdleTimeout(fq.HandshakeIdleTimeout),
+		netw.WithMaxIdleTimeout(fq.MaxIdleTimeout),
+		netw.WithKeepAlivePeriod(fq.KeepAlivePeriod),
+		netw.WithInitialReceiveWindows(fq.InitialStreamReceiveWindow, fq.InitialConnectionReceiveWindow),
+	}
+}
+
 func (be *Backend) dialQUICStream(ctx context.Context, addr string, tc *tls.Config) (net.Conn, error) {
 	conn, err := be.dialQUIC(ctx, addr, tc)
 	if err != nil {
@@ -513,11 +573,15 @@ func (be *Backend) dialQUICStream(ctx context.Context, addr string, tc *tls.Conf
 
 func (be *Backend) dialQUICBackend(ctx context.Context, proto string) (*netw.QUICConn, error) {
 	var (
-		addresses          = be.Addresses
+		addresses          = be.addresses()
 		timeout            = be.ForwardTimeout
 		insecureSkipVerify = be.InsecureSkipVerify
 		serverName         = be.ForwardServerName
 		rootCAs            = be.forwardRootCAs
+		requireOCSP        = be.ForwardRequireOCSP
+		requireSCT         = be.ForwardRequireSCT
+		forwardDANE        = be.ForwardDANE
+		pinnedKeys         = be.ForwardPinnedKeys
 		next               = &be.state.next
 	)
 	if id, ok := ctx.Value(ctxOverrideIDKey).(int); ok && id >= 0 && id < len(be.PathOverrides) {
@@ -527,11 +591,23 @@ func (be *Backend) dialQUICBackend(ctx context.Context, proto string) (*netw.QUI
 		insecureSkipVerify = po.InsecureSkipVerify
 		serverName = po.ForwardServerName
 		rootCAs = po.forwardRootCAs
+		requireOCSP = po.ForwardRequireOCSP
+		requireSCT = po.ForwardRequireSCT
+		forwardDANE = po.ForwardDANE
+		pinnedKeys = po.ForwardPinnedKeys
 		next = &be.state.oNext[id]
 	}
 
+	if id, ok := ctx.Value(ctxCanaryIDKey).(int); ok && id >= 0 && id < len(be.Canary) {
+		addresses = be.Canary[id].Addresses
+		next = &be.state.cNext[id]
+	}
+
 	if len(addresses) == 0 {
-		return nil, errors.New("no backend addresses")
+		return nil, errNoBackendAddresses
+	}
+	if addresses = be.draining.filter(addresses); len(addresses) == 0 {
+		return nil, errAllAddressesDraining
 	}
 
 	tc := &tls.Config{
@@ -540,24 +616,9 @@ func (be *Backend) dialQUICBackend(ctx context.Context, proto string) (*netw.QUI
 		NextProtos:           []string{proto},
 		RootCAs:              rootCAs,
 		GetClientCertificate: be.getClientCert(ctx),
-		VerifyConnection: func(cs tls.ConnectionState) error {
-			if len(cs.PeerCertificates) == 0 {
-				return tlsCertificateRequired
-			}
-			cert := cs.PeerCertificates[0]
-			if m, ok := be.pkiMap[hex.EncodeToString(cert.AuthorityKeyId)]; ok {
-				if m.IsRevoked(cert.SerialNumber) {
-					return tlsCertificateRevoked
-				}
-			} else if len(cert.OCSPServer) > 0 {
-				if err := be.ocspCache.VerifyChains(ctx, cs.VerifiedChains, cs.OCSPResponse); err != nil {
-					be.recordEvent(fmt.Sprintf("backend X509 %s [%s] (OCSP:%v)", idnaToUnicode(cs.ServerName), cert.Subject, err))
-					return tlsCertificateRevoked
-				}
-			}
-			return nil
-		},
+		VerifyConnection:     be.verifyConnection(ctx, requireOCSP, requireSCT, pinnedKeys),
 	}
+	be.spiffeTLSConfig(tc)
 
 	var max int
 	for {
@@ -566,13 +627,30 @@ func (be *Backend) dialQUICBackend(ctx context.Context, proto string) (*netw.QUI
 		if max == 0 {
 			max = sz
 		}
-		addr := addresses[*next]
+		addr := addresses[*next%sz]
 		*next = (*next + 1) % sz
 		be.state.mu.Unlock()
 
-		ctx, cancel := context.WithTimeout(ctx, timeout)
-		conn, err := be.dialQUIC(ctx, addr, tc)
-		cancel()
+		var conn *netw.QUICConn
+		targets, err := be.dialTargets(ctx, addr)
+		for i, target := range targets {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			targetTC := tc
+			err = nil
+			if forwardDANE {
+				targetTC, err = be.daneTLSConfig(ctx, tc, target, "udp")
+			}
+			if err == nil {
+				conn, err = be.dialQUIC(ctx, target, targetTC)
+			}
+			cancel()
+			if err == nil {
+				break
+			}
+			if i < len(targets)-1 {
+				be.logErrorF("ERR dialQUIC %q: %v", target, err)
+			}
+		}
 		if err != nil {
 			if max--; max > 0 {
 				be.logErrorF("ERR dialQUIC %q: %v", addr, err)
@@ -107,6 +107,12 @@ func TestQUICConnections(t *testing.T) {
 				ForwardRootCAs:    []string{intCA.RootCAPEM()},
 				ForwardServerName: "quic-internal.example.com",
 				ForwardRateLimit:  1000,
+				ForwardQUIC: &ForwardQUIC{
+					MaxIdleTimeout:                 time.Minute,
+					KeepAlivePeriod:                15 * time.Second,
+					InitialStreamReceiveWindow:     1 << 20,
+					InitialConnectionReceiveWindow: 2 << 20,
+				},
 			},
 			// HTTPS backend
 			{
@@ -142,6 +148,7 @@ func TestQUICConnections(t *testing.T) {
 					"h3",
 				},
 				DocumentRoot: ".",
+				EarlyData:    &EarlyData{},
 			},
 		},
 	}
@@ -435,10 +442,11 @@ func TestQUICMultiStream(t *testing.T) {
 	}()
 
 	cfg := &Config{
-		HTTPAddr: "localhost:0",
-		TLSAddr:  "localhost:0",
-		CacheDir: t.TempDir(),
-		MaxOpen:  1000,
+		HTTPAddr:              "localhost:0",
+		TLSAddr:               "localhost:0",
+		CacheDir:              t.TempDir(),
+		MaxOpen:               1000,
+		QUICInitialPacketSize: 1400,
 		Backends: []*Backend{
 			{
 				ServerNames: []string{
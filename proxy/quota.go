@@ -0,0 +1,225 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errTrafficQuotaExceeded = errors.New("traffic quota exceeded")
+
+// quotaSet contains the traffic usage of the users of each backend, keyed by
+// backend ID and email address.
+type quotaSet struct {
+	mu sync.Mutex
+	m  map[string]map[string]*trafficUsage
+}
+
+type trafficUsage struct {
+	day     string
+	month   string
+	daily   int64
+	monthly int64
+}
+
+// reset clears the counters of the periods that ended before now.
+func (u *trafficUsage) reset(now time.Time) {
+	now = now.UTC()
+	if day := now.Format(time.DateOnly); u.day != day {
+		u.day = day
+		u.daily = 0
+	}
+	if month := now.Format("2006-01"); u.month != month {
+		u.month = month
+		u.monthly = 0
+	}
+}
+
+// add adds n bytes to the usage of user, and returns the updated usage.
+func (s *quotaSet) add(id, user string, n int64, now time.Time) (daily, monthly int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string]map[string]*trafficUsage)
+	}
+	users := s.m[id]
+	if users == nil {
+		users = make(map[string]*trafficUsage)
+		s.m[id] = users
+	}
+	u := users[user]
+	if u == nil {
+		u = &trafficUsage{}
+		users[user] = u
+	}
+	u.reset(now)
+	u.daily += n
+	u.monthly += n
+	return u.daily, u.monthly
+}
+
+type userUsage struct {
+	User    string
+	Daily   int64
+	Monthly int64
+}
+
+// list returns the usage of all the users of a backend, sorted by email
+// address.
+func (s *quotaSet) list(id string, now time.Time) []userUsage {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []userUsage
+	for user, u := range s.m[id] {
+		u.reset(now)
+		out = append(out, userUsage{User: user, Daily: u.daily, Monthly: u.monthly})
+	}
+	slices.SortFunc(out, func(a, b userUsage) int {
+		return strings.Compare(a.User, b.User)
+	})
+	return out
+}
+
+// exceeded returns true if the usage is over one of the quotas.
+func (q *TrafficQuota) exceeded(daily, monthly int64) bool {
+	return (q.Daily > 0 && daily > q.Daily) || (q.Monthly > 0 && monthly > q.Monthly)
+}
+
+// retryAfter returns when the quota that was exceeded will be reset.
+func (q *TrafficQuota) retryAfter(monthly int64, now time.Time) time.Time {
+	now = now.UTC()
+	if q.Monthly > 0 && monthly > q.Monthly {
+		return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+// checkTrafficQuota responds with 429 Too Many Requests when the
+// authenticated user has exceeded one of the backend's traffic quotas.
+// Otherwise, it returns a ResponseWriter and updates the request's body to
+// count the bytes transferred. It returns false when the request should not
+// be processed any further.
+func (be *Backend) checkTrafficQuota(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, bool) {
+	if be.TrafficQuota == nil || be.quotaState == nil {
+		return w, true
+	}
+	user, _ := claimsFromCtx(req.Context())["email"].(string)
+	if user == "" {
+		return w, true
+	}
+	qc := &quotaCounter{
+		be:   be,
+		id:   be.maintenanceID(),
+		user: user,
+	}
+	now := time.Now()
+	if daily, monthly := be.quotaState.add(qc.id, user, 0, now); be.TrafficQuota.exceeded(daily, monthly) {
+		be.recordEvent("traffic quota: request rejected")
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		retry := be.TrafficQuota.retryAfter(monthly, now)
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(retry.Sub(now).Seconds())+1, 10))
+		http.Error(w, "Traffic quota exceeded", http.StatusTooManyRequests)
+		return nil, false
+	}
+	if req.Body != nil {
+		req.Body = &quotaReader{ReadCloser: req.Body, qc: qc}
+	}
+	return &quotaResponseWriter{ResponseWriter: w, qc: qc}, true
+}
+
+// quotaCounter adds the bytes transferred by one request to the user's
+// usage.
+type quotaCounter struct {
+	be   *Backend
+	id   string
+	user string
+
+	mu       sync.Mutex
+	exceeded bool
+}
+
+func (qc *quotaCounter) add(n int) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	daily, monthly := qc.be.quotaState.add(qc.id, qc.user, int64(n), time.Now())
+	if !qc.exceeded && qc.be.TrafficQuota.exceeded(daily, monthly) {
+		qc.exceeded = true
+		qc.be.recordEvent("traffic quota: stream closed")
+		qc.be.logErrorF("INF Traffic quota of %q exceeded on %q", qc.user, qc.id)
+	}
+}
+
+func (qc *quotaCounter) isExceeded() bool {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	return qc.exceeded
+}
+
+type quotaReader struct {
+	io.ReadCloser
+	qc *quotaCounter
+}
+
+func (r *quotaReader) Read(b []byte) (int, error) {
+	if r.qc.isExceeded() {
+		return 0, errTrafficQuotaExceeded
+	}
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		r.qc.add(n)
+	}
+	return n, err
+}
+
+type quotaResponseWriter struct {
+	http.ResponseWriter
+	qc *quotaCounter
+}
+
+func (w *quotaResponseWriter) Write(b []byte) (int, error) {
+	if w.qc.isExceeded() {
+		return 0, errTrafficQuotaExceeded
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if n > 0 {
+		w.qc.add(n)
+	}
+	return n, err
+}
+
+func (w *quotaResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
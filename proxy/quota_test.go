@@ -0,0 +1,112 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestQuotaSetReset(t *testing.T) {
+	var s quotaSet
+	now := time.Date(2025, 1, 31, 23, 0, 0, 0, time.UTC)
+	if d, m := s.add("be", "bob@example.com", 100, now); d != 100 || m != 100 {
+		t.Errorf("add() = %d, %d, want 100, 100", d, m)
+	}
+	if d, m := s.add("be", "bob@example.com", 50, now.Add(30*time.Minute)); d != 150 || m != 150 {
+		t.Errorf("add() = %d, %d, want 150, 150", d, m)
+	}
+	// The next day is also the next month.
+	if d, m := s.add("be", "bob@example.com", 10, now.Add(2*time.Hour)); d != 10 || m != 10 {
+		t.Errorf("add() = %d, %d, want 10, 10", d, m)
+	}
+	if d, m := s.add("be", "bob@example.com", 10, now.Add(26*time.Hour)); d != 10 || m != 20 {
+		t.Errorf("add() = %d, %d, want 10, 20", d, m)
+	}
+	s.add("be", "alice@example.com", 5, now.Add(26*time.Hour))
+	got := s.list("be", now.Add(26*time.Hour))
+	want := []userUsage{
+		{User: "alice@example.com", Daily: 5, Monthly: 5},
+		{User: "bob@example.com", Daily: 10, Monthly: 20},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("list() = %v, want %v", got, want)
+	}
+}
+
+func TestCheckTrafficQuota(t *testing.T) {
+	be := &Backend{
+		Name: "api",
+		Mode: ModeHTTP,
+		TrafficQuota: &TrafficQuota{
+			Daily: 10,
+		},
+		quotaState:  &quotaSet{},
+		recordEvent: func(string) {},
+	}
+	newReq := func(email, body string) *http.Request {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		return req.WithContext(context.WithValue(req.Context(), authCtxKey, jwt.MapClaims{"email": email}))
+	}
+
+	// The body of the request and the response are counted.
+	req := newReq("bob@example.com", "12345")
+	w, ok := be.checkTrafficQuota(httptest.NewRecorder(), req)
+	if !ok {
+		t.Fatal("checkTrafficQuota returned false")
+	}
+	if _, err := req.Body.Read(make([]byte, 10)); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if _, err := w.Write([]byte("abcdef")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	// The quota is now exceeded and the stream is closed.
+	if _, err := w.Write([]byte("x")); !errors.Is(err, errTrafficQuotaExceeded) {
+		t.Errorf("Write() = %v, want %v", err, errTrafficQuotaExceeded)
+	}
+
+	rec := httptest.NewRecorder()
+	if _, ok := be.checkTrafficQuota(rec, newReq("bob@example.com", "")); ok {
+		t.Fatal("checkTrafficQuota returned true")
+	}
+	if got, want := rec.Code, http.StatusTooManyRequests; got != want {
+		t.Errorf("Code = %d, want %d", got, want)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After is not set")
+	}
+
+	// Other users are not affected.
+	if _, ok := be.checkTrafficQuota(httptest.NewRecorder(), newReq("alice@example.com", "")); !ok {
+		t.Error("checkTrafficQuota returned false")
+	}
+}
@@ -0,0 +1,162 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxRealClientIPsPerConn is the number of real client IP addresses that are
+// remembered on each connection from a CDN edge server.
+const maxRealClientIPsPerConn = 1000
+
+// realClientIPs are the real client IP addresses that were already charged to
+// the handshake rate limit on a connection from a CDN edge server.
+type realClientIPs struct {
+	mu  sync.Mutex
+	ips map[string]bool
+}
+
+var realClientIPsMu sync.Mutex
+
+type ctxRealClientAddrKeyType struct{}
+
+var ctxRealClientAddrKey ctxRealClientAddrKeyType
+
+// realClientIP is the validated form of ConfigRealClientIP.
+type realClientIP struct {
+	header  string
+	sources []*net.IPNet
+}
+
+// isTrustedSource returns true if addr is in one of the TrustedSources
+// networks.
+func (r *realClientIP) isTrustedSource(addr net.Addr) bool {
+	if r == nil {
+		return false
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+	for _, n := range r.sources {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerIP returns the IP address in the request's header, or nil if the
+// header is missing or invalid. Only the first value is used when the header
+// contains a list.
+func (r *realClientIP) headerIP(req *http.Request) net.IP {
+	v, _, _ := strings.Cut(req.Header.Get(r.header), ",")
+	return net.ParseIP(strings.TrimSpace(v))
+}
+
+// trustsRealClientIP returns true if the real client IP address of the
+// requests on a connection from addr comes from the RealClientIP header.
+func (be *Backend) trustsRealClientIP(addr net.Addr) bool {
+	switch be.Mode {
+	case ModeConsole, ModeLocal, ModeHTTP, ModeHTTPS:
+		return be.realClientIP.isTrustedSource(addr)
+	default:
+		return false
+	}
+}
+
+// checkRealClientIP applies AllowIPs, DenyIPs, and the handshake rate limit to
+// the real client IP address of requests that come from a trusted CDN edge
+// server. The rate limit is charged once per real client IP address and
+// connection, like the handshakes of direct connections. The real address replaces the request's RemoteAddr so that it is
+// used in the logs and in the forwarded headers. If the header is missing, the
+// edge server's own address is checked instead. It returns false if the
+// request was rejected.
+func (be *Backend) checkRealClientIP(w http.ResponseWriter, req **http.Request) bool {
+	r := *req
+	conn, ok := r.Context().Value(connCtxKey).(anyConn)
+	if !ok || !be.trustsRealClientIP(conn.RemoteAddr()) {
+		return true
+	}
+	addr := conn.RemoteAddr()
+	if ip := be.realClientIP.headerIP(r); ip != nil {
+		addr = &net.TCPAddr{IP: ip}
+		r = r.WithContext(context.WithValue(r.Context(), ctxRealClientAddrKey, addr))
+		r.RemoteAddr = addr.String()
+		*req = r
+	}
+	if err := be.checkIP(addr); err != nil {
+		be.recordEvent("CheckIP " + err.Error())
+		be.logErrorF("BAD %s ➔ %s %s CheckIP: %v", formatReqDesc(r), r.Method, r.URL, err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	if newRealClientIP(conn, addr) && !be.hsLimiter.allow(addr) {
+		be.recordEvent("handshake rate limit")
+		be.logErrorF("BAD %s ➔ %s %s: rate limit exceeded", formatReqDesc(r), r.Method, r.URL)
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// newRealClientIP returns true the first time that addr is seen on conn.
+func newRealClientIP(conn anyConn, addr net.Addr) bool {
+	realClientIPsMu.Lock()
+	seen, ok := annotatedConn(conn).Annotation(realClientIPsKey, nil).(*realClientIPs)
+	if !ok {
+		seen = &realClientIPs{ips: make(map[string]bool)}
+		annotatedConn(conn).SetAnnotation(realClientIPsKey, seen)
+	}
+	realClientIPsMu.Unlock()
+
+	key := addr.String()
+	seen.mu.Lock()
+	defer seen.mu.Unlock()
+	if seen.ips[key] {
+		return false
+	}
+	if len(seen.ips) >= maxRealClientIPsPerConn {
+		clear(seen.ips)
+	}
+	seen.ips[key] = true
+	return true
+}
+
+// realClientAddr returns the real client address of the request, if it came
+// from a trusted CDN edge server.
+func realClientAddr(req *http.Request) net.Addr {
+	addr, _ := req.Context().Value(ctxRealClientAddrKey).(net.Addr)
+	return addr
+}
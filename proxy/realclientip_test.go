@@ -0,0 +1,130 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckRealClientIP(t *testing.T) {
+	_, cdn, _ := net.ParseCIDR("10.0.0.0/8")
+	_, denied, _ := net.ParseCIDR("192.168.0.0/16")
+	be := &Backend{
+		Mode:         ModeHTTPS,
+		realClientIP: &realClientIP{header: "Cf-Connecting-Ip", sources: []*net.IPNet{cdn}},
+		denyIPs:      &[]*net.IPNet{denied},
+		recordEvent:  func(string) {},
+	}
+
+	for _, tc := range []struct {
+		name       string
+		mode       string
+		remoteAddr net.Addr
+		header     string
+		wantOK     bool
+		wantRemote string
+	}{
+		{name: "untrusted source", remoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5000}, header: "192.168.1.1", wantOK: true, wantRemote: "1.2.3.4:5000"},
+		{name: "trusted source", remoteAddr: &net.TCPAddr{IP: net.IPv4(10, 1, 1, 1), Port: 5000}, header: "5.6.7.8", wantOK: true, wantRemote: "5.6.7.8:0"},
+		{name: "trusted source, ipv6 client", remoteAddr: &net.TCPAddr{IP: net.IPv4(10, 1, 1, 1), Port: 5000}, header: "2001:db8::1", wantOK: true, wantRemote: "[2001:db8::1]:0"},
+		{name: "trusted source, list", remoteAddr: &net.TCPAddr{IP: net.IPv4(10, 1, 1, 1), Port: 5000}, header: "5.6.7.8, 9.9.9.9", wantOK: true, wantRemote: "5.6.7.8:0"},
+		{name: "trusted source, denied client", remoteAddr: &net.TCPAddr{IP: net.IPv4(10, 1, 1, 1), Port: 5000}, header: "192.168.1.1", wantOK: false},
+		{name: "trusted source, no header", remoteAddr: &net.TCPAddr{IP: net.IPv4(10, 1, 1, 1), Port: 5000}, wantOK: true, wantRemote: "10.1.1.1:5000"},
+		{name: "tcp mode", mode: ModeTCP, remoteAddr: &net.TCPAddr{IP: net.IPv4(10, 1, 1, 1), Port: 5000}, header: "5.6.7.8", wantOK: true, wantRemote: "10.1.1.1:5000"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			be.Mode = ModeHTTPS
+			if tc.mode != "" {
+				be.Mode = tc.mode
+			}
+			ctx := context.WithValue(context.Background(), connCtxKey, mockConn{
+				localAddr:   &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443},
+				remoteAddr:  tc.remoteAddr,
+				annotations: map[string]any{serverNameKey: "example.com"},
+			})
+			req := httptest.NewRequest("GET", "https://example.com/", nil).WithContext(ctx)
+			req.RemoteAddr = tc.remoteAddr.String()
+			if tc.header != "" {
+				req.Header.Set("CF-Connecting-IP", tc.header)
+			}
+			w := httptest.NewRecorder()
+			if got, want := be.checkRealClientIP(w, &req), tc.wantOK; got != want {
+				t.Fatalf("checkRealClientIP() = %v, want %v", got, want)
+			}
+			if !tc.wantOK {
+				if got, want := w.Code, http.StatusForbidden; got != want {
+					t.Errorf("Code = %d, want %d", got, want)
+				}
+				return
+			}
+			if got, want := req.RemoteAddr, tc.wantRemote; got != want {
+				t.Errorf("RemoteAddr = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCheckRealClientIPRateLimit(t *testing.T) {
+	_, cdn, _ := net.ParseCIDR("10.0.0.0/8")
+	be := &Backend{
+		Mode:         ModeHTTPS,
+		realClientIP: &realClientIP{header: "Cf-Connecting-Ip", sources: []*net.IPNet{cdn}},
+		hsLimiter:    newHandshakeLimiter(&HandshakeRateLimit{Rate: 0.001, Burst: 1, IPv4Prefix: 32, IPv6Prefix: 128}),
+		recordEvent:  func(string) {},
+	}
+	newConn := func() mockConn {
+		return mockConn{
+			localAddr:   &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443},
+			remoteAddr:  &net.TCPAddr{IP: net.IPv4(10, 1, 1, 1), Port: 5000},
+			annotations: map[string]any{serverNameKey: "example.com"},
+		}
+	}
+	check := func(conn mockConn, client string) int {
+		req := httptest.NewRequest("GET", "https://example.com/", nil).WithContext(context.WithValue(context.Background(), connCtxKey, conn))
+		req.Header.Set("CF-Connecting-IP", client)
+		w := httptest.NewRecorder()
+		be.checkRealClientIP(w, &req)
+		return w.Code
+	}
+
+	// The keep-alive requests of the same client only use one token.
+	conn1 := newConn()
+	for i := range 10 {
+		if got, want := check(conn1, "5.6.7.8"), http.StatusOK; got != want {
+			t.Fatalf("[%d] Code = %d, want %d", i, got, want)
+		}
+	}
+	// Another client on the same connection has its own limit.
+	if got, want := check(conn1, "5.6.7.9"), http.StatusOK; got != want {
+		t.Errorf("Code = %d, want %d", got, want)
+	}
+	// A new connection for the same client uses another token.
+	if got, want := check(newConn(), "5.6.7.8"), http.StatusTooManyRequests; got != want {
+		t.Errorf("Code = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,122 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	redactClientIP  = "clientIP"
+	redactUser      = "user"
+	redactUserAgent = "userAgent"
+	redactQuery     = "query"
+
+	redactRemove = "remove"
+	redactHash   = "hash"
+)
+
+var redactFields = []string{redactClientIP, redactUser, redactUserAgent, redactQuery}
+
+// redactKey is the key used to hash the redacted values. It is different
+// every time the proxy is started.
+var redactKey = sync.OnceValue(func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+})
+
+// logRedactor redacts fields in the request logs. A nil logRedactor doesn't
+// redact anything.
+type logRedactor struct {
+	fields []string
+	hash   bool
+}
+
+func newLogRedactor(f ...LogFilter) *logRedactor {
+	var r logRedactor
+	for _, ff := range f {
+		if ff.Redact != nil {
+			r.fields = ff.Redact
+			break
+		}
+	}
+	if len(r.fields) == 0 {
+		return nil
+	}
+	for _, ff := range f {
+		if ff.RedactMode != "" {
+			r.hash = ff.RedactMode == redactHash
+			break
+		}
+	}
+	return &r
+}
+
+func (r *logRedactor) redacts(field string) bool {
+	return r != nil && slices.Contains(r.fields, field)
+}
+
+// value returns v, or its redacted value if field is redacted.
+func (r *logRedactor) value(field, v string) string {
+	if v == "" || !r.redacts(field) {
+		return v
+	}
+	if !r.hash {
+		return "-"
+	}
+	mac := hmac.New(sha256.New, redactKey())
+	mac.Write([]byte(v))
+	return "#" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// addr returns addr as a string, with the IP address redacted if clientIP is
+// redacted.
+func (r *logRedactor) addr(addr net.Addr) string {
+	s := addr.String()
+	if !r.redacts(redactClientIP) {
+		return s
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return r.value(redactClientIP, s)
+	}
+	return r.value(redactClientIP, host) + ":" + port
+}
+
+// target returns the request target with the query redacted if query is
+// redacted.
+func (r *logRedactor) target(target string) string {
+	if path, query, ok := strings.Cut(target, "?"); ok && r.redacts(redactQuery) {
+		return path + "?" + r.value(redactQuery, query)
+	}
+	return target
+}
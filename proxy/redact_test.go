@@ -0,0 +1,157 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+func TestLogRedactor(t *testing.T) {
+	var nilRedactor *logRedactor
+	if got, want := nilRedactor.value(redactUser, "bob"), "bob"; got != want {
+		t.Errorf("value() = %q, want %q", got, want)
+	}
+	if got := newLogRedactor(LogFilter{}, LogFilter{RedactMode: redactHash}); got != nil {
+		t.Errorf("newLogRedactor() = %v, want nil", got)
+	}
+
+	r := newLogRedactor(LogFilter{Redact: []string{redactClientIP, redactQuery}}, LogFilter{Redact: []string{redactUser}})
+	if got, want := r.value(redactUser, "bob"), "bob"; got != want {
+		t.Errorf("value(user) = %q, want %q", got, want)
+	}
+	if got, want := r.addr(testAddr{}), "-:90"; got != want {
+		t.Errorf("addr() = %q, want %q", got, want)
+	}
+	if got, want := r.target("/foo?a=b"), "/foo?-"; got != want {
+		t.Errorf("target() = %q, want %q", got, want)
+	}
+	if got, want := r.target("/foo"), "/foo"; got != want {
+		t.Errorf("target() = %q, want %q", got, want)
+	}
+
+	r = newLogRedactor(LogFilter{Redact: []string{redactUser}}, LogFilter{RedactMode: redactHash})
+	h1, h2, h3 := r.value(redactUser, "bob"), r.value(redactUser, "bob"), r.value(redactUser, "alice")
+	if !strings.HasPrefix(h1, "#") || len(h1) != 13 {
+		t.Errorf("value() = %q, want #<hash>", h1)
+	}
+	if h1 != h2 || h1 == h3 {
+		t.Errorf("value() = %q %q %q, want the same hash for the same values", h1, h2, h3)
+	}
+}
+
+func TestSampleRequest(t *testing.T) {
+	zero, one, half := 0., 1., .5
+	if !sampleRequest(LogFilter{}) {
+		t.Error("sampleRequest() = false, want true by default")
+	}
+	if sampleRequest(LogFilter{}, LogFilter{RequestSampleRate: &zero}) {
+		t.Error("sampleRequest(0) = true, want false")
+	}
+	if !sampleRequest(LogFilter{RequestSampleRate: &one}, LogFilter{RequestSampleRate: &zero}) {
+		t.Error("sampleRequest(1) = false, want true")
+	}
+	var n int
+	for range 10000 {
+		if sampleRequest(LogFilter{RequestSampleRate: &half}) {
+			n++
+		}
+	}
+	if n < 4000 || n > 6000 {
+		t.Errorf("sampleRequest(0.5) = true %d/10000 times", n)
+	}
+}
+
+func TestLogHTTPRequest(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	conn := netw.NewConnForTest(testConn{})
+	conn.SetAnnotation(serverNameKey, "example.com")
+	ctx := context.WithValue(context.Background(), authCtxKey, jwt.MapClaims{
+		"email": "bob@example.org",
+	})
+	ctx = context.WithValue(ctx, connCtxKey, conn)
+	req := httptest.NewRequest("GET", "https://example.com/foo?token=secret", nil).WithContext(ctx)
+	req.Header.Set("User-Agent", "test-agent")
+
+	zero := 0.
+	be := &Backend{
+		LogFilter: LogFilter{
+			RequestSampleRate: &zero,
+			Redact:            []string{redactClientIP, redactUser, redactUserAgent, redactQuery},
+		},
+	}
+	be.logHTTPRequest("REQ", req, req.URL.RequestURI(), http.StatusOK, "")
+	if buf.Len() != 0 {
+		t.Errorf("successful request was logged: %q", buf.String())
+	}
+	be.logHTTPRequest("REQ", req, req.URL.RequestURI(), http.StatusForbidden, " (SSO)")
+	got := buf.String()
+	for _, s := range []string{"[-] test:-:90 ➔ example.com", "GET /foo?- ➔ status:403 (SSO) (\"-\")"} {
+		if !strings.Contains(got, s) {
+			t.Errorf("log = %q, want %q", got, s)
+		}
+	}
+	for _, s := range []string{"bob", "12.34.56.78", "secret", "test-agent"} {
+		if strings.Contains(got, s) {
+			t.Errorf("log = %q, should not contain %q", got, s)
+		}
+	}
+
+	buf.Reset()
+	be.LogFilter = LogFilter{}
+	be.logHTTPRequest("REQ", req, req.URL.RequestURI(), http.StatusOK, "")
+	if got, want := buf.String(), `[bob@example.org] test:12.34.56.78:90 ➔ example.com| ➔ GET /foo?token=secret ➔ status:200 ("test-agent")`; !strings.Contains(got, want) {
+		t.Errorf("log = %q, want %q", got, want)
+	}
+}
+
+func TestLogFilterCheck(t *testing.T) {
+	rate := 1.5
+	for _, lf := range []LogFilter{
+		{RequestSampleRate: &rate},
+		{Redact: []string{"password"}},
+		{Redact: []string{redactUser}, RedactMode: "encrypt"},
+	} {
+		cfg := &Config{LogFilter: lf}
+		if err := cfg.Check(); err == nil {
+			t.Errorf("Check(%+v) succeeded unexpectedly", lf)
+		}
+		cfg = &Config{Backends: []*Backend{{ServerNames: []string{"example.com"}, LogFilter: lf}}}
+		if err := cfg.Check(); err == nil {
+			t.Errorf("Check(backend %+v) succeeded unexpectedly", lf)
+		}
+	}
+}
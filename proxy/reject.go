@@ -0,0 +1,90 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/c2FmZQ/ech"
+	"github.com/pires/go-proxyproto"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+const (
+	rejectUnrecognizedName = "unrecognized-name"
+	rejectAccessDenied     = "access-denied"
+	rejectHandshakeFailure = "handshake-failure"
+	rejectReset            = "reset"
+	rejectDrop             = "drop"
+	rejectForbidden        = "forbidden"
+)
+
+var validRejectPolicies = []string{
+	"",
+	rejectUnrecognizedName,
+	rejectAccessDenied,
+	rejectHandshakeFailure,
+	rejectReset,
+	rejectDrop,
+	rejectForbidden,
+}
+
+var forbiddenPage = []byte("<html><head><title>403 Forbidden</title></head><body><h1>403 Forbidden</h1></body></html>\n")
+
+// rejectConn rejects a TLS connection according to policy. It must be called
+// before the TLS handshake completes. The caller must close the connection.
+func (p *Proxy) rejectConn(conn *netw.Conn, policy string) {
+	switch policy {
+	case rejectAccessDenied:
+		sendAlert(conn, 0x2 /* fatal */, 0x31 /* Access denied */)
+	case rejectHandshakeFailure:
+		sendAlert(conn, 0x2 /* fatal */, 0x28 /* Handshake failure */)
+	case rejectReset:
+		resetConn(conn)
+	case rejectDrop:
+	case rejectForbidden:
+		p.serveLocalResponse(conn, http.StatusForbidden, forbiddenPage, " (rejected)")
+	default:
+		sendUnrecognizedName(conn)
+	}
+}
+
+// resetConn makes the TCP connection send a RST instead of a FIN when it is
+// closed.
+func resetConn(conn net.Conn) {
+	switch c := conn.(type) {
+	case *netw.Conn:
+		resetConn(c.Conn)
+	case *ech.Conn:
+		resetConn(c.Conn)
+	case *proxyproto.Conn:
+		resetConn(c.Raw())
+	case interface{ NetConn() net.Conn }:
+		resetConn(c.NetConn())
+	case *net.TCPConn:
+		c.SetLinger(0)
+	}
+}
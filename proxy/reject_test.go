@@ -0,0 +1,98 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestRejectPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	cfg := &Config{
+		HTTPAddr:     "localhost:0",
+		TLSAddr:      "localhost:0",
+		CacheDir:     t.TempDir(),
+		MaxOpen:      100,
+		RejectPolicy: "drop",
+	}
+	for _, policy := range []string{"", "access-denied", "handshake-failure", "reset", "forbidden"} {
+		name := policy
+		if name == "" {
+			name = "default"
+		}
+		cfg.Backends = append(cfg.Backends, &Backend{
+			ServerNames:  []string{name + ".example.com"},
+			Addresses:    []string{"127.0.0.1:1"},
+			Mode:         "HTTP",
+			DenyIPs:      &[]string{"127.0.0.0/8", "::1/128"},
+			RejectPolicy: policy,
+		})
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+
+	for _, tc := range []struct {
+		host    string
+		wantErr string
+	}{
+		{"default.example.com", "unrecognized name"},
+		{"access-denied.example.com", "access denied"},
+		{"handshake-failure.example.com", "handshake failure"},
+		{"reset.example.com", "connection reset by peer"},
+		{"unknown.example.com", "EOF"},
+	} {
+		conn, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+			ServerName: tc.host,
+			RootCAs:    extCA.RootCACertPool(),
+		})
+		if err == nil {
+			conn.Close()
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: err = %v, want %q", tc.host, err, tc.wantErr)
+		}
+	}
+
+	got, _, err := httpGet("forbidden.example.com", proxy.listener.Addr().String(), "/", extCA, nil)
+	if err != nil {
+		t.Fatalf("httpGet: %v", err)
+	}
+	if want := "HTTP/1.1 403 Forbidden\n"; !strings.HasPrefix(got, want) {
+		t.Errorf("httpGet() = %q, want prefix %q", got, want)
+	}
+}
@@ -0,0 +1,359 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	remoteRetryDelay = 5 * time.Second
+	remoteWait       = 5 * time.Minute
+)
+
+// IsRemoteConfig returns true if name is the URL of a key in etcd or in the
+// Consul KV store, e.g. consul://127.0.0.1:8500/tlsproxy/config or
+// etcd://127.0.0.1:2379/tlsproxy/config. Use consul+https:// or etcd+https://
+// to connect with TLS.
+func IsRemoteConfig(name string) bool {
+	_, err := newRemoteKV(name)
+	return err == nil
+}
+
+// ReadRemoteConfig reads and validates a YAML config from etcd or from the
+// Consul KV store.
+func ReadRemoteConfig(ctx context.Context, rawURL string) (*Config, error) {
+	kv, err := newRemoteKV(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	v, _, err := kv.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, fmt.Errorf("%s: key not found", kv)
+	}
+	return decodeConfig(bytes.NewReader(v))
+}
+
+// WatchRemoteConfig calls fn every time the config stored in etcd or in the
+// Consul KV store changes, until ctx is canceled. Invalid configs are logged
+// and ignored.
+func WatchRemoteConfig(ctx context.Context, rawURL string, fn func(*Config)) error {
+	kv, err := newRemoteKV(rawURL)
+	if err != nil {
+		return err
+	}
+	kv.watch(ctx, func(v []byte) {
+		if v == nil {
+			return
+		}
+		cfg, err := decodeConfig(bytes.NewReader(v))
+		if err != nil {
+			log.Printf("ERR %s: %v", kv, err)
+			return
+		}
+		fn(cfg)
+	})
+	return nil
+}
+
+// remoteKV is a key in etcd (with the v3 JSON gateway) or in the Consul KV
+// store.
+type remoteKV struct {
+	kind   string
+	base   string
+	key    string
+	user   *url.Userinfo
+	client *http.Client
+}
+
+func newRemoteKV(rawURL string) (*remoteKV, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	kind, scheme, _ := strings.Cut(u.Scheme, "+")
+	if scheme == "" {
+		scheme = "http"
+	}
+	if (kind != "consul" && kind != "etcd") || (scheme != "http" && scheme != "https") {
+		return nil, fmt.Errorf("%s: unsupported scheme", u.Scheme)
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, errors.New("host and key must be set")
+	}
+	return &remoteKV{
+		kind:   kind,
+		base:   scheme + "://" + u.Host,
+		key:    key,
+		user:   u.User,
+		client: &http.Client{},
+	}, nil
+}
+
+func (kv *remoteKV) String() string {
+	return kv.kind + ":" + kv.key
+}
+
+// watch calls fn with the value of the key every time it changes. The value
+// is nil when the key doesn't exist.
+func (kv *remoteKV) watch(ctx context.Context, fn func([]byte)) {
+	var last []byte
+	var index uint64
+	first := true
+	for {
+		v, next, err := kv.get(ctx)
+		if err == nil && (first || !bytes.Equal(v, last)) {
+			first = false
+			last = v
+			fn(v)
+		}
+		if err == nil {
+			index = next
+			err = kv.wait(ctx, index)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("ERR %s: %v", kv, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(remoteRetryDelay):
+			}
+		}
+	}
+}
+
+// get returns the value of the key, and the index or revision to use with
+// wait.
+func (kv *remoteKV) get(ctx context.Context) ([]byte, uint64, error) {
+	if kv.kind == "consul" {
+		return kv.consulGet(ctx, 0)
+	}
+	return kv.etcdGet(ctx)
+}
+
+// wait returns when the key might have changed after index.
+func (kv *remoteKV) wait(ctx context.Context, index uint64) error {
+	if kv.kind == "consul" {
+		_, _, err := kv.consulGet(ctx, index)
+		return err
+	}
+	return kv.etcdWatch(ctx, index+1)
+}
+
+func (kv *remoteKV) do(req *http.Request) (*http.Response, error) {
+	resp, err := kv.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// consulGet gets the value of the key. When index is non-zero, it is a
+// blocking query that waits for the value to change.
+// https://developer.hashicorp.com/consul/api-docs/features/blocking
+func (kv *remoteKV) consulGet(ctx context.Context, index uint64) ([]byte, uint64, error) {
+	v := url.Values{}
+	v.Set("raw", "")
+	if index > 0 {
+		v.Set("index", strconv.FormatUint(index, 10))
+		v.Set("wait", fmt.Sprintf("%ds", int(remoteWait.Seconds())))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, kv.base+"/v1/kv/"+kv.key+"?"+v.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	token := os.Getenv("CONSUL_HTTP_TOKEN")
+	if kv.user != nil {
+		token = kv.user.Username()
+		if pass, ok := kv.user.Password(); ok {
+			token = pass
+		}
+	}
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := kv.do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("X-Consul-Index: %w", err)
+	}
+	if next < index {
+		// The index went backward. Start over.
+		next = 0
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, next, nil
+	}
+	b, err := io.ReadAll(resp.Body)
+	return b, next, err
+}
+
+func (kv *remoteKV) etcdPost(ctx context.Context, path string, body any) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, kv.base+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if kv.user != nil && path != "/v3/auth/authenticate" {
+		token, err := kv.etcdAuthenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", token)
+	}
+	return kv.do(req)
+}
+
+// etcdAuthenticate gets a token with the username and password.
+func (kv *remoteKV) etcdAuthenticate(ctx context.Context) (string, error) {
+	pass, _ := kv.user.Password()
+	resp, err := kv.etcdPost(ctx, "/v3/auth/authenticate", map[string]string{
+		"name":     kv.user.Username(),
+		"password": pass,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.Token, nil
+}
+
+func (kv *remoteKV) etcdGet(ctx context.Context) ([]byte, uint64, error) {
+	resp, err := kv.etcdPost(ctx, "/v3/kv/range", map[string]string{
+		"key": base64.StdEncoding.EncodeToString([]byte(kv.key)),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		KVs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, 0, err
+	}
+	rev, err := strconv.ParseUint(result.Header.Revision, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("revision: %w", err)
+	}
+	if len(result.KVs) == 0 {
+		return nil, rev, nil
+	}
+	v, err := base64.StdEncoding.DecodeString(result.KVs[0].Value)
+	return v, rev, err
+}
+
+// etcdWatch returns when the key is modified at or after revision.
+func (kv *remoteKV) etcdWatch(ctx context.Context, revision uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, remoteWait)
+	defer cancel()
+	resp, err := kv.etcdPost(ctx, "/v3/watch", map[string]any{
+		"create_request": map[string]any{
+			"key":            base64.StdEncoding.EncodeToString([]byte(kv.key)),
+			"start_revision": strconv.FormatUint(revision, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var msg struct {
+			Result struct {
+				Events   []json.RawMessage `json:"events"`
+				Canceled bool              `json:"canceled"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil
+			}
+			return err
+		}
+		if len(msg.Result.Events) > 0 || msg.Result.Canceled {
+			return nil
+		}
+	}
+}
+
+// decodeConfig reads and validates a YAML config.
+func decodeConfig(r io.Reader) (*Config, error) {
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Check(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,247 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+// fakeConsulKV is a minimal Consul KV server that supports blocking queries.
+type fakeConsulKV struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	index  int
+	values map[string]string
+	closed bool
+}
+
+func newFakeConsulKV() *fakeConsulKV {
+	kv := &fakeConsulKV{values: make(map[string]string), index: 1}
+	kv.cond = sync.NewCond(&kv.mu)
+	return kv
+}
+
+func (kv *fakeConsulKV) set(key, value string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.values[key] = value
+	kv.index++
+	kv.cond.Broadcast()
+}
+
+// close unblocks all the blocking queries.
+func (kv *fakeConsulKV) close() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.closed = true
+	kv.cond.Broadcast()
+}
+
+func (kv *fakeConsulKV) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key, ok := strings.CutPrefix(req.URL.Path, "/v1/kv/")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	var index int
+	fmt.Sscanf(req.URL.Query().Get("index"), "%d", &index)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	for kv.index <= index && !kv.closed {
+		kv.cond.Wait()
+	}
+	w.Header().Set("X-Consul-Index", fmt.Sprint(kv.index))
+	v, exists := kv.values[key]
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(v))
+}
+
+func TestRemoteConfigConsul(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	kv := newFakeConsulKV()
+	server := httptest.NewServer(kv)
+	defer server.Close()
+	defer kv.close()
+
+	dir := t.TempDir()
+	configYAML := func(name string) string {
+		return fmt.Sprintf("cacheDir: %s\nbackends:\n- serverNames: [%s]\n  mode: local\n", dir, name)
+	}
+	kv.set("tlsproxy/config", configYAML("one.example.com"))
+
+	u := "consul://" + strings.TrimPrefix(server.URL, "http://") + "/tlsproxy/config"
+	if !IsRemoteConfig(u) {
+		t.Fatalf("IsRemoteConfig(%q) = false", u)
+	}
+	for _, n := range []string{"config.yaml", "/etc/tlsproxy/config.yaml", "http://example.com/config"} {
+		if IsRemoteConfig(n) {
+			t.Errorf("IsRemoteConfig(%q) = true", n)
+		}
+	}
+	cfg, err := ReadRemoteConfig(ctx, u)
+	if err != nil {
+		t.Fatalf("ReadRemoteConfig: %v", err)
+	}
+	if got, want := cfg.Backends[0].ServerNames[0], "one.example.com"; got != want {
+		t.Errorf("ServerNames[0] = %q, want %q", got, want)
+	}
+
+	ch := make(chan *Config)
+	go WatchRemoteConfig(ctx, u, func(cfg *Config) {
+		ch <- cfg
+	})
+	for _, want := range []string{"one.example.com", "two.example.com"} {
+		select {
+		case cfg := <-ch:
+			if got := cfg.Backends[0].ServerNames[0]; got != want {
+				t.Errorf("ServerNames[0] = %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		kv.set("tlsproxy/config", configYAML("two.example.com"))
+	}
+}
+
+func TestRemoteConfigEtcd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	value := fmt.Sprintf("cacheDir: %s\nbackends:\n- serverNames: [etcd.example.com]\n  mode: local\n", dir)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]any
+		json.NewDecoder(req.Body).Decode(&body)
+		switch req.URL.Path {
+		case "/v3/auth/authenticate":
+			if body["name"] != "bob" || body["password"] != "secret" {
+				http.Error(w, "denied", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"token":"TOKEN"}`)
+		case "/v3/kv/range":
+			if got, want := req.Header.Get("Authorization"), "TOKEN"; got != want {
+				t.Errorf("Authorization = %q, want %q", got, want)
+			}
+			if got, want := body["key"], base64.StdEncoding.EncodeToString([]byte("tlsproxy/config")); got != want {
+				t.Errorf("key = %q, want %q", got, want)
+			}
+			fmt.Fprintf(w, `{"header":{"revision":"5"},"kvs":[{"value":%q}]}`, base64.StdEncoding.EncodeToString([]byte(value)))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	u := "etcd://bob:secret@" + strings.TrimPrefix(server.URL, "http://") + "/tlsproxy/config"
+	cfg, err := ReadRemoteConfig(ctx, u)
+	if err != nil {
+		t.Fatalf("ReadRemoteConfig: %v", err)
+	}
+	if got, want := cfg.Backends[0].ServerNames[0], "etcd.example.com"; got != want {
+		t.Errorf("ServerNames[0] = %q, want %q", got, want)
+	}
+	if _, err := ReadRemoteConfig(ctx, "etcd://bob:wrong@"+strings.TrimPrefix(server.URL, "http://")+"/tlsproxy/config"); err == nil {
+		t.Error("ReadRemoteConfig with wrong password should fail")
+	}
+}
+
+func TestRemoteBackends(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	kv := newFakeConsulKV()
+	server := httptest.NewServer(kv)
+	defer server.Close()
+	defer kv.close()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+	be2 := newTCPServer(t, ctx, "backend2", nil)
+
+	kv.set("tlsproxy/backends", fmt.Sprintf("- serverNames: [remote.example.com]\n  mode: tcp\n  addresses: [%s]\n", be1.listener.Addr()))
+
+	cfg := &Config{
+		HTTPAddr:       "localhost:0",
+		TLSAddr:        "localhost:0",
+		CacheDir:       t.TempDir(),
+		MaxOpen:        100,
+		RemoteBackends: "consul://" + strings.TrimPrefix(server.URL, "http://") + "/tlsproxy/backends",
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Mode:        "TCP",
+				Addresses:   []string{be2.listener.Addr().String()},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	waitFor := func(sn, want string) {
+		t.Helper()
+		for i := 0; ; i++ {
+			got, _, _ := tlsGet(sn, proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil)
+			if got == want {
+				return
+			}
+			if i == 100 {
+				t.Fatalf("tlsGet(%q) = %q, want %q", sn, got, want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	waitFor("remote.example.com", "Hello from backend1\n")
+	waitFor("example.com", "Hello from backend2\n")
+
+	// Invalid remote backends are ignored.
+	kv.set("tlsproxy/backends", fmt.Sprintf("- serverNames: [example.com]\n  mode: tcp\n  addresses: [%s]\n", be1.listener.Addr()))
+	waitFor("remote.example.com", "")
+	waitFor("example.com", "Hello from backend2\n")
+
+	kv.set("tlsproxy/backends", fmt.Sprintf("- serverNames: [other.example.com]\n  mode: tcp\n  addresses: [%s]\n", be1.listener.Addr()))
+	waitFor("other.example.com", "Hello from backend1\n")
+}
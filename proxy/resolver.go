@@ -0,0 +1,310 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/c2FmZQ/ech"
+	"github.com/c2FmZQ/ech/dns"
+)
+
+const defaultResolverTimeout = 5 * time.Second
+
+// resolver resolves the host names of the backend addresses, independently of
+// the host's resolver configuration.
+type resolver struct {
+	timeout   time.Duration
+	lookup    func(ctx context.Context, host string) ([]net.IPAddr, error)
+	lookupSRV func(ctx context.Context, name string) ([]*net.SRV, error)
+	// exchange sends a raw DNS query and returns the raw response.
+	exchange func(ctx context.Context, query []byte) ([]byte, error)
+}
+
+func newResolver(cfg *ConfigResolver) (*resolver, error) {
+	r := &resolver{
+		timeout: cfg.Timeout,
+	}
+	if r.timeout == 0 {
+		r.timeout = defaultResolverTimeout
+	}
+	switch {
+	case cfg.DoH != "":
+		doh, err := ech.NewResolver(cfg.DoH)
+		if err != nil {
+			return nil, err
+		}
+		r.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			res, err := doh.Resolve(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			addrs := make([]net.IPAddr, 0, len(res.Address))
+			for _, ip := range res.Address {
+				addrs = append(addrs, net.IPAddr{IP: ip})
+			}
+			return addrs, nil
+		}
+		r.lookupSRV = func(ctx context.Context, name string) ([]*net.SRV, error) {
+			return lookupSRVDoH(ctx, cfg.DoH, name)
+		}
+		r.exchange = func(ctx context.Context, query []byte) ([]byte, error) {
+			return exchangeDoH(ctx, cfg.DoH, query)
+		}
+
+	case cfg.DoT != "":
+		addr := withDefaultPort(cfg.DoT, "853")
+		serverName := cfg.DoTServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(addr)
+		}
+		dialer := &tls.Dialer{
+			Config: &tls.Config{ServerName: serverName},
+		}
+		res := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				// A stream connection makes the resolver use TCP framing.
+				return dialer.DialContext(ctx, "tcp", addr)
+			},
+		}
+		r.lookup = res.LookupIPAddr
+		r.lookupSRV = func(ctx context.Context, name string) ([]*net.SRV, error) {
+			_, srvs, err := res.LookupSRV(ctx, "", "", name)
+			return srvs, err
+		}
+		r.exchange = func(ctx context.Context, query []byte) ([]byte, error) {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			defer conn.Close()
+			return exchangeStream(ctx, conn, query)
+		}
+
+	case len(cfg.Nameservers) > 0:
+		servers := make([]string, 0, len(cfg.Nameservers))
+		for _, ns := range cfg.Nameservers {
+			servers = append(servers, withDefaultPort(ns, "53"))
+		}
+		var next atomic.Uint32
+		var dialer net.Dialer
+		res := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				n := next.Add(1) - 1
+				return dialer.DialContext(ctx, network, servers[int(n)%len(servers)])
+			},
+		}
+		r.lookup = res.LookupIPAddr
+		r.lookupSRV = func(ctx context.Context, name string) ([]*net.SRV, error) {
+			_, srvs, err := res.LookupSRV(ctx, "", "", name)
+			return srvs, err
+		}
+		r.exchange = func(ctx context.Context, query []byte) ([]byte, error) {
+			n := next.Add(1) - 1
+			server := servers[int(n)%len(servers)]
+			resp, err := exchangeUDP(ctx, &dialer, server, query)
+			if err != nil {
+				return nil, err
+			}
+			// Retry with TCP when the response is truncated.
+			if len(resp) > 2 && resp[2]&0x02 != 0 {
+				conn, err := dialer.DialContext(ctx, "tcp", server)
+				if err != nil {
+					return nil, err
+				}
+				defer conn.Close()
+				return exchangeStream(ctx, conn, query)
+			}
+			return resp, nil
+		}
+
+	default:
+		return nil, errors.New("no nameservers")
+	}
+	return r, nil
+}
+
+// LookupIPAddr returns the IP addresses of host.
+func (r *resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	return r.lookup(ctx, host)
+}
+
+// LookupSRV returns the SRV records of name.
+func (r *resolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	return r.lookupSRV(ctx, name)
+}
+
+func lookupSRVDoH(ctx context.Context, url, name string) ([]*net.SRV, error) {
+	qq := &dns.Message{
+		RD: 1,
+		Question: []dns.Question{{
+			Name:  name,
+			Type:  dns.RRType("SRV"),
+			Class: 1,
+		}},
+	}
+	res, err := dns.DoH(ctx, qq, url)
+	if err != nil {
+		return nil, err
+	}
+	if res.RCode != 0 {
+		return nil, fmt.Errorf("rcode %d", res.RCode)
+	}
+	var srvs []*net.SRV
+	for _, a := range res.Answer {
+		if v, ok := a.Data.(dns.SRV); ok {
+			srvs = append(srvs, &net.SRV{
+				Target:   v.Target,
+				Port:     v.Port,
+				Priority: v.Priority,
+				Weight:   v.Weight,
+			})
+		}
+	}
+	return srvs, nil
+}
+
+// Exchange sends a raw DNS query and returns the raw response.
+func (r *resolver) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	return r.exchange(ctx, query)
+}
+
+func exchangeUDP(ctx context.Context, dialer *net.Dialer, server string, query []byte) ([]byte, error) {
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore the responses that don't match the query ID.
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeStream sends a DNS query on a stream connection, i.e. TCP or TLS,
+// with the 2-byte length prefix.
+func exchangeStream(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// exchangeDoH sends a DNS query with DNS-over-HTTPS (RFC 8484).
+func exchangeDoH(ctx context.Context, url string, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, port)
+}
+
+// resolveUDPAddr resolves addr with the backend's resolver, if any.
+func (be *Backend) resolveUDPAddr(ctx context.Context, addr string) (*net.UDPAddr, error) {
+	if be.resolver == nil {
+		return net.ResolveUDPAddr("udp", addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return net.ResolveUDPAddr("udp", addr)
+	}
+	p, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := be.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address", Addr: host}
+	}
+	ip := sortAddresses(ips)[0]
+	return &net.UDPAddr{IP: ip.IP, Port: p, Zone: ip.Zone}, nil
+}
@@ -0,0 +1,148 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/ech/dns"
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+// newTestDNSServer starts a DNS server that resolves the names in records to
+// IPv4 addresses.
+func newTestDNSServer(t *testing.T, records map[string]net.IP) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := dns.DecodeMessage(buf[:n])
+			if err != nil || len(req.Question) != 1 {
+				continue
+			}
+			q := req.Question[0]
+			resp := &dns.Message{
+				ID:       req.ID,
+				QR:       1,
+				RD:       req.RD,
+				RA:       1,
+				Question: req.Question,
+			}
+			ip, ok := records[q.Name]
+			if !ok {
+				resp.RCode = 3 // NXDOMAIN
+			} else if q.Type == dns.RRType("A") {
+				resp.Answer = []dns.RR{{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60, Data: ip.To4()}}
+			}
+			pc.WriteTo(resp.Bytes(), addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestResolver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ns := newTestDNSServer(t, map[string]net.IP{
+		"backend.test": net.IPv4(127, 0, 0, 1),
+	})
+	r, err := newResolver(&ConfigResolver{Nameservers: []string{ns}, Timeout: 2 * time.Second})
+	if err != nil {
+		t.Fatalf("newResolver: %v", err)
+	}
+	addrs, err := r.LookupIPAddr(ctx, "backend.test")
+	if err != nil {
+		t.Fatalf("LookupIPAddr: %v", err)
+	}
+	if len(addrs) != 1 || !addrs[0].IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("LookupIPAddr() = %v, want [127.0.0.1]", addrs)
+	}
+	if _, err := r.LookupIPAddr(ctx, "unknown.test"); err == nil {
+		t.Error("LookupIPAddr(unknown.test) should fail")
+	}
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+	_, port, _ := net.SplitHostPort(be1.listener.Addr().String())
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Resolver: &ConfigResolver{
+			Nameservers: []string{ns},
+		},
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Addresses:   []string{net.JoinHostPort("backend.test", port)},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	got, _, err := tlsGet("example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil)
+	if err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	if want := "Hello from backend1\n"; got != want {
+		t.Errorf("tlsGet() = %q, want %q", got, want)
+	}
+
+	for _, rc := range []*ConfigResolver{
+		{},
+		{Nameservers: []string{ns}, DoH: "https://1.1.1.1/dns-query"},
+		{DoH: "http://example.com/dns-query"},
+		{Nameservers: []string{ns}, DoTServerName: "example.com"},
+	} {
+		cfg := &Config{
+			CacheDir: t.TempDir(),
+			Resolver: rc,
+			Backends: []*Backend{{ServerNames: []string{"example.com"}, Addresses: []string{"127.0.0.1:1"}}},
+		}
+		if err := cfg.Check(); err == nil {
+			t.Errorf("Check() with resolver %+v should fail", rc)
+		}
+	}
+}
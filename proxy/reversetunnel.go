@@ -0,0 +1,165 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/c2FmZQ/tlsproxy/revtunnel"
+)
+
+// reverseTunnelPrefix indicates that a backend address is an agent connected
+// with a reverse tunnel, e.g. tunnel+1
+const reverseTunnelPrefix = "tunnel+"
+
+var errTooManyAgents = errors.New("too many agents")
+
+// reverseTunnelSet contains the agents connected with reverse tunnels, keyed
+// by backend ID. It is not affected by configuration changes, so that the
+// agents stay connected.
+type reverseTunnelSet struct {
+	mu     sync.Mutex
+	nextID int
+	m      map[string]map[string]*revtunnel.Session
+}
+
+func (s *reverseTunnelSet) add(key string, sess *revtunnel.Session, max int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.m[key]) >= max {
+		return "", errTooManyAgents
+	}
+	if s.m == nil {
+		s.m = make(map[string]map[string]*revtunnel.Session)
+	}
+	if s.m[key] == nil {
+		s.m[key] = make(map[string]*revtunnel.Session)
+	}
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	s.m[key][id] = sess
+	return id, nil
+}
+
+func (s *reverseTunnelSet) remove(key, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m[key], id)
+	if len(s.m[key]) == 0 {
+		delete(s.m, key)
+	}
+}
+
+// addresses returns the addresses of the agents of a backend.
+func (s *reverseTunnelSet) addresses(key string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]string, 0, len(s.m[key]))
+	for id := range s.m[key] {
+		addrs = append(addrs, reverseTunnelPrefix+id)
+	}
+	slices.Sort(addrs)
+	return addrs
+}
+
+func (s *reverseTunnelSet) dial(ctx context.Context, key, id string) (net.Conn, error) {
+	s.mu.Lock()
+	sess, ok := s.m[key][id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("agent %s is not connected", id)
+	}
+	return sess.Dial(ctx)
+}
+
+// prune closes the tunnels of the backends that no longer accept them.
+func (s *reverseTunnelSet) prune(backends []*Backend) {
+	keep := make(map[string]bool)
+	for _, be := range backends {
+		if be.ReverseTunnel != nil {
+			keep[be.maintenanceID()] = true
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, m := range s.m {
+		if keep[key] {
+			continue
+		}
+		for _, sess := range m {
+			sess.Close()
+		}
+	}
+}
+
+// reverseTunnelTLSConfig returns the TLS config of the agents' connections.
+func (be *Backend) reverseTunnelTLSConfig() *tls.Config {
+	tc := be.tlsConfig(false)
+	tc.NextProtos = []string{revtunnel.ALPNProto}
+	return tc
+}
+
+// dialReverseTunnel opens a connection to the backend server through the
+// tunnel of agent addr.
+func (be *Backend) dialReverseTunnel(ctx context.Context, addr string) (net.Conn, error) {
+	id, _ := strings.CutPrefix(addr, reverseTunnelPrefix)
+	return be.tunnelState.dial(ctx, be.maintenanceID(), id)
+}
+
+// handleReverseTunnelConnection authenticates an agent and serves its tunnel
+// until it is closed.
+func (p *Proxy) handleReverseTunnelConnection(conn *tls.Conn) {
+	if !p.authorizeTLSConnection(conn) {
+		return
+	}
+	serverName := connServerName(conn)
+	be := connBackend(conn)
+	sess, err := revtunnel.Accept(conn, be.ReverseTunnel.token)
+	if err != nil {
+		p.recordEvent("reverse tunnel: " + err.Error())
+		be.logErrorF("BAD [-] %s ➔ %q Reverse tunnel: %v", conn.RemoteAddr(), idnaToUnicode(serverName), err)
+		return
+	}
+	key := be.maintenanceID()
+	id, err := be.tunnelState.add(key, sess, be.ReverseTunnel.MaxAgents)
+	if err != nil {
+		sess.Close()
+		p.recordEvent("reverse tunnel: " + err.Error())
+		be.logErrorF("ERR [-] %s ➔ %q Reverse tunnel: %v", conn.RemoteAddr(), idnaToUnicode(serverName), err)
+		return
+	}
+	be.recordEvent("reverse tunnel connected")
+	be.logConnF("CON %s ➔ %q Reverse tunnel agent %s", conn.RemoteAddr(), idnaToUnicode(serverName), id)
+	<-sess.Done()
+	be.tunnelState.remove(key, id)
+	be.logConnF("END %s ➔ %q Reverse tunnel agent %s", conn.RemoteAddr(), idnaToUnicode(serverName), id)
+}
@@ -0,0 +1,130 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+	"github.com/c2FmZQ/tlsproxy/revtunnel"
+)
+
+func TestReverseTunnel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newTCPServer(t, ctx, "backend", nil)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	newCfg := func() *Config {
+		return &Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{{
+				ServerNames: []string{"home.example.com"},
+				Mode:        ModeTCP,
+				ReverseTunnel: &ReverseTunnel{
+					TokenFile: tokenFile,
+				},
+			}},
+		}
+	}
+	proxy := newTestProxy(newCfg(), extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+	proxyAddr := proxy.listener.Addr().String()
+
+	if got, _, _ := tlsGet("home.example.com", proxyAddr, "Hello!\n", extCA, nil, nil); got != "" {
+		t.Fatalf("tlsGet() = %q without agent, want no response", got)
+	}
+
+	newAgent := func(token string) *revtunnel.Agent {
+		return &revtunnel.Agent{
+			ProxyAddr:  proxyAddr,
+			ServerName: "home.example.com",
+			Token:      token,
+			Target:     be.listener.Addr().String(),
+			TLSConfig:  &tls.Config{RootCAs: extCA.RootCACertPool()},
+			Logf:       t.Logf,
+		}
+	}
+	if err := newAgent("wrong").Run(ctx); !errors.Is(err, revtunnel.ErrUnauthorized) {
+		t.Fatalf("Run() with wrong token = %v, want %v", err, revtunnel.ErrUnauthorized)
+	}
+
+	agentCtx, agentCancel := context.WithCancel(ctx)
+	defer agentCancel()
+	go newAgent("secret").Run(agentCtx)
+
+	waitForAgents := func(want int) {
+		t.Helper()
+		for range 100 {
+			if len(proxy.cfg.Backends[0].addresses()) == want {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("addresses() = %v, want %d agents", proxy.cfg.Backends[0].addresses(), want)
+	}
+	waitForAgents(1)
+
+	get := func() {
+		t.Helper()
+		got, _, err := tlsGet("home.example.com", proxyAddr, "Hello!\n", extCA, nil, nil)
+		if err != nil {
+			t.Fatalf("tlsGet: %v", err)
+		}
+		if want := "Hello from backend\n"; got != want {
+			t.Errorf("tlsGet() = %q, want %q", got, want)
+		}
+	}
+	get()
+
+	// The agent stays connected when the config changes.
+	if err := proxy.Reconfigure(newCfg()); err != nil {
+		t.Fatalf("Reconfigure: %v", err)
+	}
+	waitForAgents(1)
+	get()
+
+	agentCancel()
+	waitForAgents(0)
+}
@@ -62,15 +62,6 @@ func (p *Proxy) RevokeAllCertificates(ctx context.Context, reason string) error
 		return nil
 	}
 
-	accountKey, err := p.acmeAccountKey(ctx)
-	if err != nil {
-		return err
-	}
-	client := &acme.Client{
-		DirectoryURL: autocert.DefaultACMEDirectory,
-		Key:          accountKey,
-		UserAgent:    "tlsproxy",
-	}
 	p.logErrorF("!!!")
 	p.logErrorF("!!! WARNING")
 	p.logErrorF("!!!")
@@ -88,25 +79,27 @@ func (p *Proxy) RevokeAllCertificates(ctx context.Context, reason string) error
 	p.logErrorF("!!!")
 	time.Sleep(10 * time.Second)
 
-	now := time.Now()
-	for _, key := range toRevoke {
-		if now.After(certs[key].Leaf.NotAfter) {
+	return p.revokeACMECerts(ctx, certs, toRevoke, reasonCode, func(key string, expired bool) {
+		if expired {
 			p.logErrorF("!!! Expired: %s", key)
-			continue
-		}
-		if err := client.RevokeCert(ctx, certs[key].PrivateKey.(crypto.Signer), certs[key].Certificate[0], reasonCode); err != nil {
-			return err
+		} else {
+			p.logErrorF("!!! Revoked: %s", key)
 		}
-		p.logErrorF("!!! Revoked: %s", key)
-	}
-	return p.certManager.(*autocert.Manager).Cache.(*autocertcache.Cache).DeleteKeys(ctx, toRevoke)
+	})
 }
 
 func (p *Proxy) revokeUnusedCertificates(ctx context.Context) error {
-	actuallyRevoke := p.cfg.RevokeUnusedCertificates == nil || *p.cfg.RevokeUnusedCertificates
-
 	names := make(map[string]bool)
 	p.mu.Lock()
+	// With Docker backends, the server names come and go with the
+	// containers. Their certificates are not revoked automatically.
+	// In a cluster, the other instances may still be using an older
+	// config. The certificates are only revoked when explicitly requested.
+	actuallyRevoke := p.cfg.RevokeUnusedCertificates == nil && p.cfg.Cluster == nil
+	if v := p.cfg.RevokeUnusedCertificates; v != nil {
+		actuallyRevoke = *v
+	}
+	actuallyRevoke = actuallyRevoke && p.cfg.Docker == nil
 	for _, be := range p.cfg.Backends {
 		for _, n := range be.ServerNames {
 			names[n] = true
@@ -140,38 +133,86 @@ L:
 		return nil
 	}
 
-	accountKey, err := p.acmeAccountKey(ctx)
+	return p.revokeACMECerts(ctx, certs, toRevoke, acme.CRLReasonUnspecified, func(key string, expired bool) {
+		if expired {
+			p.logErrorF("INF Expired certificate: %s", key)
+		} else {
+			p.logErrorF("INF Revoked unused certificate: %s", key)
+		}
+	})
+}
+
+// revokeACMECerts revokes the certificates with these cache keys, and
+// deletes them from the cache. The expired certificates are only deleted.
+// done is called after each certificate.
+func (p *Proxy) revokeACMECerts(ctx context.Context, certs map[string]*tls.Certificate, keys []string, reason acme.CRLReasonCode, done func(key string, expired bool)) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	cache, err := p.acmeCache()
 	if err != nil {
 		return err
 	}
-	client := &acme.Client{
-		DirectoryURL: autocert.DefaultACMEDirectory,
-		Key:          accountKey,
-		UserAgent:    "tlsproxy",
+	client, err := p.acmeClient(ctx)
+	if err != nil {
+		return err
 	}
 	now := time.Now()
-	for _, key := range toRevoke {
+	for _, key := range keys {
 		if now.After(certs[key].Leaf.NotAfter) {
-			p.logErrorF("INF Expired certificate: %s", key)
+			done(key, true)
 			continue
 		}
-		if err := client.RevokeCert(ctx, certs[key].PrivateKey.(crypto.Signer), certs[key].Certificate[0], acme.CRLReasonUnspecified); err != nil {
+		if err := client.RevokeCert(ctx, certs[key].PrivateKey.(crypto.Signer), certs[key].Certificate[0], reason); err != nil {
 			return err
 		}
-		p.logErrorF("INF Revoked unused certificate: %s", key)
+		done(key, false)
 	}
-	return p.certManager.(*autocert.Manager).Cache.(*autocertcache.Cache).DeleteKeys(ctx, toRevoke)
+	return cache.DeleteKeys(ctx, keys)
 }
 
-func (p *Proxy) acmeAccountKey(ctx context.Context) (crypto.Signer, error) {
+// acmeCache returns the cache of the autocert manager.
+func (p *Proxy) acmeCache() (*autocertcache.Cache, error) {
 	m, ok := p.certManager.(*autocert.Manager)
 	if !ok {
 		return nil, fmt.Errorf("not implemented with %T", p.certManager)
 	}
-	cache, ok := m.Cache.(*autocertcache.Cache)
-	if !ok {
+	switch c := m.Cache.(type) {
+	case *autocertcache.Cache:
+		return c, nil
+	case *acmeHistoryCache:
+		return c.Cache, nil
+	default:
 		return nil, fmt.Errorf("not implemented with %T", m.Cache)
 	}
+}
+
+// acmeClient returns an ACME client that uses the account key of the
+// autocert manager.
+func (p *Proxy) acmeClient(ctx context.Context) (*acme.Client, error) {
+	accountKey, err := p.acmeAccountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{
+		DirectoryURL: autocert.DefaultACMEDirectory,
+		Key:          accountKey,
+		UserAgent:    "tlsproxy",
+	}
+	if c := p.currentACMEManager().Client; c != nil {
+		if c.DirectoryURL != "" {
+			client.DirectoryURL = c.DirectoryURL
+		}
+		client.HTTPClient = c.HTTPClient
+	}
+	return client, nil
+}
+
+func (p *Proxy) acmeAccountKey(ctx context.Context) (crypto.Signer, error) {
+	cache, err := p.acmeCache()
+	if err != nil {
+		return nil, err
+	}
 	pemAccountKey, err := cache.Get(ctx, acmeAccountKey)
 	if err != nil {
 		return nil, fmt.Errorf("invalid account key: %w", err)
@@ -188,13 +229,9 @@ func (p *Proxy) acmeAccountKey(ctx context.Context) (crypto.Signer, error) {
 }
 
 func (p *Proxy) acmeAllCerts(ctx context.Context) (map[string]*tls.Certificate, error) {
-	m, ok := p.certManager.(*autocert.Manager)
-	if !ok {
-		return nil, fmt.Errorf("not implemented with %T", p.certManager)
-	}
-	cache, ok := m.Cache.(*autocertcache.Cache)
-	if !ok {
-		return nil, fmt.Errorf("not implemented with %T", m.Cache)
+	cache, err := p.acmeCache()
+	if err != nil {
+		return nil, err
 	}
 	keys, err := cache.Keys(ctx)
 	if err != nil {
@@ -203,7 +240,7 @@ func (p *Proxy) acmeAllCerts(ctx context.Context) (map[string]*tls.Certificate,
 	out := make(map[string]*tls.Certificate)
 L:
 	for _, k := range keys {
-		if k == acmeAccountKey {
+		if k == acmeAccountKey || k == acmeReissuedKey {
 			continue
 		}
 		data, err := cache.Get(ctx, k)
@@ -0,0 +1,136 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	sessionLimitReject      = "reject"
+	sessionLimitEvictOldest = "evict-oldest"
+)
+
+// sessionSet contains the active sessions of each user, keyed by backend ID
+// and email address.
+type sessionSet struct {
+	mu sync.Mutex
+	m  map[string][]*userSession
+}
+
+type userSession struct {
+	sid       string
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// use records that session sid of a user is used now. It returns false when
+// sid is a new session and the user already has max active sessions. In
+// that case, oldest is the ID of the oldest active session.
+func (s *sessionSet) use(key, sid string, max int, idle time.Duration, now time.Time) (oldest string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string][]*userSession)
+	}
+	var active []*userSession
+	for _, us := range s.m[key] {
+		if now.Sub(us.lastSeen) < idle {
+			active = append(active, us)
+		}
+	}
+	s.m[key] = active
+	for _, us := range active {
+		if us.sid == sid {
+			us.lastSeen = now
+			return "", true
+		}
+	}
+	if len(active) >= max {
+		oldest := active[0]
+		for _, us := range active[1:] {
+			if us.firstSeen.Before(oldest.firstSeen) {
+				oldest = us
+			}
+		}
+		return oldest.sid, false
+	}
+	s.m[key] = append(active, &userSession{sid: sid, firstSeen: now, lastSeen: now})
+	return "", true
+}
+
+// remove removes session sid of a user.
+func (s *sessionSet) remove(key, sid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := s.m[key]
+	for i, us := range sessions {
+		if us.sid == sid {
+			s.m[key] = append(sessions[:i:i], sessions[i+1:]...)
+			break
+		}
+	}
+	if len(s.m[key]) == 0 {
+		delete(s.m, key)
+	}
+}
+
+// checkSessionLimit enforces the SSO policy's SessionLimit. It returns false
+// when the request should not be processed any further.
+func (be *Backend) checkSessionLimit(w http.ResponseWriter, req *http.Request, sso *BackendSSO, claims jwt.MapClaims) bool {
+	sl := sso.SessionLimit
+	if sl == nil || be.sessionState == nil {
+		return true
+	}
+	email, _ := claims["email"].(string)
+	sid, _ := claims["sid"].(string)
+	if email == "" || sid == "" {
+		return true
+	}
+	key := be.maintenanceID() + " " + email
+	now := time.Now()
+	oldest, ok := be.sessionState.use(key, sid, sl.Max, sl.IdleTimeout, now)
+	if !ok && sl.Policy == sessionLimitEvictOldest {
+		if err := sso.cm.RevokeSessions("sid", oldest); err != nil {
+			be.logErrorF("ERR [-] %s: RevokeSessions: %v", req.RemoteAddr, err)
+		} else {
+			be.recordEvent(fmt.Sprintf("session evicted %s", email))
+			be.logErrorF("INF Oldest session of %q evicted on %q", email, be.maintenanceID())
+			be.sessionState.remove(key, oldest)
+			_, ok = be.sessionState.use(key, sid, sl.Max, sl.IdleTimeout, now)
+		}
+	}
+	if !ok {
+		be.recordEvent(fmt.Sprintf("deny SSO %s: too many sessions", email))
+		be.logHTTPRequest("REQ", req, req.RequestURI, http.StatusForbidden, " (SSO session limit)")
+		http.Error(w, "Too many active sessions. Log out from another device, and try again later.", http.StatusForbidden)
+		return false
+	}
+	return true
+}
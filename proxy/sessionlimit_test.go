@@ -0,0 +1,107 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/cookiemanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/tokenmanager"
+)
+
+func TestSessionSet(t *testing.T) {
+	var s sessionSet
+	now := time.Now()
+	for _, sid := range []string{"a", "b", "a"} {
+		if _, ok := s.use("bob", sid, 2, time.Hour, now); !ok {
+			t.Errorf("use(%q) returned false", sid)
+		}
+		now = now.Add(time.Minute)
+	}
+	if oldest, ok := s.use("bob", "c", 2, time.Hour, now); ok || oldest != "a" {
+		t.Errorf("use(c) = %q, %v, want a, false", oldest, ok)
+	}
+	// Other users are not affected.
+	if _, ok := s.use("alice", "c", 2, time.Hour, now); !ok {
+		t.Error("use(c) returned false")
+	}
+	// Idle sessions are no longer active.
+	if _, ok := s.use("bob", "c", 2, time.Hour, now.Add(2*time.Hour)); !ok {
+		t.Error("use(c) returned false")
+	}
+}
+
+func TestCheckSessionLimit(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	store := storage.New(t.TempDir(), mk)
+	tm, err := tokenmanager.New(store, nil, nil)
+	if err != nil {
+		t.Fatalf("tokenmanager.New: %v", err)
+	}
+	sso := &BackendSSO{
+		SessionLimit: &SessionLimit{
+			Max:         1,
+			Policy:      sessionLimitReject,
+			IdleTimeout: time.Hour,
+		},
+		cm: cookiemanager.New(tm, "idp", "example.com", "https://idp.example.com"),
+	}
+	be := &Backend{
+		Name:         "app",
+		SSO:          sso,
+		sessionState: &sessionSet{},
+		recordEvent:  func(string) {},
+	}
+	check := func(sid string) int {
+		claims := jwt.MapClaims{"email": "bob@example.com", "sid": sid}
+		w := httptest.NewRecorder()
+		be.checkSessionLimit(w, httptest.NewRequest("GET", "/", nil), sso, claims)
+		return w.Code
+	}
+
+	if got, want := check("one"), http.StatusOK; got != want {
+		t.Errorf("check(one) = %d, want %d", got, want)
+	}
+	if got, want := check("two"), http.StatusForbidden; got != want {
+		t.Errorf("check(two) = %d, want %d", got, want)
+	}
+
+	sso.SessionLimit.Policy = sessionLimitEvictOldest
+	if got, want := check("two"), http.StatusOK; got != want {
+		t.Errorf("check(two) = %d, want %d", got, want)
+	}
+	if !tm.Revocations().IsRevoked("idp", jwt.MapClaims{"sid": "one"}) {
+		t.Error("session one is not revoked")
+	}
+}
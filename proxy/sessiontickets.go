@@ -0,0 +1,137 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sessionTicketKeysFile = "session-ticket-keys"
+
+	// The same values as the crypto/tls automatic rotation. They are used
+	// when SessionTickets isn't set.
+	sessionTicketKeyRotation = 24 * time.Hour
+	sessionTicketKeyLifetime = 7 * 24 * time.Hour
+)
+
+type sessionTicketKey struct {
+	CreationTime time.Time `json:"creationTime"`
+	Key          [32]byte  `json:"key"`
+}
+
+// rotateSessionTicketKeys loads the session ticket keys from the encrypted
+// storage, and adds a new key when the current one is due for rotation. The
+// keys are persisted so that the clients can resume their sessions after the
+// proxy restarts. With a shared secret, the keys are derived from the secret
+// instead.
+func (p *Proxy) rotateSessionTicketKeys() (retErr error) {
+	st := p.cfg.sessionTickets()
+	if st.sharedSecret != nil {
+		p.ticketKeys, p.ticketKeysLastUpdate = deriveSessionTicketKeys(st.sharedSecret, time.Now(), st.RotationInterval, st.Lifetime)
+		return nil
+	}
+
+	var keys []sessionTicketKey
+	p.store.CreateEmptyFile(sessionTicketKeysFile, &keys)
+
+	commit, err := p.store.OpenForUpdate(sessionTicketKeysFile, &keys)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+
+	now := time.Now().UTC()
+	if len(keys) == 0 || now.Sub(keys[0].CreationTime) >= st.RotationInterval {
+		var k sessionTicketKey
+		k.CreationTime = now
+		if _, err := io.ReadFull(rand.Reader, k.Key[:]); err != nil {
+			return err
+		}
+		keys = append([]sessionTicketKey{k}, keys...)
+		for len(keys) > 1 && now.Sub(keys[len(keys)-1].CreationTime) >= st.Lifetime {
+			keys = keys[:len(keys)-1]
+		}
+		if err := commit(true, nil); err != nil {
+			return err
+		}
+		p.logErrorF("INF Session ticket keys rotated")
+	}
+	p.ticketKeys = make([][32]byte, 0, len(keys))
+	for _, k := range keys {
+		p.ticketKeys = append(p.ticketKeys, k.Key)
+	}
+	p.ticketKeysLastUpdate = keys[0].CreationTime
+	return nil
+}
+
+// sessionTickets returns the session ticket parameters, or the default ones
+// when SessionTickets isn't set.
+func (cfg *Config) sessionTickets() *ConfigSessionTickets {
+	if cfg.SessionTickets != nil {
+		return cfg.SessionTickets
+	}
+	return &ConfigSessionTickets{
+		RotationInterval: sessionTicketKeyRotation,
+		Lifetime:         sessionTicketKeyLifetime,
+	}
+}
+
+// deriveSessionTicketKeys returns the session ticket keys derived from secret
+// at time now, and the time when the current key started being used. The
+// first key is the current one. The next key is also included so that the
+// tickets encrypted by an instance whose clock is a little bit ahead can be
+// decrypted.
+func deriveSessionTicketKeys(secret []byte, now time.Time, interval, lifetime time.Duration) ([][32]byte, time.Time) {
+	key := func(epoch int64) [32]byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte("tlsproxy session ticket key " + strconv.FormatInt(epoch, 10)))
+		return [32]byte(mac.Sum(nil))
+	}
+	epoch := now.UnixNano() / int64(interval)
+	keys := [][32]byte{key(epoch), key(epoch + 1)}
+	for i := int64(1); i <= int64(lifetime/interval); i++ {
+		keys = append(keys, key(epoch-i))
+	}
+	return keys, time.Unix(0, epoch*int64(interval))
+}
+
+// backendTicketKeys returns session ticket keys that are specific to the
+// backend, so that a session ticket issued for one backend can't be used to
+// resume a session with another one.
+func (p *Proxy) backendTicketKeys(be *Backend) [][32]byte {
+	out := make([][32]byte, 0, len(p.ticketKeys))
+	for _, k := range p.ticketKeys {
+		mac := hmac.New(sha256.New, k[:])
+		mac.Write([]byte(strings.Join(be.ServerNames, "\n")))
+		out = append(out, [32]byte(mac.Sum(nil)))
+	}
+	return out
+}
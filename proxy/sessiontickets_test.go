@@ -0,0 +1,198 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestSessionTicketKeys(t *testing.T) {
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"a.example.com"},
+				Mode:        "LOCAL",
+			},
+			{
+				ServerNames: []string{"b.example.com"},
+				Mode:        "LOCAL",
+			},
+		},
+	}
+	p := newTestProxy(cfg, ca)
+	if got, want := len(p.ticketKeys), 1; got != want {
+		t.Fatalf("len(ticketKeys) = %d, want %d", got, want)
+	}
+	first := p.ticketKeys[0]
+
+	// The key is loaded from storage, not regenerated.
+	if err := p.rotateSessionTicketKeys(); err != nil && err != storage.ErrRolledBack {
+		t.Fatalf("rotateSessionTicketKeys: %v", err)
+	}
+	if got, want := len(p.ticketKeys), 1; got != want || p.ticketKeys[0] != first {
+		t.Fatalf("len(ticketKeys) = %d, want %d (same key)", got, want)
+	}
+
+	// Age the key to trigger a rotation.
+	var keys []sessionTicketKey
+	if err := p.store.ReadDataFile(sessionTicketKeysFile, &keys); err != nil {
+		t.Fatalf("ReadDataFile: %v", err)
+	}
+	keys[0].CreationTime = keys[0].CreationTime.Add(-24 * time.Hour)
+	keys = append(keys, sessionTicketKey{CreationTime: time.Now().Add(-7 * 24 * time.Hour)})
+	if err := p.store.SaveDataFile(sessionTicketKeysFile, &keys); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	if err := p.rotateSessionTicketKeys(); err != nil {
+		t.Fatalf("rotateSessionTicketKeys: %v", err)
+	}
+	if got, want := len(p.ticketKeys), 2; got != want {
+		t.Fatalf("len(ticketKeys) = %d, want %d", got, want)
+	}
+	if p.ticketKeys[0] == first || p.ticketKeys[1] != first {
+		t.Errorf("ticketKeys = %v, want [new, first]", p.ticketKeys)
+	}
+
+	ka := p.backendTicketKeys(cfg.Backends[0])
+	kb := p.backendTicketKeys(cfg.Backends[1])
+	if ka[0] == kb[0] || ka[0] == p.ticketKeys[0] {
+		t.Errorf("backend keys should be different: %v %v", ka, kb)
+	}
+}
+
+func TestDeriveSessionTicketKeys(t *testing.T) {
+	secret := []byte("01234567890123456789012345678901")
+	now := time.Now()
+	interval := time.Hour
+	lifetime := 3 * time.Hour
+
+	k1, t1 := deriveSessionTicketKeys(secret, now, interval, lifetime)
+	k2, t2 := deriveSessionTicketKeys(secret, now, interval, lifetime)
+	if !reflect.DeepEqual(k1, k2) || !t1.Equal(t2) {
+		t.Fatalf("deriveSessionTicketKeys isn't deterministic")
+	}
+	if got, want := len(k1), 5; got != want {
+		t.Fatalf("len(keys) = %d, want %d", got, want)
+	}
+	if now.Before(t1) || now.Sub(t1) >= interval {
+		t.Errorf("lastUpdate = %v, now = %v", t1, now)
+	}
+
+	// One interval later, the next key becomes the current key.
+	k3, _ := deriveSessionTicketKeys(secret, now.Add(interval), interval, lifetime)
+	if k3[0] != k1[1] || k3[2] != k1[0] {
+		t.Errorf("unexpected rotation: %v -> %v", k1, k3)
+	}
+
+	k4, _ := deriveSessionTicketKeys([]byte("another secret"), now, interval, lifetime)
+	if k4[0] == k1[0] {
+		t.Error("different secrets should have different keys")
+	}
+}
+
+func TestSessionResumption(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newTCPServer(t, ctx, "backend", nil)
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames:      []string{"a.example.com", "b.example.com"},
+				Mode:             "TCP",
+				Addresses:        []string{be.listener.Addr().String()},
+				ForwardRateLimit: 1000,
+			},
+			{
+				ServerNames:      []string{"c.example.com"},
+				Mode:             "TCP",
+				Addresses:        []string{be.listener.Addr().String()},
+				ForwardRateLimit: 1000,
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	cache := tls.NewLRUClientSessionCache(10)
+	get := func(name string) bool {
+		c, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+			ServerName:         name,
+			RootCAs:            ca.RootCACertPool(),
+			ClientSessionCache: cache,
+		})
+		if err != nil {
+			t.Fatalf("tls.Dial: %v", err)
+		}
+		defer c.Close()
+		if _, err := io.ReadAll(c); err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		return c.ConnectionState().DidResume
+	}
+	if get("a.example.com") {
+		t.Error("First connection resumed")
+	}
+	if !get("a.example.com") {
+		t.Error("Second connection did not resume")
+	}
+
+	// Use the session from a.example.com with c.example.com.
+	s, ok := cache.Get("a.example.com")
+	if !ok {
+		t.Fatal("no session in cache")
+	}
+	cache.Put("c.example.com", s)
+	if get("c.example.com") {
+		t.Error("Session resumed with a different backend")
+	}
+}
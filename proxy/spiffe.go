@@ -0,0 +1,190 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+var errNoSPIFFEID = errors.New("no SPIFFE ID")
+
+// spiffeID returns the SPIFFE ID of an X509-SVID. As per the SPIFFE spec, the
+// certificate must have exactly one URI SAN, with the spiffe scheme, a trust
+// domain, and no query or fragment.
+func spiffeID(cert *x509.Certificate) (*url.URL, error) {
+	var ids []*url.URL
+	for _, u := range cert.URIs {
+		if strings.EqualFold(u.Scheme, "spiffe") {
+			ids = append(ids, u)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, errNoSPIFFEID
+	}
+	if len(cert.URIs) != 1 {
+		return nil, errors.New("SVID must have exactly one URI SAN")
+	}
+	id := ids[0]
+	if id.Scheme != "spiffe" || id.Host == "" || id.User != nil || id.Port() != "" || id.RawQuery != "" || id.Fragment != "" {
+		return nil, errors.New("invalid SPIFFE ID")
+	}
+	if id.Host != strings.ToLower(id.Host) {
+		return nil, errors.New("SPIFFE trust domain must be lowercase")
+	}
+	return id, nil
+}
+
+// checkSPIFFETrustDomain verifies that the certificate has a valid SPIFFE ID
+// in one of the trust domains.
+func checkSPIFFETrustDomain(cert *x509.Certificate, domains []string) error {
+	id, err := spiffeID(cert)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(domains, id.Host) {
+		return errors.New("SPIFFE trust domain not allowed")
+	}
+	return nil
+}
+
+// matchSPIFFEACL returns true if the SPIFFE ID matches one of the ACL's
+// wildcard entries, e.g. URI:spiffe://example.org/ns/prod/* matches
+// spiffe://example.org/ns/prod/sa/app, but not spiffe://example.org/ns/prod.
+// Exact matches are handled by the caller.
+func matchSPIFFEACL(acl []string, id *url.URL) bool {
+	s := id.String()
+	for _, a := range acl {
+		prefix, ok := strings.CutSuffix(a, "*")
+		if !ok || !strings.HasPrefix(prefix, "URI:spiffe://") || !strings.HasSuffix(prefix, "/") {
+			continue
+		}
+		if strings.HasPrefix("URI:"+s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// spiffeStartTimeout is how long to wait for the first X.509 SVID from the
+// Workload API.
+const spiffeStartTimeout = 30 * time.Second
+
+// spiffeSource provides the proxy's X.509 SVID and the trust bundles.
+type spiffeSource interface {
+	x509svid.Source
+	x509bundle.Source
+}
+
+// spiffeAuthorizer returns an Authorizer that accepts the SPIFFE IDs in ids,
+// and the members of the trust domains in ids. It returns nil when ids is
+// empty.
+func spiffeAuthorizer(ids []string) (tlsconfig.Authorizer, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var allowed []spiffeid.ID
+	var domains []spiffeid.TrustDomain
+	for _, v := range ids {
+		id, err := spiffeid.FromString(v)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", v, err)
+		}
+		if id.Path() == "" {
+			domains = append(domains, id.TrustDomain())
+			continue
+		}
+		allowed = append(allowed, id)
+	}
+	return tlsconfig.AdaptMatcher(func(id spiffeid.ID) error {
+		if slices.Contains(allowed, id) || slices.Contains(domains, id.TrustDomain()) {
+			return nil
+		}
+		return fmt.Errorf("unexpected ID %q", id)
+	}), nil
+}
+
+// spiffeTLSConfig updates tc to use the proxy's X.509 SVID as client
+// certificate, and to verify the backend server's SVID, as specified by
+// ForwardSPIFFE.
+func (be *Backend) spiffeTLSConfig(tc *tls.Config) {
+	fs := be.ForwardSPIFFE
+	if fs == nil || be.spiffe == nil {
+		return
+	}
+	if fs.ClientSVID {
+		tc.GetClientCertificate = tlsconfig.GetClientCertificate(be.spiffe)
+	}
+	if fs.authorizer != nil {
+		// The server's certificate is verified by VerifyPeerCertificate
+		// with the trust bundles. SVIDs don't have server names.
+		tc.InsecureSkipVerify = true
+		tc.RootCAs = nil
+		tc.VerifyPeerCertificate = tlsconfig.VerifyPeerCertificate(be.spiffe, fs.authorizer)
+	}
+}
+
+// spiffeSource returns a source of X.509 SVIDs and trust bundles that is
+// connected to the Workload API, if any backend uses ForwardSPIFFE. The
+// current source is re-used if the address of the Workload API hasn't
+// changed. p.mu must be held.
+func (p *Proxy) spiffeSource(cfg *Config) (*workloadapi.X509Source, error) {
+	if cfg.SPIFFE == nil || !slices.ContainsFunc(cfg.Backends, func(be *Backend) bool { return be.ForwardSPIFFE != nil }) {
+		return nil, nil
+	}
+	addr := cfg.SPIFFE.WorkloadAPIAddr
+	if p.spiffe != nil && p.spiffeAddr == addr {
+		return p.spiffe, nil
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, spiffeStartTimeout)
+	defer cancel()
+	src, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(addr)))
+	if err != nil {
+		return nil, fmt.Errorf("SPIFFE Workload API: %w", err)
+	}
+	return src, nil
+}
+
+// setSPIFFESource replaces the current source of X.509 SVIDs with src, and
+// closes the previous one. p.mu must be held.
+func (p *Proxy) setSPIFFESource(src *workloadapi.X509Source, addr string) {
+	if p.spiffe != nil && p.spiffe != src {
+		p.spiffe.Close()
+	}
+	p.spiffe = src
+	p.spiffeAddr = addr
+}
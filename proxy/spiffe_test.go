@@ -0,0 +1,237 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+func TestSPIFFEID(t *testing.T) {
+	for _, tc := range []struct {
+		uris    []string
+		want    string
+		wantErr bool
+	}{
+		{uris: nil, wantErr: true},
+		{uris: []string{"https://example.org/foo"}, wantErr: true},
+		{uris: []string{"spiffe://example.org/ns/prod/sa/app"}, want: "spiffe://example.org/ns/prod/sa/app"},
+		{uris: []string{"spiffe://example.org/a", "spiffe://example.org/b"}, wantErr: true},
+		{uris: []string{"spiffe://example.org/a", "https://example.org/b"}, wantErr: true},
+		{uris: []string{"spiffe://Example.org/a"}, wantErr: true},
+		{uris: []string{"spiffe://example.org:8443/a"}, wantErr: true},
+		{uris: []string{"spiffe://example.org/a?b=c"}, wantErr: true},
+		{uris: []string{"spiffe:///a"}, wantErr: true},
+	} {
+		cert := &x509.Certificate{}
+		for _, s := range tc.uris {
+			u, err := url.Parse(s)
+			if err != nil {
+				t.Fatalf("url.Parse(%q): %v", s, err)
+			}
+			cert.URIs = append(cert.URIs, u)
+		}
+		id, err := spiffeID(cert)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("spiffeID(%v) = %v, want error", tc.uris, id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("spiffeID(%v) failed: %v", tc.uris, err)
+			continue
+		}
+		if got := id.String(); got != tc.want {
+			t.Errorf("spiffeID(%v) = %q, want %q", tc.uris, got, tc.want)
+		}
+	}
+}
+
+func TestSPIFFEAuthorize(t *testing.T) {
+	be := &Backend{
+		ClientAuth: &ClientAuth{
+			ACL: &[]string{
+				"URI:spiffe://example.org/ns/prod/*",
+				"URI:spiffe://example.org/ns/dev/sa/app",
+				"URI:spiffe://other.org/*",
+			},
+			SPIFFETrustDomains: []string{"example.org"},
+		},
+	}
+	for _, tc := range []struct {
+		uri  string
+		want bool
+	}{
+		{uri: "spiffe://example.org/ns/prod/sa/app", want: true},
+		{uri: "spiffe://example.org/ns/prod/sa/app/x", want: true},
+		{uri: "spiffe://example.org/ns/prod", want: false},
+		{uri: "spiffe://example.org/ns/production/sa/app", want: false},
+		{uri: "spiffe://example.org/ns/dev/sa/app", want: true},
+		{uri: "spiffe://example.org/ns/dev/sa/app2", want: false},
+		{uri: "spiffe://other.org/ns/prod/sa/app", want: false},
+		{uri: "https://example.org/ns/prod/sa/app", want: false},
+	} {
+		u, _ := url.Parse(tc.uri)
+		cert := &x509.Certificate{URIs: []*url.URL{u}}
+		if got := be.authorize(cert) == nil; got != tc.want {
+			t.Errorf("authorize(%q) = %v, want %v", tc.uri, got, tc.want)
+		}
+	}
+}
+
+type testSPIFFESource struct {
+	*x509svid.SVID
+	*x509bundle.Bundle
+}
+
+func newTestSVID(t *testing.T, id string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	u, err := url.Parse(id)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	templ := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		URIs:                  []*url.URL{u},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	parent, signer := templ, key
+	if ca == nil {
+		templ.IsCA = true
+		templ.KeyUsage = x509.KeyUsageCertSign
+		templ.ExtKeyUsage = nil
+	} else {
+		parent, signer = ca, caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, templ, parent, key.Public(), signer)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	return cert, key
+}
+
+func TestForwardSPIFFE(t *testing.T) {
+	ca, caKey := newTestSVID(t, "spiffe://example.org", nil, nil)
+	serverCert, serverKey := newTestSVID(t, "spiffe://example.org/api", ca, caKey)
+	clientCert, clientKey := newTestSVID(t, "spiffe://example.org/proxy", ca, caKey)
+
+	ln, err := tls.Listen("tcp", "localhost:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("tls.Listen: %v", err)
+	}
+	defer ln.Close()
+	clientIDs := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			tc := conn.(*tls.Conn)
+			if err := tc.Handshake(); err == nil {
+				clientIDs <- tc.ConnectionState().PeerCertificates[0].URIs[0].String()
+			}
+			conn.Close()
+		}
+	}()
+
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	src := testSPIFFESource{
+		SVID: &x509svid.SVID{
+			ID:           spiffeid.RequireFromString("spiffe://example.org/proxy"),
+			Certificates: []*x509.Certificate{clientCert},
+			PrivateKey:   clientKey,
+		},
+		Bundle: x509bundle.FromX509Authorities(td, []*x509.Certificate{ca}),
+	}
+
+	for _, tc := range []struct {
+		serverIDs []string
+		wantErr   bool
+	}{
+		{serverIDs: []string{"spiffe://example.org/api"}},
+		{serverIDs: []string{"spiffe://example.org"}},
+		{serverIDs: []string{"spiffe://example.org/other"}, wantErr: true},
+		{serverIDs: []string{"spiffe://other.org"}, wantErr: true},
+	} {
+		auth, err := spiffeAuthorizer(tc.serverIDs)
+		if err != nil {
+			t.Fatalf("spiffeAuthorizer(%v): %v", tc.serverIDs, err)
+		}
+		be := &Backend{
+			ForwardSPIFFE: &ForwardSPIFFE{ClientSVID: true, ServerIDs: tc.serverIDs, authorizer: auth},
+			spiffe:        src,
+		}
+		conf := &tls.Config{ServerName: "backend.example.com"}
+		be.spiffeTLSConfig(conf)
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", ln.Addr().String(), conf)
+		if tc.wantErr {
+			if err == nil {
+				conn.Close()
+				t.Errorf("%v: Dial succeeded, want error", tc.serverIDs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: Dial: %v", tc.serverIDs, err)
+			continue
+		}
+		conn.Close()
+		if got, want := <-clientIDs, "spiffe://example.org/proxy"; got != want {
+			t.Errorf("%v: client ID = %q, want %q", tc.serverIDs, got, want)
+		}
+	}
+
+	if _, err := spiffeAuthorizer([]string{"https://example.org/api"}); err == nil {
+		t.Error("spiffeAuthorizer(https://...) succeeded, want error")
+	}
+}
@@ -0,0 +1,76 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+)
+
+const spkiPinPrefix = "SPKI:sha256/"
+
+// spkiPin returns the ACL entry that matches the certificate's public key,
+// e.g. SPKI:sha256/<base64 of the SHA-256 hash of the SubjectPublicKeyInfo>.
+// This is the same encoding as HTTP Public Key Pinning (RFC 7469).
+func spkiPin(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return spkiPinPrefix + base64.StdEncoding.EncodeToString(h[:])
+}
+
+// validateSPKIPin checks that an SPKI ACL entry is well-formed.
+func validateSPKIPin(s string) error {
+	v, ok := strings.CutPrefix(s, spkiPinPrefix)
+	if !ok {
+		return errors.New("must start with " + spkiPinPrefix)
+	}
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return err
+	}
+	if len(b) != sha256.Size {
+		return errors.New("invalid sha256 hash length")
+	}
+	return nil
+}
+
+// matchPinnedKeys returns true if the verified chains contain one of the
+// pinned keys. When the chains were not verified, only the server's own
+// certificate is checked.
+func matchPinnedKeys(cs tls.ConnectionState, pins []string) bool {
+	certs := []*x509.Certificate{cs.PeerCertificates[0]}
+	for _, chain := range cs.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	for _, c := range certs {
+		if slices.Contains(pins, spkiPin(c)) {
+			return true
+		}
+	}
+	return false
+}
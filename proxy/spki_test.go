@@ -0,0 +1,127 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestSPKIAuthorize(t *testing.T) {
+	newCert := func(key *ecdsa.PrivateKey, cn string) *x509.Certificate {
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			t.Fatalf("x509.MarshalPKIXPublicKey: %v", err)
+		}
+		return &x509.Certificate{
+			Subject:                 pkix.Name{CommonName: cn},
+			RawSubjectPublicKeyInfo: der,
+		}
+	}
+	key1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	key2, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+
+	pin := spkiPin(newCert(key1, "device"))
+	if err := validateSPKIPin(pin); err != nil {
+		t.Fatalf("validateSPKIPin(%q): %v", pin, err)
+	}
+	be := &Backend{
+		ClientAuth: &ClientAuth{
+			ACL: &[]string{pin},
+		},
+	}
+	for _, tc := range []struct {
+		name string
+		cert *x509.Certificate
+		want bool
+	}{
+		{name: "same key", cert: newCert(key1, "device"), want: true},
+		{name: "same key, new subject", cert: newCert(key1, "re-enrolled device"), want: true},
+		{name: "other key", cert: newCert(key2, "device"), want: false},
+	} {
+		if got := be.authorize(tc.cert) == nil; got != tc.want {
+			t.Errorf("%s: authorize() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	for _, v := range []string{
+		"SPKI:sha256/",
+		"SPKI:sha256/AAAA",
+		"SPKI:sha256/not-base64!",
+		"SPKI:sha1/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+	} {
+		if err := validateSPKIPin(v); err == nil {
+			t.Errorf("validateSPKIPin(%q) = nil, want error", v)
+		}
+	}
+}
+
+func TestMatchPinnedKeys(t *testing.T) {
+	newCert := func() *x509.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("ecdsa.GenerateKey: %v", err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			t.Fatalf("x509.MarshalPKIXPublicKey: %v", err)
+		}
+		return &x509.Certificate{RawSubjectPublicKeyInfo: der}
+	}
+	leaf, inter, root, other := newCert(), newCert(), newCert(), newCert()
+	verified := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{leaf, inter},
+		VerifiedChains:   [][]*x509.Certificate{{leaf, inter, root}},
+	}
+	unverified := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{leaf, inter},
+	}
+	for _, tc := range []struct {
+		name string
+		cs   tls.ConnectionState
+		pins []string
+		want bool
+	}{
+		{"leaf", verified, []string{spkiPin(leaf)}, true},
+		{"root", verified, []string{spkiPin(other), spkiPin(root)}, true},
+		{"other", verified, []string{spkiPin(other)}, false},
+		{"unverified leaf", unverified, []string{spkiPin(leaf)}, true},
+		{"unverified intermediate", unverified, []string{spkiPin(inter)}, false},
+	} {
+		if got := matchPinnedKeys(tc.cs, tc.pins); got != tc.want {
+			t.Errorf("%s: matchPinnedKeys() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
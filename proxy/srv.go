@@ -0,0 +1,151 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// srvPrefix indicates that a backend address is the name of SRV
+	// records, e.g. srv+_app._tcp.example.com
+	srvPrefix = "srv+"
+	// srvRefreshInterval is how often SRV records are resolved again.
+	srvRefreshInterval = 30 * time.Second
+)
+
+type srvCacheEntry struct {
+	records []*net.SRV
+	expires time.Time
+}
+
+// dialTargets returns the addresses to try, in order, for one of the
+// backend's addresses. For SRV addresses, the targets are ordered by priority
+// and weight, as described in RFC 2782.
+func (be *Backend) dialTargets(ctx context.Context, addr string) ([]string, error) {
+	name, ok := strings.CutPrefix(addr, srvPrefix)
+	if !ok {
+		return []string{addr}, nil
+	}
+	records, err := be.srvRecords(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]string, 0, len(records))
+	for _, r := range orderSRV(records) {
+		targets = append(targets, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+	}
+	return targets, nil
+}
+
+// srvRecords returns the SRV records for name. The records are cached for
+// srvRefreshInterval. If they can't be resolved again, the stale records are
+// used.
+func (be *Backend) srvRecords(ctx context.Context, name string) ([]*net.SRV, error) {
+	be.state.mu.Lock()
+	e := be.state.srv[name]
+	be.state.mu.Unlock()
+	if e != nil && time.Now().Before(e.expires) {
+		return e.records, nil
+	}
+
+	lookup := func(ctx context.Context, name string) ([]*net.SRV, error) {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		return records, err
+	}
+	if be.resolver != nil {
+		lookup = be.resolver.LookupSRV
+	}
+	records, err := lookup(ctx, name)
+	if err == nil {
+		records = slices.DeleteFunc(records, func(r *net.SRV) bool {
+			// A target of "." means that the service is not available.
+			return r.Target == "." || r.Target == ""
+		})
+		if len(records) == 0 {
+			err = errors.New("no SRV targets")
+		}
+	}
+	if err != nil {
+		if e != nil {
+			be.logErrorF("ERR SRV %q: %v (using stale records)", name, err)
+			return e.records, nil
+		}
+		return nil, err
+	}
+	be.state.mu.Lock()
+	defer be.state.mu.Unlock()
+	if be.state.srv == nil {
+		be.state.srv = make(map[string]*srvCacheEntry)
+	}
+	be.state.srv[name] = &srvCacheEntry{
+		records: records,
+		expires: time.Now().Add(srvRefreshInterval),
+	}
+	return records, nil
+}
+
+// orderSRV returns the records sorted by priority, and in weighted random
+// order within each priority.
+// https://www.rfc-editor.org/rfc/rfc2782.html
+func orderSRV(records []*net.SRV) []*net.SRV {
+	records = slices.Clone(records)
+	slices.SortStableFunc(records, func(a, b *net.SRV) int {
+		return int(a.Priority) - int(b.Priority)
+	})
+	out := make([]*net.SRV, 0, len(records))
+	for len(records) > 0 {
+		n := 1
+		for n < len(records) && records[n].Priority == records[0].Priority {
+			n++
+		}
+		group := records[:n]
+		records = records[n:]
+		for len(group) > 0 {
+			var sum int
+			for _, r := range group {
+				sum += int(r.Weight)
+			}
+			i := 0
+			if sum > 0 {
+				v := rand.IntN(sum) + 1
+				for ; i < len(group); i++ {
+					if v -= int(group[i].Weight); v <= 0 {
+						break
+					}
+				}
+			}
+			out = append(out, group[i])
+			group = slices.Delete(group, i, i+1)
+		}
+	}
+	return out
+}
@@ -0,0 +1,142 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestOrderSRV(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "c", Priority: 20, Weight: 1},
+		{Target: "a1", Priority: 10, Weight: 90},
+		{Target: "a2", Priority: 10, Weight: 10},
+		{Target: "b", Priority: 15, Weight: 0},
+	}
+	first := make(map[string]int)
+	for range 1000 {
+		var got []string
+		for _, r := range orderSRV(records) {
+			got = append(got, r.Target)
+		}
+		if len(got) != 4 || got[2] != "b" || got[3] != "c" || !slices.Contains(got[:2], "a1") || !slices.Contains(got[:2], "a2") {
+			t.Fatalf("orderSRV() = %v", got)
+		}
+		first[got[0]]++
+	}
+	if first["a1"] < 800 || first["a2"] < 50 {
+		t.Errorf("unexpected weighted distribution: %v", first)
+	}
+
+	var got []string
+	for _, r := range orderSRV([]*net.SRV{{Target: "x"}, {Target: "y"}}) {
+		got = append(got, r.Target)
+	}
+	if len(got) != 2 {
+		t.Errorf("orderSRV() with zero weights = %v", got)
+	}
+}
+
+func TestSRVDialTargets(t *testing.T) {
+	ctx := context.Background()
+
+	var count int
+	var fail bool
+	be := &Backend{
+		state: new(backendState),
+		resolver: &resolver{
+			timeout: time.Second,
+			lookupSRV: func(_ context.Context, name string) ([]*net.SRV, error) {
+				count++
+				if fail {
+					return nil, errors.New("failed")
+				}
+				if name != "_app._tcp.example.com" {
+					return nil, errors.New("not found")
+				}
+				return []*net.SRV{
+					{Target: "backup.example.com.", Port: 8443, Priority: 2},
+					{Target: ".", Port: 0, Priority: 0},
+					{Target: "main.example.com.", Port: 443, Priority: 1},
+				}, nil
+			},
+		},
+	}
+
+	got, err := be.dialTargets(ctx, "127.0.0.1:8080")
+	if err != nil {
+		t.Fatalf("dialTargets: %v", err)
+	}
+	if want := []string{"127.0.0.1:8080"}; !slices.Equal(got, want) {
+		t.Errorf("dialTargets() = %v, want %v", got, want)
+	}
+	if count != 0 {
+		t.Errorf("count = %d, want 0", count)
+	}
+
+	want := []string{"main.example.com:443", "backup.example.com:8443"}
+	for range 2 {
+		got, err := be.dialTargets(ctx, "srv+_app._tcp.example.com")
+		if err != nil {
+			t.Fatalf("dialTargets: %v", err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("dialTargets() = %v, want %v", got, want)
+		}
+	}
+	if count != 1 {
+		t.Errorf("count = %d, want 1", count)
+	}
+
+	// Stale records are used when the lookup fails.
+	be.state.srv["_app._tcp.example.com"].expires = time.Now().Add(-time.Second)
+	fail = true
+	got, err = be.dialTargets(ctx, "srv+_app._tcp.example.com")
+	if err != nil {
+		t.Fatalf("dialTargets: %v", err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("dialTargets() = %v, want %v", got, want)
+	}
+	if count != 2 {
+		t.Errorf("count = %d, want 2", count)
+	}
+
+	if _, err := be.dialTargets(ctx, "srv+_other._tcp.example.com"); err == nil {
+		t.Error("dialTargets(srv+_other._tcp.example.com) should fail")
+	}
+
+	cfg := &Config{
+		CacheDir: t.TempDir(),
+		Backends: []*Backend{{ServerNames: []string{"example.com"}, Addresses: []string{"srv+"}}},
+	}
+	if err := cfg.Check(); err == nil {
+		t.Error("Check() with empty SRV name should fail")
+	}
+}
@@ -0,0 +1,207 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var errSSHJumpHostClosed = errors.New("ssh jump host is closed")
+
+// sshJumpHost dials the backend servers through an SSH bastion host. The SSH
+// connection is established on demand, and it is shared by all the
+// connections to the backend servers.
+type sshJumpHost struct {
+	addr   string
+	config *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client
+	// active is the number of open connections through client.
+	active int
+	closed bool
+}
+
+func newSSHJumpHost(cfg *DialSSH) (*sshJumpHost, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("Address: must be set")
+	}
+	addr := cfg.Address
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	if cfg.User == "" {
+		return nil, errors.New("User: must be set")
+	}
+	if cfg.KeyFile == "" {
+		return nil, errors.New("KeyFile: must be set")
+	}
+	b, err := os.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("KeyFile: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("KeyFile: %w", err)
+	}
+	if len(cfg.HostKeys) == 0 && cfg.KnownHostsFile == "" {
+		return nil, errors.New("HostKeys: HostKeys or KnownHostsFile must be set")
+	}
+	var hostKeys []ssh.PublicKey
+	var hostKeyAlgos []string
+	for _, k := range cfg.HostKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			return nil, fmt.Errorf("HostKeys: %w", err)
+		}
+		hostKeys = append(hostKeys, key)
+		if key.Type() == ssh.KeyAlgoRSA {
+			hostKeyAlgos = append(hostKeyAlgos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		hostKeyAlgos = append(hostKeyAlgos, key.Type())
+	}
+	var knownHosts ssh.HostKeyCallback
+	if cfg.KnownHostsFile != "" {
+		if knownHosts, err = knownhosts.New(cfg.KnownHostsFile); err != nil {
+			return nil, fmt.Errorf("KnownHostsFile: %w", err)
+		}
+		// The algorithms are negotiated with the server when the host
+		// keys come from the known_hosts file.
+		hostKeyAlgos = nil
+	}
+	return &sshJumpHost{
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:              cfg.User,
+			Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyAlgorithms: hostKeyAlgos,
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				for _, k := range hostKeys {
+					if bytes.Equal(k.Marshal(), key.Marshal()) {
+						return nil
+					}
+				}
+				if knownHosts != nil {
+					return knownHosts(hostname, remote, key)
+				}
+				return fmt.Errorf("ssh: unknown host key %s %s", key.Type(), ssh.FingerprintSHA256(key))
+			},
+		},
+	}, nil
+}
+
+// dial opens a connection to addr from the bastion host.
+func (j *sshJumpHost) dial(ctx context.Context, addr string) (net.Conn, error) {
+	client, err := j.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		j.release()
+		return nil, err
+	}
+	return &sshJumpConn{Conn: conn, release: sync.OnceFunc(j.release)}, nil
+}
+
+// getClient returns the SSH client, after connecting to the bastion host if
+// needed. The caller must call release when the client is no longer used.
+func (j *sshJumpHost) getClient(ctx context.Context) (*ssh.Client, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return nil, errSSHJumpHostClosed
+	}
+	if j.client == nil {
+		var dialer net.Dialer
+		c, err := dialer.DialContext(ctx, "tcp", j.addr)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			c.SetDeadline(deadline)
+		}
+		cc, chans, reqs, err := ssh.NewClientConn(c, j.addr, j.config)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.SetDeadline(time.Time{})
+		client := ssh.NewClient(cc, chans, reqs)
+		go func() {
+			client.Wait()
+			j.mu.Lock()
+			defer j.mu.Unlock()
+			if j.client == client {
+				j.client = nil
+			}
+		}()
+		j.client = client
+	}
+	j.active++
+	return j.client, nil
+}
+
+func (j *sshJumpHost) release() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.active--
+	if j.closed && j.active == 0 && j.client != nil {
+		j.client.Close()
+		j.client = nil
+	}
+}
+
+// close closes the SSH connection when the last connection through it is
+// closed.
+func (j *sshJumpHost) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.closed = true
+	if j.active == 0 && j.client != nil {
+		j.client.Close()
+		j.client = nil
+	}
+}
+
+// sshJumpConn is a connection through the bastion host.
+type sshJumpConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *sshJumpConn) Close() error {
+	defer c.release()
+	return c.Conn.Close()
+}
@@ -0,0 +1,210 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDialSSH(t *testing.T) {
+	dir := t.TempDir()
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey: %v", err)
+	}
+	userPub, userPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(userPriv, "")
+	if err != nil {
+		t.Fatalf("MarshalPrivateKey: %v", err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	sshUserPub, err := ssh.NewPublicKey(userPub)
+	if err != nil {
+		t.Fatalf("NewPublicKey: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := newTCPServer(t, ctx, "backend", nil)
+	bastion := newSSHBastion(t, ctx, hostSigner, sshUserPub)
+
+	newBackend := func(hostKey string) *Backend {
+		jh, err := newSSHJumpHost(&DialSSH{
+			Address:  bastion,
+			User:     "proxy",
+			KeyFile:  keyFile,
+			HostKeys: []string{hostKey},
+		})
+		if err != nil {
+			t.Fatalf("newSSHJumpHost: %v", err)
+		}
+		p := &Proxy{}
+		return &Backend{
+			Mode:           ModeTCP,
+			Addresses:      []string{backend.listener.Addr().String()},
+			ForwardTimeout: 5 * time.Second,
+			sshJump:        jh,
+			getClientCert: func(context.Context) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return nil
+			},
+			recordEvent: func(string) {},
+			outConns:    newConnTracker(),
+			draining:    &p.draining,
+			state:       &backendState{},
+		}
+	}
+
+	be := newBackend(string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey())))
+	c, err := be.dial(ctx)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	// The SSH connection stays open until the last connection is closed.
+	be.close(nil)
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if got, want := string(b), "Hello from backend\n"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+	c.Close()
+	if be.sshJump.client != nil {
+		t.Error("SSH connection is still open")
+	}
+	if _, err := be.dial(ctx); !errors.Is(err, errSSHJumpHostClosed) {
+		t.Errorf("dial after close: %v, want %v", err, errSSHJumpHostClosed)
+	}
+
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	otherKey, err := ssh.NewPublicKey(otherPub)
+	if err != nil {
+		t.Fatalf("NewPublicKey: %v", err)
+	}
+	be = newBackend(string(ssh.MarshalAuthorizedKey(otherKey)))
+	if _, err := be.dial(ctx); err == nil {
+		t.Error("dial with unknown host key should fail")
+	}
+}
+
+// newSSHBastion starts an SSH server that accepts direct-tcpip channels, i.e.
+// port forwarding, from userKey.
+func newSSHBastion(t *testing.T, ctx context.Context, hostKey ssh.Signer, userKey ssh.PublicKey) string {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(userKey.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(c, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					if nc.ChannelType() != "direct-tcpip" {
+						nc.Reject(ssh.UnknownChannelType, "unsupported")
+						continue
+					}
+					var payload struct {
+						Host     string
+						Port     uint32
+						OrigHost string
+						OrigPort uint32
+					}
+					if err := ssh.Unmarshal(nc.ExtraData(), &payload); err != nil {
+						nc.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+					if err != nil {
+						nc.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					ch, chReqs, err := nc.Accept()
+					if err != nil {
+						target.Close()
+						continue
+					}
+					go ssh.DiscardRequests(chReqs)
+					go func() {
+						io.Copy(ch, target)
+						ch.CloseWrite()
+					}()
+					go func() {
+						io.Copy(target, ch)
+						target.Close()
+					}()
+				}
+			}()
+		}
+	}()
+	return fmt.Sprintf("localhost:%d", l.Addr().(*net.TCPAddr).Port)
+}
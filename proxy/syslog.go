@@ -0,0 +1,281 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	syslogQueueSize    = 1000
+	syslogTimeout      = 5 * time.Second
+	syslogRetryBackoff = 5 * time.Second
+)
+
+var (
+	syslogFacilities = map[string]int{
+		"kern": 0, "user": 1, "mail": 2, "daemon": 3,
+		"auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+		"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+		"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+		"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+	}
+	syslogSeverities = map[string]int{
+		"FATAL": 2, "ERR": 3, "WRN": 4, "INF": 6, "DBG": 7,
+	}
+	logDatePrefix = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(\.\d+)? `)
+)
+
+var logOutput struct {
+	sync.Mutex
+	local io.Writer
+	sink  io.Writer
+}
+
+// SetLogOutput sets the local destination of the logs, e.g. os.Stdout. When
+// a syslog server is configured, the logs are also sent to it.
+func SetLogOutput(w io.Writer) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	logOutput.local = w
+	applyLogOutputLocked()
+}
+
+func setLogSink(w io.Writer) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	if logOutput.local == nil {
+		logOutput.local = log.Writer()
+	}
+	logOutput.sink = w
+	applyLogOutputLocked()
+}
+
+func applyLogOutputLocked() {
+	if logOutput.sink == nil {
+		log.SetOutput(logOutput.local)
+		return
+	}
+	log.SetOutput(io.MultiWriter(logOutput.local, logOutput.sink))
+}
+
+// updateSyslog starts, stops, or restarts the syslog writer to match cfg.
+func (p *Proxy) updateSyslog(cfg *ConfigSyslog) {
+	p.syslogMu.Lock()
+	defer p.syslogMu.Unlock()
+	if cfg != nil && p.syslogCfg != nil && reflect.DeepEqual(cfg, p.syslogCfg) {
+		return
+	}
+	if p.syslog != nil {
+		setLogSink(nil)
+		p.syslog.close()
+		p.syslog = nil
+		p.syslogCfg = nil
+	}
+	if cfg == nil {
+		return
+	}
+	w, err := newSyslogWriter(cfg)
+	if err != nil {
+		p.logErrorF("ERR syslog: %v", err)
+		return
+	}
+	c := *cfg
+	c.RootCAs = slices.Clone(cfg.RootCAs)
+	p.syslogCfg = &c
+	p.syslog = w
+	setLogSink(w)
+}
+
+// syslogWriter is an io.Writer that sends log messages to a syslog server
+// using the RFC 5424 format. Messages are queued and sent asynchronously. They
+// are dropped when the queue is full or when the server is unreachable.
+type syslogWriter struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	facility  int
+	appName   string
+	hostname  string
+	pid       int
+
+	mu     sync.Mutex
+	closed bool
+	ch     chan []byte
+	done   chan struct{}
+
+	conn      net.Conn
+	lastError time.Time
+}
+
+func newSyslogWriter(cfg *ConfigSyslog) (*syslogWriter, error) {
+	w := &syslogWriter{
+		network:  cfg.Network,
+		address:  cfg.Address,
+		facility: syslogFacilities[cfg.Facility],
+		appName:  cfg.AppName,
+		hostname: cfg.Hostname,
+		pid:      os.Getpid(),
+		ch:       make(chan []byte, syslogQueueSize),
+		done:     make(chan struct{}),
+	}
+	if w.hostname == "" {
+		if h, err := os.Hostname(); err == nil {
+			w.hostname = h
+		} else {
+			w.hostname = "-"
+		}
+	}
+	if w.network == "tls" {
+		w.tlsConfig = &tls.Config{
+			ServerName: cfg.ServerName,
+		}
+		if w.tlsConfig.ServerName == "" {
+			host, _, err := net.SplitHostPort(w.address)
+			if err != nil {
+				return nil, err
+			}
+			w.tlsConfig.ServerName = host
+		}
+		if len(cfg.RootCAs) > 0 {
+			pool := x509.NewCertPool()
+			for _, n := range cfg.RootCAs {
+				if err := loadCerts(pool, n); err != nil {
+					return nil, err
+				}
+			}
+			w.tlsConfig.RootCAs = pool
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+// Write queues one log message.
+func (w *syslogWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return len(b), nil
+	}
+	select {
+	case w.ch <- slices.Clone(b):
+	default:
+	}
+	return len(b), nil
+}
+
+func (w *syslogWriter) close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.ch)
+	}
+	w.mu.Unlock()
+	select {
+	case <-w.done:
+	case <-time.After(syslogTimeout):
+	}
+}
+
+func (w *syslogWriter) run() {
+	defer close(w.done)
+	defer func() {
+		if w.conn != nil {
+			w.conn.Close()
+		}
+	}()
+	for b := range w.ch {
+		w.send(w.format(string(b), time.Now()))
+	}
+}
+
+// format returns a RFC 5424 message. With TCP and TLS, the message is framed
+// with octet counting (RFC 6587).
+func (w *syslogWriter) format(line string, now time.Time) []byte {
+	line = strings.TrimRight(line, "\r\n")
+	line = logDatePrefix.ReplaceAllString(line, "")
+	severity := 6
+	if word, _, ok := strings.Cut(line, " "); ok {
+		if s, exists := syslogSeverities[word]; exists {
+			severity = s
+		}
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		w.facility*8+severity,
+		now.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		w.hostname, w.appName, w.pid, line)
+	if w.network == "udp" {
+		return []byte(msg)
+	}
+	return []byte(fmt.Sprintf("%d %s", len(msg), msg))
+}
+
+func (w *syslogWriter) send(msg []byte) {
+	for range 2 {
+		if w.conn == nil {
+			if time.Since(w.lastError) < syslogRetryBackoff {
+				return
+			}
+			conn, err := w.dial()
+			if err != nil {
+				w.lastError = time.Now()
+				return
+			}
+			w.conn = conn
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err := w.conn.Write(msg); err == nil {
+			return
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	w.lastError = time.Now()
+}
+
+func (w *syslogWriter) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogTimeout}
+	switch w.network {
+	case "udp", "tcp":
+		return dialer.Dial(w.network, w.address)
+	case "tls":
+		return tls.DialWithDialer(dialer, "tcp", w.address, w.tlsConfig)
+	default:
+		return nil, errors.New("invalid network")
+	}
+}
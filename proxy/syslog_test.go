@@ -0,0 +1,208 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestSyslogFormat(t *testing.T) {
+	w := &syslogWriter{
+		network:  "udp",
+		facility: syslogFacilities["local0"],
+		appName:  "tlsproxy",
+		hostname: "host1",
+		pid:      123,
+	}
+	now := time.Date(2025, 1, 2, 3, 4, 5, 6000, time.UTC)
+	for _, tc := range []struct {
+		line string
+		want string
+	}{
+		{"2025/01/02 03:04:05 ERR something failed\n", "<131>1 2025-01-02T03:04:05.000006Z host1 tlsproxy 123 - - ERR something failed"},
+		{"2025/01/02 03:04:05.123456 INF hello\n", "<134>1 2025-01-02T03:04:05.000006Z host1 tlsproxy 123 - - INF hello"},
+		{"REQ 10.0.0.1 ➔ GET /\n", "<134>1 2025-01-02T03:04:05.000006Z host1 tlsproxy 123 - - REQ 10.0.0.1 ➔ GET /"},
+		{"WRN careful\n", "<132>1 2025-01-02T03:04:05.000006Z host1 tlsproxy 123 - - WRN careful"},
+	} {
+		if got := string(w.format(tc.line, now)); got != tc.want {
+			t.Errorf("format(%q) = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+
+	w.network = "tcp"
+	got := string(w.format("FATAL bye\n", now))
+	want := "<130>1 2025-01-02T03:04:05.000006Z host1 tlsproxy 123 - - FATAL bye"
+	if want = strconv.Itoa(len(want)) + " " + want; got != want {
+		t.Errorf("format() = %q, want %q", got, want)
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer pc.Close()
+
+	cfg := &Config{
+		Syslog: &ConfigSyslog{
+			Address:  pc.LocalAddr().String(),
+			Hostname: "host1",
+		},
+	}
+	if err := cfg.Check(); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	w, err := newSyslogWriter(cfg.Syslog)
+	if err != nil {
+		t.Fatalf("newSyslogWriter: %v", err)
+	}
+	defer w.close()
+	w.Write([]byte("ERR hello\n"))
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if got, want := string(buf[:n]), "<27>1 "; !strings.HasPrefix(got, want) || !strings.HasSuffix(got, " host1 tlsproxy "+strconv.Itoa(w.pid)+" - - ERR hello") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSyslogTLS(t *testing.T) {
+	cm, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cm.TLSConfig())
+	if err != nil {
+		t.Fatalf("tls.Listen: %v", err)
+	}
+	defer ln.Close()
+	ch := make(chan string)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			size, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(size))
+			if err != nil {
+				t.Errorf("invalid frame size %q", size)
+				return
+			}
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			ch <- string(buf)
+		}
+	}()
+
+	cfg := &Config{
+		Syslog: &ConfigSyslog{
+			Network:    "tls",
+			Address:    ln.Addr().String(),
+			ServerName: "syslog.example.com",
+			RootCAs:    []string{cm.RootCAPEM()},
+			Facility:   "local7",
+			AppName:    "test",
+			Hostname:   "host1",
+		},
+	}
+	if err := cfg.Check(); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	w, err := newSyslogWriter(cfg.Syslog)
+	if err != nil {
+		t.Fatalf("newSyslogWriter: %v", err)
+	}
+	defer w.close()
+	w.Write([]byte("INF one\n"))
+	w.Write([]byte("ERR two\n"))
+
+	for _, want := range []string{"<190>1 * host1 test * - - INF one", "<187>1 * host1 test * - - ERR two"} {
+		select {
+		case got := <-ch:
+			gf, wf := strings.Fields(got), strings.Fields(want)
+			if len(gf) != len(wf) {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+			for i := range wf {
+				if wf[i] != "*" && wf[i] != gf[i] {
+					t.Errorf("got %q, want %q", got, want)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+}
+
+func TestSyslogConfig(t *testing.T) {
+	cfg := &Config{
+		Syslog: &ConfigSyslog{
+			Network: "tls",
+			Address: "syslog.example.com",
+		},
+	}
+	if err := cfg.Check(); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if got, want := cfg.Syslog.Address, "syslog.example.com:6514"; got != want {
+		t.Errorf("Address = %q, want %q", got, want)
+	}
+	if got, want := cfg.Syslog.Facility, "daemon"; got != want {
+		t.Errorf("Facility = %q, want %q", got, want)
+	}
+
+	for _, sl := range []*ConfigSyslog{
+		{Network: "http", Address: "syslog.example.com"},
+		{Network: "udp"},
+		{Address: "syslog.example.com", Facility: "foo"},
+		{Address: "syslog.example.com", RootCAs: []string{"foo"}},
+	} {
+		cfg := &Config{Syslog: sl}
+		if err := cfg.Check(); err == nil {
+			t.Errorf("Check(%+v) succeeded unexpectedly", sl)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build tailscale
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"tailscale.com/tsnet"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+const tailscaleIsEnabled = true
+
+// tailscaleNode is the proxy's node on the tailnet.
+type tailscaleNode struct {
+	srv *tsnet.Server
+}
+
+func newTailscaleNode(cfg *ConfigTailscale) (*tailscaleNode, error) {
+	srv := &tsnet.Server{
+		Hostname:   cfg.Hostname,
+		Dir:        cfg.StateDir,
+		ControlURL: cfg.ControlURL,
+		Ephemeral:  cfg.Ephemeral,
+		// The backend logs are very verbose. Only the messages intended
+		// for the user, e.g. the authorization URL, are logged.
+		Logf: func(string, ...any) {},
+		UserLogf: func(format string, args ...any) {
+			log.Printf("INF Tailscale: "+format, args...)
+		},
+	}
+	if cfg.AuthKeyFile != "" {
+		b, err := os.ReadFile(cfg.AuthKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Tailscale.AuthKeyFile: %w", err)
+		}
+		srv.AuthKey = strings.TrimSpace(string(b))
+	}
+	if err := os.MkdirAll(cfg.StateDir, 0o700); err != nil {
+		return nil, fmt.Errorf("Tailscale.StateDir: %w", err)
+	}
+	return &tailscaleNode{srv: srv}, nil
+}
+
+// listen returns a listener that receives TCP connections from the tailnet
+// on addr, e.g. :443. The node is started if it wasn't already.
+func (n *tailscaleNode) listen(addr string) (net.Listener, error) {
+	l, err := n.srv.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return netw.NewListener(l), nil
+}
+
+// dial opens a TCP connection to addr on the tailnet. addr can be a MagicDNS
+// name or a tailnet IP address.
+func (n *tailscaleNode) dial(ctx context.Context, addr string) (net.Conn, error) {
+	return n.srv.Dial(ctx, "tcp", addr)
+}
+
+func (n *tailscaleNode) close() error {
+	return n.srv.Close()
+}
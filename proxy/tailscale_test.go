@@ -0,0 +1,89 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestTailscaleConfig(t *testing.T) {
+	newCfg := func(ts *ConfigTailscale, mode string, addrs ...string) *Config {
+		return &Config{
+			CacheDir:  t.TempDir(),
+			Tailscale: ts,
+			Listeners: []*ConfigListener{{
+				Address:  "tailscale+:443",
+				Backends: []string{"db"},
+			}},
+			Backends: []*Backend{{
+				Name:        "db",
+				ServerNames: []string{"example.com"},
+				Mode:        mode,
+				Addresses:   addrs,
+			}},
+		}
+	}
+
+	if err := newCfg(nil, ModeTCP, "192.168.0.1:80").Check(); err == nil {
+		t.Error("Check() with tailnet listener and without Tailscale should fail")
+	}
+	cfg := newCfg(nil, ModeTCP, "tailscale+db.example.ts.net:5432")
+	cfg.Listeners = nil
+	if err := cfg.Check(); err == nil {
+		t.Error("Check() with tailnet address and without Tailscale should fail")
+	}
+
+	cfg = newCfg(&ConfigTailscale{}, ModeTCP, "tailscale+db.example.ts.net:5432")
+	err := cfg.Check()
+	if !tailscaleIsEnabled {
+		if err == nil {
+			t.Error("Check() should fail when Tailscale isn't enabled")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Check() = %v", err)
+	}
+	if got, want := cfg.Tailscale.Hostname, defaultTailscaleHostname; got != want {
+		t.Errorf("Hostname = %q, want %q", got, want)
+	}
+	if got, want := cfg.Tailscale.StateDir, filepath.Join(cfg.CacheDir, "tailscale"); got != want {
+		t.Errorf("StateDir = %q, want %q", got, want)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		mode  string
+		addrs []string
+	}{
+		{"no port", ModeTCP, []string{"tailscale+db.example.ts.net"}},
+		{"no host", ModeTCP, []string{"tailscale+:5432"}},
+		{"quic", ModeQUIC, []string{"tailscale+db.example.ts.net:5432"}},
+	} {
+		if err := newCfg(&ConfigTailscale{}, tc.mode, tc.addrs...).Check(); err == nil {
+			t.Errorf("%s: Check() should fail", tc.name)
+		}
+	}
+}
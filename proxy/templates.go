@@ -0,0 +1,109 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+)
+
+// pageTemplates are the templates of the pages that the proxy serves itself.
+// The passkey templates are nil when the built-in ones are used.
+type pageTemplates struct {
+	login            *template.Template
+	logout           *template.Template
+	permissionDenied *template.Template
+	ssoStatus        *template.Template
+	style            []byte
+	passkeyAuth      *template.Template
+	passkeyManage    *template.Template
+	passkeyAdmin     *template.Template
+	errorPage        *template.Template
+}
+
+func defaultPageTemplates() *pageTemplates {
+	return &pageTemplates{
+		login:            loginTemplate,
+		logout:           logoutTemplate,
+		permissionDenied: permissionDeniedTemplate,
+		ssoStatus:        ssoStatusTemplate,
+		style:            styleEmbed,
+	}
+}
+
+// loadPageTemplates reads the templates in dir. The built-in templates are
+// used for the files that don't exist.
+func loadPageTemplates(dir string) (*pageTemplates, error) {
+	t := defaultPageTemplates()
+	if dir == "" {
+		return t, nil
+	}
+	for _, f := range []struct {
+		file string
+		name string
+		tmpl **template.Template
+	}{
+		{"login.html", "login", &t.login},
+		{"logout.html", "logout", &t.logout},
+		{"permission-denied.html", "permission-denied", &t.permissionDenied},
+		{"sso-status.html", "sso-status", &t.ssoStatus},
+		{"passkey-auth.html", "passkey-auth", &t.passkeyAuth},
+		{"passkey-manage.html", "passkey-manage", &t.passkeyManage},
+		{"passkey-admin.html", "passkey-admin", &t.passkeyAdmin},
+		{"error-page.html", "error-page", &t.errorPage},
+	} {
+		b, err := os.ReadFile(filepath.Join(dir, f.file))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(f.name).Parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.file, err)
+		}
+		*f.tmpl = tmpl
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "style.css"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		t.style = b
+	}
+	return t, nil
+}
+
+// pageTemplates returns the templates of the pages that the backend serves
+// itself.
+func (be *Backend) pageTemplates() *pageTemplates {
+	if be.templates == nil {
+		return defaultPageTemplates()
+	}
+	return be.templates
+}
@@ -0,0 +1,76 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPageTemplates(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"logout.html":     "<h1>ACME Corp</h1>{{if .Everywhere}}everywhere{{end}}",
+		"style.css":       "body { color: red; }",
+		"error-page.html": "<h1>Oops {{.Status}}</h1>",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	tmpl, err := loadPageTemplates(dir)
+	if err != nil {
+		t.Fatalf("loadPageTemplates: %v", err)
+	}
+	if tmpl.login != loginTemplate {
+		t.Error("login template isn't the built-in one")
+	}
+	if tmpl.passkeyAuth != nil {
+		t.Error("passkeyAuth template is set")
+	}
+	if tmpl.errorPage == nil {
+		t.Error("errorPage template isn't set")
+	}
+
+	be := &Backend{templates: tmpl}
+	rec := httptest.NewRecorder()
+	be.serveSSOStyle(rec, httptest.NewRequest("GET", "/.sso/style.css", nil))
+	if got, want := rec.Body.String(), "body { color: red; }"; got != want {
+		t.Errorf("style = %q, want %q", got, want)
+	}
+	rec = httptest.NewRecorder()
+	be.serveLogout(rec, httptest.NewRequest("POST", "/.sso/logout", nil))
+	if got, want := rec.Body.String(), "<h1>ACME Corp</h1>"; got != want {
+		t.Errorf("logout = %q, want %q", got, want)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "login.html"), []byte("{{.Foo"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := loadPageTemplates(dir); err == nil {
+		t.Error("loadPageTemplates() with invalid template succeeded")
+	}
+}
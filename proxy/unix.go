@@ -40,3 +40,12 @@ func openFileLimit() (int, error) {
 	}
 	return int(rl.Cur), nil
 }
+
+// currentOpenFileLimit returns the current limit of open files.
+func currentOpenFileLimit() (int, error) {
+	var rl unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, err
+	}
+	return int(rl.Cur), nil
+}
@@ -92,6 +92,13 @@ func connProto(c anyConn) string {
 	return ""
 }
 
+func connID(c anyConn) string {
+	if v, ok := annotatedConn(c).Annotation(connIDKey, "").(string); ok {
+		return v
+	}
+	return ""
+}
+
 func connECHAccepted(c anyConn) bool {
 	v, _ := annotatedConn(c).Annotation(echAcceptedKey, false).(bool)
 	return v
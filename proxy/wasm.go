@@ -0,0 +1,350 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+const (
+	defaultPluginMaxBodySize = 1 << 20
+	defaultPluginTimeout     = time.Second
+)
+
+type pluginCtxKeyType struct{}
+
+var pluginCtxKey pluginCtxKeyType
+
+// wasmRuntime compiles and runs the WebAssembly plugins.
+type wasmRuntime struct {
+	rt      wazero.Runtime
+	modules map[[32]byte]*wasmPlugin
+}
+
+// wasmPlugin is a compiled WebAssembly plugin.
+type wasmPlugin struct {
+	rt         wazero.Runtime
+	mod        wazero.CompiledModule
+	onRequest  bool
+	onResponse bool
+}
+
+// pluginInput is the input of the on_request and on_response functions.
+type pluginInput struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	RemoteAddr string      `json:"remoteAddr"`
+	User       string      `json:"user,omitempty"`
+	Header     http.Header `json:"header"`
+	Status     int         `json:"status,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+	Config     string      `json:"config,omitempty"`
+}
+
+// pluginOutput is the output of the on_request and on_response functions.
+type pluginOutput struct {
+	Action       string      `json:"action,omitempty"`
+	Status       int         `json:"status,omitempty"`
+	SetHeader    http.Header `json:"setHeader,omitempty"`
+	DeleteHeader []string    `json:"deleteHeader,omitempty"`
+	Body         *[]byte     `json:"body,omitempty"`
+}
+
+func newWASMRuntime(ctx context.Context) (*wasmRuntime, error) {
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	if _, err := rt.NewHostModuleBuilder("tlsproxy").
+		NewFunctionBuilder().WithFunc(pluginLog).Export("log").
+		Instantiate(ctx); err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	return &wasmRuntime{
+		rt:      rt,
+		modules: make(map[[32]byte]*wasmPlugin),
+	}, nil
+}
+
+// pluginLog implements the log function that the plugins can import.
+func pluginLog(ctx context.Context, m api.Module, ptr, size uint32) {
+	b, ok := m.Memory().Read(ptr, size)
+	if !ok {
+		return
+	}
+	if be, ok := ctx.Value(pluginCtxKey).(*Backend); ok {
+		be.logErrorF("INF Plugin: %s", b)
+	}
+}
+
+// compile compiles a WebAssembly module, or returns the one that was already
+// compiled from the same code.
+func (w *wasmRuntime) compile(ctx context.Context, code []byte) (*wasmPlugin, error) {
+	key := sha256.Sum256(code)
+	if wp, ok := w.modules[key]; ok {
+		return wp, nil
+	}
+	mod, err := w.rt.CompileModule(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	funcs := mod.ExportedFunctions()
+	wp := &wasmPlugin{
+		rt:         w.rt,
+		mod:        mod,
+		onRequest:  funcs["on_request"] != nil,
+		onResponse: funcs["on_response"] != nil,
+	}
+	if _, ok := mod.ExportedMemories()["memory"]; !ok || funcs["malloc"] == nil || (!wp.onRequest && !wp.onResponse) {
+		mod.Close(ctx)
+		return nil, errors.New("module must export memory, malloc, and on_request or on_response")
+	}
+	w.modules[key] = wp
+	return wp, nil
+}
+
+// prune closes the compiled modules that are no longer used by backends,
+// after giving the in-flight calls some time to finish.
+func (w *wasmRuntime) prune(backends []*Backend) {
+	inUse := make(map[*wasmPlugin]bool)
+	for _, be := range backends {
+		for _, pl := range be.WASMPlugins {
+			inUse[pl.plugin] = true
+		}
+	}
+	for key, wp := range w.modules {
+		if inUse[wp] {
+			continue
+		}
+		delete(w.modules, key)
+		time.AfterFunc(time.Minute, func() {
+			wp.mod.Close(context.Background())
+		})
+	}
+}
+
+func (w *wasmRuntime) close() {
+	w.rt.Close(context.Background())
+}
+
+// call calls one of the plugin's functions with a new instance of the
+// module.
+func (pl *WASMPlugin) call(ctx context.Context, fn string, in *pluginInput) (*pluginOutput, error) {
+	ctx, cancel := context.WithTimeout(ctx, pl.Timeout)
+	defer cancel()
+
+	wp := pl.plugin
+	mod, err := wp.rt.InstantiateModule(ctx, wp.mod, wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, err
+	}
+	defer mod.Close(context.Background())
+
+	in.Config = pl.Config
+	b, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	res, err := mod.ExportedFunction("malloc").Call(ctx, uint64(len(b)))
+	if err != nil {
+		return nil, fmt.Errorf("malloc: %w", err)
+	}
+	if len(res) != 1 || !mod.Memory().Write(uint32(res[0]), b) {
+		return nil, errors.New("malloc: invalid pointer")
+	}
+	if res, err = mod.ExportedFunction(fn).Call(ctx, res[0], uint64(len(b))); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	var out pluginOutput
+	if len(res) != 1 || res[0] == 0 {
+		return &out, nil
+	}
+	ob, ok := mod.Memory().Read(uint32(res[0]>>32), uint32(res[0]))
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid output location", fn)
+	}
+	if err := json.Unmarshal(ob, &out); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	if out.Action != "" && out.Action != "continue" && out.Action != "respond" {
+		return nil, fmt.Errorf("%s: invalid action %q", fn, out.Action)
+	}
+	if out.Status == 0 {
+		out.Status = http.StatusOK
+	}
+	if out.Status < 100 || out.Status > 999 {
+		return nil, fmt.Errorf("%s: invalid status %d", fn, out.Status)
+	}
+	return &out, nil
+}
+
+// readBody reads the body for the plugin, when needed. It returns the body to
+// forward.
+func (pl *WASMPlugin) readBody(in *pluginInput, body io.ReadCloser) (io.ReadCloser, error) {
+	if !pl.Bodies || body == nil || body == http.NoBody {
+		return body, nil
+	}
+	b, err := io.ReadAll(io.LimitReader(body, pl.MaxBodySize+1))
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	if int64(len(b)) <= pl.MaxBodySize {
+		in.Body = b
+	}
+	return readCloser{io.MultiReader(bytes.NewReader(b), body), body}, nil
+}
+
+func (out *pluginOutput) applyHeader(h http.Header) {
+	for _, k := range out.DeleteHeader {
+		h.Del(k)
+	}
+	for k, v := range out.SetHeader {
+		h[http.CanonicalHeaderKey(k)] = v
+	}
+}
+
+func (be *Backend) pluginInput(req *http.Request, header http.Header, status int) *pluginInput {
+	url, _ := req.Context().Value(ctxURLKey).(string)
+	email, _ := claimsFromCtx(req.Context())["email"].(string)
+	return &pluginInput{
+		Method:     req.Method,
+		URL:        url,
+		RemoteAddr: req.RemoteAddr,
+		User:       email,
+		Header:     header,
+		Status:     status,
+	}
+}
+
+// runRequestPlugins calls the on_request function of the backend's plugins.
+// It returns false when the request should not be processed any further.
+func (be *Backend) runRequestPlugins(w http.ResponseWriter, req *http.Request) bool {
+	ctx := context.WithValue(req.Context(), pluginCtxKey, be)
+	for _, pl := range be.WASMPlugins {
+		if !pathMatches(pl.Paths, req.URL.Path) {
+			continue
+		}
+		if pl.Bodies && pl.plugin.onResponse {
+			req.Header.Del("Accept-Encoding")
+		}
+		if !pl.plugin.onRequest {
+			continue
+		}
+		in := be.pluginInput(req, req.Header, 0)
+		body, err := pl.readBody(in, req.Body)
+		if err != nil {
+			be.logErrorF("ERR [-] %s: plugin %s: %v", req.RemoteAddr, pl.Module, err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return false
+		}
+		req.Body = body
+		out, err := pl.call(ctx, "on_request", in)
+		if err != nil {
+			be.recordEvent("plugin error")
+			be.logErrorF("ERR [-] %s: plugin %s: %v", req.RemoteAddr, pl.Module, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return false
+		}
+		if out.Action == "respond" {
+			be.recordEvent("plugin response")
+			out.applyHeader(w.Header())
+			var b []byte
+			if out.Body != nil {
+				b = *out.Body
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+			w.WriteHeader(out.Status)
+			w.Write(b)
+			return false
+		}
+		out.applyHeader(req.Header)
+		if out.Body != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			req.Body = io.NopCloser(bytes.NewReader(*out.Body))
+			req.ContentLength = int64(len(*out.Body))
+		}
+	}
+	return true
+}
+
+// runResponsePlugins calls the on_response function of the backend's
+// plugins.
+func (be *Backend) runResponsePlugins(resp *http.Response) error {
+	req := resp.Request
+	ctx := context.WithValue(req.Context(), pluginCtxKey, be)
+	for _, pl := range be.WASMPlugins {
+		if !pl.plugin.onResponse || !pathMatches(pl.Paths, req.URL.Path) {
+			continue
+		}
+		in := be.pluginInput(req, resp.Header, resp.StatusCode)
+		body, err := pl.readBody(in, resp.Body)
+		if err != nil {
+			return fmt.Errorf("plugin %s: %w", pl.Module, err)
+		}
+		resp.Body = body
+		out, err := pl.call(ctx, "on_response", in)
+		if err != nil {
+			be.recordEvent("plugin error")
+			return fmt.Errorf("plugin %s: %w", pl.Module, err)
+		}
+		if out.Action == "respond" {
+			be.recordEvent("plugin response")
+			resp.StatusCode = out.Status
+			resp.Status = fmt.Sprintf("%d %s", out.Status, http.StatusText(out.Status))
+			resp.Header = http.Header{}
+			if out.Body == nil {
+				out.Body = &[]byte{}
+			}
+		}
+		out.applyHeader(resp.Header)
+		if out.Body != nil {
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+			resp.Body = io.NopCloser(bytes.NewReader(*out.Body))
+			resp.ContentLength = int64(len(*out.Body))
+			resp.Header.Set("Content-Length", strconv.Itoa(len(*out.Body)))
+			resp.Header.Del("Content-Encoding")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWASMPlugins(t *testing.T) {
+	ctx := context.Background()
+	rt, err := newWASMRuntime(ctx)
+	if err != nil {
+		t.Fatalf("newWASMRuntime: %v", err)
+	}
+	defer rt.close()
+
+	if _, err := rt.compile(ctx, []byte("not wasm")); err == nil {
+		t.Error("compile() succeeded unexpectedly")
+	}
+	newBackend := func(reqOut, respOut string) *Backend {
+		wp, err := rt.compile(ctx, testWASMModule(reqOut, respOut))
+		if err != nil {
+			t.Fatalf("compile: %v", err)
+		}
+		return &Backend{
+			Mode: ModeHTTP,
+			WASMPlugins: []*WASMPlugin{{
+				Module:      "test.wasm",
+				Bodies:      true,
+				MaxBodySize: defaultPluginMaxBodySize,
+				Timeout:     defaultPluginTimeout,
+				plugin:      wp,
+			}},
+			recordEvent: func(string) {},
+		}
+	}
+
+	// Modify the request and the response.
+	be := newBackend(
+		`{"setHeader":{"X-Plugin":["yes"]},"deleteHeader":["X-Secret"]}`,
+		`{"setHeader":{"X-Resp":["1"]},"body":"bmV3"}`,
+	)
+	req := httptest.NewRequest("POST", "/", strings.NewReader("hello"))
+	req.Header.Set("X-Secret", "foo")
+	if !be.runRequestPlugins(httptest.NewRecorder(), req) {
+		t.Fatal("runRequestPlugins() = false, want true")
+	}
+	if got, want := req.Header.Get("X-Plugin"), "yes"; got != want {
+		t.Errorf("X-Plugin = %q, want %q", got, want)
+	}
+	if got := req.Header.Get("X-Secret"); got != "" {
+		t.Errorf("X-Secret = %q, want empty", got)
+	}
+	if b, _ := io.ReadAll(req.Body); string(b) != "hello" {
+		t.Errorf("Body = %q, want %q", b, "hello")
+	}
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/plain"}},
+		Body:       io.NopCloser(strings.NewReader("old")),
+		Request:    httptest.NewRequest("GET", "/", nil),
+	}
+	if err := be.runResponsePlugins(resp); err != nil {
+		t.Fatalf("runResponsePlugins: %v", err)
+	}
+	if got, want := resp.Header.Get("X-Resp"), "1"; got != want {
+		t.Errorf("X-Resp = %q, want %q", got, want)
+	}
+	if b, _ := io.ReadAll(resp.Body); string(b) != "new" || resp.ContentLength != 3 {
+		t.Errorf("Body = %q (%d), want %q (3)", b, resp.ContentLength, "new")
+	}
+
+	// Respond directly.
+	be = newBackend(`{"action":"respond","status":418,"body":"dGVhcG90"}`, "")
+	rec := httptest.NewRecorder()
+	if be.runRequestPlugins(rec, httptest.NewRequest("GET", "/", nil)) {
+		t.Fatal("runRequestPlugins() = true, want false")
+	}
+	if rec.Code != 418 || rec.Body.String() != "teapot" {
+		t.Errorf("Response = %d %q, want 418 %q", rec.Code, rec.Body.String(), "teapot")
+	}
+
+	// Invalid output.
+	be = newBackend(`{"action":"explode"}`, "")
+	rec = httptest.NewRecorder()
+	if be.runRequestPlugins(rec, httptest.NewRequest("GET", "/", nil)) {
+		t.Fatal("runRequestPlugins() = true, want false")
+	}
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Code = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+
+	// Unused modules are closed.
+	rt.prune(nil)
+	if len(rt.modules) != 0 {
+		t.Errorf("len(modules) = %d, want 0", len(rt.modules))
+	}
+}
+
+// testWASMModule returns a WebAssembly module whose on_request and
+// on_response functions return reqOut and respOut, respectively.
+func testWASMModule(reqOut, respOut string) []byte {
+	result := func(offset int64, out string) []byte {
+		var v int64
+		if out != "" {
+			v = offset<<32 | int64(len(out))
+		}
+		return slices.Concat([]byte{0x00, 0x42}, sleb128(v), []byte{0x0b})
+	}
+	data := func(offset int64, out string) []byte {
+		return slices.Concat([]byte{0x00, 0x41}, sleb128(offset), []byte{0x0b}, wasmName(out))
+	}
+	return slices.Concat(
+		[]byte("\x00asm\x01\x00\x00\x00"),
+		// (i32) -> i32, (i32, i32) -> i64
+		wasmSection(1, []byte{0x60, 0x01, 0x7f, 0x01, 0x7f}, []byte{0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e}),
+		wasmSection(3, []byte{0}, []byte{1}, []byte{1}),
+		// 1 page of memory.
+		wasmSection(5, []byte{0x00, 0x01}),
+		// The heap pointer, starting at 4096.
+		wasmSection(6, slices.Concat([]byte{0x7f, 0x01, 0x41}, sleb128(4096), []byte{0x0b})),
+		wasmSection(7,
+			append(wasmName("memory"), 0x02, 0x00),
+			append(wasmName("malloc"), 0x00, 0x00),
+			append(wasmName("on_request"), 0x00, 0x01),
+			append(wasmName("on_response"), 0x00, 0x02),
+		),
+		wasmSection(10,
+			// global.get 0, global.get 0, local.get 0, i32.add, global.set 0
+			wasmName("\x00\x23\x00\x23\x00\x20\x00\x6a\x24\x00\x0b"),
+			wasmName(string(result(1024, reqOut))),
+			wasmName(string(result(2048, respOut))),
+		),
+		wasmSection(11, data(1024, reqOut), data(2048, respOut)),
+	)
+}
+
+func wasmSection(id byte, items ...[]byte) []byte {
+	content := slices.Concat(append([][]byte{uleb128(uint64(len(items)))}, items...)...)
+	return slices.Concat([]byte{id}, uleb128(uint64(len(content))), content)
+}
+
+func wasmName(s string) []byte {
+	return append(uleb128(uint64(len(s))), s...)
+}
+
+func uleb128(v uint64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+func sleb128(v int64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
@@ -0,0 +1,68 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// callWebHooks sends a POST request with body to each webhook, retrying
+// transient errors for up to 5 minutes. A non-nil body is sent as JSON.
+func (p *Proxy) callWebHooks(ctx context.Context, desc string, webhooks []string, body []byte) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	client := retryablehttp.NewClient()
+	client.Logger = nil
+	client.HTTPClient.Transport = http.DefaultTransport
+	for _, wh := range webhooks {
+		var rawBody any
+		if body != nil {
+			rawBody = body
+		}
+		req, err := retryablehttp.NewRequestWithContext(ctx, "POST", wh, rawBody)
+		if err != nil {
+			p.logErrorF("ERR %s WebHook %q: %v", desc, wh, err)
+			continue
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			p.logErrorF("ERR %s WebHook %q: %v", desc, wh, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			p.logErrorF("ERR %s WebHook %q: status code %d", desc, wh, resp.StatusCode)
+		}
+	}
+}
@@ -59,7 +59,7 @@ func (p *Proxy) webSocketHandler(cfg WebSocketConfig) http.Handler {
 			p.logErrorF("ERR webSocketHandler: %v", err)
 			return
 		}
-		setKeepAlive(out)
+		setTCPOptions(out, nil)
 		wc := netw.NewConn(out)
 		wc.SetAnnotation(startTimeKey, time.Now())
 		if conn, ok := req.Context().Value(connCtxKey).(anyConn); ok {
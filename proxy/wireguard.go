@@ -0,0 +1,207 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build wireguard
+
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+const wireGuardIsEnabled = true
+
+// wireGuardTunnel is a WireGuard tunnel terminated with a userspace network
+// stack.
+type wireGuardTunnel struct {
+	// key is the tunnel's configuration. The tunnel is recreated when it
+	// changes.
+	key  string
+	dev  *device.Device
+	tnet *netstack.Net
+}
+
+// wireGuardTunnels returns the tunnels of cfg. The existing tunnels are reused
+// when their configuration hasn't changed.
+func (p *Proxy) wireGuardTunnels(cfg *Config) (map[string]*wireGuardTunnel, error) {
+	tunnels := make(map[string]*wireGuardTunnel, len(cfg.WireGuard))
+	closeNew := func() {
+		for name, t := range tunnels {
+			if p.wireGuard[name] != t {
+				t.close()
+			}
+		}
+	}
+	for _, wg := range cfg.WireGuard {
+		ipc, err := wg.ipcConfig()
+		if err != nil {
+			closeNew()
+			return nil, fmt.Errorf("WireGuard %q: %w", wg.Name, err)
+		}
+		key := fmt.Sprintf("%s|%v|%v|%d", ipc, wg.Addresses, wg.DNS, wg.MTU)
+		if t := p.wireGuard[wg.Name]; t != nil && t.key == key {
+			tunnels[wg.Name] = t
+			continue
+		}
+		t, err := newWireGuardTunnel(wg, ipc)
+		if err != nil {
+			closeNew()
+			return nil, fmt.Errorf("WireGuard %q: %w", wg.Name, err)
+		}
+		t.key = key
+		tunnels[wg.Name] = t
+	}
+	return tunnels, nil
+}
+
+// setWireGuardTunnels replaces the proxy's tunnels, and closes the ones that
+// are no longer used.
+func (p *Proxy) setWireGuardTunnels(tunnels map[string]*wireGuardTunnel) {
+	for name, t := range p.wireGuard {
+		if tunnels[name] != t {
+			t.close()
+		}
+	}
+	p.wireGuard = tunnels
+}
+
+func newWireGuardTunnel(cfg *ConfigWireGuard, ipc string) (*wireGuardTunnel, error) {
+	addrs := make([]netip.Addr, 0, len(cfg.Addresses))
+	for _, a := range cfg.Addresses {
+		addr, err := netip.ParseAddr(a)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	dns := make([]netip.Addr, 0, len(cfg.DNS))
+	for _, a := range cfg.DNS {
+		addr, err := netip.ParseAddr(a)
+		if err != nil {
+			return nil, err
+		}
+		dns = append(dns, addr)
+	}
+	tunDev, tnet, err := netstack.CreateNetTUN(addrs, dns, cfg.MTU)
+	if err != nil {
+		return nil, err
+	}
+	logger := &device.Logger{
+		Verbosef: device.DiscardLogf,
+		Errorf: func(format string, args ...any) {
+			log.Printf("ERR WireGuard %q: %s", cfg.Name, fmt.Sprintf(format, args...))
+		},
+	}
+	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), logger)
+	if err := dev.IpcSet(ipc); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return &wireGuardTunnel{dev: dev, tnet: tnet}, nil
+}
+
+// ipcConfig returns the device configuration in the format of the
+// cross-platform userspace API.
+func (cfg *ConfigWireGuard) ipcConfig() (string, error) {
+	var buf strings.Builder
+	key, err := readWireGuardKey(cfg.PrivateKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("PrivateKeyFile: %w", err)
+	}
+	fmt.Fprintf(&buf, "private_key=%s\n", key)
+	for i, p := range cfg.Peers {
+		pub, err := wireGuardKey(p.PublicKey)
+		if err != nil {
+			return "", fmt.Errorf("Peers[%d].PublicKey: %w", i, err)
+		}
+		fmt.Fprintf(&buf, "public_key=%s\n", pub)
+		if p.PresharedKeyFile != "" {
+			psk, err := readWireGuardKey(p.PresharedKeyFile)
+			if err != nil {
+				return "", fmt.Errorf("Peers[%d].PresharedKeyFile: %w", i, err)
+			}
+			fmt.Fprintf(&buf, "preshared_key=%s\n", psk)
+		}
+		if p.Endpoint != "" {
+			addr, err := net.ResolveUDPAddr("udp", p.Endpoint)
+			if err != nil {
+				return "", fmt.Errorf("Peers[%d].Endpoint: %w", i, err)
+			}
+			ap := addr.AddrPort()
+			fmt.Fprintf(&buf, "endpoint=%s\n", netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()))
+		}
+		if p.PersistentKeepalive > 0 {
+			fmt.Fprintf(&buf, "persistent_keepalive_interval=%d\n", int(p.PersistentKeepalive.Seconds()))
+		}
+		for _, a := range p.AllowedIPs {
+			fmt.Fprintf(&buf, "allowed_ip=%s\n", a)
+		}
+	}
+	return buf.String(), nil
+}
+
+func readWireGuardKey(name string) (string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return wireGuardKey(strings.TrimSpace(string(b)))
+}
+
+// wireGuardKey converts a base64 key, e.g. from wg genkey, to hex.
+func wireGuardKey(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	if len(b) != 32 {
+		return "", errors.New("invalid key length")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// dial opens a TCP connection to addr through the tunnel.
+func (t *wireGuardTunnel) dial(ctx context.Context, addr string) (net.Conn, error) {
+	return t.tnet.DialContext(ctx, "tcp", addr)
+}
+
+func (t *wireGuardTunnel) close() {
+	t.dev.Close()
+}
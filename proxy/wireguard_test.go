@@ -0,0 +1,232 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build wireguard
+
+package proxy
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+func TestWireGuardConfig(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := newWireGuardKey(t)
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte(priv+"\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	newCfg := func(f func(*ConfigWireGuard, *Backend)) *Config {
+		wg := &ConfigWireGuard{
+			Name:           "wg",
+			PrivateKeyFile: keyFile,
+			Addresses:      []string{"10.9.0.2"},
+			Peers: []*ConfigWireGuardPeer{{
+				PublicKey:  pub,
+				Endpoint:   "127.0.0.1:51820",
+				AllowedIPs: []string{"10.9.0.0/24"},
+			}},
+		}
+		be := &Backend{
+			ServerNames:   []string{"example.com"},
+			Mode:          ModeTCP,
+			Addresses:     []string{"10.9.0.1:80"},
+			DialWireGuard: "wg",
+		}
+		f(wg, be)
+		return &Config{
+			CacheDir:  dir,
+			WireGuard: []*ConfigWireGuard{wg},
+			Backends:  []*Backend{be},
+		}
+	}
+
+	cfg := newCfg(func(*ConfigWireGuard, *Backend) {})
+	if err := cfg.Check(); err != nil {
+		t.Fatalf("Check() = %v", err)
+	}
+	if got, want := cfg.WireGuard[0].MTU, 1420; got != want {
+		t.Errorf("MTU = %d, want %d", got, want)
+	}
+
+	for _, tc := range []struct {
+		name string
+		f    func(*ConfigWireGuard, *Backend)
+	}{
+		{"undefined tunnel", func(_ *ConfigWireGuard, be *Backend) { be.DialWireGuard = "foo" }},
+		{"quic", func(_ *ConfigWireGuard, be *Backend) { be.Mode = ModeQUIC }},
+		{"dial interface", func(_ *ConfigWireGuard, be *Backend) { be.DialInterface = "eth0" }},
+		{"no key file", func(wg *ConfigWireGuard, _ *Backend) { wg.PrivateKeyFile = "" }},
+		{"invalid address", func(wg *ConfigWireGuard, _ *Backend) { wg.Addresses = []string{"10.9.0.2/24"} }},
+		{"invalid public key", func(wg *ConfigWireGuard, _ *Backend) { wg.Peers[0].PublicKey = "foo" }},
+		{"invalid allowed ips", func(wg *ConfigWireGuard, _ *Backend) { wg.Peers[0].AllowedIPs = []string{"10.9.0.1"} }},
+		{"no peers", func(wg *ConfigWireGuard, _ *Backend) { wg.Peers = nil }},
+	} {
+		if err := newCfg(tc.f).Check(); err == nil {
+			t.Errorf("%s: Check() should fail", tc.name)
+		}
+	}
+}
+
+func TestWireGuardDial(t *testing.T) {
+	dir := t.TempDir()
+	proxyPriv, proxyPub := newWireGuardKey(t)
+	peerPriv, peerPub := newWireGuardKey(t)
+
+	// The remote network, with a TCP server at 10.9.0.1:80.
+	peerTun, peerNet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.9.0.1")}, nil, 1420)
+	if err != nil {
+		t.Fatalf("CreateNetTUN: %v", err)
+	}
+	peerDev := device.NewDevice(peerTun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelError, "peer: "))
+	defer peerDev.Close()
+	uc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	peerPort := uc.LocalAddr().(*net.UDPAddr).Port
+	uc.Close()
+	if err := peerDev.IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=%d\npublic_key=%s\nallowed_ip=10.9.0.2/32\n", hexKey(t, peerPriv), peerPort, hexKey(t, proxyPub))); err != nil {
+		t.Fatalf("IpcSet: %v", err)
+	}
+	if err := peerDev.Up(); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	l, err := peerNet.ListenTCP(&net.TCPAddr{IP: net.IPv4(10, 9, 0, 1), Port: 80})
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(c, "Hello from %s\n", c.RemoteAddr())
+			c.Close()
+		}
+	}()
+
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte(proxyPriv), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	cfg := &Config{
+		CacheDir: dir,
+		WireGuard: []*ConfigWireGuard{{
+			Name:           "wg",
+			PrivateKeyFile: keyFile,
+			Addresses:      []string{"10.9.0.2"},
+			Peers: []*ConfigWireGuardPeer{{
+				PublicKey:  peerPub,
+				Endpoint:   fmt.Sprintf("127.0.0.1:%d", peerPort),
+				AllowedIPs: []string{"10.9.0.0/24"},
+			}},
+		}},
+		Backends: []*Backend{{
+			ServerNames:    []string{"example.com"},
+			Mode:           ModeTCP,
+			Addresses:      []string{"10.9.0.1:80"},
+			DialWireGuard:  "wg",
+			ForwardTimeout: 10 * time.Second,
+		}},
+	}
+	if err := cfg.Check(); err != nil {
+		t.Fatalf("Check() = %v", err)
+	}
+	p := &Proxy{}
+	tunnels, err := p.wireGuardTunnels(cfg)
+	if err != nil {
+		t.Fatalf("wireGuardTunnels() = %v", err)
+	}
+	p.setWireGuardTunnels(tunnels)
+	defer p.setWireGuardTunnels(nil)
+
+	// The tunnel is reused when the config doesn't change.
+	tunnels2, err := p.wireGuardTunnels(cfg)
+	if err != nil {
+		t.Fatalf("wireGuardTunnels() = %v", err)
+	}
+	if tunnels2["wg"] != tunnels["wg"] {
+		t.Error("wireGuardTunnels() created a new tunnel")
+	}
+
+	be := cfg.Backends[0]
+	be.wireGuard = tunnels["wg"]
+	be.getClientCert = func(context.Context) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return nil
+	}
+	be.recordEvent = func(string) {}
+	be.outConns = newConnTracker()
+	be.draining = &p.draining
+	be.state = &backendState{}
+
+	c, err := be.dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if got, want := string(b), "Hello from 10.9.0.2:"; len(got) < len(want) || got[:len(want)] != want {
+		t.Errorf("Got %q, want %q...", got, want)
+	}
+}
+
+func newWireGuardKey(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(key.Bytes()), base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+}
+
+func hexKey(t *testing.T, key string) string {
+	t.Helper()
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		t.Fatalf("DecodeString: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
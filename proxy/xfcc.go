@@ -30,15 +30,29 @@ import (
 	"encoding/pem"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 )
 
 const xFCCHeader = "x-forwarded-client-cert"
 
-func addXFCCHeader(req *http.Request, which []string) {
+// envoyXFCCOrder is the order in which Envoy adds the fields to the XFCC
+// header.
+var envoyXFCCOrder = []string{"hash", "cert", "chain", "subject", "uri", "dns"}
+
+func addXFCCHeader(req *http.Request, which []string, format string) {
 	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
 		return
 	}
+	if format == "envoy" {
+		var ordered []string
+		for _, f := range envoyXFCCOrder {
+			if slices.ContainsFunc(which, func(w string) bool { return strings.EqualFold(w, f) }) {
+				ordered = append(ordered, f)
+			}
+		}
+		which = ordered
+	}
 	var fields []string
 	for _, f := range which {
 		switch strings.ToLower(f) {
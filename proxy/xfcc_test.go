@@ -24,6 +24,11 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/url"
 	"testing"
 )
 
@@ -63,3 +68,27 @@ func TestEncodeXFCCSubject(t *testing.T) {
 		}
 	}
 }
+
+func TestAddXFCCHeaderEnvoyOrder(t *testing.T) {
+	u, _ := url.Parse("spiffe://example.org/app")
+	cert := &x509.Certificate{
+		Raw:      []byte("cert"),
+		Subject:  pkix.Name{CommonName: "foo"},
+		URIs:     []*url.URL{u},
+		DNSNames: []string{"foo.example.org"},
+	}
+	req := &http.Request{
+		Header: http.Header{},
+		TLS:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+	}
+	which := []string{"dns", "uri", "Subject", "hash"}
+
+	addXFCCHeader(req, which, "")
+	if got, want := req.Header.Get(xFCCHeader), `DNS=foo.example.org;URI=spiffe%3A%2F%2Fexample.org%2Fapp;Subject="/CN=foo";Hash=06298432e8066b29e2223bcc23aa9504b56ae508fabf3435508869b9c3190e22`; got != want {
+		t.Errorf("XFCC = %q, want %q", got, want)
+	}
+	addXFCCHeader(req, which, "envoy")
+	if got, want := req.Header.Get(xFCCHeader), `Hash=06298432e8066b29e2223bcc23aa9504b56ae508fabf3435508869b9c3190e22;Subject="/CN=foo";URI=spiffe%3A%2F%2Fexample.org%2Fapp;DNS=foo.example.org`; got != want {
+		t.Errorf("XFCC = %q, want %q", got, want)
+	}
+}
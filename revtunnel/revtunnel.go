@@ -0,0 +1,380 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package revtunnel implements reverse tunnels between tlsproxy and agents
+// that run next to backend servers that can't receive connections, e.g.
+// behind NAT.
+//
+// The agent opens a TLS connection to the proxy with the backend's server
+// name and the ALPN protocol ALPNProto, and authenticates with a token. Then,
+// the roles are reversed: the proxy is the HTTP/2 client, and it opens one
+// CONNECT stream for each connection to the backend server. The agent
+// bridges the streams with connections to the local server, e.g.
+//
+//	a := &revtunnel.Agent{
+//		ProxyAddr:  "proxy.example.com:443",
+//		ServerName: "home.example.com",
+//		Token:      token,
+//		Target:     "localhost:8080",
+//	}
+//	err := a.Run(ctx)
+package revtunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	// ALPNProto is the ALPN protocol of the reverse tunnel connections.
+	ALPNProto = "tlsproxy-tunnel/1"
+
+	handshakeTimeout = 10 * time.Second
+	pingInterval     = 30 * time.Second
+	pingTimeout      = 15 * time.Second
+	maxTokenSize     = 1024
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrClosed       = errors.New("tunnel closed")
+)
+
+// Session is the proxy side of a reverse tunnel.
+type Session struct {
+	conn *closeNotifyConn
+	cc   *http2.ClientConn
+}
+
+// Accept authenticates the agent on conn, and returns a new Session. The
+// token must match the one sent by the agent.
+func Accept(conn net.Conn, token string) (*Session, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	br := bufio.NewReaderSize(io.LimitReader(conn, maxTokenSize), maxTokenSize)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if br.Buffered() > 0 {
+		return nil, errors.New("unexpected data after token")
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(line)), []byte(token)) != 1 {
+		io.WriteString(conn, "ERR unauthorized\n")
+		return nil, ErrUnauthorized
+	}
+	if _, err := io.WriteString(conn, "OK\n"); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	cn := &closeNotifyConn{Conn: conn, done: make(chan struct{})}
+	tr := &http2.Transport{
+		ReadIdleTimeout: pingInterval,
+		PingTimeout:     pingTimeout,
+	}
+	cc, err := tr.NewClientConn(cn)
+	if err != nil {
+		cn.Close()
+		return nil, err
+	}
+	return &Session{conn: cn, cc: cc}, nil
+}
+
+// Dial opens a new connection to the backend server through the tunnel.
+func (s *Session) Dial(ctx context.Context) (net.Conn, error) {
+	if !s.cc.CanTakeNewRequest() {
+		return nil, ErrClosed
+	}
+	pr, pw := io.Pipe()
+	// The stream's context must outlive ctx, which is only used for the
+	// dial.
+	sctx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	req, err := http.NewRequestWithContext(sctx, http.MethodConnect, "https://backend", pr)
+	if err != nil {
+		stop()
+		cancel()
+		return nil, err
+	}
+	resp, err := s.cc.RoundTrip(req)
+	if !stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("agent: %s", resp.Status)
+	}
+	stream := &streamConn{
+		r:      resp.Body,
+		w:      pw,
+		cancel: cancel,
+	}
+	// net.Pipe provides the deadlines that the stream doesn't have.
+	c1, c2 := net.Pipe()
+	go func() {
+		io.Copy(stream, c2)
+		stream.Close()
+	}()
+	go func() {
+		io.Copy(c2, stream)
+		c2.Close()
+	}()
+	return &addrConn{Conn: c1, local: s.conn.LocalAddr(), remote: s.conn.RemoteAddr()}, nil
+}
+
+// Done returns a channel that is closed when the session ends.
+func (s *Session) Done() <-chan struct{} {
+	return s.conn.done
+}
+
+// RemoteAddr returns the agent's address.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Close closes the session and all its connections.
+func (s *Session) Close() error {
+	return s.cc.Close()
+}
+
+// Agent is the backend side of a reverse tunnel.
+type Agent struct {
+	// ProxyAddr is the address of the proxy, e.g. proxy.example.com:443.
+	ProxyAddr string
+	// ServerName is the backend's server name.
+	ServerName string
+	// Token is the token used to authenticate with the proxy.
+	Token string
+	// Target is the address of the backend server, e.g. localhost:8080.
+	Target string
+	// TLSConfig is an optional TLS config to connect to the proxy, e.g.
+	// with RootCAs or client certificates.
+	TLSConfig *tls.Config
+	// Logf is used to log the agent's events. The default is log.Printf.
+	Logf func(format string, args ...any)
+}
+
+// Run connects to the proxy and serves the tunnel until ctx is canceled. The
+// connection is re-established when it fails.
+func (a *Agent) Run(ctx context.Context) error {
+	const (
+		minBackoff = time.Second
+		maxBackoff = time.Minute
+	)
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		err := a.serve(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrUnauthorized) {
+			return err
+		}
+		if time.Since(start) > maxBackoff {
+			backoff = minBackoff
+		}
+		a.logf("Tunnel to %s: %v, reconnecting in %s", a.ProxyAddr, err, backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+func (a *Agent) serve(ctx context.Context) error {
+	tc := &tls.Config{}
+	if a.TLSConfig != nil {
+		tc = a.TLSConfig.Clone()
+	}
+	tc.ServerName = a.ServerName
+	tc.NextProtos = []string{ALPNProto}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: handshakeTimeout},
+		Config:    tc,
+	}
+	c, err := dialer.DialContext(ctx, "tcp", a.ProxyAddr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if p := c.(*tls.Conn).ConnectionState().NegotiatedProtocol; p != ALPNProto {
+		return fmt.Errorf("unexpected protocol %q", p)
+	}
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	if _, err := io.WriteString(c, a.Token+"\n"); err != nil {
+		return err
+	}
+	// The proxy doesn't send anything after the response until the agent
+	// starts serving HTTP/2.
+	resp, err := bufio.NewReaderSize(c, 64).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if resp = strings.TrimSpace(resp); resp != "OK" {
+		if strings.HasPrefix(resp, "ERR unauthorized") {
+			return ErrUnauthorized
+		}
+		return fmt.Errorf("unexpected response %q", resp)
+	}
+	c.SetDeadline(time.Time{})
+	a.logf("Tunnel to %s established", a.ProxyAddr)
+
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+	srv := &http2.Server{
+		ReadIdleTimeout: pingInterval,
+		PingTimeout:     pingTimeout,
+	}
+	srv.ServeConn(c, &http2.ServeConnOpts{
+		Context: ctx,
+		Handler: http.HandlerFunc(a.handleStream),
+	})
+	return ErrClosed
+}
+
+func (a *Agent) handleStream(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodConnect {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var dialer net.Dialer
+	target, err := dialer.DialContext(req.Context(), "tcp", a.Target)
+	if err != nil {
+		a.logf("Dial %s: %v", a.Target, err)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(target, req.Body)
+		if tc, ok := target.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := target.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				break
+			}
+			if err := rc.Flush(); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	req.Body.Close()
+	wg.Wait()
+}
+
+func (a *Agent) logf(format string, args ...any) {
+	if a.Logf != nil {
+		a.Logf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// closeNotifyConn closes done when the connection is closed.
+type closeNotifyConn struct {
+	net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *closeNotifyConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// streamConn is a CONNECT stream.
+type streamConn struct {
+	r      io.ReadCloser
+	w      *io.PipeWriter
+	cancel context.CancelFunc
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *streamConn) Close() error {
+	c.w.Close()
+	c.r.Close()
+	c.cancel()
+	return nil
+}
+
+// addrConn overrides the addresses of a net.Pipe connection.
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,131 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package revtunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestTunnel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	l, err := tls.Listen("tcp", "localhost:0", &tls.Config{
+		GetCertificate: cm.GetCertificate,
+		NextProtos:     []string{ALPNProto},
+	})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	target, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			b := make([]byte, 5)
+			io.ReadFull(c, b)
+			io.WriteString(c, "Hello "+string(b))
+			c.Close()
+		}
+	}()
+
+	sessCh := make(chan *Session)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			sess, err := Accept(c, "secret")
+			if err != nil {
+				t.Logf("Accept: %v", err)
+				c.Close()
+				continue
+			}
+			sessCh <- sess
+		}
+	}()
+
+	agent := func(token string) *Agent {
+		return &Agent{
+			ProxyAddr:  l.Addr().String(),
+			ServerName: "tunnel.example.com",
+			Token:      token,
+			Target:     target.Addr().String(),
+			TLSConfig:  &tls.Config{RootCAs: cm.RootCACertPool()},
+			Logf:       t.Logf,
+		}
+	}
+	if err := agent("foo").Run(ctx); err != ErrUnauthorized {
+		t.Fatalf("Run() = %v, want %v", err, ErrUnauthorized)
+	}
+
+	agentCtx, agentCancel := context.WithCancel(ctx)
+	go agent("secret").Run(agentCtx)
+	sess := <-sessCh
+
+	for range 3 {
+		conn, err := sess.Dial(ctx)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		io.WriteString(conn, "world")
+		b, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		if got, want := string(b), "Hello world"; got != want {
+			t.Errorf("Got %q, want %q", got, want)
+		}
+		conn.Close()
+	}
+
+	agentCancel()
+	select {
+	case <-sess.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session not closed")
+	}
+	if _, err := sess.Dial(ctx); err == nil {
+		t.Error("Dial() on closed session should fail")
+	}
+}
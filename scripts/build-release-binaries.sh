@@ -39,5 +39,29 @@ for os in android darwin linux; do
     fi
   done
 done
+# tlsbench
+for os in darwin linux; do
+  for arch in amd64 arm64 arm; do
+    basename="bin/tlsbench-${os}-${arch}"
+    echo "Building ${basename}"
+    GOOS="${os}" GOARCH="${arch}" go build -a -trimpath "${flag}" -tags "${tags}" -o "${basename}" ./tlsbench
+    if [[ $? == 0 ]]; then
+      sha256sum "${basename}" | cut -d " " -f1 > "${basename}.sha256"
+      sign "${basename}"
+    fi
+  done
+done
+# tunnelagent
+for os in darwin linux; do
+  for arch in amd64 arm64 arm; do
+    basename="bin/tunnelagent-${os}-${arch}"
+    echo "Building ${basename}"
+    GOOS="${os}" GOARCH="${arch}" go build -a -trimpath "${flag}" -tags "${tags}" -o "${basename}" ./tunnelagent
+    if [[ $? == 0 ]]; then
+      sha256sum "${basename}" | cut -d " " -f1 > "${basename}.sha256"
+      sign "${basename}"
+    fi
+  done
+done
 
 ls -l bin/
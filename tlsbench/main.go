@@ -0,0 +1,377 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Command tlsbench opens many concurrent TLS or QUIC connections to a server,
+// e.g. tlsproxy, and reports the handshake latency, the throughput, and the
+// distribution of errors. It is intended for capacity testing.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c2FmZQ/ech/quic"
+)
+
+// Version is set with -ldflags="-X main.Version=${VERSION}"
+var Version = "dev"
+
+func main() {
+	versionFlag := flag.Bool("v", false, "Show the version.")
+	concurrency := flag.Int("c", 10, "The number of concurrent connections.")
+	count := flag.Int("n", 100, "The total number of connections. With -duration, 0 means no limit.")
+	duration := flag.Duration("duration", 0, "How long to run the test. By default, the test runs until -n connections are done.")
+	timeout := flag.Duration("timeout", 10*time.Second, "The timeout of each connection.")
+	alpn := flag.String("alpn", "", "The ALPN proto to request.")
+	echFlag := flag.String("ech", "", "Use this ECH ConfigList.")
+	useQUIC := flag.Bool("quic", false, "Use QUIC.")
+	serverName := flag.String("servername", "", "The server name to send. The default is the target's host name.")
+	insecure := flag.Bool("insecure", false, "Don't verify the server's certificate.")
+	payloadSize := flag.Int("payload", 0, "The number of bytes to send on each connection. With 0, only the handshake is done.")
+	pattern := flag.String("pattern", "zero", "The payload pattern: zero, random, or text.")
+	echo := flag.Bool("echo", false, "Expect the server to echo the payload back.")
+	flag.Parse()
+
+	if *versionFlag {
+		os.Stdout.WriteString(Version + " " + runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH + "\n")
+		return
+	}
+	if flag.NArg() != 1 || *concurrency <= 0 || *count < 0 || (*count == 0 && *duration <= 0) {
+		os.Stderr.WriteString("Usage: tlsbench [-c=<concurrency>] [-n=<count>] [-duration=<duration>] [-payload=<size>] [-pattern=zero|random|text] [-echo] [-alpn=<proto>] [-ech=<configlist>] [-quic] host:port\n")
+		os.Exit(1)
+	}
+	payload, err := makePayload(*pattern, *payloadSize)
+	if err != nil {
+		log.Fatalf("ERR: %v", err)
+	}
+
+	addr := flag.Arg(0)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		port = "443"
+	}
+	if *serverName == "" {
+		*serverName = host
+	}
+	tc := &tls.Config{
+		ServerName:         *serverName,
+		InsecureSkipVerify: *insecure,
+	}
+	if *alpn != "" {
+		tc.NextProtos = []string{*alpn}
+	}
+	if *echFlag != "" {
+		configList, err := base64.StdEncoding.DecodeString(*echFlag)
+		if err != nil {
+			log.Fatalf("ERR: --ech decoding error: %v", err)
+		}
+		tc.EncryptedClientHelloConfigList = configList
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if *duration > 0 {
+		var c context.CancelFunc
+		ctx, c = context.WithTimeout(ctx, *duration)
+		defer c()
+	}
+
+	b := &bench{
+		target:  net.JoinHostPort(host, port),
+		tc:      tc,
+		quic:    *useQUIC,
+		timeout: *timeout,
+		payload: payload,
+		echo:    *echo,
+		errors:  make(map[string]int),
+	}
+	fmt.Fprintf(os.Stderr, "Running against %s with %d concurrent connections\n", b.target, *concurrency)
+	start := time.Now()
+	b.run(ctx, *concurrency, *count)
+	b.report(os.Stdout, time.Since(start))
+}
+
+func makePayload(pattern string, size int) ([]byte, error) {
+	if size < 0 {
+		return nil, errors.New("invalid payload size")
+	}
+	b := make([]byte, size)
+	switch pattern {
+	case "zero":
+	case "random":
+		rand.Read(b)
+	case "text":
+		const text = "The quick brown fox jumps over the lazy dog.\n"
+		for i := range b {
+			b[i] = text[i%len(text)]
+		}
+	default:
+		return nil, fmt.Errorf("invalid payload pattern %q", pattern)
+	}
+	return b, nil
+}
+
+type bench struct {
+	target  string
+	tc      *tls.Config
+	quic    bool
+	timeout time.Duration
+	payload []byte
+	echo    bool
+
+	sent     atomic.Int64
+	received atomic.Int64
+
+	mu         sync.Mutex
+	handshakes []time.Duration
+	durations  []time.Duration
+	errors     map[string]int
+}
+
+func (b *bench) run(ctx context.Context, concurrency, count int) {
+	var remaining atomic.Int64
+	remaining.Store(int64(count))
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if count > 0 && remaining.Add(-1) < 0 {
+					return
+				}
+				b.once(ctx)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// once opens one connection, sends the payload, and reads the response.
+func (b *bench) once(parent context.Context) {
+	ctx, cancel := context.WithTimeout(parent, b.timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := b.dial(ctx)
+	if err != nil {
+		if parent.Err() != nil {
+			// The test is over.
+			return
+		}
+		b.recordError("handshake", err)
+		return
+	}
+	defer conn.Close()
+	hsTime := time.Since(start)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if len(b.payload) > 0 {
+		n, err := conn.Write(b.payload)
+		b.sent.Add(int64(n))
+		if err != nil {
+			b.recordError("write", err)
+			return
+		}
+	}
+	if !b.echo {
+		conn.CloseWrite()
+	}
+	var r io.Reader = conn
+	if b.echo {
+		r = io.LimitReader(conn, int64(len(b.payload)))
+	}
+	n, err := io.Copy(io.Discard, r)
+	b.received.Add(n)
+	if err != nil {
+		b.recordError("read", err)
+		return
+	}
+	if b.echo && n != int64(len(b.payload)) {
+		b.recordError("read", io.ErrUnexpectedEOF)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handshakes = append(b.handshakes, hsTime)
+	b.durations = append(b.durations, time.Since(start))
+}
+
+type benchConn interface {
+	io.ReadWriteCloser
+	CloseWrite() error
+	SetDeadline(time.Time) error
+}
+
+func (b *bench) dial(ctx context.Context) (benchConn, error) {
+	if b.quic {
+		conn, err := quic.Dial(ctx, "udp", b.target, b.tc, nil)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := conn.OpenStream()
+		if err != nil {
+			conn.CloseWithError(0, "")
+			return nil, err
+		}
+		return &quicConn{quicStream: stream, close: func() { conn.CloseWithError(0, "") }}, nil
+	}
+	d := &tls.Dialer{Config: b.tc}
+	conn, err := d.DialContext(ctx, "tcp", b.target)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*tls.Conn), nil
+}
+
+type quicStream interface {
+	io.ReadWriteCloser
+	SetDeadline(time.Time) error
+}
+
+type quicConn struct {
+	quicStream
+	close func()
+}
+
+func (c *quicConn) CloseWrite() error {
+	return c.quicStream.Close()
+}
+
+func (c *quicConn) Close() error {
+	c.close()
+	return nil
+}
+
+func (b *bench) recordError(stage string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.errors[stage+": "+errorClass(err)]++
+}
+
+// errorClass returns a short description of err without the addresses, so
+// that similar errors are grouped together.
+func errorClass(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		err = opErr.Err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return err.Error()
+}
+
+// percentile returns the p-th percentile of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+func (b *bench) report(w io.Writer, elapsed time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var numErrors int
+	for _, n := range b.errors {
+		numErrors += n
+	}
+	fmt.Fprintf(w, "Connections: %d ok, %d failed in %s (%.1f conn/s)\n",
+		len(b.durations), numErrors, elapsed.Truncate(time.Millisecond),
+		float64(len(b.durations))/elapsed.Seconds())
+
+	for _, s := range []struct {
+		name string
+		d    []time.Duration
+	}{
+		{"Handshake", b.handshakes},
+		{"Total", b.durations},
+	} {
+		if len(s.d) == 0 {
+			continue
+		}
+		slices.Sort(s.d)
+		fmt.Fprintf(w, "%-10s min %s, p50 %s, p90 %s, p99 %s, max %s\n", s.name+":",
+			s.d[0].Truncate(time.Microsecond),
+			percentile(s.d, 50).Truncate(time.Microsecond),
+			percentile(s.d, 90).Truncate(time.Microsecond),
+			percentile(s.d, 99).Truncate(time.Microsecond),
+			s.d[len(s.d)-1].Truncate(time.Microsecond))
+	}
+	sent, received := b.sent.Load(), b.received.Load()
+	fmt.Fprintf(w, "Throughput: sent %d bytes (%s/s), received %d bytes (%s/s)\n",
+		sent, formatBytes(float64(sent)/elapsed.Seconds()),
+		received, formatBytes(float64(received)/elapsed.Seconds()))
+
+	if numErrors == 0 {
+		return
+	}
+	keys := make([]string, 0, len(b.errors))
+	for k := range b.errors {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if b.errors[keys[i]] != b.errors[keys[j]] {
+			return b.errors[keys[i]] > b.errors[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	fmt.Fprintln(w, "Errors:")
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %6d %s\n", b.errors[k], k)
+	}
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
@@ -0,0 +1,115 @@
+// MIT License
+//
+// Copyright (c) 2025 TTBT Enterprises LLC
+// Copyright (c) 2025 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestBench(t *testing.T) {
+	cm, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cm.TLSConfig())
+	if err != nil {
+		t.Fatalf("tls.Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	payload, err := makePayload("text", 10000)
+	if err != nil {
+		t.Fatalf("makePayload: %v", err)
+	}
+	b := &bench{
+		target: l.Addr().String(),
+		tc: &tls.Config{
+			ServerName: "example.com",
+			RootCAs:    cm.RootCACertPool(),
+		},
+		timeout: 5 * time.Second,
+		payload: payload,
+		echo:    true,
+		errors:  make(map[string]int),
+	}
+	b.run(context.Background(), 5, 20)
+
+	if got, want := len(b.durations), 20; got != want {
+		t.Errorf("Connections = %d, want %d, errors: %v", got, want, b.errors)
+	}
+	if got, want := b.received.Load(), int64(20*len(payload)); got != want {
+		t.Errorf("Received = %d, want %d", got, want)
+	}
+	var out strings.Builder
+	b.report(&out, time.Second)
+	if !strings.Contains(out.String(), "Connections: 20 ok, 0 failed") {
+		t.Errorf("Unexpected report: %s", out.String())
+	}
+
+	b.tc.RootCAs = nil
+	b.durations = nil
+	b.run(context.Background(), 2, 4)
+	if got := len(b.durations); got != 0 {
+		t.Errorf("Connections = %d, want 0", got)
+	}
+	var numErrors int
+	for k, v := range b.errors {
+		if !strings.HasPrefix(k, "handshake: ") {
+			t.Errorf("Unexpected error %q", k)
+		}
+		numErrors += v
+	}
+	if numErrors != 4 {
+		t.Errorf("Errors = %d, want 4", numErrors)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	if got, want := errorClass(context.DeadlineExceeded), "timeout"; got != want {
+		t.Errorf("errorClass() = %q, want %q", got, want)
+	}
+	if got, want := errorClass(errors.New("foo")), "foo"; got != want {
+		t.Errorf("errorClass() = %q, want %q", got, want)
+	}
+}
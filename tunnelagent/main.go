@@ -0,0 +1,106 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Command tunnelagent connects to tlsproxy with a reverse tunnel and forwards
+// the connections that it receives through the tunnel to a local server.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/c2FmZQ/tlsproxy/revtunnel"
+)
+
+// Version is set with -ldflags="-X main.Version=${VERSION}"
+var Version = "dev"
+
+func main() {
+	versionFlag := flag.Bool("v", false, "Show the version.")
+	proxyAddr := flag.String("proxy", "", "The address of the proxy, e.g. proxy.example.com:443. The default is the server name on port 443.")
+	serverName := flag.String("servername", "", "The backend's server name.")
+	target := flag.String("target", "", "The address of the local server, e.g. localhost:8080.")
+	tokenFile := flag.String("token-file", "", "A file that contains the reverse tunnel token.")
+	key := flag.String("key", "", "A file that contains the TLS key to use.")
+	cert := flag.String("cert", "", "A file that contains the TLS certificate to use.")
+	rootCA := flag.String("root-ca", "", "A file that contains the root CA certificates of the proxy. The default is to use the system's root CAs.")
+	flag.Parse()
+
+	if *versionFlag {
+		os.Stdout.WriteString(Version + " " + runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH + "\n")
+		return
+	}
+	if *serverName == "" || *target == "" || *tokenFile == "" || (*key == "") != (*cert == "") {
+		os.Stderr.WriteString("Usage: tunnelagent -servername=<name> -target=<host:port> -token-file=<file> [-proxy=<host:port>] [-key=<keyfile> -cert=<certfile>] [-root-ca=<file>]\n")
+		os.Exit(1)
+	}
+	token, err := os.ReadFile(*tokenFile)
+	if err != nil {
+		log.Fatalf("ERR: %v", err)
+	}
+	if *proxyAddr == "" {
+		*proxyAddr = net.JoinHostPort(*serverName, "443")
+	}
+
+	tc := &tls.Config{}
+	if *key != "" && *cert != "" {
+		c, err := tls.LoadX509KeyPair(*cert, *key)
+		if err != nil {
+			log.Fatalf("ERR: %v", err)
+		}
+		tc.Certificates = append(tc.Certificates, c)
+	}
+	if *rootCA != "" {
+		b, err := os.ReadFile(*rootCA)
+		if err != nil {
+			log.Fatalf("ERR: %v", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(b) {
+			log.Fatalf("ERR: %s: no certificates", *rootCA)
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	agent := &revtunnel.Agent{
+		ProxyAddr:  *proxyAddr,
+		ServerName: *serverName,
+		Token:      strings.TrimSpace(string(token)),
+		Target:     *target,
+		TLSConfig:  tc,
+	}
+	if err := agent.Run(ctx); err != nil && ctx.Err() == nil {
+		log.Fatalf("ERR: %v", err)
+	}
+}